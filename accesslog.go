@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Access log has a line for every request with its method, path, status, latency, client IP and request ID.
+// The request ID is taken from the X-Request-ID header if it is valid, or generated, and returned in the
+// X-Request-ID response header. Payments created by a request keep its ID so checker log lines of the payment
+// can be found from the request. Query strings are not logged and tokens in paths are redacted, so tokens and
+// passwords never reach the log.
+
+const requestIDHeader = "X-Request-ID"
+
+// Access log formats.
+const (
+	accessLogText = "text"
+	accessLogJSON = "json"
+	accessLogOff  = "off"
+)
+
+// Request IDs from clients are accepted if they are short and safe to print in logs.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request r, or empty string if it is not set by accessLogMiddleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLogEntry is a line in access log.
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS int64     `json:"latencyMs"`
+	ClientIP  string    `json:"clientIp"`
+}
+
+func (e AccessLogEntry) String() string {
+	return fmt.Sprintf("%s %s %s %d %dms %s", e.RequestID, e.Method, e.Path, e.Status, e.LatencyMS, e.ClientIP)
+}
+
+type accessLogger struct {
+	format string
+	// Entries are written to the normal log if nil.
+	out io.Writer
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+var accessLog *accessLogger
+
+func newAccessLogger(format string, out io.Writer) *accessLogger {
+	return &accessLogger{format: format, out: out, now: time.Now}
+}
+
+// middleware sets the request ID and logs the request after it is served.
+// It must run after clientIPMiddleware so the client IP behind trusted proxies is logged.
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegexp.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		if l.format == accessLogOff {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := l.now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		l.write(AccessLogEntry{
+			Time:      start.UTC(),
+			RequestID: id,
+			Method:    r.Method,
+			Path:      redactPath(r.URL.Path),
+			Status:    rec.status,
+			LatencyMS: l.now().Sub(start).Milliseconds(),
+			ClientIP:  remoteIP(r),
+		})
+	})
+}
+
+func (l *accessLogger) write(e AccessLogEntry) {
+	line := e.String()
+	if l.format == accessLogJSON {
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		line = string(b)
+	}
+	if l.out == nil {
+		log.Infoln("access:", line)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.out, line+"\n"); err != nil {
+		log.Errorln("cannot write access log:", err)
+	}
+}
+
+// statusRecorder keeps the status of a response without its body.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush lets event streams through.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket upgrades through.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// logName returns the account of p with the ID of the request that created it, for checker log lines.
+func (p *Payment) logName() string {
+	if p.RequestID == "" {
+		return p.Account
+	}
+	return p.Account + " (request " + p.RequestID + ")"
+}
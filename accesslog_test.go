@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedDuration = -1
+	t.Cleanup(func() { config.AllowedDuration = 0 })
+	stopCheckLoops(t)
+	trusted, err := parseTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	logger := newAccessLogger(accessLogJSON, &out)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/pay", handlePay)
+	mux.HandleFunc("/api/verify", handleVerify)
+	h := clientIPMiddleware(trusted, logger.middleware(mux))
+	serve := func(r *http.Request) (*httptest.ResponseRecorder, AccessLogEntry) {
+		t.Helper()
+		out.Reset()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var e AccessLogEntry
+		if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+			t.Fatalf("invalid log line: %q", out.String())
+		}
+		return w, e
+	}
+
+	// Incoming request ID is propagated and stored on the payment.
+	r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(url.Values{"amount": {"1"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(requestIDHeader, "shop-checkout-42")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.RemoteAddr = "10.0.0.1:1234"
+	w, e := serve(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get(requestIDHeader) != "shop-checkout-42" || e.RequestID != "shop-checkout-42" {
+		t.Errorf("request ID is not propagated: %q %+v", w.Header().Get(requestIDHeader), e)
+	}
+	if e.Method != http.MethodPost || e.Path != "/api/pay" || e.Status != http.StatusOK || e.ClientIP != "203.0.113.7" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	var response Response
+	if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPayment([]byte(response.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RequestID != "shop-checkout-42" || p.logName() != p.Account+" (request shop-checkout-42)" {
+		t.Errorf("request ID is not saved: %q", p.logName())
+	}
+
+	// Invalid request ID is replaced and the query with the token is not logged.
+	r = httptest.NewRequest(http.MethodGet, "/api/verify?token="+url.QueryEscape(response.Token), nil)
+	r.Header.Set(requestIDHeader, "bad id\nINFO forged")
+	w, e = serve(r)
+	if id := w.Header().Get(requestIDHeader); !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) || e.RequestID != id {
+		t.Errorf("unexpected generated request ID: %q %q", id, e.RequestID)
+	}
+	if strings.Contains(out.String(), response.Token) || e.Path != "/api/verify" || e.ClientIP != "192.0.2.1" {
+		t.Errorf("unexpected entry: %s", out.String())
+	}
+
+	// Text format.
+	logger.format = accessLogText
+	out.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if !regexp.MustCompile(`^[0-9a-f]{16} GET /missing 404 \d+ms 192\.0\.2\.1\n$`).MatchString(out.String()) {
+		t.Errorf("unexpected text entry: %q", out.String())
+	}
+	// Request ID is still set when access log is off.
+	logger.format = accessLogOff
+	out.Reset()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if out.Len() != 0 || w.Header().Get(requestIDHeader) == "" {
+		t.Errorf("unexpected output with access log off: %q", out.String())
+	}
+
+	c := Config{AccessLogFormat: "xml"}
+	c.setDefaults()
+	if err = c.validate(); err == nil || !strings.Contains(err.Error(), "AccessLogFormat") {
+		t.Error("invalid AccessLogFormat is accepted")
+	}
+}
@@ -0,0 +1,120 @@
+// Package accounting converts payment transactions into double-entry records
+// and writes them in formats that accounting software can import.
+package accounting
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Kind of a Transaction.
+type Kind string
+
+const (
+	// Received is a verified payment from a customer.
+	Received Kind = "received"
+	// Swept is the transfer of received funds to the merchant account.
+	Swept Kind = "swept"
+	// Fee is the platform fee taken from received funds.
+	Fee Kind = "fee"
+	// Refunded is the transfer of funds back to the customer.
+	Refunded Kind = "refunded"
+	// WrittenOff is a received payment that is written off after a dispute.
+	WrittenOff Kind = "written_off"
+)
+
+// Transaction is a movement of funds related to a payment.
+type Transaction struct {
+	Kind      Kind
+	Date      time.Time
+	Amount    decimal.Decimal
+	Currency  string
+	Reference string
+	Memo      string
+	// Identifier of the payment that the transaction belongs to.
+	PaymentID string
+	// Optional fiat valuation columns.
+	FiatAmount       decimal.Decimal
+	FiatCurrency     string
+	Rate             decimal.NullDecimal
+	VerificationRate decimal.NullDecimal
+	// Where Rate comes from. Empty if there is no rate.
+	RateSource RateSource
+	// Versions of accept-nano and node software at the time of the transaction. Empty if unknown.
+	SoftwareVersion string
+	NodeVersion     string
+}
+
+// RateSource tells whether a rate was recorded at the time of payment or fetched later.
+type RateSource string
+
+const (
+	// Contemporaneous rate is recorded when the payment is created.
+	Contemporaneous RateSource = "contemporaneous"
+	// Backfilled rate is fetched from historical price data after the payment.
+	Backfilled RateSource = "backfilled"
+)
+
+// Accounts are the ledger account names used in entries.
+type Accounts struct {
+	// Asset account holding funds on payment accounts.
+	Deposits string
+	// Asset account of the merchant wallet.
+	Merchant string
+	// Income account for sales.
+	Revenue string
+	// Expense account for platform fees.
+	Fees string
+	// Contra-income account for refunds.
+	Refunds string
+	// Expense account for payments written off after disputes.
+	WrittenOff string
+}
+
+// Entry is a double-entry record.
+type Entry struct {
+	Transaction
+	Debit  string
+	Credit string
+}
+
+// mapping defines debit and credit accounts for each transaction kind.
+var mapping = map[Kind]func(a Accounts) (debit, credit string){
+	Received:   func(a Accounts) (string, string) { return a.Deposits, a.Revenue },
+	Swept:      func(a Accounts) (string, string) { return a.Merchant, a.Deposits },
+	Fee:        func(a Accounts) (string, string) { return a.Fees, a.Deposits },
+	Refunded:   func(a Accounts) (string, string) { return a.Refunds, a.Deposits },
+	WrittenOff: func(a Accounts) (string, string) { return a.WrittenOff, a.Revenue },
+}
+
+// Entries converts transactions to entries ordered by date.
+func Entries(txs []Transaction, accounts Accounts) ([]Entry, error) {
+	entries := make([]Entry, 0, len(txs))
+	for _, tx := range txs {
+		m, ok := mapping[tx.Kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown transaction kind: %q", tx.Kind)
+		}
+		debit, credit := m(accounts)
+		entries = append(entries, Entry{Transaction: tx, Debit: debit, Credit: credit})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+	return entries, nil
+}
+
+// Format writes entries in a specific file format.
+type Format interface {
+	ContentType() string
+	FileExtension() string
+	Write(w io.Writer, entries []Entry) error
+}
+
+// Formats contains all supported formats by name.
+var Formats = map[string]Format{
+	"csv": doubleEntryCSV{},
+	"qif": qif{},
+}
@@ -0,0 +1,114 @@
+package accounting
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+var testAccounts = Accounts{
+	Deposits:   "Assets:Nano:Deposits",
+	Merchant:   "Assets:Nano:Wallet",
+	Revenue:    "Income:Sales",
+	Fees:       "Expenses:Fees",
+	Refunds:    "Income:Refunds",
+	WrittenOff: "Expenses:WrittenOff",
+}
+
+func fixtureTransactions() []Transaction {
+	day := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	return []Transaction{
+		{
+			Kind:             Received,
+			Date:             day,
+			Amount:           decimal.RequireFromString("2.5"),
+			Currency:         "NANO",
+			Reference:        "nano_1payment1",
+			Memo:             "order-1",
+			PaymentID:        "0b5c3f0e-8f4b-4d0e-9a57-2f2d1c7e6a10",
+			FiatAmount:       decimal.RequireFromString("5"),
+			FiatCurrency:     "USD",
+			Rate:             decimal.NullDecimal{Decimal: decimal.RequireFromString("2"), Valid: true},
+			VerificationRate: decimal.NullDecimal{Decimal: decimal.RequireFromString("2.01"), Valid: true},
+			RateSource:       Contemporaneous,
+			SoftwareVersion:  "v1.2.0",
+			NodeVersion:      "Nano V21.3",
+		},
+		{Kind: Fee, Date: day.Add(time.Minute), Amount: decimal.RequireFromString("0.05"), Currency: "NANO", Reference: "nano_1payment1"},
+		{Kind: Swept, Date: day.Add(time.Minute), Amount: decimal.RequireFromString("2.45"), Currency: "NANO", Reference: "nano_1payment1"},
+		{
+			Kind:         Received,
+			Date:         day.Add(time.Hour),
+			Amount:       decimal.RequireFromString("1"),
+			Currency:     "NANO",
+			Reference:    "nano_1payment2",
+			FiatAmount:   decimal.RequireFromString("1.9"),
+			FiatCurrency: "USD",
+			Rate:         decimal.NullDecimal{Decimal: decimal.RequireFromString("1.9"), Valid: true},
+			RateSource:   Backfilled,
+		},
+		{Kind: Refunded, Date: day.Add(2 * time.Hour), Amount: decimal.RequireFromString("1"), Currency: "NANO", Reference: "nano_1payment2"},
+		{Kind: WrittenOff, Date: day.Add(3 * time.Hour), Amount: decimal.RequireFromString("0.5"), Currency: "NANO", Reference: "nano_1payment3", Memo: "dispute"},
+	}
+}
+
+func TestEntries(t *testing.T) {
+	entries, err := Entries(fixtureTransactions(), testAccounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ debit, credit string }{
+		{"Assets:Nano:Deposits", "Income:Sales"},
+		{"Expenses:Fees", "Assets:Nano:Deposits"},
+		{"Assets:Nano:Wallet", "Assets:Nano:Deposits"},
+		{"Assets:Nano:Deposits", "Income:Sales"},
+		{"Income:Refunds", "Assets:Nano:Deposits"},
+		{"Expenses:WrittenOff", "Income:Sales"},
+	}
+	for i, e := range entries {
+		if e.Debit != expected[i].debit || e.Credit != expected[i].credit {
+			t.Errorf("entry %d: got %s/%s, expected %s/%s", i, e.Debit, e.Credit, expected[i].debit, expected[i].credit)
+		}
+	}
+	_, err = Entries([]Transaction{{Kind: "unknown"}}, testAccounts)
+	if err == nil {
+		t.Error("expected error for unknown kind")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	entries, err := Entries(fixtureTransactions(), testAccounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, format := range Formats {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := format.Write(&buf, entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "export."+format.FileExtension()+".golden")
+			if *update {
+				err = ioutil.WriteFile(golden, buf.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), expected) {
+				t.Errorf("output does not match %s:\n%s", golden, buf.String())
+			}
+		})
+	}
+}
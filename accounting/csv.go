@@ -0,0 +1,58 @@
+package accounting
+
+import (
+	"encoding/csv"
+	"io"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// doubleEntryCSV writes one row per entry with debit and credit account columns.
+type doubleEntryCSV struct{}
+
+func (doubleEntryCSV) ContentType() string   { return "text/csv; charset=utf-8" }
+func (doubleEntryCSV) FileExtension() string { return "csv" }
+
+func (doubleEntryCSV) Write(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"date", "debit_account", "credit_account", "amount", "currency", "reference", "memo", "fiat_amount", "fiat_currency", "rate", "verification_rate", "rate_source", "payment_id", "software_version", "node_version"})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var fiatAmount string
+		if e.FiatCurrency != "" {
+			fiatAmount = e.FiatAmount.String()
+		}
+		err = cw.Write([]string{
+			e.Date.UTC().Format(time.RFC3339),
+			e.Debit,
+			e.Credit,
+			e.Amount.String(),
+			e.Currency,
+			e.Reference,
+			e.Memo,
+			fiatAmount,
+			e.FiatCurrency,
+			nullDecimalString(e.Rate),
+			nullDecimalString(e.VerificationRate),
+			string(e.RateSource),
+			e.PaymentID,
+			e.SoftwareVersion,
+			e.NodeVersion,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func nullDecimalString(d decimal.NullDecimal) string {
+	if !d.Valid {
+		return ""
+	}
+	return d.Decimal.String()
+}
@@ -0,0 +1,44 @@
+package accounting
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// qif writes entries in Quicken Interchange Format.
+// Entries are grouped under their debit account and the credit account is written as the category.
+type qif struct{}
+
+func (qif) ContentType() string   { return "application/qif" }
+func (qif) FileExtension() string { return "qif" }
+
+func (qif) Write(w io.Writer, entries []Entry) error {
+	var accounts []string
+	byAccount := make(map[string][]Entry)
+	for _, e := range entries {
+		if _, ok := byAccount[e.Debit]; !ok {
+			accounts = append(accounts, e.Debit)
+		}
+		byAccount[e.Debit] = append(byAccount[e.Debit], e)
+	}
+	bw := bufio.NewWriter(w)
+	for _, account := range accounts {
+		fmt.Fprintf(bw, "!Account\nN%s\nTBank\n^\n!Type:Bank\n", account)
+		for _, e := range byAccount[account] {
+			fmt.Fprintf(bw, "D%s\n", e.Date.UTC().Format("01/02/2006"))
+			fmt.Fprintf(bw, "T%s\n", e.Amount.String())
+			if e.Reference != "" {
+				fmt.Fprintf(bw, "N%s\n", e.Reference)
+			}
+			memo := e.Currency
+			if e.Memo != "" {
+				memo += " " + e.Memo
+			}
+			fmt.Fprintf(bw, "M%s\n", memo)
+			fmt.Fprintf(bw, "L%s\n", e.Credit)
+			fmt.Fprint(bw, "^\n")
+		}
+	}
+	return bw.Flush()
+}
@@ -10,27 +10,39 @@ import (
 
 const adminName = "admin"
 
-func handleAdminGetActivePayments(w http.ResponseWriter, r *http.Request) {
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return
+// adminHandler wraps h with HTTP basic auth check for admin endpoints.
+func adminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if adminAuthBlocked(r.Context(), ip) {
+			recordAudit(r, http.StatusTooManyRequests, auditOutcomeRateLimited)
+			http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			recordAudit(r, http.StatusUnauthorized, auditOutcomeDenied)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !validAdminCredentials(username, password) {
+			recordAdminAuthFailure(r.Context(), ip)
+			recordAudit(r, http.StatusForbidden, auditOutcomeDenied)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		rec := &auditRecorder{ResponseWriter: w}
+		h(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		recordAudit(r, rec.status, auditOutcome(rec.status))
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return
-	}
-	payments, err := LoadActivePayments()
-	if err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	b, err := json.MarshalIndent(&payments, "", "  ")
+}
+
+// writeAdminJSON writes v as indented JSON to w.
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -42,21 +54,41 @@ func handleAdminGetActivePayments(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleAdminGetPayment(w http.ResponseWriter, r *http.Request) {
-	username, password, ok := r.BasicAuth()
+// handleAdminGetActivePayments returns payments that are not finished.
+// They can be filtered by tag, by merchant and by metadata with metadata_key and metadata_value parameters.
+func handleAdminGetActivePayments(w http.ResponseWriter, r *http.Request) {
+	filter, ok := requestMetadataFilter(r)
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		http.Error(w, "metadata_key and metadata_value must be set together", http.StatusBadRequest)
 		return
 	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	payments, err := LoadActivePayments()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tag := r.FormValue("tag")
+	ret := payments[:0]
+	for _, p := range payments {
+		if filter.match(p) && (tag == "" || stringInSlice(tag, p.Tags)) {
+			ret = append(ret, p)
+		}
+	}
+	writeAdminJSON(w, ret)
+}
+
+func handleAdminGetPayment(w http.ResponseWriter, r *http.Request) {
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	account := r.FormValue("account")
 	if account == "" {
 		http.Error(w, "invalid account", http.StatusBadRequest)
 		return
@@ -72,16 +104,9 @@ func handleAdminGetPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
-	if err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	_, err = w.Write(b)
-	if err != nil {
-		log.Debug(err)
-	}
+	// Transitions that are not saved yet, such as expiry, are shown too.
+	payment.syncHistory()
+	writeAdminJSON(w, payment)
 }
 
 func handleAdminCheckPayment(w http.ResponseWriter, r *http.Request) {
@@ -89,20 +114,16 @@ func handleAdminCheckPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST only", http.StatusMethodNotAllowed)
 		return
 	}
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	account := r.FormValue("account")
 	if account == "" {
 		http.Error(w, "invalid account", http.StatusBadRequest)
 		return
@@ -120,29 +141,24 @@ func handleAdminCheckPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = payment.check()
-	if err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if payment.Imported {
+		writeError(w, errCodePaymentImported, http.StatusConflict, errPaymentImported.Error())
 		return
 	}
-	payment.LastCheckedAt = now()
-	err = payment.Save()
+	err = payment.check()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
+	payment.checked()
+	err = payment.Save()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = w.Write(b)
-	if err != nil {
-		log.Debug(err)
-	}
+	writeAdminJSON(w, payment)
 }
 
 func handleAdminReceivePending(w http.ResponseWriter, r *http.Request) {
@@ -150,20 +166,16 @@ func handleAdminReceivePending(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST only", http.StatusMethodNotAllowed)
 		return
 	}
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	account := r.FormValue("account")
 	if account == "" {
 		http.Error(w, "invalid account", http.StatusBadRequest)
 		return
@@ -181,6 +193,13 @@ func handleAdminReceivePending(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if payment.Imported {
+		writeError(w, errCodePaymentImported, http.StatusConflict, errPaymentImported.Error())
+		return
+	}
+	if !requireOwnership(w, r, "receive", payment) {
+		return
+	}
 	payment.ReceivedAt = nil
 	err = payment.Save()
 	if err != nil {
@@ -195,22 +214,13 @@ func handleAdminReceivePending(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	payment.ReceivedAt = now()
-	err = payment.Save()
+	err = payment.saveMilestone()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
-	if err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	_, err = w.Write(b)
-	if err != nil {
-		log.Debug(err)
-	}
+	writeAdminJSON(w, payment)
 }
 
 func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
@@ -218,20 +228,16 @@ func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST only", http.StatusMethodNotAllowed)
 		return
 	}
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	account := r.FormValue("account")
 	if account == "" {
 		http.Error(w, "invalid account", http.StatusBadRequest)
 		return
@@ -249,6 +255,21 @@ func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if payment.Imported {
+		writeError(w, errCodePaymentImported, http.StatusConflict, errPaymentImported.Error())
+		return
+	}
+	if payment.disputed() {
+		http.Error(w, errPaymentDisputed.Error(), http.StatusConflict)
+		return
+	}
+	if !config.sweepEnabled() {
+		http.Error(w, errSweepDisabled.Error(), http.StatusConflict)
+		return
+	}
+	if !requireOwnership(w, r, "send", payment) {
+		return
+	}
 	payment.SentAt = nil
 	err = payment.Save()
 	if err != nil {
@@ -267,20 +288,55 @@ func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	payment.SentAt = now()
-	err = payment.Save()
+	err = payment.saveMilestone()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
+	writeAdminJSON(w, payment)
+}
+
+// handleAdminApproveSweep allows sending funds of a payment created with a stale price.
+// Funds are sent on the next check. If the payment is already expired, use /admin/send instead.
+func handleAdminApproveSweep(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = w.Write(b)
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		log.Debugln("account not found:", account)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Debug(err)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payment.SweepApprovedAt = now()
+	err = payment.Save()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	writeAdminJSON(w, payment)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// New payments are admitted by the load of the check scheduler.
+// Over the soft threshold payments are created with a warning and clients are asked to poll less often.
+// Over the hard threshold /api/pay is refused, because checks of new payments would run too late for customers waiting on them.
+
+// Admission decisions, also keys of pay_admission_total metric.
+const (
+	admissionAccepted = "accepted"
+	admissionDegraded = "degraded"
+	admissionQueued   = "queued"
+	admissionRejected = "rejected"
+)
+
+const admissionMessage = "Payment confirmations may be delayed because of high load."
+
+var metricPayAdmission = expvar.NewMap("pay_admission_total")
+
+// over returns true if h reaches queue percent of workers or lag seconds. Zero thresholds are disabled.
+func (h schedulerHealth) over(queue, lag int) bool {
+	if queue > 0 && h.Workers > 0 && h.QueueDepth*100 >= queue*h.Workers {
+		return true
+	}
+	return lag > 0 && h.MedianLag >= time.Duration(lag)*time.Second
+}
+
+// admitPayment returns the admission decision for a new payment created with apiKey.
+func admitPayment(apiKey APIKey) string {
+	decision := admissionAccepted
+	if checks != nil {
+		h := checks.health(clock.Now())
+		switch {
+		case h.over(config.AdmissionHardQueue, config.AdmissionHardLag):
+			if apiKey.NonInteractive && config.AdmissionQueueNonInteractive {
+				decision = admissionQueued
+			} else {
+				decision = admissionRejected
+			}
+		case h.over(config.AdmissionSoftQueue, config.AdmissionSoftLag):
+			decision = admissionDegraded
+		}
+		if decision != admissionAccepted {
+			log.Debugf("payment %s: %d checks queued on %d workers, median lag %s", decision, h.QueueDepth, h.Workers, h.MedianLag)
+		}
+	}
+	metricPayAdmission.Add(decision, 1)
+	return decision
+}
+
+// applyAdmission sets the warning of a payment created over the soft threshold to response.
+func applyAdmission(response *Response, decision string) {
+	if decision == admissionAccepted {
+		return
+	}
+	if response.ServiceStatus == "" {
+		response.ServiceStatus = serviceStatusDegraded
+		response.ServiceMessage = admissionMessage
+	}
+	response.SuggestedClientPollSeconds = config.AdmissionPollSeconds
+}
+
+func writeBackloggedError(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(config.AdmissionRetryAfter))
+	writeError(w, errCodeCheckingBacklogged, http.StatusServiceUnavailable, "payment checks are backlogged, try again later")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stopCheckLoops stops the check loops started by the test before the cleanups registered earlier
+// restore the config and clock they read.
+func stopCheckLoops(t *testing.T) {
+	t.Cleanup(func() {
+		close(stopCheckPayments)
+		checkPaymentWG.Wait()
+		stopCheckPayments = make(chan struct{})
+	})
+}
+
+func TestPayAdmission(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	c := useFakeClock(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.AllowedDuration = -1
+	config.AdmissionSoftQueue, config.AdmissionHardQueue = 100, 300
+	config.AdmissionSoftLag = 30
+	config.AdmissionQueueNonInteractive = true
+	config.APIKeys = map[string]APIKey{"backend-key": {NonInteractive: true}}
+	old := checks
+	checks = newCheckScheduler(1, 0.8)
+	t.Cleanup(func() {
+		checks = old
+		config.AllowedDuration = 0
+		config.AdmissionSoftQueue, config.AdmissionHardQueue, config.AdmissionSoftLag = 0, 0, 0
+		config.AdmissionQueueNonInteractive = false
+		config.APIKeys = nil
+	})
+	stopCheckLoops(t)
+	pay := func(key string) (*httptest.ResponseRecorder, Response) {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(url.Values{"amount": {"1"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		var response Response
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, response
+	}
+	queued := func(n int) {
+		for checks.health(c.Now()).QueueDepth != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Single worker is busy, jobs wait in the queue.
+	release := make(chan struct{})
+	jobs := make(chan struct{}, 4)
+	for i := 0; i < 4; i++ {
+		go checks.run(laneDefault, func() {
+			<-release
+			jobs <- struct{}{}
+		})
+	}
+	queued(3)
+	if w, _ := pay(""); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("payment is not refused over hard threshold: %d %s", w.Code, w.Body)
+	} else {
+		expectErrorCode(t, w, http.StatusServiceUnavailable, errCodeCheckingBacklogged)
+	}
+	if w, r := pay("backend-key"); w.Code != http.StatusOK || r.ServiceStatus != serviceStatusDegraded || r.SuggestedClientPollSeconds != 10 {
+		t.Fatalf("non-interactive payment is not queued: %d %s", w.Code, w.Body)
+	}
+
+	// Below hard threshold payments are accepted with a warning.
+	release <- struct{}{}
+	<-jobs
+	queued(2)
+	if w, r := pay(""); w.Code != http.StatusOK || r.ServiceStatus != serviceStatusDegraded || r.ServiceMessage == "" || r.SuggestedClientPollSeconds != 10 {
+		t.Fatalf("payment is not degraded over soft threshold: %d %s", w.Code, w.Body)
+	}
+
+	// Half of the jobs waited long enough to hold the median lag over the soft threshold after the queue drains.
+	c.Add(time.Minute / 2)
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+		<-jobs
+	}
+	queued(0)
+	if h := checks.health(c.Now()); h.MedianLag < 30*time.Second {
+		t.Fatalf("lag is not recorded: %+v", h)
+	}
+	if _, r := pay(""); r.ServiceStatus != serviceStatusDegraded {
+		t.Fatalf("payment is not degraded over soft lag: %+v", r)
+	}
+
+	// Recovers when the lag samples get old.
+	c.Add(2 * lagWindow)
+	if w, r := pay(""); w.Code != http.StatusOK || r.ServiceStatus != "" || r.SuggestedClientPollSeconds != 0 {
+		t.Fatalf("payment is degraded after recovery: %d %s", w.Code, w.Body)
+	}
+	if metricPayAdmission.Get(admissionRejected).String() == "0" || metricPayAdmission.Get(admissionQueued) == nil {
+		t.Errorf("admission decisions are not counted: %s", metricPayAdmission)
+	}
+}
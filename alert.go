@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+const alertTimeout = 10 * time.Second
+
+var alertClient = &http.Client{Timeout: alertTimeout}
+
+// Alert is posted to AlertURL in JSON format to notify the operator.
+type Alert struct {
+	Kind    string                 `json:"kind"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// sendAlert logs the alert and posts it to AlertURL in background.
+// Alerts raised in a maintenance window are recorded but not posted.
+func sendAlert(kind, message string, details map[string]interface{}) {
+	alert := Alert{
+		Kind:    kind,
+		Message: message,
+		Details: details,
+		Time:    clock.Now(),
+	}
+	if maintenance.suppress(alert) {
+		log.Noticef("alert suppressed in maintenance window: %s: %s", kind, message)
+		return
+	}
+	log.Warningf("alert: %s: %s", kind, message)
+	if config.AlertURL == "" {
+		return
+	}
+	go postAlert(&alert)
+}
+
+func postAlert(alert *Alert) {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		log.Errorln("cannot marshal alert:", err)
+		return
+	}
+	resp, err := alertClient.Post(config.AlertURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Errorln("cannot send alert:", err)
+		return
+	}
+	defer func() {
+		if err2 := resp.Body.Close(); err2 != nil {
+			log.Debug(err2)
+		}
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Errorln("bad alert response:", resp.Status)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"go.etcd.io/bbolt"
+)
+
+// Amounts in currency are kept at a canonical scale, so "10" and "10.00" USD are stored,
+// compared and emitted the same way. Decimals must be compared with Cmp or Equal;
+// struct equality depends on the internal exponent.
+
+// defaultCurrencyDigits is used for currencies not in currencyDigits.
+const defaultCurrencyDigits = 2
+
+// currencyDigits are the fraction digits of currencies that do not have 2 (ISO 4217 minor units).
+var currencyDigits = map[string]int32{
+	// Amounts in NANO have no fixed scale. Trailing zeros are removed.
+	"BCB": 0,
+	"BIF": 0,
+	"CLP": 0,
+	"DJF": 0,
+	"GNF": 0,
+	"ISK": 0,
+	"JPY": 0,
+	"KMF": 0,
+	"KRW": 0,
+	"PYG": 0,
+	"RWF": 0,
+	"UGX": 0,
+	"VND": 0,
+	"VUV": 0,
+	"XAF": 0,
+	"XOF": 0,
+	"XPF": 0,
+	"BHD": 3,
+	"IQD": 3,
+	"JOD": 3,
+	"KWD": 3,
+	"LYD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"BTC": 8,
+}
+
+var errAmountExponent = errors.New("amount must not be in exponent form")
+
+// parseAmount parses an amount given by a client. Exponent forms like "1e3" are rejected
+// because they are not used by any currency and hide the scale of the amount.
+func parseAmount(s string) (decimal.Decimal, error) {
+	if strings.ContainsAny(s, "eE") {
+		return decimal.Decimal{}, errAmountExponent
+	}
+	return decimal.NewFromString(s)
+}
+
+// parseRawAmount parses an amount in raw given by a client with unit=raw.
+func parseRawAmount(s string) (decimal.Decimal, error) {
+	raw, err := parseAmount(s)
+	if err != nil {
+		return raw, err
+	}
+	return raw, validateRaw(raw)
+}
+
+// paymentLimits returns MinPayment and MaxPayment in NANO, nil if they are not set.
+func (c *Config) paymentLimits() (min, max *decimal.Decimal, err error) {
+	parse := func(name, s string) (*decimal.Decimal, error) {
+		if s == "" {
+			return nil, nil
+		}
+		d, err := decimal.NewFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if d.IsNegative() {
+			return nil, fmt.Errorf("%s cannot be negative", name)
+		}
+		return &d, nil
+	}
+	if min, err = parse("MinPayment", c.MinPayment); err != nil {
+		return
+	}
+	max, err = parse("MaxPayment", c.MaxPayment)
+	return
+}
+
+// checkPaymentLimits returns an error with the amount if amount in NANO is outside MinPayment and MaxPayment.
+func checkPaymentLimits(amount decimal.Decimal) error {
+	min, max, _ := config.paymentLimits()
+	if min != nil && amount.LessThan(*min) {
+		return fmt.Errorf("amount %s NANO is below the minimum of %s NANO", amount, min)
+	}
+	if max != nil && amount.GreaterThan(*max) {
+		return fmt.Errorf("amount %s NANO is above the maximum of %s NANO", amount, max)
+	}
+	return nil
+}
+
+// fractionDigits returns the number of fraction digits of currency.
+func fractionDigits(currency string) int32 {
+	if currency == "" {
+		currency = "BCB"
+	}
+	if digits, ok := currencyDigits[strings.ToUpper(currency)]; ok {
+		return digits
+	}
+	return defaultCurrencyDigits
+}
+
+// validCurrency returns true if currency looks like a currency code, 3 to 5 letters.
+func validCurrency(currency string) bool {
+	if len(currency) < 3 || len(currency) > 5 {
+		return false
+	}
+	for _, c := range currency {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// CurrencyAmount is an amount in a currency at the canonical scale of the currency.
+// It is encoded with all digits of its scale, e.g. "10.00" for USD.
+type CurrencyAmount struct {
+	decimal.Decimal
+}
+
+// NewCurrencyAmount returns d at the scale of currency's fraction digits.
+// More fraction digits are kept if d has significant digits beyond the scale, so the value never changes.
+func NewCurrencyAmount(d decimal.Decimal, currency string) CurrencyAmount {
+	d = trimZeros(d)
+	if digits := fractionDigits(currency); -d.Exponent() < digits {
+		d = d.Round(digits)
+	}
+	return CurrencyAmount{d}
+}
+
+// trimZeros removes trailing zeros of the fraction and makes the exponent of integers zero.
+func trimZeros(d decimal.Decimal) decimal.Decimal {
+	if d.Exponent() >= 0 {
+		return d.Round(0)
+	}
+	coef, exp := d.Coefficient(), d.Exponent()
+	ten, rem := big.NewInt(10), new(big.Int)
+	for exp < 0 {
+		q, r := new(big.Int).QuoRem(coef, ten, rem)
+		if r.Sign() != 0 {
+			break
+		}
+		coef = q
+		exp++
+	}
+	return decimal.NewFromBigInt(coef, exp)
+}
+
+// String returns the amount with all digits of its scale.
+func (a CurrencyAmount) String() string {
+	if exp := a.Exponent(); exp < 0 {
+		return a.StringFixed(-exp)
+	}
+	return a.Decimal.String()
+}
+
+// MarshalJSON encodes the amount as a string like decimal.Decimal does, but keeps trailing zeros.
+func (a CurrencyAmount) MarshalJSON() ([]byte, error) {
+	if decimal.MarshalJSONWithoutQuotes {
+		return []byte(a.String()), nil
+	}
+	return []byte(`"` + a.String() + `"`), nil
+}
+
+// normalizeAmounts converts the amount in currency to its canonical scale. Returns true if it is changed.
+func (p *Payment) normalizeAmounts() bool {
+	a := NewCurrencyAmount(p.AmountInCurrency.Decimal, p.Currency)
+	if a.Exponent() == p.AmountInCurrency.Exponent() {
+		return false
+	}
+	p.AmountInCurrency = a
+	return true
+}
+
+// migrateAmountScale rewrites payments saved before amounts were kept at the scale of their currency.
+func migrateAmountScale(tx *bbolt.Tx) error {
+	n, err := rewritePayments(tx, (*Payment).normalizeAmounts)
+	if n > 0 {
+		log.Infof("normalized amounts of %d payments", n)
+	}
+	return err
+}
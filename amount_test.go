@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"go.etcd.io/bbolt"
+)
+
+func TestCurrencyAmount(t *testing.T) {
+	cases := []struct {
+		input    string
+		currency string
+		expected string
+	}{
+		{"10", "USD", "10.00"},
+		{"10.00", "USD", "10.00"},
+		{"10.000", "usd", "10.00"},
+		{"10.5", "EUR", "10.50"},
+		{"10.005", "USD", "10.005"},
+		{"1000", "JPY", "1000"},
+		{"1000.00", "JPY", "1000"},
+		{"1.5", "KWD", "1.500"},
+		{"0", "USD", "0.00"},
+		{"2.50", "BCB", "2.5"},
+		{"2.50", "", "2.5"},
+		{"100", "BCB", "100"},
+	}
+	for _, c := range cases {
+		t.Run(c.input+" "+c.currency, func(t *testing.T) {
+			d, err := parseAmount(c.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := NewCurrencyAmount(d, c.currency)
+			if a.String() != c.expected {
+				t.Fatalf("got %s, expected %s", a, c.expected)
+			}
+			b, err := json.Marshal(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != `"`+c.expected+`"` {
+				t.Fatalf("encoded as %s", b)
+			}
+			var decoded CurrencyAmount
+			if err = json.Unmarshal(b, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Exponent() != a.Exponent() || !decoded.Equal(a.Decimal) {
+				t.Fatalf("round trip changed %s to %s", a, decoded)
+			}
+		})
+	}
+}
+
+func TestParseAmountRejectsExponent(t *testing.T) {
+	for _, s := range []string{"1e3", "1E3", "1.5e-2"} {
+		if _, err := parseAmount(s); err != errAmountExponent {
+			t.Errorf("%s is accepted: %v", s, err)
+		}
+	}
+}
+
+func TestAmountsCompareAcrossScales(t *testing.T) {
+	openTestDB(t, 0)
+	for _, s := range []string{"10", "10.00"} {
+		d := decimal.RequireFromString(s)
+		p := &Payment{Account: "nano_1amount" + s, Currency: "USD", AmountInCurrency: CurrencyAmount{d}}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var loaded []*Payment
+	err := forEachPayment(func(p *Payment) error {
+		loaded = append(loaded, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("loaded %d payments", len(loaded))
+	}
+	a, b := loaded[0].AmountInCurrency, loaded[1].AmountInCurrency
+	if a.Exponent() != b.Exponent() || a.String() != b.String() || a.Cmp(b.Decimal) != 0 {
+		t.Fatalf("loaded amounts differ: %s, %s", a, b)
+	}
+
+	// Fiat impact of payments is summed by currency in slippage stats.
+	stats := newSlippageStats()
+	for _, p := range loaded {
+		p.Amount = NanoToRaw(decimal.NewFromInt(5))
+		p.VerificationPrice = decimal.NullDecimal{Decimal: decimal.NewFromInt(3), Valid: true}
+		p.PriceSlippagePercent = decimal.NullDecimal{Decimal: decimal.Zero, Valid: true}
+		stats.add(p)
+	}
+	if impact := stats.FiatImpact["USD"]; !impact.Equal(decimal.NewFromInt(10)) {
+		t.Fatalf("unexpected fiat impact: %s", impact)
+	}
+}
+
+func TestMigrateAmountScale(t *testing.T) {
+	openTestDB(t, 0)
+	err := dbUpdate(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(paymentsBucket)).Put([]byte("nano_1old"), []byte(`{"account":"nano_1old","currency":"USD","amountInCurrency":"10"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dbUpdate(migrateAmountScale); err != nil {
+		t.Fatal(err)
+	}
+	err = dbView(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte(paymentsBucket)).Get([]byte("nano_1old")); !strings.Contains(string(v), `"amountInCurrency":"10.00"`) {
+			t.Fatalf("amount is not normalized: %s", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayAmountUnitAndLimits(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedDuration = -1
+	config.MinPayment, config.MaxPayment = "0.01", "1000"
+	t.Cleanup(func() {
+		config.AllowedDuration = 0
+		config.MinPayment, config.MaxPayment = "", ""
+	})
+	stopCheckLoops(t)
+	pay := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+
+	// Raw amounts are not rounded.
+	w := pay("amount=12345678901234567890123456789&unit=raw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+	}
+	var resp Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(resp.URI, "amount=12345678901234567890123456789") || resp.Amount.String() != "1.2345678901234567890123456789" {
+		t.Errorf("unexpected amount: %s %s", resp.URI, resp.Amount)
+	}
+
+	for _, body := range []string{"amount=1.5&unit=raw", "amount=-1&unit=raw", "amount=1e30&unit=raw"} {
+		expectErrorCode(t, pay(body), http.StatusBadRequest, errCodeInvalidAmount)
+	}
+	expectErrorCode(t, pay("amount=1&unit=xrb"), http.StatusBadRequest, errCodeInvalidUnit)
+	expectErrorCode(t, pay("amount=1&unit=raw&currency=USD"), http.StatusBadRequest, errCodeInvalidUnit)
+
+	// Amount in the message is the converted amount.
+	w = pay("amount=1&unit=raw")
+	expectErrorCode(t, w, http.StatusBadRequest, errCodeAmountOutOfRange)
+	if !strings.Contains(w.Body.String(), "0.0000000000000000000000000001 NANO") {
+		t.Errorf("amount is not in the message: %s", w.Body)
+	}
+	expectErrorCode(t, pay("amount=10000"), http.StatusBadRequest, errCodeAmountOutOfRange)
+
+	config.MinPayment = "1001"
+	if config.validate() == nil {
+		t.Error("MinPayment greater than MaxPayment is accepted")
+	}
+}
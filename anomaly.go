@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Signals watched by the anomaly detector. Each is counted per minute and compared with its moving baseline.
+const (
+	// Payments created, by fingerprint of the API key.
+	anomalyPaymentCreations = "payment_creations"
+	// Prices fetched from a provider after the preferred one failed.
+	anomalyPriceFailovers = "price_failovers"
+	// Blocks rejected by the node.
+	anomalyPublishRejections = "publish_rejections"
+)
+
+const (
+	anomalyInterval = time.Minute
+	// Weight of the last interval in the baseline.
+	anomalyBaselineWeight = 0.1
+	// Intervals counted before the baseline is used.
+	anomalyWarmupIntervals = 10
+	// Recent detections kept for /admin/anomalies.
+	anomalyHistorySize = 100
+)
+
+// Anomaly is a signal that exceeded AnomalyThreshold times its baseline.
+type Anomaly struct {
+	Signal string `json:"signal"`
+	// Fingerprint of the API key for payment_creations.
+	Key        string    `json:"key,omitempty"`
+	DetectedAt time.Time `json:"detectedAt"`
+	// Events in the last interval.
+	Count    float64 `json:"count"`
+	Baseline float64 `json:"baseline"`
+	// Ratio of Count to Baseline.
+	Multiple float64 `json:"multiple"`
+}
+
+type anomalyKey struct {
+	signal, key string
+}
+
+// anomalySeries is the moving baseline of a signal.
+type anomalySeries struct {
+	baseline  float64
+	intervals int
+	firedAt   time.Time
+}
+
+// anomalyDetector counts events of signals and fires an alert when an interval is far above the baseline.
+type anomalyDetector struct {
+	now    func() time.Time
+	notify func(kind, message string, details map[string]interface{})
+
+	m          sync.Mutex
+	counts     map[anomalyKey]float64
+	series     map[anomalyKey]*anomalySeries
+	detections []Anomaly
+}
+
+var anomalies = &anomalyDetector{
+	now:    clockNow,
+	notify: sendAlert,
+}
+
+func (d *anomalyDetector) enabled() bool { return config.AnomalyThreshold > 0 }
+
+// record counts an event of signal. key separates the series of a signal, it is empty for global signals.
+func (d *anomalyDetector) record(signal, key string) {
+	if !d.enabled() {
+		return
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.counts == nil {
+		d.counts = make(map[anomalyKey]float64)
+	}
+	d.counts[anomalyKey{signal, key}]++
+}
+
+// evaluate closes the current interval, fires alerts for anomalous signals and updates the baselines.
+func (d *anomalyDetector) evaluate() {
+	d.m.Lock()
+	defer d.m.Unlock()
+	now := d.now()
+	if d.series == nil {
+		d.series = make(map[anomalyKey]*anomalySeries)
+	}
+	for k := range d.counts {
+		if d.series[k] == nil {
+			d.series[k] = &anomalySeries{}
+		}
+	}
+	for k, s := range d.series {
+		count := d.counts[k]
+		if s.intervals >= anomalyWarmupIntervals && count >= float64(config.AnomalyMinCount) &&
+			count > s.baseline*config.AnomalyThreshold && now.Sub(s.firedAt) >= time.Duration(config.AnomalyCooldown)*time.Second {
+			s.firedAt = now
+			d.fire(Anomaly{Signal: k.signal, Key: k.key, DetectedAt: now, Count: count, Baseline: s.baseline, Multiple: multiple(count, s.baseline)})
+		}
+		if s.intervals == 0 {
+			s.baseline = count
+		} else {
+			s.baseline = anomalyBaselineWeight*count + (1-anomalyBaselineWeight)*s.baseline
+		}
+		s.intervals++
+		// Series of a key that stopped sending events is forgotten.
+		if count == 0 && s.baseline < 0.01 && now.Sub(s.firedAt) >= time.Duration(config.AnomalyCooldown)*time.Second {
+			delete(d.series, k)
+		}
+	}
+	d.counts = nil
+}
+
+func multiple(count, baseline float64) float64 {
+	if baseline == 0 {
+		return 0
+	}
+	return count / baseline
+}
+
+func (d *anomalyDetector) fire(a Anomaly) {
+	d.detections = append(d.detections, a)
+	if len(d.detections) > anomalyHistorySize {
+		d.detections = d.detections[len(d.detections)-anomalyHistorySize:]
+	}
+	message := fmt.Sprintf("%s is %.0f in the last minute, baseline is %.1f", a.Signal, a.Count, a.Baseline)
+	if a.Key != "" {
+		message += " for " + a.Key
+	}
+	log.Warningln("anomaly:", message)
+	d.notify("anomaly_"+a.Signal, message, map[string]interface{}{
+		"key":      a.Key,
+		"count":    a.Count,
+		"baseline": a.Baseline,
+	})
+}
+
+// Detections returns recent detections, the latest first.
+func (d *anomalyDetector) Detections() []Anomaly {
+	d.m.Lock()
+	defer d.m.Unlock()
+	ret := append([]Anomaly{}, d.detections...)
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].DetectedAt.After(ret[j].DetectedAt) })
+	return ret
+}
+
+func handleAdminAnomalies(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, anomalies.Detections())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	config.setDefaults()
+	config.AnomalyThreshold = 3
+	t.Cleanup(func() { config.AnomalyThreshold = 0 })
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	var alerts []string
+	d := &anomalyDetector{
+		now:    func() time.Time { return at },
+		notify: func(kind, message string, details map[string]interface{}) { alerts = append(alerts, kind) },
+	}
+	// Feeds a minute of events for each key and closes the interval.
+	minute := func(counts map[string]int) {
+		for key, n := range counts {
+			for i := 0; i < n; i++ {
+				d.record(anomalyPaymentCreations, key)
+			}
+		}
+		d.evaluate()
+		at = at.Add(anomalyInterval)
+	}
+
+	// Spikes during warmup are not reported.
+	minute(map[string]int{"shop": 5, "kiosk": 1})
+	minute(map[string]int{"shop": 100, "kiosk": 1})
+	for i := 0; i < 30; i++ {
+		minute(map[string]int{"shop": 5, "kiosk": 1})
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("steady traffic is reported: %v", alerts)
+	}
+
+	// Low volume is not reported even if far above its baseline.
+	minute(map[string]int{"shop": 5, "kiosk": 9})
+	if len(alerts) != 0 {
+		t.Fatalf("low volume is reported: %v", alerts)
+	}
+
+	minute(map[string]int{"shop": 60, "kiosk": 1})
+	if len(alerts) != 1 || alerts[0] != "anomaly_payment_creations" {
+		t.Fatalf("spike is not reported: %v", alerts)
+	}
+	detections := d.Detections()
+	if len(detections) != 1 || detections[0].Key != "shop" || detections[0].Count != 60 || detections[0].Multiple < 3 {
+		t.Fatalf("unexpected detections: %+v", detections)
+	}
+
+	// Another spike in cooldown is not reported.
+	minute(map[string]int{"shop": 80, "kiosk": 1})
+	if len(alerts) != 1 {
+		t.Fatalf("spike in cooldown is reported: %v", alerts)
+	}
+	for i := 0; i < 60; i++ {
+		minute(map[string]int{"shop": 5, "kiosk": 1})
+	}
+	minute(map[string]int{"shop": 80, "kiosk": 1})
+	if len(alerts) != 2 {
+		t.Fatalf("spike after cooldown is not reported: %v", alerts)
+	}
+	if detections = d.Detections(); len(detections) != 2 || !detections[0].DetectedAt.After(detections[1].DetectedAt) {
+		t.Fatalf("detections are not ordered: %+v", detections)
+	}
+
+	// Series of a key that stopped sending is dropped.
+	for i := 0; i < 120; i++ {
+		minute(map[string]int{"shop": 5})
+	}
+	if _, ok := d.series[anomalyKey{anomalyPaymentCreations, "kiosk"}]; ok {
+		t.Error("idle series is kept")
+	}
+}
+
+func TestHandleAdminAnomalies(t *testing.T) {
+	config.setDefaults()
+	config.AnomalyThreshold = 2
+	t.Cleanup(func() { config.AnomalyThreshold = 0 })
+	old := anomalies
+	anomalies = &anomalyDetector{now: clockNow, notify: func(string, string, map[string]interface{}) {}}
+	t.Cleanup(func() { anomalies = old })
+	for i := 0; i < anomalyWarmupIntervals; i++ {
+		anomalies.record(anomalyPriceFailovers, "")
+		anomalies.evaluate()
+	}
+	for i := 0; i < 20; i++ {
+		anomalies.record(anomalyPriceFailovers, "")
+	}
+	anomalies.evaluate()
+
+	w := httptest.NewRecorder()
+	handleAdminAnomalies(w, httptest.NewRequest(http.MethodGet, "/admin/anomalies", nil))
+	var detections []Anomaly
+	if err := json.Unmarshal(w.Body.Bytes(), &detections); err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 1 || detections[0].Signal != anomalyPriceFailovers || detections[0].Baseline != 1 {
+		t.Errorf("unexpected response: %s", w.Body)
+	}
+}
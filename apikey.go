@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+// Server-side callers pass an API key in X-API-Key or "Authorization: Bearer <key>" header.
+// Requests with a valid key skip the IP rate limit of /api/pay and are limited by the RateLimit of the key instead, if set.
+// An unknown bearer token is ignored and the request is handled as anonymous, so browsers sending
+// their own Authorization headers keep working. An unknown X-API-Key is refused by /api/pay.
+
+var (
+	metricAPIKeyRequests    = expvar.NewMap("api_key_requests_total")
+	metricAPIKeyRateLimited = expvar.NewMap("api_key_rate_limited_total")
+)
+
+// apiKeyLimiters holds a limiter for each key fingerprint with a RateLimit. Set by initAPIKeyLimiters.
+var apiKeyLimiters map[string]*limiter.Limiter
+
+func initAPIKeyLimiters() error {
+	store := memory.NewStore()
+	limiters := make(map[string]*limiter.Limiter)
+	for key, apiKey := range config.APIKeys {
+		if apiKey.RateLimit == "" {
+			continue
+		}
+		rate, err := limiter.NewRateFromFormatted(apiKey.RateLimit)
+		if err != nil {
+			return err
+		}
+		limiters[keyFingerprint(key)] = limiter.New(store, rate)
+	}
+	apiKeyLimiters = limiters
+	return nil
+}
+
+// bearerToken returns the token in Authorization header of r.
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) <= len(prefix) || strings.ToLower(h[:len(prefix)]) != prefix {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// lookupAPIKey finds key in APIKeys. Hashes of all keys are compared, so the time does not depend on how much of key matches.
+func lookupAPIKey(key string) (APIKey, bool) {
+	sum := sha256.Sum256([]byte(key))
+	var found APIKey
+	var ok bool
+	for k, apiKey := range config.APIKeys {
+		s := sha256.Sum256([]byte(k))
+		if subtle.ConstantTimeCompare(sum[:], s[:]) == 1 {
+			found, ok = apiKey, true
+		}
+	}
+	return found, ok
+}
+
+// requestAPIKey returns the valid API key of r from X-API-Key or Authorization header.
+// Returns empty key if r has no valid key.
+func requestAPIKey(r *http.Request) (key string, apiKey APIKey) {
+	for _, key = range []string{r.Header.Get("X-API-Key"), bearerToken(r)} {
+		if key == "" {
+			continue
+		}
+		if found, ok := lookupAPIKey(key); ok {
+			return key, found
+		}
+	}
+	return "", APIKey{}
+}
+
+// apiKeyRateLimit serves requests with a valid API key within the limit of the key.
+// Other requests are passed to anonymous, usually the IP rate limit.
+func apiKeyRateLimit(anonymous, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _ := requestAPIKey(r)
+		if key == "" {
+			anonymous.ServeHTTP(w, r)
+			return
+		}
+		client := keyFingerprint(key)
+		metricAPIKeyRequests.Add(client, 1)
+		if l := apiKeyLimiters[client]; l != nil {
+			ctx, err := l.Get(r.Context(), client)
+			if err != nil {
+				handleRateLimitError(w, r, err)
+				return
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(ctx.Limit, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(ctx.Remaining, 10))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(ctx.Reset, 10))
+			if ctx.Reached {
+				metricAPIKeyRateLimited.Add(client, 1)
+				handleRateLimited(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
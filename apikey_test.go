@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	config.setDefaults()
+	config.APIKeys = map[string]APIKey{"server": {}, "limited": {RateLimit: "2-H"}}
+	defer func() { config.APIKeys = nil; apiKeyLimiters = nil }()
+	if err := initAPIKeyLimiters(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := newRateLimiter("1-H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients = append(clients, clientFingerprint(r))
+	})
+	handler := apiKeyRateLimit(newRateLimitMiddleware(l).Handler(h), h)
+	request := func(header, value string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", nil)
+		r.RemoteAddr = "1.1.1.1:1000"
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if request("", "") != http.StatusOK || request("", "") != http.StatusTooManyRequests {
+		t.Fatal("anonymous request is not limited by IP")
+	}
+	for i := 0; i < 3; i++ {
+		if code := request("Authorization", "Bearer server"); code != http.StatusOK {
+			t.Fatalf("request with bearer key is limited by IP: %d", code)
+		}
+	}
+	if request("X-API-Key", "server") != http.StatusOK {
+		t.Fatal("request with X-API-Key is limited by IP")
+	}
+	if request("Authorization", "Bearer unknown") != http.StatusTooManyRequests {
+		t.Fatal("unknown bearer key is not handled as anonymous")
+	}
+	if request("Authorization", "bearer limited") != http.StatusOK || request("Authorization", "Bearer limited") != http.StatusOK {
+		t.Fatal("request within the key limit is refused")
+	}
+	if request("Authorization", "Bearer limited") != http.StatusTooManyRequests {
+		t.Fatal("key limit is not enforced")
+	}
+	server := keyFingerprint("server")
+	if clients[0] != "anonymous" || clients[1] != server || clients[4] != server || clients[5] != keyFingerprint("limited") {
+		t.Fatalf("unexpected clients: %v", clients)
+	}
+	if v := metricAPIKeyRequests.Get(server); v == nil || v.String() != "4" {
+		t.Fatalf("unexpected request count: %v", v)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cenkalti/log"
+)
+
+// Static assets of the status page are served under content hashed paths like /static/<hash>/status.js,
+// so they can be cached forever and pinned by merchants embedding the page.
+// Hashes are calculated at startup and listed with subresource integrity values at /api/assets.
+
+const (
+	staticPrefix = "/static/"
+	// Length of the hash prefix in asset paths (hex characters).
+	assetHashLength = 16
+)
+
+// staticFiles are kept in source because embedding files needs a newer Go version than the module supports.
+var staticFiles = map[string]string{
+	"checkout.css": checkoutStyle,
+	"checkout.js":  checkoutScript,
+	"status.css": `body{font-family:sans-serif;margin:0;padding:1em;color:#222}
+.status{font-weight:bold}
+.status.fulfilled{color:#1a7f37}
+.account{font-family:monospace;word-break:break-all}
+`,
+	"status.js": `(function () {
+  "use strict";
+  var root = document.getElementById("payment");
+  var token = root.getAttribute("data-token");
+  function update(p) {
+    root.querySelector(".balance").textContent = p.balance;
+    var status = root.querySelector(".status");
+    status.textContent = p.fulfilled ? "Paid" : (p.remainingSeconds > 0 ? "Waiting for payment" : "Expired");
+    status.className = p.fulfilled ? "status fulfilled" : "status";
+    return p.fulfilled || p.remainingSeconds <= 0;
+  }
+  function poll() {
+    fetch("/api/verify?token=" + encodeURIComponent(token))
+      .then(function (r) { return r.json(); })
+      .then(function (p) { if (!update(p)) { setTimeout(poll, 5000); } })
+      .catch(function () { setTimeout(poll, 5000); });
+  }
+  poll();
+})();
+`,
+}
+
+// Asset is a static file with its content hash.
+type Asset struct {
+	Path string `json:"path"`
+	// Subresource integrity value for integrity attribute.
+	Integrity   string `json:"integrity"`
+	ContentType string `json:"contentType"`
+
+	content []byte
+}
+
+// assetIndex holds the hashed assets by name and by path.
+type assetIndex struct {
+	byName map[string]*Asset
+	byPath map[string]*Asset
+}
+
+func newAssetIndex(files map[string]string) *assetIndex {
+	idx := &assetIndex{byName: make(map[string]*Asset, len(files)), byPath: make(map[string]*Asset, len(files))}
+	for name, content := range files {
+		sum := sha512.Sum384([]byte(content))
+		a := &Asset{
+			Path:        staticPrefix + hex.EncodeToString(sum[:])[:assetHashLength] + "/" + name,
+			Integrity:   "sha384-" + base64.StdEncoding.EncodeToString(sum[:]),
+			ContentType: assetContentType(name),
+			content:     []byte(content),
+		}
+		idx.byName[name] = a
+		idx.byPath[a.Path] = a
+	}
+	return idx
+}
+
+var staticAssets = newAssetIndex(staticFiles)
+
+func assetContentType(name string) string {
+	switch path.Ext(name) {
+	case ".js":
+		return "text/javascript; charset=utf-8"
+	case ".css":
+		return "text/css; charset=utf-8"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	a, ok := staticAssets.byPath[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	// Content of a path never changes.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_, err := w.Write(a.content)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// AssetManifest is returned from /api/assets.
+type AssetManifest struct {
+	Assets map[string]*Asset `json:"assets"`
+}
+
+func handleAssets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err := json.NewEncoder(w).Encode(AssetManifest{Assets: staticAssets.byName})
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// StatusPage is rendered at /status for a payment token.
+type StatusPage struct {
+	Token    string
+	Payment  *Response
+	Scripts  []*Asset
+	Styles   []*Asset
+	Merchant string
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Payment status</title>
+{{range .Styles}}<link rel="stylesheet" href="{{.Path}}" integrity="{{.Integrity}}" crossorigin="anonymous">
+{{end}}</head>
+<body>
+<div id="payment" data-token="{{.Token}}">
+{{if .Merchant}}<h1>{{.Merchant}}</h1>{{end}}
+<p class="status{{if .Payment.Fulfilled}} fulfilled{{end}}">{{if .Payment.Fulfilled}}Paid{{else if gt .Payment.RemainingSeconds 0}}Waiting for payment{{else}}Expired{{end}}</p>
+<p>Send <b>{{.Payment.Amount}}</b> NANO to <span class="account">{{.Payment.Account}}</span></p>
+<p>Received: <span class="balance">{{.Payment.Balance}}</span> NANO</p>
+</div>
+{{range .Scripts}}<script src="{{.Path}}" integrity="{{.Integrity}}" crossorigin="anonymous"></script>
+{{end}}</body>
+</html>
+`))
+
+// assetsOfPage returns the assets of a page with the extension sorted by path.
+// Assets of a page are named after it, like status.js.
+func (idx *assetIndex) assetsOfPage(page, ext string) []*Asset {
+	var ret []*Asset
+	for name, a := range idx.byName {
+		if strings.HasPrefix(name, page+".") && strings.HasSuffix(name, ext) {
+			ret = append(ret, a)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	claims, err := ParseToken(token)
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	payment, err := LoadPayment([]byte(claims.Account))
+	if err == errPaymentNotFound {
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	page := StatusPage{
+		Token:    token,
+		Payment:  NewResponse(payment, token),
+		Scripts:  staticAssets.assetsOfPage("status", ".js"),
+		Styles:   staticAssets.assetsOfPage("status", ".css"),
+		Merchant: config.MerchantName,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = statusTemplate.Execute(w, page)
+	if err != nil {
+		log.Debug(err)
+	}
+}
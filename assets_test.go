@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAssetManifest(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleAssets(w, httptest.NewRequest(http.MethodGet, "/api/assets", nil))
+	var manifest AssetManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Assets) != len(staticFiles) {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	for name, a := range manifest.Assets {
+		w = httptest.NewRecorder()
+		handleStatic(w, httptest.NewRequest(http.MethodGet, a.Path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+			t.Fatalf("cannot get %s: %d %v", a.Path, w.Code, w.Header())
+		}
+		sum := sha512.Sum384(w.Body.Bytes())
+		if a.Integrity != "sha384-"+base64.StdEncoding.EncodeToString(sum[:]) {
+			t.Fatalf("integrity of %s does not match content", name)
+		}
+	}
+
+	changed := map[string]string{"status.js": staticFiles["status.js"] + "\n"}
+	if newAssetIndex(changed).byName["status.js"].Path == staticAssets.byName["status.js"].Path {
+		t.Fatal("path does not change with content")
+	}
+	w = httptest.NewRecorder()
+	handleStatic(w, httptest.NewRequest(http.MethodGet, "/static/0000000000000000/status.js", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown hash is served: %d", w.Code)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	p := &Payment{Account: "nano_1status", Index: "1", PaymentID: "status"}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken(p.Index, p.Account, p.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleStatus(w, httptest.NewRequest(http.MethodGet, "/status?token="+token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot render status page: %d %s", w.Code, w.Body)
+	}
+	js := staticAssets.byName["status.js"]
+	// Attribute values are escaped by the template.
+	if !strings.Contains(html.UnescapeString(w.Body.String()), `<script src="`+js.Path+`" integrity="`+js.Integrity+`"`) {
+		t.Fatalf("script is not pinned:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Admin requests that change something, and all requests refused by the authentication, are recorded in auditBucket.
+// Entries are only appended, keyed by a sequence number, and listed newest first at GET /admin/audit.
+// IPs with too many failed logins are refused for the rest of the AdminAuthFailureLimit period without
+// checking their credentials.
+
+const (
+	auditBucket        = "audit"
+	defaultAuditLimit  = 100
+	maxAuditLimit      = 1000
+	auditOutcomeOK     = "ok"
+	auditOutcomeFailed = "failed"
+	// Credentials are missing or wrong.
+	auditOutcomeDenied = "denied"
+	// IP has too many failed logins.
+	auditOutcomeRateLimited = "rate_limited"
+)
+
+// AuditEntry records an admin request.
+type AuditEntry struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	RemoteIP string    `json:"remoteIp"`
+	// Username sent with the request. Set for denied requests too.
+	Admin    string `json:"admin,omitempty"`
+	Method   string `json:"method"`
+	Endpoint string `json:"endpoint"`
+	// Account of the payment that the request is about, if any.
+	Account string `json:"account,omitempty"`
+	Status  int    `json:"status"`
+	Outcome string `json:"outcome"`
+}
+
+// auditRecorder keeps the status of the response for the audit entry.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// validAdminCredentials compares hashes of the credentials, so the time does not depend on how much of them match.
+func validAdminCredentials(username, password string) bool {
+	user, expectedUser := sha256.Sum256([]byte(username)), sha256.Sum256([]byte(adminName))
+	pass, expectedPass := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(config.AdminPassword))
+	return subtle.ConstantTimeCompare(user[:], expectedUser[:])&subtle.ConstantTimeCompare(pass[:], expectedPass[:]) == 1
+}
+
+// adminAuthBlocked returns true if ip has reached the limit of failed logins.
+func adminAuthBlocked(ctx context.Context, ip string) bool {
+	if adminAuthLimiter == nil {
+		return false
+	}
+	c, err := adminAuthLimiter.Peek(ctx, ip)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return c.Remaining == 0
+}
+
+// recordAdminAuthFailure counts a failed login of ip.
+func recordAdminAuthFailure(ctx context.Context, ip string) {
+	if adminAuthLimiter == nil {
+		return
+	}
+	c, err := adminAuthLimiter.Get(ctx, ip)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if c.Remaining == 0 {
+		log.Warningf("admin logins from %s are refused after %d failed attempts", ip, c.Limit)
+	}
+}
+
+// audited returns true if the request must be recorded. Reads are not recorded unless they are refused.
+func audited(r *http.Request, outcome string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return outcome == auditOutcomeDenied || outcome == auditOutcomeRateLimited
+	}
+	return true
+}
+
+// auditAccount returns the account that the request is about, from the form parsed by the handler or from the query.
+func auditAccount(r *http.Request) string {
+	values := r.Form
+	if values == nil {
+		values = r.URL.Query()
+	}
+	if account := values.Get("account"); account != "" {
+		return account
+	}
+	if id := values.Get("id"); id != "" {
+		account, err := accountOfPaymentID(id)
+		if err == nil {
+			return account
+		}
+	}
+	return ""
+}
+
+// recordAudit appends an entry for the admin request. status is the response status.
+func recordAudit(r *http.Request, status int, outcome string) {
+	if !audited(r, outcome) {
+		return
+	}
+	username, _, _ := r.BasicAuth()
+	e := AuditEntry{
+		Time:     clock.Now().UTC(),
+		RemoteIP: remoteIP(r),
+		Admin:    username,
+		Method:   r.Method,
+		Endpoint: r.URL.Path,
+		Status:   status,
+		Outcome:  outcome,
+	}
+	if outcome != auditOutcomeDenied && outcome != auditOutcomeRateLimited {
+		e.Account = auditAccount(r)
+	}
+	err := dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(auditBucket))
+		if err != nil {
+			return err
+		}
+		e.ID, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, e.ID)
+		return b.Put(key, value)
+	})
+	if err != nil {
+		log.Errorln("cannot write audit entry:", err)
+	}
+}
+
+// auditOutcome returns the outcome of a request that passed authentication.
+func auditOutcome(status int) string {
+	if status >= http.StatusBadRequest {
+		return auditOutcomeFailed
+	}
+	return auditOutcomeOK
+}
+
+// AuditFilter selects entries in loadAuditEntries. Empty fields match all entries.
+type AuditFilter struct {
+	Account  string
+	Endpoint string
+	Outcome  string
+	Since    time.Time
+	Limit    int
+}
+
+func (f AuditFilter) match(e *AuditEntry) bool {
+	return (f.Account == "" || e.Account == f.Account) &&
+		(f.Endpoint == "" || e.Endpoint == f.Endpoint) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome)
+}
+
+// loadAuditEntries returns the entries matching f, newest first.
+func loadAuditEntries(f AuditFilter) ([]*AuditEntry, error) {
+	entries := make([]*AuditEntry, 0)
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(auditBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < f.Limit; k, v = c.Prev() {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Time.Before(f.Since) {
+				break
+			}
+			if f.match(&e) {
+				entries = append(entries, &e)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// handleAdminAudit lists audit entries, newest first.
+// They can be filtered with account, endpoint, outcome and since (RFC 3339) parameters.
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	f := AuditFilter{
+		Account:  r.FormValue("account"),
+		Endpoint: r.FormValue("endpoint"),
+		Outcome:  r.FormValue("outcome"),
+		Limit:    defaultAuditLimit,
+	}
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		f.Since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		f.Limit, err = strconv.Atoi(s)
+		if err != nil || f.Limit <= 0 || f.Limit > maxAuditLimit {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := loadAuditEntries(f)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, entries)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAuthFailureLimit(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.AdminPassword = "secret"
+	l, err := newRateLimiter("2-H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminAuthLimiter = l
+	t.Cleanup(func() {
+		config.AdminPassword = ""
+		adminAuthLimiter = nil
+	})
+	h := adminHandler(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(ip, password string) int {
+		r := httptest.NewRequest(http.MethodGet, "/admin/payment", nil)
+		r.RemoteAddr = ip + ":1000"
+		if password != "" {
+			r.SetBasicAuth(adminName, password)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+	if request("1.1.1.1", "") != http.StatusUnauthorized || request("1.1.1.1", "secret") != http.StatusOK {
+		t.Fatal("unexpected response")
+	}
+	for i := 0; i < 2; i++ {
+		if code := request("1.1.1.1", "guess"); code != http.StatusForbidden {
+			t.Fatalf("wrong password is not refused: %d", code)
+		}
+	}
+	if code := request("1.1.1.1", "secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("IP is not blocked after failed attempts: %d", code)
+	}
+	if code := request("2.2.2.2", "secret"); code != http.StatusOK {
+		t.Fatalf("other IP is blocked: %d", code)
+	}
+	if validAdminCredentials("admin", "secre") || validAdminCredentials("root", "secret") || !validAdminCredentials("admin", "secret") {
+		t.Fatal("unexpected credential check")
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.AdminPassword = "secret"
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	t.Cleanup(func() { config.AdminPassword = "" })
+	h := adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("account") == "nano_1missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+	request := func(method, password string, values url.Values) {
+		r := httptest.NewRequest(method, "/admin/send", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "1.1.1.1:1000"
+		r.SetBasicAuth(adminName, password)
+		h(httptest.NewRecorder(), r)
+		c.Add(time.Second)
+	}
+	request(http.MethodGet, "secret", nil)
+	request(http.MethodPost, "secret", url.Values{"account": {"nano_1paid"}})
+	request(http.MethodPost, "secret", url.Values{"account": {"nano_1missing"}})
+	request(http.MethodGet, "wrong", nil)
+
+	audit := func(query string) []AuditEntry {
+		r := httptest.NewRequest(http.MethodGet, "/admin/audit?"+query, nil)
+		w := httptest.NewRecorder()
+		handleAdminAudit(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("cannot list audit entries: %d %s", w.Code, w.Body)
+		}
+		var entries []AuditEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	entries := audit("")
+	if len(entries) != 3 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	denied, failed, ok := entries[0], entries[1], entries[2]
+	if denied.Outcome != auditOutcomeDenied || denied.Status != http.StatusForbidden || denied.Account != "" {
+		t.Fatalf("denied request is not recorded: %+v", denied)
+	}
+	if failed.Outcome != auditOutcomeFailed || failed.Status != http.StatusNotFound || failed.Account != "nano_1missing" {
+		t.Fatalf("failed request is not recorded: %+v", failed)
+	}
+	if ok.Outcome != auditOutcomeOK || ok.Status != http.StatusOK || ok.Account != "nano_1paid" || ok.Endpoint != "/admin/send" ||
+		ok.RemoteIP != "1.1.1.1" || ok.Admin != adminName || ok.Method != http.MethodPost || ok.ID >= failed.ID {
+		t.Fatalf("unexpected entry: %+v", ok)
+	}
+	if entries = audit("account=nano_1paid"); len(entries) != 1 || entries[0].ID != ok.ID {
+		t.Fatalf("entries are not filtered by account: %+v", entries)
+	}
+	if entries = audit("since=" + failed.Time.Format(time.RFC3339)); len(entries) != 2 {
+		t.Fatalf("entries are not filtered by time: %+v", entries)
+	}
+	if entries = audit("limit=1"); len(entries) != 1 || entries[0].ID != denied.ID {
+		t.Fatalf("entries are not limited: %+v", entries)
+	}
+}
+
+func TestAdminMutationsRequirePost(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"send":    handleAdminSendToMerchant,
+		"receive": handleAdminReceivePending,
+		"check":   handleAdminCheckPayment,
+		"advance": handleAdminAdvance,
+		"cancel":  handleAdminCancel,
+		"approve": handleAdminApproveSweep,
+	}
+	for name, h := range handlers {
+		r := httptest.NewRequest(http.MethodGet, "/admin/"+name+"?account=nano_1paid", nil)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET is accepted by /admin/%s: %d", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// With AutoTLS, certificates of AutoTLS.Hosts are obtained from Let's Encrypt on the first handshake and renewed
+// before they expire. A second listener on AutoTLS.HTTPAddress answers HTTP-01 challenges and redirects other
+// requests to HTTPS. Names not in AutoTLS.Hosts are refused, so clients cannot make the server request
+// certificates for arbitrary names and use up the rate limits of the account.
+
+// challengeServer serves HTTP-01 challenges when AutoTLS is used.
+var challengeServer http.Server
+
+// autoTLSEnabled returns true if certificates are managed with AutoTLS.
+func (c *Config) autoTLSEnabled() bool {
+	return len(c.AutoTLS.Hosts) > 0 && (c.CertFile == "" || c.KeyFile == "")
+}
+
+func (a *AutoTLS) validate() error {
+	if len(a.Hosts) == 0 {
+		return nil
+	}
+	if a.CacheDir == "" {
+		return errors.New("AutoTLS.CacheDir is required with AutoTLS.Hosts")
+	}
+	for _, host := range a.Hosts {
+		// HTTP-01 challenges cannot prove wildcards or IP addresses.
+		if host == "" || strings.Contains(host, "*") || net.ParseIP(host) != nil {
+			return fmt.Errorf("invalid AutoTLS host %q", host)
+		}
+	}
+	return nil
+}
+
+// newAutocertManager returns the certificate manager for a. It fails if the cache directory is not writable,
+// so a server that cannot keep its certificates does not start.
+func newAutocertManager(a AutoTLS) (*autocert.Manager, error) {
+	err := checkWritableDir(a.CacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("AutoTLS.CacheDir is not writable: %w", err)
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(a.CacheDir),
+		HostPolicy: autocert.HostWhitelist(a.Hosts...),
+		Email:      a.Email,
+	}, nil
+}
+
+// checkWritableDir creates dir if it does not exist and writes a file in it.
+func checkWritableDir(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".write-test")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAutoTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accept-nano-autotls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := AutoTLS{Hosts: []string{"pay.example.com"}, CacheDir: filepath.Join(dir, "certs")}
+	if err = a.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"*.example.com", "127.0.0.1"} {
+		if (&AutoTLS{Hosts: []string{host}, CacheDir: dir}).validate() == nil {
+			t.Errorf("host %s is accepted", host)
+		}
+	}
+	if (&AutoTLS{Hosts: a.Hosts}).validate() == nil {
+		t.Error("cache directory is not required")
+	}
+
+	m, err := newAutocertManager(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.HostPolicy(context.Background(), "pay.example.com"); err != nil {
+		t.Errorf("configured host is refused: %s", err)
+	}
+	if m.HostPolicy(context.Background(), "other.example.com") == nil {
+		t.Error("host not in the list is accepted")
+	}
+
+	// Directory cannot be created under a file.
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newAutocertManager(AutoTLS{Hosts: a.Hosts, CacheDir: filepath.Join(file, "certs")}); err == nil {
+		t.Error("unwritable cache directory is accepted")
+	}
+
+	// Certificate files take precedence.
+	c := Config{AutoTLS: a}
+	c.setDefaults()
+	if !c.autoTLSEnabled() || c.ListenAddress != ":443" || c.AutoTLS.HTTPAddress != ":80" {
+		t.Errorf("unexpected defaults: %t %s %s", c.autoTLSEnabled(), c.ListenAddress, c.AutoTLS.HTTPAddress)
+	}
+	c.CertFile, c.KeyFile = "cert.pem", "key.pem"
+	if c.autoTLSEnabled() {
+		t.Error("AutoTLS is used with certificate files")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Max number of attempts for a payment when provider is rate limiting.
+const backfillMaxAttempts = 5
+
+// BackfilledRate is a historical price of NANO at the time a payment is verified.
+type BackfilledRate struct {
+	Rate     decimal.Decimal `json:"rate"`
+	Currency string          `json:"currency"`
+	Provider string          `json:"provider"`
+	// Time of the price. Same as FulfilledAt of the payment.
+	At        time.Time `json:"at"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// BackfillStatus is returned from backfill status endpoint.
+// Job can be started again to continue with the payments that are still missing a rate.
+type BackfillStatus struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Failed     int        `json:"failed"`
+	Remaining  int        `json:"remaining"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+var errBackfillRunning = errors.New("backfill is already running")
+
+// backfiller fetches historical prices for payments without a stored rate one by one,
+// waiting between requests to stay under the rate limit of the provider.
+type backfiller struct {
+	provider historicalPriceProvider
+	interval time.Duration
+
+	mu     sync.Mutex
+	status BackfillStatus
+}
+
+var backfill = &backfiller{}
+
+// needsBackfill returns true if the payment is verified but there is no rate to value it in fiat.
+func needsBackfill(p *Payment) bool {
+	return p.FulfilledAt != nil && p.Price.IsZero() && p.BackfilledRate == nil
+}
+
+// backfillCurrency returns the fiat currency to fetch the rate in.
+func backfillCurrency(p *Payment) string {
+	if p.Price.IsZero() && p.Currency != "" && p.Currency != "BCB" && p.Currency != "NANO" {
+		// Created before rates were stored.
+		return p.Currency
+	}
+	return config.BackfillCurrency
+}
+
+func (b *backfiller) Status() BackfillStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.status
+	s.Remaining = s.Total - s.Done - s.Failed
+	return s
+}
+
+// start runs the job in background.
+func (b *backfiller) start(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.status.Running {
+		return errBackfillRunning
+	}
+	var accounts []string
+	err := forEachPayment(func(p *Payment) error {
+		if needsBackfill(p) {
+			accounts = append(accounts, p.Account)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	b.status = BackfillStatus{Running: true, StartedAt: &now, Total: len(accounts)}
+	go b.run(ctx, accounts)
+	return nil
+}
+
+func (b *backfiller) run(ctx context.Context, accounts []string) {
+	defer func() {
+		b.mu.Lock()
+		now := clock.Now()
+		b.status.Running = false
+		b.status.FinishedAt = &now
+		b.mu.Unlock()
+	}()
+	for i, account := range accounts {
+		if i > 0 && !sleepContext(ctx, b.interval) {
+			return
+		}
+		err := b.backfillPayment(ctx, account)
+		b.mu.Lock()
+		if err != nil {
+			log.Warningf("cannot backfill rate of %s: %s", account, err)
+			b.status.Failed++
+			b.status.LastError = err.Error()
+		} else {
+			b.status.Done++
+		}
+		b.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (b *backfiller) backfillPayment(ctx context.Context, account string) error {
+	p, err := LoadPayment([]byte(account))
+	if err != nil {
+		return err
+	}
+	if !needsBackfill(p) {
+		return nil
+	}
+	currency := backfillCurrency(p)
+	var rate decimal.Decimal
+	for attempt := 1; ; attempt++ {
+		rate, err = b.provider.HistoricalPrice(currency, *p.FulfilledAt)
+		perr, ok := err.(*PriceError)
+		if !ok || perr.Class != priceErrRateLimited || attempt == backfillMaxAttempts {
+			break
+		}
+		retryAfter := perr.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfter
+		}
+		log.Noticef("backfill is rate limited, waiting %s", retryAfter)
+		if !sleepContext(ctx, retryAfter) {
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	p, err = LoadPayment([]byte(account))
+	if err != nil {
+		return err
+	}
+	if !needsBackfill(p) {
+		return nil
+	}
+	p.BackfilledRate = &BackfilledRate{
+		Rate:      rate,
+		Currency:  currency,
+		Provider:  b.provider.Name(),
+		At:        *p.FulfilledAt,
+		FetchedAt: clock.Now(),
+	}
+	return p.Save()
+}
+
+// sleepContext waits for d and returns false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startBackfill starts the backfill with the configured provider.
+func startBackfill() error {
+	backfill.mu.Lock()
+	if backfill.provider == nil {
+		backfill.provider = &coingecko{url: coingeckoURL}
+		backfill.interval = time.Duration(config.BackfillRequestInterval) * time.Millisecond
+	}
+	backfill.mu.Unlock()
+	return backfill.start(context.Background())
+}
+
+// handleAdminBackfill starts the backfill, or defers it to the end of the maintenance window.
+func handleAdminBackfill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if maintenance.window(maintenance.now()) != nil {
+		maintenance.runOrDefer(jobBackfill)
+		w.WriteHeader(http.StatusAccepted)
+		writeAdminJSON(w, maintenance.status())
+		return
+	}
+	err := startBackfill()
+	if err == errBackfillRunning {
+		writeError(w, errCodeBackfillInProgress, http.StatusConflict, "backfill is in progress")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, backfill.Status())
+}
+
+func handleAdminBackfillStatus(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, backfill.Status())
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/accounting"
+)
+
+// historicalStub returns a rate limited error for the first limited calls.
+type historicalStub struct {
+	stubProvider
+	limited int
+}
+
+func (p *historicalStub) HistoricalPrice(currency string, at time.Time) (decimal.Decimal, error) {
+	p.calls++
+	if p.limited > 0 {
+		p.limited--
+		return decimal.Zero, &PriceError{Provider: p.name, Class: priceErrRateLimited, RetryAfter: time.Millisecond}
+	}
+	return p.price, nil
+}
+
+func TestBackfill(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	verifiedAt := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	payments := []*Payment{
+		{Account: "nano_1native", Currency: "BCB", Balance: NanoToRaw(decimal.NewFromInt(2)), FulfilledAt: &verifiedAt},
+		{Account: "nano_1old", Currency: "EUR", AmountInCurrency: NewCurrencyAmount(decimal.NewFromInt(3), "EUR"), FulfilledAt: &verifiedAt},
+		{Account: "nano_1priced", Currency: "USD", Price: decimal.NewFromInt(2), FulfilledAt: &verifiedAt},
+		{Account: "nano_1unpaid", Currency: "BCB"},
+	}
+	for _, p := range payments {
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider := &historicalStub{stubProvider: stubProvider{name: "stub", price: decimal.RequireFromString("1.5")}, limited: 1}
+	b := &backfiller{provider: provider, interval: time.Millisecond}
+	if err := b.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for b.Status().Running {
+		time.Sleep(time.Millisecond)
+	}
+	status := b.Status()
+	if status.Total != 2 || status.Done != 2 || status.Remaining != 0 || provider.calls != 3 {
+		t.Fatalf("unexpected status: %+v, calls: %d", status, provider.calls)
+	}
+
+	p, _ := LoadPayment([]byte("nano_1native"))
+	if r := p.BackfilledRate; r == nil || r.Currency != "USD" || r.Provider != "stub" || !r.At.Equal(verifiedAt) {
+		t.Fatalf("unexpected backfilled rate: %+v", r)
+	}
+	txs := paymentTransactions(p)
+	if txs[0].RateSource != accounting.Backfilled || !txs[0].FiatAmount.Equal(decimal.NewFromInt(3)) {
+		t.Errorf("unexpected transaction: %+v", txs[0])
+	}
+	p, _ = LoadPayment([]byte("nano_1old"))
+	if p.BackfilledRate == nil || p.BackfilledRate.Currency != "EUR" {
+		t.Fatalf("unexpected backfilled rate: %+v", p.BackfilledRate)
+	}
+	p, _ = LoadPayment([]byte("nano_1priced"))
+	if p.BackfilledRate != nil || paymentTransactions(p)[0].RateSource != accounting.Contemporaneous {
+		t.Fatal("payment with stored rate is backfilled")
+	}
+
+	// Running again does nothing because all rates are filled.
+	if err := b.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for b.Status().Running {
+		time.Sleep(time.Millisecond)
+	}
+	if b.Status().Total != 0 {
+		t.Fatalf("backfill did not resume: %+v", b.Status())
+	}
+}
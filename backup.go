@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Payments are backed up with GET /admin/export, which streams the stored records as newline-delimited JSON,
+// and restored with the -import flag, e.g. to move them to another host. Records contain the key index of
+// the deposit account but no keys, so the restoring host needs the same Seed to move funds of the payments.
+// Records are restored as they are, unlike the payments imported from other processors in import.go.
+// Prefixes of blocks elided from large records are not included.
+
+// Statuses of restored records. Existing accounts are reported as importStatusDuplicate unless overwritten.
+const (
+	backupStatusRestored    = "restored"
+	backupStatusOverwritten = "overwritten"
+)
+
+func handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	var createdAfter time.Time
+	if s := r.FormValue("created_after"); s != "" {
+		var err error
+		createdAfter, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid created_after", http.StatusBadRequest)
+			return
+		}
+	}
+	merchant := r.FormValue("merchant")
+	filename := fmt.Sprintf("payments-%s.ndjson", clock.Now().Format("20060102"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	enc := json.NewEncoder(w)
+	var count int
+	err := forEachPayment(func(p *Payment) error {
+		if !p.CreatedAt.After(createdAfter) || (merchant != "" && p.Merchant != merchant) {
+			return nil
+		}
+		count++
+		return enc.Encode(p)
+	})
+	if err != nil {
+		// Headers are sent, so the client sees a truncated file.
+		log.Errorf("export is interrupted after %d payments: %s", count, err)
+		return
+	}
+	log.Noticef("%d payments exported by %s", count, adminIdentity(r))
+}
+
+// validateBackupRecord checks a record read from a backup.
+func validateBackupRecord(p *Payment) error {
+	if !accountRegexp.MatchString(p.Account) {
+		return errors.New("invalid account")
+	}
+	if p.Index == "" && !p.Imported {
+		return errors.New("index is required")
+	}
+	if p.Index != "" {
+		if _, err := strconv.ParseUint(p.Index, 10, 64); err != nil {
+			return errors.New("invalid index")
+		}
+	}
+	if _, ok := config.Merchants[p.Merchant]; p.Merchant != "" && !ok {
+		return errUnknownMerchant
+	}
+	if p.Amount.IsNegative() || p.Balance.IsNegative() {
+		return errors.New("amounts must not be negative")
+	}
+	if p.CreatedAt.IsZero() {
+		return errors.New("createdAt is required")
+	}
+	return nil
+}
+
+// restorePayments reads a backup from r and saves the records. Existing accounts are skipped unless overwrite is set.
+// Bad records are reported with their line numbers and do not stop the restore.
+func restorePayments(r io.Reader, overwrite bool) (*ImportReport, error) {
+	// Tags of the existing accounts, so their index is updated on overwrite.
+	existing := make(map[string][]string)
+	// Key indexes must stay unique, otherwise two payments would share a deposit account.
+	indexes := make(map[string]string)
+	err := forEachPayment(func(p *Payment) error {
+		existing[p.Account] = p.Tags
+		if p.Index != "" {
+			indexes[p.Index] = p.Account
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := &ImportReport{Counts: make(map[string]int)}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return report, err
+		}
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			row := ImportRow{Rows: []int{line}}
+			row.Status, row.Error = restoreRecord(b, &row, existing, indexes, overwrite)
+			report.Counts[row.Status]++
+			// Restored records are only counted, so the report of a large backup stays small.
+			if row.Status == importStatusError || row.Status == importStatusDuplicate {
+				report.Rows = append(report.Rows, row)
+			}
+		}
+		if err == io.EOF {
+			return report, nil
+		}
+	}
+}
+
+// restoreRecord saves the record in b. Returns the status and error message for the report.
+func restoreRecord(b []byte, row *ImportRow, existing map[string][]string, indexes map[string]string, overwrite bool) (status, message string) {
+	p := new(Payment)
+	if err := json.Unmarshal(b, p); err != nil {
+		return importStatusError, "invalid record: " + err.Error()
+	}
+	row.Account, row.PaymentID = p.Account, p.PaymentID
+	if err := validateBackupRecord(p); err != nil {
+		return importStatusError, err.Error()
+	}
+	if account, ok := indexes[p.Index]; ok && p.Index != "" && account != p.Account {
+		return importStatusError, "index is used by " + account
+	}
+	oldTags, exists := existing[p.Account]
+	if exists && !overwrite {
+		return importStatusDuplicate, "account exists"
+	}
+	if err := restorePayment(p, exists, oldTags); err != nil {
+		return importStatusError, err.Error()
+	}
+	if p.Index != "" {
+		indexes[p.Index] = p.Account
+	}
+	existing[p.Account] = p.Tags
+	if exists {
+		return backupStatusOverwritten, ""
+	}
+	return backupStatusRestored, ""
+}
+
+// restorePayment saves p in place of the existing record with oldTags, or as a new payment.
+func restorePayment(p *Payment, exists bool, oldTags []string) error {
+	p.tagsChanged = len(p.Tags) > 0
+	if exists {
+		p.oldTags, p.tagsChanged = oldTags, true
+		// Record is overwritten whatever revision it has, so it is saved over the stored one.
+		stored, err := LoadPayment([]byte(p.Account))
+		if err != nil {
+			return err
+		}
+		p.Revision = stored.Revision
+		return p.Save()
+	}
+	// SQL store keeps the key indexes in use apart from the payments.
+	if s, ok := store.(*sqlStore); ok {
+		_, err := s.copyPayment(p)
+		return err
+	}
+	err := p.create(statePolicy{})
+	if err != nil || !p.tagsChanged {
+		return err
+	}
+	// Tag index is written on save.
+	return p.Save()
+}
+
+// runRestore implements -import flag.
+func runRestore(path string, overwrite bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report, err := restorePayments(f, overwrite)
+	if report != nil {
+		b, err2 := json.MarshalIndent(report, "", "  ")
+		if err2 != nil {
+			return err2
+		}
+		fmt.Println(string(b))
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	openTestDB(t, 0)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	useFakeClock(t, start.Add(time.Hour))
+	account := func(c string) string { return "nano_3" + strings.Repeat(c, 59) }
+	newPayment := func(c, index string, createdAt time.Time) *Payment {
+		p := &Payment{Account: account(c), Index: index, PaymentID: "id-" + c, Amount: decimal.New(1, 30), CreatedAt: createdAt}
+		if err := p.create(statePolicy{}); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	newPayment("a", "1", start)
+	tagged := newPayment("b", "2", start.Add(time.Minute))
+	tagged.setTags([]string{"vip"})
+	if err := tagged.Save(); err != nil {
+		t.Fatal(err)
+	}
+	newPayment("c", "3", start.Add(2*time.Minute))
+
+	w := httptest.NewRecorder()
+	handleAdminExport(w, httptest.NewRequest(http.MethodGet, "/admin/export?created_after=2021-01-01T00:00:00Z", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", w.Code, w.Body)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], account("b")) || strings.Contains(w.Body.String(), "private") {
+		t.Fatalf("unexpected export: %s", w.Body)
+	}
+
+	// Restored to another host, which has a payment using index 3 and the same account as the payment with index 2.
+	_ = closeDB()
+	openTestDB(t, 0)
+	newPayment("d", "3", start)
+	newPayment("b", "9", start)
+	backup := w.Body.String() + "{not json}\n" + `{"account":"nano_1bad","index":"4","createdAt":"2021-01-01T00:00:00Z"}` + "\n" +
+		`{"account":"` + account("e") + `","index":"5","amount":"1x","createdAt":"2021-01-01T00:00:00Z"}` + "\n"
+	report, err := restorePayments(strings.NewReader(backup), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Counts[backupStatusRestored] != 0 || report.Counts[importStatusDuplicate] != 1 || report.Counts[importStatusError] != 4 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	byLine := make(map[int]ImportRow)
+	for _, row := range report.Rows {
+		byLine[row.Rows[0]] = row
+	}
+	if byLine[2].Error != "index is used by "+account("d") || byLine[4].Error != "invalid account" || byLine[5].Status != importStatusError {
+		t.Errorf("unexpected rows: %+v", report.Rows)
+	}
+
+	// Overwritten record keeps its tags in the index.
+	report, err = restorePayments(bytes.NewBufferString(lines[0]), true)
+	if err != nil || report.Counts[backupStatusOverwritten] != 1 {
+		t.Fatalf("record is not overwritten: %+v %v", report, err)
+	}
+	p, err := LoadPayment([]byte(account("b")))
+	if err != nil || p.Index != "2" {
+		t.Fatalf("unexpected restored payment: %+v %v", p, err)
+	}
+	found, _, err := findPaymentsByTag("vip", "", nil, 10)
+	if err != nil || len(found) != 1 {
+		t.Errorf("tag index is not restored: %d %v", len(found), err)
+	}
+}
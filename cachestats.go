@@ -0,0 +1,108 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var metricCacheRequests = expvar.NewMap("cache_requests_total")
+
+// Upper bounds of age buckets for cache hits. The last bucket counts older entries.
+var cacheAgeBuckets = []time.Duration{time.Second, 10 * time.Second, time.Minute, 10 * time.Minute, time.Hour}
+
+// cacheStats counts lookups of an in-memory cache.
+type cacheStats struct {
+	name string
+
+	mu            sync.Mutex
+	hits          int64
+	misses        int64
+	invalidations int64
+	// Hits by age of the entry, one more than cacheAgeBuckets.
+	ages []int64
+}
+
+var (
+	priceCacheStats   = newCacheStats("price")
+	qrCacheStats      = newCacheStats("qr")
+	sessionCacheStats = newCacheStats("session")
+
+	allCacheStats = []*cacheStats{priceCacheStats, qrCacheStats, sessionCacheStats}
+)
+
+func newCacheStats(name string) *cacheStats {
+	return &cacheStats{name: name, ages: make([]int64, len(cacheAgeBuckets)+1)}
+}
+
+// hit records a lookup served from an entry stored age ago.
+func (s *cacheStats) hit(age time.Duration) {
+	metricCacheRequests.Add(s.name+"_hit", 1)
+	i := 0
+	for i < len(cacheAgeBuckets) && age > cacheAgeBuckets[i] {
+		i++
+	}
+	s.mu.Lock()
+	s.hits++
+	s.ages[i]++
+	s.mu.Unlock()
+}
+
+func (s *cacheStats) miss() {
+	metricCacheRequests.Add(s.name+"_miss", 1)
+	s.mu.Lock()
+	s.misses++
+	s.mu.Unlock()
+}
+
+// invalidate records an entry removed from the cache because it is expired, evicted or no longer valid.
+func (s *cacheStats) invalidate() {
+	metricCacheRequests.Add(s.name+"_invalidation", 1)
+	s.mu.Lock()
+	s.invalidations++
+	s.mu.Unlock()
+}
+
+// CacheStats is returned from /admin/debug/caches.
+type CacheStats struct {
+	Name          string  `json:"name"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	Invalidations int64   `json:"invalidations"`
+	HitRatio      float64 `json:"hitRatio"`
+	// Hits by age of the served entry.
+	AgeAtHit []CacheAgeBucket `json:"ageAtHit"`
+}
+
+// CacheAgeBucket counts hits of entries not older than Max. Max is empty in the last bucket.
+type CacheAgeBucket struct {
+	Max   string `json:"max,omitempty"`
+	Count int64  `json:"count"`
+}
+
+func (s *cacheStats) stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := CacheStats{Name: s.name, Hits: s.hits, Misses: s.misses, Invalidations: s.invalidations}
+	if total := s.hits + s.misses; total > 0 {
+		stats.HitRatio = float64(s.hits) / float64(total)
+	}
+	for i, count := range s.ages {
+		var b CacheAgeBucket
+		if i < len(cacheAgeBuckets) {
+			b.Max = cacheAgeBuckets[i].String()
+		}
+		b.Count = count
+		stats.AgeAtHit = append(stats.AgeAtHit, b)
+	}
+	return stats
+}
+
+func handleAdminDebugCaches(w http.ResponseWriter, r *http.Request) {
+	stats := make([]CacheStats, 0, len(allCacheStats))
+	for _, s := range allCacheStats {
+		stats = append(stats, s.stats())
+	}
+	writeAdminJSON(w, stats)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheStats(t *testing.T) {
+	s := newCacheStats("test")
+	for _, age := range []time.Duration{0, time.Second, 5 * time.Second, 30 * time.Minute, 2 * time.Hour} {
+		s.hit(age)
+	}
+	s.miss()
+	s.miss()
+	s.miss()
+	s.invalidate()
+	stats := s.stats()
+	if stats.Hits != 5 || stats.Misses != 3 || stats.Invalidations != 1 || stats.HitRatio != 5.0/8 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	expected := []int64{2, 1, 0, 0, 1, 1}
+	for i, b := range stats.AgeAtHit {
+		if b.Count != expected[i] {
+			t.Errorf("bucket %q: %d hits, expected %d", b.Max, b.Count, expected[i])
+		}
+	}
+	if stats.AgeAtHit[0].Max != "1s" || stats.AgeAtHit[len(expected)-1].Max != "" {
+		t.Errorf("unexpected buckets: %+v", stats.AgeAtHit)
+	}
+}
+
+func TestPriceCacheStats(t *testing.T) {
+	config.setDefaults()
+	clock, _ := fakePriceSource(t)
+	before := priceCacheStats.stats()
+	// First lookup fetches the price, the next ones within the update interval are served from cache.
+	for i := 0; i < 4; i++ {
+		if _, err := getNanoPrice("USD"); err != nil {
+			t.Fatal(err)
+		}
+		*clock = clock.Add(10 * time.Second)
+	}
+	*clock = clock.Add(priceCacheDuration())
+	if _, err := getNanoPrice("USD"); err != nil {
+		t.Fatal(err)
+	}
+	after := priceCacheStats.stats()
+	if after.Hits-before.Hits != 3 || after.Misses-before.Misses != 2 || after.Invalidations-before.Invalidations != 1 {
+		t.Fatalf("unexpected stats: before %+v, after %+v", before, after)
+	}
+	// Hits are 10, 20 and 30 seconds old.
+	if after.AgeAtHit[1].Count-before.AgeAtHit[1].Count != 1 || after.AgeAtHit[2].Count-before.AgeAtHit[2].Count != 2 {
+		t.Errorf("unexpected ages: %+v", after.AgeAtHit)
+	}
+
+	w := httptest.NewRecorder()
+	handleAdminDebugCaches(w, httptest.NewRequest(http.MethodGet, "/admin/debug/caches", nil))
+	var caches []CacheStats
+	if err := json.Unmarshal(w.Body.Bytes(), &caches); err != nil {
+		t.Fatal(err)
+	}
+	if len(caches) != len(allCacheStats) || caches[0].Name != "price" || caches[0].Hits != after.Hits {
+		t.Errorf("unexpected response: %s", w.Body)
+	}
+}
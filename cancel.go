@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cenkalti/log"
+)
+
+// Payments can be cancelled until funds arrive, e.g. when the customer changes the order and a new payment is created.
+// Account is checked once more before cancelling, so funds sent just before are not missed.
+
+var (
+	errCannotCancel      = errors.New("payment is verified or funds have arrived")
+	errCancelCheckFailed = errors.New("cannot check payment before cancelling")
+)
+
+// PaymentCancelled is published when a payment is cancelled.
+type PaymentCancelled struct {
+	Payment
+}
+
+func (p PaymentCancelled) Account() Account {
+	return Account(p.Payment.Account)
+}
+
+// cancelPayment marks the payment of account as cancelled and stops its check loop.
+// by is the admin cancelling the payment, empty for the customer. Cancelling a cancelled payment is not an error.
+func cancelPayment(account, by string) (*Payment, error) {
+	p, err := markCancelled(account, by)
+	if err != nil {
+		return nil, err
+	}
+	stopCheckLoop(account)
+	go verifications.Publish(PaymentCancelled{Payment: *p})
+	return p, nil
+}
+
+func markCancelled(account, by string) (*Payment, error) {
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	p, err := LoadPayment([]byte(account))
+	if err != nil {
+		return nil, err
+	}
+	if p.CancelledAt != nil {
+		return p, nil
+	}
+	if p.Imported || p.FulfilledAt != nil || p.ReceivedAt != nil || p.SentAt != nil {
+		return nil, errCannotCancel
+	}
+	err = p.checkPending()
+	switch err {
+	case nil, errPaymentNotFulfilled:
+	default:
+		log.Errorf("cannot check %s before cancelling: %s", account, err)
+		return nil, errCancelCheckFailed
+	}
+	if p.Balance.IsPositive() || len(p.SubPayments) > 0 || p.ElidedBlocks != nil {
+		// Saved, so the check loop sees the funds.
+		if err = p.Save(); err != nil {
+			return nil, err
+		}
+		return nil, errCannotCancel
+	}
+	p.CancelledAt = now()
+	p.CancelledBy = by
+	if err = p.Save(); err != nil {
+		return nil, err
+	}
+	log.Noticef("payment %s is cancelled", account)
+	return p, nil
+}
+
+// stopCheckLoop stops the check loop of account if it is running in this instance.
+func stopCheckLoop(account string) {
+	checkingMu.Lock()
+	defer checkingMu.Unlock()
+	if s, ok := checkingPayments[account]; ok && s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, errCodeMethodNotAllowed, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if err := parseJSONBody(r); err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, err.Error())
+		return
+	}
+	token := r.FormValue("token")
+	claims, err := ParseToken(token)
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	p, err := cancelPayment(claims.Account, "")
+	switch err {
+	case nil:
+	case errPaymentNotFound:
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	case errCannotCancel:
+		writeError(w, errCodeCannotCancel, http.StatusConflict, err.Error())
+		return
+	case errCancelCheckFailed:
+		writeError(w, errCodeNodeUnavailable, http.StatusBadGateway, err.Error())
+		return
+	default:
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	b, err := json.Marshal(NewResponse(p, token))
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+func handleAdminCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	account, err := requestAccount(r)
+	if err != nil && err != errPaymentNotFound {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account == "" && err == nil {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	p, err := cancelPayment(account, adminIdentity(r))
+	switch err {
+	case nil:
+		writeAdminJSON(w, p)
+	case errPaymentNotFound:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errCannotCancel:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errCancelCheckFailed:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
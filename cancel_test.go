@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestCancelPayment(t *testing.T) {
+	openTestDB(t, 0)
+	fakeEmptyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	post := func(h http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/cancel", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	p := &Payment{Account: "nano_1cancel", PaymentID: "cancel", Amount: decimal.New(1, 30), CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken("1", p.Account, p.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.StartChecking()
+
+	w := post(handleCancel, url.Values{"token": {token}})
+	var response Response
+	if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK || !response.Cancelled {
+		t.Fatalf("payment is not cancelled: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "check loop to stop", func() bool {
+		checkingMu.Lock()
+		defer checkingMu.Unlock()
+		_, ok := checkingPayments[p.Account]
+		return !ok
+	})
+	p, _ = LoadPayment([]byte(p.Account))
+	if p.CancelledAt == nil || p.nextStep() != stepNone || !p.finished() {
+		t.Fatalf("payment is not cancelled: %+v", p)
+	}
+	w = httptest.NewRecorder()
+	handleVerify(w, httptest.NewRequest(http.MethodGet, "/api/verify?token="+token, nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK || !response.Cancelled || response.RemainingSeconds != 0 {
+		t.Fatalf("verify does not show cancelled: %d %s", w.Code, w.Body)
+	}
+	if w = post(handleCancel, url.Values{"token": {token}}); w.Code != http.StatusOK {
+		t.Fatalf("cancelling again fails: %d %s", w.Code, w.Body)
+	}
+
+	paid := &Payment{Account: "nano_1paid", Amount: decimal.New(1, 30), Balance: decimal.New(1, 29), CreatedAt: clock.Now()}
+	if err = paid.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, _ = NewToken("2", paid.Account, "")
+	expectErrorCode(t, post(handleCancel, url.Values{"token": {token}}), http.StatusConflict, errCodeCannotCancel)
+	if w = postAdminForm(handleAdminCancel, url.Values{"account": {paid.Account}}); w.Code != http.StatusConflict {
+		t.Fatalf("admin cancels paid payment: %d %s", w.Code, w.Body)
+	}
+	paid.Balance = decimal.Zero
+	if err = paid.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if w = postAdminForm(handleAdminCancel, url.Values{"account": {paid.Account}}); w.Code != http.StatusOK {
+		t.Fatalf("admin cannot cancel: %d %s", w.Code, w.Body)
+	}
+	paid, _ = LoadPayment([]byte(paid.Account))
+	if paid.CancelledAt == nil || paid.CancelledBy != adminName {
+		t.Fatalf("payment is not cancelled by admin: %+v", paid)
+	}
+	if w = postAdminForm(handleAdminCancel, url.Values{"account": {"nano_1unknown"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected response for unknown account: %d", w.Code)
+	}
+}
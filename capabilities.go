@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Clients detect the features of an instance from GET /api/capabilities instead of hardcoding them.
+// Only settings that clients need for building requests are included. Admin endpoints and
+// thresholds that help abusing the service (e.g. underpayment tolerance) are never listed.
+
+const (
+	// Version of the capabilities document. Incremented on incompatible changes.
+	capabilitiesVersion = 1
+	// Capabilities change only with config, so they are cached for a short time.
+	capabilitiesCacheDuration = time.Minute
+)
+
+// Capabilities is returned from /api/capabilities.
+type Capabilities struct {
+	Version int `json:"version"`
+	// "live" or "test".
+	Network string `json:"network"`
+	// Versions of /api/pay and /api/verify responses.
+	ResponseVersions []int           `json:"responseVersions"`
+	Features         map[string]bool `json:"features"`
+	// Paths of the available endpoints by feature.
+	Endpoints  map[string]string    `json:"endpoints"`
+	Limits     CapabilityLimits     `json:"limits"`
+	Currencies CapabilityCurrencies `json:"currencies"`
+	Widget     CapabilityWidget     `json:"widget"`
+}
+
+type CapabilityLimits struct {
+	// Payments below this amount are not detected, in NANO.
+	MinAmount decimal.Decimal `json:"minAmount"`
+	// Range of amounts accepted by /api/pay, in NANO. Not set if there is no limit.
+	MinPayment *decimal.Decimal `json:"minPayment,omitempty"`
+	MaxPayment *decimal.Decimal `json:"maxPayment,omitempty"`
+	// Time customer has to send the funds unless a preset sets another (seconds).
+	PaymentTimeout int `json:"paymentTimeout"`
+	// Upper limit of X-Request-Deadline-Ms header (milliseconds). Zero if the header is ignored.
+	MaxRequestDeadline int `json:"maxRequestDeadline"`
+	MaxQRSize          int `json:"maxQrSize"`
+	// Upper limit of currencies in display_currencies parameter.
+	MaxDisplayCurrencies int `json:"maxDisplayCurrencies"`
+	// Rate of /api/pay requests allowed per client, e.g. "60-H" for 60 per hour.
+	PayRateLimit string `json:"payRateLimit"`
+	// Upper limit of tokens subscribed over one websocket connection.
+	MaxWebsocketSubscriptions int `json:"maxWebsocketSubscriptions"`
+}
+
+type CapabilityCurrencies struct {
+	// Amounts can be requested in fiat currencies.
+	Fiat bool `json:"fiat"`
+	// Price providers in the order they are tried.
+	Providers []string `json:"providers"`
+	// "refuse" or "flag", see PriceStalePolicy config.
+	StalePricePolicy string `json:"stalePricePolicy"`
+}
+
+type CapabilityWidget struct {
+	// Version that new pages should use.
+	Latest string `json:"latest"`
+	// Path of the widget config.
+	Config string `json:"config"`
+	// Served versions, oldest first.
+	Bundles []*WidgetBundle `json:"bundles"`
+}
+
+// currentCapabilities derives the capabilities from config.
+func currentCapabilities() *Capabilities {
+	c := &Capabilities{
+		Version:          capabilitiesVersion,
+		Network:          "live",
+		ResponseVersions: []int{1},
+		Features: map[string]bool{
+			"websocket":               true,
+			"websocket_resume":        config.WebsocketSessionTTL > 0,
+			"websocket_subscriptions": true,
+			"events":                  true,
+			"receipts":                true,
+			"qr":                      true,
+			"proof":                   true,
+			"cancel":                  true,
+			"display_currencies":      true,
+			"batch_price":             true,
+			"sandbox":                 config.SandboxMode,
+			"presets":                 true,
+			"status_page":             true,
+			"public_stats":            len(config.PublicStatsFields) > 0,
+			"request_deadline":        config.MaxRequestDeadline > 0,
+			"signed_tokens":           tokenKeys.signingKey(clock.Now()) != nil,
+			"merchants":               len(config.Merchants) > 0,
+			"checkout_page":           config.EnableCheckoutPage,
+		},
+		Endpoints: map[string]string{
+			"pay":        "/api/pay",
+			"verify":     "/api/verify",
+			"cancel":     "/api/cancel",
+			"price":      "/api/price",
+			"currencies": "/api/currencies",
+			"websocket":  "/websocket",
+			"events":     "/api/events",
+			"sandbox":    "/api/sandbox/fulfill",
+			"receipts":   "/api/receipt",
+			"qr":         "/api/qr",
+			"proof":      "/api/proof",
+			"keys":       "/api/keys",
+			"assets":     "/api/assets",
+			"status":     "/status",
+			"widget":     widgetConfigPath,
+			"checkout":   checkoutPrefix,
+		},
+		Limits: CapabilityLimits{
+			PaymentTimeout:            config.AllowedDuration,
+			MaxRequestDeadline:        config.MaxRequestDeadline,
+			MaxQRSize:                 config.QRMaxSize,
+			MaxDisplayCurrencies:      config.MaxDisplayCurrencies,
+			PayRateLimit:              config.PayRateLimit,
+			MaxWebsocketSubscriptions: config.WebsocketMaxSubscriptions,
+		},
+		Currencies: CapabilityCurrencies{
+			Fiat:             len(config.PriceProviders) > 0,
+			Providers:        config.PriceProviders,
+			StalePricePolicy: config.PriceStalePolicy,
+		},
+	}
+	idx := widgetBundleIndex()
+	c.Widget = CapabilityWidget{Latest: idx.latest().Version, Config: widgetConfigPath, Bundles: idx.served(clock.Now())}
+	if config.Testnet {
+		c.Network = "test"
+	}
+	if len(config.PublicStatsFields) > 0 {
+		c.Endpoints["public_stats"] = "/api/stats/public"
+	}
+	c.Limits.MinAmount, _ = decimal.NewFromString(config.ReceiveThreshold)
+	c.Limits.MinPayment, c.Limits.MaxPayment, _ = config.paymentLimits()
+	return c
+}
+
+var (
+	capabilitiesMu       sync.Mutex
+	capabilitiesCache    []byte
+	capabilitiesCachedAt time.Time
+)
+
+func getCapabilities() ([]byte, error) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	if capabilitiesCache != nil && time.Since(capabilitiesCachedAt) < capabilitiesCacheDuration {
+		return capabilitiesCache, nil
+	}
+	b, err := json.Marshal(currentCapabilities())
+	if err != nil {
+		return nil, err
+	}
+	capabilitiesCache = b
+	capabilitiesCachedAt = time.Now()
+	return b, nil
+}
+
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	b, err := getCapabilities()
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(capabilitiesCacheDuration.Seconds())))
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
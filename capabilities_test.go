@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// keysOf returns the sorted keys of a JSON object.
+func keysOf(m map[string]json.RawMessage) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func TestCapabilities(t *testing.T) {
+	config.setDefaults()
+	config.Testnet = true
+	config.PublicStatsFields = []string{"total_verified"}
+	t.Cleanup(func() {
+		config.Testnet = false
+		config.PublicStatsFields = nil
+		capabilitiesCache = nil
+	})
+	w := httptest.NewRecorder()
+	handleCapabilities(w, httptest.NewRequest("GET", "/api/capabilities", nil))
+	var c Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != capabilitiesVersion || c.Network != "test" || !c.Features["public_stats"] || c.Endpoints["public_stats"] == "" || c.Limits.MinAmount.String() != "0.001" {
+		t.Fatalf("unexpected capabilities: %s", w.Body)
+	}
+
+	// Only whitelisted fields are published. Review new fields for sensitive settings before adding them here.
+	whitelist := map[string]string{
+		"":           "currencies,endpoints,features,limits,network,responseVersions,version,widget",
+		"limits":     "maxDisplayCurrencies,maxQrSize,maxRequestDeadline,maxWebsocketSubscriptions,minAmount,payRateLimit,paymentTimeout",
+		"currencies": "fiat,providers,stalePricePolicy",
+		"widget":     "bundles,config,latest",
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for field, expected := range whitelist {
+		m := doc
+		if field != "" {
+			m = nil
+			if err := json.Unmarshal(doc[field], &m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if keys := keysOf(m); keys != expected {
+			t.Errorf("fields of %q: got %s, expected %s", field, keys, expected)
+		}
+	}
+	for path := range c.Endpoints {
+		if strings.HasPrefix(c.Endpoints[path], "/admin") {
+			t.Errorf("admin endpoint is published: %s", path)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/cenkalti/log"
+)
+
+// The checkout page at /checkout/<token> is a ready-made payment page for merchants that do not build their own.
+// It shows the amount, the account and the QR code of the payment, follows it over the websocket with /api/verify
+// as a fallback, counts down to expiry and redirects to success_url when the payment is verified.
+// success_url must be under one of CheckoutSuccessURLs, so the page cannot be used to redirect customers elsewhere.
+// Script and style are served from staticFiles like the status page, and the page loads nothing from other origins.
+
+const checkoutPrefix = "/checkout/"
+
+// CheckoutText holds the texts displayed on the checkout page.
+type CheckoutText struct {
+	Title        string
+	Instructions string
+	// Status texts by payment state.
+	Waiting             string
+	PendingConfirmation string
+	Paid                string
+	Expired             string
+	// Displayed before the remaining time.
+	Countdown string
+	// Label of the link to success_url, displayed when the payment is verified.
+	Continue string
+}
+
+func (t *CheckoutText) setDefaults() {
+	defaults := []struct {
+		value *string
+		text  string
+	}{
+		{&t.Title, "Pay with NANO"},
+		{&t.Instructions, "Scan the QR code with your wallet or send the exact amount to the account below."},
+		{&t.Waiting, "Waiting for payment"},
+		{&t.PendingConfirmation, "Payment seen, waiting for network confirmation"},
+		{&t.Paid, "Paid"},
+		{&t.Expired, "Expired"},
+		{&t.Countdown, "Time left:"},
+		{&t.Continue, "Continue"},
+	}
+	for _, d := range defaults {
+		if *d.value == "" {
+			*d.value = d.text
+		}
+	}
+}
+
+const checkoutStyle = `body{font-family:sans-serif;margin:0;padding:1em;color:#222;background:#f6f7f9}
+.checkout{max-width:24em;margin:0 auto;padding:1.5em;background:#fff;border-top:4px solid var(--accent);border-radius:4px;text-align:center}
+.checkout h1{font-size:1.3em;margin:0 0 .5em}
+.checkout .qr{width:240px;height:240px}
+.checkout .amount{font-size:1.4em;font-weight:bold}
+.checkout .account{font-family:monospace;word-break:break-all;font-size:.9em}
+.checkout .status{font-weight:bold;color:var(--accent)}
+.checkout[data-state=paid] .status{color:#1a7f37}
+.checkout[data-state=expired] .status{color:#b42318}
+.checkout[data-state=paid] .qr,.checkout[data-state=expired] .qr,.checkout[data-state=paid] .timer{display:none}
+.checkout .continue{display:none;margin-top:1em;padding:.6em 1.2em;color:#fff;background:var(--accent);border-radius:4px;text-decoration:none}
+.checkout[data-state=paid] .continue[href]{display:inline-block}
+`
+
+const checkoutScript = `(function () {
+  "use strict";
+  var root = document.getElementById("checkout");
+  var token = root.getAttribute("data-token");
+  var successURL = root.getAttribute("data-success-url");
+  var expiresAt = Date.parse(root.getAttribute("data-expires-at"));
+  var done = false;
+  var revision = -1;
+  function set(selector, value) {
+    var node = root.querySelector(selector);
+    if (node) { node.textContent = value; }
+  }
+  function update(p) {
+    // Error frames and replies are not payments, and a reply older than the rendered state is dropped.
+    if (done || !p || !p.account || typeof p.revision !== "number" || p.revision < revision) { return; }
+    revision = p.revision;
+    expiresAt = Date.parse(p.expiresAt);
+    set(".amount", p.amount + " NANO");
+    set(".balance", p.balance);
+    var state = "waiting";
+    if (p.fulfilled) {
+      state = "paid";
+    } else if (p.pendingConfirmation) {
+      state = "confirming";
+    } else if (p.cancelled || p.remainingSeconds <= 0) {
+      state = "expired";
+    }
+    root.setAttribute("data-state", state);
+    set(".status", root.getAttribute("data-text-" + state));
+    if (state === "paid" || state === "expired") {
+      done = true;
+      if (state === "paid" && successURL) { window.location.assign(successURL); }
+    }
+  }
+  function countdown() {
+    var left = Math.max(0, Math.floor((expiresAt - Date.now()) / 1000));
+    set(".remaining", Math.floor(left / 60) + ":" + ("0" + left % 60).slice(-2));
+    if (!done) { setTimeout(countdown, 1000); }
+  }
+  function refresh() {
+    return fetch("/api/verify?token=" + encodeURIComponent(token))
+      .then(function (r) { return r.json(); })
+      .then(update);
+  }
+  function poll() {
+    refresh()
+      .catch(function () {})
+      .then(function () { if (!done) { setTimeout(poll, 15000); } });
+  }
+  function connect() {
+    var scheme = window.location.protocol === "https:" ? "wss://" : "ws://";
+    var ws = new WebSocket(scheme + window.location.host + "/websocket?token=" + encodeURIComponent(token));
+    ws.onmessage = function (e) {
+      var m = JSON.parse(e.data);
+      // Events are dropped when the page is slow, so the state is read again.
+      if (m.resync) {
+        refresh().catch(function () {});
+        return;
+      }
+      update(m);
+      if (done) { ws.close(); }
+    };
+    ws.onclose = function () {
+      if (!done) { setTimeout(connect, 5000); }
+    };
+  }
+  connect();
+  poll();
+  countdown();
+})();
+`
+
+// CheckoutPage is rendered at /checkout/<token>.
+type CheckoutPage struct {
+	Token       string
+	Payment     *Response
+	SuccessURL  string
+	Text        CheckoutText
+	AccentColor string
+	Merchant    string
+	Script      *Asset
+	Style       *Asset
+}
+
+var checkoutTemplate = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Text.Title}}</title>
+<link rel="stylesheet" href="{{.Style.Path}}" integrity="{{.Style.Integrity}}" crossorigin="anonymous">
+</head>
+<body>
+<div id="checkout" class="checkout" style="--accent: {{.AccentColor}}" data-token="{{.Token}}" data-success-url="{{.SuccessURL}}"
+ data-expires-at="{{.Payment.ExpiresAt.Format "2006-01-02T15:04:05Z07:00"}}" data-state="waiting"
+ data-text-waiting="{{.Text.Waiting}}" data-text-confirming="{{.Text.PendingConfirmation}}" data-text-paid="{{.Text.Paid}}" data-text-expired="{{.Text.Expired}}">
+{{if .Merchant}}<p class="merchant">{{.Merchant}}</p>{{end}}
+<h1>{{.Text.Title}}</h1>
+<p class="status">{{.Text.Waiting}}</p>
+<img class="qr" src="/api/qr?token={{.Token}}" alt="">
+<p>{{.Text.Instructions}}</p>
+<p class="amount">{{.Payment.Amount}} NANO</p>
+<p class="account">{{.Payment.Account}}</p>
+<p class="timer">{{.Text.Countdown}} <span class="remaining"></span></p>
+<a class="continue"{{if .SuccessURL}} href="{{.SuccessURL}}"{{end}}>{{.Text.Continue}}</a>
+</div>
+<script src="{{.Script.Path}}" integrity="{{.Script.Integrity}}" crossorigin="anonymous"></script>
+</body>
+</html>
+`))
+
+// allowedSuccessURL returns true if s is under one of CheckoutSuccessURLs.
+// Scheme and host must be equal, and the path must be the path of the entry or under it after dot segments are
+// resolved like browsers do.
+func allowedSuccessURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.User != nil || !validNotificationURL(s) || strings.Contains(u.Path, "\\") {
+		return false
+	}
+	p := "/"
+	if u.Path != "" {
+		p = path.Clean(u.Path)
+	}
+	for _, entry := range config.CheckoutSuccessURLs {
+		// Validated when config is loaded.
+		allowed, _ := url.Parse(entry)
+		if u.Scheme != allowed.Scheme || !strings.EqualFold(u.Host, allowed.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(allowed.Path, "/")
+		if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func handleCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, errCodeMethodNotAllowed, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, checkoutPrefix)
+	claims, err := ParseToken(token)
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	successURL := r.FormValue("success_url")
+	if successURL != "" && !allowedSuccessURL(successURL) {
+		writeError(w, errCodeInvalidSuccessURL, http.StatusBadRequest, "success_url is not allowed")
+		return
+	}
+	payment, err := LoadPayment([]byte(claims.Account))
+	if err == nil && !payment.visibleTo(nil, claims) {
+		err = errPaymentNotFound
+	}
+	if err == errPaymentNotFound {
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	page := CheckoutPage{
+		Token:       token,
+		Payment:     NewResponse(payment, token),
+		SuccessURL:  successURL,
+		Text:        config.CheckoutText,
+		AccentColor: config.CheckoutAccentColor,
+		Merchant:    config.MerchantName,
+		Script:      staticAssets.byName["checkout.js"],
+		Style:       staticAssets.byName["checkout.css"],
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; connect-src 'self' ws: wss:; img-src 'self'; style-src 'self' 'unsafe-inline'")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err = checkoutTemplate.Execute(w, page)
+	if err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckoutPage(t *testing.T) {
+	openTestDB(t, 0)
+	config.CheckoutSuccessURLs = []string{"https://shop.example.com/orders/", "https://thanks.example.com"}
+	config.CheckoutText = CheckoutText{Title: "Pay Example Shop"}
+	config.WidgetAccentColor, config.CheckoutAccentColor = "#112233", ""
+	config.setDefaults()
+	config.Seed = "seed"
+	t.Cleanup(func() {
+		config.CheckoutSuccessURLs = nil
+		config.CheckoutText = CheckoutText{}
+		config.WidgetAccentColor = ""
+		config.CheckoutAccentColor = ""
+	})
+	p := &Payment{Account: "nano_1checkout", Index: "1", PaymentID: "checkout"}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken(p.Index, p.Account, p.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleCheckout(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	successURL := "https://shop.example.com/orders/42?paid=1"
+	w := get(checkoutPrefix + token + "?success_url=" + url.QueryEscape(successURL))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot render checkout page: %d %s", w.Code, w.Body)
+	}
+	body := html.UnescapeString(w.Body.String())
+	js, css := staticAssets.byName["checkout.js"], staticAssets.byName["checkout.css"]
+	for _, s := range []string{
+		`<script src="` + js.Path + `" integrity="` + js.Integrity + `"`,
+		`<link rel="stylesheet" href="` + css.Path + `" integrity="` + css.Integrity + `"`,
+		`data-success-url="` + successURL + `"`,
+		`src="/api/qr?token=` + token + `"`,
+		"--accent: #112233",
+		"<title>Pay Example Shop</title>",
+		`data-text-confirming="Payment seen, waiting for network confirmation"`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("page does not contain %s:\n%s", s, body)
+		}
+	}
+	if strings.Contains(body, "http://") || strings.Contains(body, "//cdn") {
+		t.Errorf("page loads from other origins:\n%s", body)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.HasPrefix(csp, "default-src 'self'") {
+		t.Errorf("unexpected policy: %s", csp)
+	}
+
+	for _, s := range []string{
+		"https://evil.example.com/orders/42",
+		"https://shop.example.com.evil.com/orders/42",
+		"https://shop.example.com/ordersx",
+		"http://shop.example.com/orders/42",
+		"https://user@shop.example.com/orders/42",
+		"https://shop.example.com/orders/../x",
+		"https://shop.example.com/orders/%2e%2e/x",
+		"https://shop.example.com/orders/..\\x",
+		"https://shop.example.com/orders/..",
+		"javascript:alert(1)",
+	} {
+		expectErrorCode(t, get(checkoutPrefix+token+"?success_url="+url.QueryEscape(s)), http.StatusBadRequest, errCodeInvalidSuccessURL)
+	}
+	for _, s := range []string{
+		"https://thanks.example.com/",
+		"https://shop.example.com/orders/",
+		"https://shop.example.com/orders",
+		"https://shop.example.com/orders/./42",
+		"https://shop.example.com/orders/a/../42",
+	} {
+		if !allowedSuccessURL(s) {
+			t.Errorf("allowed URL is refused: %s", s)
+		}
+	}
+	expectErrorCode(t, get(checkoutPrefix+"invalid"), http.StatusBadRequest, errCodeTokenInvalid)
+
+	// Tokens in checkout paths are not logged.
+	if s := redactPath(checkoutPrefix + token); s != checkoutPrefix+redacted {
+		t.Errorf("token is not redacted: %s", s)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Clock returns the current time.
+// Deadlines are calculated with the global clock so that they can be tested with a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+// Now returns the current time in UTC without monotonic clock reading,
+// so the result can be compared and stored together with persisted timestamps.
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+var clock Clock = systemClock{}
+
+// clockNow can be used as a func value that follows changes to clock.
+func clockNow() time.Time { return clock.Now() }
+
+// normalizeTime converts t to UTC. Returns true if t was in another location.
+func normalizeTime(t *time.Time) bool {
+	if t == nil || t.Location() == time.UTC {
+		return false
+	}
+	*t = t.UTC()
+	return true
+}
+
+// paymentJSON has the default JSON encoding of Payment.
+type paymentJSON Payment
+
+// UnmarshalJSON converts timestamps to UTC and amounts to their canonical scale.
+// Payments saved by older versions may contain timestamps in the local time zone of the host.
+func (p *Payment) UnmarshalJSON(b []byte) error {
+	err := json.Unmarshal(b, (*paymentJSON)(p))
+	if err != nil {
+		return err
+	}
+	p.normalizeTimes()
+	p.normalizeAmounts()
+	return nil
+}
+
+// normalizeTimes converts all timestamps of the payment to UTC. Returns true if any is changed.
+func (p *Payment) normalizeTimes() bool {
+	times := []*time.Time{&p.CreatedAt, p.LastCheckedAt, p.FulfilledAt, p.NotifiedAt, p.ReceivedAt, p.SentAt, p.FeeSentAt, p.SweepApprovedAt}
+	for _, sp := range p.SubPayments {
+		times = append(times, sp.ConfirmedAt)
+	}
+	for _, sb := range p.SatisfiedBy {
+		times = append(times, sb.ConfirmedAt)
+	}
+	if p.Dispute != nil {
+		times = append(times, &p.Dispute.OpenedAt, p.Dispute.ResolvedAt)
+	}
+	if p.BackfilledRate != nil {
+		times = append(times, &p.BackfilledRate.At, &p.BackfilledRate.FetchedAt)
+	}
+	var changed bool
+	for _, t := range times {
+		if normalizeTime(t) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// migrateUTCTimes rewrites payments with timestamps in local time zone in UTC.
+func migrateUTCTimes(tx *bbolt.Tx) error {
+	n, err := rewritePayments(tx, (*Payment).normalizeTimes)
+	if n > 0 {
+		log.Infof("converted timestamps of %d payments to UTC", n)
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// fakeClock only moves when it is told to.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+// useFakeClock replaces the global clock until the test ends.
+func useFakeClock(t *testing.T, at time.Time) *fakeClock {
+	c := &fakeClock{t: at.UTC()}
+	old := clock
+	clock = c
+	t.Cleanup(func() { clock = old })
+	return c
+}
+
+// Saved by an older version on a host in New York, around the switch to daylight saving time.
+const localPaymentJSON = `{"account":"nano_1local","state":"order-1","createdAt":"2020-03-08T01:30:00-05:00","lastCheckedAt":"2020-03-08T03:10:00-04:00"}`
+
+// deadlineReport describes the result of deadline calculations for a payment saved in local time.
+func deadlineReport(t *testing.T) string {
+	c := useFakeClock(t, time.Date(2020, 3, 8, 7, 20, 0, 0, time.UTC))
+	var p Payment
+	if err := json.Unmarshal([]byte(localPaymentJSON), &p); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored struct {
+		CreatedAt     string `json:"createdAt"`
+		LastCheckedAt string `json:"lastCheckedAt"`
+	}
+	if err = json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	report := fmt.Sprintf("createdAt=%s lastCheckedAt=%s finished=%v remaining=%s next=%s",
+		stored.CreatedAt, stored.LastCheckedAt, p.finished(), p.remainingDuration(), p.NextCheck())
+	c.Add(11 * time.Minute)
+	return report + fmt.Sprintf(" later: finished=%v remaining=%s", p.finished(), p.remainingDuration())
+}
+
+func TestDeadlinesInTimeZones(t *testing.T) {
+	config.setDefaults()
+	config.AllowedDuration = 3600
+	oldLocal := time.Local
+	defer func() { time.Local = oldLocal }()
+	reports := make(map[string]string)
+	for _, name := range []string{"UTC", "America/New_York"} {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skip(err)
+		}
+		time.Local = loc
+		reports[name] = deadlineReport(t)
+	}
+	expected := "createdAt=2020-03-08T06:30:00Z lastCheckedAt=2020-03-08T07:10:00Z finished=false remaining=10m0s"
+	if !strings.HasPrefix(reports["UTC"], expected) {
+		t.Fatalf("unexpected deadlines: %s", reports["UTC"])
+	}
+	if !strings.HasSuffix(reports["UTC"], "later: finished=true remaining=-1m0s") {
+		t.Fatalf("payment is not finished after allowed duration: %s", reports["UTC"])
+	}
+	if reports["UTC"] != reports["America/New_York"] {
+		t.Fatalf("deadlines depend on time zone:\nUTC: %s\nAmerica/New_York: %s", reports["UTC"], reports["America/New_York"])
+	}
+}
+
+func TestMigrateUTCTimes(t *testing.T) {
+	openTestDB(t, 0)
+	err := dbUpdate(func(tx *bbolt.Tx) error {
+		err := tx.Bucket([]byte(paymentsBucket)).Put([]byte("nano_1local"), []byte(localPaymentJSON))
+		if err != nil {
+			return err
+		}
+		return migrateUTCTimes(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbView(func(tx *bbolt.Tx) error {
+		value := string(tx.Bucket([]byte(paymentsBucket)).Get([]byte("nano_1local")))
+		if !strings.Contains(value, `"createdAt":"2020-03-08T06:30:00Z"`) {
+			t.Errorf("payment is not converted to UTC: %s", value)
+		}
+		index := string(tx.Bucket([]byte(statesBucket)).Get(stateIndexKey("order-1", "nano_1local")))
+		if index != "2020-03-08T06:30:00Z" {
+			t.Errorf("state index is not converted to UTC: %s", index)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
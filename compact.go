@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	compactFileSuffix     = ".compact"
+	databaseCheckInterval = 10 * time.Minute
+)
+
+var errRecordCountMismatch = errors.New("record count mismatch after compaction")
+
+// CompactionResult contains information about the last compaction run.
+type CompactionResult struct {
+	StartedAt  time.Time     `json:"startedAt"`
+	Duration   time.Duration `json:"duration"`
+	SizeBefore int64         `json:"sizeBefore"`
+	SizeAfter  int64         `json:"sizeAfter"`
+	Records    int           `json:"records"`
+	Error      string        `json:"error,omitempty"`
+}
+
+var (
+	// compactMu prevents running multiple compactions at the same time.
+	compactMu      sync.Mutex
+	lastCompaction *CompactionResult
+	mLastCompact   sync.Mutex
+)
+
+func getLastCompaction() *CompactionResult {
+	mLastCompact.Lock()
+	defer mLastCompact.Unlock()
+	return lastCompaction
+}
+
+// compactDB writes a compacted copy of the database and replaces the original with it.
+// Writes are paused during the copy. Database is closed only for the duration of rename.
+// If the process crashes before rename, the original file remains intact
+// and the incomplete copy is removed on next start.
+func compactDB() (*CompactionResult, error) {
+	compactMu.Lock()
+	defer compactMu.Unlock()
+
+	result := &CompactionResult{StartedAt: clock.Now()}
+	err := doCompactDB(result)
+	result.Duration = time.Since(result.StartedAt)
+	if err != nil {
+		result.Error = err.Error()
+		metricCompactionFailures.Add(1)
+	} else {
+		metricCompactions.Add(1)
+	}
+	mLastCompact.Lock()
+	lastCompaction = result
+	mLastCompact.Unlock()
+	return result, err
+}
+
+func doCompactDB(result *CompactionResult) error {
+	var err error
+	result.SizeBefore, err = databaseFileSize()
+	if err != nil {
+		return err
+	}
+	tmpPath := config.DatabasePath + compactFileSuffix
+
+	dbWriteMu.Lock()
+	defer dbWriteMu.Unlock()
+
+	log.Noticeln("compacting database into:", tmpPath)
+	var srcCount, dstCount int
+	err = dbView(func(tx *bbolt.Tx) error {
+		var err2 error
+		srcCount, err2 = compactInto(tx, tmpPath)
+		return err2
+	})
+	if err != nil {
+		removeFile(tmpPath)
+		return err
+	}
+	dstCount, err = countRecordsInFile(tmpPath)
+	if err != nil {
+		removeFile(tmpPath)
+		return err
+	}
+	if srcCount != dstCount {
+		removeFile(tmpPath)
+		return fmt.Errorf("%w: %d != %d", errRecordCountMismatch, srcCount, dstCount)
+	}
+	result.Records = dstCount
+
+	err = swapDB(tmpPath)
+	if err != nil {
+		return err
+	}
+	result.SizeAfter, err = databaseFileSize()
+	if err != nil {
+		return err
+	}
+	log.Noticef("database is compacted from %d to %d bytes", result.SizeBefore, result.SizeAfter)
+	return nil
+}
+
+// swapDB replaces the database file with the file at path.
+func swapDB(path string) error {
+	dbSwapMu.Lock()
+	defer dbSwapMu.Unlock()
+	err := db.Close()
+	if err != nil {
+		return err
+	}
+	renameErr := os.Rename(path, config.DatabasePath)
+	if renameErr == nil {
+		syncDir(filepath.Dir(config.DatabasePath))
+	} else {
+		removeFile(path)
+	}
+	// Reopen the database whether the rename is succeeded or not.
+	db, err = bbolt.Open(config.DatabasePath, 0600, nil)
+	if err != nil {
+		log.Fatalln("cannot reopen database after compaction:", err)
+	}
+	return renameErr
+}
+
+// compactInto copies all buckets in tx into a new database at path.
+// Returns the number of records copied.
+func compactInto(tx *bbolt.Tx, path string) (count int, err error) {
+	dst, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err2 := dst.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	err = dst.Update(func(dstTx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			nb, err2 := dstTx.CreateBucket(name)
+			if err2 != nil {
+				return err2
+			}
+			n, err2 := copyBucket(b, nb)
+			count += n
+			return err2
+		})
+	})
+	return count, err
+}
+
+func copyBucket(src, dst *bbolt.Bucket) (int, error) {
+	var count int
+	err := src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nb, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			n, err := copyBucket(src.Bucket(k), nb)
+			count += n
+			return err
+		}
+		count++
+		return dst.Put(k, v)
+	})
+	return count, err
+}
+
+func countRecordsInFile(path string) (count int, err error) {
+	d, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err2 := d.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	err = d.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			count += countBucket(b)
+			return nil
+		})
+	})
+	return count, err
+}
+
+func countBucket(b *bbolt.Bucket) int {
+	var count int
+	_ = b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			count += countBucket(b.Bucket(k))
+		} else {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// removeStaleCompaction removes the copy left from a compaction that is interrupted before rename.
+func removeStaleCompaction() {
+	path := config.DatabasePath + compactFileSuffix
+	if _, err := os.Stat(path); err == nil {
+		log.Warningln("removing incomplete compaction file:", path)
+		removeFile(path)
+	}
+}
+
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Errorln("cannot remove file:", err)
+	}
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Errorln("cannot open directory:", err)
+		return
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		log.Debugln("cannot sync directory:", err)
+	}
+}
+
+// checkDatabaseSize sends an alert once when the database file size goes above the threshold.
+// The returned value must be passed in next call.
+func checkDatabaseSize(alerted bool) bool {
+	if config.DatabaseSizeAlertThreshold <= 0 {
+		return false
+	}
+	size, err := databaseFileSize()
+	if err != nil {
+		log.Errorln("cannot get database size:", err)
+		return alerted
+	}
+	if size < config.DatabaseSizeAlertThreshold {
+		return false
+	}
+	if !alerted {
+		sendAlert("database_size", "database file is too large, consider running compaction with POST /admin/compact", map[string]interface{}{
+			"size":      size,
+			"threshold": config.DatabaseSizeAlertThreshold,
+			"freelist":  dbStats().FreeAlloc,
+		})
+	}
+	return true
+}
+
+func handleAdminCompact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := compactDB()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, result)
+}
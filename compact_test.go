@@ -0,0 +1,104 @@
+package main // nolint: testpackage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func openTestDB(t testing.TB, records int) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "accept-nano-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DatabasePath = filepath.Join(dir, "test.db")
+	err = openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = closeDB()
+		_ = os.RemoveAll(dir)
+	})
+	err = dbUpdate(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(paymentsBucket))
+		for i := 0; i < records; i++ {
+			if err2 := b.Put([]byte(strconv.Itoa(i)), []byte("{}")); err2 != nil {
+				return err2
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countRecords(t *testing.T) int {
+	t.Helper()
+	var count int
+	err := dbView(func(tx *bbolt.Tx) error {
+		count = countBucket(tx.Bucket([]byte(paymentsBucket)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestCompactDB(t *testing.T) {
+	openTestDB(t, 1000)
+	result, err := compactDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Payments and the records of the completed migrations.
+	if result.Records != 1003 {
+		t.Fatalf("unexpected record count in result: %d", result.Records)
+	}
+	if n := countRecords(t); n != 1000 {
+		t.Fatalf("unexpected record count after compaction: %d", n)
+	}
+	if _, err = os.Stat(config.DatabasePath + compactFileSuffix); !os.IsNotExist(err) {
+		t.Fatal("compaction file is not removed")
+	}
+}
+
+// TestCompactCrashBeforeRename simulates a crash after the copy is written but before it replaces the original.
+func TestCompactCrashBeforeRename(t *testing.T) {
+	openTestDB(t, 100)
+	tmpPath := config.DatabasePath + compactFileSuffix
+	err := dbView(func(tx *bbolt.Tx) error {
+		_, err2 := compactInto(tx, tmpPath)
+		return err2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the copy to make sure it is never used.
+	err = ioutil.WriteFile(tmpPath, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Restart
+	err = closeDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRecords(t); n != 100 {
+		t.Fatalf("unexpected record count after restart: %d", n)
+	}
+	if _, err = os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Fatal("stale compaction file is not removed")
+	}
+}
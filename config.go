@@ -1,50 +1,211 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+
 	"github.com/BurntSushi/toml"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/shopspring/decimal"
+	"github.com/ulule/limiter/v3"
 )
 
 type Config struct {
+	// Named set of defaults for a deployment: "kiosk", "invoicing" or "high-volume".
+	// Settings in config file and environment override the profile.
+	Profile string
 	// Print debug level log messages to console.
 	EnableDebugLog bool
 	// Created payment requests are saved in this database. Do not lose this file.
 	DatabasePath string
+	// Optional SQL database for payments, shared by instances: "postgres://..." or "sqlite:<path>".
+	// Migrations are run at startup. Start with -migrate-from-bolt once to copy payments from DatabasePath.
+	// Other data is kept in DatabasePath.
+	DatabaseURL string
 	// Listen address for HTTP server.
 	ListenAddress string
+	// Admin endpoints are served on this address instead of ListenAddress if set, so they can be kept off the public network.
+	AdminListenAddress string
 	// Optional TLS certificate and key if you want to serve over HTTPS.
+	// Files are reloaded when they change on disk.
 	CertFile, KeyFile string
+	// Alert when TLS certificate expires in less than this many days.
+	CertExpiryAlertDays int
+	// Certificates are obtained and renewed from Let's Encrypt if hosts are set. CertFile and KeyFile take precedence.
+	AutoTLS AutoTLS
+	// Node is on a test network. Required for EnableFaults.
+	Testnet bool
+	// Enable fault injection via /admin/faults for testing clients in staging environments.
+	EnableFaults bool
 	// URL of a running node.
 	NodeURL string `envconfig:"NODE_URL"`
-	// Websocket URL of a running node.
+	// URLs of nodes tried in order. A request goes to the next node when a node cannot be reached. NodeURL is used if empty.
+	NodeURLs []string `envconfig:"NODE_URLS"`
+	// Node is skipped after this many consecutive failures until it responds to a probe.
+	NodeFailureThreshold int
+	// Skipped nodes are probed in this interval (seconds).
+	NodeProbeInterval int
+	// Websocket URL of a running node. Payments are checked when the node confirms a block of their accounts.
 	NodeWebsocketURL string `envconfig:"NODE_WEBSOCKET_URL"`
+	// Delay before reconnecting to the websocket, doubled after each failed attempt up to NodeWebsocketMaxBackoff (milliseconds).
+	NodeWebsocketMinBackoff int
+	NodeWebsocketMaxBackoff int
 	// Timeout for requests made to Node URL (milliseconds).
 	NodeTimeout uint
+	// Node calls, including retries and requests to the other NodeURLs, are given up after this duration (milliseconds).
+	// work_generate calls are limited by NodeTimeout only.
+	NodeCallTimeout int
+	// Read-only node calls are retried this many times when no node can be reached. Negative for no retries.
+	// Blocks are never published twice.
+	NodeRetries int
+	// Delay before the first retry, doubled after each attempt, with random jitter (milliseconds).
+	NodeRetryBackoff int
+	// Node calls fail fast for NodeBreakerCooldown seconds after NodeBreakerThreshold consecutive calls
+	// could not reach any node. Negative threshold disables the breaker.
+	NodeBreakerThreshold int
+	NodeBreakerCooldown  int
+	// work_generate endpoints, such as nano-work-server or DPoW, asked in order for the work of receive and send blocks.
+	// Node is asked if all of them fail. Work is generated on this host if empty.
+	WorkServerURLs []string `envconfig:"WORK_SERVER_URLS"`
+	// Timeout for requests made to WorkServerURLs (milliseconds).
+	WorkServerTimeout int
+	// Minimum work difficulty of send and receive blocks in hex, e.g. "fffffff800000000". Defaults are used if empty.
+	WorkDifficultySend    string
+	WorkDifficultyReceive string
+	// Dependency checks of /health endpoint are given up after this duration (milliseconds).
+	HealthTimeout int
+	// Check that the price source responds in /health. Price is not critical, a failure does not make the instance unhealthy.
+	HealthCheckPrice bool
+	// Received blocks kept in a payment record. Later blocks are aggregated into a single total.
+	MaxSubPayments int
+	// Limit for the JSON encoded metadata of payments and presets (bytes).
+	MaxMetadataSize int
+	// Retried /api/pay requests with the same Idempotency-Key get the payment created first within this duration (seconds).
+	// Keys are kept at least until their payment expires.
+	IdempotencyWindow int
+	// Static values returned in the "extra" object of every payment response, such as a support contact or store ID.
+	// Values are strings, numbers or booleans. Keys cannot be the names of response fields.
+	ExtraResponseFields map[string]interface{}
+	// /api/verify waits this long for a running check of the payment, so it does not miss a change being saved (milliseconds).
+	VerifyLockWait int
+	// Node version is fetched in this interval (seconds). Operator is alerted when its major version changes.
+	NodeVersionRefreshInterval int
+	// Maximum number of concurrent requests to the node. Requests over the limit wait for a free slot.
+	// Waiting API requests get the next slot, then payment checks, then background jobs such as recovery scan.
+	NodeConcurrency int
+	// Requests of each priority fail after waiting this long for a free slot (milliseconds). No limit if zero.
+	NodeQueueTimeoutInteractive int
+	NodeQueueTimeoutChecker     int
+	NodeQueueTimeoutBackground  int
 	// Funds will be sent to this address.
 	Account string `envconfig:"ACCOUNT"`
+	// ID of the node wallet holding the key of Account. Refunds of payments already sent to Account are sent from it.
+	MerchantWallet string
 	// Representative for created deposit accounts.
 	Representative string
 	// Seed to generate private keys from.
 	// This is not your Account seed!
-	// You can generate a new seed with -seed flag.
+	// You can generate a new seed with "generate-seed" command.
 	// This seed will also be used for signing JWT tokens.
 	Seed string `envconfig:"SEED"`
+	// Start even if Seed looks generated by hand. Only for testing.
+	AllowWeakSeed bool
+	// Allow sandbox payments, created with sandbox=true in /api/pay and fulfilled with /api/sandbox/fulfill
+	// without moving funds. Only for integration testing, never enable in production.
+	SandboxMode bool
+	// Seeds used before Seed was replaced. Ownership check reports accounts derived from them,
+	// but their funds are not moved because keys are derived only from Seed.
+	LegacySeeds []string
+	// Re-derive the key of payments on load and block moving funds of the ones not matching their account.
+	// One of "off", "sample" (IntegritySampleRate of loads) or "full" (first load of every payment in the process).
+	IntegrityMode string
+	// Fraction of loads checked in "sample" IntegrityMode, between 0 and 1.
+	IntegritySampleRate float64
 	// When customer sends the funds, merhchant will be notified at this URL.
 	NotificationURL string
+	// Notifications are signed with HMAC-SHA256 of the body using this secret if set.
+	// Signature is sent in X-Signature header as "sha256=<hex>".
+	NotificationSecret string `envconfig:"NOTIFICATION_SECRET"`
+	// Daily digest of all payments is posted to this URL.
+	DigestURL string
+	// Digest of the previous day is sent at this hour (UTC).
+	DigestHour int
+	// Path of a text/template file rendering the text of the digest. A built-in template is used if empty.
+	DigestTemplate string
+	// Give up notifying the merchant of a payment after this many failed attempts and move on to the sweep.
+	// Attempts are made on each check of the payment, so they are spaced like the checks. 0 means no limit.
+	NotificationMaxAttempts int
+	// Deliver notifications from a persisted outbox in background instead of during the payment check.
+	// Payment moves on to the sweep when its notification is saved to the outbox.
+	OutboxEnabled bool
+	// Delay before retrying a failed delivery, doubled after each attempt up to OutboxMaxBackoff (milliseconds).
+	OutboxMinBackoff int
+	OutboxMaxBackoff int
+	// Delivery is given up after this many attempts. Retried forever if zero.
+	OutboxMaxAttempts int
+	// Deliveries to a host are paused after this many consecutive failures.
+	OutboxBreakerThreshold int
+	// Paused host is probed with a single delivery after this duration (milliseconds).
+	OutboxBreakerCooldown int
+	// Timeout of a delivery request (milliseconds).
+	OutboxTimeout int
 	// Give some time to unfinished HTTP requests before shutting down the server (milliseconds).
 	ShutdownTimeout uint
-	// Limit payment creation requests to prevent DOS attack.
+	// Give some time to running payment checks before closing the database (milliseconds).
+	// Checks still running are cancelled and resumed at the next start.
+	ShutdownGracePeriod uint
+	// Limit requests to public endpoints from an IP to prevent DOS attack, e.g. "60-H" for 60 per hour.
 	RateLimit string
+	// Limits of /api/pay and /api/price requests from an IP. Default to RateLimit.
+	PayRateLimit, PriceRateLimit string
+	// Addresses or CIDRs of reverse proxies. For requests from them, the client IP is read from
+	// X-Forwarded-For or X-Real-IP and used for rate limits and request logs.
+	TrustedProxies []string
 	// Payments below this amount are ignored.
 	ReceiveThreshold string
 	// Maximum number of payments allowed to fulfill the expected amount.
 	MaxPayments int
+	// Pending blocks are requested from the node in pages of this size.
+	PendingPageSize int
+	// Pages of pending blocks read in a single check. Later pages are read in the next checks.
+	PendingPagesPerCheck int
 	// Up to this amount underpayments are accepted. Amount in NANO.
 	UnderPaymentToleranceFixed float64
 	// Up to this amount underpayments are accepted. Amount in percent.
 	UnderPaymentTolerancePercent float64
 	// Max allowed time for payment after it is created (seconds).
 	AllowedDuration int
+	// Range of the timeout parameter of /api/pay (seconds). Requests outside the range are refused.
+	MinPaymentTimeout int
+	MaxPaymentTimeout int
+	// Detected funds that fulfill the payment but are not confirmed by the network yet are waited for this long,
+	// even after the payment expires (seconds). Then the payment stays in pending_confirmation state and operator is alerted.
+	RequiredConfirmationTimeout int
+	// Range of amounts accepted by /api/pay, after conversion from the currency. Amounts in NANO, empty for no limit.
+	MinPayment, MaxPayment string
+	// Database transactions taking longer than this are logged with their caller (milliseconds).
+	SlowTransactionThreshold int
+	// Scans over all payments read this many records per transaction.
+	ScanChunkSize int
+	// Upper limit for X-Request-Deadline-Ms header (milliseconds).
+	MaxRequestDeadline int
+	// Funds arriving to an expired payment within this duration after expiry are held for admin to fulfill or refund (seconds).
+	// Funds arriving later are reported as orphan funds. Late funds fulfill the payment if zero.
+	LatePaymentWindow int
+	// Hot wallets of exchanges. Funds of expired payments are not refunded automatically to these accounts,
+	// because the exchange may not credit them to the customer, unless AllowExchangeRefunds is set.
+	ExchangeAccounts     []string
+	AllowExchangeRefunds bool
+	// Finished payments are checked for funds sent to them later and the funds are sent to Account in this interval (seconds).
+	// Disabled if zero. A sweep can also be started at /admin/sweep.
+	LeftoverSweepInterval int
+	// Number of accounts queried from node at once in a leftover sweep.
+	LeftoverSweepBatchSize int
+	// Wait between node requests of a leftover sweep, so it does not overload the node (milliseconds).
+	LeftoverSweepDelay int
 	// Parameter for calculating next check time of the payment.
 	// Time passed since the creation of payment request is divided to this number.
 	NextCheckDurationFactor int
@@ -52,11 +213,342 @@ type Config struct {
 	MinNextCheckDuration int
 	// Max allowed duration to check the payment (seconds).
 	MaxNextCheckDuration int
+	// Payments are checked every FastCheckInterval seconds for FastCheckDuration seconds after they are created
+	// or a new block is seen for them. FastCheckInterval may be shorter than MinNextCheckDuration.
+	// Fast checks are disabled if FastCheckDuration is negative.
+	FastCheckInterval int
+	FastCheckDuration int
+	// Running checks are inspected for being stuck at this interval (seconds).
+	WatchdogInterval int
+	// Check is cancelled if it is still running this many times its wait interval after its scheduled time.
+	StuckCheckFactor int
+	// Alert is sent when this many checks are found stuck at once.
+	StuckCheckAlertThreshold int
+	// Number of payment checks that can run concurrently.
+	CheckWorkers int
+	// Max share of check workers given to priority tiers while default tier payments are waiting (percent).
+	PriorityWorkerShare int
+	// New payments are created with a degraded warning when queued checks reach AdmissionSoftQueue percent of CheckWorkers
+	// or the median wait of checks reaches AdmissionSoftLag seconds. Disabled if zero.
+	AdmissionSoftQueue int
+	AdmissionSoftLag   int
+	// /api/pay is refused with 503 when queued checks reach AdmissionHardQueue percent of CheckWorkers
+	// or the median wait of checks reaches AdmissionHardLag seconds. Disabled if zero.
+	AdmissionHardQueue int
+	AdmissionHardLag   int
+	// Accept payments of API keys marked NonInteractive over the hard threshold instead of refusing them.
+	// Their checks wait in the queue.
+	AdmissionQueueNonInteractive bool
+	// Poll interval suggested to clients of payments created over the soft threshold (seconds).
+	AdmissionPollSeconds int
+	// Retry-After of refused /api/pay requests (seconds).
+	AdmissionRetryAfter int
+	// Partition checking of active payments between instances sharing the payment store.
+	Partitioning bool
+	// Unique name of this instance. Generated if empty.
+	InstanceID string
+	// Interval for sending heartbeats and finding new payments when Partitioning is enabled (seconds).
+	HeartbeatInterval int
+	// Instance is removed from partitions if no heartbeat is received for this duration (seconds).
+	HeartbeatTTL int
+	// Checker settings by tier name.
+	CheckerTiers map[string]CheckerTier
+	// Settings of API keys. Clients pass the key in X-API-Key or "Authorization: Bearer" header.
+	APIKeys map[string]APIKey
+	// Shops served by this instance by merchant ID. Payments without a merchant use Seed, Account and NotificationURL.
+	Merchants map[string]Merchant
+	// Payments can be created by preset name with /api/pay?preset=NAME.
+	// More presets can be added at /admin/presets.
+	Presets map[string]Preset
+	// Reject payment requests without state.
+	RequireState bool
+	// Regular expression that state must match if set.
+	StatePattern string
+	// Max number of payments with the same state created within DuplicateStateWindow. Unlimited if zero.
+	MaxDuplicateStates int
+	// Window for MaxDuplicateStates (seconds).
+	DuplicateStateWindow int
+	// Origins allowed for browser clients, used for both CORS and websocket Origin check.
+	// All origins are allowed if empty. A "*" in an origin matches any characters, e.g. "https://*.example.com".
+	AllowedOrigins []string
+	// Origins allowed for CORS requests if different from AllowedOrigins.
+	CORSAllowedOrigins []string
+	// Request headers allowed in CORS requests in addition to Origin, Accept, Content-Type and X-Requested-With.
+	CORSAllowedHeaders []string
+	// Allow cookies and authorization headers in CORS requests. Origins must be listed explicitly.
+	CORSAllowCredentials bool
+	// Disable passing token as a query parameter on websocket connections.
+	// Clients must send the token in the first message instead.
+	DisableWebsocketQueryToken bool
+	// Max number of messages queued for a websocket client.
+	// If the client is slower, queued messages are dropped and {"resync":true} is sent
+	// so the client can fetch the current state from /api/verify.
+	WebsocketQueueSize int
+	// Time limit for writing a message to a websocket client (seconds).
+	WebsocketWriteTimeout int
+	// Websocket clients are pinged at this interval (milliseconds), so proxies do not close idle connections.
+	// Pings are disabled if negative.
+	WebsocketPingInterval int
+	// Connections are closed if nothing, including a pong, is received for WebsocketPingInterval plus this duration (milliseconds).
+	WebsocketPongTimeout int
+	// Maximum number of tokens a websocket client can subscribe to over one connection.
+	WebsocketMaxSubscriptions int
+	// Interval of keepalive comments on /api/events streams (milliseconds).
+	EventStreamKeepaliveInterval int
+	// Websocket sessions are kept for this duration after the client disconnects (seconds),
+	// so reconnecting with the same token is served from memory. Disabled if zero.
+	WebsocketSessionTTL int
+	// Maximum number of cached websocket sessions.
+	WebsocketSessionCacheSize int
+	// Subscriptions of websocket sessions without open connections are cancelled at this interval (seconds).
+	SubscriptionSweepInterval int
+	// Time limit for the client to send the token after websocket connection is opened (seconds).
+	WebsocketAuthTimeout int
+	// Values of iss and aud claims of tokens.
+	TokenIssuer   string
+	TokenAudience string
+	// Tokens created by older versions without registered claims are refused after this time (RFC 3339).
+	// They are accepted forever if empty.
+	AcceptLegacyTokensUntil string
+	// Tokens signed with a key generated by /admin/keys/rotate expire after this duration (seconds).
+	// Previous key is retired after the tokens signed with it are expired.
+	TokenLifetime int
+	// Next key is published at /api/keys for this duration before tokens are signed with it (seconds).
+	KeyRotationOverlap int
+	// Handling of legacy request parameters by name, "map" (default), "warn" or "reject".
+	// See deprecatedParams in deprecation.go for the names. Legacy forms are mapped to the modern ones unless rejected.
+	// Warned and rejected requests get a Deprecation response header.
+	DeprecatedParams map[string]string
+	// Sunset header is added to responses with Deprecation header if set (RFC 3339).
+	DeprecationSunset string
 	// Password for accessing admin endpoints.
-	// Admin endpoints are protected with HTTP basic auth. Username is "admin".
+	// Admin endpoints are protected with HTTP basic auth. Username is "admin". Credentials are compared in constant time.
 	AdminPassword string `envconfig:"ADMIN_PASSWORD"`
+	// Limit of failed admin logins from an IP, e.g. "10-M". Further requests from the IP are refused until the period ends.
+	AdminAuthFailureLimit string
+	// Merchant name displayed on receipts.
+	MerchantName string
+	// URL that the service is reachable at from browsers, e.g. "https://pay.example.com".
+	// Widget config contains absolute API and websocket URLs if set, paths otherwise.
+	PublicURL string
+	// Fiat currencies listed in widget config. Only NANO is listed if PriceProviders is empty.
+	WidgetCurrencies []string
+	// Color of the widget border, e.g. "#4a90e2".
+	WidgetAccentColor string
+	// Days that superseded widget versions are still served, with Deprecation header.
+	WidgetDeprecationWindow int
+	// Serve the checkout page at /checkout/<token>.
+	EnableCheckoutPage bool
+	// The success_url parameter of the checkout page must start with one of these URLs, e.g. "https://shop.example.com/orders/".
+	CheckoutSuccessURLs []string
+	// Color of the checkout page buttons and borders. WidgetAccentColor is used if empty.
+	CheckoutAccentColor string
+	// Texts displayed on the checkout page.
+	CheckoutText CheckoutText
+	// Largest size of QR codes served at /api/qr (pixels). Larger requested sizes are clamped.
+	QRMaxSize int
+	// Maximum number of currencies in display_currencies parameter of /api/pay and /api/verify.
+	MaxDisplayCurrencies int
+	// Image (PNG or JPEG) drawn at the center of QR codes with error correction level Q or H.
+	QRLogoFile string
+	// Link template for blocks displayed on receipts. "{hash}" is replaced with the block hash.
+	// Example: "https://nanocrawler.cc/explorer/block/{hash}"
+	BlockExplorerURL string
 	// Coinmarketcap API Key
 	CoinmarketcapAPIKey string
+	// Schemes and ports allowed for node URLs supplied to /api/proof/verify by third parties.
+	ProofNodeAllowedSchemes []string
+	ProofNodeAllowedPorts   []int
+	// Operator alerts are posted to this URL in JSON format.
+	AlertURL string
+	// Requests to these paths are logged with their responses. Paths ending with a slash match paths under them.
+	// Logging can also be enabled for an API key or IP via /admin/http-log.
+	HTTPLogRoutes []string
+	// Percent of requests to HTTPLogRoutes that are logged.
+	HTTPLogSamplePercent int
+	// Bodies are truncated to this size in HTTP log entries (bytes).
+	HTTPLogMaxBodySize int
+	// HTTP log entries are appended to this file as JSON lines. Normal log is used if empty.
+	HTTPLogFile string
+	// Format of the access log line written for every request: "text", "json" or "off".
+	AccessLogFormat string
+	// Access log lines are appended to this file. Normal log is used if empty.
+	AccessLogFile string
+	// Aggregate stats published at /api/stats/public. Disabled if empty.
+	// Allowed fields are "total_verified", "median_verification_seconds", "verified_within_percent" and "uptime_seconds".
+	PublicStatsFields []string
+	// Public stats are collected at most once in this duration (seconds).
+	PublicStatsCacheDuration int
+	// Threshold for verified_within_percent public stat (seconds).
+	PublicStatsVerifiedWithin int
+	// Compact the database file periodically (seconds). Disabled if zero.
+	// Compaction can also be triggered manually via POST /admin/compact.
+	CompactionInterval int
+	// S3 compatible object storage for exports. Objects are uploaded with path-style URLs.
+	// Export can be triggered via POST /admin/export-to-object-storage.
+	ObjectStorageEndpoint  string
+	ObjectStorageRegion    string
+	ObjectStorageBucket    string
+	ObjectStorageAccessKey string `envconfig:"OBJECT_STORAGE_ACCESS_KEY"`
+	ObjectStorageSecretKey string `envconfig:"OBJECT_STORAGE_SECRET_KEY"`
+	// Prepended to the names of exported objects.
+	ObjectStoragePrefix string
+	// Export payments to object storage periodically (seconds). Disabled if zero.
+	ObjectStorageExportInterval int
+	// Size of each uploaded part (bytes). Must be at least 5 MiB.
+	ObjectStoragePartSize int
+	// Number of retries for a failed part upload.
+	ObjectStoragePartRetries int
+	// Redis server (host:port) that holds the locks of money moving operations.
+	// Advisory locks of the database are used if it is empty and DatabaseURL is a Postgres database.
+	// Must be set when Partitioning is enabled with other stores.
+	LockRedisAddress string
+	// Lock leases expire if the instance holding them cannot renew them in this duration (seconds).
+	LockLeaseTTL int
+	// Money moving operations fail if the lock of the account cannot be acquired in this duration (seconds).
+	LockWaitTimeout int
+	// Send an alert suggesting compaction when database file is larger than this (bytes). Disabled if zero.
+	DatabaseSizeAlertThreshold int64
+	// How often SLA alerts are evaluated (seconds).
+	SLAEvaluationInterval int
+	// Alert if no payment is verified in this many minutes while at least SLANoVerificationMinCreated payments are created.
+	// Disabled if zero.
+	SLANoVerificationMinutes    int
+	SLANoVerificationMinCreated int
+	// Alert if median time between creation and verification of payments in the last hour is above this (seconds).
+	// Disabled if zero.
+	SLAMaxMedianLatency int
+	// Alert if node cannot be reached for more than this duration (seconds). Disabled if zero.
+	SLANodeUnreachableSeconds int
+	// Service enters degraded mode when the error rate of node requests in NodeErrorWindow reaches this (percent).
+	// Customers see serviceStatus "degraded" and DegradedMessage in API responses. Disabled if zero.
+	DegradedErrorRate float64
+	// Degraded mode is not entered before this many requests are made in the window.
+	DegradedMinRequests int
+	// Degraded mode is exited after error rate stays below this for DegradedCooldown (percent).
+	DegradedRecoveryRate float64
+	DegradedCooldown     int
+	// Window for calculating the error rate of node requests (seconds).
+	NodeErrorWindow int
+	// Message displayed to customers in degraded mode.
+	DegradedMessage string
+	// Alert is resolved after its condition stays clear for this duration (seconds).
+	SLAAlertRecoveryTime int
+	// Alert when a signal counted per minute, e.g. payments created with an API key, exceeds its
+	// moving baseline this many times. Disabled if zero.
+	AnomalyThreshold float64
+	// Signals with fewer events than this in a minute are not reported.
+	AnomalyMinCount int
+	// Same signal is not reported again for this duration (seconds).
+	AnomalyCooldown int
+	// Funds are left on payment accounts when false. Payments are still verified and received,
+	// but nothing is sent from payment accounts. Defaults to true.
+	SweepEnabled *bool
+	// Alert when funds received and not yet sent to the merchant total more than this on all payment accounts (NANO).
+	// New payments are refused while exceeded unless SweepEnabled is false. Disabled if empty.
+	ExposureAlertThreshold string
+	// Recurring maintenance windows start at the times matching this cron expression in UTC,
+	// e.g. "0 2 * * 0" for Sundays at 02:00. Alerts are suppressed and background jobs are deferred in a window.
+	MaintenanceSchedule string
+	// Length of scheduled maintenance windows (minutes).
+	MaintenanceDuration int
+	// Background jobs run up to this percent of their interval later than due, so they do not all run at the same time.
+	JobJitter int
+	// Optional account to collect a platform fee on sweep.
+	// When set, received funds are split between Account and FeeAccount.
+	FeeAccount string
+	// Fee taken from received funds in percent (e.g. "2.5").
+	FeePercent string
+	// Fixed fee taken from received funds in raw. Cannot be used with FeePercent.
+	FeeFixedRaw string
+	// Which side keeps the fraction of raw left over from percentage fee calculation.
+	// Can be "merchant" or "fee".
+	FeeRemainderPolicy string
+	// Fiat currency for historical rates backfilled for payments requested in NANO.
+	// Backfill can be started with POST /admin/backfill.
+	BackfillCurrency string
+	// Wait between requests to the historical price provider during backfill (milliseconds).
+	BackfillRequestInterval int
+	// Price providers in failover order. Supported providers are "coinmarketcap" and "coingecko".
+	// Coinmarketcap is skipped if CoinmarketcapAPIKey is empty.
+	PriceProviders []string
+	// How to choose the price provider to fetch from. Can be "ordered" or "fastest".
+	// "ordered" tries PriceProviders in order. "fastest" tries healthy providers with the
+	// lowest moving latency adjusted for failures first.
+	ProviderSelection string
+	// Price is fetched again when the cached price gets older than this (seconds).
+	PriceCacheDuration int
+	// Cached price is served while ticker is down until it gets older than this (seconds).
+	PriceMaxStaleness int
+	// What to do on payment requests when price is older than PriceMaxStaleness.
+	// "refuse" returns an error. "flag" accepts the payment with the stale price
+	// and holds the sweep until an admin approves it.
+	PriceStalePolicy string
+	// Ledger account names used in accounting exports.
+	AccountingDepositsAccount string
+	AccountingMerchantAccount string
+	AccountingRevenueAccount  string
+	AccountingFeesAccount     string
+	AccountingRefundsAccount  string
+	// Expense account for payments written off after disputes.
+	AccountingWrittenOffAccount string
+}
+
+// AutoTLS configures certificates from Let's Encrypt. HTTPS is served on ListenAddress, ":443" by default.
+type AutoTLS struct {
+	// Certificates are only issued for these names. Handshakes for other names are refused.
+	Hosts []string
+	// Certificates and the account key are kept in this directory. It must be writable.
+	CacheDir string
+	// Contact address for notices about the certificates. Optional.
+	Email string
+	// Listen address for HTTP-01 challenges. Other HTTP requests are redirected to HTTPS.
+	HTTPAddress string
+}
+
+// CheckerTier overrides how often payments are checked.
+// Zero values fall back to global settings.
+// Checks cannot be scheduled more often than the global MinNextCheckDuration, except the fast checks of new payments.
+type CheckerTier struct {
+	// Payments in a priority tier are checked first when check workers are saturated.
+	Priority                bool
+	NextCheckDurationFactor int
+	MaxNextCheckDuration    int
+}
+
+// APIKey contains settings for payments created with the key.
+// State policy fields override the global ones when set.
+type APIKey struct {
+	// Payments are checked with the settings of this tier from CheckerTiers.
+	Tier               string
+	RequireState       bool
+	StatePattern       string
+	MaxDuplicateStates int
+	// Daily digest of the payments created with this key is posted to this URL.
+	DigestURL string
+	// Set for keys of backends creating payments without a customer waiting.
+	// Their payments are accepted over the hard admission threshold if AdmissionQueueNonInteractive is set.
+	NonInteractive bool
+	// Added to ExtraResponseFields in the responses of payments created with the key, replacing the global values.
+	ExtraResponseFields map[string]interface{}
+	// Requests with the key are not limited by the IP rate limits. This limits them instead, e.g. "1000-M". No limit if empty.
+	RateLimit string
+	// Default on_expiry_with_funds of payments created with the key: "hold", "auto_refund" or "notify_credit".
+	OnExpiryWithFunds string
+	// Payments created with the key belong to this merchant. Set for the APIKey of Merchants.
+	Merchant string
+}
+
+// Merchant is a shop with its own deposit accounts, destination account and notifications.
+type Merchant struct {
+	// Deposit accounts are derived from this seed. Seed is used if empty, and the merchant shares its keyspace.
+	Seed string
+	// Verified funds are sent to this account.
+	Account string
+	// Notifications of the payments are posted to this URL. NotificationURL is used if empty.
+	NotificationURL string
+	// Payments created with this key belong to the merchant. It is added to APIKeys if it is not there.
+	APIKey string
 }
 
 func (c *Config) Read() error {
@@ -68,7 +560,326 @@ func (c *Config) Read() error {
 	if err != nil {
 		return err
 	}
+	err = c.applyProfile()
+	if err != nil {
+		return err
+	}
 	c.setDefaults()
+	err = c.validate()
+	if err != nil {
+		return err
+	}
+	return c.checkSeed()
+}
+
+func (c *Config) validate() error {
+	if err := c.validateProfile(); err != nil {
+		return err
+	}
+	if c.MaintenanceSchedule != "" {
+		if _, err := parseCronSchedule(c.MaintenanceSchedule); err != nil {
+			return fmt.Errorf("invalid MaintenanceSchedule: %w", err)
+		}
+		if c.MaintenanceDuration <= 0 || time.Duration(c.MaintenanceDuration)*time.Minute > maxMaintenanceDuration {
+			return fmt.Errorf("MaintenanceDuration must be between 1 and %d minutes", int(maxMaintenanceDuration.Minutes()))
+		}
+	}
+	if c.DatabaseURL != "" {
+		if _, _, err := sqlDataSource(c.DatabaseURL); err != nil {
+			return err
+		}
+	}
+	for _, rate := range []string{c.RateLimit, c.PayRateLimit, c.PriceRateLimit, c.AdminAuthFailureLimit} {
+		if _, err := limiter.NewRateFromFormatted(rate); err != nil {
+			return fmt.Errorf("invalid rate limit %q: %w", rate, err)
+		}
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	if c.FastCheckInterval < 0 {
+		return errors.New("FastCheckInterval must be positive")
+	}
+	for _, s := range []string{c.WorkDifficultySend, c.WorkDifficultyReceive} {
+		if _, err := parseWorkDifficulty(s); err != nil {
+			return fmt.Errorf("invalid work difficulty %q: %w", s, err)
+		}
+	}
+	if err := c.AutoTLS.validate(); err != nil {
+		return err
+	}
+	if c.JobJitter < 0 || c.JobJitter > 100 {
+		return errors.New("JobJitter must be between 0 and 100")
+	}
+	if c.DigestHour < 0 || c.DigestHour > 23 {
+		return errors.New("DigestHour must be between 0 and 23")
+	}
+	if c.DigestTemplate != "" {
+		if _, err := template.ParseFiles(c.DigestTemplate); err != nil {
+			return err
+		}
+	}
+	if c.PendingPageSize < 0 || c.PendingPagesPerCheck < 0 {
+		return errors.New("PendingPageSize and PendingPagesPerCheck cannot be negative")
+	}
+	if c.ObjectStoragePartSize < minExportPartSize {
+		return errors.New("ObjectStoragePartSize must be at least 5 MiB")
+	}
+	if c.ObjectStorageExportInterval > 0 && (c.ObjectStorageEndpoint == "" || c.ObjectStorageBucket == "") {
+		return errors.New("ObjectStorageEndpoint and ObjectStorageBucket must be set for ObjectStorageExportInterval")
+	}
+	for _, seed := range c.LegacySeeds {
+		if _, err := hex.DecodeString(seed); err != nil || len(seed) != seedLength {
+			return errors.New("LegacySeeds must be hex encoded seeds")
+		}
+	}
+	if c.LockLeaseTTL < 3 {
+		return errors.New("LockLeaseTTL must be at least 3 seconds")
+	}
+	if c.LockWaitTimeout <= 0 {
+		return errors.New("LockWaitTimeout must be positive")
+	}
+	if c.Partitioning && c.LockRedisAddress == "" {
+		if driver, _, _ := sqlDataSource(c.DatabaseURL); driver != "postgres" {
+			return errors.New("LockRedisAddress or a Postgres DatabaseURL must be set when Partitioning is enabled")
+		}
+	}
+	if c.AnomalyThreshold != 0 && c.AnomalyThreshold <= 1 {
+		return errors.New("AnomalyThreshold must be greater than 1")
+	}
+	if c.DegradedErrorRate > 0 && c.DegradedRecoveryRate > c.DegradedErrorRate {
+		return errors.New("DegradedRecoveryRate cannot be greater than DegradedErrorRate")
+	}
+	if err := validatePublicStatsFields(c.PublicStatsFields); err != nil {
+		return err
+	}
+	if c.EnableFaults && !c.Testnet {
+		return errors.New("EnableFaults can only be set with Testnet")
+	}
+	if c.CORSAllowCredentials {
+		origins := c.CORSAllowedOrigins
+		if len(origins) == 0 {
+			origins = c.AllowedOrigins
+		}
+		if len(origins) == 0 || stringInSlice("*", origins) {
+			return errors.New("CORSAllowCredentials cannot be used when all origins are allowed")
+		}
+	}
+	if c.FeePercent != "" && c.FeeFixedRaw != "" {
+		return errors.New("FeePercent and FeeFixedRaw cannot be set together")
+	}
+	if c.FeePercent != "" {
+		percent, err := decimal.NewFromString(c.FeePercent)
+		if err != nil {
+			return fmt.Errorf("invalid FeePercent: %w", err)
+		}
+		if percent.IsNegative() || percent.GreaterThan(decimal.New(100, 0)) { // nolint: gomnd
+			return errors.New("FeePercent must be between 0 and 100")
+		}
+	}
+	if c.FeeFixedRaw != "" {
+		fixed, err := decimal.NewFromString(c.FeeFixedRaw)
+		if err != nil {
+			return fmt.Errorf("invalid FeeFixedRaw: %w", err)
+		}
+		if err = validateRaw(fixed); err != nil {
+			return fmt.Errorf("invalid FeeFixedRaw: %w", err)
+		}
+	}
+	if c.NodeWebsocketMinBackoff < 0 || c.NodeWebsocketMaxBackoff < c.NodeWebsocketMinBackoff {
+		return errors.New("NodeWebsocketMaxBackoff cannot be less than NodeWebsocketMinBackoff")
+	}
+	if c.NodeFailureThreshold < 0 || c.NodeProbeInterval < 0 {
+		return errors.New("NodeFailureThreshold and NodeProbeInterval cannot be negative")
+	}
+	if c.NodeCallTimeout < 0 || c.NodeRetryBackoff < 0 || c.NodeBreakerCooldown < 0 {
+		return errors.New("NodeCallTimeout, NodeRetryBackoff and NodeBreakerCooldown cannot be negative")
+	}
+	if c.NodeConcurrency < 0 {
+		return errors.New("NodeConcurrency cannot be negative")
+	}
+	if c.HTTPLogSamplePercent < 0 || c.HTTPLogSamplePercent > 100 {
+		return errors.New("HTTPLogSamplePercent must be between 0 and 100")
+	}
+	if c.TokenLifetime < 0 || c.KeyRotationOverlap < 0 {
+		return errors.New("TokenLifetime and KeyRotationOverlap cannot be negative")
+	}
+	if c.AcceptLegacyTokensUntil != "" {
+		if _, err := time.Parse(time.RFC3339, c.AcceptLegacyTokensUntil); err != nil {
+			return fmt.Errorf("invalid AcceptLegacyTokensUntil: %w", err)
+		}
+	}
+	if c.QRMaxSize < qrMinSize {
+		return fmt.Errorf("QRMaxSize cannot be less than %d", qrMinSize)
+	}
+	switch c.AccessLogFormat {
+	case accessLogText, accessLogJSON, accessLogOff:
+	default:
+		return fmt.Errorf("invalid AccessLogFormat: %q", c.AccessLogFormat)
+	}
+	if c.HTTPLogMaxBodySize < 0 {
+		return errors.New("HTTPLogMaxBodySize cannot be negative")
+	}
+	if c.MaxRequestDeadline < 0 {
+		return errors.New("MaxRequestDeadline cannot be negative")
+	}
+	if c.WebsocketPongTimeout < 0 {
+		return errors.New("WebsocketPongTimeout cannot be negative")
+	}
+	if c.WebsocketMaxSubscriptions < 0 {
+		return errors.New("WebsocketMaxSubscriptions cannot be negative")
+	}
+	if c.EventStreamKeepaliveInterval < 0 {
+		return errors.New("EventStreamKeepaliveInterval cannot be negative")
+	}
+	if c.RequiredConfirmationTimeout < 0 {
+		return errors.New("RequiredConfirmationTimeout cannot be negative")
+	}
+	if c.LatePaymentWindow < 0 {
+		return errors.New("LatePaymentWindow cannot be negative")
+	}
+	if c.PublicURL != "" && !validNotificationURL(c.PublicURL) {
+		return errors.New("PublicURL must be an absolute http or https URL")
+	}
+	for _, currency := range c.WidgetCurrencies {
+		if !validCurrency(currency) {
+			return fmt.Errorf("invalid currency in WidgetCurrencies: %q", currency)
+		}
+	}
+	if c.WidgetAccentColor != "" && !colorRegexp.MatchString(c.WidgetAccentColor) {
+		return errors.New("WidgetAccentColor must be a color like #4a90e2")
+	}
+	if c.WidgetDeprecationWindow < 0 {
+		return errors.New("WidgetDeprecationWindow cannot be negative")
+	}
+	if c.CheckoutAccentColor != "" && !colorRegexp.MatchString(c.CheckoutAccentColor) {
+		return errors.New("CheckoutAccentColor must be a color like #4a90e2")
+	}
+	for _, s := range c.CheckoutSuccessURLs {
+		if !validNotificationURL(s) {
+			return fmt.Errorf("invalid URL in CheckoutSuccessURLs: %q", s)
+		}
+	}
+	for _, account := range c.ExchangeAccounts {
+		if !accountRegexp.MatchString(account) {
+			return fmt.Errorf("invalid account in ExchangeAccounts: %q", account)
+		}
+	}
+	if c.OutboxMinBackoff < 0 || c.OutboxMaxBackoff < c.OutboxMinBackoff {
+		return errors.New("OutboxMaxBackoff cannot be less than OutboxMinBackoff")
+	}
+	if c.SubscriptionSweepInterval < 0 {
+		return errors.New("SubscriptionSweepInterval cannot be negative")
+	}
+	if c.WatchdogInterval < 0 || c.StuckCheckFactor < 0 {
+		return errors.New("WatchdogInterval and StuckCheckFactor cannot be negative")
+	}
+	for name, mode := range c.DeprecatedParams {
+		if !stringInSlice(name, deprecatedParamNames()) {
+			return fmt.Errorf("unknown deprecated parameter: %q", name)
+		}
+		if mode != deprecationMap && mode != deprecationWarn && mode != deprecationReject {
+			return fmt.Errorf("invalid mode for deprecated parameter %s: %q", name, mode)
+		}
+	}
+	if c.DeprecationSunset != "" {
+		if _, err := time.Parse(time.RFC3339, c.DeprecationSunset); err != nil {
+			return fmt.Errorf("invalid DeprecationSunset: %w", err)
+		}
+	}
+	if c.NotificationMaxAttempts < 0 {
+		return errors.New("NotificationMaxAttempts cannot be negative")
+	}
+	if c.OutboxMaxAttempts < 0 {
+		return errors.New("OutboxMaxAttempts cannot be negative")
+	}
+	if c.AdmissionSoftQueue < 0 || c.AdmissionSoftLag < 0 || c.AdmissionHardQueue < 0 || c.AdmissionHardLag < 0 {
+		return errors.New("admission thresholds cannot be negative")
+	}
+	if c.AdmissionHardQueue > 0 && c.AdmissionSoftQueue > c.AdmissionHardQueue {
+		return errors.New("AdmissionSoftQueue cannot be greater than AdmissionHardQueue")
+	}
+	if c.AdmissionHardLag > 0 && c.AdmissionSoftLag > c.AdmissionHardLag {
+		return errors.New("AdmissionSoftLag cannot be greater than AdmissionHardLag")
+	}
+	if c.PriorityWorkerShare < 0 || c.PriorityWorkerShare > 100 {
+		return errors.New("PriorityWorkerShare must be between 0 and 100")
+	}
+	if _, err := compileStatePattern(c.StatePattern); err != nil {
+		return fmt.Errorf("invalid StatePattern: %w", err)
+	}
+	if err := validateExtraResponseFields(c.ExtraResponseFields); err != nil {
+		return fmt.Errorf("invalid ExtraResponseFields: %w", err)
+	}
+	if err := c.validateMerchants(); err != nil {
+		return err
+	}
+	for _, key := range c.APIKeys {
+		if _, ok := c.CheckerTiers[key.Tier]; key.Tier != "" && !ok {
+			return fmt.Errorf("unknown tier in APIKeys: %q", key.Tier)
+		}
+		if _, err := compileStatePattern(key.StatePattern); err != nil {
+			return fmt.Errorf("invalid StatePattern in APIKeys: %w", err)
+		}
+		if err := validateExtraResponseFields(key.ExtraResponseFields); err != nil {
+			return fmt.Errorf("invalid ExtraResponseFields in APIKeys: %w", err)
+		}
+		if !validExpiryPolicy(key.OnExpiryWithFunds) {
+			return fmt.Errorf("invalid OnExpiryWithFunds in APIKeys: %q", key.OnExpiryWithFunds)
+		}
+		if key.RateLimit != "" {
+			if _, err := limiter.NewRateFromFormatted(key.RateLimit); err != nil {
+				return fmt.Errorf("invalid RateLimit in APIKeys: %w", err)
+			}
+		}
+	}
+	if c.ExposureAlertThreshold != "" {
+		if _, err := decimal.NewFromString(c.ExposureAlertThreshold); err != nil {
+			return fmt.Errorf("invalid ExposureAlertThreshold: %w", err)
+		}
+	}
+	for name, pr := range c.Presets {
+		pr.Name = name
+		if err := pr.validate(); err != nil {
+			return fmt.Errorf("invalid preset %q: %w", name, err)
+		}
+	}
+	switch c.ProviderSelection {
+	case providerSelectionOrdered, providerSelectionFastest:
+	default:
+		return fmt.Errorf("invalid ProviderSelection: %q", c.ProviderSelection)
+	}
+	if c.PriceCacheDuration > c.PriceMaxStaleness {
+		return errors.New("PriceCacheDuration cannot be greater than PriceMaxStaleness")
+	}
+	switch c.PriceStalePolicy {
+	case priceStaleRefuse, priceStaleFlag:
+	default:
+		return fmt.Errorf("invalid PriceStalePolicy: %q", c.PriceStalePolicy)
+	}
+	if c.MinPaymentTimeout > c.MaxPaymentTimeout {
+		return errors.New("MinPaymentTimeout cannot be greater than MaxPaymentTimeout")
+	}
+	minPayment, maxPayment, err := c.paymentLimits()
+	if err != nil {
+		return err
+	}
+	if minPayment != nil && maxPayment != nil && minPayment.GreaterThan(*maxPayment) {
+		return errors.New("MinPayment cannot be greater than MaxPayment")
+	}
+	switch c.IntegrityMode {
+	case integrityOff, integritySample, integrityFull:
+	default:
+		return fmt.Errorf("invalid IntegrityMode: %q", c.IntegrityMode)
+	}
+	if c.IntegritySampleRate < 0 || c.IntegritySampleRate > 1 {
+		return errors.New("IntegritySampleRate must be between 0 and 1")
+	}
+	switch c.FeeRemainderPolicy {
+	case feeRemainderMerchant, feeRemainderFee:
+	default:
+		return fmt.Errorf("invalid FeeRemainderPolicy: %q", c.FeeRemainderPolicy)
+	}
 	return nil
 }
 
@@ -76,36 +887,182 @@ func (c *Config) setDefaults() {
 	if c.DatabasePath == "" {
 		c.DatabasePath = "accept-bcb.db"
 	}
+	if c.CertExpiryAlertDays == 0 {
+		c.CertExpiryAlertDays = 14
+	}
 	if c.ListenAddress == "" {
 		c.ListenAddress = "127.0.0.1:8080"
+		if c.autoTLSEnabled() {
+			c.ListenAddress = ":443"
+		}
+	}
+	if c.AutoTLS.HTTPAddress == "" {
+		c.AutoTLS.HTTPAddress = ":80"
 	}
+	c.setMerchantAPIKeys()
 	if c.NodeURL == "" {
 		c.NodeURL = "http://127.0.0.1:9076"
 	}
 	if c.NodeWebsocketURL == "" {
 		c.NodeWebsocketURL = "ws://127.0.0.1:9078"
 	}
+	if c.NodeWebsocketMinBackoff == 0 {
+		c.NodeWebsocketMinBackoff = 1000
+	}
+	if c.NodeWebsocketMaxBackoff == 0 {
+		c.NodeWebsocketMaxBackoff = 60000
+	}
 	if c.NodeTimeout == 0 {
 		c.NodeTimeout = 600000
 	}
+	if c.WorkServerTimeout == 0 {
+		c.WorkServerTimeout = 15000
+	}
+	if c.NodeFailureThreshold == 0 {
+		c.NodeFailureThreshold = 3
+	}
+	if c.NodeCallTimeout == 0 {
+		c.NodeCallTimeout = 30000
+	}
+	if c.NodeRetries == 0 {
+		c.NodeRetries = 2
+	}
+	if c.NodeRetryBackoff == 0 {
+		c.NodeRetryBackoff = 200
+	}
+	if c.NodeBreakerThreshold == 0 {
+		c.NodeBreakerThreshold = 5
+	}
+	if c.NodeBreakerCooldown == 0 {
+		c.NodeBreakerCooldown = 30
+	}
+	if c.NodeProbeInterval == 0 {
+		c.NodeProbeInterval = 10
+	}
+	if c.HealthTimeout == 0 {
+		c.HealthTimeout = 2000
+	}
+	if c.MaxSubPayments == 0 {
+		c.MaxSubPayments = 100
+	}
+	if c.MaxMetadataSize == 0 {
+		c.MaxMetadataSize = defaultMaxMetadataSize
+	}
+	if c.IdempotencyWindow == 0 {
+		c.IdempotencyWindow = 86400
+	}
+	if c.NodeVersionRefreshInterval == 0 {
+		c.NodeVersionRefreshInterval = 3600
+	}
+	if c.NodeConcurrency == 0 {
+		c.NodeConcurrency = 16
+	}
+	if c.NodeQueueTimeoutInteractive == 0 {
+		c.NodeQueueTimeoutInteractive = 10000
+	}
+	if c.NodeQueueTimeoutChecker == 0 {
+		c.NodeQueueTimeoutChecker = 60000
+	}
 	if c.Representative == "" {
 		c.Representative = "bcb_1os5ijf6dcd5cuo4q7gmpp8wmwjowt36u7wapg7hgxiccn6wpxka3s9du3dt"
 	}
 	if c.ShutdownTimeout == 0 {
 		c.ShutdownTimeout = 5000
 	}
+	if c.VerifyLockWait == 0 {
+		c.VerifyLockWait = 250
+	}
+	if c.LeftoverSweepBatchSize == 0 {
+		c.LeftoverSweepBatchSize = defaultRecoverBatchSize
+	}
+	if c.LeftoverSweepDelay == 0 {
+		c.LeftoverSweepDelay = 200
+	}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = 30000
+	}
 	if c.RateLimit == "" {
 		c.RateLimit = "60-H"
 	}
+	if c.PayRateLimit == "" {
+		c.PayRateLimit = c.RateLimit
+	}
+	if c.PriceRateLimit == "" {
+		c.PriceRateLimit = c.RateLimit
+	}
+	if c.AdminAuthFailureLimit == "" {
+		c.AdminAuthFailureLimit = "10-M"
+	}
+	if c.WidgetDeprecationWindow == 0 {
+		c.WidgetDeprecationWindow = 180
+	}
+	if c.CheckoutAccentColor == "" {
+		c.CheckoutAccentColor = c.WidgetAccentColor
+	}
+	if c.CheckoutAccentColor == "" {
+		c.CheckoutAccentColor = "#4a90e2"
+	}
+	c.CheckoutText.setDefaults()
 	if c.ReceiveThreshold == "" {
 		c.ReceiveThreshold = "0.001"
 	}
 	if c.MaxPayments == 0 {
 		c.MaxPayments = 10
 	}
+	if c.PendingPageSize == 0 {
+		c.PendingPageSize = 1000
+	}
+	if c.PendingPagesPerCheck == 0 {
+		c.PendingPagesPerCheck = 10
+	}
 	if c.AllowedDuration == 0 {
 		c.AllowedDuration = 3600
 	}
+	if c.RequiredConfirmationTimeout == 0 {
+		c.RequiredConfirmationTimeout = 600
+	}
+	if c.MinPaymentTimeout == 0 {
+		c.MinPaymentTimeout = 60
+	}
+	if c.MaxPaymentTimeout == 0 {
+		c.MaxPaymentTimeout = 86400
+	}
+	if c.SlowTransactionThreshold == 0 {
+		c.SlowTransactionThreshold = 1000
+	}
+	if c.ScanChunkSize == 0 {
+		c.ScanChunkSize = defaultScanChunkSize
+	}
+	if c.MaxRequestDeadline == 0 {
+		c.MaxRequestDeadline = 30000
+	}
+	if c.OutboxMinBackoff == 0 {
+		c.OutboxMinBackoff = 5000
+	}
+	if c.OutboxMaxBackoff == 0 {
+		c.OutboxMaxBackoff = 3600000
+	}
+	if c.OutboxBreakerThreshold == 0 {
+		c.OutboxBreakerThreshold = 5
+	}
+	if c.OutboxBreakerCooldown == 0 {
+		c.OutboxBreakerCooldown = 60000
+	}
+	if c.OutboxTimeout == 0 {
+		c.OutboxTimeout = 10000
+	}
+	if c.WatchdogInterval == 0 {
+		c.WatchdogInterval = 30
+	}
+	if c.JobJitter == 0 {
+		c.JobJitter = 10
+	}
+	if c.StuckCheckFactor == 0 {
+		c.StuckCheckFactor = 3
+	}
+	if c.StuckCheckAlertThreshold == 0 {
+		c.StuckCheckAlertThreshold = 3
+	}
 	if c.NextCheckDurationFactor == 0 {
 		c.NextCheckDurationFactor = 20
 	}
@@ -115,4 +1072,205 @@ func (c *Config) setDefaults() {
 	if c.MaxNextCheckDuration == 0 {
 		c.MaxNextCheckDuration = 1200
 	}
+	if c.FastCheckInterval == 0 {
+		c.FastCheckInterval = 3
+	}
+	if c.FastCheckDuration == 0 {
+		c.FastCheckDuration = 120
+	}
+	if c.WebsocketQueueSize == 0 {
+		c.WebsocketQueueSize = 100
+	}
+	if c.WebsocketWriteTimeout == 0 {
+		c.WebsocketWriteTimeout = 10
+	}
+	if c.WebsocketPingInterval == 0 {
+		c.WebsocketPingInterval = 30000
+	}
+	if c.WebsocketPongTimeout == 0 {
+		c.WebsocketPongTimeout = 10000
+	}
+	if c.WebsocketMaxSubscriptions == 0 {
+		c.WebsocketMaxSubscriptions = 100
+	}
+	if c.EventStreamKeepaliveInterval == 0 {
+		c.EventStreamKeepaliveInterval = 15000
+	}
+	if c.PublicStatsCacheDuration == 0 {
+		c.PublicStatsCacheDuration = 300
+	}
+	if c.PublicStatsVerifiedWithin == 0 {
+		c.PublicStatsVerifiedWithin = 30
+	}
+	if c.BackfillCurrency == "" {
+		c.BackfillCurrency = "USD"
+	}
+	if c.BackfillRequestInterval == 0 {
+		c.BackfillRequestInterval = 3000
+	}
+	if c.DegradedMinRequests == 0 {
+		c.DegradedMinRequests = 10
+	}
+	if c.DegradedRecoveryRate == 0 {
+		c.DegradedRecoveryRate = c.DegradedErrorRate / 2
+	}
+	if c.DegradedCooldown == 0 {
+		c.DegradedCooldown = 300
+	}
+	if c.NodeErrorWindow == 0 {
+		c.NodeErrorWindow = 300
+	}
+	if c.DegradedMessage == "" {
+		c.DegradedMessage = "Payment confirmations may be delayed because of network problems."
+	}
+	if c.ObjectStorageRegion == "" {
+		c.ObjectStorageRegion = "us-east-1"
+	}
+	if c.ObjectStoragePrefix == "" {
+		c.ObjectStoragePrefix = "exports/"
+	}
+	if c.ObjectStoragePartSize == 0 {
+		c.ObjectStoragePartSize = 8 << 20
+	}
+	if c.ObjectStoragePartRetries == 0 {
+		c.ObjectStoragePartRetries = 3
+	}
+	if c.LockLeaseTTL == 0 {
+		c.LockLeaseTTL = 30
+	}
+	if c.LockWaitTimeout == 0 {
+		c.LockWaitTimeout = 60
+	}
+	if c.InstanceID == "" {
+		c.InstanceID = defaultInstanceID()
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = 10
+	}
+	if c.HeartbeatTTL == 0 {
+		c.HeartbeatTTL = 30
+	}
+	if c.DuplicateStateWindow == 0 {
+		c.DuplicateStateWindow = 86400
+	}
+	if c.CheckWorkers == 0 {
+		c.CheckWorkers = 100
+	}
+	if c.PriorityWorkerShare == 0 {
+		c.PriorityWorkerShare = 80
+	}
+	if c.AdmissionPollSeconds == 0 {
+		c.AdmissionPollSeconds = 10
+	}
+	if c.AdmissionRetryAfter == 0 {
+		c.AdmissionRetryAfter = 30
+	}
+	if c.WebsocketAuthTimeout == 0 {
+		c.WebsocketAuthTimeout = 10
+	}
+	if len(c.ProofNodeAllowedSchemes) == 0 {
+		c.ProofNodeAllowedSchemes = []string{"https", "http"}
+	}
+	if len(c.ProofNodeAllowedPorts) == 0 {
+		c.ProofNodeAllowedPorts = []int{443, 7076}
+	}
+	if c.SLAEvaluationInterval == 0 {
+		c.SLAEvaluationInterval = 60
+	}
+	if c.SLANoVerificationMinCreated == 0 {
+		c.SLANoVerificationMinCreated = 1
+	}
+	if c.SLAAlertRecoveryTime == 0 {
+		c.SLAAlertRecoveryTime = 300
+	}
+	if c.AnomalyMinCount == 0 {
+		c.AnomalyMinCount = 10
+	}
+	if c.AnomalyCooldown == 0 {
+		c.AnomalyCooldown = 3600
+	}
+	if c.FeeRemainderPolicy == "" {
+		c.FeeRemainderPolicy = feeRemainderMerchant
+	}
+	if len(c.PriceProviders) == 0 {
+		c.PriceProviders = []string{"coinmarketcap"}
+	}
+	if c.HTTPLogSamplePercent == 0 {
+		c.HTTPLogSamplePercent = 100
+	}
+	if c.SubscriptionSweepInterval == 0 {
+		c.SubscriptionSweepInterval = 60
+	}
+	if c.WebsocketSessionCacheSize == 0 {
+		c.WebsocketSessionCacheSize = 10000
+	}
+	if c.TokenIssuer == "" {
+		c.TokenIssuer = "accept-nano"
+	}
+	if c.TokenAudience == "" {
+		c.TokenAudience = "accept-nano"
+	}
+	if c.TokenLifetime == 0 {
+		c.TokenLifetime = 30 * 24 * 3600
+	}
+	if c.KeyRotationOverlap == 0 {
+		c.KeyRotationOverlap = 24 * 3600
+	}
+	if c.QRMaxSize == 0 {
+		c.QRMaxSize = 1024
+	}
+	if c.MaxDisplayCurrencies == 0 {
+		c.MaxDisplayCurrencies = 5
+	}
+	if c.AccessLogFormat == "" {
+		c.AccessLogFormat = accessLogText
+	}
+	if c.HTTPLogMaxBodySize == 0 {
+		c.HTTPLogMaxBodySize = 4096
+	}
+	if c.PriceCacheDuration == 0 {
+		c.PriceCacheDuration = defaultPriceCacheDuration
+	}
+	if c.PriceMaxStaleness == 0 {
+		c.PriceMaxStaleness = 600
+	}
+	if c.ProviderSelection == "" {
+		c.ProviderSelection = providerSelectionOrdered
+	}
+	if c.PriceStalePolicy == "" {
+		c.PriceStalePolicy = priceStaleRefuse
+	}
+	if c.IntegrityMode == "" {
+		c.IntegrityMode = integrityOff
+	}
+	if c.IntegritySampleRate == 0 {
+		c.IntegritySampleRate = 0.01
+	}
+	if c.AccountingDepositsAccount == "" {
+		c.AccountingDepositsAccount = "Assets:Nano:Deposits"
+	}
+	if c.AccountingMerchantAccount == "" {
+		c.AccountingMerchantAccount = "Assets:Nano:Merchant"
+	}
+	if c.AccountingRevenueAccount == "" {
+		c.AccountingRevenueAccount = "Income:Sales"
+	}
+	if c.AccountingFeesAccount == "" {
+		c.AccountingFeesAccount = "Expenses:Fees"
+	}
+	if c.AccountingRefundsAccount == "" {
+		c.AccountingRefundsAccount = "Income:Refunds"
+	}
+	if c.AccountingWrittenOffAccount == "" {
+		c.AccountingWrittenOffAccount = "Expenses:WrittenOff"
+	}
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
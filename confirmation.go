@@ -0,0 +1,127 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// Payments are verified only with blocks that the network has confirmed. Pending blocks are read with the
+// unconfirmed ones and every new block is looked up with blocks_info. Unconfirmed blocks are kept in Unconfirmed,
+// not in Balance, so they never fulfill the payment and they are never received or sent to the merchant.
+// If the detected funds would fulfill the payment, it is in pending_confirmation state and clients can show
+// that the payment is seen. The payment is checked for RequiredConfirmationTimeout even after it expires, so a
+// block sent in time is not lost to a slow network. If the blocks are not confirmed in time, the payment stays
+// in pending_confirmation and operator is alerted. Blocks of a fork that loses are dropped from pending at the node,
+// so they are not counted again and the payment goes back to waiting for funds.
+
+// States in payment history.
+const historyPendingConfirmation = "pending_confirmation"
+
+var metricConfirmationTimeouts = expvar.NewInt("confirmation_timeouts_total")
+
+// PaymentPendingConfirmation is published when detected funds fulfill the payment but they are not confirmed yet.
+type PaymentPendingConfirmation struct {
+	Payment
+}
+
+func (p PaymentPendingConfirmation) Account() Account {
+	return Account(p.Payment.Account)
+}
+
+// unconfirmedBlocks returns the blocks of a pending page that the network has not confirmed yet.
+// Blocks in skip and blocks that are known to be confirmed are not looked up again.
+func (p *Payment) unconfirmedBlocks(blocks map[string]nano.PendingBlock, skip []string) (map[string]bool, error) {
+	var hashes []string
+	for hash := range blocks {
+		if sp, ok := p.SubPayments[hash]; (ok && !sp.Unconfirmed) || stringInSlice(hashPrefix(hash), skip) {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	infos, err := p.node().BlocksInfo(hashes)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for _, hash := range hashes {
+		// Block is not found if it is rolled back in a fork after the pending page is read.
+		if info, ok := infos[hash]; !ok || info.Confirmed != "true" {
+			ret[hash] = true
+		}
+	}
+	return ret, nil
+}
+
+// setBlockConfirmed records the confirmation of a block in SubPayments.
+func (p *Payment) setBlockConfirmed(hash string, confirmed bool) {
+	if sp, ok := p.SubPayments[hash]; ok && sp.Unconfirmed == confirmed {
+		sp.Unconfirmed = !confirmed
+		p.SubPayments[hash] = sp
+	}
+}
+
+// setUnconfirmed sets the sum of unconfirmed blocks and returns true if it is changed.
+func (p *Payment) setUnconfirmed(amount decimal.Decimal) bool {
+	switch {
+	case amount.IsZero() && p.Unconfirmed == nil:
+		return false
+	case amount.IsZero():
+		p.Unconfirmed = nil
+	case p.Unconfirmed != nil && p.Unconfirmed.Equal(amount):
+		return false
+	default:
+		p.Unconfirmed = &amount
+	}
+	return true
+}
+
+// updatePendingConfirmation moves the payment in or out of pending_confirmation state after Balance and Unconfirmed
+// are updated. It returns true if the payment needs to be saved.
+func (p *Payment) updatePendingConfirmation() bool {
+	detected := p.Balance
+	if p.Unconfirmed != nil {
+		detected = detected.Add(*p.Unconfirmed)
+	}
+	pending := p.Unconfirmed != nil && !p.isFulfilled() && p.fulfilledBy(detected)
+	switch {
+	case pending && p.PendingConfirmationAt == nil:
+		p.PendingConfirmationAt = now()
+		log.Noticef("payment %s is waiting for confirmation of %s NANO", p.logName(), RawToNano(*p.Unconfirmed))
+		go verifications.Publish(PaymentPendingConfirmation{Payment: *p})
+		return true
+	case pending && p.ConfirmationTimedOutAt == nil && now().After(p.PendingConfirmationAt.Add(requiredConfirmationTimeout())):
+		p.ConfirmationTimedOutAt = now()
+		metricConfirmationTimeouts.Add(1)
+		sendAlert("confirmation_timeout", "funds of payment "+p.Account+" are not confirmed in "+requiredConfirmationTimeout().String(), map[string]interface{}{
+			"account":     p.Account,
+			"unconfirmed": RawToNano(*p.Unconfirmed),
+		})
+		return true
+	case !pending && p.PendingConfirmationAt != nil && !p.isFulfilled():
+		// Unconfirmed blocks are dropped.
+		p.PendingConfirmationAt, p.ConfirmationTimedOutAt = nil, nil
+		return true
+	}
+	return false
+}
+
+func requiredConfirmationTimeout() time.Duration {
+	return time.Duration(config.RequiredConfirmationTimeout) * time.Second
+}
+
+// pendingConfirmation returns true if the payment is in pending_confirmation state.
+func (p Payment) pendingConfirmation() bool {
+	return p.PendingConfirmationAt != nil && p.FulfilledAt == nil && p.CancelledAt == nil
+}
+
+// awaitingConfirmation returns true if the payment is checked for the confirmation of its funds after it expires.
+func (p Payment) awaitingConfirmation() bool {
+	return p.pendingConfirmation() && p.ConfirmationTimedOutAt == nil
+}
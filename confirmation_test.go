@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPendingConfirmation(t *testing.T) {
+	openTestDB(t, 0)
+	l := fakeLedgerNode(t)
+	clock := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	amount := NanoToRaw(decimal.NewFromInt(2))
+	p := &Payment{Account: "nano_1unconfirmed", Amount: amount, CreatedAt: clock.Now(), Timeout: 600}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 1)
+	cancel := verifications.Subscribe(Account(p.Account), func(e Event) { events <- e })
+	defer cancel()
+
+	// Unconfirmed block is seen but it does not fulfill the payment.
+	hash := l.sendUnconfirmed("nano_1customer", p.Account, amount)
+	if err := p.runStep(stepCheckPending); err != errPaymentNotFulfilled {
+		t.Fatalf("expected errPaymentNotFulfilled, got %v", err)
+	}
+	select {
+	case e := <-events:
+		if _, ok := e.(PaymentPendingConfirmation); !ok {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending confirmation is not published")
+	}
+	r := NewResponse(p, "")
+	if !r.PendingConfirmation || r.Fulfilled || r.PartiallyPaid || !r.Balance.IsZero() || !r.SubPayments[hash].Unconfirmed {
+		t.Fatalf("unexpected response: %+v", r)
+	}
+	if s := r.History; len(s) != 3 || s[2].State != historyPendingConfirmation {
+		t.Errorf("unexpected history: %+v", s)
+	}
+
+	// Payment is checked after it expires while the block is waiting for confirmation.
+	clock.Add(11 * time.Minute)
+	if p.finished() || p.nextStep() != stepCheckPending {
+		t.Fatalf("payment is not checked for confirmation: %s", p.nextStep())
+	}
+	l.confirm(hash)
+	if err := p.runStep(stepCheckPending); err != nil {
+		t.Fatal(err)
+	}
+	r = NewResponse(p, "")
+	if !r.Fulfilled || r.PendingConfirmation || r.SubPayments[hash].Unconfirmed || len(r.SatisfiedBy) != 1 || !p.Balance.Equal(amount) {
+		t.Fatalf("unexpected response: %+v", r)
+	}
+
+	// Payment goes back to waiting for funds when the block is rolled back.
+	forked := &Payment{Account: "nano_1forked", Amount: amount, CreatedAt: clock.Now(), Timeout: 600}
+	if err := forked.Save(); err != nil {
+		t.Fatal(err)
+	}
+	hash = l.sendUnconfirmed("nano_1customer", forked.Account, amount)
+	if err := forked.runStep(stepCheckPending); err != errPaymentNotFulfilled || !forked.pendingConfirmation() {
+		t.Fatalf("payment is not pending confirmation: %v", err)
+	}
+	l.rollback(forked.Account, hash)
+	if err := forked.runStep(stepCheckPending); err != errPaymentNotFulfilled || forked.pendingConfirmation() || forked.Unconfirmed != nil {
+		t.Fatalf("rolled back block is still pending confirmation: %v", err)
+	}
+
+	// Payment stays in pending confirmation after the timeout and it is not checked anymore.
+	stuck := &Payment{Account: "nano_1stuck", Amount: amount, CreatedAt: clock.Now(), Timeout: 600}
+	if err := stuck.Save(); err != nil {
+		t.Fatal(err)
+	}
+	l.sendUnconfirmed("nano_1customer", stuck.Account, amount)
+	if err := stuck.runStep(stepCheckPending); err != errPaymentNotFulfilled {
+		t.Fatal(err)
+	}
+	clock.Add(requiredConfirmationTimeout() + time.Second)
+	if stuck.finished() {
+		t.Fatal("payment is finished before the timeout is recorded")
+	}
+	if err := stuck.runStep(stepCheckPending); err != errPaymentNotFulfilled {
+		t.Fatal(err)
+	}
+	if stuck.ConfirmationTimedOutAt == nil || !stuck.pendingConfirmation() || !stuck.finished() || stuck.FulfilledAt != nil {
+		t.Errorf("unexpected state after timeout: %+v", stuck)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cenkalti/log"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// The node-conformance command runs the RPC calls that accept-nano depends on against a node
+// and compares the responses with conformanceCases. Run it before moving to another node implementation or version.
+// The fake node in tests answers with the examples of the cases, so expectations of the client and the fake cannot drift apart.
+
+// Patterns for the JSON encoding of response values. Amounts and hashes are strings in node responses.
+const (
+	conformanceRaw     = `^"[0-9]+"$`
+	conformanceAccount = `^"(nano|xrb)_[13][13456789abcdefghijkmnopqrstuwxyz]{59}"$`
+	conformanceHash    = `^"[0-9A-F]{64}"$`
+)
+
+// conformanceCase is an RPC behavior that accept-nano relies on.
+// Placeholders in braces in Request, Fields, Absent and Example are replaced with the parameters of the run, see conformanceParams.
+type conformanceCase struct {
+	Name string
+	// Why accept-nano depends on the behavior. Printed with failures.
+	Reason  string
+	Request map[string]interface{}
+	// Node must answer with an error message matching this if set.
+	Error string
+	// JSON encodings of the values at dotted paths must match the patterns. "*" in a path matches every key of an object.
+	Fields map[string]string
+	// Paths that must not be in the response.
+	Absent []string
+	// Limit for the number of keys in "blocks" object if set.
+	MaxBlocks int
+	// Keys of "blocks" object must not be in the ones of the named case.
+	DistinctFrom string
+	// Response of a conforming node.
+	Example string
+}
+
+var conformanceCases = []conformanceCase{
+	{
+		Name:    "version",
+		Reason:  "node version is recorded with the operations of payments and its major version is watched for changes",
+		Request: map[string]interface{}{"action": "version"},
+		Fields:  map[string]string{"rpc_version": `^"[0-9]+"$`, "node_vendor": `^"[^"]*[Vv][0-9]+`},
+		Example: `{"rpc_version":"1","store_version":"21","protocol_version":"19","node_vendor":"Nano V25.1","network":"live","build_info":"a1b2c3d"}`,
+	},
+	{
+		Name:    "account_info_unopened",
+		Reason:  "unopened payment accounts are told apart from node errors by the exact message",
+		Request: map[string]interface{}{"action": "account_info", "account": "{unopened}"},
+		Error:   `^Account not found$`,
+		Example: `{"error":"Account not found"}`,
+	},
+	{
+		Name:    "accounts_balances",
+		Reason:  "balances of payment accounts are fetched in batches",
+		Request: map[string]interface{}{"action": "accounts_balances", "accounts": []string{"{account}"}},
+		Fields:  map[string]string{"balances.{account}.balance": conformanceRaw, "balances.{account}.pending": conformanceRaw},
+		Example: `{"balances":{"{account}":{"balance":"0","pending":"3000","receivable":"3000"}}}`,
+	},
+	{
+		Name:      "pending",
+		Reason:    "pending blocks are read with their amounts and sources, count of them at a time",
+		Request:   map[string]interface{}{"action": "pending", "account": "{account}", "count": 1, "threshold": "1", "source": "true", "include_only_confirmed": "true"},
+		Fields:    map[string]string{"blocks.*.amount": conformanceRaw, "blocks.*.source": conformanceAccount},
+		MaxBlocks: 1,
+		Example:   `{"blocks":{"8A3F4C7E50AF1DE0D1DBA1B2C83F5C4B8E1AB1F6B9742B0FBA2D6C2E7A1F9E01":{"amount":"1000","source":"nano_1111111111111111111111111111111111111111111111111111hifc8npp"}}}`,
+	},
+	{
+		Name:         "pending_offset",
+		Reason:       "accounts with many pending blocks are scanned in pages with offset",
+		Request:      map[string]interface{}{"action": "pending", "account": "{account}", "count": 1, "offset": 1, "threshold": "1", "source": "true", "include_only_confirmed": "true"},
+		Fields:       map[string]string{"blocks.*.amount": conformanceRaw, "blocks.*.source": conformanceAccount},
+		MaxBlocks:    1,
+		DistinctFrom: "pending",
+		Example:      `{"blocks":{"0C2B1E6D8F4A3B5C7D9E1F2A4B6C8D0E1F3A5B7C9D1E3F5A7B9C1D3E5F7A9B02":{"amount":"2000","source":"nano_1111111111111111111111111111111111111111111111111111hifc8npp"}}}`,
+	},
+	{
+		Name:   "pending_unconfirmed",
+		Reason: "pending blocks that are not confirmed yet are read to show payments waiting for confirmation",
+		Request: map[string]interface{}{"action": "pending", "account": "{account}", "count": 1, "threshold": "1", "source": "true",
+			"include_only_confirmed": "false"},
+		Fields:    map[string]string{"blocks.*.amount": conformanceRaw, "blocks.*.source": conformanceAccount},
+		MaxBlocks: 1,
+		Example:   `{"blocks":{"8A3F4C7E50AF1DE0D1DBA1B2C83F5C4B8E1AB1F6B9742B0FBA2D6C2E7A1F9E01":{"amount":"1000","source":"nano_1111111111111111111111111111111111111111111111111111hifc8npp"}}}`,
+	},
+	{
+		Name:    "pending_unopened",
+		Reason:  "an account without pending blocks is answered with an empty blocks value, not an error",
+		Request: map[string]interface{}{"action": "pending", "account": "{unopened}", "count": 1, "threshold": "1", "source": "true", "include_only_confirmed": "true"},
+		Fields:  map[string]string{"blocks": `^(""|\{\})$`},
+		Example: `{"blocks":""}`,
+	},
+	{
+		Name:   "blocks_info",
+		Reason: "payments are verified with the confirmation, amount and destination of their blocks",
+		Request: map[string]interface{}{"action": "blocks_info", "hashes": []string{"{block}"}, "json_block": "true",
+			"include_not_found": "true"},
+		Fields: map[string]string{
+			"blocks.{block}.block_account":            conformanceAccount,
+			"blocks.{block}.amount":                   conformanceRaw,
+			"blocks.{block}.balance":                  conformanceRaw,
+			"blocks.{block}.confirmed":                `^"true"$`,
+			"blocks.{block}.subtype":                  `^"send"$`,
+			"blocks.{block}.contents.type":            `^"state"$`,
+			"blocks.{block}.contents.link_as_account": conformanceAccount,
+		},
+		Example: `{"blocks":{"{block}":{"block_account":"nano_1111111111111111111111111111111111111111111111111111hifc8npp",` +
+			`"amount":"1000","balance":"5000","confirmed":"true","subtype":"send",` +
+			`"contents":{"type":"state","link_as_account":"nano_1111111111111111111111111111111111111111111111111111hifc8npp"}}}}`,
+	},
+	{
+		Name:   "blocks_info_not_found",
+		Reason: "a published block is looked up to decide if an error from process can be ignored",
+		Request: map[string]interface{}{"action": "blocks_info", "hashes": []string{"{missing}"}, "json_block": "true",
+			"include_not_found": "true"},
+		Fields:  map[string]string{"blocks": `^\{`},
+		Absent:  []string{"blocks.{missing}"},
+		Example: `{"blocks":{},"blocks_not_found":["{missing}"]}`,
+	},
+	{
+		Name:    "work_validate",
+		Reason:  "work is generated locally at a fixed difficulty, node must accept it",
+		Request: map[string]interface{}{"action": "work_validate", "hash": "{block}", "work": "{work}", "difficulty": "{difficulty}"},
+		Fields:  map[string]string{"valid": `^"1"$`},
+		Example: `{"valid":"1","difficulty":"ff00000000000000","multiplier":"1"}`,
+	},
+	{
+		Name:   "block_create",
+		Reason: "blocks are signed by the node and published as they are returned",
+		Request: map[string]interface{}{"action": "block_create", "type": "state", "previous": "00000000000000000000000000000000",
+			"account": "{unopened}", "representative": "{account}", "balance": "1", "link": "{block}", "key": "{unopened_key}",
+			"work": "{unopened_work}"},
+		Fields:  map[string]string{"hash": conformanceHash, "block": `^"\{`},
+		Example: `{"hash":"5B0E7C2D9A1F3E4B6C8D0A2F4E6B8C0D2A4F6E8B0C2D4A6F8E0B2C4D6A8F0E02","block":"{\"type\":\"state\"}"}`,
+	},
+	{
+		Name:    "process_invalid",
+		Reason:  "rejected blocks are told apart from uncertain publishes by the error field",
+		Request: map[string]interface{}{"action": "process", "block": `{"type":"state"}`},
+		Error:   `.`,
+		Example: `{"error":"Block is invalid"}`,
+	},
+}
+
+// conformanceParams returns the values of placeholders in conformanceCases.
+// account must have at least two pending blocks. block must be a confirmed state send block.
+func conformanceParams(account, block string) (map[string]string, error) {
+	seed, err := NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	unopened, err := nano.DeriveKey(seed, 0)
+	if err != nil {
+		return nil, err
+	}
+	missing, err := NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	work, err := nano.GenerateWork(block, false)
+	if err != nil {
+		return nil, err
+	}
+	unopenedWork, err := nano.GenerateWork(unopened.Public, false)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"account":       account,
+		"block":         block,
+		"unopened":      unopened.Account,
+		"unopened_key":  unopened.Private,
+		"missing":       missing,
+		"work":          work,
+		"unopened_work": unopenedWork,
+		"difficulty":    nano.WorkThreshold(false),
+	}, nil
+}
+
+func replaceConformanceParams(s string, params map[string]string) string {
+	pairs := make([]string, 0, 2*len(params))
+	for k, v := range params {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// request returns the request of the case with params.
+func (c *conformanceCase) request(params map[string]string) (map[string]interface{}, error) {
+	b, err := json.Marshal(c.Request)
+	if err != nil {
+		return nil, err
+	}
+	var args map[string]interface{}
+	err = json.Unmarshal([]byte(replaceConformanceParams(string(b), params)), &args)
+	return args, err
+}
+
+// ConformanceResult is the outcome of a conformance case.
+type ConformanceResult struct {
+	Name     string   `json:"name"`
+	Passed   bool     `json:"passed"`
+	Reason   string   `json:"reason"`
+	Failures []string `json:"failures,omitempty"`
+	// Response of the node, included if the case failed.
+	Response string `json:"response,omitempty"`
+
+	blocks []string
+}
+
+// check compares the response of the node, or the error it answered with, with the expectations of the case.
+func (c *conformanceCase) check(params map[string]string, response json.RawMessage, err error) ConformanceResult {
+	result := ConformanceResult{Name: c.Name, Reason: c.Reason}
+	fail := func(format string, args ...interface{}) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+	}
+	var nodeErr *nano.NodeError
+	switch {
+	case errors.As(err, &nodeErr) && c.Error != "":
+		if !regexp.MustCompile(c.Error).MatchString(nodeErr.Error()) {
+			fail("error %q does not match %s", nodeErr.Error(), c.Error)
+		}
+	case err != nil:
+		fail("unexpected error: %s", err)
+	case c.Error != "":
+		fail("no error, expected one matching %s", c.Error)
+	default:
+		result.blocks = c.checkResponse(params, response, fail)
+	}
+	result.Passed = len(result.Failures) == 0
+	if !result.Passed {
+		result.Response = string(response)
+	}
+	return result
+}
+
+func (c *conformanceCase) checkResponse(params map[string]string, response json.RawMessage, fail func(string, ...interface{})) []string {
+	var v interface{}
+	if err := json.Unmarshal(response, &v); err != nil {
+		fail("invalid JSON: %s", err)
+		return nil
+	}
+	paths := make([]string, 0, len(c.Fields))
+	for path := range c.Fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		pattern := regexp.MustCompile(c.Fields[path])
+		path = replaceConformanceParams(path, params)
+		values := conformanceLookup(v, strings.Split(path, "."))
+		if len(values) == 0 {
+			fail("%s is missing", path)
+		}
+		for _, value := range values {
+			b, _ := json.Marshal(value)
+			if !pattern.Match(b) {
+				fail("%s is %s, expected to match %s", path, b, pattern)
+			}
+		}
+	}
+	for _, path := range c.Absent {
+		path = replaceConformanceParams(path, params)
+		if len(conformanceLookup(v, strings.Split(path, "."))) > 0 {
+			fail("%s is in the response", path)
+		}
+	}
+	var blocks []string
+	if m, ok := v.(map[string]interface{}); ok {
+		if b, ok := m["blocks"].(map[string]interface{}); ok {
+			for hash := range b {
+				blocks = append(blocks, hash)
+			}
+			sort.Strings(blocks)
+		}
+	}
+	if c.MaxBlocks > 0 && len(blocks) > c.MaxBlocks {
+		fail("%d blocks are returned, expected at most %d", len(blocks), c.MaxBlocks)
+	}
+	return blocks
+}
+
+// conformanceLookup returns the values at path in v.
+func conformanceLookup(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if path[0] != "*" {
+		child, ok := m[path[0]]
+		if !ok {
+			return nil
+		}
+		return conformanceLookup(child, path[1:])
+	}
+	var ret []interface{}
+	for _, child := range m {
+		ret = append(ret, conformanceLookup(child, path[1:])...)
+	}
+	return ret
+}
+
+// runConformance runs conformanceCases with n.
+func runConformance(n *nano.Node, params map[string]string) []ConformanceResult {
+	results := make([]ConformanceResult, 0, len(conformanceCases))
+	blocks := make(map[string][]string)
+	for i := range conformanceCases {
+		c := &conformanceCases[i]
+		args, err := c.request(params)
+		if err != nil {
+			results = append(results, ConformanceResult{Name: c.Name, Reason: c.Reason, Failures: []string{err.Error()}})
+			continue
+		}
+		action := args["action"].(string)
+		delete(args, "action")
+		var response json.RawMessage
+		err = n.Call(action, args, &response)
+		result := c.check(params, response, err)
+		if c.DistinctFrom != "" {
+			for _, hash := range result.blocks {
+				for _, other := range blocks[c.DistinctFrom] {
+					if hash == other {
+						result.Failures = append(result.Failures, fmt.Sprintf("block %s is also returned in %s", hash, c.DistinctFrom))
+						result.Passed = false
+						result.Response = string(response)
+					}
+				}
+			}
+		}
+		blocks[c.Name] = result.blocks
+		results = append(results, result)
+	}
+	return results
+}
+
+func runNodeConformanceCommand(args []string) {
+	fs := flag.NewFlagSet("node-conformance", flag.ExitOnError)
+	nodeURL := fs.String("url", "", "node RPC URL")
+	account := fs.String("account", "", "account with at least two pending blocks")
+	block := fs.String("block", "", "hash of a confirmed state send block")
+	jsonOutput := fs.Bool("json", false, "print the report in JSON")
+	_ = fs.Parse(args)
+	if *nodeURL == "" || *account == "" || *block == "" {
+		log.Fatal("usage: accept-nano node-conformance -url URL -account ACCOUNT -block HASH")
+	}
+	params, err := conformanceParams(*account, *block)
+	if err != nil {
+		log.Fatal(err)
+	}
+	results := runConformance(nano.New(*nodeURL), params)
+	failed := 0
+	for _, result := range results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	if *jsonOutput {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, result := range results {
+			if result.Passed {
+				fmt.Printf("PASS %s\n", result.Name)
+				continue
+			}
+			fmt.Printf("FAIL %s: %s\n", result.Name, result.Reason)
+			for _, failure := range result.Failures {
+				fmt.Printf("    %s\n", failure)
+			}
+			if result.Response != "" {
+				fmt.Printf("    response: %s\n", result.Response)
+			}
+		}
+		fmt.Printf("%d passed, %d failed\n", len(results)-failed, failed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+const conformanceTestBlock = "991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948"
+
+// fakeConformanceNode answers the requests in conformanceCases with their examples.
+// edit can change the example before it is served.
+func fakeConformanceNode(t *testing.T, params map[string]string, edit func(name, example string) string) *nano.Node {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&args)
+		for i := range conformanceCases {
+			c := &conformanceCases[i]
+			request, err := c.request(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(request, args) {
+				_, _ = w.Write([]byte(edit(c.Name, replaceConformanceParams(c.Example, params))))
+				return
+			}
+		}
+		t.Errorf("unexpected request: %v", args)
+		_, _ = w.Write([]byte(`{"error":"unexpected request"}`))
+	}))
+	t.Cleanup(ts.Close)
+	return nano.New(ts.URL)
+}
+
+func TestNodeConformance(t *testing.T) {
+	params, err := conformanceParams("nano_1111111111111111111111111111111111111111111111111111hifc8npp", conformanceTestBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := fakeConformanceNode(t, params, func(name, example string) string { return example })
+	for _, result := range runConformance(n, params) {
+		if !result.Passed {
+			t.Errorf("example does not conform: %+v", result)
+		}
+	}
+
+	// Typed client methods accept the responses of a conforming node.
+	if _, err = n.AccountInfo(params["unopened"]); err != nano.ErrAccountNotFound {
+		t.Errorf("unopened account: %v", err)
+	}
+	first, err := n.PendingPage(params["account"], 1, 0, "1")
+	if err != nil || len(first) != 1 {
+		t.Errorf("pending: %v %v", first, err)
+	}
+	if blocks, err := n.PendingPage(params["unopened"], 1, 0, "1"); err != nil || len(blocks) != 0 {
+		t.Errorf("pending of unopened account: %v %v", blocks, err)
+	}
+	blocks, err := n.BlocksInfo([]string{conformanceTestBlock})
+	if err != nil || blocks[conformanceTestBlock].Confirmed != "true" || blocks[conformanceTestBlock].Subtype != "send" {
+		t.Errorf("blocks info: %+v %v", blocks, err)
+	}
+	if _, err = n.Process(`{"type":"state"}`); err == nil {
+		t.Error("invalid block is processed")
+	} else if _, ok := err.(*nano.NodeError); !ok {
+		t.Errorf("process error is not a node error: %v", err)
+	}
+
+	// Deviations of a node are reported.
+	n = fakeConformanceNode(t, params, func(name, example string) string {
+		switch name {
+		case "pending_offset":
+			// Offset is ignored.
+			for _, c := range conformanceCases {
+				if c.Name == "pending" {
+					return replaceConformanceParams(c.Example, params)
+				}
+			}
+		case "blocks_info":
+			return strings.Replace(example, `"confirmed":"true"`, `"confirmed":true`, 1)
+		case "account_info_unopened":
+			return `{"error":"Account not found (use account_info with include_confirmed)"}`
+		}
+		return example
+	})
+	failed := make(map[string]bool)
+	for _, result := range runConformance(n, params) {
+		if !result.Passed {
+			failed[result.Name] = true
+		}
+	}
+	if !reflect.DeepEqual(failed, map[string]bool{"pending_offset": true, "blocks_info": true, "account_info_unopened": true}) {
+		t.Errorf("unexpected failures: %v", failed)
+	}
+}
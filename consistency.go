@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// Responses of /api/verify and websocket messages must not show a payment going back to an earlier state.
+// Events are published only after the record is saved, and every response carries the revision of the record,
+// so clients can ignore one older than what they have seen. Verify waits briefly for a check of the payment that is running,
+// since the check may be about to save a change that a websocket client is told about.
+
+// loadSettledPayment loads the payment of account after waiting up to VerifyLockWait for the lock of the account.
+// The payment is loaded anyway if the lock is not released in time.
+func loadSettledPayment(account string) (*Payment, error) {
+	if locks.LockTimeout(account, time.Duration(config.VerifyLockWait)*time.Millisecond) {
+		defer locks.Unlock(account)
+	}
+	return LoadPayment([]byte(account))
+}
+
+// loadSettledPaymentByID is loadSettledPayment for a payment ID.
+func loadSettledPaymentByID(id string) (*Payment, error) {
+	account, err := accountOfPaymentID(id)
+	if err != nil {
+		return nil, err
+	}
+	return loadSettledPayment(account)
+}
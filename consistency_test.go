@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestVerifyRevisionDoesNotGoBack(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	token := saveSessionPayment(t)
+	const account = "nano_1session"
+
+	// Highest revision that a websocket client could have seen.
+	var visible uint64
+	cancel := verifications.Subscribe(account, func(e Event) {
+		if p, ok := e.(PaymentVerified); ok {
+			atomic.StoreUint64(&visible, p.Revision)
+		}
+	})
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			locks.Lock(account)
+			p, err := LoadPayment([]byte(account))
+			if err == nil {
+				p.Balance = p.Balance.Add(decimal.NewFromInt(1))
+				err = p.Save()
+			}
+			locks.Unlock(account)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			verifications.Publish(PaymentVerified{Payment: *p})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				seen := atomic.LoadUint64(&visible)
+				r := httptest.NewRequest(http.MethodGet, "/api/verify?"+url.Values{"token": {token}}.Encode(), nil)
+				w := httptest.NewRecorder()
+				handleVerify(w, r)
+				var response Response
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+					t.Error(err)
+					return
+				}
+				if response.Revision < seen {
+					t.Errorf("verify returned revision %d after %d is published", response.Revision, seen)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// Request headers allowed in CORS requests when CORSAllowedHeaders is not set.
+var defaultCORSHeaders = []string{"Origin", "Accept", "Content-Type", "X-Requested-With"}
+
+// corsOrigins returns the origins allowed for CORS requests. All origins are allowed if empty.
+func corsOrigins() []string {
+	if len(config.CORSAllowedOrigins) > 0 {
+		return config.CORSAllowedOrigins
+	}
+	return config.AllowedOrigins
+}
+
+// corsMiddleware handles CORS requests to h. Admin endpoints are never called cross-origin
+// so they are served without CORS headers and their preflight requests are not answered.
+func corsMiddleware(h http.Handler) http.Handler {
+	c := cors.New(cors.Options{
+		AllowedOrigins:   corsOrigins(),
+		AllowedHeaders:   append(append([]string{}, defaultCORSHeaders...), config.CORSAllowedHeaders...),
+		AllowCredentials: config.CORSAllowCredentials,
+	})
+	withCORS := c.Handler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		withCORS.ServeHTTP(w, r)
+	})
+}
+
+// matchOrigin returns true if origin matches pattern. A "*" in pattern matches any characters.
+func matchOrigin(pattern, origin string) bool {
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == origin
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
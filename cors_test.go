@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func preflight(h http.Handler, path, origin, headers string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodOptions, path, nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	if headers != "" {
+		r.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	t.Cleanup(func() {
+		config.AllowedOrigins, config.CORSAllowedOrigins, config.CORSAllowedHeaders, config.CORSAllowCredentials = nil, nil, nil, false
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/pay", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/admin/payment", func(w http.ResponseWriter, r *http.Request) {})
+
+	// All origins are allowed by default.
+	w := preflight(corsMiddleware(mux), "/api/pay", "https://any.example.org", "")
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("default is not permissive: %v", w.Header())
+	}
+	if w = preflight(corsMiddleware(mux), "/api/pay", "https://any.example.org", "X-Custom"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("custom header is allowed by default: %v", w.Header())
+	}
+
+	config.CORSAllowedOrigins = []string{"https://shop.example.com", "https://*.example.net"}
+	config.CORSAllowedHeaders = []string{"X-Custom"}
+	config.CORSAllowCredentials = true
+	h := corsMiddleware(mux)
+	for origin, allowed := range map[string]bool{
+		"https://shop.example.com":    true,
+		"https://a.b.example.net":     true,
+		"https://example.net":         false,
+		"https://evil.com":            false,
+		"http://shop.example.com":     false,
+		"https://shop.example.com.ru": false,
+	} {
+		w = preflight(h, "/api/pay", origin, "X-Custom")
+		if got := w.Header().Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Errorf("origin %s allowed: %v", origin, got)
+		}
+		if allowed && (w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Allow-Headers") != "X-Custom") {
+			t.Errorf("unexpected preflight response for %s: %v", origin, w.Header())
+		}
+	}
+
+	// Admin endpoints get no CORS headers.
+	w = preflight(h, "/admin/payment", "https://shop.example.com", "")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") != "" {
+		t.Errorf("admin endpoint has CORS headers: %v", w.Header())
+	}
+
+	config.setDefaults()
+	c := config
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.CORSAllowedOrigins = []string{"*"}
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "CORSAllowCredentials") {
+		t.Errorf("credentials are allowed for all origins: %v", err)
+	}
+}
+
+func TestMatchOrigin(t *testing.T) {
+	for _, c := range []struct {
+		pattern, origin string
+		match           bool
+	}{
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "https://EXAMPLE.com", true},
+		{"https://*.example.com", "https://a.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://example.com.evil", false},
+		{"*", "http://localhost:8080", true},
+	} {
+		if matchOrigin(c.pattern, c.origin) != c.match {
+			t.Errorf("%s matches %s: %v", c.pattern, c.origin, !c.match)
+		}
+	}
+}
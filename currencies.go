@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// /api/price accepts several currencies, comma separated or repeated, and returns the prices by currency.
+// Prices are looked up concurrently and a currency that fails gets an error entry instead of failing the request.
+// /api/currencies lists the fiat currencies that the configured price providers have prices in.
+
+// The list of currencies of providers rarely changes.
+const currencyListCacheDuration = time.Hour
+
+var errNoCurrencyList = errors.New("no price provider can list its currencies")
+
+var (
+	currencyListMu        sync.Mutex
+	currencyList          []string
+	currencyListFetchedAt time.Time
+)
+
+// priceErrorEntry is the entry of a currency that has no price in a batch response.
+func priceErrorEntry(code, msg string) map[string]interface{} {
+	return map[string]interface{}{"error": APIError{Code: code, Message: msg}}
+}
+
+// priceEntry returns the entry of a currency in a batch response from the result of the lookup.
+func priceEntry(quote PriceQuote, err error) map[string]interface{} {
+	switch {
+	case err == nil:
+		return priceResponse(quote)
+	case err == errPriceCurrencyUnsupported:
+		return priceErrorEntry(errCodeUnsupportedCurrency, err.Error())
+	case err == errPriceUnavailable && !quote.AsOf.IsZero() && config.PriceStalePolicy == priceStaleFlag:
+		return priceResponse(quote)
+	}
+	return priceErrorEntry(errCodePriceUnavailable, "price is not available")
+}
+
+// handleBatchPrice writes the prices of currencies in values, each may be a comma separated list.
+func handleBatchPrice(w http.ResponseWriter, r *http.Request, values []string) {
+	currencies, err := parseDisplayCurrencies(strings.Join(values, ","))
+	if err != nil {
+		writeError(w, errCodeInvalidCurrency, http.StatusBadRequest, "at most "+strconv.Itoa(config.MaxDisplayCurrencies)+" currencies are allowed")
+		return
+	}
+	entries := make([]map[string]interface{}, len(currencies))
+	var wg sync.WaitGroup
+	for i, currency := range currencies {
+		if !validCurrency(currency) {
+			entries[i] = priceErrorEntry(errCodeInvalidCurrency, "invalid currency")
+			continue
+		}
+		wg.Add(1)
+		go func(i int, currency string) {
+			defer wg.Done()
+			entries[i] = priceEntry(getNanoPriceQuoteContext(r.Context(), currency))
+		}(i, currency)
+	}
+	wg.Wait()
+	if !checkDeadline(w, r) {
+		return
+	}
+	prices := make(map[string]interface{}, len(currencies))
+	for i, currency := range currencies {
+		prices[currency] = entries[i]
+	}
+	b, err := json.Marshal(map[string]interface{}{"prices": prices})
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// supportedCurrencies returns the currencies that at least one of the providers has prices in, sorted.
+// The list is cached for currencyListCacheDuration. If providers cannot be reached, the cached list is returned.
+func supportedCurrencies() ([]string, time.Time, error) {
+	currencyListMu.Lock()
+	defer currencyListMu.Unlock()
+	if currencyList != nil && priceNow().Sub(currencyListFetchedAt) < currencyListCacheDuration {
+		return currencyList, currencyListFetchedAt, nil
+	}
+	priceProvidersMu.Lock()
+	providers := priceProviders
+	priceProvidersMu.Unlock()
+	var currencies []string
+	var listed, failed bool
+	for _, s := range providers {
+		lister, ok := s.provider.(currencyLister)
+		if !ok {
+			continue
+		}
+		list, err := lister.SupportedCurrencies()
+		if err != nil {
+			log.Warningf("cannot list currencies of %s: %s", lister.Name(), err)
+			failed = true
+			continue
+		}
+		listed = true
+		for _, currency := range list {
+			if !stringInSlice(currency, currencies) {
+				currencies = append(currencies, currency)
+			}
+		}
+	}
+	if failed && currencyList != nil {
+		return currencyList, currencyListFetchedAt, nil
+	}
+	if !listed {
+		return nil, time.Time{}, errNoCurrencyList
+	}
+	sort.Strings(currencies)
+	if failed {
+		// Not cached, so the list is completed when the provider recovers.
+		return currencies, priceNow(), nil
+	}
+	currencyList, currencyListFetchedAt = currencies, priceNow()
+	return currencyList, currencyListFetchedAt, nil
+}
+
+func handleCurrencies(w http.ResponseWriter, r *http.Request) {
+	currencies, asOf, err := supportedCurrencies()
+	if err != nil {
+		log.Errorln("cannot list currencies:", err)
+		writeError(w, errCodePriceUnavailable, http.StatusServiceUnavailable, "currencies are not available")
+		return
+	}
+	b, err := json.Marshal(map[string]interface{}{"currencies": currencies, "asOf": asOf})
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
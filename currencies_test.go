@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestBatchPrice(t *testing.T) {
+	config.setDefaults()
+	fakePriceSource(t)
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	barrier := make(chan struct{})
+	fetchPrice = func(currency string) (decimal.Decimal, string, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		if inFlight == 2 {
+			close(barrier)
+		}
+		mu.Unlock()
+		// Both lookups must be running at the same time to pass the barrier.
+		<-barrier
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if currency == "XYZ" {
+			return decimal.Zero, "", errPriceCurrencyUnsupported
+		}
+		return decimal.NewFromInt(2), "test", nil
+	}
+
+	w := httptest.NewRecorder()
+	handlePrice(w, httptest.NewRequest(http.MethodGet, "/api/price?currency=usd,xyz&currency=usd&currency=1x", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Prices map[string]struct {
+			Price *decimal.Decimal `json:"price"`
+			Error *APIError        `json:"error"`
+		} `json:"prices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Prices) != 3 {
+		t.Fatalf("unexpected prices: %s", w.Body)
+	}
+	if p := resp.Prices["USD"]; p.Price == nil || !p.Price.Equal(decimal.NewFromInt(2)) || p.Error != nil {
+		t.Errorf("unexpected USD entry: %s", w.Body)
+	}
+	if p := resp.Prices["XYZ"]; p.Error == nil || p.Error.Code != errCodeUnsupportedCurrency {
+		t.Errorf("unexpected XYZ entry: %s", w.Body)
+	}
+	if p := resp.Prices["1X"]; p.Error == nil || p.Error.Code != errCodeInvalidCurrency {
+		t.Errorf("unexpected 1X entry: %s", w.Body)
+	}
+	if maxInFlight != 2 {
+		t.Errorf("prices are not fetched concurrently: %d", maxInFlight)
+	}
+
+	// A single unsupported currency fails the request.
+	fetchPrice = func(currency string) (decimal.Decimal, string, error) {
+		return decimal.Zero, "", errPriceCurrencyUnsupported
+	}
+	w = httptest.NewRecorder()
+	handlePrice(w, httptest.NewRequest(http.MethodGet, "/api/price?currency=xyz", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for unsupported currency: %d", w.Code)
+	}
+}
+
+func TestSupportedCurrencies(t *testing.T) {
+	clock, _ := fakePriceSource(t)
+	resetCurrencyList := func() {
+		currencyListMu.Lock()
+		currencyList, currencyListFetchedAt = nil, priceNow()
+		currencyListMu.Unlock()
+	}
+	resetCurrencyList()
+	t.Cleanup(resetCurrencyList)
+	cmcStatus, cmcBody := http.StatusOK, `{"data":[{"symbol":"USD"},{"symbol":"EUR"}]}`
+	cgStatus, cgBody := http.StatusOK, `["usd","try","btc","xau"]`
+	cmc := &coinmarketcap{fiatURL: testProviderServer(t, &cmcStatus, &cmcBody), apiKey: "key"}
+	cg := &coingecko{currenciesURL: testProviderServer(t, &cgStatus, &cgBody)}
+	setPriceProviders(cmc, cg)
+	defer setPriceProviders()
+
+	get := func() (int, []string) {
+		w := httptest.NewRecorder()
+		handleCurrencies(w, httptest.NewRequest(http.MethodGet, "/api/currencies", nil))
+		var resp struct {
+			Currencies []string `json:"currencies"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp.Currencies
+	}
+	expect := func(expected ...string) {
+		t.Helper()
+		code, currencies := get()
+		if code != http.StatusOK || len(currencies) != len(expected) {
+			t.Fatalf("expected %v, got %d %v", expected, code, currencies)
+		}
+		for i := range expected {
+			if currencies[i] != expected[i] {
+				t.Fatalf("expected %v, got %v", expected, currencies)
+			}
+		}
+	}
+
+	expect("EUR", "TRY", "USD")
+
+	// Cached list is returned while providers are down.
+	*clock = clock.Add(currencyListCacheDuration)
+	cmcStatus, cgStatus = http.StatusBadGateway, http.StatusBadGateway
+	expect("EUR", "TRY", "USD")
+
+	resetCurrencyList()
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status without a list: %d", code)
+	}
+
+	// A list missing a provider is not cached.
+	cgStatus = http.StatusOK
+	expect("TRY", "USD")
+	cmcStatus = http.StatusOK
+	expect("EUR", "TRY", "USD")
+}
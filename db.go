@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+const migrationsBucket = "migrations"
+
+var (
+	// dbWriteMu is held exclusively while the database is being copied by compaction.
+	// Writes are paused but reads can continue during the copy.
+	dbWriteMu sync.RWMutex
+	// dbSwapMu is held exclusively while the database file is being replaced.
+	dbSwapMu sync.RWMutex
+)
+
+// openDB opens the database at config.DatabasePath and creates the buckets.
+func openDB() error {
+	removeStaleCompaction()
+	log.Debugln("opening db:", config.DatabasePath)
+	var err error
+	db, err = bbolt.Open(config.DatabasePath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	log.Debugln("db has been opened successfully")
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, txErr := tx.CreateBucketIfNotExists([]byte(paymentsBucket))
+		if txErr != nil {
+			return txErr
+		}
+		txErr = createStatesBucket(tx)
+		if txErr != nil {
+			return txErr
+		}
+		txErr = createPaymentIDsBucket(tx)
+		if txErr != nil {
+			return txErr
+		}
+		txErr = runMigration(tx, "utc_times", migrateUTCTimes)
+		if txErr != nil {
+			return txErr
+		}
+		txErr = runMigration(tx, "amount_scale", migrateAmountScale)
+		if txErr != nil {
+			return txErr
+		}
+		return runMigration(tx, "final_notified", migrateFinalNotified)
+	})
+	if err != nil {
+		return err
+	}
+	err = loadSigningKeys()
+	if err != nil {
+		return err
+	}
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	store = s
+	return nil
+}
+
+// runMigration runs fn if it has not been run on the database before.
+// Completed migrations are recorded by name in migrations bucket.
+func runMigration(tx *bbolt.Tx, name string, fn func(tx *bbolt.Tx) error) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(migrationsBucket))
+	if err != nil {
+		return err
+	}
+	if b.Get([]byte(name)) != nil {
+		return nil
+	}
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(name), []byte(clock.Now().Format(time.RFC3339)))
+}
+
+// rewritePayments saves the payments that are changed by fn in tx. Returns the number of changed payments.
+// Payments are decoded with their default JSON encoding, so fn sees the values as stored.
+func rewritePayments(tx *bbolt.Tx, fn func(p *Payment) bool) (int, error) {
+	pb := tx.Bucket([]byte(paymentsBucket))
+	sb := tx.Bucket([]byte(statesBucket))
+	updated := make(map[string]*Payment)
+	err := pb.ForEach(func(k, v []byte) error {
+		var p Payment
+		if json.Unmarshal(v, (*paymentJSON)(&p)) != nil {
+			return nil
+		}
+		if fn(&p) {
+			updated[string(k)] = &p
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Bucket cannot be modified during ForEach.
+	for k, p := range updated {
+		value, err := json.Marshal(p)
+		if err != nil {
+			return 0, err
+		}
+		if err = pb.Put([]byte(k), value); err != nil {
+			return 0, err
+		}
+		if p.State != "" {
+			if err = putStateIndex(sb, p); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(updated), nil
+}
+
+func closeDB() error {
+	if err := store.Close(); err != nil {
+		log.Errorln("cannot close payment store:", err)
+	}
+	dbSwapMu.Lock()
+	defer dbSwapMu.Unlock()
+	return db.Close()
+}
+
+// dbView runs fn in a read-only transaction.
+func dbView(fn func(tx *bbolt.Tx) error) error {
+	dbSwapMu.RLock()
+	defer dbSwapMu.RUnlock()
+	defer trackTx("read", time.Now())
+	return db.View(fn)
+}
+
+// dbUpdate runs fn in a read-write transaction.
+func dbUpdate(fn func(tx *bbolt.Tx) error) error {
+	dbWriteMu.RLock()
+	defer dbWriteMu.RUnlock()
+	dbSwapMu.RLock()
+	defer dbSwapMu.RUnlock()
+	defer trackTx("write", time.Now())
+	return db.Update(fn)
+}
+
+// dbStats returns statistics of the open database.
+func dbStats() bbolt.Stats {
+	dbSwapMu.RLock()
+	defer dbSwapMu.RUnlock()
+	if db == nil {
+		return bbolt.Stats{}
+	}
+	return db.Stats()
+}
+
+// databaseFileSize returns the size of database file on disk in bytes.
+func databaseFileSize() (int64, error) {
+	fi, err := os.Stat(config.DatabasePath)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
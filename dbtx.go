@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// A long read transaction pins old pages and blocks the writer that needs to grow the memory map,
+// so scans over all records are done with scanBucket in many short transactions.
+// Durations of all transactions are tracked and slow ones are logged with their caller.
+
+const (
+	// Recent transactions kept for /admin/debug/stats.
+	txHistorySize        = 1000
+	defaultScanChunkSize = 1000
+)
+
+var metricSlowTransactions = expvar.NewMap("db_slow_transactions_total")
+
+// TxRecord is a finished database transaction.
+type TxRecord struct {
+	// "read" or "write".
+	Kind      string        `json:"kind"`
+	Caller    string        `json:"caller"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"duration"`
+}
+
+type txTracker struct {
+	mu     sync.Mutex
+	recent [txHistorySize]TxRecord
+	next   int
+	count  int
+}
+
+var transactions = &txTracker{}
+
+func (t *txTracker) record(rec TxRecord) {
+	t.mu.Lock()
+	t.recent[t.next] = rec
+	t.next = (t.next + 1) % txHistorySize
+	if t.count < txHistorySize {
+		t.count++
+	}
+	t.mu.Unlock()
+}
+
+// longest returns the n longest of the recent transactions.
+func (t *txTracker) longest(n int) []TxRecord {
+	t.mu.Lock()
+	ret := make([]TxRecord, t.count)
+	copy(ret, t.recent[:t.count])
+	t.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Duration > ret[j].Duration })
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// trackTx records the transaction started at start. It must be deferred from dbView or dbUpdate.
+func trackTx(kind string, start time.Time) {
+	rec := TxRecord{Kind: kind, StartedAt: start, Duration: time.Since(start)}
+	rec.Caller = "unknown"
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		if f := runtime.FuncForPC(pc); f != nil {
+			rec.Caller = strings.TrimPrefix(f.Name(), "main.")
+		}
+	}
+	transactions.record(rec)
+	if threshold := time.Duration(config.SlowTransactionThreshold) * time.Millisecond; threshold > 0 && rec.Duration >= threshold {
+		metricSlowTransactions.Add(kind, 1)
+		log.Warningf("slow %s transaction in %s: %s", kind, rec.Caller, rec.Duration)
+	}
+}
+
+// scanBucket calls f for every record in bucket, reading ScanChunkSize records per transaction.
+// f is called outside of the transaction, so it can be slow or write to the database.
+//
+// Records of a chunk are read from the same snapshot, but the database may change between chunks:
+// a record updated during the scan is seen with either its old or new value,
+// records inserted before the cursor position are not seen and deleted ones may still be seen.
+func scanBucket(bucket string, f func(k, v []byte) error) error {
+	chunkSize := config.ScanChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultScanChunkSize
+	}
+	var after []byte
+	for {
+		var keys, values [][]byte
+		err := dbView(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(keys) < chunkSize; k, v = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+				values = append(values, append([]byte(nil), v...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			if err = f(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		if len(keys) < chunkSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
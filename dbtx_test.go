@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScanDoesNotStallWriters(t *testing.T) {
+	openTestDB(t, 0)
+	config.ScanChunkSize = 10
+	t.Cleanup(func() { config.ScanChunkSize = 0 })
+	for i := 0; i < 100; i++ {
+		p := &Payment{Account: "nano_1scan" + strconv.Itoa(i)}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A slow reader, like an export streaming to a slow client.
+	const perRecord = 5 * time.Millisecond
+	var scanned int
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = forEachPayment(func(p *Payment) error {
+			scanned++
+			time.Sleep(perRecord)
+			return nil
+		})
+	}()
+
+	// Writes with large values grow the database, which needs the memory map to be resized
+	// and waits for all open read transactions to finish.
+	var longestSave time.Duration
+	metadata := map[string]interface{}{"x": strings.Repeat("x", maxMetadataSize()/2)}
+	for i := 0; i < 200; i++ {
+		p := &Payment{Account: "nano_1grow" + strconv.Itoa(i), Metadata: metadata, SubPayments: make(map[string]SubPayment)}
+		for j := 0; j < 50; j++ {
+			p.SubPayments[strconv.Itoa(j)+strings.Repeat("0", 60)] = SubPayment{}
+		}
+		start := time.Now()
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > longestSave {
+			longestSave = d
+		}
+	}
+	wg.Wait()
+	if scanned < 100 {
+		t.Fatalf("scanned %d records", scanned)
+	}
+	// Whole scan takes at least 100*perRecord. Chunks are read without waiting for the callback,
+	// so writers wait only for copying a chunk.
+	if longestSave > 50*perRecord {
+		t.Fatalf("save is stalled for %s", longestSave)
+	}
+	for _, tx := range transactions.longest(1) {
+		if tx.Kind == "read" && tx.Caller == "scanBucket" && tx.Duration > 10*perRecord {
+			t.Fatalf("scan held a transaction for %s", tx.Duration)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Clients calling /api/pay inside their own request can bound our latency with X-Request-Deadline-Ms header.
+// The deadline is applied to the request context and checked before the payment index is allocated.
+// After that point payment creation is completed even if the deadline passes,
+// so a late response never leaves a half created payment behind.
+
+const deadlineHeader = "X-Request-Deadline-Ms"
+
+var metricDeadlineExceeded = expvar.NewMap("request_deadline_exceeded_total")
+
+// deadlineMiddleware sets the deadline of the request context from deadlineHeader, capped by MaxRequestDeadline.
+func deadlineMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := r.Header.Get(deadlineHeader)
+		if s == "" || config.MaxRequestDeadline == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ms, err := strconv.Atoi(s)
+		if err != nil || ms <= 0 {
+			writeError(w, errCodeInvalidDeadline, http.StatusBadRequest, "invalid deadline")
+			return
+		}
+		if ms > config.MaxRequestDeadline {
+			ms = config.MaxRequestDeadline
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkDeadline writes deadline_exceeded error and returns false if the request context is done.
+func checkDeadline(w http.ResponseWriter, r *http.Request) bool {
+	if r.Context().Err() == nil {
+		return true
+	}
+	metricDeadlineExceeded.Add(r.URL.Path, 1)
+	writeError(w, errCodeDeadlineExceeded, http.StatusGatewayTimeout, "deadline exceeded")
+	return false
+}
+
+// getNanoPriceQuoteContext is getNanoPriceQuote that returns ctx.Err() when ctx is done.
+// The fetch continues in background and updates the cache for the next request.
+func getNanoPriceQuoteContext(ctx context.Context, currency string) (PriceQuote, error) {
+	if ctx.Done() == nil {
+		return getNanoPriceQuote(currency)
+	}
+	type result struct {
+		quote PriceQuote
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		quote, err := getNanoPriceQuote(currency)
+		ch <- result{quote, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.quote, res.err
+	case <-ctx.Done():
+		return PriceQuote{}, ctx.Err()
+	}
+}
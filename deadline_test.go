@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPayDeadline(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.MaxRequestDeadline = 1000
+	config.AllowedDuration = -1
+	t.Cleanup(func() { config.AllowedDuration = 0 })
+	oldFetch := fetchPrice
+	release := make(chan struct{})
+	fetchPrice = func(currency string) (decimal.Decimal, string, error) {
+		<-release
+		return decimal.New(2, 0), "test", nil
+	}
+	t.Cleanup(func() { fetchPrice = oldFetch })
+	stopCheckLoops(t)
+	h := deadlineMiddleware(http.HandlerFunc(handlePay))
+	pay := func(deadline string) *httptest.ResponseRecorder {
+		values := url.Values{"amount": {"1"}, "currency": {"xts"}, "state": {"order"}}
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set(deadlineHeader, deadline)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := pay("soon"); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid deadline accepted: %d", w.Code)
+	}
+	w := pay("50")
+	if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "DEADLINE_EXCEEDED") {
+		t.Fatalf("deadline is not honored: %d %s", w.Code, w.Body)
+	}
+	err := forEachPayment(func(p *Payment) error {
+		t.Fatalf("payment is created after deadline: %+v", p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Price fetched in background is used by the next request.
+	close(release)
+	for cached := false; !cached; time.Sleep(time.Millisecond) {
+		mPrice.Lock()
+		_, cached = prices["XTS"]
+		mPrice.Unlock()
+	}
+	t.Cleanup(func() { delete(prices, "XTS") })
+	if w = pay("50"); w.Code != http.StatusOK {
+		t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+)
+
+// DebugStats is returned from admin debug endpoint.
+type DebugStats struct {
+	DB DBDebugStats `json:"db"`
+	// Longest of the recent database transactions.
+	LongestTransactions []TxRecord `json:"longestTransactions"`
+	// Open connections, sessions and subscriptions of websocket clients.
+	Websocket WebsocketDebugStats `json:"websocket"`
+}
+
+type DBDebugStats struct {
+	FileSize       int64             `json:"fileSize"`
+	FreePages      int               `json:"freePages"`
+	FreelistBytes  int               `json:"freelistBytes"`
+	FreelistInuse  int               `json:"freelistInuse"`
+	LastCompaction *CompactionResult `json:"lastCompaction"`
+}
+
+func handleAdminDebugStats(w http.ResponseWriter, r *http.Request) {
+	var stats DebugStats
+	stats.DB.FileSize, _ = databaseFileSize()
+	dbs := dbStats()
+	stats.DB.FreePages = dbs.FreePageN
+	stats.DB.FreelistBytes = dbs.FreeAlloc
+	stats.DB.FreelistInuse = dbs.FreelistInuse
+	stats.DB.LastCompaction = getLastCompaction()
+	stats.LongestTransactions = transactions.longest(10)
+	stats.Websocket = websocketDebugStats()
+	writeAdminJSON(w, &stats)
+}
+
+func handleAdminDebugProviders(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, priceProvidersHealth())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+const (
+	serviceStatusOK       = "ok"
+	serviceStatusDegraded = "degraded"
+)
+
+// nodeErrorBudget tracks the error rate of node requests in a rolling window
+// and switches the service to degraded mode when the rate is too high.
+// Degraded mode is announced to customers in API responses and to the operator with an alert.
+type nodeErrorBudget struct {
+	now    func() time.Time
+	notify func(kind, message string, details map[string]interface{})
+
+	m        sync.Mutex
+	buckets  []errorBucket
+	degraded bool
+	// Start of the period in which the error rate stayed below recovery threshold.
+	clearSince *time.Time
+}
+
+// errorBucket counts requests made in one second.
+type errorBucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+var nodeErrors = &nodeErrorBudget{
+	now:    clockNow,
+	notify: sendAlert,
+}
+
+// record adds the result of a node request and re-evaluates the service status.
+func (b *nodeErrorBudget) record(failed bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	now := b.now()
+	second := now.Unix()
+	if n := len(b.buckets); n == 0 || b.buckets[n-1].second != second {
+		b.buckets = append(b.buckets, errorBucket{second: second})
+	}
+	last := &b.buckets[len(b.buckets)-1]
+	last.requests++
+	if failed {
+		last.failures++
+	}
+	b.evaluate(now)
+}
+
+// status returns the service status and the message to display to customers.
+func (b *nodeErrorBudget) status() (status, message string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.evaluate(b.now())
+	if b.degraded {
+		return serviceStatusDegraded, config.DegradedMessage
+	}
+	return serviceStatusOK, ""
+}
+
+// rate returns the error rate in percent and number of requests in the window.
+func (b *nodeErrorBudget) rate(now time.Time) (rate float64, requests, failures int) {
+	cutoff := now.Add(-time.Duration(config.NodeErrorWindow) * time.Second).Unix()
+	i := 0
+	for i < len(b.buckets) && b.buckets[i].second <= cutoff {
+		i++
+	}
+	b.buckets = b.buckets[i:]
+	for _, bucket := range b.buckets {
+		requests += bucket.requests
+		failures += bucket.failures
+	}
+	if requests > 0 {
+		rate = float64(failures) * 100 / float64(requests)
+	}
+	return
+}
+
+// evaluate enters degraded mode when error rate reaches DegradedErrorRate.
+// Degraded mode is exited after error rate stays below DegradedRecoveryRate for DegradedCooldown.
+func (b *nodeErrorBudget) evaluate(now time.Time) {
+	if config.DegradedErrorRate <= 0 {
+		return
+	}
+	rate, requests, failures := b.rate(now)
+	details := map[string]interface{}{"errorRate": rate, "requests": requests, "failures": failures, "window": config.NodeErrorWindow}
+	if !b.degraded {
+		if requests >= config.DegradedMinRequests && rate >= config.DegradedErrorRate {
+			b.degraded = true
+			b.clearSince = nil
+			log.Warningf("entering degraded mode, node error rate: %.1f%%", rate)
+			b.notify("degraded_mode", "service is degraded because of node errors", details)
+		}
+		return
+	}
+	if rate >= config.DegradedRecoveryRate {
+		b.clearSince = nil
+		return
+	}
+	if b.clearSince == nil {
+		b.clearSince = &now
+	}
+	if now.Sub(*b.clearSince) >= time.Duration(config.DegradedCooldown)*time.Second {
+		b.degraded = false
+		b.clearSince = nil
+		log.Noticef("exiting degraded mode, node error rate: %.1f%%", rate)
+		b.notify("degraded_mode_resolved", "service is not degraded anymore", details)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestDegradedMode(t *testing.T) {
+	config.setDefaults()
+	config.DegradedErrorRate = 50
+	config.DegradedRecoveryRate = 10
+	config.DegradedCooldown = 60
+	config.NodeErrorWindow = 30
+	t.Cleanup(func() { config.DegradedErrorRate, config.DegradedRecoveryRate = 0, 0 })
+
+	now := time.Now()
+	var alerts []string
+	nodeErrors = &nodeErrorBudget{
+		now:    func() time.Time { return now },
+		notify: func(kind, message string, details map[string]interface{}) { alerts = append(alerts, kind) },
+	}
+	t.Cleanup(func() { nodeErrors = &nodeErrorBudget{now: time.Now, notify: sendAlert} })
+
+	var failing int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		fmt.Fprint(w, `{"balance": "0", "pending": "0"}`)
+	}))
+	defer srv.Close()
+	n := nano.New(srv.URL)
+	n.SetObserver(nodeErrors.record)
+	call := func(count int) {
+		for i := 0; i < count; i++ {
+			_, _ = n.AccountInfo("nano_1test")
+		}
+	}
+	status := func() string { return NewResponse(&Payment{}, "").ServiceStatus }
+
+	call(config.DegradedMinRequests - 1)
+	if s := status(); s != "" {
+		t.Fatalf("degraded before min requests: %q", s)
+	}
+	call(1)
+	response := NewResponse(&Payment{}, "")
+	if response.ServiceStatus != serviceStatusDegraded || response.ServiceMessage != config.DegradedMessage {
+		t.Fatalf("service is not degraded: %+v", response)
+	}
+	if len(alerts) != 1 || alerts[0] != "degraded_mode" {
+		t.Fatalf("unexpected alerts: %v", alerts)
+	}
+
+	// Node recovers. Failed requests leave the window but cooldown is not passed yet.
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(31 * time.Second)
+	call(10)
+	if s := status(); s != serviceStatusDegraded {
+		t.Fatal("recovered before cooldown")
+	}
+	now = now.Add(30 * time.Second)
+	if s := status(); s != serviceStatusDegraded {
+		t.Fatal("recovered before cooldown")
+	}
+	now = now.Add(31 * time.Second)
+	call(1)
+	if s := status(); s != "" {
+		t.Fatalf("service is still degraded: %q", s)
+	}
+	if len(alerts) != 2 || alerts[1] != "degraded_mode_resolved" {
+		t.Fatalf("unexpected alerts: %v", alerts)
+	}
+}
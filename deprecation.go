@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Old clients keep sending parameters that are renamed or replaced. Requests are normalized with the
+// table below before handlers read them, so legacy and modern forms of a request behave the same.
+// Each legacy form can be switched from mapping silently to warning and rejecting with DeprecatedParams.
+
+// Modes of deprecated parameters.
+const (
+	deprecationMap    = "map"
+	deprecationWarn   = "warn"
+	deprecationReject = "reject"
+)
+
+var metricDeprecatedParams = expvar.NewMap("deprecated_params_total")
+
+// deprecatedParam is a legacy form of a request parameter.
+type deprecatedParam struct {
+	// Name is used for the mode in DeprecatedParams and the metric.
+	Name string
+	// Endpoint the parameter is sent to.
+	Path string
+	// Legacy parameter name and the parameter it is renamed to.
+	Param    string
+	NewParam string
+	// If set, only this value of Param is legacy and it is replaced with NewValue. Compared case-insensitively.
+	Value    string
+	NewValue string
+}
+
+var deprecatedParams = []deprecatedParam{
+	// Same name as the preset field.
+	{Name: "notification_url", Path: "/api/pay", Param: "notification_url", NewParam: "notify_url"},
+	// Amount in the native currency is requested without currency.
+	{Name: "currency=NANO", Path: "/api/pay", Param: "currency", NewParam: "currency", Value: "NANO"},
+	{Name: "currency=XNO", Path: "/api/pay", Param: "currency", NewParam: "currency", Value: "XNO"},
+}
+
+// used returns true if the request form has the legacy form of the parameter.
+func (d deprecatedParam) used(r *http.Request) bool {
+	values, ok := r.Form[d.Param]
+	if !ok {
+		return false
+	}
+	return d.Value == "" || (len(values) > 0 && strings.EqualFold(values[0], d.Value))
+}
+
+// apply replaces the legacy form in the request form with the modern one.
+func (d deprecatedParam) apply(r *http.Request) {
+	value := r.Form.Get(d.Param)
+	if d.Value != "" {
+		value = d.NewValue
+	}
+	if d.Param != d.NewParam {
+		r.Form.Del(d.Param)
+		if _, ok := r.Form[d.NewParam]; ok {
+			// Modern parameter is used if both are sent.
+			return
+		}
+	}
+	r.Form.Set(d.NewParam, value)
+}
+
+func (d deprecatedParam) mode() string {
+	if mode, ok := config.DeprecatedParams[d.Name]; ok {
+		return mode
+	}
+	return deprecationMap
+}
+
+func deprecatedParamNames() []string {
+	names := make([]string, len(deprecatedParams))
+	for i, d := range deprecatedParams {
+		names[i] = d.Name
+	}
+	return names
+}
+
+// clientFingerprint identifies the client in metrics without exposing its API key.
+func clientFingerprint(r *http.Request) string {
+	key, _ := requestAPIKey(r)
+	if key == "" {
+		return "anonymous"
+	}
+	return keyFingerprint(key)
+}
+
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// normalizeDeprecatedParams maps the legacy parameters of r to their modern forms.
+// It writes an error response and returns false if one of them is rejected.
+func normalizeDeprecatedParams(w http.ResponseWriter, r *http.Request) bool {
+	if r.Form == nil {
+		// Same as r.FormValue, which ignores the parse errors.
+		_ = r.ParseMultipartForm(32 << 20)
+	}
+	var warned []string
+	for _, d := range deprecatedParams {
+		if d.Path != r.URL.Path || !d.used(r) {
+			continue
+		}
+		metricDeprecatedParams.Add(d.Name+"."+clientFingerprint(r), 1)
+		switch d.mode() {
+		case deprecationReject:
+			setDeprecationHeaders(w)
+			writeError(w, errCodeDeprecatedParameter, http.StatusBadRequest, "deprecated parameter: "+d.Name)
+			return false
+		case deprecationWarn:
+			warned = append(warned, d.Name)
+		}
+		d.apply(r)
+	}
+	if len(warned) > 0 {
+		log.Warningf("deprecated parameters in request to %s: %s", r.URL.Path, strings.Join(warned, ", "))
+		setDeprecationHeaders(w)
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", "deprecated parameters: "+strings.Join(warned, ", ")))
+	}
+	return true
+}
+
+func setDeprecationHeaders(w http.ResponseWriter) {
+	w.Header().Set("Deprecation", "true")
+	if config.DeprecationSunset != "" {
+		sunset, _ := time.Parse(time.RFC3339, config.DeprecationSunset)
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+}
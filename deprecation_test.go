@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeprecatedParamsMapping(t *testing.T) {
+	config.DeprecatedParams = nil
+	normalized := func(path string, values url.Values) url.Values {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		if !normalizeDeprecatedParams(w, r) {
+			t.Fatalf("request is rejected: %s", w.Body)
+		}
+		if w.Header().Get("Deprecation") != "" {
+			t.Fatal("deprecation header is set in map mode")
+		}
+		return r.Form
+	}
+	for _, d := range deprecatedParams {
+		t.Run(d.Name, func(t *testing.T) {
+			legacy, modern := url.Values{"amount": {"1"}}, url.Values{"amount": {"1"}}
+			if d.Value != "" {
+				legacy.Set(d.Param, strings.ToLower(d.Value))
+				modern.Set(d.NewParam, d.NewValue)
+			} else {
+				legacy.Set(d.Param, "https://example.com/hook")
+				modern.Set(d.NewParam, "https://example.com/hook")
+			}
+			if got, expected := normalized(d.Path, legacy), normalized(d.Path, modern); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("legacy form is mapped to %v, expected %v", got, expected)
+			}
+		})
+	}
+}
+
+func TestPayWithLegacyCurrency(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedDuration = -1
+	config.DeprecationSunset = "2030-01-01T00:00:00Z"
+	t.Cleanup(func() {
+		config.AllowedDuration = 0
+		config.DeprecatedParams = nil
+		config.DeprecationSunset = ""
+	})
+	stopCheckLoops(t)
+	pay := func(values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+	currency := func(w *httptest.ResponseRecorder) string {
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %s", err, w.Body)
+		}
+		return response.Currency + " " + response.AmountInCurrency.String()
+	}
+	modern := currency(pay(url.Values{"amount": {"0.5"}}))
+	if legacy := currency(pay(url.Values{"amount": {"0.5"}, "currency": {"NANO"}})); legacy != modern {
+		t.Fatalf("legacy currency creates %s, expected %s", legacy, modern)
+	}
+
+	config.DeprecatedParams = map[string]string{"currency=NANO": deprecationWarn}
+	w := pay(url.Values{"amount": {"0.5"}, "currency": {"NANO"}})
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" || w.Header().Get("Sunset") != "Tue, 01 Jan 2030 00:00:00 GMT" || w.Header().Get("Warning") == "" {
+		t.Fatalf("legacy currency is not warned: %d %v", w.Code, w.Header())
+	}
+	config.DeprecatedParams = map[string]string{"currency=NANO": deprecationReject}
+	w = pay(url.Values{"amount": {"0.5"}, "currency": {"NANO"}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "DEPRECATED_PARAMETER") {
+		t.Fatalf("legacy currency is not rejected: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"go.etcd.io/bbolt"
+)
+
+// A digest summarizes the payments of a day for merchants that do not watch the admin endpoints.
+// Digest of all payments is posted to DigestURL and digests of the payments created with an API key
+// are posted to DigestURL of the key. The last sent date of each digest is saved, so a restart does not send it again.
+
+const (
+	digestsBucket    = "digests"
+	digestDateLayout = "2006-01-02"
+	digestEvent      = "daily_digest"
+	// Name of the digest of all payments.
+	digestAll = "all"
+	// Number of errors in a digest.
+	digestTopErrors = 5
+)
+
+var metricDigestsSent = expvar.NewInt("digests_sent_total")
+
+const defaultDigestTemplate = `Payments on {{.Date}}
+Created: {{.Created}}
+Verified: {{.Verified}}
+Expired with funds: {{.ExpiredWithFunds}}
+Received: {{.Received}} NANO
+{{range $currency, $amount := .ReceivedByCurrency}}  {{$amount}} {{$currency}}
+{{end}}{{if .TopErrors}}Top errors:
+{{range .TopErrors}}  {{.Count}} x {{.Error}}
+{{end}}{{end}}{{if .Attention}}Needs attention:
+{{range .Attention}}  {{.Account}} ({{.PaymentID}}): {{.Reason}}
+{{end}}{{end}}`
+
+// Digest is the summary of payments of a day.
+type Digest struct {
+	Event string `json:"event"`
+	Date  string `json:"date"`
+	// Fingerprint of the API key for the digest of a merchant. Empty for all payments.
+	Client string `json:"client,omitempty"`
+	// Payments created and verified on the day.
+	Created  int `json:"created"`
+	Verified int `json:"verified"`
+	// Payments expired on the day with funds less than the amount.
+	ExpiredWithFunds int `json:"expiredWithFunds"`
+	// Balances of payments verified on the day, in NANO.
+	Received decimal.Decimal `json:"received"`
+	// Requested amounts of payments verified on the day, by currency.
+	ReceivedByCurrency map[string]decimal.Decimal `json:"receivedByCurrency"`
+	// Notification errors of payments created or verified on the day, most frequent first.
+	TopErrors []DigestError `json:"topErrors"`
+	// Payments waiting for the operator at the time the digest is made.
+	Attention []DigestItem `json:"attention"`
+	// Digest rendered with DigestTemplate.
+	Text string `json:"text"`
+}
+
+type DigestError struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+type DigestItem struct {
+	Account   string `json:"account"`
+	PaymentID string `json:"paymentId"`
+	// One of "disputed", "late_paid", "notification_failed" or "pending_overflow".
+	Reason string `json:"reason"`
+}
+
+// digestTarget is a digest that is sent every day.
+type digestTarget struct {
+	name   string
+	client string
+	url    string
+}
+
+func digestTargets() []digestTarget {
+	var targets []digestTarget
+	if config.DigestURL != "" {
+		targets = append(targets, digestTarget{name: digestAll, url: config.DigestURL})
+	}
+	for key, apiKey := range config.APIKeys {
+		if apiKey.DigestURL != "" {
+			fp := keyFingerprint(key)
+			targets = append(targets, digestTarget{name: fp, client: fp, url: apiKey.DigestURL})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+	return targets
+}
+
+// inDay returns true if t is in the day starting at start.
+func inDay(t *time.Time, start time.Time) bool {
+	return t != nil && !t.Before(start) && t.Before(start.AddDate(0, 0, 1))
+}
+
+// collectDigest summarizes the payments on the UTC day of date. Only the payments of client are included if it is set.
+func collectDigest(date time.Time, client string) (*Digest, error) {
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	d := &Digest{
+		Event:              digestEvent,
+		Date:               start.Format(digestDateLayout),
+		Client:             client,
+		ReceivedByCurrency: make(map[string]decimal.Decimal),
+		TopErrors:          []DigestError{},
+		Attention:          []DigestItem{},
+	}
+	errorCounts := make(map[string]int)
+	err := forEachPayment(func(p *Payment) error {
+		if p.Sandbox || (client != "" && p.Client != client) {
+			return nil
+		}
+		created, verified := inDay(&p.CreatedAt, start), inDay(p.FulfilledAt, start)
+		if created {
+			d.Created++
+		}
+		if verified {
+			d.Verified++
+			d.Received = d.Received.Add(RawToNano(p.Balance))
+			d.ReceivedByCurrency[p.Currency] = d.ReceivedByCurrency[p.Currency].Add(p.AmountInCurrency.Decimal)
+		}
+		if expiresAt := p.expiresAt(); p.FulfilledAt == nil && p.Balance.IsPositive() && inDay(&expiresAt, start) {
+			d.ExpiredWithFunds++
+		}
+		if (created || verified) && p.NotificationError != "" {
+			errorCounts[p.NotificationError]++
+		}
+		if reason := p.attentionReason(); reason != "" {
+			d.Attention = append(d.Attention, DigestItem{Account: p.Account, PaymentID: p.PaymentID, Reason: reason})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for e, n := range errorCounts {
+		d.TopErrors = append(d.TopErrors, DigestError{Error: e, Count: n})
+	}
+	sort.Slice(d.TopErrors, func(i, j int) bool {
+		if d.TopErrors[i].Count != d.TopErrors[j].Count {
+			return d.TopErrors[i].Count > d.TopErrors[j].Count
+		}
+		return d.TopErrors[i].Error < d.TopErrors[j].Error
+	})
+	if len(d.TopErrors) > digestTopErrors {
+		d.TopErrors = d.TopErrors[:digestTopErrors]
+	}
+	d.Text, err = renderDigest(d)
+	return d, err
+}
+
+// attentionReason returns why the payment needs the operator, if it does.
+func (p *Payment) attentionReason() string {
+	switch {
+	case p.disputed():
+		return "disputed"
+	case p.Late.unresolved():
+		return "late_paid"
+	case p.NotificationFailedAt != nil && p.SentAt == nil:
+		return "notification_failed"
+	case p.PendingOverflowAt != nil && p.SentAt == nil:
+		return "pending_overflow"
+	}
+	return ""
+}
+
+func renderDigest(d *Digest) (string, error) {
+	var t *template.Template
+	var err error
+	if config.DigestTemplate != "" {
+		t, err = template.ParseFiles(config.DigestTemplate)
+	} else {
+		t, err = template.New("digest").Parse(defaultDigestTemplate)
+	}
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, d)
+	return buf.String(), err
+}
+
+func lastDigestDate(name string) (string, error) {
+	var date string
+	err := dbView(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(digestsBucket)); b != nil {
+			date = string(b.Get([]byte(name)))
+		}
+		return nil
+	})
+	return date, err
+}
+
+func saveDigestDate(name, date string) error {
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(digestsBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), []byte(date))
+	})
+}
+
+// postDigest posts d to url through the outbox if it is enabled.
+func postDigest(name, url string, d *Digest) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if outbox != nil {
+		return outbox.enqueue(&Delivery{Account: "digest:" + name, Event: digestEvent, URL: url, Body: data})
+	}
+	return deliverNotification(http.DefaultClient, url, data)
+}
+
+// sendDueDigests sends the digests of the day before now that are not sent yet.
+// Digests are sent after DigestHour. A digest that cannot be sent is tried again on the next call.
+func sendDueDigests(now time.Time) {
+	now = now.UTC()
+	if now.Hour() < config.DigestHour {
+		return
+	}
+	date := now.AddDate(0, 0, -1)
+	day := date.Format(digestDateLayout)
+	for _, target := range digestTargets() {
+		last, err := lastDigestDate(target.name)
+		if err != nil {
+			log.Errorln("cannot load digest date:", err)
+			return
+		}
+		// Dates in the layout sort by time.
+		if last >= day {
+			continue
+		}
+		d, err := collectDigest(date, target.client)
+		if err != nil {
+			log.Errorf("cannot collect digest %s: %s", target.name, err)
+			continue
+		}
+		if err = postDigest(target.name, target.url, d); err != nil {
+			log.Warningf("cannot send digest %s: %s", target.name, err)
+			continue
+		}
+		if err = saveDigestDate(target.name, day); err != nil {
+			log.Errorln("cannot save digest date:", err)
+			continue
+		}
+		metricDigestsSent.Add(1)
+		log.Noticef("sent digest %s of %s", target.name, day)
+	}
+}
+
+// handleAdminDigestPreview returns the digest of a day without sending it.
+// Date defaults to yesterday, client is the fingerprint of an API key.
+func handleAdminDigestPreview(w http.ResponseWriter, r *http.Request) {
+	date := clock.Now().UTC().AddDate(0, 0, -1)
+	if s := r.FormValue("date"); s != "" {
+		var err error
+		date, err = time.Parse(digestDateLayout, s)
+		if err != nil {
+			http.Error(w, "invalid date", http.StatusBadRequest)
+			return
+		}
+	}
+	d, err := collectDigest(date, r.FormValue("client"))
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(d.Text))
+		return
+	}
+	writeAdminJSON(w, d)
+}
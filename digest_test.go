@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestDailyDigest(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	c := useFakeClock(t, time.Date(2020, 1, 2, 5, 0, 0, 0, time.UTC))
+	var mu sync.Mutex
+	received := make(map[string][]Digest)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d Digest
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &d); err != nil {
+			t.Errorf("invalid digest: %s", b)
+		}
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], d)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	config.DigestURL = ts.URL + "/all"
+	config.DigestHour = 6
+	config.APIKeys = map[string]APIKey{"merchant-key": {DigestURL: ts.URL + "/merchant"}}
+	t.Cleanup(func() {
+		config.DigestURL = ""
+		config.DigestHour = 0
+		config.APIKeys = nil
+	})
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) *time.Time {
+		t := day.Add(time.Duration(h) * time.Hour)
+		return &t
+	}
+	merchant := keyFingerprint("merchant-key")
+	payments := []*Payment{
+		{Account: "nano_1verified", Client: merchant, CreatedAt: *at(1), FulfilledAt: at(2), Currency: "USD",
+			AmountInCurrency: NewCurrencyAmount(decimal.NewFromInt(10), "USD"), Balance: NanoToRaw(decimal.NewFromInt(5))},
+		{Account: "nano_1expired", CreatedAt: *at(3), Timeout: 600, Balance: NanoToRaw(decimal.NewFromInt(1)), Amount: NanoToRaw(decimal.NewFromInt(2))},
+		{Account: "nano_1failed", Client: merchant, CreatedAt: *at(4), NotificationError: "connection refused", NotificationFailedAt: at(5)},
+		{Account: "nano_1yesterday", CreatedAt: day.Add(-time.Hour)},
+	}
+	for _, p := range payments {
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not sent before DigestHour.
+	sendDueDigests(c.Now())
+	if len(received) != 0 {
+		t.Fatalf("digest is sent before DigestHour: %v", received)
+	}
+	c.Add(2 * time.Hour)
+	sendDueDigests(c.Now())
+	all, own := received["/all"], received["/merchant"]
+	if len(all) != 1 || len(own) != 1 {
+		t.Fatalf("unexpected digests: %v", received)
+	}
+	if d := all[0]; d.Date != "2020-01-01" || d.Created != 3 || d.Verified != 1 || d.ExpiredWithFunds != 1 ||
+		!d.Received.Equal(decimal.NewFromInt(5)) || !d.ReceivedByCurrency["USD"].Equal(decimal.NewFromInt(10)) {
+		t.Errorf("unexpected digest: %+v", d)
+	}
+	if d := own[0]; d.Client != merchant || d.Created != 2 || len(d.Attention) != 1 || d.Attention[0].Reason != "notification_failed" ||
+		len(d.TopErrors) != 1 || d.TopErrors[0].Count != 1 || !strings.Contains(d.Text, "connection refused") {
+		t.Errorf("unexpected merchant digest: %+v", d)
+	}
+
+	// Sent once per day, also after a restart reads the dates from the database.
+	sendDueDigests(c.Now())
+	if len(received["/all"]) != 1 {
+		t.Fatal("digest is sent again")
+	}
+	c.Add(24 * time.Hour)
+	sendDueDigests(c.Now())
+	if all = received["/all"]; len(all) != 2 || all[1].Date != "2020-01-02" || all[1].Created != 0 {
+		t.Fatalf("next digest is not sent: %+v", all)
+	}
+
+	w := httptest.NewRecorder()
+	handleAdminDigestPreview(w, httptest.NewRequest(http.MethodGet, "/admin/digest/preview?date=2020-01-01&client="+merchant, nil))
+	var preview Digest
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil || preview.Created != 2 {
+		t.Fatalf("unexpected preview: %d %s", w.Code, w.Body)
+	}
+	if len(received["/merchant"]) != 2 {
+		t.Errorf("preview is sent: %d", len(received["/merchant"]))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checkout pages can show the amount in more currencies than the one the payment is created in.
+// Display amounts are informational only, Amount is still the amount the customer needs to send.
+
+var errTooManyDisplayCurrencies = errors.New("too many display currencies")
+
+// DisplayAmount is the amount of the payment in one of the currencies requested in display_currencies.
+type DisplayAmount struct {
+	Currency string          `json:"currency"`
+	Amount   *CurrencyAmount `json:"amount,omitempty"`
+	// Set when Amount is calculated from the current price instead of the rate the payment is created with.
+	Indicative bool `json:"indicative,omitempty"`
+	// Time of the current price. Not set for the rate of the payment.
+	AsOf *time.Time `json:"asOf,omitempty"`
+	// Set instead of Amount if the currency is invalid or its price is not available.
+	Warning string `json:"warning,omitempty"`
+}
+
+// parseDisplayCurrencies parses the comma separated currencies in display_currencies parameter.
+// Duplicates are removed. Invalid currencies are kept, they are reported in their display entries.
+func parseDisplayCurrencies(s string) ([]string, error) {
+	var currencies []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c != "" && !stringInSlice(c, currencies) {
+			currencies = append(currencies, c)
+		}
+	}
+	if len(currencies) > config.MaxDisplayCurrencies {
+		return nil, errTooManyDisplayCurrencies
+	}
+	return currencies, nil
+}
+
+// displayAmounts returns the amount of p in currencies.
+// Currency of the payment is displayed at the stored rate. Others use the cached current price.
+func displayAmounts(ctx context.Context, p *Payment, currencies []string) []DisplayAmount {
+	if len(currencies) == 0 {
+		return nil
+	}
+	ret := make([]DisplayAmount, 0, len(currencies))
+	for _, currency := range currencies {
+		d := DisplayAmount{Currency: currency}
+		switch {
+		case !validCurrency(currency):
+			d.Warning = "invalid currency"
+		case currency == p.Currency && p.Currency != "BCB":
+			d.Amount = &p.AmountInCurrency
+		default:
+			quote, err := getNanoPriceQuoteContext(ctx, currency)
+			if err == errPriceCurrencyUnsupported {
+				d.Warning = "currency is not supported"
+				break
+			}
+			if err != nil {
+				d.Warning = "price is not available"
+				break
+			}
+			a := NewCurrencyAmount(RawToNano(p.Amount).Mul(quote.Price), currency)
+			d.Amount = &a
+			d.Indicative = true
+			d.AsOf = &quote.AsOf
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+// writeDisplayCurrenciesError writes the error for an invalid display_currencies parameter.
+func writeDisplayCurrenciesError(w http.ResponseWriter) {
+	writeError(w, errCodeInvalidCurrency, http.StatusBadRequest, "at most "+strconv.Itoa(config.MaxDisplayCurrencies)+" display currencies are allowed")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestDisplayCurrencies(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	fakePriceSource(t)
+	fetch := fetchPrice
+	fetchPrice = func(currency string) (decimal.Decimal, string, error) {
+		if currency == "XYZ" {
+			return decimal.Zero, "", errors.New("unknown currency")
+		}
+		return fetch(currency)
+	}
+	// Created at 5 USD per NANO, current price is 2.
+	p := &Payment{
+		Account:          "nano_1display",
+		PaymentID:        "display",
+		Amount:           NanoToRaw(decimal.NewFromInt(2)),
+		AmountInCurrency: NewCurrencyAmount(decimal.NewFromInt(10), "USD"),
+		Currency:         "USD",
+		Price:            decimal.NewFromInt(5),
+		CreatedAt:        clock.Now(),
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken("1", p.Account, p.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleVerify(w, httptest.NewRequest(http.MethodGet, "/api/verify?token="+token+"&display_currencies=eur,USD,xyz,U1,EUR", nil))
+	var response Response
+	if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if len(response.Display) != 4 {
+		t.Fatalf("unexpected display amounts: %+v", response.Display)
+	}
+	eur, usd, xyz, invalid := response.Display[0], response.Display[1], response.Display[2], response.Display[3]
+	if eur.Currency != "EUR" || eur.Amount.String() != "4.00" || !eur.Indicative || eur.AsOf == nil {
+		t.Errorf("unexpected indicative amount: %+v", eur)
+	}
+	if usd.Amount.String() != "10.00" || usd.Indicative || usd.AsOf != nil {
+		t.Errorf("unexpected stored amount: %+v", usd)
+	}
+	if xyz.Amount != nil || xyz.Warning == "" || invalid.Amount != nil || invalid.Warning == "" {
+		t.Errorf("unknown currencies are not skipped: %+v %+v", xyz, invalid)
+	}
+	if !response.Amount.Equal(decimal.NewFromInt(2)) || response.AmountInCurrency.String() != "10.00" {
+		t.Errorf("payment amounts are changed: %s %s", response.Amount, response.AmountInCurrency)
+	}
+
+	w = httptest.NewRecorder()
+	handleVerify(w, httptest.NewRequest(http.MethodGet, "/api/verify?token="+token+"&display_currencies=A,B,C,D,E,F", nil))
+	expectErrorCode(t, w, http.StatusBadRequest, errCodeInvalidCurrency)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Dispositions of a resolved dispute.
+const (
+	dispositionRefunded   = "refunded"
+	dispositionReleased   = "released"
+	dispositionWrittenOff = "written_off"
+)
+
+const (
+	maxDisputeReasonLength = 200
+	maxDisputeNotesLength  = 4000
+)
+
+var errPaymentDisputed = errors.New("payment is disputed")
+
+// Dispute is opened by admin when customer claims a problem with the payment.
+// Funds of a disputed payment are not sent to the merchant until the dispute is resolved.
+type Dispute struct {
+	Reason   string    `json:"reason"`
+	Notes    string    `json:"notes"`
+	OpenedAt time.Time `json:"openedAt"`
+	OpenedBy string    `json:"openedBy"`
+	// Set when dispute is resolved.
+	ResolvedAt      *time.Time `json:"resolvedAt"`
+	ResolvedBy      string     `json:"resolvedBy,omitempty"`
+	Disposition     string     `json:"disposition,omitempty"`
+	ResolutionNotes string     `json:"resolutionNotes,omitempty"`
+}
+
+// PaymentDisputed is published when a dispute is opened or resolved.
+type PaymentDisputed struct {
+	Payment
+}
+
+func (p PaymentDisputed) Account() Account {
+	return Account(p.Payment.Account)
+}
+
+// disputed returns true if the payment has an open dispute.
+func (p Payment) disputed() bool {
+	return p.Dispute != nil && p.Dispute.ResolvedAt == nil
+}
+
+func init() {
+	expvar.Publish("disputed_payments", expvar.Func(func() interface{} {
+		var count int
+		_ = forEachPayment(func(p *Payment) error {
+			if p.disputed() {
+				count++
+			}
+			return nil
+		})
+		return count
+	}))
+}
+
+// adminIdentity returns the name of the admin making the request.
+func adminIdentity(r *http.Request) string {
+	username, _, _ := r.BasicAuth()
+	return username
+}
+
+// updateDispute loads the payment, calls f and saves the payment if f returns true.
+// f must write the error response if it returns false.
+func updateDispute(w http.ResponseWriter, r *http.Request, f func(p *Payment) bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	payment := updatePayment(w, r, f)
+	if payment == nil {
+		return
+	}
+	go verifications.Publish(PaymentDisputed{Payment: *payment})
+	writeAdminJSON(w, payment)
+}
+
+func handleAdminDispute(w http.ResponseWriter, r *http.Request) {
+	updateDispute(w, r, func(p *Payment) bool {
+		reason, notes := r.FormValue("reason"), r.FormValue("notes")
+		if reason == "" || len(reason) > maxDisputeReasonLength {
+			http.Error(w, "invalid reason", http.StatusBadRequest)
+			return false
+		}
+		if len(notes) > maxDisputeNotesLength {
+			http.Error(w, "notes too long", http.StatusBadRequest)
+			return false
+		}
+		if p.disputed() {
+			http.Error(w, "payment is already disputed", http.StatusConflict)
+			return false
+		}
+		p.Dispute = &Dispute{
+			Reason:   reason,
+			Notes:    notes,
+			OpenedAt: *now(),
+			OpenedBy: adminIdentity(r),
+		}
+		log.Noticef("dispute opened for %s by %s", p.Account, p.Dispute.OpenedBy)
+		return true
+	})
+}
+
+func handleAdminResolveDispute(w http.ResponseWriter, r *http.Request) {
+	updateDispute(w, r, func(p *Payment) bool {
+		disposition, notes := r.FormValue("disposition"), r.FormValue("notes")
+		switch disposition {
+		case dispositionRefunded, dispositionReleased, dispositionWrittenOff:
+		default:
+			http.Error(w, "invalid disposition", http.StatusBadRequest)
+			return false
+		}
+		if len(notes) > maxDisputeNotesLength {
+			http.Error(w, "notes too long", http.StatusBadRequest)
+			return false
+		}
+		if !p.disputed() {
+			http.Error(w, "payment is not disputed", http.StatusConflict)
+			return false
+		}
+		p.Dispute.ResolvedAt = now()
+		p.Dispute.ResolvedBy = adminIdentity(r)
+		p.Dispute.Disposition = disposition
+		p.Dispute.ResolutionNotes = notes
+		log.Noticef("dispute resolved for %s by %s: %s", p.Account, p.Dispute.ResolvedBy, disposition)
+		return true
+	})
+}
+
+// handleAdminGetDisputedPayments returns payments with open disputes, or all disputes if all=true.
+// They can be filtered by merchant.
+func handleAdminGetDisputedPayments(w http.ResponseWriter, r *http.Request) {
+	all := r.FormValue("all") == "true"
+	merchant := r.FormValue("merchant")
+	payments := make([]*Payment, 0)
+	err := forEachPayment(func(p *Payment) error {
+		if merchant != "" && p.Merchant != merchant {
+			return nil
+		}
+		if p.disputed() || (all && p.Dispute != nil) {
+			payments = append(payments, p)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, payments)
+}
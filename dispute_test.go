@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postAdminForm(h http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(adminName, "")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestDispute(t *testing.T) {
+	openTestDB(t, 0)
+	// Received but not yet sent to merchant.
+	p := &Payment{Account: "nano_1disputed", FulfilledAt: now(), NotifiedAt: now(), ReceivedAt: now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := postAdminForm(handleAdminDispute, url.Values{"account": {p.Account}, "reason": {"not delivered"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot open dispute: %d %s", w.Code, w.Body)
+	}
+	p, _ = LoadPayment([]byte(p.Account))
+	if !p.disputed() || p.Dispute.OpenedBy != adminName {
+		t.Fatalf("payment is not disputed: %+v", p.Dispute)
+	}
+	// Sweep is blocked while disputed.
+	if err := p.process(); err != errPaymentDisputed {
+		t.Errorf("expected errPaymentDisputed, got %v", err)
+	}
+	if w = postAdminForm(handleAdminDispute, url.Values{"account": {p.Account}, "reason": {"again"}}); w.Code != http.StatusConflict {
+		t.Errorf("expected conflict, got %d", w.Code)
+	}
+	if w = postAdminForm(handleAdminResolveDispute, url.Values{"account": {p.Account}, "disposition": {"unknown"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %d", w.Code)
+	}
+	w = postAdminForm(handleAdminResolveDispute, url.Values{"account": {p.Account}, "disposition": {dispositionWrittenOff}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot resolve dispute: %d %s", w.Code, w.Body)
+	}
+	p, _ = LoadPayment([]byte(p.Account))
+	if p.disputed() || p.Dispute.Disposition != dispositionWrittenOff {
+		t.Errorf("dispute is not resolved: %+v", p.Dispute)
+	}
+	txs := paymentTransactions(p)
+	if len(txs) != 2 || txs[1].Kind != "written_off" {
+		t.Errorf("unexpected transactions: %+v", txs)
+	}
+}
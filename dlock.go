@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+var (
+	errLeaseLost   = errors.New("lease of distributed lock is lost")
+	errLockTimeout = errors.New("timed out waiting for distributed lock")
+)
+
+// DistributedLock guards money moving operations on a payment account
+// when multiple instances share the same payment store.
+// It is acquired in addition to the in-process per-account lock.
+type DistributedLock interface {
+	// Acquire blocks until the lock for key is obtained.
+	// It returns errLockTimeout if the lock is held by another instance for LockWaitTimeout.
+	Acquire(key string) (Lease, error)
+}
+
+// Lease is a held DistributedLock.
+// Implementations with expiring leases must renew them in background while held.
+type Lease interface {
+	// Lost is closed when the lease cannot be renewed anymore.
+	// Blocks must not be published after the lease is lost.
+	Lost() <-chan struct{}
+	Release() error
+}
+
+// moneyLock is set depending on the configured store.
+// BoltDB can only be opened by a single process so no distributed lock is required for it.
+// Instances sharing a SQL store use Redis if LockRedisAddress is set, or advisory locks of Postgres.
+var moneyLock DistributedLock = noopLock{}
+
+type noopLock struct{}
+
+func (noopLock) Acquire(key string) (Lease, error) { return noopLease{}, nil }
+
+type noopLease struct{}
+
+func (noopLease) Lost() <-chan struct{} { return nil }
+func (noopLease) Release() error        { return nil }
+
+// withMoneyLock runs f while holding the distributed lock for account.
+func withMoneyLock(account string, f func(lease Lease) error) error {
+	lease, err := moneyLock.Acquire(account)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := lease.Release(); err2 != nil {
+			log.Errorln("cannot release lock:", err2)
+		}
+	}()
+	return f(lease)
+}
+
+// publish processes block on the node after checking that the lease is still held.
+func publish(lease Lease, block string) (string, error) {
+	select {
+	case <-lease.Lost():
+		return "", errLeaseLost
+	default:
+	}
+	return checkerNode().Process(block)
+}
+
+// renewingLease is a helper for DistributedLock implementations with expiring leases.
+// It calls renew periodically until the lease is released and marks the lease lost if renew fails.
+type renewingLease struct {
+	release func() error
+	lost    chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newRenewingLease(interval time.Duration, renew, release func() error) *renewingLease {
+	l := &renewingLease{
+		release: release,
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go l.run(interval, renew)
+	return l
+}
+
+func (l *renewingLease) run(interval time.Duration, renew func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := renew(); err != nil {
+				log.Errorln("cannot renew lease:", err)
+				close(l.lost)
+				return
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *renewingLease) Lost() <-chan struct{} { return l.lost }
+
+func (l *renewingLease) Release() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		err = l.release()
+	})
+	return err
+}
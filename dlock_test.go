@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// fakeRedis implements the commands used by redisLock. Keys do not expire.
+type fakeRedis struct {
+	mu   sync.Mutex
+	keys map[string]string
+	addr string
+}
+
+func fakeRedisServer(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeRedis{keys: make(map[string]string), addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, _ = r.ReadString('\n')
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		_, _ = io.ReadFull(r, b)
+		args[i] = string(b[:size])
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch args[0] {
+	case "SET":
+		if _, ok := s.keys[args[1]]; ok {
+			_, _ = io.WriteString(conn, "$-1\r\n")
+			return
+		}
+		s.keys[args[1]] = args[2]
+		_, _ = io.WriteString(conn, "+OK\r\n")
+	case "EVAL":
+		key, token := args[3], args[4]
+		if s.keys[key] != token {
+			_, _ = io.WriteString(conn, ":0\r\n")
+			return
+		}
+		if args[1] == redisReleaseScript {
+			delete(s.keys, key)
+		}
+		_, _ = io.WriteString(conn, ":1\r\n")
+	default:
+		_, _ = io.WriteString(conn, "-ERR unknown command\r\n")
+	}
+}
+
+func useRedisLock(t *testing.T, addr string, ttl time.Duration) *redisLock {
+	l := newRedisLock(addr, ttl, time.Minute)
+	l.retry = time.Millisecond
+	old := moneyLock
+	moneyLock = l
+	t.Cleanup(func() { moneyLock = old })
+	return l
+}
+
+func TestRedisLock(t *testing.T) {
+	s := fakeRedisServer(t)
+	l := useRedisLock(t, s.addr, 30*time.Millisecond)
+
+	lease, err := l.Acquire("nano_1a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan Lease)
+	go func() {
+		lease2, err2 := l.Acquire("nano_1a")
+		if err2 != nil {
+			t.Error(err2)
+		}
+		acquired <- lease2
+	}()
+	// Lease is renewed while held, so the other instance keeps waiting.
+	select {
+	case <-acquired:
+		t.Fatal("lock is acquired twice")
+	case <-lease.Lost():
+		t.Fatal("lease is lost while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err = lease.Release(); err != nil {
+		t.Fatal(err)
+	}
+	lease = <-acquired
+
+	// Lease is lost when the key is taken over, e.g. after expiry.
+	s.mu.Lock()
+	s.keys[l.prefix+"nano_1a"] = "other"
+	s.mu.Unlock()
+	select {
+	case <-lease.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lease is not lost")
+	}
+	if _, err = publish(lease, "{}"); err != errLeaseLost {
+		t.Errorf("block is published after lease is lost: %v", err)
+	}
+	_ = lease.Release()
+	s.mu.Lock()
+	if s.keys[l.prefix+"nano_1a"] != "other" {
+		t.Error("lock of another instance is released")
+	}
+	s.mu.Unlock()
+}
+
+// Two instances share the payment store, the node and the lock server.
+// In-process locks are not taken, so only the distributed lock separates them.
+func TestMoneyLockTwoInstances(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	useRedisLock(t, fakeRedisServer(t).addr, time.Second)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	config.FeeAccount = "nano_1fee"
+	config.FeePercent = "10"
+	t.Cleanup(func() { config.Account, config.FeeAccount, config.FeePercent = "", "", "" })
+	amount := NanoToRaw(decimal.NewFromInt(1))
+	p := &Payment{Account: "nano_1shared", PublicKey: randomHash(), Amount: amount.Mul(decimal.NewFromInt(3)), CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ledger.send("nano_1customer", p.Account, amount)
+	}
+
+	instances := func(f func(p *Payment) error) {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			p2, err := LoadPayment([]byte(p.Account))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := f(p2); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	instances(func(p *Payment) error { return p.receivePending() })
+	ledger.mu.Lock()
+	if ledger.published != 3 || !ledger.balances[p.Account].Equal(amount.Mul(decimal.NewFromInt(3))) {
+		t.Fatalf("blocks are not received once: %d", ledger.published)
+	}
+	ledger.mu.Unlock()
+
+	instances(func(p *Payment) error {
+		err := p.sendToMerchant()
+		if err != nil {
+			return err
+		}
+		p.SentAt = now()
+		return p.Save()
+	})
+	ledger.mu.Lock()
+	if ledger.published != 5 {
+		t.Errorf("sweep is not done once: %d", ledger.published)
+	}
+	ledger.mu.Unlock()
+	fee := NanoToRaw(decimal.NewFromFloat(0.3))
+	if !ledger.received(config.FeeAccount).Equal(fee) || !ledger.received(config.Account).Equal(amount.Mul(decimal.NewFromInt(3)).Sub(fee)) {
+		t.Errorf("funds are split wrong: fee %s, merchant %s", ledger.received(config.FeeAccount), ledger.received(config.Account))
+	}
+}
+
+func TestLockWaitTimeout(t *testing.T) {
+	l := useRedisLock(t, fakeRedisServer(t).addr, time.Second)
+	l.wait = 20 * time.Millisecond
+	lease, err := l.Acquire("nano_1a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release()
+	if _, err = l.Acquire("nano_1a"); err != errLockTimeout {
+		t.Fatalf("expected errLockTimeout, got %v", err)
+	}
+
+	// Instances sharing a store that has no advisory locks cannot be started without Redis.
+	c := config
+	c.setDefaults()
+	c.Partitioning = true
+	for url, ok := range map[string]bool{"": false, "sqlite:/tmp/payments.db": false, "postgres://db/payments": true} {
+		c.DatabaseURL = url
+		if err = c.validate(); (err == nil) != ok {
+			t.Errorf("unexpected result for %q: %v", url, err)
+		}
+	}
+	c.DatabaseURL, c.LockRedisAddress = "sqlite:/tmp/payments.db", "127.0.0.1:6379"
+	if err = c.validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// GET /api/events streams the messages of the websocket session of a token as Server-Sent Events,
+// for clients behind proxies that break websockets. The event ID is the sequence number of the message.
+// Browsers send the last ID in Last-Event-ID header when reconnecting, and the stream starts with the
+// latest state unless the client has already seen it, so an update sent while the client was offline is not missed.
+// The stream ends when the payment is fulfilled, cancelled or expired without funds.
+
+var (
+	eventStreamsDone     = make(chan struct{})
+	eventStreamsDoneOnce sync.Once
+)
+
+// stopEventStreams ends the open streams. Server.Shutdown waits for them otherwise.
+func stopEventStreams() {
+	eventStreamsDoneOnce.Do(func() { close(eventStreamsDone) })
+}
+
+// eventState holds the fields of a message that decide if the stream ends.
+type eventState struct {
+	Seq       uint64          `json:"seq"`
+	Resync    bool            `json:"resync"`
+	Fulfilled bool            `json:"fulfilled"`
+	Cancelled bool            `json:"cancelled"`
+	Balance   decimal.Decimal `json:"balance"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Summary   json.RawMessage `json:"summary"`
+}
+
+// final returns true if no more messages are expected for the payment.
+func (s *eventState) final(now time.Time) bool {
+	if s.Fulfilled || s.Cancelled || s.Summary != nil {
+		return true
+	}
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt) && s.Balance.IsZero()
+}
+
+// writeEvent writes message b as an event and returns its state.
+func writeEvent(w http.ResponseWriter, b []byte) (*eventState, error) {
+	var s eventState
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Resync {
+		// No ID, so the client resumes from the last message it has seen.
+		_, err = fmt.Fprintf(w, "event: resync\ndata: %s\n\n", b)
+		return &s, err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", s.Seq, b)
+	return &s, err
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errCodeMethodNotAllowed, http.StatusMethodNotAllowed, "GET only")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("response writer cannot stream events")
+		writeInternalError(w)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "token is required")
+		return
+	}
+	q := newWSQueue(wsClassEvents, config.WebsocketQueueSize, nil)
+	q.conn = websockets.open(nil)
+	defer websockets.close(q.conn)
+	session, err := wsSessions.acquire(token, q)
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	defer q.close()
+	defer wsSessions.release(session, q)
+	// EventSource sends it on reconnect. The query parameter is for clients that cannot set headers.
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.FormValue("last_event_id")
+	}
+	if _, err = strconv.ParseUint(since, 10, 64); since != "" && err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, "invalid Last-Event-ID")
+		return
+	}
+	err = session.resume(q, since)
+	switch err {
+	case nil:
+	case errPaymentNotFound:
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	default:
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disables response buffering of nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(time.Duration(config.EventStreamKeepaliveInterval) * time.Millisecond)
+	defer keepalive.Stop()
+	var last *eventState
+	for {
+		select {
+		case <-q.wake:
+			for _, b := range q.take() {
+				s, err := writeEvent(w, b)
+				if err != nil {
+					log.Debugln("cannot write event:", err)
+					return
+				}
+				if !s.Resync {
+					last = s
+				}
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err = fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-eventStreamsDone:
+			return
+		}
+		if last != nil && last.final(clock.Now()) {
+			return
+		}
+	}
+}
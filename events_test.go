@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// sseEvent is an event read from a stream.
+type sseEvent struct {
+	id, event string
+	data      Response
+}
+
+// readEvent returns the next event, skipping comments. It fails the test at the end of stream.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("cannot read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && (e.id != "" || e.event != ""):
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.WebsocketSessionTTL = 60
+	t.Cleanup(func() { config.WebsocketSessionTTL = 0 })
+	wsSessions = &wsSessionCache{}
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	t.Cleanup(srv.Close)
+	token := saveWebsocketPayment(t, "nano_1events")
+	connect := func(lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"?token="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+	publish := func(revision uint64, balance int64, fulfilled bool) {
+		p := Payment{Account: "nano_1events", Revision: revision, Balance: NanoToRaw(decimal.New(balance, 0))}
+		if fulfilled {
+			now := clock.Now()
+			p.FulfilledAt = &now
+		}
+		verifications.Publish(PaymentVerified{Payment: p})
+	}
+
+	resp, r := connect("")
+	if e := readEvent(t, r); e.id != "0" || e.data.Account != "nano_1events" {
+		t.Fatalf("current state is not sent: %+v", e)
+	}
+	publish(10, 1, false)
+	if e := readEvent(t, r); e.id != "1" || !e.data.Balance.Equal(decimal.New(1, 0)) {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	resp.Body.Close()
+
+	// Update sent while the client is offline is sent when it reconnects.
+	waitFor(t, "stream to be closed", func() bool {
+		wsSessions.mu.Lock()
+		s := wsSessions.sessions[token]
+		wsSessions.mu.Unlock()
+		return s.idle(clock.Now(), 0)
+	})
+	publish(11, 2, false)
+	resp, r = connect("1")
+	if e := readEvent(t, r); e.id != "2" || !e.data.Balance.Equal(decimal.New(2, 0)) {
+		t.Fatalf("missed event is not sent: %+v", e)
+	}
+	resp.Body.Close()
+
+	// Nothing is repeated if the client has seen the latest message, and the stream ends when the payment is fulfilled.
+	resp, r = connect("2")
+	defer resp.Body.Close()
+	publish(12, 3, true)
+	if e := readEvent(t, r); e.id != "3" || !e.data.Fulfilled {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	if rest, err := ioutil.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Fatalf("stream is not ended: %q %v", rest, err)
+	}
+}
+
+func TestEventStreamErrors(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.EventStreamKeepaliveInterval = 10
+	t.Cleanup(func() { config.EventStreamKeepaliveInterval = 0 })
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	t.Cleanup(srv.Close)
+	get := func(token string) *http.Response {
+		resp, err := http.Get(srv.URL + "?token=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for token, status := range map[string]int{"": http.StatusBadRequest, "bad": http.StatusBadRequest} {
+		resp := get(token)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("token %q: expected %d, got %d", token, status, resp.StatusCode)
+		}
+	}
+	missing, err := NewToken("1", "nano_1nostream", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := get(missing)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown payment is streamed: %d", resp.StatusCode)
+	}
+
+	resp = get(saveWebsocketPayment(t, "nano_1keepalive"))
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ": keepalive\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no keepalive")
+		}
+	}
+}
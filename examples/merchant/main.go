@@ -0,0 +1,245 @@
+// Command merchant is an example web shop that accepts payments with accept-nano.
+//
+// It has a single product. When the customer clicks the buy button, it creates a payment
+// on accept-nano, shows the payment account to the customer and marks the order as paid
+// when accept-nano reports the payment as verified on websocket or via notification callback.
+//
+// Run accept-nano with NotificationURL set to http://<merchant address>/callback, then:
+//
+//	go run ./examples/merchant -accept-nano http://127.0.0.1:8080
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	listenAddress = flag.String("listen", "127.0.0.1:8081", "listen address")
+	acceptNanoURL = flag.String("accept-nano", "http://127.0.0.1:8080", "base URL of accept-nano server")
+	productPrice  = flag.String("price", "1", "price of the product")
+	currency      = flag.String("currency", "USD", "currency of the price, empty for NANO")
+)
+
+// payment is the part of accept-nano API response used by the shop.
+type payment struct {
+	Token     string          `json:"token"`
+	Account   string          `json:"account"`
+	Amount    decimal.Decimal `json:"amount"`
+	State     string          `json:"state"`
+	Fulfilled bool            `json:"fulfilled"`
+}
+
+// notification is posted by accept-nano to NotificationURL.
+type notification struct {
+	Account   string `json:"account"`
+	State     string `json:"state"`
+	Fulfilled bool   `json:"fulfilled"`
+}
+
+type order struct {
+	ID      string
+	Account string
+	Amount  decimal.Decimal
+	Token   string
+	PaidAt  *time.Time
+}
+
+type shop struct {
+	acceptNanoURL string
+	price         string
+	currency      string
+	client        *http.Client
+
+	mu     sync.Mutex
+	orders map[string]*order
+}
+
+func newShop(acceptNanoURL, price, currency string) *shop {
+	return &shop{
+		acceptNanoURL: strings.TrimSuffix(acceptNanoURL, "/"),
+		price:         price,
+		currency:      currency,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		orders:        make(map[string]*order),
+	}
+}
+
+func (s *shop) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/buy", s.handleBuy)
+	mux.HandleFunc("/order", s.handleOrder)
+	mux.HandleFunc("/callback", s.handleCallback)
+	return mux
+}
+
+// createPayment requests a new payment from accept-nano. Order ID is passed as state.
+func (s *shop) createPayment(orderID string) (*payment, error) {
+	form := url.Values{"amount": {s.price}, "currency": {s.currency}, "state": {orderID}}
+	resp, err := s.client.PostForm(s.acceptNanoURL+"/api/pay", form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("cannot create payment: " + resp.Status)
+	}
+	var p payment
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	return &p, err
+}
+
+// waitPayment listens on accept-nano websocket until the payment is verified.
+// The token is sent in the first message so that it does not appear in access logs.
+func (s *shop) waitPayment(o *order) error {
+	wsURL := "ws" + strings.TrimPrefix(s.acceptNanoURL, "http") + "/websocket"
+	ws, err := websocket.Dial(wsURL, "", s.acceptNanoURL)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	err = websocket.JSON.Send(ws, map[string]string{"auth": o.Token})
+	if err != nil {
+		return err
+	}
+	for {
+		var p payment
+		err = websocket.JSON.Receive(ws, &p)
+		if err != nil {
+			return err
+		}
+		if p.Fulfilled {
+			s.markPaid(p.State)
+			return nil
+		}
+	}
+}
+
+func (s *shop) markPaid(orderID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[orderID]
+	if !ok || o.PaidAt != nil {
+		return
+	}
+	t := time.Now()
+	o.PaidAt = &t
+	log.Printf("order %s is paid", orderID)
+}
+
+func (s *shop) getOrder(id string) (order, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[id]
+	if !ok {
+		return order{}, false
+	}
+	return *o, true
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><body>
+<h1>Example product</h1>
+<p>Price: {{.Price}} {{.Currency}}</p>
+<form method="post" action="/buy"><button type="submit">Buy</button></form>
+</body></html>`))
+
+var orderTemplate = template.Must(template.New("order").Parse(`<!DOCTYPE html>
+<html><body>
+<h1>Order {{.ID}}</h1>
+{{if .PaidAt}}
+<p>Paid. Thank you!</p>
+{{else}}
+<p>Send {{.Amount}} NANO to:</p>
+<p><a href="nano:{{.Account}}">{{.Account}}</a></p>
+<p>This page refreshes until the payment is received.</p>
+<script>setTimeout(function () { location.reload(); }, 5000);</script>
+{{end}}
+</body></html>`))
+
+func (s *shop) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	_ = indexTemplate.Execute(w, map[string]string{"Price": s.price, "Currency": s.currency})
+}
+
+func (s *shop) handleBuy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := "order-" + hex.EncodeToString(b)
+	p, err := s.createPayment(id)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "cannot create payment", http.StatusBadGateway)
+		return
+	}
+	o := &order{ID: id, Account: p.Account, Amount: p.Amount, Token: p.Token}
+	s.mu.Lock()
+	s.orders[id] = o
+	s.mu.Unlock()
+	go func() {
+		if err := s.waitPayment(o); err != nil {
+			log.Printf("websocket error for order %s: %s", id, err)
+		}
+	}()
+	http.Redirect(w, r, "/order?id="+id, http.StatusSeeOther)
+}
+
+func (s *shop) handleOrder(w http.ResponseWriter, r *http.Request) {
+	o, ok := s.getOrder(r.FormValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	_ = orderTemplate.Execute(w, o)
+}
+
+// handleCallback receives notifications from accept-nano.
+// Notifications are not signed by accept-nano, so the account is checked against the order
+// and the callback should only be reachable by accept-nano.
+func (s *shop) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var n notification
+	err := json.NewDecoder(r.Body).Decode(&n)
+	if err != nil {
+		http.Error(w, "invalid notification", http.StatusBadRequest)
+		return
+	}
+	o, ok := s.getOrder(n.State)
+	if !ok || o.Account != n.Account {
+		http.Error(w, "unknown order", http.StatusNotFound)
+		return
+	}
+	if n.Fulfilled {
+		s.markPaid(n.State)
+	}
+}
+
+func main() {
+	flag.Parse()
+	s := newShop(*acceptNanoURL, *productPrice, *currency)
+	log.Printf("listening on http://%s", *listenAddress)
+	log.Fatal(http.ListenAndServe(*listenAddress, s.handler()))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+)
+
+// fakeAcceptNano creates payments and reports them verified on websocket after auth message.
+func fakeAcceptNano(t *testing.T, verify bool) *httptest.Server {
+	var state string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/pay", func(w http.ResponseWriter, r *http.Request) {
+		state = r.FormValue("state")
+		_ = json.NewEncoder(w).Encode(payment{Token: "TOKEN", Account: "nano_1order", Amount: decimal.RequireFromString("0.5"), State: state})
+	})
+	mux.Handle("/websocket", websocket.Handler(func(ws *websocket.Conn) {
+		var auth map[string]string
+		if err := websocket.JSON.Receive(ws, &auth); err != nil || auth["auth"] != "TOKEN" {
+			return
+		}
+		if verify {
+			_ = websocket.JSON.Send(ws, payment{Account: "nano_1order", State: state, Fulfilled: true})
+		}
+		var b []byte
+		_ = websocket.Message.Receive(ws, &b)
+	}))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func buy(t *testing.T, s *shop) string {
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Post(srv.URL+"/buy", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	return strings.TrimPrefix(resp.Header.Get("Location"), "/order?id=")
+}
+
+func TestPaidOnWebsocket(t *testing.T) {
+	s := newShop(fakeAcceptNano(t, true).URL, "1", "USD")
+	id := buy(t, s)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o, _ := s.getOrder(id)
+		if o.PaidAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("order is not paid")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPaidOnCallback(t *testing.T) {
+	s := newShop(fakeAcceptNano(t, false).URL, "1", "USD")
+	id := buy(t, s)
+
+	post := func(n notification) int {
+		b, _ := json.Marshal(n)
+		w := httptest.NewRecorder()
+		s.handleCallback(w, httptest.NewRequest(http.MethodPost, "/callback", bytes.NewReader(b)))
+		return w.Code
+	}
+	if code := post(notification{Account: "nano_1other", State: id, Fulfilled: true}); code != http.StatusNotFound {
+		t.Errorf("callback for another account is accepted: %d", code)
+	}
+	if o, _ := s.getOrder(id); o.PaidAt != nil {
+		t.Fatal("order is paid by wrong callback")
+	}
+	if code := post(notification{Account: "nano_1order", State: id, Fulfilled: true}); code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if o, _ := s.getOrder(id); o.PaidAt == nil {
+		t.Error("order is not paid")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// OnExpiryWithFunds of a payment decides what happens to the funds when it expires with less than the amount.
+// By default the funds are held on the account for admin to resolve.
+// With "auto_refund" they are sent back to the customer if the refund passes the safety checks, and held otherwise.
+// With "notify_credit" the merchant is notified with "expired_credit" event to credit the received amount
+// to the customer, and the funds are sent to the merchant account.
+// Funds completing the payment after expiry are handled as late funds.
+
+// Policies of a payment expiring with funds.
+const (
+	expiryHold         = "hold"
+	expiryAutoRefund   = "auto_refund"
+	expiryNotifyCredit = "notify_credit"
+)
+
+// Event type of the notification sent for payments expired with notify_credit policy.
+const notificationEventExpiredCredit = "expired_credit"
+
+var metricExpiryActions = expvar.NewMap("expiry_actions_total")
+
+// ExpiryAction records the policy executed when the payment expired with funds.
+type ExpiryAction struct {
+	ExpiredAt time.Time `json:"expiredAt"`
+	// Balance of the account at expiry, in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Executed policy. Set to hold if the refund is refused by a safety check.
+	Action     string `json:"action"`
+	HeldReason string `json:"heldReason,omitempty"`
+	// Funds are sent back to this account if action is auto_refund.
+	RefundAccount string     `json:"refundAccount,omitempty"`
+	RefundHash    string     `json:"refundHash,omitempty"`
+	RefundedAt    *time.Time `json:"refundedAt"`
+	// Set when the merchant accepts the expired_credit notification.
+	CreditNotifiedAt *time.Time `json:"creditNotifiedAt"`
+}
+
+// ExpiryCredit is sent in expired_credit notification.
+type ExpiryCredit struct {
+	// Amount to credit to the customer.
+	Amount    decimal.Decimal `json:"amount"`
+	AmountRaw string          `json:"amountRaw"`
+	ExpiredAt time.Time       `json:"expiredAt"`
+}
+
+// PaymentExpired is published when a payment expires with funds.
+type PaymentExpired struct {
+	Payment
+}
+
+func (p PaymentExpired) Account() Account {
+	return Account(p.Payment.Account)
+}
+
+// validExpiryPolicy returns true if s is empty or a known policy.
+func validExpiryPolicy(s string) bool {
+	switch s {
+	case "", expiryHold, expiryAutoRefund, expiryNotifyCredit:
+		return true
+	}
+	return false
+}
+
+// refunding returns true if funds are to be refunded but not sent yet.
+func (e *ExpiryAction) refunding() bool {
+	return e != nil && e.Action == expiryAutoRefund && e.RefundedAt == nil
+}
+
+func (e *ExpiryAction) refunded() bool {
+	return e != nil && e.RefundedAt != nil
+}
+
+// crediting returns true if the merchant is to be notified but not notified yet.
+func (e *ExpiryAction) crediting() bool {
+	return e != nil && e.Action == expiryNotifyCredit && e.CreditNotifiedAt == nil
+}
+
+func (e *ExpiryAction) credited() bool {
+	return e != nil && e.CreditNotifiedAt != nil
+}
+
+// held returns true if funds of the expired payment are kept on the account for admin.
+func (e *ExpiryAction) held() bool {
+	return e != nil && (e.Action == expiryHold || e.HeldReason != "")
+}
+
+// expiredWithFunds returns true if the payment expired with partial funds and its policy is not executed yet.
+func (p Payment) expiredWithFunds() bool {
+	if p.OnExpiryWithFunds != expiryAutoRefund && p.OnExpiryWithFunds != expiryNotifyCredit {
+		return false
+	}
+	return p.Expiry == nil && p.Late == nil && p.partiallyPaid() && now().After(p.expiresAt()) && !p.awaitingConfirmation()
+}
+
+// expire executes OnExpiryWithFunds of the payment.
+// Account is checked once more, so funds sent just before the expiry are included.
+func (p *Payment) expire() error {
+	err := p.checkPending()
+	switch err {
+	case nil:
+		// Rest of the amount arrived. It fulfills the payment or is handled as late funds.
+		return p.runStep(stepCheckPending)
+	case errPaymentNotFulfilled:
+	default:
+		return err
+	}
+	e := &ExpiryAction{ExpiredAt: p.expiresAt(), Amount: p.Balance, Action: p.OnExpiryWithFunds}
+	if e.Action == expiryAutoRefund {
+		e.RefundAccount = p.refundAccount()
+		if reason := p.refundRefusal(e.RefundAccount); reason != "" {
+			e.Action, e.HeldReason = expiryHold, reason
+			sendAlert("expiry_refund_refused", "funds of expired payment "+p.Account+" are held: "+reason, map[string]interface{}{
+				"account":   p.Account,
+				"paymentId": p.PaymentID,
+				"balance":   RawToNano(p.Balance).String(),
+			})
+		}
+	}
+	p.Expiry = e
+	err = p.Save()
+	if err != nil {
+		return err
+	}
+	metricExpiryActions.Add(e.Action, 1)
+	log.Noticef("payment %s expired with funds: %s", p.logName(), e.Action)
+	go verifications.Publish(PaymentExpired{Payment: *p})
+	return nil
+}
+
+// refundRefusal returns the reason funds cannot be refunded to account automatically. Empty if the refund is safe.
+func (p Payment) refundRefusal(account string) string {
+	switch {
+	case account == "":
+		return "sender is not known"
+	case p.disputed():
+		return "payment is disputed"
+	case !config.AllowExchangeRefunds && isExchangeAccount(account):
+		return "sender is an exchange hot wallet"
+	}
+	return ""
+}
+
+func isExchangeAccount(account string) bool {
+	for _, a := range config.ExchangeAccounts {
+		if a == account {
+			return true
+		}
+	}
+	return false
+}
+
+// refundExpired receives pending funds and sends the whole balance to the refund account.
+func (p *Payment) refundExpired() error {
+	return p.refund(p.Expiry.RefundAccount, func() bool { return p.Expiry.refunded() }, func(hash string) { p.Expiry.RefundHash = hash })
+}
+
+// notifyCredit sends the expired_credit notification with the amount to credit to the customer.
+func (p *Payment) notifyCredit() error {
+	n := p.notification()
+	n.Event = notificationEventExpiredCredit
+	n.Credit = &ExpiryCredit{Amount: RawToNano(p.Expiry.Amount), AmountRaw: p.Expiry.Amount.String(), ExpiredAt: p.Expiry.ExpiredAt}
+	return p.postNotification(n)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestExpiryWithFunds(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	config.ExchangeAccounts = []string{"nano_1exchange"}
+	var mu sync.Mutex
+	notifications := make(map[string]Notification)
+	failCredit := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		_ = json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		defer mu.Unlock()
+		if n.Event == notificationEventExpiredCredit && failCredit {
+			failCredit = false
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		notifications[n.Account+":"+n.Event] = n
+	}))
+	t.Cleanup(server.Close)
+	config.NotificationURL = server.URL
+	t.Cleanup(func() {
+		config.NotificationURL = ""
+		config.Account = ""
+		config.ExchangeAccounts = nil
+	})
+	amount := NanoToRaw(decimal.New(1, 0))
+	partial := NanoToRaw(decimal.New(4, -1))
+	newPayment := func(account, policy, sender string) *Payment {
+		p := &Payment{Account: account, PublicKey: randomHash(), Amount: amount, CreatedAt: clock.Now(), OnExpiryWithFunds: policy}
+		ledger.own(p)
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		ledger.send(sender, account, partial)
+		if err := p.check(); err != nil {
+			t.Fatal(err)
+		}
+		if !p.partiallyPaid() || p.Expiry != nil {
+			t.Fatalf("payment is not partially paid: %+v", p)
+		}
+		return p
+	}
+	hold := newPayment("nano_1hold", "", "nano_1customer")
+	refund := newPayment("nano_1refund", expiryAutoRefund, "nano_1customer")
+	exchange := newPayment("nano_1fromexchange", expiryAutoRefund, "nano_1exchange")
+	disputed := newPayment("nano_1disputed", expiryAutoRefund, "nano_1customer")
+	disputed.Dispute = &Dispute{Reason: "not delivered", OpenedAt: clock.Now()}
+	if err := disputed.Save(); err != nil {
+		t.Fatal(err)
+	}
+	credit := newPayment("nano_1credit", expiryNotifyCredit, "nano_1customer")
+
+	c.Add(time.Duration(config.AllowedDuration+1) * time.Second)
+	for _, p := range []*Payment{hold, refund, exchange, disputed} {
+		if err := p.check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if hold.Expiry != nil || !hold.finished() || hold.ReceivedAt != nil {
+		t.Fatalf("funds of payment without policy are not held: %+v", hold)
+	}
+
+	if e := refund.Expiry; e == nil || e.Action != expiryAutoRefund || e.RefundedAt == nil || e.RefundHash == "" || e.RefundAccount != "nano_1customer" {
+		t.Fatalf("payment is not refunded: %+v", refund.Expiry)
+	}
+	if !ledger.received("nano_1customer").Equal(partial) || refund.nextStep() != stepNone {
+		t.Fatalf("refund is not sent to customer: %s", ledger.received("nano_1customer"))
+	}
+	mu.Lock()
+	final, ok := notifications["nano_1refund:final"]
+	mu.Unlock()
+	if !ok || final.Summary.Outcome != outcomeRefunded || final.Summary.Refund.AmountRaw != partial.String() {
+		t.Fatalf("final notification of refund is not sent: %+v", final.Summary)
+	}
+
+	for p, reason := range map[*Payment]string{exchange: "sender is an exchange hot wallet", disputed: "payment is disputed"} {
+		if e := p.Expiry; e == nil || e.Action != expiryHold || e.HeldReason != reason || e.RefundedAt != nil || !p.finished() {
+			t.Fatalf("unsafe refund is not held: %+v", p.Expiry)
+		}
+	}
+	if !ledger.received("nano_1exchange").IsZero() {
+		t.Fatal("refund is sent to exchange")
+	}
+
+	// Notification is retried until the merchant accepts it.
+	if err := credit.check(); err == nil {
+		t.Fatal("failed notification is not an error")
+	}
+	if credit.Expiry == nil || credit.Expiry.CreditNotifiedAt != nil || credit.nextStep() != stepNotifyCredit || credit.finished() {
+		t.Fatalf("failed notification is not retried: %+v", credit.Expiry)
+	}
+	if err := credit.check(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	n, ok := notifications["nano_1credit:expired_credit"]
+	final = notifications["nano_1credit:final"]
+	mu.Unlock()
+	if !ok || n.Credit == nil || n.Credit.AmountRaw != partial.String() || !n.Credit.Amount.Equal(decimal.New(4, -1)) ||
+		!n.Credit.ExpiredAt.Equal(credit.expiresAt()) || n.Fulfilled {
+		t.Fatalf("unexpected credit notification: %+v", n)
+	}
+	if credit.SentAt == nil || !ledger.received(config.Account).Equal(partial) {
+		t.Fatalf("credited funds are not sent to merchant: %+v", credit)
+	}
+	if final.Summary == nil || final.Summary.Outcome != outcomeSwept {
+		t.Fatalf("final notification of credited payment is not sent: %+v", final.Summary)
+	}
+}
+
+func TestPayExpiryPolicy(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedDuration = -1
+	config.APIKeys = map[string]APIKey{"backend-key": {OnExpiryWithFunds: expiryNotifyCredit}}
+	t.Cleanup(func() {
+		config.AllowedDuration = 0
+		config.APIKeys = nil
+	})
+	stopCheckLoops(t)
+	pay := func(key, policy string) *httptest.ResponseRecorder {
+		values := url.Values{"amount": {"1"}}
+		if policy != "" {
+			values.Set("on_expiry_with_funds", policy)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+	expectErrorCode(t, pay("", "refund"), http.StatusBadRequest, errCodeInvalidExpiryPolicy)
+	cases := []struct {
+		key, policy, expected string
+	}{
+		{"", "", ""},
+		{"", expiryAutoRefund, expiryAutoRefund},
+		{"backend-key", "", expiryNotifyCredit},
+		{"backend-key", expiryHold, ""},
+	}
+	for _, tc := range cases {
+		w := pay(tc.key, tc.policy)
+		if w.Code != http.StatusOK {
+			t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+		}
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		p, err := LoadPaymentByID(response.PaymentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.OnExpiryWithFunds != tc.expected {
+			t.Errorf("key %q policy %q: expected %q, got %q", tc.key, tc.policy, tc.expected, p.OnExpiryWithFunds)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/accounting"
+)
+
+// paymentTransactions returns accounting transactions for the funds movements of the payment.
+func paymentTransactions(p *Payment) []accounting.Transaction {
+	var txs []accounting.Transaction
+	if p.FulfilledAt != nil {
+		tx := accounting.Transaction{
+			Kind:      accounting.Received,
+			Date:      *p.FulfilledAt,
+			Amount:    RawToNano(p.Balance),
+			Currency:  "BCB",
+			Reference: p.Account,
+			PaymentID: p.PaymentID,
+			Memo:      p.State,
+		}
+		v := p.operationVersions(operationReceive)
+		tx.SoftwareVersion, tx.NodeVersion = v.AcceptNano, v.Node
+		switch {
+		case !p.Price.IsZero():
+			tx.FiatAmount = p.AmountInCurrency.Decimal
+			tx.FiatCurrency = p.Currency
+			tx.Rate = decimal.NullDecimal{Decimal: p.Price, Valid: true}
+			tx.VerificationRate = p.VerificationPrice
+			tx.RateSource = accounting.Contemporaneous
+		case p.BackfilledRate != nil:
+			tx.FiatAmount = tx.Amount.Mul(p.BackfilledRate.Rate).Round(2) // nolint: gomnd
+			tx.FiatCurrency = p.BackfilledRate.Currency
+			tx.Rate = decimal.NullDecimal{Decimal: p.BackfilledRate.Rate, Valid: true}
+			tx.RateSource = accounting.Backfilled
+		}
+		txs = append(txs, tx)
+	}
+	if p.FeeSentAt != nil && !p.FeeAmount.IsZero() {
+		v := p.operationVersions(operationFee)
+		txs = append(txs, accounting.Transaction{
+			Kind:            accounting.Fee,
+			Date:            *p.FeeSentAt,
+			Amount:          RawToNano(p.FeeAmount),
+			Currency:        "BCB",
+			Reference:       p.FeeSendHash,
+			PaymentID:       p.PaymentID,
+			Memo:            p.Account,
+			SoftwareVersion: v.AcceptNano,
+			NodeVersion:     v.Node,
+		})
+	}
+	if p.SentAt != nil {
+		v := p.operationVersions(operationSend)
+		txs = append(txs, accounting.Transaction{
+			Kind:            accounting.Swept,
+			Date:            *p.SentAt,
+			Amount:          RawToNano(p.Balance.Sub(p.FeeAmount)),
+			Currency:        "BCB",
+			Reference:       p.SendHash,
+			PaymentID:       p.PaymentID,
+			Memo:            p.Account,
+			SoftwareVersion: v.AcceptNano,
+			NodeVersion:     v.Node,
+		})
+	}
+	if d := p.Dispute; d != nil && d.ResolvedAt != nil {
+		kind := map[string]accounting.Kind{
+			dispositionRefunded:   accounting.Refunded,
+			dispositionWrittenOff: accounting.WrittenOff,
+		}[d.Disposition]
+		if kind != "" {
+			txs = append(txs, accounting.Transaction{
+				Kind:      kind,
+				Date:      *d.ResolvedAt,
+				Amount:    RawToNano(p.Balance),
+				Currency:  "BCB",
+				Reference: p.Account,
+				PaymentID: p.PaymentID,
+				Memo:      "dispute: " + d.Reason,
+			})
+		}
+	}
+	return txs
+}
+
+func accountingAccounts() accounting.Accounts {
+	return accounting.Accounts{
+		Deposits:   config.AccountingDepositsAccount,
+		Merchant:   config.AccountingMerchantAccount,
+		Revenue:    config.AccountingRevenueAccount,
+		Fees:       config.AccountingFeesAccount,
+		Refunds:    config.AccountingRefundsAccount,
+		WrittenOff: config.AccountingWrittenOffAccount,
+	}
+}
+
+func handleAdminExportPayments(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("format")
+	if name == "" {
+		name = "csv"
+	}
+	format, ok := accounting.Formats[name]
+	if !ok {
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	merchant := r.FormValue("merchant")
+	var txs []accounting.Transaction
+	err := forEachPayment(func(p *Payment) error {
+		if !p.Sandbox && (merchant == "" || p.Merchant == merchant) {
+			txs = append(txs, paymentTransactions(p)...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := accounting.Entries(txs, accountingAccounts())
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("payments-%s.%s", clock.Now().Format("20060102"), format.FileExtension())
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	err = format.Write(w, entries)
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// reservedExtraFields are the JSON names of Response fields. They cannot be used in ExtraResponseFields,
+// so a client reading both never confuses an extra value with a real field.
+var reservedExtraFields = responseFieldNames()
+
+func responseFieldNames() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(Response{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[strings.ToLower(name)] = true
+		}
+	}
+	return names
+}
+
+func validateExtraResponseFields(fields map[string]interface{}) error {
+	for k, v := range fields {
+		if k == "" {
+			return fmt.Errorf("empty key")
+		}
+		if reservedExtraFields[strings.ToLower(k)] {
+			return fmt.Errorf("%q is a response field", k)
+		}
+		switch v.(type) {
+		case string, bool, int, int64, float64:
+		default:
+			return fmt.Errorf("value of %q must be a string, number or boolean", k)
+		}
+	}
+	return nil
+}
+
+// extraResponseFields returns the extra fields for the payments of client: global ones with the ones of its API key over them.
+// It returns nil if there are none.
+func extraResponseFields(client string) map[string]interface{} {
+	var keyFields map[string]interface{}
+	if client != "" {
+		for key, apiKey := range config.APIKeys {
+			if keyFingerprint(key) == client {
+				keyFields = apiKey.ExtraResponseFields
+				break
+			}
+		}
+	}
+	if len(keyFields) == 0 {
+		if len(config.ExtraResponseFields) == 0 {
+			return nil
+		}
+		return config.ExtraResponseFields
+	}
+	fields := make(map[string]interface{}, len(config.ExtraResponseFields)+len(keyFields))
+	for k, v := range config.ExtraResponseFields {
+		fields[k] = v
+	}
+	for k, v := range keyFields {
+		fields[k] = v
+	}
+	return fields
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestExtraResponseFields(t *testing.T) {
+	for _, fields := range []map[string]interface{}{
+		{"Token": "x"},
+		{"extra": "x"},
+		{"terms": []string{"x"}},
+	} {
+		if err := validateExtraResponseFields(fields); err == nil {
+			t.Errorf("invalid fields are accepted: %v", fields)
+		}
+	}
+
+	config.ExtraResponseFields = map[string]interface{}{"supportEmail": "support@example.com", "storeId": int64(1)}
+	config.APIKeys = map[string]APIKey{"merchant-key": {ExtraResponseFields: map[string]interface{}{"storeId": int64(2)}}}
+	t.Cleanup(func() { config.ExtraResponseFields, config.APIKeys = nil, nil })
+	if err := validateExtraResponseFields(config.ExtraResponseFields); err != nil {
+		t.Fatal(err)
+	}
+	extra := NewResponse(&Payment{Client: keyFingerprint("merchant-key")}, "").Extra
+	if extra["storeId"] != int64(2) || extra["supportEmail"] != "support@example.com" {
+		t.Errorf("key fields are not merged: %v", extra)
+	}
+	if extra = NewResponse(&Payment{}, "").Extra; extra["storeId"] != int64(1) {
+		t.Errorf("unexpected global fields: %v", extra)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Fault injection lets QA test clients against failures in staging environments.
+// It can only be enabled together with Testnet.
+// Every rule expires so faults cannot be left on by accident.
+
+// Fault types.
+const (
+	// Delay delivery of verification events to websocket clients.
+	faultDelayVerification = "delay_verification"
+	// Return an error for a percentage of /api/pay requests.
+	faultPayError = "pay_error"
+	// Close websocket connections after a duration.
+	faultCloseWebsocket = "close_websocket"
+)
+
+// maxFaultTTL is the longest time a rule can stay active.
+const maxFaultTTL = 24 * time.Hour
+
+// FaultRule is an active fault injected into the server.
+type FaultRule struct {
+	Type string `json:"type"`
+	// Delay for delay_verification and close_websocket rules.
+	Delay time.Duration `json:"delay,omitempty"`
+	// Percent of requests affected by pay_error rule.
+	Percent int `json:"percent,omitempty"`
+	// HTTP status returned by pay_error rule.
+	Status    int       `json:"status,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (r FaultRule) String() string {
+	switch r.Type {
+	case faultPayError:
+		return fmt.Sprintf("%s %d%% status %d until %s", r.Type, r.Percent, r.Status, r.ExpiresAt.Format(time.RFC3339))
+	default:
+		return fmt.Sprintf("%s %s until %s", r.Type, r.Delay, r.ExpiresAt.Format(time.RFC3339))
+	}
+}
+
+// faults is nil unless EnableFaults is set in config.
+var faults *faultInjector
+
+type faultInjector struct {
+	mu    sync.Mutex
+	rules map[string]FaultRule
+	now   func() time.Time
+	// Returns a number in [0,100).
+	roll func() int
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		rules: make(map[string]FaultRule),
+		now:   clockNow,
+		roll:  func() int { return rand.Intn(100) }, // nolint: gosec
+	}
+}
+
+// set adds the rule replacing the previous rule of the same type.
+func (f *faultInjector) set(r FaultRule) {
+	f.mu.Lock()
+	f.rules[r.Type] = r
+	f.mu.Unlock()
+	log.Warningln("fault injected:", r)
+}
+
+func (f *faultInjector) clear() {
+	f.mu.Lock()
+	f.rules = make(map[string]FaultRule)
+	f.mu.Unlock()
+}
+
+// rule returns the active rule of type t.
+func (f *faultInjector) rule(t string) (FaultRule, bool) {
+	if f == nil {
+		return FaultRule{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.rules[t]
+	if !ok {
+		return r, false
+	}
+	if !f.now().Before(r.ExpiresAt) {
+		delete(f.rules, t)
+		log.Noticeln("fault expired:", r.Type)
+		return r, false
+	}
+	return r, true
+}
+
+// active returns the rules that are not expired yet.
+func (f *faultInjector) active() []FaultRule {
+	if f == nil {
+		return nil
+	}
+	rules := make([]FaultRule, 0)
+	for _, t := range []string{faultDelayVerification, faultPayError, faultCloseWebsocket} {
+		if r, ok := f.rule(t); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// middleware fails requests while a pay_error rule is active.
+func (f *faultInjector) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rule, ok := f.rule(faultPayError); ok && f.roll() < rule.Percent {
+			writeError(w, errCodeInternal, rule.Status, "injected fault")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// intercept delays verification events while a delay_verification rule is active.
+func (f *faultInjector) intercept(e Event, next func(Event)) {
+	if _, ok := e.(PaymentVerified); ok {
+		if rule, ok := f.rule(faultDelayVerification); ok {
+			time.AfterFunc(rule.Delay, func() { next(e) })
+			return
+		}
+	}
+	next(e)
+}
+
+// websocketCloseAfter returns the duration after which a new websocket connection must be closed.
+func (f *faultInjector) websocketCloseAfter() (time.Duration, bool) {
+	rule, ok := f.rule(faultCloseWebsocket)
+	return rule.Delay, ok
+}
+
+// parseFaultRule reads a rule from admin request form values.
+// Durations are in seconds.
+func parseFaultRule(r *http.Request, now time.Time) (FaultRule, error) {
+	rule := FaultRule{Type: r.FormValue("type")}
+	ttl, err := strconv.Atoi(r.FormValue("ttl"))
+	if err != nil || ttl <= 0 {
+		return rule, errors.New("ttl must be a positive number of seconds")
+	}
+	if time.Duration(ttl)*time.Second > maxFaultTTL {
+		return rule, fmt.Errorf("ttl cannot be longer than %s", maxFaultTTL)
+	}
+	rule.ExpiresAt = now.Add(time.Duration(ttl) * time.Second)
+	switch rule.Type {
+	case faultDelayVerification, faultCloseWebsocket:
+		seconds, err := strconv.Atoi(r.FormValue("delay"))
+		if err != nil || seconds < 0 {
+			return rule, errors.New("invalid delay")
+		}
+		rule.Delay = time.Duration(seconds) * time.Second
+	case faultPayError:
+		rule.Percent, err = strconv.Atoi(r.FormValue("percent"))
+		if err != nil || rule.Percent <= 0 || rule.Percent > 100 {
+			return rule, errors.New("percent must be between 1 and 100")
+		}
+		rule.Status = http.StatusInternalServerError
+		if s := r.FormValue("status"); s != "" {
+			rule.Status, err = strconv.Atoi(s)
+			if err != nil || rule.Status < 400 || rule.Status > 599 {
+				return rule, errors.New("invalid status")
+			}
+		}
+	default:
+		return rule, fmt.Errorf("unknown fault type: %q", rule.Type)
+	}
+	return rule, nil
+}
+
+// handleAdminFaults lists active rules on GET, adds a rule on POST and removes all rules on DELETE.
+func handleAdminFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		rule, err := parseFaultRule(r, faults.now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		faults.set(rule)
+	case http.MethodDelete:
+		faults.clear()
+		log.Noticeln("faults cleared by", adminIdentity(r))
+	default:
+		http.Error(w, "GET, POST or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, faults.active())
+}
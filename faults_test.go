@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// useFaults enables fault injection with a controllable clock until the test ends.
+func useFaults(t *testing.T) *time.Time {
+	now := time.Now()
+	faults = newFaultInjector()
+	faults.now = func() time.Time { return now }
+	faults.roll = func() int { return 0 }
+	t.Cleanup(func() { faults = nil })
+	return &now
+}
+
+func TestFaultPayError(t *testing.T) {
+	now := useFaults(t)
+	w := postAdminForm(handleAdminFaults, url.Values{"type": {faultPayError}, "percent": {"10"}, "ttl": {"60"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot set fault: %d %s", w.Code, w.Body)
+	}
+	h := faults.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/pay", nil))
+		return w.Code
+	}
+	if code := serve(); code != http.StatusInternalServerError {
+		t.Fatalf("expected injected error, got %d", code)
+	}
+	faults.roll = func() int { return 10 }
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("request outside percentage failed: %d", code)
+	}
+	faults.roll = func() int { return 0 }
+	*now = now.Add(time.Minute)
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("fault did not expire: %d", code)
+	}
+	if len(faults.active()) != 0 {
+		t.Fatal("expired rule is still active")
+	}
+}
+
+func TestFaultRuleRequiresTTL(t *testing.T) {
+	useFaults(t)
+	w := postAdminForm(handleAdminFaults, url.Values{"type": {faultPayError}, "percent": {"10"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("rule without ttl accepted: %d", w.Code)
+	}
+}
+
+func TestFaultDelayVerification(t *testing.T) {
+	now := useFaults(t)
+	faults.set(FaultRule{Type: faultDelayVerification, Delay: 100 * time.Millisecond, ExpiresAt: now.Add(time.Minute)})
+	var hub Hub
+	hub.Intercept(faults.intercept)
+	received := make(chan struct{}, 1)
+	cancel := hub.Subscribe("nano_1test", func(e Event) { received <- struct{}{} })
+	defer cancel()
+
+	hub.Publish(PaymentVerified{Payment: Payment{Account: "nano_1test"}})
+	select {
+	case <-received:
+		t.Fatal("event is not delayed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("delayed event is not delivered")
+	}
+
+	*now = now.Add(time.Minute)
+	hub.Publish(PaymentVerified{Payment: Payment{Account: "nano_1test"}})
+	select {
+	case <-received:
+	default:
+		t.Fatal("event is delayed after fault expired")
+	}
+}
+
+func TestFaultCloseWebsocket(t *testing.T) {
+	openTestDB(t, 0)
+	now := useFaults(t)
+	url := startWebsocketServer(t)
+	faults.set(FaultRule{Type: faultCloseWebsocket, Delay: 0, ExpiresAt: now.Add(time.Minute)})
+	token := saveSessionPayment(t)
+	ws, err := websocket.Dial(url+"?token="+token, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	expectClosed(t, ws)
+
+	*now = now.Add(time.Minute)
+	ws2, err := websocket.Dial(url+"?token="+token, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws2.Close()
+	receiveResponse(t, ws2)
+	err = ws2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b []byte
+	err = websocket.Message.Receive(ws2, &b)
+	if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+		t.Fatalf("connection closed after fault expired: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+const (
+	feeRemainderMerchant = "merchant"
+	feeRemainderFee      = "fee"
+)
+
+// calculateFee returns the fee share in raw for the given balance in raw.
+// Result is always an integer amount and never exceeds the balance.
+func calculateFee(balance decimal.Decimal) decimal.Decimal {
+	var fee decimal.Decimal
+	switch {
+	case config.FeePercent != "":
+		percent := decimal.RequireFromString(config.FeePercent)
+		fee = balance.Mul(percent).Shift(-2)
+		if config.FeeRemainderPolicy == feeRemainderFee {
+			fee = fee.Ceil()
+		} else {
+			fee = fee.Floor()
+		}
+	case config.FeeFixedRaw != "":
+		fee = decimal.RequireFromString(config.FeeFixedRaw)
+	}
+	if fee.GreaterThan(balance) {
+		fee = balance
+	}
+	return fee
+}
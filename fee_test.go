@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestCalculateFee(t *testing.T) {
+	t.Cleanup(func() { config.FeePercent, config.FeeFixedRaw, config.FeeRemainderPolicy = "", "", "" })
+	cases := []struct {
+		percent, fixed, policy string
+		balance, fee           int64
+	}{
+		{"2.5", "", feeRemainderMerchant, 1000, 25},
+		{"2.5", "", feeRemainderMerchant, 1001, 25},
+		{"2.5", "", feeRemainderFee, 1001, 26},
+		{"2.5", "", feeRemainderFee, 1000, 25},
+		{"100", "", feeRemainderMerchant, 7, 7},
+		{"", "300", feeRemainderMerchant, 1000, 300},
+		// Fee cannot exceed the balance.
+		{"", "300", feeRemainderMerchant, 200, 200},
+		{"", "", feeRemainderMerchant, 1000, 0},
+	}
+	for _, c := range cases {
+		config.FeePercent, config.FeeFixedRaw, config.FeeRemainderPolicy = c.percent, c.fixed, c.policy
+		fee := calculateFee(decimal.NewFromInt(c.balance))
+		if !fee.Equal(decimal.NewFromInt(c.fee)) {
+			t.Errorf("fee of %d with %+v is %s", c.balance, c, fee)
+		}
+	}
+}
+
+func TestSendFeeRetriesMissingLeg(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	config.FeeAccount = "nano_1fee"
+	config.FeePercent = "10"
+	t.Cleanup(func() { config.Account, config.FeeAccount, config.FeePercent = "", "", "" })
+	balance := NanoToRaw(decimal.NewFromInt(2))
+	p := &Payment{Account: "nano_1split", PublicKey: randomHash(), Amount: balance, CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ledger.send("nano_1customer", p.Account, balance)
+	if err := p.receivePending(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Merchant leg fails after the fee is sent.
+	ledger.mu.Lock()
+	ledger.faults["process"] = []string{"", faultReject}
+	ledger.mu.Unlock()
+	if err := p.sendToMerchant(); err == nil {
+		t.Fatal("merchant leg is not failed")
+	}
+	fee := NanoToRaw(decimal.NewFromFloat(0.2))
+	if p.FeeSentAt == nil || !p.FeeAmount.Equal(fee) || p.SendHash != "" {
+		t.Fatalf("fee leg is not recorded: %+v", p)
+	}
+
+	// Only the merchant leg is sent on retry.
+	config.FeePercent = "50"
+	if err := p.sendToMerchant(); err != nil {
+		t.Fatal(err)
+	}
+	if p.SendHash == "" {
+		t.Fatal("merchant leg is not sent")
+	}
+	if !ledger.received(config.FeeAccount).Equal(fee) || !ledger.received(config.Account).Equal(balance.Sub(fee)) {
+		t.Errorf("funds are split wrong: fee %s, merchant %s", ledger.received(config.FeeAccount), ledger.received(config.Account))
+	}
+}
@@ -6,9 +6,13 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/cenkalti/log v1.0.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/rs/cors v1.7.0
 	github.com/shopspring/decimal v1.2.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/ulule/limiter/v3 v3.5.0
 	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Health checks of the dependencies are run in parallel and given up after HealthTimeout,
+// so the endpoint answers in time for load balancers even if the node hangs.
+// Endpoint is not rate limited.
+
+const healthBucket = "health"
+
+// Health is returned from health endpoint.
+type Health struct {
+	// Set when all critical dependencies are up. Status code is 503 otherwise.
+	OK bool `json:"ok"`
+	// "ok" or "degraded".
+	ServiceStatus  string `json:"serviceStatus"`
+	ServiceMessage string `json:"serviceMessage,omitempty"`
+	// Status of dependencies by name: "node", "database" and "price" if HealthCheckPrice is set.
+	Dependencies map[string]DependencyHealth `json:"dependencies"`
+	// Set when serving TLS with CertFile and KeyFile.
+	TLSCertExpiresAt *time.Time `json:"tlsCertExpiresAt,omitempty"`
+	// Set in a maintenance window. Alerts are suppressed and background jobs are deferred until MaintenanceEndsAt.
+	Maintenance       bool       `json:"maintenance"`
+	MaintenanceEndsAt *time.Time `json:"maintenanceEndsAt,omitempty"`
+	// Currently active SLA alerts.
+	SLAAlerts []SLAAlert `json:"slaAlerts"`
+	// Conditions that need attention but do not make the service unhealthy.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type DependencyHealth struct {
+	OK bool `json:"ok"`
+	// Instance is unhealthy when a critical dependency is down.
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	// Duration of the check in milliseconds.
+	Duration int64 `json:"duration"`
+}
+
+// healthCheck checks a dependency. It must return when ctx is done.
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+func healthChecks() []healthCheck {
+	list := []healthCheck{
+		{name: "node", critical: true, check: checkNodeHealth},
+		{name: "database", critical: true, check: checkDatabaseHealth},
+	}
+	if config.HealthCheckPrice {
+		list = append(list, healthCheck{name: "price", check: checkPriceHealth})
+	}
+	return list
+}
+
+func checkNodeHealth(ctx context.Context) error {
+	_, err := node.WithContext(ctx).Version()
+	return err
+}
+
+// checkDatabaseHealth writes the time of the check to verify the database is writable.
+func checkDatabaseHealth(ctx context.Context) error {
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(healthBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("checkedAt"), []byte(clock.Now().Format(time.RFC3339)))
+	})
+}
+
+func checkPriceHealth(ctx context.Context) error {
+	_, err := getNanoPriceQuoteContext(ctx, "USD")
+	return err
+}
+
+// runHealthChecks runs checks in parallel. Checks not finished before ctx is done are reported as failed.
+func runHealthChecks(ctx context.Context, list []healthCheck) map[string]DependencyHealth {
+	type result struct {
+		name   string
+		health DependencyHealth
+	}
+	results := make(chan result, len(list))
+	for _, c := range list {
+		go func(c healthCheck) {
+			start := time.Now()
+			err := c.check(ctx)
+			h := DependencyHealth{OK: err == nil, Critical: c.critical, Duration: time.Since(start).Milliseconds()}
+			if err != nil {
+				h.Error = err.Error()
+			}
+			results <- result{c.name, h}
+		}(c)
+	}
+	ret := make(map[string]DependencyHealth, len(list))
+	for _, c := range list {
+		ret[c.name] = DependencyHealth{Critical: c.critical, Error: "timeout"}
+	}
+	for range list {
+		select {
+		case res := <-results:
+			ret[res.name] = res.health
+		case <-ctx.Done():
+			return ret
+		}
+	}
+	return ret
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := Health{OK: true}
+	health.ServiceStatus, health.ServiceMessage = nodeErrors.status()
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.HealthTimeout)*time.Millisecond)
+	health.Dependencies = runHealthChecks(ctx, healthChecks())
+	cancel()
+	for name, dep := range health.Dependencies {
+		if dep.Critical && !dep.OK {
+			log.Warningf("health check of %s failed: %s", name, dep.Error)
+			health.OK = false
+		}
+	}
+	if certs != nil {
+		expiresAt := certs.ExpiresAt()
+		health.TLSCertExpiresAt = &expiresAt
+	}
+	if window := maintenance.window(maintenance.now()); window != nil {
+		health.Maintenance = true
+		health.MaintenanceEndsAt = &window.End
+	}
+	health.SLAAlerts = slaAlerts.Alerts()
+	for _, rule := range faults.active() {
+		health.Warnings = append(health.Warnings, "fault injection active: "+rule.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !health.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(&health)
+	if err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestHealthDependencies(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.HealthTimeout = 200
+	t.Cleanup(func() { config.HealthTimeout = 0 })
+	health := func() (int, Health) {
+		w := httptest.NewRecorder()
+		handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var h Health
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatalf("invalid health: %s", w.Body)
+		}
+		return w.Code, h
+	}
+
+	fakeKeyNode(t)
+	if code, h := health(); code != http.StatusOK || !h.OK || !h.Dependencies["node"].OK || !h.Dependencies["database"].OK {
+		t.Fatalf("unexpected health: %d %+v", code, h)
+	}
+
+	// Node does not answer until the request is aborted.
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hanging.Close)
+	node = nano.New(hanging.URL)
+	start := time.Now()
+	code, h := health()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("health check took %s", elapsed)
+	}
+	if code != http.StatusServiceUnavailable || h.OK || h.Dependencies["node"].OK || !h.Dependencies["database"].OK {
+		t.Fatalf("unexpected health with hanging node: %d %+v", code, h)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Payments keep a history of their state transitions for debugging and for progress timelines in clients.
+// Transitions are found from the timestamps of the payment when it is saved and appended to History in the same
+// record, so the history cannot disagree with the state after a crash. Expiry has no timestamp of its own,
+// so it is added to the history when the payment is saved or shown after it expires.
+// /admin/payment shows the full history, responses only the states and their times.
+
+// States in payment history.
+const (
+	historyCreated       = "created"
+	historyFundsDetected = "funds_detected"
+	// Blocks seen on the account add up to the amount.
+	historyConfirmed = "confirmed"
+	// Merchant is notified of the verified payment.
+	historyVerified  = "verified"
+	historyReceived  = "received"
+	historySent      = "sent"
+	historyExpired   = "expired"
+	historyCancelled = "cancelled"
+)
+
+// HistoryEvent is a state transition of a payment.
+type HistoryEvent struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+	// Hash of the block for funds_detected and of the send block for sent.
+	Hash string `json:"hash,omitempty"`
+	// Amount of the block for funds_detected, in raw.
+	Amount *decimal.Decimal `json:"amount,omitempty"`
+}
+
+// HistoryState is a state transition in responses.
+type HistoryState struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// history returns History with the transitions that are not appended to it yet, in time order.
+func (p *Payment) history() []HistoryEvent {
+	seen := make(map[string]bool, len(p.History))
+	for _, e := range p.History {
+		seen[e.State+e.Hash] = true
+	}
+	var added []HistoryEvent
+	add := func(e HistoryEvent) {
+		if !seen[e.State+e.Hash] {
+			seen[e.State+e.Hash] = true
+			added = append(added, e)
+		}
+	}
+	at := func(state string, t *time.Time, hash string) {
+		if t != nil {
+			add(HistoryEvent{State: state, At: t.UTC(), Hash: hash})
+		}
+	}
+	at(historyCreated, &p.CreatedAt, "")
+	hashes := make([]string, 0, len(p.SubPayments))
+	for hash := range p.SubPayments {
+		hashes = append(hashes, hash)
+	}
+	// Blocks seen at the same time are in the same order every time.
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		if sp := p.SubPayments[hash]; sp.ConfirmedAt != nil {
+			amount := sp.Amount
+			add(HistoryEvent{State: historyFundsDetected, At: sp.ConfirmedAt.UTC(), Hash: hash, Amount: &amount})
+		}
+	}
+	at(historyPendingConfirmation, p.PendingConfirmationAt, "")
+	at(historyConfirmed, p.FulfilledAt, "")
+	at(historyVerified, p.NotifiedAt, "")
+	at(historyReceived, p.ReceivedAt, "")
+	at(historySent, p.SentAt, p.SendHash)
+	at(historyCancelled, p.CancelledAt, "")
+	switch {
+	case p.Expiry != nil:
+		at(historyExpired, &p.Expiry.ExpiredAt, "")
+	case p.FulfilledAt == nil && p.CancelledAt == nil && !p.Imported && now().After(p.expiresAt()):
+		expiresAt := p.expiresAt()
+		at(historyExpired, &expiresAt, "")
+	}
+	if len(added) == 0 {
+		return p.History
+	}
+	events := append(append([]HistoryEvent(nil), p.History...), added...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events
+}
+
+// syncHistory appends the new transitions to History before the payment is saved.
+func (p *Payment) syncHistory() {
+	p.History = p.history()
+}
+
+// historyStates returns the history without details for responses.
+func (p *Payment) historyStates() []HistoryState {
+	events := p.history()
+	ret := make([]HistoryState, len(events))
+	for i, e := range events {
+		ret[i] = HistoryState{State: e.State, At: e.At}
+	}
+	return ret
+}
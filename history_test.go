@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPaymentHistory(t *testing.T) {
+	openTestDB(t, 0)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := useFakeClock(t, start)
+	config.setDefaults()
+	config.AllowedDuration = 600
+	t.Cleanup(func() { config.AllowedDuration = 0 })
+	states := func(events []HistoryEvent) string {
+		var s []string
+		for _, e := range events {
+			s = append(s, e.State)
+		}
+		return strings.Join(s, ",")
+	}
+
+	p := &Payment{Account: "nano_1history", Amount: decimal.New(1, 30), CreatedAt: start}
+	if err := p.create(statePolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Minute)
+	if err := p.addSubPayment("HASH", "nano_1sender", decimal.New(1, 30)); err != nil {
+		t.Fatal(err)
+	}
+	p.Balance = p.Amount
+	p.FulfilledAt = now()
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Minute)
+	p.NotifiedAt, p.ReceivedAt = now(), now()
+	clock.Add(time.Minute)
+	p.SentAt, p.SendHash = now(), "SEND"
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// Expiry is not added after the payment is fulfilled.
+	clock.Add(time.Hour)
+
+	p, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := states(p.History); s != "created,funds_detected,confirmed,verified,received,sent" {
+		t.Fatalf("unexpected history: %s", s)
+	}
+	detected, sent := p.History[1], p.History[5]
+	if detected.Hash != "HASH" || !detected.Amount.Equal(p.Amount) || !detected.At.Equal(start.Add(time.Minute)) || sent.Hash != "SEND" {
+		t.Errorf("unexpected events: %+v %+v", detected, sent)
+	}
+
+	// Responses only contain the states and their times.
+	b, err := json.Marshal(NewResponse(p, "").History)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "HASH") || !strings.Contains(string(b), `{"state":"sent","at":"2021-01-01T00:03:00Z"}`) {
+		t.Errorf("unexpected response history: %s", b)
+	}
+
+	// Expiry is shown before it is saved.
+	expired := &Payment{Account: "nano_1expired", Amount: decimal.New(1, 30), CreatedAt: clock.Now()}
+	if err = expired.create(statePolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(11 * time.Minute)
+	if s := expired.historyStates(); len(s) != 2 || s[1].State != historyExpired || !s[1].At.Equal(expired.expiresAt()) {
+		t.Errorf("expiry is not in history: %+v", s)
+	}
+	if s := states(expired.History); s != "created" {
+		t.Errorf("unexpected saved history: %s", s)
+	}
+}
@@ -1,43 +1,117 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cenkalti/log"
-	"github.com/rs/cors"
 	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+	"github.com/ulule/limiter/v3"
 	"github.com/ulule/limiter/v3/drivers/middleware/stdlib"
 	"golang.org/x/net/websocket"
 )
 
 func runServer() {
-	ratelimitMiddleware := stdlib.NewMiddleware(rateLimiter)
+	ratelimitMiddleware := newRateLimitMiddleware(rateLimiter)
+	payRateLimitMiddleware := newRateLimitMiddleware(payRateLimiter)
+	priceRateLimitMiddleware := newRateLimitMiddleware(priceRateLimiter)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/version", handleVersion)
-	mux.Handle("/api/pay", ratelimitMiddleware.Handler(http.HandlerFunc(handlePay)))
-	mux.Handle("/api/price", ratelimitMiddleware.Handler(http.HandlerFunc(handlePrice)))
-	mux.HandleFunc("/api/verify", handleVerify)
-	mux.Handle("/websocket", websocket.Handler(handleWebsocket))
+	mux.HandleFunc("/health", handleHealth)
+	var payHandler http.Handler = http.HandlerFunc(handlePay)
+	if faults != nil {
+		payHandler = faults.middleware(payHandler)
+	}
+	payHandler = deadlineMiddleware(payHandler)
+	mux.Handle("/api/pay", apiKeyRateLimit(payRateLimitMiddleware.Handler(payHandler), payHandler))
+	mux.Handle("/api/price", priceRateLimitMiddleware.Handler(deadlineMiddleware(http.HandlerFunc(handlePrice))))
+	mux.Handle("/api/currencies", priceRateLimitMiddleware.Handler(http.HandlerFunc(handleCurrencies)))
+	if config.SandboxMode {
+		mux.HandleFunc("/api/sandbox/fulfill", handleSandboxFulfill)
+	}
+	if len(config.PublicStatsFields) > 0 {
+		mux.Handle("/api/stats/public", ratelimitMiddleware.Handler(http.HandlerFunc(handlePublicStats)))
+	}
+	mux.Handle("/api/verify", apiKeyRateLimit(http.HandlerFunc(handleVerify), http.HandlerFunc(handleVerify)))
+	mux.HandleFunc("/api/cancel", handleCancel)
+	mux.HandleFunc("/api/receipt", handleReceipt)
+	mux.HandleFunc("/api/qr", handleQR)
+	mux.HandleFunc("/api/keys", handleKeys)
+	mux.HandleFunc("/api/assets", handleAssets)
+	mux.HandleFunc("/api/capabilities", handleCapabilities)
+	mux.HandleFunc(staticPrefix, handleStatic)
+	mux.HandleFunc(widgetPrefix, handleWidget)
+	mux.HandleFunc("/status", handleStatus)
+	if config.EnableCheckoutPage {
+		mux.HandleFunc(checkoutPrefix, handleCheckout)
+	}
+	mux.HandleFunc("/api/proof", handleProof)
+	mux.Handle("/api/proof/verify", ratelimitMiddleware.Handler(http.HandlerFunc(handleProofVerify)))
+	mux.Handle("/websocket", websocketHandler())
+	mux.HandleFunc("/api/events", handleEvents)
+	// Admin endpoints are served on a separate mux if they have their own listener.
+	adminMux := mux
+	if config.AdminListenAddress != "" {
+		adminMux = http.NewServeMux()
+	}
 	if config.AdminPassword != "" {
-		mux.HandleFunc("/admin/payments/active", handleAdminGetActivePayments)
-		mux.HandleFunc("/admin/payment", handleAdminGetPayment)
-		mux.HandleFunc("/admin/check", handleAdminCheckPayment)
-		mux.HandleFunc("/admin/receive", handleAdminReceivePending)
-		mux.HandleFunc("/admin/send", handleAdminSendToMerchant)
+		registerAdminRoutes(adminMux)
 	}
 
 	server.Addr = config.ListenAddress
-	server.Handler = cors.Default().Handler(mux)
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Handler = clientIPMiddleware(trustedProxies, accessLog.middleware(httpLog.middleware(corsMiddleware(mux))))
+	server.RegisterOnShutdown(stopEventStreams)
 
+	switch {
+	case config.CertFile != "" && config.KeyFile != "":
+		if len(config.AutoTLS.Hosts) > 0 {
+			log.Warning("AutoTLS is not used because CertFile and KeyFile are set")
+		}
+		certs, err = newCertReloader(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go runCertExpiryMonitor(certs)
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate} // nolint: gosec
+	case config.autoTLSEnabled():
+		m, err := newAutocertManager(config.AutoTLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = m.TLSConfig()
+		challengeServer.Addr = config.AutoTLS.HTTPAddress
+		challengeServer.Handler = m.HTTPHandler(nil)
+		go serve(&challengeServer)
+	}
+	if config.AdminListenAddress != "" && config.AdminPassword != "" {
+		adminServer.Addr = config.AdminListenAddress
+		adminServer.Handler = clientIPMiddleware(trustedProxies, accessLog.middleware(httpLog.middleware(adminMux)))
+		adminServer.TLSConfig = server.TLSConfig
+		go serve(&adminServer)
+	}
+	serve(&server)
+}
+
+// serve runs s until it is shut down. TLS is used if s has a TLS config.
+func serve(s *http.Server) {
 	var err error
-	if config.CertFile != "" && config.KeyFile != "" {
-		err = server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+	if s.TLSConfig != nil {
+		err = s.ListenAndServeTLS("", "")
 	} else {
-		err = server.ListenAndServe()
+		err = s.ListenAndServe()
 	}
 	if err == http.ErrServerClosed {
 		return
@@ -45,6 +119,65 @@ func runServer() {
 	log.Fatal(err)
 }
 
+// registerAdminRoutes adds the admin endpoints to mux.
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/payments/active", adminHandler(handleAdminGetActivePayments))
+	mux.HandleFunc("/admin/payment", adminHandler(handleAdminGetPayment))
+	mux.HandleFunc("/admin/payments/search", adminHandler(handleAdminSearchPayments))
+	mux.HandleFunc("/admin/payment/notes", adminHandler(handleAdminPaymentNotes))
+	mux.HandleFunc("/admin/payment/tags", adminHandler(handleAdminPaymentTags))
+	mux.HandleFunc("/admin/check", adminHandler(handleAdminCheckPayment))
+	mux.HandleFunc("/admin/receive", adminHandler(handleAdminReceivePending))
+	mux.HandleFunc("/admin/send", adminHandler(handleAdminSendToMerchant))
+	mux.HandleFunc("/admin/approve", adminHandler(handleAdminApproveSweep))
+	mux.HandleFunc("/admin/advance", adminHandler(handleAdminAdvance))
+	mux.HandleFunc("/admin/cancel", adminHandler(handleAdminCancel))
+	mux.HandleFunc("/admin/dispute", adminHandler(handleAdminDispute))
+	mux.HandleFunc("/admin/dispute/resolve", adminHandler(handleAdminResolveDispute))
+	mux.HandleFunc("/admin/payments/disputed", adminHandler(handleAdminGetDisputedPayments))
+	mux.HandleFunc("/admin/stats", adminHandler(handleAdminStats))
+	mux.HandleFunc("/admin/anomalies", adminHandler(handleAdminAnomalies))
+	mux.HandleFunc("/admin/digest/preview", adminHandler(handleAdminDigestPreview))
+	mux.HandleFunc("/admin/partitions", adminHandler(handleAdminPartitions))
+	mux.HandleFunc("/admin/payments/export", adminHandler(handleAdminExportPayments))
+	mux.HandleFunc("/admin/export", adminHandler(handleAdminExport))
+	mux.HandleFunc("/admin/balances", adminHandler(handleAdminBalances))
+	mux.HandleFunc("/admin/account/ownership", adminHandler(handleAdminAccountOwnership))
+	mux.HandleFunc("/admin/integrity", adminHandler(handleAdminIntegrity))
+	mux.HandleFunc("/admin/integrity/resolve", adminHandler(handleAdminResolveIntegrity))
+	if config.ObjectStorageBucket != "" {
+		mux.HandleFunc("/admin/export-to-object-storage", adminHandler(handleAdminExportToObjectStorage))
+		mux.HandleFunc("/admin/exports", adminHandler(handleAdminGetExports))
+	}
+	mux.HandleFunc("/admin/backfill", adminHandler(handleAdminBackfill))
+	mux.HandleFunc("/admin/backfill/status", adminHandler(handleAdminBackfillStatus))
+	mux.HandleFunc("/admin/recover-scan", adminHandler(handleAdminRecoverScan))
+	mux.HandleFunc("/admin/sweep", adminHandler(handleAdminSweep))
+	mux.HandleFunc("/admin/compact", adminHandler(handleAdminCompact))
+	mux.HandleFunc("/admin/debug/stats", adminHandler(handleAdminDebugStats))
+	mux.HandleFunc("/admin/debug/providers", adminHandler(handleAdminDebugProviders))
+	mux.HandleFunc("/admin/debug/caches", adminHandler(handleAdminDebugCaches))
+	mux.HandleFunc("/admin/debug/large-payments", adminHandler(handleAdminDebugLargePayments))
+	mux.HandleFunc("/admin/presets", adminHandler(handleAdminPresets))
+	mux.HandleFunc("/admin/keys/rotate", adminHandler(handleAdminRotateKeys))
+	mux.HandleFunc("/admin/import", adminHandler(handleAdminImport))
+	mux.HandleFunc("/admin/resolve-late", adminHandler(handleAdminResolveLate))
+	mux.HandleFunc("/admin/refund", adminHandler(handleAdminRefund))
+	mux.HandleFunc("/admin/notify", adminHandler(handleAdminNotify))
+	mux.HandleFunc("/admin/outbox", adminHandler(handleAdminOutbox))
+	mux.HandleFunc("/admin/outbox/reset-breaker", adminHandler(handleAdminResetBreaker))
+	mux.HandleFunc("/admin/http-log", adminHandler(handleAdminHTTPLog))
+	mux.HandleFunc("/admin/nodes", adminHandler(handleAdminNodes))
+	mux.HandleFunc("/admin/config-effective", adminHandler(handleAdminConfigEffective))
+	mux.HandleFunc("/admin/maintenance", adminHandler(handleAdminMaintenance))
+	mux.HandleFunc("/admin/jobs", adminHandler(handleAdminJobs))
+	if faults != nil {
+		mux.HandleFunc("/admin/faults", adminHandler(handleAdminFaults))
+	}
+	mux.HandleFunc("/admin/audit", adminHandler(handleAdminAudit))
+	mux.Handle("/admin/metrics", adminHandler(expvar.Handler().ServeHTTP))
+}
+
 func handleVersion(w http.ResponseWriter, r *http.Request) {
 	_, err := w.Write([]byte(Version))
 	if err != nil {
@@ -52,18 +185,45 @@ func handleVersion(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func newRateLimitMiddleware(l *limiter.Limiter) *stdlib.Middleware {
+	return stdlib.NewMiddleware(l, stdlib.WithLimitReachedHandler(handleRateLimited), stdlib.WithErrorHandler(handleRateLimitError))
+}
+
+func handleRateLimited(w http.ResponseWriter, r *http.Request) {
+	writeError(w, errCodeRateLimited, http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+func handleRateLimitError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Error(err)
+	writeInternalError(w)
+}
+
 func handlePrice(w http.ResponseWriter, r *http.Request) {
 	currency := r.FormValue("currency")
-	price, err := getNanoPrice(currency)
-	if err != nil {
-		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if values := r.Form["currency"]; len(values) > 1 || strings.Contains(currency, ",") {
+		handleBatchPrice(w, r, values)
+		return
+	}
+	if currency != "" && !validCurrency(currency) {
+		writeError(w, errCodeInvalidCurrency, http.StatusBadRequest, "invalid currency")
+		return
+	}
+	quote, err := getNanoPriceQuoteContext(r.Context(), currency)
+	if !checkDeadline(w, r) {
+		return
+	}
+	if err == errPriceCurrencyUnsupported {
+		writeError(w, errCodeUnsupportedCurrency, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err == errPriceUnavailable && (quote.AsOf.IsZero() || config.PriceStalePolicy == priceStaleRefuse) {
+		writeError(w, errCodePriceUnavailable, http.StatusServiceUnavailable, "price is not available")
 		return
 	}
-	b, err := json.Marshal(map[string]interface{}{"price": price})
+	b, err := json.Marshal(priceResponse(quote))
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
 	_, err = w.Write(b)
@@ -72,72 +232,297 @@ func handlePrice(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// priceResponse is the body of /api/price for quote.
+func priceResponse(quote PriceQuote) map[string]interface{} {
+	return map[string]interface{}{
+		"price":  quote.Price,
+		"asOf":   quote.AsOf,
+		"age":    int(priceNow().Sub(quote.AsOf).Seconds()),
+		"source": quote.Source,
+		"stale":  quote.Stale,
+	}
+}
+
 func handlePay(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		writeError(w, errCodeMethodNotAllowed, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if err := parseJSONBody(r); err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !normalizeDeprecatedParams(w, r) {
+		return
+	}
+	clientKey, apiKey := requestAPIKey(r)
+	if clientKey == "" && r.Header.Get("X-API-Key") != "" {
+		writeError(w, errCodeInvalidAPIKey, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	var idempotencyKey string
+	if key := requestIdempotencyKey(r); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, errCodeInvalidIdempotency, http.StatusBadRequest, "idempotency key is too long")
+			return
+		}
+		idempotencyKey = idempotencyScope(clientFingerprint(r), key)
+		defer idempotencyLocks.lock(idempotencyKey)()
+		p, err := findIdempotentPayment(idempotencyKey)
+		if err != nil {
+			log.Error(err)
+			writeInternalError(w)
+			return
+		}
+		if p != nil {
+			writeIdempotentPayment(w, r, p)
+			return
+		}
+	}
+	if exposure.refusePayments() {
+		writeError(w, errCodeExposureLimit, http.StatusServiceUnavailable, "payments are paused until held funds are swept")
+		return
+	}
+	admission := admitPayment(apiKey)
+	if admission == admissionRejected {
+		writeBackloggedError(w)
+		return
+	}
+	state := r.FormValue("state")
+	policy := statePolicyFor(apiKey)
+	if !policy.valid(state) {
+		writeError(w, errCodeInvalidState, http.StatusBadRequest, "missing or invalid state")
+		return
+	}
+	displayCurrencies, err := parseDisplayCurrencies(r.FormValue("display_currencies"))
+	if err != nil {
+		writeDisplayCurrenciesError(w)
+		return
+	}
+	fields := payFields{Amount: r.FormValue("amount"), Currency: r.FormValue("currency"), NotifyURL: r.FormValue("notify_url")}
+	if fields.NotifyURL != "" && !validNotificationURL(fields.NotifyURL) {
+		writeError(w, errCodeInvalidNotifyURL, http.StatusBadRequest, "invalid notify_url")
+		return
+	}
+	if s := r.FormValue("timeout"); s != "" {
+		fields.Timeout, err = strconv.Atoi(s)
+		if err != nil || fields.Timeout < config.MinPaymentTimeout || fields.Timeout > config.MaxPaymentTimeout {
+			writeError(w, errCodeInvalidTimeout, http.StatusBadRequest,
+				fmt.Sprintf("timeout must be between %d and %d seconds", config.MinPaymentTimeout, config.MaxPaymentTimeout))
+			return
+		}
+	}
+	onExpiry := apiKey.OnExpiryWithFunds
+	if s := r.FormValue("on_expiry_with_funds"); s != "" {
+		onExpiry = s
+	}
+	if !validExpiryPolicy(onExpiry) {
+		writeError(w, errCodeInvalidExpiryPolicy, http.StatusBadRequest, "on_expiry_with_funds must be hold, auto_refund or notify_credit")
+		return
+	}
+	if onExpiry == expiryHold {
+		onExpiry = ""
+	}
+	sandbox, ok := parseSandbox(w, r)
+	if !ok {
+		return
+	}
+	merchant, ok := requestMerchant(w, r, apiKey)
+	if !ok {
+		return
+	}
+	var metadata map[string]interface{}
+	if s := r.FormValue("metadata"); s != "" {
+		metadata, err = parseMetadata(s)
+		if !writeMetadataError(w, err) {
+			return
+		}
+	}
+	var preset *Preset
+	if name := r.FormValue("preset"); name != "" {
+		var err error
+		preset, err = loadPreset(name)
+		if err == errPresetNotFound {
+			writeError(w, errCodeUnknownPreset, http.StatusBadRequest, "unknown preset")
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			writeInternalError(w)
+			return
+		}
+		fields, err = preset.merge(fields)
+		if e, ok := err.(*presetConflictError); ok {
+			writeError(w, e.Code(), http.StatusBadRequest, e.Error())
+			return
+		}
+	}
+	var amount, price, rawAmount decimal.Decimal
+	var staleRate bool
+	currency := fields.Currency
+	unit := r.FormValue("unit")
+	switch unit {
+	case "", "nano":
+	case "raw":
+		// Raw amounts are exact, so they are not converted from a currency.
+		if currency != "" {
+			writeError(w, errCodeInvalidUnit, http.StatusBadRequest, "unit=raw cannot be used with a currency")
+			return
+		}
+	default:
+		writeError(w, errCodeInvalidUnit, http.StatusBadRequest, "unit must be nano or raw")
 		return
 	}
-	var amount decimal.Decimal
-	amountInCurrency, err := decimal.NewFromString(r.FormValue("amount"))
+	amountInCurrency, err := parseAmount(fields.Amount)
+	if unit == "raw" {
+		rawAmount, err = parseRawAmount(fields.Amount)
+		amountInCurrency = RawToNano(rawAmount)
+	}
 	if err != nil {
 		log.Debug(err)
-		http.Error(w, "invalid amount", http.StatusBadRequest)
+		writeError(w, errCodeInvalidAmount, http.StatusBadRequest, "invalid amount")
+		return
+	}
+	if currency != "" && !validCurrency(currency) {
+		writeError(w, errCodeInvalidCurrency, http.StatusBadRequest, "invalid currency")
 		return
 	}
-	currency := r.FormValue("currency")
 	if currency != "" {
-		price, err2 := getNanoPrice(currency)
-		if err2 != nil {
-			log.Error(err2)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		quote, err2 := getNanoPriceQuoteContext(r.Context(), currency)
+		if !checkDeadline(w, r) {
+			return
+		}
+		if err2 == errPriceCurrencyUnsupported {
+			writeError(w, errCodeUnsupportedCurrency, http.StatusBadRequest, err2.Error())
+			return
+		}
+		if err2 == errPriceUnavailable && (quote.AsOf.IsZero() || config.PriceStalePolicy == priceStaleRefuse) {
+			writeError(w, errCodePriceUnavailable, http.StatusServiceUnavailable, "price is not available")
 			return
 		}
+		price = quote.Price
+		staleRate = err2 == errPriceUnavailable
 		amount = amountInCurrency.DivRound(price, 6)
 	} else {
 		amount = amountInCurrency
 		currency = "BCB"
 	}
 	currency = strings.ToUpper(currency)
-	index, err := NewIndex()
+	if unit != "raw" {
+		rawAmount, err = NanoToRawChecked(amount)
+	}
+	if err != nil || !rawAmount.IsPositive() {
+		log.Debugln("invalid amount:", amount, err)
+		writeError(w, errCodeInvalidAmount, http.StatusBadRequest, "invalid amount")
+		return
+	}
+	if err = checkPaymentLimits(amount); err != nil {
+		writeError(w, errCodeAmountOutOfRange, http.StatusBadRequest, err.Error())
+		return
+	}
+	if node.CircuitOpen() {
+		writeNodeUnavailable(w)
+		return
+	}
+	// Allocated indexes are not reused, so the deadline is not checked after this point.
+	if !checkDeadline(w, r) {
+		return
+	}
+	index, err := store.AllocateIndex(indexNamespace(merchant))
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	seed, err := merchantSeed(merchant)
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	key, err := node.DeterministicKey(seed, index)
+	if nano.IsUnavailable(err) {
+		log.Errorln("cannot derive key:", err)
+		writeNodeUnavailable(w)
+		return
+	}
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
-	key, err := node.DeterministicKey(config.Seed, index)
+	paymentID, err := NewPaymentID()
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
-	token, err := NewToken(index, key.Account)
+	token, err := newMerchantToken(index, key.Account, paymentID, merchant)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
 	payment := &Payment{
+		PaymentID:        paymentID,
 		PublicKey:        key.Public,
 		Account:          key.Account,
 		Index:            index,
-		Amount:           NanoToRaw(amount),
-		AmountInCurrency: amountInCurrency,
+		Amount:           rawAmount,
+		AmountInCurrency: NewCurrencyAmount(amountInCurrency, currency),
 		Currency:         currency,
-		State:            r.FormValue("state"),
-		CreatedAt:        time.Now().UTC(),
+		Price:            price,
+		StaleRate:        staleRate,
+		Tier:             apiKey.Tier,
+		State:            state,
+		CreatedAt:        clock.Now(),
+	}
+	versions := currentVersions()
+	payment.CreatedWith = &versions
+	if preset != nil {
+		preset.apply(payment)
+	}
+	payment.Metadata = mergeMetadata(payment.Metadata, metadata)
+	if !writeMetadataError(w, payment.checkMetadataSize()) {
+		return
+	}
+	payment.NotificationURL = fields.NotifyURL
+	payment.Timeout = fields.Timeout
+	payment.OnExpiryWithFunds = onExpiry
+	if clientKey != "" {
+		payment.Client = keyFingerprint(clientKey)
+	}
+	payment.IdempotencyKey = idempotencyKey
+	payment.Sandbox = sandbox
+	payment.Merchant = merchant
+	payment.RequestID = requestID(r)
+	err = payment.create(policy)
+	if err == errDuplicateState {
+		writeError(w, errCodeDuplicateState, http.StatusConflict, errDuplicateState.Error())
+		return
+	}
+	if err == errDuplicateIdempotencyKey {
+		writeError(w, errCodeIdempotencyInUse, http.StatusConflict, errDuplicateIdempotencyKey.Error())
+		return
 	}
-	err = payment.Save()
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
+	slaAlerts.recordCreated(payment.CreatedAt)
+	anomalies.record(anomalyPaymentCreations, payment.Client)
 	payment.StartChecking()
+	if !payment.Sandbox {
+		startOpenWork(payment.Account, payment.PublicKey)
+	}
 	response := NewResponse(payment, token)
+	response.Display = displayAmounts(r.Context(), payment, displayCurrencies)
+	applyAdmission(response, admission)
 	b, err := json.Marshal(&response)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
 	log.Debugf("created new payment: %s", b)
@@ -147,33 +532,75 @@ func handlePay(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleVerify returns the payment by token or by payment ID.
 func handleVerify(w http.ResponseWriter, r *http.Request) {
-	token := r.FormValue("token")
-	if token == "" {
-		http.Error(w, "invalid token", http.StatusBadRequest)
+	if err := parseJSONBody(r); err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, err.Error())
 		return
 	}
-	claims, err := ParseToken(token)
-	if err != nil {
-		http.Error(w, "invalid token", http.StatusBadRequest)
+	if !normalizeDeprecatedParams(w, r) {
 		return
 	}
-	payment, err := LoadPayment([]byte(claims.Account))
-	if err == errPaymentNotFound {
-		log.Debugln("token not found:", token)
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	displayCurrencies, err := parseDisplayCurrencies(r.FormValue("display_currencies"))
+	if err != nil {
+		writeDisplayCurrenciesError(w)
 		return
 	}
-	if err != nil {
-		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	var payment *Payment
+	token := r.FormValue("token")
+	id := r.FormValue("id")
+	switch {
+	case token != "":
+		claims, err := ParseToken(token)
+		if err != nil {
+			writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+			return
+		}
+		payment, err = loadSettledPayment(claims.Account)
+		if err == nil && !payment.visibleTo(r, claims) {
+			err = errPaymentNotFound
+		}
+		if err == errPaymentNotFound {
+			log.Debugln("token not found:", token)
+			writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			writeInternalError(w)
+			return
+		}
+	case id != "":
+		var err error
+		payment, err = loadSettledPaymentByID(id)
+		if err == nil && !payment.visibleTo(r, nil) {
+			err = errPaymentNotFound
+		}
+		if err == errPaymentNotFound {
+			writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			writeInternalError(w)
+			return
+		}
+		token, err = newPaymentToken(payment)
+		if err != nil {
+			log.Error(err)
+			writeInternalError(w)
+			return
+		}
+	default:
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
 		return
 	}
 	response := NewResponse(payment, token)
+	response.Display = displayAmounts(r.Context(), payment, displayCurrencies)
 	b, err := json.Marshal(&response)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
 	_, err = w.Write(b)
@@ -182,34 +609,43 @@ func handleVerify(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// onWebsocketRead is called after every read from a websocket client. Replaced in tests.
+var onWebsocketRead = func() {}
+
+// handleWebsocket serves a websocket client. Panics are recovered here, so the deferred teardown
+// in serveWebsocket always runs and the server keeps running.
 func handleWebsocket(conn *websocket.Conn) {
-	r := conn.Request()
-	token := r.FormValue("token")
-	if token == "" {
+	id := websockets.open(conn)
+	defer websockets.close(id)
+	defer func() {
+		if v := recover(); v != nil {
+			log.Errorf("panic in websocket handler: %v\n%s", v, debug.Stack())
+		}
+	}()
+	serveWebsocket(conn, id)
+}
+
+func serveWebsocket(conn *websocket.Conn, id uint64) {
+	token, err := websocketToken(conn)
+	if err != nil {
+		log.Debugln("websocket auth failed:", err)
 		return
 	}
-	claims, err := ParseToken(token)
+	c := newWSConn(conn, id)
+	go c.queue.run()
+	defer c.close()
+	err = c.subscribe(token, conn.Request().FormValue("since"))
 	if err != nil {
+		log.Debugln("websocket auth failed:", err)
+		c.subscribeError(err, token)
 		return
 	}
-	cancel := verifications.Subscribe(Account(claims.Account), func(e Event) {
-		pv := e.(PaymentVerified)
-		response := NewResponse(&pv.Payment, token)
-		b, err := json.Marshal(&response)
-		if err != nil {
-			return
-		}
-		_, _ = conn.Write(b)
-	})
-	defer cancel()
-	const readBufferSize = 1024
-	buf := make([]byte, readBufferSize)
-	for {
-		_, err := conn.Read(buf)
-		if err != nil {
-			return
-		}
+	go c.keepalive()
+	if d, ok := faults.websocketCloseAfter(); ok {
+		t := time.AfterFunc(d, func() { _ = conn.Close() })
+		defer t.Stop()
 	}
+	c.read()
 }
 
 type PaymentVerified struct {
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// HTTP logging captures requests and responses for debugging merchant integrations.
+// Requests are logged if their path is in HTTPLogRoutes and they are sampled,
+// or if they come from an API key or IP enabled via /admin/http-log.
+// Credentials and tokens are always redacted before an entry is written.
+
+// maxHTTPLogTTL is the longest time logging can stay enabled for a target.
+const maxHTTPLogTTL = 24 * time.Hour
+
+const redacted = "[redacted]"
+
+// Headers containing credentials. Headers with "Signature" in their names are redacted too.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+var (
+	// Query and form parameters containing credentials.
+	redactParamRegexp = regexp.MustCompile(`(?i)(^|&)(token|password|seed|api_key|secret)=[^&]*`)
+	// JSON fields containing credentials. Matches values cut by body size limit.
+	redactJSONRegexp = regexp.MustCompile(`(?i)"(token|password|seed|apiKey|secret)"(\s*):(\s*)"[^"]*("|$)`)
+	// JWTs anywhere in the text, including truncated ones.
+	redactJWTRegexp = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*(\.[A-Za-z0-9_-]*){0,2}`)
+)
+
+// redactText removes credentials from a query string or body.
+func redactText(s string) string {
+	s = redactParamRegexp.ReplaceAllString(s, "$1$2="+redacted)
+	s = redactJSONRegexp.ReplaceAllString(s, `"$1"$2:$3"`+redacted+`"`)
+	return redactJWTRegexp.ReplaceAllString(s, redacted)
+}
+
+// redactPath removes tokens from a path like /checkout/<token>.
+func redactPath(s string) string {
+	return redactJWTRegexp.ReplaceAllString(s, redacted)
+}
+
+func redactHeaders(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for name, values := range h {
+		value := strings.Join(values, ", ")
+		if stringInSlice(name, redactedHeaders) || strings.Contains(name, "Signature") {
+			value = redacted
+		}
+		m[name] = redactText(value)
+	}
+	return m
+}
+
+// HTTPLogEntry is a logged request and its response.
+type HTTPLogEntry struct {
+	Time            time.Time         `json:"time"`
+	Method          string            `json:"method"`
+	Path            string            `json:"path"`
+	Query           string            `json:"query,omitempty"`
+	RemoteAddr      string            `json:"remoteAddr"`
+	ProxyAddr       string            `json:"proxyAddr,omitempty"`
+	Client          string            `json:"client"`
+	RequestHeaders  map[string]string `json:"requestHeaders"`
+	RequestBody     string            `json:"requestBody,omitempty"`
+	Status          int               `json:"status"`
+	ResponseHeaders map[string]string `json:"responseHeaders"`
+	ResponseBody    string            `json:"responseBody,omitempty"`
+	DurationMS      int64             `json:"durationMs"`
+	// Set if a body is longer than HTTPLogMaxBodySize.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// HTTPLogTarget enables logging of all requests from an API key or IP until it expires.
+type HTTPLogTarget struct {
+	apiKey string
+	// First characters of the API key for display.
+	APIKey    string    `json:"apiKey,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (t HTTPLogTarget) matches(r *http.Request) bool {
+	if t.apiKey != "" {
+		key, _ := requestAPIKey(r)
+		return key == t.apiKey
+	}
+	return remoteIP(r) == t.IP
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var httpLog *httpLogger
+
+type httpLogger struct {
+	// Entries are written here as JSON lines. Normal logger is used if nil.
+	out     io.Writer
+	mu      sync.Mutex
+	targets []HTTPLogTarget
+	now     func() time.Time
+	// Returns a number in [0,100).
+	roll func() int
+}
+
+func newHTTPLogger(out io.Writer) *httpLogger {
+	return &httpLogger{
+		out:  out,
+		now:  clockNow,
+		roll: func() int { return rand.Intn(100) }, // nolint: gosec
+	}
+}
+
+// addTarget adds t replacing the previous target for the same API key or IP.
+func (l *httpLogger) addTarget(t HTTPLogTarget) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	targets := l.targets[:0]
+	for _, old := range l.targets {
+		if old.apiKey != t.apiKey || old.IP != t.IP {
+			targets = append(targets, old)
+		}
+	}
+	l.targets = append(targets, t)
+	log.Noticeln("http logging enabled for", t.describe(), "until", t.ExpiresAt.Format(time.RFC3339))
+}
+
+func (t HTTPLogTarget) describe() string {
+	if t.apiKey != "" {
+		return "API key " + t.APIKey
+	}
+	return "IP " + t.IP
+}
+
+func (l *httpLogger) clearTargets() {
+	l.mu.Lock()
+	l.targets = nil
+	l.mu.Unlock()
+}
+
+// activeTargets removes expired targets and returns the remaining ones.
+func (l *httpLogger) activeTargets() []HTTPLogTarget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	active := make([]HTTPLogTarget, 0, len(l.targets))
+	for _, t := range l.targets {
+		if now.Before(t.ExpiresAt) {
+			active = append(active, t)
+		} else {
+			log.Noticeln("http logging expired for", t.describe())
+		}
+	}
+	l.targets = active
+	return append([]HTTPLogTarget(nil), active...)
+}
+
+// enabled returns true if the request must be logged.
+func (l *httpLogger) enabled(r *http.Request) bool {
+	for _, t := range l.activeTargets() {
+		if t.matches(r) {
+			return true
+		}
+	}
+	return routeEnabled(r.URL.Path, config.HTTPLogRoutes) && l.roll() < config.HTTPLogSamplePercent
+}
+
+// routeEnabled matches paths exactly. Routes ending with a slash match paths under them.
+func routeEnabled(path string, routes []string) bool {
+	for _, route := range routes {
+		if path == route || strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware logs requests that are enabled.
+// Websocket upgrades are not logged because the connection is hijacked.
+func (l *httpLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || !l.enabled(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := l.now()
+		reqBody := &cappedBuffer{max: config.HTTPLogMaxBodySize}
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK, body: cappedBuffer{max: config.HTTPLogMaxBodySize}}
+		next.ServeHTTP(rec, r)
+		l.write(HTTPLogEntry{
+			Time:            start.UTC(),
+			Method:          r.Method,
+			Path:            redactPath(r.URL.Path),
+			Query:           redactText(r.URL.RawQuery),
+			RemoteAddr:      r.RemoteAddr,
+			ProxyAddr:       proxyAddr(r),
+			Client:          clientFingerprint(r),
+			RequestHeaders:  redactHeaders(r.Header),
+			RequestBody:     redactText(reqBody.String()),
+			Status:          rec.status,
+			ResponseHeaders: redactHeaders(w.Header()),
+			ResponseBody:    redactText(rec.body.String()),
+			DurationMS:      l.now().Sub(start).Milliseconds(),
+			Truncated:       reqBody.truncated || rec.body.truncated,
+		})
+	})
+}
+
+func (l *httpLogger) write(e HTTPLogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if l.out == nil {
+		log.Infoln("http:", string(b))
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.out.Write(append(b, '\n'))
+	if err != nil {
+		log.Errorln("cannot write http log:", err)
+	}
+}
+
+// cappedBuffer keeps the first max bytes written to it.
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - b.Len(); n > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.Buffer.Write(p)
+	return n, nil
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        cappedBuffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	_, _ = r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush lets event streams through while they are logged.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// parseHTTPLogTarget reads a target from admin request form values.
+func parseHTTPLogTarget(r *http.Request, now time.Time) (HTTPLogTarget, error) {
+	var t HTTPLogTarget
+	ttl, err := strconv.Atoi(r.FormValue("ttl"))
+	if err != nil || ttl <= 0 {
+		return t, errors.New("ttl must be a positive number of seconds")
+	}
+	if time.Duration(ttl)*time.Second > maxHTTPLogTTL {
+		return t, fmt.Errorf("ttl cannot be longer than %s", maxHTTPLogTTL)
+	}
+	t.ExpiresAt = now.Add(time.Duration(ttl) * time.Second)
+	apiKey, ip := r.FormValue("api_key"), r.FormValue("ip")
+	switch {
+	case apiKey != "" && ip != "":
+		return t, errors.New("api_key and ip cannot be set together")
+	case apiKey != "":
+		const shown = 4
+		t.apiKey = apiKey
+		t.APIKey = apiKey
+		if len(apiKey) > shown {
+			t.APIKey = apiKey[:shown] + "..."
+		}
+	case ip != "":
+		if net.ParseIP(ip) == nil {
+			return t, errors.New("invalid ip")
+		}
+		t.IP = ip
+	default:
+		return t, errors.New("api_key or ip is required")
+	}
+	return t, nil
+}
+
+// handleAdminHTTPLog lists targets on GET, adds a target on POST and removes all targets on DELETE.
+func handleAdminHTTPLog(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		t, err := parseHTTPLogTarget(r, httpLog.now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpLog.addTarget(t)
+	case http.MethodDelete:
+		httpLog.clearTargets()
+		log.Noticeln("http log targets cleared by", adminIdentity(r))
+	default:
+		http.Error(w, "GET, POST or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, httpLog.activeTargets())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+// fakeKeyNode derives the same account for every index.
+func fakeKeyNode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(nano.Key{
+			Private: "9F0E444C69F77A49BD0BE89DB92C38FE713E0963165CCA12FAF5712D7657120F",
+			Public:  "C008B814A7D269A1FA3C6528B19201A24D797912DB9996FF02A1FF356E45552B",
+			Account: "nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b7",
+		})
+	}))
+	t.Cleanup(ts.Close)
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+}
+
+func TestHTTPLogRedactsTokens(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.HTTPLogRoutes = []string{"/api/"}
+	config.AllowedDuration = -1
+	t.Cleanup(func() {
+		config.HTTPLogRoutes = nil
+		config.HTTPLogMaxBodySize = 0
+		config.AllowedDuration = 0
+	})
+	stopCheckLoops(t)
+	var out bytes.Buffer
+	logger := newHTTPLogger(&out)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/pay", handlePay)
+	mux.HandleFunc("/api/verify", handleVerify)
+	h := logger.middleware(mux)
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s failed: %d %s", r.URL.Path, w.Code, w.Body)
+		}
+		return w
+	}
+	postForm := func(path string, values url.Values) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	var response Response
+	w := serve(postForm("/api/pay", url.Values{"amount": {"1"}}))
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	token := response.Token
+	serve(httptest.NewRequest(http.MethodGet, "/api/verify?token="+url.QueryEscape(token), nil))
+	serve(postForm("/api/verify", url.Values{"token": {token}}))
+	r := httptest.NewRequest(http.MethodGet, "/api/verify?id="+response.PaymentID, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Referer", "https://shop.example/checkout?token="+token)
+	serve(r)
+	// Tokens cut anywhere by the size limit must not leak either.
+	for size := 1; size < w.Body.Len(); size++ {
+		config.HTTPLogMaxBodySize = size
+		serve(httptest.NewRequest(http.MethodGet, "/api/verify?id="+response.PaymentID, nil))
+	}
+
+	logged := out.String()
+	if n := strings.Count(logged, "\n"); n != 4+w.Body.Len()-1 {
+		t.Fatalf("unexpected number of entries: %d", n)
+	}
+	const minLength = 8
+	for i := 0; i+minLength <= len(token); i++ {
+		if s := token[i : i+minLength]; strings.Contains(logged, s) {
+			t.Fatalf("token substring %q is logged", s)
+		}
+	}
+	if !strings.Contains(logged, response.Account) {
+		t.Fatal("response body is not logged")
+	}
+}
+
+func TestHTTPLogTarget(t *testing.T) {
+	now := time.Now()
+	httpLog = newHTTPLogger(&bytes.Buffer{})
+	httpLog.now = func() time.Time { return now }
+	t.Cleanup(func() { httpLog = nil })
+	w := postAdminForm(handleAdminHTTPLog, url.Values{"ip": {"192.0.2.1"}, "ttl": {"60"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot add target: %d %s", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/verify", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if !httpLog.enabled(r) {
+		t.Fatal("request from target IP is not logged")
+	}
+	r.RemoteAddr = "192.0.2.2:1234"
+	if httpLog.enabled(r) {
+		t.Fatal("request from other IP is logged")
+	}
+	now = now.Add(time.Minute)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if httpLog.enabled(r) {
+		t.Fatal("target did not expire")
+	}
+	w = postAdminForm(handleAdminHTTPLog, url.Values{"ip": {"192.0.2.1"}, "ttl": {"86401"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("ttl longer than limit accepted: %d", w.Code)
+	}
+}
@@ -2,7 +2,14 @@ package main
 
 // This file is copied from https://github.com/cenkalti/hub/blob/master/hub.go then modified for the project.
 
-import "sync"
+import (
+	"expvar"
+	"sync"
+
+	"github.com/cenkalti/log"
+)
+
+var metricSubscriberPanics = expvar.NewInt("subscriber_panics_total")
 
 type Account string
 
@@ -19,15 +26,35 @@ type Hub struct {
 	subscribers map[Account][]handler
 	m           sync.RWMutex
 	seq         uint64
+	intercept   Interceptor
+}
+
+// Interceptor is called for every published event instead of dispatching it.
+// It must call next to deliver the event to the subscribers.
+type Interceptor func(e Event, next func(Event))
+
+// Intercept sets the interceptor of published events.
+func (h *Hub) Intercept(i Interceptor) {
+	h.m.Lock()
+	h.intercept = i
+	h.m.Unlock()
 }
 
 type handler struct {
 	f  func(Event)
 	id uint64
+	// Set if the subscription is made with SubscribeOwner.
+	owner string
 }
 
 // Subscribe registers f for the event of a specific account.
 func (h *Hub) Subscribe(account Account, f func(Event)) (cancel func()) {
+	return h.SubscribeOwner(account, "", f)
+}
+
+// SubscribeOwner is same as Subscribe but records the owner of the subscription,
+// so subscriptions of owners that are gone can be found and cancelled with CancelOwner.
+func (h *Hub) SubscribeOwner(account Account, owner string, f func(Event)) (cancel func()) {
 	var cancelled bool
 	h.m.Lock()
 	h.seq++
@@ -35,36 +62,121 @@ func (h *Hub) Subscribe(account Account, f func(Event)) (cancel func()) {
 	if h.subscribers == nil {
 		h.subscribers = make(map[Account][]handler)
 	}
-	h.subscribers[account] = append(h.subscribers[account], handler{id: id, f: f})
+	h.subscribers[account] = append(h.subscribers[account], handler{id: id, f: f, owner: owner})
 	h.m.Unlock()
 	return func() {
 		h.m.Lock()
-		if cancelled {
-			h.m.Unlock()
-			return
+		if !cancelled {
+			cancelled = true
+			h.remove(account, func(s handler) bool { return s.id == id })
 		}
-		cancelled = true
-		a := h.subscribers[account]
-		for i, f := range a {
-			if f.id == id {
-				a[i], h.subscribers[account] = a[len(a)-1], a[:len(a)-1]
-				break
-			}
+		h.m.Unlock()
+	}
+}
+
+// remove deletes the handlers of account that match. Write lock must be held.
+func (h *Hub) remove(account Account, match func(handler) bool) int {
+	var kept []handler
+	for _, s := range h.subscribers[account] {
+		if !match(s) {
+			kept = append(kept, s)
 		}
-		if len(a) == 0 {
-			delete(h.subscribers, account)
+	}
+	removed := len(h.subscribers[account]) - len(kept)
+	if len(kept) == 0 {
+		delete(h.subscribers, account)
+	} else {
+		h.subscribers[account] = kept
+	}
+	return removed
+}
+
+// Len returns the number of subscriptions.
+func (h *Hub) Len() int {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	var n int
+	for _, a := range h.subscribers {
+		n += len(a)
+	}
+	return n
+}
+
+// Owners returns the owners of the subscriptions made with SubscribeOwner.
+func (h *Hub) Owners() []string {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	seen := make(map[string]struct{})
+	var owners []string
+	for _, a := range h.subscribers {
+		for _, s := range a {
+			if _, ok := seen[s.owner]; !ok && s.owner != "" {
+				seen[s.owner] = struct{}{}
+				owners = append(owners, s.owner)
+			}
 		}
-		h.m.Unlock()
 	}
+	return owners
+}
+
+// CancelOwner removes the subscriptions of owner and returns their number.
+func (h *Hub) CancelOwner(owner string) int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	var n int
+	for account := range h.subscribers {
+		n += h.remove(account, func(s handler) bool { return s.owner == owner })
+	}
+	return n
 }
 
 // Publish an event to the subscribers.
 func (h *Hub) Publish(e Event) {
+	h.m.RLock()
+	intercept := h.intercept
+	h.m.RUnlock()
+	if intercept != nil {
+		intercept(e, h.dispatch)
+		return
+	}
+	h.dispatch(e)
+}
+
+func (h *Hub) dispatch(e Event) {
+	var panicked []uint64
 	h.m.RLock()
 	if handlers, ok := h.subscribers[e.Account()]; ok {
-		for _, h := range handlers {
-			h.f(e)
+		for _, s := range handlers {
+			if !call(s.f, e) {
+				panicked = append(panicked, s.id)
+			}
 		}
 	}
 	h.m.RUnlock()
+	if len(panicked) == 0 {
+		return
+	}
+	// Handlers that panic are broken, they are removed so they do not hold their owners forever.
+	h.m.Lock()
+	h.remove(e.Account(), func(s handler) bool {
+		for _, id := range panicked {
+			if s.id == id {
+				return true
+			}
+		}
+		return false
+	})
+	h.m.Unlock()
+}
+
+// call runs f with e and returns false if f panics.
+func call(f func(Event), e Event) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			metricSubscriberPanics.Add(1)
+			log.Errorf("panic in subscriber of %s: %v", e.Account(), v)
+		}
+	}()
+	f(e)
+	return true
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// idempotencyBucket maps idempotency keys of /api/pay requests to the accounts of the payments they created.
+// Keys are "<client>/<key>" so that clients with different API keys do not share keys.
+const idempotencyBucket = "idempotency_keys"
+
+const maxIdempotencyKeyLength = 255
+
+var errDuplicateIdempotencyKey = errors.New("payment with the same idempotency key is being created")
+
+// idempotencyRecord is the value in idempotencyBucket.
+type idempotencyRecord struct {
+	Account   string    `json:"account"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// requestIdempotencyKey returns the key in Idempotency-Key header or idempotency_key parameter.
+func requestIdempotencyKey(r *http.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return r.FormValue("idempotency_key")
+}
+
+func idempotencyScope(client, key string) string {
+	return client + "/" + key
+}
+
+// idempotencyExpiry returns the time that the key of p can be forgotten.
+// It is kept for IdempotencyWindow, and at least until the payment expires.
+func idempotencyExpiry(p *Payment) time.Time {
+	window := time.Duration(config.IdempotencyWindow) * time.Second
+	if d := p.allowedDuration(); d > window {
+		window = d
+	}
+	return p.CreatedAt.Add(window)
+}
+
+// findIdempotentPayment returns the payment created with the scoped key, or nil if there is none or it is expired.
+func findIdempotentPayment(scope string) (*Payment, error) {
+	record, err := store.IdempotencyRecord(scope)
+	if err != nil || record == nil || !clock.Now().Before(record.ExpiresAt) {
+		return nil, err
+	}
+	p, err := LoadPayment([]byte(record.Account))
+	if err == errPaymentNotFound {
+		return nil, nil
+	}
+	return p, err
+}
+
+// putIdempotencyKey records the key of p in tx. Called when the payment is created.
+// It returns errDuplicateIdempotencyKey if the key is recorded for another payment that is not expired,
+// so that instances sharing the database do not create two payments for the same key.
+func putIdempotencyKey(tx *bbolt.Tx, p *Payment) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(idempotencyBucket))
+	if err != nil {
+		return err
+	}
+	if v := b.Get([]byte(p.IdempotencyKey)); v != nil {
+		var record idempotencyRecord
+		if json.Unmarshal(v, &record) == nil && clock.Now().Before(record.ExpiresAt) {
+			return errDuplicateIdempotencyKey
+		}
+	}
+	value, err := json.Marshal(idempotencyRecord{Account: p.Account, ExpiresAt: idempotencyExpiry(p)})
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(p.IdempotencyKey), value)
+}
+
+// deleteExpiredIdempotencyKeys removes the keys that expired before now. Returns the number of deleted keys.
+func deleteExpiredIdempotencyKeys(now time.Time) (int, error) {
+	return store.DeleteExpiredIdempotencyKeys(now)
+}
+
+func (boltStore) IdempotencyRecord(scope string) (*idempotencyRecord, error) {
+	var record *idempotencyRecord
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(idempotencyBucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(scope))
+		if v == nil {
+			return nil
+		}
+		record = new(idempotencyRecord)
+		return json.Unmarshal(v, record)
+	})
+	return record, err
+}
+
+func (boltStore) DeleteExpiredIdempotencyKeys(now time.Time) (int, error) {
+	var count int
+	err := dbUpdate(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(idempotencyBucket))
+		if b == nil {
+			return nil
+		}
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var record idempotencyRecord
+			if json.Unmarshal(v, &record) != nil || !now.Before(record.ExpiresAt) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return count, err
+}
+
+// idempotencyLocks serializes /api/pay requests with the same key in this instance,
+// so that a retry waits for the first request and gets its payment.
+var idempotencyLocks = &keyLocks{locks: make(map[string]*keyLock)}
+
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the key and returns the function to unlock it.
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.waiters++
+	l.mu.Unlock()
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		kl.waiters--
+		if kl.waiters == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// writeIdempotentPayment writes the payment created by an earlier request with the same idempotency key.
+// The token is signed again, it refers to the same payment as the first one.
+func writeIdempotentPayment(w http.ResponseWriter, r *http.Request, p *Payment) {
+	token, err := newPaymentToken(p)
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	response := NewResponse(p, token)
+	if displayCurrencies, err := parseDisplayCurrencies(r.FormValue("display_currencies")); err == nil {
+		response.Display = displayAmounts(r.Context(), p, displayCurrencies)
+	}
+	b, err := json.Marshal(response)
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	log.Debugf("returning payment %s for idempotency key", p.PaymentID)
+	w.Header().Set("Idempotent-Replayed", "true")
+	if _, err = w.Write(b); err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotentPay(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedDuration = 600
+	config.IdempotencyWindow = 60
+	t.Cleanup(func() {
+		config.AllowedDuration = 0
+		config.IdempotencyWindow = 0
+	})
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	stopCheckLoops(t)
+	pay := func(key string) (Response, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(url.Values{"amount": {"1"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		var response Response
+		if w.Code != http.StatusOK {
+			t.Errorf("cannot create payment: %d %s", w.Code, w.Body)
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &response)
+		return response, w
+	}
+
+	// Concurrent retries get the same payment.
+	var wg sync.WaitGroup
+	ids := make([]string, 5)
+	replayed := 0
+	var mu sync.Mutex
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, w := pay("order-1")
+			ids[i] = response.PaymentID
+			mu.Lock()
+			if w.Header().Get("Idempotent-Replayed") == "true" {
+				replayed++
+			}
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id == "" || id != ids[0] {
+			t.Fatalf("retries created different payments: %v", ids)
+		}
+	}
+	if replayed != len(ids)-1 {
+		t.Errorf("%d responses are replayed", replayed)
+	}
+	claims, err := ParseToken(func() string { r, _ := pay("order-1"); return r.Token }())
+	if err != nil || claims.PaymentID != ids[0] {
+		t.Fatalf("token of replayed payment is invalid: %v %+v", err, claims)
+	}
+
+	// Key is kept until the payment expires, after the window.
+	c.Add(5 * time.Minute)
+	if r, _ := pay("order-1"); r.PaymentID != ids[0] {
+		t.Error("key is forgotten before the payment expires")
+	}
+	c.Add(6 * time.Minute)
+	if r, _ := pay("order-1"); r.PaymentID == ids[0] {
+		t.Error("expired key returns the old payment")
+	}
+	c.Add(time.Hour)
+	count, err := deleteExpiredIdempotencyKeys(clock.Now())
+	if err != nil || count != 1 {
+		t.Errorf("expired key is not deleted: %d %v", count, err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(url.Values{"amount": {"1"}, "idempotency_key": {strings.Repeat("k", 256)}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handlePay(w, r)
+	expectErrorCode(t, w, http.StatusBadRequest, errCodeInvalidIdempotency)
+}
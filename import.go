@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Payment history exported from other payment processors can be imported with
+// "accept-nano import" command or POST /admin/import.
+// Imported payments are final: they are never checked and funds of their accounts are never moved.
+//
+// Supported formats:
+//
+// "csv" is a generic CSV file with a header row. Columns are:
+//   account      (required) deposit account of the payment
+//   amount       (required) received amount in NANO
+//   created_at   (required) RFC 3339 time
+//   fulfilled_at RFC 3339 time, created_at is used if empty
+//   currency, amount_in_currency, price  fiat valuation at the time of payment
+//   state        merchant reference of the payment
+//   payment_id   identifier from the other processor, a new one is generated if empty
+//   block_hash   hash of the send block
+// Columns with other names can be mapped with a mapping like "account=Address,amount=Paid".
+//
+// "btcpay" is the invoice export of BTCPay Server in CSV format. Rows of the same invoice are merged
+// and rows with a CryptoCode other than XNO or NANO are skipped.
+
+// Import statuses of rows.
+const (
+	importStatusImported  = "imported"
+	importStatusValid     = "valid"
+	importStatusDuplicate = "duplicate"
+	importStatusSkipped   = "skipped"
+	importStatusError     = "error"
+)
+
+var importFormats = []string{"csv", "btcpay"}
+
+var accountRegexp = regexp.MustCompile(`^(nano|xrb)_[13][13456789abcdefghijkmnopqrstuwxyz]{59}$`)
+
+var errPaymentImported = errors.New("payment is imported")
+
+// importedRecord is a payment read from an export file with the row numbers it came from.
+type importedRecord struct {
+	rows    []int
+	payment *Payment
+	err     error
+	skipped bool
+}
+
+// ImportRow is the result of importing a payment.
+type ImportRow struct {
+	// Line numbers in the file. Header is line 1.
+	Rows      []int  `json:"rows"`
+	Account   string `json:"account,omitempty"`
+	PaymentID string `json:"paymentId,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ImportReport is the result of an import.
+type ImportReport struct {
+	DryRun bool           `json:"dryRun"`
+	Counts map[string]int `json:"counts"`
+	Rows   []ImportRow    `json:"rows"`
+}
+
+// parseImportMapping parses a mapping like "account=Address,amount=Paid" into field to column names.
+func parseImportMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if s == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid mapping: %q", pair)
+		}
+		mapping[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return mapping, nil
+}
+
+// csvRows reads a CSV file with a header and returns each row as a map of column names to values.
+func csvRows(r io.Reader) ([]map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	var rows []map[string]string
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(name)] = strings.TrimSpace(record[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// readImport parses payments in format from r.
+func readImport(r io.Reader, format string, mapping map[string]string) ([]importedRecord, error) {
+	rows, err := csvRows(r)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "csv":
+		records := make([]importedRecord, len(rows))
+		for i, row := range rows {
+			records[i].rows = []int{i + 2}
+			records[i].payment, records[i].err = parseGenericImportRow(row, mapping)
+		}
+		return records, nil
+	case "btcpay":
+		return parseBTCPayRows(rows), nil
+	default:
+		return nil, fmt.Errorf("unknown format: %q", format)
+	}
+}
+
+func parseGenericImportRow(row map[string]string, mapping map[string]string) (*Payment, error) {
+	get := func(field string) string {
+		if column, ok := mapping[field]; ok {
+			return row[column]
+		}
+		return row[field]
+	}
+	p := &Payment{
+		Account:   get("account"),
+		Currency:  strings.ToUpper(get("currency")),
+		State:     get("state"),
+		PaymentID: get("payment_id"),
+	}
+	amount, err := parseImportAmount(get("amount"))
+	if err != nil {
+		return nil, err
+	}
+	p.Amount, p.Balance = amount, amount
+	if s := get("amount_in_currency"); s != "" {
+		amountInCurrency, err2 := parseAmount(s)
+		if err2 != nil {
+			return nil, errors.New("invalid amount_in_currency")
+		}
+		p.AmountInCurrency = NewCurrencyAmount(amountInCurrency, p.Currency)
+	}
+	if s := get("price"); s != "" {
+		if p.Price, err = decimal.NewFromString(s); err != nil {
+			return nil, errors.New("invalid price")
+		}
+	}
+	if p.CreatedAt, err = time.Parse(time.RFC3339, get("created_at")); err != nil {
+		return nil, errors.New("invalid created_at")
+	}
+	fulfilledAt := p.CreatedAt
+	if s := get("fulfilled_at"); s != "" {
+		if fulfilledAt, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, errors.New("invalid fulfilled_at")
+		}
+	}
+	p.FulfilledAt = &fulfilledAt
+	if hash := get("block_hash"); hash != "" {
+		p.SubPayments = map[string]SubPayment{hash: {Amount: amount, ConfirmedAt: &fulfilledAt}}
+	}
+	return p, nil
+}
+
+// parseBTCPayRows merges rows of the same invoice into a payment.
+func parseBTCPayRows(rows []map[string]string) []importedRecord {
+	var records []importedRecord
+	invoices := make(map[string]int)
+	for i, row := range rows {
+		line := i + 2
+		code := strings.ToUpper(row["CryptoCode"])
+		if code != "XNO" && code != "NANO" {
+			records = append(records, importedRecord{rows: []int{line}, skipped: true})
+			continue
+		}
+		amount, err := parseImportAmount(row["Paid"])
+		if err != nil {
+			records = append(records, importedRecord{rows: []int{line}, err: err})
+			continue
+		}
+		receivedAt, err := time.Parse(time.RFC3339, row["ReceivedDate"])
+		if err != nil {
+			records = append(records, importedRecord{rows: []int{line}, err: errors.New("invalid ReceivedDate")})
+			continue
+		}
+		idx, ok := invoices[row["InvoiceId"]]
+		if !ok {
+			p := &Payment{
+				Account:     row["Destination"],
+				PaymentID:   row["InvoiceId"],
+				State:       row["OrderId"],
+				Currency:    strings.ToUpper(row["InvoiceCurrency"]),
+				SubPayments: make(map[string]SubPayment),
+			}
+			amountInCurrency, _ := parseAmount(row["InvoicePrice"])
+			p.AmountInCurrency = NewCurrencyAmount(amountInCurrency, p.Currency)
+			p.Price, _ = decimal.NewFromString(row["ConversionRate"])
+			p.CreatedAt, err = time.Parse(time.RFC3339, row["InvoiceCreatedDate"])
+			if err != nil {
+				records = append(records, importedRecord{rows: []int{line}, err: errors.New("invalid InvoiceCreatedDate")})
+				continue
+			}
+			idx = len(records)
+			invoices[row["InvoiceId"]] = idx
+			records = append(records, importedRecord{payment: p})
+		}
+		rec := &records[idx]
+		rec.rows = append(rec.rows, line)
+		p := rec.payment
+		if p.Account != row["Destination"] {
+			rec.err = errors.New("payments of the invoice are sent to different accounts")
+			continue
+		}
+		p.Amount = p.Amount.Add(amount)
+		p.Balance = p.Amount
+		p.SubPayments[row["PaymentId"]] = SubPayment{Amount: amount, ConfirmedAt: &receivedAt}
+		if p.FulfilledAt == nil || receivedAt.After(*p.FulfilledAt) {
+			p.FulfilledAt = &receivedAt
+		}
+	}
+	return records
+}
+
+// parseImportAmount parses an amount in NANO into raw.
+func parseImportAmount(s string) (decimal.Decimal, error) {
+	amount, err := decimal.NewFromString(s)
+	if err != nil {
+		return decimal.Zero, errors.New("invalid amount")
+	}
+	raw, err := NanoToRawChecked(amount)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if !raw.IsPositive() {
+		return decimal.Zero, errAmountNotPositive
+	}
+	return raw, nil
+}
+
+// validateImportedPayment checks the fields of a payment read from an export.
+func validateImportedPayment(p *Payment) error {
+	if !accountRegexp.MatchString(p.Account) {
+		return errors.New("invalid account")
+	}
+	if !p.Amount.IsPositive() {
+		return errAmountNotPositive
+	}
+	if p.CreatedAt.IsZero() || p.CreatedAt.After(clock.Now()) {
+		return errors.New("created_at must be in the past")
+	}
+	if p.FulfilledAt != nil && p.FulfilledAt.Before(p.CreatedAt) {
+		return errors.New("fulfilled_at is before created_at")
+	}
+	if p.Currency != "" && p.AmountInCurrency.IsZero() {
+		return errors.New("amount_in_currency is required with currency")
+	}
+	return p.checkMetadataSize()
+}
+
+// importIndex holds the keys of existing payments for duplicate detection.
+type importIndex struct {
+	accounts   map[string]bool
+	hashes     map[string]bool
+	paymentIDs map[string]bool
+}
+
+func loadImportIndex() (*importIndex, error) {
+	idx := &importIndex{accounts: make(map[string]bool), hashes: make(map[string]bool), paymentIDs: make(map[string]bool)}
+	err := forEachPayment(func(p *Payment) error {
+		idx.add(p)
+		return nil
+	})
+	return idx, err
+}
+
+func (idx *importIndex) add(p *Payment) {
+	idx.accounts[p.Account] = true
+	idx.paymentIDs[p.PaymentID] = true
+	for hash := range p.SubPayments {
+		idx.hashes[hash] = true
+	}
+}
+
+// duplicate returns the reason if p is already saved.
+func (idx *importIndex) duplicate(p *Payment) string {
+	if idx.accounts[p.Account] {
+		return "account exists"
+	}
+	for hash := range p.SubPayments {
+		if idx.hashes[hash] {
+			return "block exists: " + hash
+		}
+	}
+	// Payment IDs from other processors may collide with ours.
+	if p.PaymentID != "" && idx.paymentIDs[p.PaymentID] {
+		return "payment id exists"
+	}
+	return ""
+}
+
+// importPayments reads payments in format from r and saves the ones that do not exist yet.
+// Nothing is saved if dryRun is true.
+func importPayments(r io.Reader, format string, mapping map[string]string, dryRun bool) (*ImportReport, error) {
+	records, err := readImport(r, format, mapping)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := loadImportIndex()
+	if err != nil {
+		return nil, err
+	}
+	report := &ImportReport{DryRun: dryRun, Counts: make(map[string]int)}
+	for _, rec := range records {
+		row := ImportRow{Rows: rec.rows}
+		p := rec.payment
+		if p != nil {
+			row.Account = p.Account
+		}
+		switch {
+		case rec.skipped:
+			row.Status = importStatusSkipped
+		case rec.err != nil:
+			row.Status, row.Error = importStatusError, rec.err.Error()
+		default:
+			row.Status, row.Error = importPayment(p, format, idx, dryRun)
+			row.PaymentID = p.PaymentID
+		}
+		report.Counts[row.Status]++
+		report.Rows = append(report.Rows, row)
+	}
+	return report, nil
+}
+
+// importPayment validates p and saves it unless it is a duplicate. Returns the status and error message for the report.
+func importPayment(p *Payment, format string, idx *importIndex, dryRun bool) (status, message string) {
+	if err := validateImportedPayment(p); err != nil {
+		return importStatusError, err.Error()
+	}
+	if reason := idx.duplicate(p); reason != "" {
+		return importStatusDuplicate, reason
+	}
+	// Later rows in the same file are checked against this one.
+	idx.add(p)
+	if dryRun {
+		return importStatusValid, ""
+	}
+	p.Imported = true
+	p.ImportedFrom = format
+	if p.PaymentID == "" {
+		id, err := NewPaymentID()
+		if err != nil {
+			return importStatusError, err.Error()
+		}
+		p.PaymentID = id
+	}
+	if err := p.create(statePolicy{}); err != nil {
+		return importStatusError, err.Error()
+	}
+	return importStatusImported, ""
+}
+
+func handleAdminImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if !stringInSlice(format, importFormats) {
+		http.Error(w, "format must be one of "+strings.Join(importFormats, ", "), http.StatusBadRequest)
+		return
+	}
+	mapping, err := parseImportMapping(r.URL.Query().Get("mapping"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := importPayments(r.Body, format, mapping, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !dryRun {
+		log.Noticef("%d payments imported by %s", report.Counts[importStatusImported], adminIdentity(r))
+	}
+	writeAdminJSON(w, report)
+}
+
+// runImportCommand implements "accept-nano import" subcommand.
+func runImportCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(configPath, "config", *configPath, "config file path")
+	format := fs.String("format", "csv", "format of the file: "+strings.Join(importFormats, ", "))
+	mappingFlag := fs.String("mapping", "", `column names for csv format, e.g. "account=Address,amount=Paid"`)
+	dryRun := fs.Bool("dry-run", false, "validate the file and report duplicates without saving")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: accept-nano import [flags] FILE")
+	}
+	mapping, err := parseImportMapping(*mappingFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	err = openDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeDB()
+	report, err := importPayments(f, *format, mapping, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func importFixture(t *testing.T, name, format string, dryRun bool) *ImportReport {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	report, err := importPayments(f, format, nil, dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func expectImportCounts(t *testing.T, report *ImportReport, expected map[string]int) {
+	t.Helper()
+	for status, n := range expected {
+		if report.Counts[status] != n {
+			t.Fatalf("expected %d %s rows, got counts %v, rows %+v", n, status, report.Counts, report.Rows)
+		}
+	}
+}
+
+func TestImportGeneric(t *testing.T) {
+	openTestDB(t, 0)
+	report := importFixture(t, "import_generic.csv", "csv", true)
+	expectImportCounts(t, report, map[string]int{importStatusValid: 2, importStatusDuplicate: 1, importStatusError: 2})
+	err := forEachPayment(func(p *Payment) error {
+		t.Fatalf("dry run saved payment: %+v", p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report = importFixture(t, "import_generic.csv", "csv", false)
+	expectImportCounts(t, report, map[string]int{importStatusImported: 2, importStatusDuplicate: 1, importStatusError: 2})
+	if row := report.Rows[3]; row.Rows[0] != 5 || row.Error != "invalid account" {
+		t.Fatalf("unexpected error row: %+v", row)
+	}
+	p, err := LoadPayment([]byte(report.Rows[0].Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Imported || p.ImportedFrom != "csv" || p.nextStep() != stepNone || !p.finished() {
+		t.Fatalf("payment is not final: %+v", p)
+	}
+	if !p.Amount.Equal(NanoToRaw(decimal.RequireFromString("1.5"))) || p.Currency != "USD" || p.FulfilledAt.Minute() != 5 || len(p.SubPayments) != 1 {
+		t.Fatalf("unexpected payment: %+v", p)
+	}
+	if _, err = LoadPaymentByID("legacy-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	report = importFixture(t, "import_generic.csv", "csv", false)
+	expectImportCounts(t, report, map[string]int{importStatusImported: 0, importStatusDuplicate: 3})
+
+	w := postAdminForm(handleAdminReceivePending, url.Values{"account": {p.Account}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("imported payment is received: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestImportBTCPay(t *testing.T) {
+	openTestDB(t, 0)
+	report := importFixture(t, "import_btcpay.csv", "btcpay", false)
+	expectImportCounts(t, report, map[string]int{importStatusImported: 1, importStatusSkipped: 1, importStatusError: 1})
+	row := report.Rows[0]
+	if len(row.Rows) != 2 || row.PaymentID != "Inv1000" {
+		t.Fatalf("invoice rows are not merged: %+v", row)
+	}
+	p, err := LoadPaymentByID("Inv1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Amount.Equal(NanoToRaw(decimal.New(3, 0))) || len(p.SubPayments) != 2 || p.State != "shop-1" || p.FulfilledAt.Minute() != 3 {
+		t.Fatalf("unexpected payment: %+v", p)
+	}
+}
+
+func TestAdminImportMapping(t *testing.T) {
+	openTestDB(t, 0)
+	body := "Address,Paid,Created\n" +
+		"nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r399,1,2020-01-02T10:00:00Z\n"
+	r := httptest.NewRequest(http.MethodPost, "/admin/import?format=csv&mapping=account=Address,amount=Paid,created_at=Created", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handleAdminImport(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot import: %d %s", w.Code, w.Body)
+	}
+	if _, err := LoadPayment([]byte("nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r399")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Values for IntegrityMode config.
+const (
+	integrityOff = "off"
+	// A fraction of loads, set by IntegritySampleRate, are checked.
+	integritySample = "sample"
+	// Every payment is checked on its first load.
+	integrityFull = "full"
+)
+
+// integrityBucket keeps the payments whose stored key does not match the key derived from the seed, by account.
+// It is separate from payments, so detecting a mismatch on load does not write the payment record.
+const integrityBucket = "integrity_mismatches"
+
+// Resolutions of an integrity mismatch.
+const (
+	// Public key is replaced with the derived one. Account must match the derived account.
+	integrityRepaired = "repaired"
+	// Operator checked the record and accepts it as it is.
+	integrityAcknowledged = "acknowledged"
+)
+
+var errIntegrityMismatch = errors.New("stored key does not match the key derived from seed")
+
+var metricIntegrityMismatches = expvar.NewInt("integrity_mismatches_total")
+
+// IntegrityMismatch is recorded when the account or public key of a payment is not derived from the configured seeds at its index.
+type IntegrityMismatch struct {
+	Account    string    `json:"account"`
+	Index      string    `json:"index"`
+	PublicKey  string    `json:"publicKey"`
+	DetectedAt time.Time `json:"detectedAt"`
+	// Set when an operator resolves the mismatch.
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+	ResolvedBy string     `json:"resolvedBy,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+}
+
+// blocks returns true if funds of the payment must not be moved.
+func (m *IntegrityMismatch) blocks() bool {
+	return m != nil && m.ResolvedAt == nil
+}
+
+// integrityRandom returns a number in [0, 1) to sample loads. Replaced in tests.
+var integrityRandom = rand.Float64
+
+// integrityVerified keeps the records that are checked in this process, so they are not checked on every load.
+// Values are "<index>/<public key>" of the record when it is checked.
+var integrityVerified sync.Map
+
+func integrityFingerprint(p *Payment) string {
+	return p.Index + "/" + strings.ToUpper(p.PublicKey)
+}
+
+// shouldCheckIntegrity returns true if the payment is checked on this load.
+func (p *Payment) shouldCheckIntegrity() bool {
+	if p.Imported || p.Sandbox || p.Index == "" || p.integrity != nil {
+		return false
+	}
+	switch config.IntegrityMode {
+	case integrityFull:
+	case integritySample:
+		if integrityRandom() >= config.IntegritySampleRate {
+			return false
+		}
+	default:
+		return false
+	}
+	v, ok := integrityVerified.Load(p.Account)
+	return !ok || v != integrityFingerprint(p)
+}
+
+// checkIntegrity derives the key of the payment and records a mismatch if it is not owned by one of the configured seeds.
+// Errors of the node are logged, the payment is checked again on a later load.
+func (p *Payment) checkIntegrity() {
+	o, err := p.checkOwnership()
+	if err != nil {
+		log.Debugln("cannot check integrity of", p.logName(), err)
+		return
+	}
+	if o.Result == ownershipOwned || o.Result == ownershipLegacySeed {
+		integrityVerified.Store(p.Account, integrityFingerprint(p))
+		return
+	}
+	m := &IntegrityMismatch{Account: p.Account, Index: p.Index, PublicKey: p.PublicKey, DetectedAt: clock.Now()}
+	if err = saveIntegrityMismatch(m); err != nil {
+		log.Errorln("cannot record integrity mismatch:", err)
+		return
+	}
+	p.integrity = m
+	metricIntegrityMismatches.Add(1)
+	message := fmt.Sprintf("stored key of %s is not derived from seed at index %s", p.Account, p.Index)
+	log.Errorln(message)
+	sendAlert("integrity_mismatch", message, map[string]interface{}{"account": p.Account, "index": p.Index})
+}
+
+func saveIntegrityMismatch(m *IntegrityMismatch) error {
+	return store.SaveIntegrityMismatch(m)
+}
+
+func (boltStore) SaveIntegrityMismatch(m *IntegrityMismatch) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(integrityBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(m.Account), value)
+	})
+}
+
+// decodeIntegrityMismatch decodes the mismatch of the payment from integrityBucket. It returns nil if there is none,
+// or if the record is changed since the mismatch is resolved, so it is checked again.
+func decodeIntegrityMismatch(v []byte, p *Payment) (*IntegrityMismatch, error) {
+	if v == nil {
+		return nil, nil
+	}
+	var m IntegrityMismatch
+	if err := json.Unmarshal(v, &m); err != nil {
+		return nil, err
+	}
+	if m.ResolvedAt != nil && (m.Index != p.Index || !strings.EqualFold(m.PublicKey, p.PublicKey)) {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// integrityMismatches returns the recorded mismatches, resolved ones included.
+func integrityMismatches() ([]IntegrityMismatch, error) {
+	return store.IntegrityMismatches()
+}
+
+func (boltStore) IntegrityMismatches() ([]IntegrityMismatch, error) {
+	ret := make([]IntegrityMismatch, 0)
+	err := scanBucket(integrityBucket, func(k, v []byte) error {
+		var m IntegrityMismatch
+		if err := json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		ret = append(ret, m)
+		return nil
+	})
+	return ret, err
+}
+
+func handleAdminIntegrity(w http.ResponseWriter, r *http.Request) {
+	mismatches, err := integrityMismatches()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, mismatches)
+}
+
+// handleAdminResolveIntegrity resolves the mismatch of a payment so its funds can be moved again.
+// With resolution=repaired the public key is replaced with the key derived from Seed, if the account matches it.
+// With resolution=acknowledged the record is kept as it is. It is checked again if its index or key changes.
+func handleAdminResolveIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	resolution := r.FormValue("resolution")
+	if resolution != integrityRepaired && resolution != integrityAcknowledged {
+		http.Error(w, "invalid resolution", http.StatusBadRequest)
+		return
+	}
+	var m *IntegrityMismatch
+	p := updatePayment(w, r, func(p *Payment) bool {
+		if !p.integrity.blocks() {
+			http.Error(w, "payment has no integrity mismatch", http.StatusConflict)
+			return false
+		}
+		m = p.integrity
+		if resolution == integrityRepaired {
+			key, err := p.deriveKey()
+			if err != nil {
+				log.Error(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return false
+			}
+			if key.Account != p.Account {
+				http.Error(w, "account is not derived from seed at its index, it cannot be repaired", http.StatusConflict)
+				return false
+			}
+			p.PublicKey = key.Public
+		}
+		return true
+	})
+	if p == nil {
+		return
+	}
+	m.ResolvedAt = now()
+	m.ResolvedBy = adminIdentity(r)
+	m.Resolution = resolution
+	m.PublicKey = p.PublicKey
+	if err := saveIntegrityMismatch(m); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Noticef("integrity mismatch of %s resolved by %s: %s", p.Account, m.ResolvedBy, resolution)
+	p.integrity = m
+	writeAdminJSON(w, m)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestIntegrity(t *testing.T) {
+	openTestDB(t, 0)
+	fakeDeriveNode(t)
+	config.setDefaults()
+	const seed = "0000000000000000000000000000000000000000000000000000000000000000"
+	oldSeed := config.Seed
+	config.Seed = seed
+	oldRandom := integrityRandom
+	integrityRandom = func() float64 { return 0.5 }
+	t.Cleanup(func() {
+		config.Seed = oldSeed
+		config.IntegrityMode, config.IntegritySampleRate = "", 0
+		integrityRandom = oldRandom
+	})
+
+	key := func(index uint32) *nano.Key {
+		k, err := nano.DeriveKey(seed, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	// Public key stored with the account is derived from the next index.
+	corrupt := func(account string, index uint32) *Payment {
+		p := &Payment{Account: account, PublicKey: key(index + 1).Public, Index: strconv.Itoa(int(index)), FulfilledAt: now(), NotifiedAt: now(), ReceivedAt: now()}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	load := func(account string) *Payment {
+		p, err := LoadPayment([]byte(account))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	corrupt("nano_1off", 1)
+	config.IntegrityMode = integrityOff
+	if load("nano_1off").integrity != nil {
+		t.Error("mismatch is detected in off mode")
+	}
+
+	corrupt("nano_1sampled", 2)
+	config.IntegrityMode, config.IntegritySampleRate = integritySample, 0.1
+	if load("nano_1sampled").integrity != nil {
+		t.Error("load out of sample is checked")
+	}
+	config.IntegritySampleRate = 0.9
+	if !load("nano_1sampled").integrity.blocks() {
+		t.Error("mismatch is not detected in sample mode")
+	}
+
+	before := metricIntegrityMismatches.Value()
+	config.IntegrityMode = integrityFull
+	// Account is derived from seed, only the public key is corrupted.
+	k := key(3)
+	corrupt(k.Account, 3)
+	p := load(k.Account)
+	if !p.integrity.blocks() || metricIntegrityMismatches.Value() != before+1 {
+		t.Fatalf("mismatch is not detected in full mode: %+v", p.integrity)
+	}
+	if err := p.runStep(stepSweep); err != errIntegrityMismatch {
+		t.Errorf("sweep is not blocked: %v", err)
+	}
+	w := postAdminForm(handleAdminSendToMerchant, url.Values{"account": {k.Account}})
+	expectErrorCode(t, w, http.StatusConflict, errCodeIntegrityMismatch)
+
+	w = httptest.NewRecorder()
+	handleAdminIntegrity(w, httptest.NewRequest(http.MethodGet, "/admin/integrity", nil))
+	var report []IntegrityMismatch
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || len(report) != 2 {
+		t.Fatalf("unexpected report: %s", w.Body)
+	}
+
+	// A corrupted account cannot be repaired, it can only be acknowledged.
+	w = postAdminForm(handleAdminResolveIntegrity, url.Values{"account": {"nano_1sampled"}, "resolution": {integrityRepaired}})
+	if w.Code != http.StatusConflict {
+		t.Errorf("account not derived from seed is repaired: %d %s", w.Code, w.Body)
+	}
+	w = postAdminForm(handleAdminResolveIntegrity, url.Values{"account": {"nano_1sampled"}, "resolution": {integrityAcknowledged}})
+	if w.Code != http.StatusOK || load("nano_1sampled").integrity.blocks() {
+		t.Errorf("cannot acknowledge mismatch: %d %s", w.Code, w.Body)
+	}
+
+	w = postAdminForm(handleAdminResolveIntegrity, url.Values{"account": {k.Account}, "resolution": {integrityRepaired}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot repair: %d %s", w.Code, w.Body)
+	}
+	p = load(k.Account)
+	if p.integrity.blocks() || p.PublicKey != k.Public {
+		t.Fatalf("payment is not repaired: %+v %+v", p, p.integrity)
+	}
+	if o, err := p.checkOwnership(); err != nil || o.Result != ownershipOwned {
+		t.Errorf("repaired payment is not owned: %+v %v", o, err)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/tundak/accept-nano/nano"
+	"go.etcd.io/bbolt"
+)
+
+// Periodic background work runs as named jobs of one scheduler instead of separate tickers.
+// Each job has a class: at most one node-heavy and one store-heavy job run at a time, cheap jobs run when due.
+// Node-heavy jobs also wait while background node requests are throttled.
+// A random delay of up to JobJitter percent of the interval is added to every run time, so jobs with the same interval
+// and instances started together do not run at the same moment. Next run times and recent runs are saved in database,
+// so after a restart jobs continue on their schedule instead of all running at start.
+
+const (
+	jobsBucket       = "jobs"
+	jobSchedulerTick = time.Second
+	maxJobHistory    = 20
+)
+
+// Names of scheduled jobs. Jobs deferred in maintenance windows are defined in maintenance.go.
+const (
+	jobDatabaseSize    = "database-size"
+	jobSLA             = "sla"
+	jobAnomalies       = "anomalies"
+	jobExposure        = "exposure"
+	jobWatchdog        = "watchdog"
+	jobIdempotencyKeys = "idempotency-keys"
+	jobLeftoverSweep   = "leftover-sweep"
+	jobNodeVersion     = "node-version"
+	jobNodeProbe       = "node-probe"
+)
+
+type jobClass string
+
+const (
+	jobClassNode  jobClass = "node-heavy"
+	jobClassStore jobClass = "store-heavy"
+	jobClassCheap jobClass = "cheap"
+)
+
+// Reasons of a due job for waiting.
+const (
+	jobWaitingClass       = "class"
+	jobWaitingNode        = "node"
+	jobWaitingMaintenance = "maintenance"
+)
+
+var errUnknownJob = errors.New("unknown job")
+
+// Job is a background task run by the scheduler.
+type Job struct {
+	Name  string
+	Class jobClass
+	// Zero runs the job only when it is triggered.
+	Interval time.Duration
+	// Runs the job at start instead of after the first interval, unless a next run is saved.
+	RunAtStart bool
+	// Deferred to the end of maintenance windows.
+	Deferrable bool
+	Run        func() error
+}
+
+// JobRun is the outcome of a run of a job.
+type JobRun struct {
+	StartedAt time.Time `json:"startedAt"`
+	// Seconds.
+	Duration float64 `json:"duration"`
+	// True if the run is started with the admin endpoint or by another job.
+	Triggered bool   `json:"triggered,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// jobRecord is the saved state of a job in jobsBucket.
+type jobRecord struct {
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	Paused    bool       `json:"paused,omitempty"`
+	Runs      int        `json:"runs"`
+	Failures  int        `json:"failures"`
+	// Latest run is the last.
+	History []JobRun `json:"history,omitempty"`
+}
+
+// JobStatus is returned from /admin/jobs.
+type JobStatus struct {
+	Name  string   `json:"name"`
+	Class jobClass `json:"class"`
+	// Seconds. Zero if the job runs only when triggered.
+	Interval  float64    `json:"interval"`
+	Paused    bool       `json:"paused"`
+	Running   bool       `json:"running"`
+	Waiting   string     `json:"waiting,omitempty"`
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	LastRun   *JobRun    `json:"lastRun,omitempty"`
+	Runs      int        `json:"runs"`
+	Failures  int        `json:"failures"`
+	// Set when a single job is requested.
+	History []JobRun `json:"history,omitempty"`
+}
+
+type scheduledJob struct {
+	Job
+	jobRecord
+	running   bool
+	triggered bool
+	// Why the job is not started although it is due.
+	waiting string
+}
+
+type jobScheduler struct {
+	now  func() time.Time
+	rand func() float64
+	// Returns true if node-heavy jobs should wait for the node.
+	nodeBusy func() bool
+
+	m    sync.Mutex
+	jobs map[string]*scheduledJob
+	// Heavy classes with a running job.
+	busy map[jobClass]bool
+	wg   sync.WaitGroup
+}
+
+var jobs = newJobScheduler()
+
+func newJobScheduler() *jobScheduler {
+	return &jobScheduler{
+		now:      clockNow,
+		rand:     rand.Float64,
+		nodeBusy: func() bool { return nodeThrottled(nano.PriorityBackground) },
+		jobs:     make(map[string]*scheduledJob),
+		busy:     make(map[jobClass]bool),
+	}
+}
+
+// jitter returns the random delay added to a run time of a job with interval d.
+func (s *jobScheduler) jitter(d time.Duration) time.Duration {
+	return time.Duration(s.rand() * float64(d) * float64(config.JobJitter) / 100)
+}
+
+// register adds the job with its saved state.
+func (s *jobScheduler) register(job Job) error {
+	var record jobRecord
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(jobsBucket))
+		if b == nil {
+			return nil
+		}
+		if value := b.Get([]byte(job.Name)); value != nil {
+			return json.Unmarshal(value, &record)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if job.Interval == 0 {
+		record.NextRunAt = nil
+	} else if record.NextRunAt == nil {
+		next := s.now().Add(s.jitter(job.Interval))
+		if !job.RunAtStart {
+			next = next.Add(job.Interval)
+		}
+		record.NextRunAt = &next
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.jobs[job.Name] = &scheduledJob{Job: job, jobRecord: record}
+	return nil
+}
+
+// save writes the state of j to database. Must be called with s.m held.
+func (s *jobScheduler) save(j *scheduledJob) {
+	value, err := json.Marshal(j.jobRecord)
+	if err == nil {
+		err = dbUpdate(func(tx *bbolt.Tx) error {
+			b, err2 := tx.CreateBucketIfNotExists([]byte(jobsBucket))
+			if err2 != nil {
+				return err2
+			}
+			return b.Put([]byte(j.Name), value)
+		})
+	}
+	if err != nil {
+		log.Errorf("cannot save state of job %s: %s", j.Name, err)
+	}
+}
+
+func (s *jobScheduler) names() []string {
+	names := make([]string, 0, len(s.jobs))
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tick starts the jobs that are due and can run now.
+func (s *jobScheduler) tick() {
+	now := s.now()
+	inMaintenance := maintenance.window(now) != nil
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, name := range s.names() {
+		j := s.jobs[name]
+		if j.running || (j.Paused && !j.triggered) || j.NextRunAt == nil || now.Before(*j.NextRunAt) {
+			continue
+		}
+		var waiting string
+		switch {
+		case j.Deferrable && inMaintenance && !j.triggered:
+			waiting = jobWaitingMaintenance
+		case j.Class != jobClassCheap && s.busy[j.Class]:
+			waiting = jobWaitingClass
+		case j.Class == jobClassNode && s.nodeBusy():
+			waiting = jobWaitingNode
+		}
+		if waiting == jobWaitingMaintenance && j.waiting != waiting {
+			log.Noticef("%s is deferred until the end of maintenance window", j.Name)
+		}
+		j.waiting = waiting
+		if waiting == "" {
+			s.start(j, now)
+		}
+	}
+}
+
+// start runs j in background. Must be called with s.m held.
+func (s *jobScheduler) start(j *scheduledJob, now time.Time) {
+	j.running = true
+	if j.Class != jobClassCheap {
+		s.busy[j.Class] = true
+	}
+	run := JobRun{StartedAt: now, Triggered: j.triggered}
+	j.triggered = false
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := j.Run()
+		s.finish(j, run, err)
+	}()
+}
+
+func (s *jobScheduler) finish(j *scheduledJob, run JobRun, err error) {
+	now := s.now()
+	run.Duration = now.Sub(run.StartedAt).Seconds()
+	if err != nil {
+		log.Errorf("job %s failed: %s", j.Name, err)
+		run.Error = err.Error()
+	} else {
+		log.Debugf("job %s completed in %.3f seconds", j.Name, run.Duration)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	j.running = false
+	delete(s.busy, j.Class)
+	j.Runs++
+	if err != nil {
+		j.Failures++
+	}
+	j.History = append(j.History, run)
+	if len(j.History) > maxJobHistory {
+		j.History = j.History[len(j.History)-maxJobHistory:]
+	}
+	// A job triggered while it was running runs again.
+	if j.Interval > 0 && !j.triggered {
+		next := now.Add(j.Interval + s.jitter(j.Interval))
+		j.NextRunAt = &next
+	} else if !j.triggered {
+		j.NextRunAt = nil
+	}
+	s.save(j)
+}
+
+// trigger makes the job due now. It is started on the next tick if its class allows.
+// Returns false if there is no such job.
+func (s *jobScheduler) trigger(name string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return false
+	}
+	now := s.now()
+	j.NextRunAt = &now
+	j.triggered = true
+	s.save(j)
+	return true
+}
+
+func (s *jobScheduler) setPaused(name string, paused bool) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return errUnknownJob
+	}
+	j.Paused = paused
+	s.save(j)
+	return nil
+}
+
+func (j *scheduledJob) status() JobStatus {
+	st := JobStatus{
+		Name:      j.Name,
+		Class:     j.Class,
+		Interval:  j.Interval.Seconds(),
+		Paused:    j.Paused,
+		Running:   j.running,
+		Waiting:   j.waiting,
+		NextRunAt: j.NextRunAt,
+		Runs:      j.Runs,
+		Failures:  j.Failures,
+	}
+	if len(j.History) > 0 {
+		last := j.History[len(j.History)-1]
+		st.LastRun = &last
+	}
+	return st
+}
+
+func (s *jobScheduler) statuses() []JobStatus {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ret := make([]JobStatus, 0, len(s.jobs))
+	for _, name := range s.names() {
+		ret = append(ret, s.jobs[name].status())
+	}
+	return ret
+}
+
+// inspect returns the status of the job with its recent runs.
+func (s *jobScheduler) inspect(name string) (JobStatus, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return JobStatus{}, errUnknownJob
+	}
+	st := j.status()
+	st.History = append([]JobRun{}, j.History...)
+	return st, nil
+}
+
+// backgroundJobs returns the jobs enabled in config.
+func backgroundJobs() []Job {
+	var dbAlerted bool
+	list := []Job{
+		{Name: jobDatabaseSize, Class: jobClassCheap, Interval: databaseCheckInterval, Run: func() error {
+			dbAlerted = checkDatabaseSize(dbAlerted)
+			return nil
+		}},
+		{Name: jobWatchdog, Class: jobClassCheap, Interval: time.Duration(config.WatchdogInterval) * time.Second, Run: func() error {
+			cancelStuckChecks(clock.Now())
+			return nil
+		}},
+		{Name: jobSweepSubscriptions, Class: jobClassCheap, Interval: time.Duration(config.SubscriptionSweepInterval) * time.Second, Deferrable: true, Run: func() error {
+			reapOrphanSubscriptions(clock.Now(), time.Duration(config.SubscriptionSweepInterval)*time.Second)
+			return nil
+		}},
+		{Name: jobIdempotencyKeys, Class: jobClassStore, Interval: time.Hour, Run: func() error {
+			count, err := deleteExpiredIdempotencyKeys(clock.Now())
+			if count > 0 {
+				log.Debugf("deleted %d expired idempotency keys", count)
+			}
+			return err
+		}},
+		{Name: jobNodeVersion, Class: jobClassCheap, Interval: time.Duration(config.NodeVersionRefreshInterval) * time.Second, RunAtStart: true, Run: refreshNodeVersion},
+		// Checks all active accounts after the node websocket reconnects.
+		{Name: jobReconcile, Class: jobClassNode, Run: func() error {
+			reconcile(activeAccounts())
+			return nil
+		}},
+	}
+	if config.CompactionInterval > 0 {
+		list = append(list, Job{Name: jobCompaction, Class: jobClassStore, Interval: time.Duration(config.CompactionInterval) * time.Second, Deferrable: true, Run: func() error {
+			_, err := compactDB()
+			return err
+		}})
+	}
+	if config.ObjectStorageExportInterval > 0 {
+		list = append(list, Job{Name: jobExport, Class: jobClassStore, Interval: time.Duration(config.ObjectStorageExportInterval) * time.Second, Deferrable: true, Run: exportToObjectStorage})
+	}
+	if config.SLANoVerificationMinutes > 0 || config.SLAMaxMedianLatency > 0 || config.SLANodeUnreachableSeconds > 0 {
+		list = append(list, Job{Name: jobSLA, Class: jobClassCheap, Interval: time.Duration(config.SLAEvaluationInterval) * time.Second, Run: func() error {
+			slaAlerts.evaluate()
+			return nil
+		}})
+	}
+	if anomalies.enabled() {
+		list = append(list, Job{Name: jobAnomalies, Class: jobClassCheap, Interval: anomalyInterval, Run: func() error {
+			anomalies.evaluate()
+			return nil
+		}})
+	}
+	if config.ExposureAlertThreshold != "" {
+		list = append(list, Job{Name: jobExposure, Class: jobClassStore, Interval: exposureCheckInterval, RunAtStart: true, Run: exposure.check})
+	}
+	if config.LeftoverSweepInterval > 0 && config.sweepEnabled() {
+		list = append(list, Job{Name: jobLeftoverSweep, Class: jobClassNode, Interval: time.Duration(config.LeftoverSweepInterval) * time.Second, Run: runScheduledLeftoverSweep})
+	}
+	if len(digestTargets()) > 0 {
+		list = append(list, Job{Name: jobDigest, Class: jobClassStore, Interval: time.Minute, Deferrable: true, Run: func() error {
+			sendDueDigests(clock.Now())
+			return nil
+		}})
+	}
+	if len(nodeURLs()) > 1 {
+		list = append(list, Job{Name: jobNodeProbe, Class: jobClassCheap, Interval: time.Duration(config.NodeProbeInterval) * time.Second, Run: func() error {
+			node.Probe()
+			return nil
+		}})
+	}
+	return list
+}
+
+// runJobScheduler registers the background jobs and runs them until shutdown.
+func runJobScheduler() {
+	for _, job := range backgroundJobs() {
+		if err := jobs.register(job); err != nil {
+			log.Errorf("cannot register job %s: %s", job.Name, err)
+		}
+	}
+	log.Debugln("starting job scheduler")
+	ticker := time.NewTicker(jobSchedulerTick)
+	defer ticker.Stop()
+	jobs.tick()
+	for {
+		select {
+		case <-ticker.C:
+			jobs.tick()
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+// handleAdminJobs lists the jobs on GET, or returns one job with its recent runs if name is given.
+// POST with name and action "trigger", "pause" or "resume" changes the job.
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			writeAdminJSON(w, map[string]interface{}{"jobs": jobs.statuses()})
+			return
+		}
+	case http.MethodPost:
+		var err error
+		switch action := r.FormValue("action"); action {
+		case "trigger":
+			if !jobs.trigger(name) {
+				err = errUnknownJob
+			}
+		case "pause", "resume":
+			err = jobs.setPaused(name, action == "pause")
+		default:
+			http.Error(w, "action must be trigger, pause or resume", http.StatusBadRequest)
+			return
+		}
+		if err == errUnknownJob {
+			http.Error(w, fmt.Sprintf("unknown job: %q", name), http.StatusNotFound)
+			return
+		}
+		log.Noticef("job %s: %s by %s", name, r.FormValue("action"), adminIdentity(r))
+	default:
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := jobs.inspect(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unknown job: %q", name), http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, status)
+}
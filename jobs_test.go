@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestJobScheduler(t *testing.T) (*jobScheduler, *fakeClock) {
+	t.Helper()
+	openTestDB(t, 0)
+	config.setDefaults()
+	c := useFakeClock(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := newJobScheduler()
+	s.rand = func() float64 { return 0.5 }
+	s.nodeBusy = func() bool { return false }
+	return s, c
+}
+
+func TestJobSchedulerNodeHeavyExclusion(t *testing.T) {
+	s, _ := newTestJobScheduler(t)
+	release := make(chan struct{})
+	ran := make(chan string, 10)
+	job := func(name string, class jobClass, wait bool) Job {
+		return Job{Name: name, Class: class, Interval: time.Hour, RunAtStart: true, Run: func() error {
+			ran <- name
+			if wait {
+				<-release
+			}
+			return nil
+		}}
+	}
+	for _, j := range []Job{job("a", jobClassNode, true), job("b", jobClassNode, false), job("c", jobClassCheap, false)} {
+		if err := s.register(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Run times are due after the jitter.
+	s.now = func() time.Time { return clock.Now().Add(time.Hour) }
+	s.tick()
+	first, second := <-ran, <-ran
+	if first+second != "ac" && first+second != "ca" {
+		t.Fatalf("unexpected jobs started: %s %s", first, second)
+	}
+	st, _ := s.inspect("b")
+	if st.Running || st.Waiting != jobWaitingClass {
+		t.Fatalf("second node-heavy job is not waiting: %+v", st)
+	}
+	s.tick()
+	if st, _ = s.inspect("b"); st.Running {
+		t.Fatal("node-heavy jobs run at the same time")
+	}
+	close(release)
+	s.wg.Wait()
+	s.tick()
+	if name := <-ran; name != "b" {
+		t.Fatalf("unexpected job started: %s", name)
+	}
+	s.wg.Wait()
+}
+
+func TestJobSchedulerJitter(t *testing.T) {
+	s, c := newTestJobScheduler(t)
+	config.JobJitter = 10
+	start := c.Now()
+	if err := s.register(Job{Name: "j", Class: jobClassCheap, Interval: 100 * time.Second, Run: func() error { return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := s.inspect("j")
+	if !st.NextRunAt.Equal(start.Add(105 * time.Second)) {
+		t.Fatalf("jitter is not added to first run: %s", st.NextRunAt)
+	}
+	c.Add(105 * time.Second)
+	s.tick()
+	s.wg.Wait()
+	st, _ = s.inspect("j")
+	if st.Runs != 1 || !st.NextRunAt.Equal(c.Now().Add(105*time.Second)) {
+		t.Fatalf("jitter is not added to next run: %+v", st)
+	}
+}
+
+func TestJobSchedulerPersistence(t *testing.T) {
+	s, c := newTestJobScheduler(t)
+	failing := Job{Name: "j", Class: jobClassStore, Interval: time.Hour, Run: func() error { return errUnknownJob }}
+	if err := s.register(failing); err != nil {
+		t.Fatal(err)
+	}
+	if !s.trigger("j") {
+		t.Fatal("job is not triggered")
+	}
+	s.tick()
+	s.wg.Wait()
+	if err := s.setPaused("j", true); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := s.inspect("j")
+
+	// Restarted later.
+	c.Add(time.Minute)
+	restarted := newJobScheduler()
+	if err := restarted.register(failing); err != nil {
+		t.Fatal(err)
+	}
+	after, err := restarted.inspect("j")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Paused || after.Runs != 1 || after.Failures != 1 || len(after.History) != 1 || !after.NextRunAt.Equal(*before.NextRunAt) {
+		t.Fatalf("job state is not restored: %+v", after)
+	}
+	if run := after.History[0]; !run.Triggered || run.Error != errUnknownJob.Error() {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	c.Add(2 * time.Hour)
+	restarted.tick()
+	if st, _ := restarted.inspect("j"); st.Running || st.Runs != 1 {
+		t.Fatal("paused job is run")
+	}
+}
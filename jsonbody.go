@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// Same limit as the form parsing in net/http.
+const maxJSONBodySize = 10 << 20
+
+// parseJSONBody fills the form of r from a JSON object body, so handlers can read it with r.FormValue.
+// Values must be strings or numbers. Numbers are kept as written, so amounts do not lose precision.
+// Metadata can be an object, it is kept as its JSON encoding.
+// Requests without JSON content type are not changed and their form is parsed as usual.
+func parseJSONBody(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" || r.Body == nil {
+		return nil
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxJSONBodySize))
+	dec.UseNumber()
+	var body map[string]interface{}
+	if err := dec.Decode(&body); err != nil {
+		return fmt.Errorf("invalid JSON body: %s", err)
+	}
+	if dec.More() {
+		return errors.New("invalid JSON body: unexpected data after object")
+	}
+	form := r.URL.Query()
+	postForm := make(url.Values, len(body))
+	for key, value := range body {
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case json.Number:
+			s = v.String()
+		case map[string]interface{}:
+			if key != "metadata" {
+				return fmt.Errorf("invalid JSON body: %q must be a string or number", key)
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("invalid JSON body: %s", err)
+			}
+			s = string(b)
+		case nil:
+			continue
+		default:
+			return fmt.Errorf("invalid JSON body: %q must be a string or number", key)
+		}
+		form.Set(key, s)
+		postForm[key] = []string{s}
+	}
+	r.Form, r.PostForm = form, postForm
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONBody(t *testing.T) {
+	newRequest := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay?currency=USD", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json; charset=utf-8")
+		return r
+	}
+	r := newRequest(`{"amount": 0.100000000000000000000000000001, "state": "s", "token": null}`)
+	if err := parseJSONBody(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.FormValue("amount") != "0.100000000000000000000000000001" || r.FormValue("state") != "s" || r.FormValue("currency") != "USD" || r.FormValue("token") != "" {
+		t.Fatalf("unexpected form: %v", r.Form)
+	}
+	for _, body := range []string{`{"amount": "1"`, `["1"]`, `{"amount": {"value": 1}}`, `{} {}`} {
+		if err := parseJSONBody(newRequest(body)); err == nil {
+			t.Errorf("invalid body accepted: %s", body)
+		}
+	}
+
+	// Form bodies are left to the usual parsing.
+	r = httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader("amount=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := parseJSONBody(r); err != nil || r.Form != nil || r.FormValue("amount") != "1" {
+		t.Fatalf("form body is changed: %v %v", r.Form, err)
+	}
+}
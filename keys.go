@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/dgrijalva/jwt-go"
+	"go.etcd.io/bbolt"
+)
+
+// Tokens are signed with HS256 using the seed until an admin rotates keys via POST /admin/keys/rotate.
+// Each rotation generates an ES256 key that is published at /api/keys immediately
+// and used for signing after KeyRotationOverlap, so verifiers can fetch it in advance.
+// The previous key is kept in /api/keys until all tokens signed with it are expired.
+
+const signingKeysBucket = "signing_keys"
+
+var errRotationInProgress = errors.New("next key is not active yet")
+
+func init() {
+	// Token expiry is checked with the same clock as deadlines.
+	jwt.TimeFunc = clockNow
+}
+
+// SigningKey is a P-256 key for signing tokens.
+type SigningKey struct {
+	KID string `json:"kid"`
+	// PKCS #8 encoded private key.
+	PrivateKey []byte    `json:"privateKey"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Tokens are signed with the key starting from this time.
+	ActiveAt time.Time `json:"activeAt"`
+	// Set when the next key is generated. Key is not accepted after this time.
+	RetireAt *time.Time `json:"retireAt,omitempty"`
+
+	private *ecdsa.PrivateKey
+}
+
+func (k *SigningKey) retired(now time.Time) bool {
+	return k.RetireAt != nil && !now.Before(*k.RetireAt)
+}
+
+// keyring holds the signing keys sorted by ActiveAt.
+type keyring struct {
+	mu   sync.RWMutex
+	keys []*SigningKey
+}
+
+var tokenKeys = &keyring{}
+
+// signingKey returns the key that tokens are signed with at now. Nil if the seed is used.
+func (r *keyring) signingKey(now time.Time) *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		k := r.keys[i]
+		if !k.ActiveAt.After(now) && !k.retired(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// verificationKey returns the key with kid if it is not retired at now.
+func (r *keyring) verificationKey(kid string, now time.Time) *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range r.keys {
+		if k.KID == kid && !k.retired(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// published returns the keys that are not retired at now, including the next key.
+func (r *keyring) published(now time.Time) []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]*SigningKey, 0, len(r.keys))
+	for _, k := range r.keys {
+		if !k.retired(now) {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+func (r *keyring) set(keys []*SigningKey) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ActiveAt.Before(keys[j].ActiveAt) })
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+}
+
+// loadSigningKeys reads the keys from database into tokenKeys.
+func loadSigningKeys() error {
+	var keys []*SigningKey
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(signingKeysBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var key SigningKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			private, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			key.private, ok = private.(*ecdsa.PrivateKey)
+			if !ok {
+				return errors.New("signing key is not an ECDSA key")
+			}
+			keys = append(keys, &key)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	tokenKeys.set(keys)
+	return nil
+}
+
+// rotateSigningKeys generates the next key that becomes active after KeyRotationOverlap.
+// The current latest key is retired after the tokens that it signs until then are expired.
+// Keys that are already retired are removed.
+func rotateSigningKeys(now time.Time) (*SigningKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	kid := make([]byte, 8)
+	if _, err = rand.Read(kid); err != nil {
+		return nil, err
+	}
+	next := &SigningKey{
+		KID:        hex.EncodeToString(kid),
+		PrivateKey: der,
+		CreatedAt:  now,
+		ActiveAt:   now.Add(time.Duration(config.KeyRotationOverlap) * time.Second),
+		private:    private,
+	}
+	tokenKeys.mu.RLock()
+	keys := append([]*SigningKey(nil), tokenKeys.keys...)
+	tokenKeys.mu.RUnlock()
+	if len(keys) > 0 && keys[len(keys)-1].ActiveAt.After(now) {
+		return nil, errRotationInProgress
+	}
+	err = dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(signingKeysBucket))
+		if err != nil {
+			return err
+		}
+		put := func(k *SigningKey) error {
+			value, err := json.Marshal(k)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(k.KID), value)
+		}
+		kept := keys[:0]
+		for _, k := range keys {
+			if k.retired(now) {
+				if err = b.Delete([]byte(k.KID)); err != nil {
+					return err
+				}
+				continue
+			}
+			kept = append(kept, k)
+		}
+		keys = kept
+		if len(keys) > 0 {
+			// Copy so that the key in tokenKeys is not modified before the transaction commits.
+			last := *keys[len(keys)-1]
+			retireAt := next.ActiveAt.Add(time.Duration(config.TokenLifetime) * time.Second)
+			last.RetireAt = &retireAt
+			if err = put(&last); err != nil {
+				return err
+			}
+			keys[len(keys)-1] = &last
+		}
+		return put(next)
+	})
+	if err != nil {
+		return nil, err
+	}
+	tokenKeys.set(append(keys, next))
+	return next, nil
+}
+
+// JWK is the public part of a signing key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	KID string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// Tokens are signed with the key starting from this time (unix seconds).
+	NotBefore int64 `json:"nbf"`
+	// Key is not accepted after this time (unix seconds). Omitted for the current key.
+	Expires int64 `json:"exp,omitempty"`
+}
+
+func (k *SigningKey) jwk() JWK {
+	const coordinateSize = 32
+	coordinate := func(b []byte) string {
+		padded := make([]byte, coordinateSize)
+		copy(padded[coordinateSize-len(b):], b)
+		return base64.RawURLEncoding.EncodeToString(padded)
+	}
+	j := JWK{
+		Kty:       "EC",
+		Crv:       "P-256",
+		X:         coordinate(k.private.X.Bytes()),
+		Y:         coordinate(k.private.Y.Bytes()),
+		KID:       k.KID,
+		Alg:       "ES256",
+		Use:       "sig",
+		NotBefore: k.ActiveAt.Unix(),
+	}
+	if k.RetireAt != nil {
+		j.Expires = k.RetireAt.Unix()
+	}
+	return j
+}
+
+// JWKS is the document served at /api/keys.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func handleKeys(w http.ResponseWriter, r *http.Request) {
+	keys := tokenKeys.published(clock.Now())
+	doc := JWKS{Keys: make([]JWK, len(keys))}
+	for i, k := range keys {
+		doc.Keys[i] = k.jwk()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err := json.NewEncoder(w).Encode(doc)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+func handleAdminRotateKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := rotateSigningKeys(clock.Now())
+	if err == errRotationInProgress {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Noticeln("signing key rotated by", adminIdentity(r)+":", key.KID)
+	writeAdminJSON(w, key.jwk())
+}
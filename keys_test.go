@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSigningKeyRotation(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	t.Cleanup(func() { tokenKeys.set(nil) })
+	c := useFakeClock(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	overlap := time.Duration(config.KeyRotationOverlap) * time.Second
+	lifetime := time.Duration(config.TokenLifetime) * time.Second
+
+	sign := func() string {
+		token, err := NewToken("1", "nano_1test", "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := func(token string) bool {
+		_, err := ParseToken(token)
+		return err == nil
+	}
+	published := func() map[string]JWK {
+		w := httptest.NewRecorder()
+		handleKeys(w, httptest.NewRequest("GET", "/api/keys", nil))
+		var doc JWKS
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		keys := make(map[string]JWK)
+		for _, k := range doc.Keys {
+			keys[k.KID] = k
+		}
+		return keys
+	}
+	rotate := func() *SigningKey {
+		key, err := rotateSigningKeys(clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	seedToken := sign()
+	first := rotate()
+	if k, ok := published()[first.KID]; !ok || k.NotBefore != clock.Now().Add(overlap).Unix() {
+		t.Fatalf("next key is not published: %+v", published())
+	}
+	if _, err := rotateSigningKeys(clock.Now()); err != errRotationInProgress {
+		t.Fatalf("rotated during overlap: %v", err)
+	}
+	// Seed is used until the first key is active.
+	duringOverlap := sign()
+	c.Add(overlap)
+	firstToken := sign()
+	if !valid(seedToken) || !valid(duringOverlap) || !valid(firstToken) || duringOverlap == firstToken {
+		t.Fatal("tokens are not valid after first key is active")
+	}
+
+	second := rotate()
+	c.Add(overlap / 2)
+	firstDuringOverlap := sign()
+	if len(published()) != 2 || !valid(firstDuringOverlap) {
+		t.Fatal("both keys must be published during overlap")
+	}
+	c.Add(overlap / 2)
+	secondToken := sign()
+	if !valid(firstDuringOverlap) || !valid(secondToken) || tokenKeys.signingKey(clock.Now()).KID != second.KID {
+		t.Fatal("tokens are not valid after second key is active")
+	}
+	if published()[first.KID].Expires != clock.Now().Add(lifetime).Unix() {
+		t.Fatalf("first key retire time is not published: %+v", published())
+	}
+
+	// Persisted state survives restart.
+	if err := loadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	c.Add(lifetime)
+	if _, ok := published()[first.KID]; ok || valid(firstDuringOverlap) {
+		t.Fatal("first key is not retired")
+	}
+	if !valid(seedToken) {
+		t.Fatal("token signed with seed is rejected")
+	}
+	c.Add(time.Second)
+	if valid(secondToken) {
+		t.Fatal("expired token accepted")
+	}
+	if !valid(sign()) {
+		t.Fatal("new token is not valid")
+	}
+}
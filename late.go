@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Funds may arrive long after a payment is expired, e.g. when an exchange processes a withdrawal late.
+// If LatePaymentWindow is set, such payments are held in late_paid state and the merchant is notified
+// with a "late_paid" event. An admin resolves them via POST /admin/resolve-late, either fulfilling the payment
+// as if it was verified in time or refunding the funds to the customer.
+// Funds arriving after LatePaymentWindow are left in the account and reported as orphan funds.
+
+// Dispositions of a late payment.
+const (
+	lateDispositionFulfill = "fulfill"
+	lateDispositionRefund  = "refund"
+)
+
+// Event type of the notification sent for late payments.
+const notificationEventLatePaid = "late_paid"
+
+var (
+	errPaymentLate    = errors.New("payment is waiting for late funds to be resolved")
+	errOrphanFunds    = errors.New("funds arrived after late payment window")
+	errRefundAccount  = errors.New("refund_account is required when funds are sent from multiple accounts")
+	errPaymentNotLate = errors.New("payment has no unresolved late funds")
+)
+
+var metricLatePayments = expvar.NewMap("late_payments_total")
+
+// LatePayment records funds that arrived after the payment is expired.
+type LatePayment struct {
+	DetectedAt time.Time `json:"detectedAt"`
+	// Balance of the account when late funds are detected, in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Set when the merchant is notified about late funds.
+	NotifiedAt *time.Time `json:"notifiedAt"`
+	// Set when admin resolves the late payment.
+	ResolvedAt  *time.Time `json:"resolvedAt"`
+	ResolvedBy  string     `json:"resolvedBy,omitempty"`
+	Disposition string     `json:"disposition,omitempty"`
+	// Funds are sent back to this account if disposition is refund.
+	RefundAccount string     `json:"refundAccount,omitempty"`
+	RefundHash    string     `json:"refundHash,omitempty"`
+	RefundedAt    *time.Time `json:"refundedAt"`
+}
+
+// unresolved returns true if late funds are waiting for admin decision.
+func (l *LatePayment) unresolved() bool {
+	return l != nil && l.ResolvedAt == nil
+}
+
+// refunding returns true if funds are to be refunded but not sent yet.
+func (l *LatePayment) refunding() bool {
+	return l != nil && l.Disposition == lateDispositionRefund && l.RefundedAt == nil
+}
+
+func (l *LatePayment) refunded() bool {
+	return l != nil && l.RefundedAt != nil
+}
+
+// PaymentLate is published when late funds are detected.
+type PaymentLate struct {
+	Payment
+}
+
+func (p PaymentLate) Account() Account {
+	return Account(p.Payment.Account)
+}
+
+// expiresAt returns the time that customer has to send the funds until.
+func (p Payment) expiresAt() time.Time {
+	return p.CreatedAt.Add(p.allowedDuration())
+}
+
+// hasLateFunds returns true if funds are found on an expired payment that was never fulfilled.
+func (p Payment) hasLateFunds() bool {
+	return config.LatePaymentWindow > 0 && p.FulfilledAt == nil && p.Late == nil && p.Expiry == nil &&
+		p.Balance.IsPositive() && now().After(p.expiresAt()) && !p.awaitingConfirmation()
+}
+
+// awaitingLateFunds returns true if the payment expired without funds and late funds arriving now would be held.
+// Such payments are checked until the end of LatePaymentWindow, so their accounts stay in the confirmation subscription.
+func (p Payment) awaitingLateFunds() bool {
+	if config.LatePaymentWindow <= 0 || p.FulfilledAt != nil || p.Late != nil || p.Expiry != nil || p.CancelledAt != nil || p.Imported {
+		return false
+	}
+	return now().Before(p.expiresAt().Add(time.Duration(config.LatePaymentWindow) * time.Second))
+}
+
+// markLate moves the payment to late_paid state if funds arrived within LatePaymentWindow after expiry.
+func (p *Payment) markLate() error {
+	late := now().Sub(p.expiresAt())
+	if late > time.Duration(config.LatePaymentWindow)*time.Second {
+		metricLatePayments.Add("orphaned", 1)
+		sendAlert("orphan_funds", "funds arrived to expired payment "+p.Account+" after "+late.Round(time.Second).String(), map[string]interface{}{
+			"account":   p.Account,
+			"paymentId": p.PaymentID,
+			"balance":   RawToNano(p.Balance).String(),
+		})
+		return errOrphanFunds
+	}
+	p.Late = &LatePayment{DetectedAt: *now(), Amount: p.Balance}
+	err := p.Save()
+	if err != nil {
+		return err
+	}
+	metricLatePayments.Add("detected", 1)
+	sendAlert("late_payment", "late funds arrived to payment "+p.Account, map[string]interface{}{
+		"account":   p.Account,
+		"paymentId": p.PaymentID,
+		"balance":   RawToNano(p.Balance).String(),
+	})
+	go verifications.Publish(PaymentLate{Payment: *p})
+	return nil
+}
+
+// notifyLate sends the late_paid notification to the merchant if it is not sent yet.
+func (p *Payment) notifyLate() error {
+	if p.Late.NotifiedAt != nil {
+		return nil
+	}
+	n := p.notification()
+	n.Event = notificationEventLatePaid
+	err := p.postNotification(n)
+	if err != nil {
+		return err
+	}
+	p.Late.NotifiedAt = now()
+	return p.Save()
+}
+
+// refundLate receives the late funds and sends the whole balance to the refund account.
+func (p *Payment) refundLate() error {
+	return p.refund(p.Late.RefundAccount, func() bool { return p.Late.refunded() }, func(hash string) { p.Late.RefundHash = hash })
+}
+
+// refund receives pending funds and sends the whole balance to account.
+// refunded and record are called with the payment reloaded under the money lock.
+func (p *Payment) refund(account string, refunded func() bool, record func(hash string)) error {
+	err := p.receivePending()
+	if err != nil {
+		return err
+	}
+	key, err := p.deriveKey()
+	if err != nil {
+		return err
+	}
+	return withMoneyLock(p.Account, func(lease Lease) error {
+		err := p.reload()
+		if err != nil {
+			return err
+		}
+		if refunded() {
+			return nil
+		}
+		hash, err := sendAll(lease, p.Account, account, key.Private)
+		if err != nil {
+			return err
+		}
+		record(hash)
+		p.stampOperation(operationRefund)
+		return nil
+	})
+}
+
+// refundAccount returns the account that sent the funds if all blocks are sent from the same account.
+func (p Payment) refundAccount() string {
+	var account string
+	for _, sp := range p.SubPayments {
+		if account != "" && sp.Account != account {
+			return ""
+		}
+		account = sp.Account
+	}
+	return account
+}
+
+func handleAdminResolveLate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	disposition := r.FormValue("disposition")
+	if disposition != lateDispositionFulfill && disposition != lateDispositionRefund {
+		http.Error(w, "disposition must be fulfill or refund", http.StatusBadRequest)
+		return
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !payment.Late.unresolved() {
+		http.Error(w, errPaymentNotLate.Error(), http.StatusConflict)
+		return
+	}
+	switch disposition {
+	case lateDispositionFulfill:
+		payment.SatisfiedBy, err = payment.satisfiedBy()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		payment.FulfilledAt = now()
+	case lateDispositionRefund:
+		refundAccount := r.FormValue("refund_account")
+		if refundAccount != "" && !accountRegexp.MatchString(refundAccount) {
+			http.Error(w, "invalid refund_account", http.StatusBadRequest)
+			return
+		}
+		if refundAccount == "" {
+			refundAccount = payment.refundAccount()
+		}
+		if refundAccount == "" {
+			http.Error(w, errRefundAccount.Error(), http.StatusBadRequest)
+			return
+		}
+		payment.Late.RefundAccount = refundAccount
+	}
+	if !requireOwnership(w, r, "resolve-late "+disposition, payment) {
+		return
+	}
+	payment.Late.ResolvedAt = now()
+	payment.Late.ResolvedBy = adminIdentity(r)
+	payment.Late.Disposition = disposition
+	err = payment.Save()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metricLatePayments.Add(disposition, 1)
+	log.Noticef("late payment %s resolved by %s: %s", payment.Account, payment.Late.ResolvedBy, disposition)
+	if disposition == lateDispositionFulfill {
+		go verifications.Publish(PaymentVerified{Payment: *payment})
+	}
+	// Expired payments are not checked periodically, so the remaining steps are run here.
+	// Failed steps are retried with /admin/advance.
+	err = payment.check()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, payment)
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// fakeLedger is a node that keeps balances and pending blocks and applies published blocks.
+type fakeLedger struct {
+	mu       sync.Mutex
+	balances map[string]decimal.Decimal
+	frontier map[string]string
+	pending  map[string]map[string]nano.PendingBlock
+	// Published blocks by hash.
+	blocks map[string]bool
+	// Ledger info of receive and pending send blocks returned from blocks_info.
+	infos map[string]nano.BlockInfo
+	// Blocks sent with the send action by id.
+	sends map[string]string
+	// Number of accepted process requests.
+	published int
+	// Faults to inject in the next requests by action.
+	faults map[string][]string
+	// Keys returned by deterministic_key by index.
+	keys map[string]nano.Key
+}
+
+// Faults of fakeLedger.
+const (
+	// Block is applied but the connection is dropped before the response.
+	faultAcceptDrop = "accept_drop"
+	// Connection is dropped without applying the block.
+	faultDrop = "drop"
+	// Block is rejected as a fork.
+	faultReject = "reject"
+)
+
+func randomHash() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func fakeLedgerNode(t *testing.T) *fakeLedger {
+	l := &fakeLedger{
+		balances: make(map[string]decimal.Decimal),
+		frontier: make(map[string]string),
+		pending:  make(map[string]map[string]nano.PendingBlock),
+		blocks:   make(map[string]bool),
+		infos:    make(map[string]nano.BlockInfo),
+		sends:    make(map[string]string),
+		faults:   make(map[string][]string),
+		keys:     make(map[string]nano.Key),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action   string   `json:"action"`
+			Account  string   `json:"account"`
+			Previous string   `json:"previous"`
+			Balance  string   `json:"balance"`
+			Link     string   `json:"link"`
+			Block    string   `json:"block"`
+			Hashes   []string `json:"hashes"`
+			Accounts []string `json:"accounts"`
+			Index    string   `json:"index"`
+			// Pending blocks that are not confirmed are returned only if it is "false".
+			IncludeOnlyConfirmed string `json:"include_only_confirmed"`
+			// Fields of the send action.
+			Wallet      string `json:"wallet"`
+			Source      string `json:"source"`
+			Destination string `json:"destination"`
+			Amount      string `json:"amount"`
+			ID          string `json:"id"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		enc := json.NewEncoder(w)
+		var fault string
+		if faults := l.faults[req.Action]; len(faults) > 0 {
+			fault, l.faults[req.Action] = faults[0], faults[1:]
+		}
+		if fault == faultDrop {
+			panic(http.ErrAbortHandler)
+		}
+		switch req.Action {
+		case "deterministic_key":
+			key, ok := l.keys[req.Index]
+			if !ok {
+				key.Private = "PRIV"
+			}
+			_ = enc.Encode(key)
+		case "account_info":
+			frontier, ok := l.frontier[req.Account]
+			if !ok {
+				_ = enc.Encode(map[string]string{"error": "Account not found"})
+				return
+			}
+			_ = enc.Encode(nano.AccountInfo{Frontier: frontier, Balance: l.balances[req.Account].String()})
+		case "pending":
+			if len(l.pending[req.Account]) == 0 {
+				_ = enc.Encode(map[string]string{"blocks": ""})
+				return
+			}
+			blocks := make(map[string]nano.PendingBlock)
+			for hash, b := range l.pending[req.Account] {
+				if req.IncludeOnlyConfirmed == "false" || l.infos[hash].Confirmed == "true" {
+					blocks[hash] = b
+				}
+			}
+			if len(blocks) == 0 {
+				_ = enc.Encode(map[string]string{"blocks": ""})
+				return
+			}
+			_ = enc.Encode(map[string]interface{}{"blocks": blocks})
+		case "accounts_balances":
+			balances := make(map[string]nano.AccountBalance)
+			for _, account := range req.Accounts {
+				pending := decimal.Zero
+				for _, b := range l.pending[account] {
+					pending = pending.Add(decimal.RequireFromString(b.Amount))
+				}
+				balances[account] = nano.AccountBalance{Balance: l.balances[account].String(), Pending: pending.String()}
+			}
+			_ = enc.Encode(map[string]interface{}{"balances": balances})
+		case "block_create":
+			block, _ := json.Marshal(req)
+			sum := sha256.Sum256(block)
+			_ = enc.Encode(map[string]string{"hash": hex.EncodeToString(sum[:]), "block": string(block)})
+		case "blocks_info":
+			blocks := make(map[string]nano.BlockInfo)
+			for _, hash := range req.Hashes {
+				if info, ok := l.infos[hash]; ok {
+					blocks[hash] = info
+				} else if l.blocks[hash] {
+					blocks[hash] = nano.BlockInfo{}
+				}
+			}
+			_ = enc.Encode(map[string]interface{}{"blocks": blocks})
+		case "process":
+			sum := sha256.Sum256([]byte(req.Block))
+			hash := hex.EncodeToString(sum[:])
+			_ = json.Unmarshal([]byte(req.Block), &req)
+			frontier, ok := l.frontier[req.Account]
+			if !ok {
+				frontier = "00000000000000000000000000000000"
+			}
+			switch {
+			case l.blocks[hash]:
+				_ = enc.Encode(map[string]string{"error": "Old block"})
+				return
+			case fault == faultReject, req.Previous != frontier:
+				_ = enc.Encode(map[string]string{"error": "Fork"})
+				return
+			}
+			balance := decimal.RequireFromString(req.Balance)
+			old := l.balances[req.Account]
+			if balance.GreaterThan(old) {
+				delete(l.pending[req.Account], req.Link)
+				var info nano.BlockInfo
+				info.BlockAccount = req.Account
+				info.Contents.Link = req.Link
+				l.infos[hash] = info
+			} else {
+				l.addPending(req.Link, req.Account, old.Sub(balance))
+			}
+			l.blocks[hash] = true
+			l.published++
+			l.balances[req.Account] = balance
+			l.frontier[req.Account] = hash
+			if fault == faultAcceptDrop {
+				panic(http.ErrAbortHandler)
+			}
+			_ = enc.Encode(map[string]string{"hash": hash})
+		case "send":
+			hash, ok := l.sends[req.ID]
+			if !ok {
+				amount := decimal.RequireFromString(req.Amount)
+				if req.Wallet == "" || l.balances[req.Source].LessThan(amount) {
+					_ = enc.Encode(map[string]string{"error": "Insufficient balance"})
+					return
+				}
+				l.balances[req.Source] = l.balances[req.Source].Sub(amount)
+				l.addPending(req.Destination, req.Source, amount)
+				hash = randomHash()
+				l.sends[req.ID] = hash
+			}
+			_ = enc.Encode(map[string]string{"block": hash})
+		default:
+			_ = enc.Encode(map[string]string{"error": "unexpected action"})
+		}
+	}))
+	t.Cleanup(ts.Close)
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+	return l
+}
+
+func (l *fakeLedger) addPending(account, source string, amount decimal.Decimal) string {
+	if l.pending[account] == nil {
+		l.pending[account] = make(map[string]nano.PendingBlock)
+	}
+	hash := randomHash()
+	l.pending[account][hash] = nano.PendingBlock{Amount: amount.String(), Source: source}
+	l.infos[hash] = nano.BlockInfo{BlockAccount: source, Confirmed: "true"}
+	return hash
+}
+
+func (l *fakeLedger) send(from, to string, amount decimal.Decimal) {
+	l.mu.Lock()
+	l.addPending(to, from, amount)
+	l.mu.Unlock()
+}
+
+// sendUnconfirmed adds a pending block that the network has not confirmed yet and returns its hash.
+func (l *fakeLedger) sendUnconfirmed(from, to string, amount decimal.Decimal) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hash := l.addPending(to, from, amount)
+	info := l.infos[hash]
+	info.Confirmed = "false"
+	l.infos[hash] = info
+	return hash
+}
+
+// confirm marks a pending block confirmed.
+func (l *fakeLedger) confirm(hash string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info := l.infos[hash]
+	info.Confirmed = "true"
+	l.infos[hash] = info
+}
+
+// rollback drops a pending block of account, like a node does when the block loses a fork.
+func (l *fakeLedger) rollback(account, hash string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending[account], hash)
+	delete(l.infos, hash)
+}
+
+// own makes the account of p derivable at its index, so admin operations pass the ownership check.
+func (l *fakeLedger) own(p *Payment) {
+	if p.Index == "" {
+		p.Index = p.Account
+	}
+	if p.PublicKey == "" {
+		p.PublicKey = randomHash()
+	}
+	l.mu.Lock()
+	l.keys[p.Index] = nano.Key{Private: "PRIV", Public: p.PublicKey, Account: p.Account}
+	l.mu.Unlock()
+}
+
+// received returns the funds sent to account, including pending.
+func (l *fakeLedger) received(account string) decimal.Decimal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := l.balances[account]
+	for _, b := range l.pending[account] {
+		total = total.Add(decimal.RequireFromString(b.Amount))
+	}
+	return total
+}
+
+func TestLatePayment(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	config.LatePaymentWindow = 90 * 24 * 3600
+	var mu sync.Mutex
+	var events []string
+	notifications := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		_ = json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		events = append(events, n.Account+":"+n.Event)
+		mu.Unlock()
+	}))
+	t.Cleanup(notifications.Close)
+	config.NotificationURL = notifications.URL
+	t.Cleanup(func() {
+		config.LatePaymentWindow = 0
+		config.NotificationURL = ""
+		config.Account = ""
+	})
+	amount := NanoToRaw(decimal.New(1, 0))
+	newPayment := func(account string) *Payment {
+		p := &Payment{Account: account, PublicKey: randomHash(), Amount: amount, CreatedAt: clock.Now()}
+		ledger.own(p)
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	fulfill := newPayment("nano_1fulfill")
+	refund := newPayment("nano_1refund")
+	orphan := newPayment("nano_1orphan")
+
+	// Funds arrive a month after expiry.
+	c.Add(30 * 24 * time.Hour)
+	for _, p := range []*Payment{fulfill, refund} {
+		ledger.send("nano_1customer", p.Account, amount)
+		if err := p.check(); err != nil {
+			t.Fatal(err)
+		}
+		if p.nextStep() != stepAwaitLate || !p.Late.Amount.Equal(amount) || p.Late.NotifiedAt == nil || p.FulfilledAt != nil {
+			t.Fatalf("payment is not late: %+v", p)
+		}
+		if !NewResponse(p, "").LatePaid {
+			t.Fatal("late payment is not shown in response")
+		}
+	}
+	mu.Lock()
+	if len(events) != 2 || events[0] != "nano_1fulfill:late_paid" {
+		t.Fatalf("unexpected notifications: %v", events)
+	}
+	mu.Unlock()
+
+	w := postAdminForm(handleAdminResolveLate, url.Values{"account": {orphan.Account}, "disposition": {"fulfill"}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("payment without late funds is resolved: %d", w.Code)
+	}
+
+	w = postAdminForm(handleAdminResolveLate, url.Values{"account": {fulfill.Account}, "disposition": {"fulfill"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot fulfill: %d %s", w.Code, w.Body)
+	}
+	p, _ := LoadPayment([]byte(fulfill.Account))
+	if p.FulfilledAt == nil || p.NotifiedAt == nil || p.SentAt == nil || len(p.SatisfiedBy) != 1 {
+		t.Fatalf("payment is not fulfilled: %+v", p)
+	}
+	if !ledger.received(config.Account).Equal(amount) {
+		t.Fatalf("merchant received %s", ledger.received(config.Account))
+	}
+	mu.Lock()
+	if len(events) != 4 || events[2] != "nano_1fulfill:" || events[3] != "nano_1fulfill:final" {
+		t.Fatalf("verified and final notifications are not sent: %v", events)
+	}
+	mu.Unlock()
+
+	w = postAdminForm(handleAdminResolveLate, url.Values{"account": {refund.Account}, "disposition": {"refund"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot refund: %d %s", w.Code, w.Body)
+	}
+	p, _ = LoadPayment([]byte(refund.Account))
+	if p.Late.RefundedAt == nil || p.Late.RefundAccount != "nano_1customer" || p.nextStep() != stepNone || p.SentAt != nil {
+		t.Fatalf("payment is not refunded: %+v", p.Late)
+	}
+	if !ledger.received("nano_1customer").Equal(amount) || !ledger.received(config.Account).Equal(amount) {
+		t.Fatal("refund is not sent to customer")
+	}
+	mu.Lock()
+	if len(events) != 5 || events[4] != "nano_1refund:final" {
+		t.Fatalf("final notification is not sent: %v", events)
+	}
+	mu.Unlock()
+
+	// Funds arriving after the window are left in the account.
+	c.Add(90 * 24 * time.Hour)
+	ledger.send("nano_1customer", orphan.Account, amount)
+	if err := orphan.check(); err != nil {
+		t.Fatal(err)
+	}
+	if orphan.Late != nil || orphan.FulfilledAt != nil || !orphan.Balance.Equal(amount) {
+		t.Fatalf("orphan funds are not left: %+v", orphan)
+	}
+}
+
+func TestLateFundsSubscription(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	t.Cleanup(func() {
+		config.LatePaymentWindow = 0
+		config.Account = ""
+	})
+	stopCheckLoops(t)
+	amount := NanoToRaw(decimal.New(1, 0))
+	p := &Payment{Account: "nano_1expired", PublicKey: randomHash(), Amount: amount, CreatedAt: clock.Now(), Timeout: 600}
+	ledger.own(p)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c.Add(time.Hour)
+	if !p.finished() {
+		t.Fatal("expired payment is checked without LatePaymentWindow")
+	}
+
+	// Expired payment keeps its check loop and subscription within the window.
+	config.LatePaymentWindow = 24 * 3600
+	if p.finished() {
+		t.Fatal("expired payment is not checked for late funds")
+	}
+	loop := *p
+	loop.StartChecking()
+	if !stringInSlice(p.Account, activeAccounts()) {
+		t.Fatalf("expired account is not subscribed: %v", activeAccounts())
+	}
+
+	// Confirmation from the websocket checks the account and the funds are held as late.
+	ledger.send("nano_1customer", p.Account, amount)
+	p.checkOnce()
+	if p.Late == nil || !p.Late.Amount.Equal(amount) || p.nextStep() != stepAwaitLate || p.FulfilledAt != nil {
+		t.Fatalf("payment is not late: %+v", p)
+	}
+
+	idle := &Payment{Account: "nano_1idle", Amount: amount, CreatedAt: p.CreatedAt, Timeout: 600}
+	c.Add(24 * time.Hour)
+	if !idle.finished() {
+		t.Error("payment is checked after LatePaymentWindow")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// Customers may send funds to the account of a payment after it is finished, e.g. a second transaction after paying.
+// Leftover sweep checks the accounts of finished payments and sends their funds to Account.
+// Unlike the recovery scan it walks the payments in the database, because payment indexes are random.
+
+var errLeftoverRunning = errors.New("leftover sweep is already running")
+
+// LeftoverAccount is the account of a finished payment holding funds.
+type LeftoverAccount struct {
+	RecoveredAccount
+	PaymentID string `json:"paymentId"`
+}
+
+// LeftoverReport is the result of a leftover sweep. Amounts are in raw.
+type LeftoverReport struct {
+	DryRun     bool       `json:"dryRun"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Number of payment accounts checked.
+	Checked  int               `json:"checked"`
+	Accounts []LeftoverAccount `json:"accounts"`
+	// Total of balances and pending funds found. In a dry run it is the amount that would be moved.
+	Total decimal.Decimal `json:"total"`
+}
+
+// leftoverCandidate returns true if funds on the account of p are not expected by any step of the payment.
+// Funds waiting for an admin decision, such as late funds, approvals, disputes or held expiries, are left alone.
+func (p *Payment) leftoverCandidate() bool {
+	if p.Imported || p.Sandbox || p.Index == "" || p.integrity.blocks() || !p.finished() || p.Refund.unsent() {
+		return false
+	}
+	if p.disputed() || p.Expiry.held() {
+		return false
+	}
+	if step := p.nextStep(); step != stepNone && step != stepCheckPending {
+		return false
+	}
+	// Funds arriving to an unfulfilled payment within the window are held as late funds.
+	window := time.Duration(config.LatePaymentWindow) * time.Second
+	return p.FulfilledAt != nil || window == 0 || now().After(p.expiresAt().Add(window))
+}
+
+func unexpectedFundsAccount(account string) bool {
+	p, err := LoadPayment([]byte(account))
+	return err != nil || !p.leftoverCandidate()
+}
+
+// leftoverThrottle waits LeftoverSweepDelay before the next node request.
+func leftoverThrottle(ctx context.Context) error {
+	select {
+	case <-time.After(time.Duration(config.LeftoverSweepDelay) * time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sweepLeftovers finds funds on the accounts of finished payments and sends them to Account, or to the account
+// of their merchant, unless dryRun is set.
+// Errors of single accounts are reported in their results. progress is called with a copy of the report after each batch.
+func sweepLeftovers(ctx context.Context, dryRun bool, progress func(LeftoverReport)) (*LeftoverReport, error) {
+	if !config.sweepEnabled() {
+		return nil, errSweepDisabled
+	}
+	report := &LeftoverReport{DryRun: dryRun, StartedAt: clock.Now(), Accounts: []LeftoverAccount{}}
+	payments := make(map[string]*Payment)
+	var accounts []string
+	err := forEachPayment(func(p *Payment) error {
+		if p.leftoverCandidate() {
+			payments[p.Account] = p
+			accounts = append(accounts, p.Account)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := openRecoverLedger(config.DatabasePath + ".leftover.log")
+	if err != nil {
+		return nil, err
+	}
+	defer ledger.Close()
+	opts := RecoverOptions{Skip: unexpectedFundsAccount}
+	for start := 0; start < len(accounts); start += config.LeftoverSweepBatchSize {
+		end := start + config.LeftoverSweepBatchSize
+		if end > len(accounts) {
+			end = len(accounts)
+		}
+		if start > 0 {
+			if err = leftoverThrottle(ctx); err != nil {
+				return report, err
+			}
+		}
+		balances, err := backgroundNode().AccountsBalances(accounts[start:end])
+		if err != nil {
+			return report, err
+		}
+		for _, account := range accounts[start:end] {
+			b, ok := balances[account]
+			if !ok {
+				continue
+			}
+			balance, err := parseRaw(b.Balance)
+			if err != nil {
+				return report, err
+			}
+			pending, err := parseRaw(b.Pending)
+			if err != nil {
+				return report, err
+			}
+			if balance.IsZero() && pending.IsZero() {
+				continue
+			}
+			p := payments[account]
+			la := LeftoverAccount{
+				RecoveredAccount: RecoveredAccount{Index: p.Index, Account: account, Balance: balance, Pending: pending},
+				PaymentID:        p.PaymentID,
+			}
+			report.Total = report.Total.Add(balance).Add(pending)
+			err = ledger.write(recoverLedgerEntry{Event: "found", Index: p.Index, Account: account, Amount: balance.Add(pending)})
+			if err != nil {
+				return report, err
+			}
+			if !dryRun {
+				if err = leftoverThrottle(ctx); err != nil {
+					return report, err
+				}
+				if err = sweepLeftover(opts, p.Merchant, &la.RecoveredAccount, ledger); err != nil {
+					log.Errorf("cannot sweep leftover funds of %s: %s", account, err)
+					la.Error = err.Error()
+				}
+			}
+			report.Accounts = append(report.Accounts, la)
+		}
+		report.Checked = end
+		if progress != nil {
+			progress(*report)
+		}
+	}
+	report.FinishedAt = now()
+	return report, nil
+}
+
+// sweepLeftover sends the funds of ra to the account of the merchant.
+func sweepLeftover(opts RecoverOptions, merchant string, ra *RecoveredAccount, ledger *recoverLedger) error {
+	seed, err := merchantSeed(merchant)
+	if err != nil {
+		return err
+	}
+	if opts.SweepTo, err = merchantAccount(merchant); err != nil {
+		return err
+	}
+	key, err := backgroundNode().DeterministicKey(seed, ra.Index)
+	if err != nil {
+		return err
+	}
+	if key.Account != ra.Account {
+		return errIntegrityMismatch
+	}
+	return recoverSweep(opts, ra, key, ledger)
+}
+
+var (
+	leftoverMu     sync.Mutex
+	leftoverStatus *LeftoverReport
+	leftoverErr    error
+	leftoverActive bool
+)
+
+// beginLeftoverSweep marks a sweep as running. It must be followed by runLeftoverSweep.
+func beginLeftoverSweep() error {
+	if !config.sweepEnabled() {
+		return errSweepDisabled
+	}
+	leftoverMu.Lock()
+	defer leftoverMu.Unlock()
+	if leftoverActive {
+		return errLeftoverRunning
+	}
+	leftoverActive = true
+	leftoverErr = nil
+	return nil
+}
+
+// runLeftoverSweep runs the sweep started with beginLeftoverSweep and records its result as the status.
+func runLeftoverSweep(dryRun bool) error {
+	report, err := sweepLeftovers(context.Background(), dryRun, func(r LeftoverReport) {
+		leftoverMu.Lock()
+		leftoverStatus = &r
+		leftoverMu.Unlock()
+	})
+	if err != nil {
+		log.Errorln("leftover sweep failed:", err)
+	} else if len(report.Accounts) > 0 {
+		log.Noticef("leftover sweep found %d accounts with %s raw (dry run: %v)", len(report.Accounts), report.Total, dryRun)
+	}
+	leftoverMu.Lock()
+	if report != nil {
+		leftoverStatus = report
+	}
+	leftoverErr = err
+	leftoverActive = false
+	leftoverMu.Unlock()
+	return err
+}
+
+// startLeftoverSweep runs a sweep in background. Found accounts and money movements are logged next to the database.
+func startLeftoverSweep(dryRun bool) error {
+	if err := beginLeftoverSweep(); err != nil {
+		return err
+	}
+	go runLeftoverSweep(dryRun)
+	return nil
+}
+
+// runScheduledLeftoverSweep is the job of LeftoverSweepInterval. It does nothing if a sweep started by an admin is running.
+func runScheduledLeftoverSweep() error {
+	err := beginLeftoverSweep()
+	if err == errLeftoverRunning {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return runLeftoverSweep(false)
+}
+
+// handleAdminSweep starts a leftover sweep on POST and returns the progress on GET.
+// With dry_run=true funds are only reported.
+func handleAdminSweep(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var dryRun bool
+		if s := r.FormValue("dry_run"); s != "" {
+			var err error
+			dryRun, err = strconv.ParseBool(s)
+			if err != nil {
+				http.Error(w, "invalid dry_run", http.StatusBadRequest)
+				return
+			}
+		}
+		err := startLeftoverSweep(dryRun)
+		if err == errLeftoverRunning || err == errSweepDisabled {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Noticef("leftover sweep started by %s (dry run: %v)", adminIdentity(r), dryRun)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	leftoverMu.Lock()
+	status := struct {
+		Running bool `json:"running"`
+		// Set while the sweep is waiting for node requests with higher priority.
+		Throttled bool            `json:"throttled"`
+		Error     string          `json:"error,omitempty"`
+		Report    *LeftoverReport `json:"report"`
+	}{Running: leftoverActive, Throttled: leftoverActive && nodeThrottled(nano.PriorityBackground), Report: leftoverStatus}
+	if leftoverErr != nil {
+		status.Error = leftoverErr.Error()
+	}
+	leftoverMu.Unlock()
+	writeAdminJSON(w, status)
+}
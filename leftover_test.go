@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestSweepLeftovers(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	config.setDefaults()
+	config.LeftoverSweepDelay = 1
+	merchant := recoverAccount(t, 100)
+	oldAccount := config.Account
+	config.Account = merchant
+	t.Cleanup(func() { config.Account = oldAccount })
+	amount := NanoToRaw(decimal.NewFromInt(1))
+	payments := []*Payment{
+		// Customer sent again after the payment is swept.
+		{Account: recoverAccount(t, 1), Index: "1", CreatedAt: *now(), FulfilledAt: now(), SentAt: now(), FinalNotifiedAt: now()},
+		// Still being checked.
+		{Account: recoverAccount(t, 2), Index: "2", CreatedAt: *now()},
+		// Waiting for admin to resolve late funds.
+		{Account: recoverAccount(t, 3), Index: "3", CreatedAt: now().AddDate(0, 0, -1), Late: &LatePayment{DetectedAt: *now()}},
+		// Finished with an open dispute.
+		{Account: recoverAccount(t, 4), Index: "4", CreatedAt: *now(), FulfilledAt: now(), SentAt: now(), Dispute: &Dispute{OpenedAt: *now()}},
+		// Expired with funds held for admin.
+		{Account: recoverAccount(t, 5), Index: "5", CreatedAt: now().AddDate(0, 0, -1), Expiry: &ExpiryAction{ExpiredAt: *now(), Action: expiryHold}},
+	}
+	for _, p := range payments {
+		ledger.keys[p.Index] = nano.Key{Account: p.Account, Private: "PRIV"}
+		ledger.send("nano_1customer", p.Account, amount)
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := sweepLeftovers(context.Background(), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || len(report.Accounts) != 1 || report.Accounts[0].Account != payments[0].Account || !report.Total.Equal(amount) {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if !ledger.received(merchant).IsZero() {
+		t.Fatal("funds are moved in dry run")
+	}
+
+	report, err = sweepLeftovers(context.Background(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Accounts) != 1 || report.Accounts[0].SweepHash == "" || !ledger.received(merchant).Equal(amount) {
+		t.Fatalf("leftover funds are not swept: %+v", report.Accounts)
+	}
+
+	if w := postAdminForm(handleAdminSweep, url.Values{"dry_run": {"maybe"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid dry_run is accepted: %d", w.Code)
+	}
+}
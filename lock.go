@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"time"
 )
 
 type MapLock struct {
@@ -32,3 +33,25 @@ func (m *MapLock) Unlock(key string) {
 	m.m.Unlock()
 	l.Unlock()
 }
+
+// LockTimeout locks the key if it can within d. It returns false if the lock is held by someone else after d.
+func (m *MapLock) LockTimeout(key string, d time.Duration) bool {
+	acquired := make(chan struct{})
+	go func() {
+		m.Lock(key)
+		close(acquired)
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-acquired:
+		return true
+	case <-t.C:
+		// The lock is released as soon as it is acquired.
+		go func() {
+			<-acquired
+			m.Unlock(key)
+		}()
+		return false
+	}
+}
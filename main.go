@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,7 +15,6 @@ import (
 	"github.com/tundak/accept-nano/nano"
 	"github.com/cenkalti/log"
 	"github.com/ulule/limiter/v3"
-	"github.com/ulule/limiter/v3/drivers/store/memory"
 	"go.etcd.io/bbolt"
 )
 
@@ -25,10 +25,17 @@ var (
 	generateSeed      = flag.Bool("seed", false, "generate a seed and exit")
 	configPath        = flag.String("config", "config.toml", "config file path")
 	version           = flag.Bool("version", false, "display version and exit")
+	migrateBolt       = flag.Bool("migrate-from-bolt", false, "copy payments from DatabasePath to DatabaseURL and exit")
+	importFile        = flag.String("import", "", "restore payments from a file made with /admin/export and exit")
+	importOverwrite   = flag.Bool("import-overwrite", false, "overwrite existing payments with -import instead of skipping them")
 	config            Config
 	db                *bbolt.DB
 	server            http.Server
+	adminServer       http.Server
 	rateLimiter       *limiter.Limiter
+	payRateLimiter    *limiter.Limiter
+	priceRateLimiter  *limiter.Limiter
+	adminAuthLimiter  *limiter.Limiter
 	node              *nano.Node
 	stopCheckPayments = make(chan struct{})
 	checkPaymentWG    sync.WaitGroup
@@ -41,6 +48,27 @@ func main() {
 		Version = "v0.0.0"
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "recover" {
+		runRecoverCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImportCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		runCheckConfigCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "node-conformance" {
+		runNodeConformanceCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "generate-seed" {
+		printNewSeed()
+		return
+	}
+
 	flag.Parse()
 
 	if *version {
@@ -49,11 +77,7 @@ func main() {
 	}
 
 	if *generateSeed {
-		seed, err := NewSeed()
-		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Println(seed)
+		printNewSeed()
 		return
 	}
 
@@ -66,33 +90,126 @@ func main() {
 		log.SetLevel(log.DEBUG)
 	}
 
-	if config.CoinmarketcapAPIKey == "" {
-		log.Warning("empty CoinmarketcapAPIKey in config, fiat conversions will not work")
+	if config.CoinmarketcapAPIKey == "" && stringInSlice("coinmarketcap", config.PriceProviders) {
+		log.Warning("empty CoinmarketcapAPIKey in config, coinmarketcap price provider is disabled")
 	}
-
-	rate, err := limiter.NewRateFromFormatted(config.RateLimit)
+	err = initPriceProviders()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	rateLimiter = limiter.New(memory.NewStore(), rate, limiter.WithTrustForwardHeader(true))
-	node = nano.New(config.NodeURL)
+	rateLimiter, err = newRateLimiter(config.RateLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	payRateLimiter, err = newRateLimiter(config.PayRateLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	priceRateLimiter, err = newRateLimiter(config.PriceRateLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	adminAuthLimiter, err = newRateLimiter(config.AdminAuthFailureLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initAPIKeyLimiters()
+	if err != nil {
+		log.Fatal(err)
+	}
+	node = nano.New(nodeURLs()...)
+	node.SetFailureThreshold(config.NodeFailureThreshold)
 	node.SetTimeout(time.Duration(config.NodeTimeout) * time.Millisecond)
+	configureNodeCalls(node)
+	node.SetObserver(nodeErrors.record)
+	nodeLimiter = newNodeLimiter()
+	node.SetLimiter(nodeLimiter)
 
-	log.Debugln("opening db:", config.DatabasePath)
-	db, err = bbolt.Open(config.DatabasePath, 0600, nil)
+	err = openDB()
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Debugln("db has been opened successfully")
-
-	err = db.Update(func(tx *bbolt.Tx) error {
-		_, txErr := tx.CreateBucketIfNotExists([]byte(paymentsBucket))
-		return txErr
-	})
+	if *migrateBolt {
+		err = migrateFromBolt()
+		_ = closeDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *importFile != "" {
+		err = runRestore(*importFile, *importOverwrite)
+		_ = closeDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	err = maintenance.load()
 	if err != nil {
 		log.Fatal(err)
 	}
+	lockTTL, lockWait := time.Duration(config.LockLeaseTTL)*time.Second, time.Duration(config.LockWaitTimeout)*time.Second
+	if config.LockRedisAddress != "" {
+		moneyLock = newRedisLock(config.LockRedisAddress, lockTTL, lockWait)
+	} else if s, ok := store.(*sqlStore); ok && s.postgres {
+		moneyLock = newAdvisoryLock(s.db, lockTTL, lockWait)
+	}
+
+	if config.OutboxEnabled {
+		outbox = newOutboxDispatcher()
+		err = outbox.start()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	checks = newCheckScheduler(config.CheckWorkers, float64(config.PriorityWorkerShare)/100) // nolint: gomnd
+
+	if config.EnableFaults {
+		log.Warning("fault injection is enabled")
+		faults = newFaultInjector()
+		verifications.Intercept(faults.intercept)
+	}
+
+	var httpLogOut io.Writer
+	if config.HTTPLogFile != "" {
+		f, err2 := os.OpenFile(config.HTTPLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err2 != nil {
+			log.Fatal(err2)
+		}
+		defer f.Close()
+		httpLogOut = f
+	}
+	httpLog = newHTTPLogger(httpLogOut)
+
+	var accessLogOut io.Writer
+	if config.AccessLogFile != "" && config.AccessLogFormat != accessLogOff {
+		f, err2 := os.OpenFile(config.AccessLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err2 != nil {
+			log.Fatal(err2)
+		}
+		defer f.Close()
+		accessLogOut = f
+	}
+	accessLog = newAccessLogger(config.AccessLogFormat, accessLogOut)
+
+	if config.QRLogoFile != "" {
+		qrLogo, err = loadQRLogo(config.QRLogoFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.Partitioning {
+		var membership MembershipStore = boltMembership{}
+		if m, ok := store.(MembershipStore); ok {
+			membership = m
+		}
+		partitions = newCoordinator(config.InstanceID, membership, time.Duration(config.HeartbeatTTL)*time.Second)
+		go runCoordinator(partitions)
+	}
 
 	// Check existing payments.
 	payments, err := LoadActivePayments()
@@ -104,10 +221,12 @@ func main() {
 	}
 
 	if config.NodeWebsocketURL != "" {
-		go runSubscriber()
+		go runSubscriber(stopCheckPayments)
 		go runChecker()
 	}
 
+	go runJobScheduler()
+	go runMaintenanceMonitor()
 	go runServer()
 
 	stop := make(chan os.Signal, 1)
@@ -126,11 +245,40 @@ func main() {
 	if err != nil {
 		log.Errorln("shutdown error:", err)
 	}
+	if config.AdminListenAddress != "" {
+		err = adminServer.Shutdown(ctx)
+		if err != nil {
+			log.Errorln("admin server shutdown error:", err)
+		}
+	}
+	if config.autoTLSEnabled() {
+		err = challengeServer.Shutdown(ctx)
+		if err != nil {
+			log.Errorln("challenge server shutdown error:", err)
+		}
+	}
+
+	websockets.closeAll()
+
+	if waitChecks(time.Duration(config.ShutdownGracePeriod) * time.Millisecond) {
+		log.Noticeln("payment checks are finished")
+	}
+	if outbox != nil {
+		outbox.close()
+	}
 
-	checkPaymentWG.Wait()
+	err = closeDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Noticeln("shutdown complete")
+}
 
-	err = db.Close()
+// printNewSeed prints a random seed to stdout. It is not logged anywhere.
+func printNewSeed() {
+	seed, err := NewSeed()
 	if err != nil {
 		log.Fatal(err)
 	}
+	fmt.Println(seed)
 }
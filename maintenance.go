@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Maintenance windows are periods of planned work on the node or the host.
+// During a window alerts are logged and kept but not posted to AlertURL, and non-critical background jobs
+// are deferred until the window closes. Payments are checked and processed as usual.
+// Windows recur with MaintenanceSchedule or are started one-off with POST /admin/maintenance.
+// One-off windows and deferred jobs are saved in database so they survive a restart.
+
+const (
+	maintenanceBucket        = "maintenance"
+	maintenanceCheckInterval = 30 * time.Second
+	maxMaintenanceDuration   = 7 * 24 * time.Hour
+	maxSuppressedAlerts      = 100
+
+	maintenanceSourceSchedule = "schedule"
+	maintenanceSourceManual   = "manual"
+)
+
+// Jobs that are deferred during maintenance windows.
+const (
+	jobDigest     = "digest"
+	jobCompaction = "compaction"
+	jobExport     = "export"
+	jobBackfill   = "backfill"
+	// Cleanup of orphan websocket subscriptions.
+	jobSweepSubscriptions = "sweep-subscriptions"
+	// Check of all accounts after the node websocket reconnects.
+	jobReconcile = "reconcile"
+)
+
+var metricAlertsSuppressed = expvar.NewInt("alerts_suppressed_total")
+
+// MaintenanceWindow is a period in which alerts are suppressed and background jobs are deferred.
+type MaintenanceWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// "schedule" or "manual".
+	Source string `json:"source"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (w *MaintenanceWindow) contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// MaintenanceStatus is returned from maintenance endpoint.
+type MaintenanceStatus struct {
+	Active bool `json:"active"`
+	// Window in effect now.
+	Window *MaintenanceWindow `json:"window,omitempty"`
+	// One-off window set with the endpoint, current or upcoming.
+	Manual           *MaintenanceWindow `json:"manual,omitempty"`
+	DeferredJobs     []string           `json:"deferredJobs"`
+	SuppressedAlerts []Alert            `json:"suppressedAlerts"`
+}
+
+type maintenanceState struct {
+	now func() time.Time
+	// Runs a deferred job after the window closes. Defaults to runMaintenanceJob.
+	run func(job string)
+
+	m      sync.Mutex
+	manual *MaintenanceWindow
+	// Jobs to run after the window, in order they are deferred.
+	deferred []string
+	// Last recorded alerts that are not sent in a window.
+	suppressed []Alert
+	// State seen in the last tick.
+	active bool
+}
+
+var maintenance = &maintenanceState{now: clockNow}
+
+// runMaintenanceJob runs a job deferred by runOrDefer.
+// Scheduled jobs are triggered, so they run within the limits of their class.
+func runMaintenanceJob(job string) {
+	if jobs.trigger(job) {
+		return
+	}
+	switch job {
+	case jobDigest:
+		sendDueDigests(clock.Now())
+	case jobCompaction:
+		if _, err := compactDB(); err != nil {
+			log.Errorln("compaction error:", err)
+		}
+	case jobExport:
+		_ = exportToObjectStorage()
+	case jobBackfill:
+		if err := startBackfill(); err != nil && err != errBackfillRunning {
+			log.Errorln("cannot start backfill:", err)
+		}
+	case jobSweepSubscriptions:
+		reapOrphanSubscriptions(clock.Now(), time.Duration(config.SubscriptionSweepInterval)*time.Second)
+	case jobReconcile:
+		reconcile(activeAccounts())
+	default:
+		log.Warningf("unknown deferred job: %s", job)
+	}
+}
+
+func (s *maintenanceState) runJob(job string) {
+	if s.run != nil {
+		s.run(job)
+		return
+	}
+	runMaintenanceJob(job)
+}
+
+// load reads the one-off window and deferred jobs saved in database.
+func (s *maintenanceState) load() error {
+	var manual *MaintenanceWindow
+	var deferred []string
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(maintenanceBucket))
+		if b == nil {
+			return nil
+		}
+		if value := b.Get([]byte("window")); value != nil {
+			manual = new(MaintenanceWindow)
+			if err := json.Unmarshal(value, manual); err != nil {
+				return err
+			}
+		}
+		if value := b.Get([]byte("deferred")); value != nil {
+			return json.Unmarshal(value, &deferred)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	s.manual, s.deferred = manual, deferred
+	s.m.Unlock()
+	return nil
+}
+
+// save writes the one-off window and deferred jobs to database. Must be called with s.m held.
+func (s *maintenanceState) save() error {
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(maintenanceBucket))
+		if err != nil {
+			return err
+		}
+		if s.manual == nil {
+			err = b.Delete([]byte("window"))
+		} else {
+			err = putJSON(b, "window", s.manual)
+		}
+		if err != nil {
+			return err
+		}
+		return putJSON(b, "deferred", s.deferred)
+	})
+}
+
+func putJSON(b *bbolt.Bucket, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
+
+// window returns the maintenance window at t, or nil if t is not in a window.
+func (s *maintenanceState) window(t time.Time) *MaintenanceWindow {
+	s.m.Lock()
+	manual := s.manual
+	s.m.Unlock()
+	if manual != nil && manual.contains(t) {
+		return manual
+	}
+	return scheduledWindow(t)
+}
+
+// scheduledWindow returns the window of MaintenanceSchedule containing t if there is one.
+func scheduledWindow(t time.Time) *MaintenanceWindow {
+	if config.MaintenanceSchedule == "" {
+		return nil
+	}
+	schedule, err := parseCronSchedule(config.MaintenanceSchedule)
+	if err != nil {
+		return nil
+	}
+	duration := time.Duration(config.MaintenanceDuration) * time.Minute
+	// Latest start before t has the latest end.
+	start := t.UTC().Truncate(time.Minute)
+	for i := 0; i < config.MaintenanceDuration; i++ {
+		if schedule.matches(start) {
+			return &MaintenanceWindow{Start: start, End: start.Add(duration), Source: maintenanceSourceSchedule}
+		}
+		start = start.Add(-time.Minute)
+	}
+	return nil
+}
+
+// suppress records the alert and returns true if it is raised in a maintenance window.
+func (s *maintenanceState) suppress(alert Alert) bool {
+	if s.window(alert.Time) == nil {
+		return false
+	}
+	s.m.Lock()
+	s.suppressed = append(s.suppressed, alert)
+	if len(s.suppressed) > maxSuppressedAlerts {
+		s.suppressed = s.suppressed[len(s.suppressed)-maxSuppressedAlerts:]
+	}
+	s.m.Unlock()
+	metricAlertsSuppressed.Add(1)
+	return true
+}
+
+// runOrDefer runs the job now, or after the window closes when in a maintenance window.
+// A job is deferred once no matter how many times it is due in the window.
+func (s *maintenanceState) runOrDefer(job string) {
+	w := s.window(s.now())
+	if w == nil {
+		s.runJob(job)
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, name := range s.deferred {
+		if name == job {
+			return
+		}
+	}
+	s.deferred = append(s.deferred, job)
+	if err := s.save(); err != nil {
+		log.Errorln("cannot save deferred jobs:", err)
+	}
+	log.Noticef("%s is deferred until the end of maintenance window at %s", job, w.End.Format(time.RFC3339))
+}
+
+// tick logs the changes of maintenance state and runs the deferred jobs after the window closes.
+func (s *maintenanceState) tick() {
+	now := s.now()
+	w := s.window(now)
+	s.m.Lock()
+	entered, exited := w != nil && !s.active, w == nil && s.active
+	s.active = w != nil
+	var jobs []string
+	if w == nil && (len(s.deferred) > 0 || s.manual != nil && !now.Before(s.manual.End)) {
+		jobs = s.deferred
+		s.deferred = nil
+		if s.manual != nil && !now.Before(s.manual.End) {
+			s.manual = nil
+		}
+		if err := s.save(); err != nil {
+			log.Errorln("cannot save maintenance state:", err)
+		}
+	}
+	s.m.Unlock()
+	switch {
+	case entered:
+		log.Noticef("maintenance window started, ends at %s", w.End.Format(time.RFC3339))
+	case exited:
+		log.Notice("maintenance window ended")
+	}
+	for _, job := range jobs {
+		log.Noticef("running deferred job: %s", job)
+		s.runJob(job)
+	}
+}
+
+func (s *maintenanceState) status() MaintenanceStatus {
+	w := s.window(s.now())
+	s.m.Lock()
+	defer s.m.Unlock()
+	return MaintenanceStatus{
+		Active:           w != nil,
+		Window:           w,
+		Manual:           s.manual,
+		DeferredJobs:     append([]string{}, s.deferred...),
+		SuppressedAlerts: append([]Alert{}, s.suppressed...),
+	}
+}
+
+func (s *maintenanceState) setManual(w *MaintenanceWindow) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	old := s.manual
+	s.manual = w
+	err := s.save()
+	if err != nil {
+		s.manual = old
+	}
+	return err
+}
+
+func runMaintenanceMonitor() {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	maintenance.tick()
+	for {
+		select {
+		case <-ticker.C:
+			maintenance.tick()
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+// parseMaintenanceWindow reads a one-off window from admin request form values.
+// Start is in RFC 3339 format and defaults to now. Duration is in seconds.
+func parseMaintenanceWindow(r *http.Request, now time.Time) (*MaintenanceWindow, error) {
+	w := &MaintenanceWindow{Start: now, Source: maintenanceSourceManual, Reason: r.FormValue("reason")}
+	if s := r.FormValue("start"); s != "" {
+		start, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, errors.New("invalid start")
+		}
+		w.Start = start.UTC()
+	}
+	seconds, err := strconv.Atoi(r.FormValue("duration"))
+	if err != nil || seconds <= 0 {
+		return nil, errors.New("duration must be a positive number of seconds")
+	}
+	duration := time.Duration(seconds) * time.Second
+	if duration > maxMaintenanceDuration {
+		return nil, fmt.Errorf("duration cannot be longer than %s", maxMaintenanceDuration)
+	}
+	w.End = w.Start.Add(duration)
+	if !w.End.After(now) {
+		return nil, errors.New("window is in the past")
+	}
+	return w, nil
+}
+
+// handleAdminMaintenance returns the maintenance status on GET, sets the one-off window on POST
+// and removes it on DELETE. Deferred jobs run on the next check after the window is removed.
+func handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		window, err := parseMaintenanceWindow(r, maintenance.now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = maintenance.setManual(window); err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Noticef("maintenance window is set from %s to %s", window.Start.Format(time.RFC3339), window.End.Format(time.RFC3339))
+	case http.MethodDelete:
+		if err := maintenance.setManual(nil); err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		go maintenance.tick()
+	default:
+		http.Error(w, "GET, POST or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, maintenance.status())
+}
+
+// cronSchedule is a parsed cron expression with fields minute, hour, day of month, month and day of week.
+// A nil field matches any value. Unlike cron, both day fields must match.
+type cronSchedule [5]map[int]bool
+
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCronSchedule parses an expression of 5 fields, each "*" or a comma separated list of numbers and ranges like "1-5".
+// Sunday is 0 or 7 in day of week.
+func parseCronSchedule(s string) (cronSchedule, error) {
+	var c cronSchedule
+	fields := strings.Fields(s)
+	if len(fields) != len(c) {
+		return c, fmt.Errorf("schedule must have %d fields: minute hour day-of-month month day-of-week", len(c))
+	}
+	for i, field := range fields {
+		if field == "*" {
+			continue
+		}
+		c[i] = make(map[int]bool)
+		for _, part := range strings.Split(field, ",") {
+			lo, hi, err := parseCronRange(part)
+			if err != nil {
+				return c, err
+			}
+			if lo < cronFieldRanges[i][0] || hi > cronFieldRanges[i][1] || lo > hi {
+				return c, fmt.Errorf("value out of range in schedule: %q", part)
+			}
+			for v := lo; v <= hi; v++ {
+				if i == 4 {
+					// Sunday is both 0 and 7.
+					c[i][v%7] = true
+				} else {
+					c[i][v] = true
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+func parseCronRange(s string) (lo, hi int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	lo, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid value in schedule: %q", s)
+	}
+	hi = lo
+	if len(parts) == 2 {
+		hi, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid value in schedule: %q", s)
+		}
+	}
+	return lo, hi, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	values := [5]int{t.Minute(), t.Hour(), t.Day(), int(t.Month()), int(t.Weekday())}
+	for i, field := range c {
+		if field != nil && !field[values[i]] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func useTestMaintenance(t *testing.T, ran *[]string) {
+	old := maintenance
+	maintenance = &maintenanceState{now: clockNow, run: func(job string) { *ran = append(*ran, job) }}
+	t.Cleanup(func() { maintenance = old })
+}
+
+func TestMaintenanceSchedule(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.MaintenanceSchedule = "0 2 * * 7"
+	config.MaintenanceDuration = 60
+	t.Cleanup(func() { config.MaintenanceSchedule, config.MaintenanceDuration = "", 0 })
+	// A Sunday.
+	c := useFakeClock(t, time.Date(2024, 1, 7, 1, 59, 0, 0, time.UTC))
+	var ran []string
+	useTestMaintenance(t, &ran)
+	fakeKeyNode(t)
+	health := func() Health {
+		w := httptest.NewRecorder()
+		handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var h Health
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatalf("invalid health: %s", w.Body)
+		}
+		return h
+	}
+
+	maintenance.tick()
+	maintenance.runOrDefer(jobDigest)
+	sendAlert("test", "before window", nil)
+	if len(ran) != 1 || len(maintenance.status().SuppressedAlerts) != 0 || health().Maintenance {
+		t.Fatalf("maintenance is in effect before the window: %v", ran)
+	}
+
+	c.Add(time.Minute)
+	maintenance.tick()
+	maintenance.runOrDefer(jobDigest)
+	maintenance.runOrDefer(jobDigest)
+	maintenance.runOrDefer(jobCompaction)
+	sendAlert("test", "in window", nil)
+	// Degraded mode is entered without notifying.
+	nodeErrors.notify("degraded", "service is degraded", nil)
+	status := maintenance.status()
+	if len(ran) != 1 || !status.Active || !reflect.DeepEqual(status.DeferredJobs, []string{jobDigest, jobCompaction}) {
+		t.Fatalf("jobs are not deferred: %v %+v", ran, status)
+	}
+	if len(status.SuppressedAlerts) != 2 || status.SuppressedAlerts[0].Message != "in window" {
+		t.Fatalf("alerts are not recorded: %+v", status.SuppressedAlerts)
+	}
+	if h := health(); !h.Maintenance || !h.MaintenanceEndsAt.Equal(time.Date(2024, 1, 7, 3, 0, 0, 0, time.UTC)) {
+		t.Fatalf("health does not report maintenance: %+v", h)
+	}
+
+	// Deferred jobs survive a restart.
+	useTestMaintenance(t, &ran)
+	if err := maintenance.load(); err != nil {
+		t.Fatal(err)
+	}
+	c.Add(time.Hour)
+	maintenance.tick()
+	if !reflect.DeepEqual(ran, []string{jobDigest, jobDigest, jobCompaction}) || len(maintenance.status().DeferredJobs) != 0 {
+		t.Fatalf("deferred jobs are not run after the window: %v", ran)
+	}
+	maintenance.runOrDefer(jobDigest)
+	if len(ran) != 4 {
+		t.Fatal("job is deferred after the window")
+	}
+}
+
+func TestManualMaintenanceWindow(t *testing.T) {
+	openTestDB(t, 0)
+	c := useFakeClock(t, time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC))
+	var ran []string
+	useTestMaintenance(t, &ran)
+
+	w := postAdminForm(handleAdminMaintenance, url.Values{"start": {"2024-01-10T12:30:00Z"}, "duration": {"1800"}, "reason": {"node upgrade"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body)
+	}
+	if maintenance.status().Active {
+		t.Fatal("window is active before its start")
+	}
+	c.Add(30 * time.Minute)
+	maintenance.runOrDefer(jobExport)
+	if w = postAdminForm(handleAdminBackfill, nil); w.Code != http.StatusAccepted {
+		t.Fatalf("backfill is not deferred: %d %s", w.Code, w.Body)
+	}
+
+	// Window is loaded after restart.
+	useTestMaintenance(t, &ran)
+	if err := maintenance.load(); err != nil {
+		t.Fatal(err)
+	}
+	status := maintenance.status()
+	if !status.Active || status.Window.Reason != "node upgrade" || !reflect.DeepEqual(status.DeferredJobs, []string{jobExport, jobBackfill}) {
+		t.Fatalf("window is not restored: %+v", status)
+	}
+	c.Add(30 * time.Minute)
+	maintenance.tick()
+	if !reflect.DeepEqual(ran, []string{jobExport, jobBackfill}) || maintenance.status().Manual != nil {
+		t.Fatalf("window is not closed: %v %+v", ran, maintenance.status())
+	}
+
+	for _, values := range []url.Values{{"duration": {"0"}}, {"duration": {"60"}, "start": {"2024-01-01T00:00:00Z"}}, {"duration": {"60"}, "start": {"tomorrow"}}} {
+		if w = postAdminForm(handleAdminMaintenance, values); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid window %v is accepted: %d", values, w.Code)
+		}
+	}
+}
+
+func TestParseCronSchedule(t *testing.T) {
+	saturday := time.Date(2024, 1, 6, 2, 30, 0, 0, time.UTC)
+	sunday := saturday.AddDate(0, 0, 1)
+	monday := saturday.AddDate(0, 0, 2)
+	for _, s := range []string{"30 1-3 * * 0,6", "30 2 * * 6,7", "30 2 * * 6-7"} {
+		c, err := parseCronSchedule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.matches(saturday) || !c.matches(sunday) || c.matches(monday) {
+			t.Errorf("schedule %q matches wrong days", s)
+		}
+	}
+	c, err := parseCronSchedule("* * * * 5-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.matches(sunday) || c.matches(monday) {
+		t.Error("schedule matches wrong days")
+	}
+	for _, s := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "a * * * *", "5-1 * * * *"} {
+		if _, err = parseCronSchedule(s); err == nil {
+			t.Errorf("invalid schedule %q is parsed", s)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+// Merchants let one instance serve several shops. A payment is created for a merchant with the merchant parameter
+// of /api/pay or with the APIKey of the merchant. Its deposit account is derived from the Seed of the merchant,
+// verified funds are sent to the Account of the merchant and notifications are posted to its NotificationURL.
+// Merchants with their own seed allocate key indexes in their own namespace, so shops never share a key.
+// Tokens carry the merchant, and requests with the API key of a merchant cannot see payments of the others.
+
+var merchantIDRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var errUnknownMerchant = errors.New("unknown merchant")
+
+func (c *Config) validateMerchants() error {
+	for id, m := range c.Merchants {
+		if !merchantIDRegexp.MatchString(id) {
+			return fmt.Errorf("invalid merchant ID: %q", id)
+		}
+		if !accountRegexp.MatchString(m.Account) {
+			return fmt.Errorf("invalid Account of merchant %q: %q", id, m.Account)
+		}
+		if m.NotificationURL != "" && !validNotificationURL(m.NotificationURL) {
+			return fmt.Errorf("invalid NotificationURL of merchant %q", id)
+		}
+		if m.APIKey != "" {
+			if owner := c.APIKeys[m.APIKey].Merchant; owner != id {
+				return fmt.Errorf("APIKey of merchant %q belongs to merchant %q", id, owner)
+			}
+		}
+	}
+	for _, key := range c.APIKeys {
+		if _, ok := c.Merchants[key.Merchant]; key.Merchant != "" && !ok {
+			return fmt.Errorf("unknown merchant in APIKeys: %q", key.Merchant)
+		}
+	}
+	return nil
+}
+
+// setMerchantAPIKeys adds the APIKey of merchants to APIKeys.
+func (c *Config) setMerchantAPIKeys() {
+	for id, m := range c.Merchants {
+		if m.APIKey == "" {
+			continue
+		}
+		if c.APIKeys == nil {
+			c.APIKeys = make(map[string]APIKey)
+		}
+		key := c.APIKeys[m.APIKey]
+		if key.Merchant == "" {
+			key.Merchant = id
+			c.APIKeys[m.APIKey] = key
+		}
+	}
+}
+
+// merchantSeed returns the seed deposit accounts of the merchant are derived from. Empty id is for payments without a merchant.
+func merchantSeed(id string) (string, error) {
+	if id == "" {
+		return config.Seed, nil
+	}
+	m, ok := config.Merchants[id]
+	if !ok {
+		return "", errUnknownMerchant
+	}
+	if m.Seed == "" {
+		return config.Seed, nil
+	}
+	return m.Seed, nil
+}
+
+// merchantAccount returns the account verified funds of the merchant are sent to.
+func merchantAccount(id string) (string, error) {
+	if id == "" {
+		return config.Account, nil
+	}
+	m, ok := config.Merchants[id]
+	if !ok {
+		return "", errUnknownMerchant
+	}
+	return m.Account, nil
+}
+
+// indexNamespace returns the namespace key indexes of the merchant are allocated in.
+// Merchants without their own seed share the namespace of Seed.
+func indexNamespace(id string) string {
+	if m, ok := config.Merchants[id]; ok && m.Seed != "" {
+		return id
+	}
+	return ""
+}
+
+// deriveKey derives the key of the deposit account of p from the seed of its merchant.
+func (p *Payment) deriveKey() (*nano.Key, error) {
+	seed, err := merchantSeed(p.Merchant)
+	if err != nil {
+		return nil, err
+	}
+	return p.node().DeterministicKey(seed, p.Index)
+}
+
+// requestMerchant returns the merchant of a /api/pay request, from the merchant parameter or the API key.
+// It writes the error response and returns false if the merchant is unknown or the API key belongs to another merchant.
+func requestMerchant(w http.ResponseWriter, r *http.Request, apiKey APIKey) (string, bool) {
+	id := r.FormValue("merchant")
+	if id == "" {
+		return apiKey.Merchant, true
+	}
+	if _, ok := config.Merchants[id]; !ok {
+		writeError(w, errCodeUnknownMerchant, http.StatusBadRequest, errUnknownMerchant.Error())
+		return "", false
+	}
+	if apiKey.Merchant != "" && apiKey.Merchant != id {
+		writeError(w, errCodeMerchantMismatch, http.StatusForbidden, "API key belongs to another merchant")
+		return "", false
+	}
+	return id, true
+}
+
+// visibleTo returns false if the token is of another merchant than p, or if the request r is made with the API key
+// of another merchant. Both r and claims can be nil.
+func (p *Payment) visibleTo(r *http.Request, claims *MyCustomClaims) bool {
+	if claims != nil && claims.Merchant != p.Merchant {
+		return false
+	}
+	if r == nil {
+		return true
+	}
+	_, apiKey := requestAPIKey(r)
+	return apiKey.Merchant == "" || apiKey.Merchant == p.Merchant
+}
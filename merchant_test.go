@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestMerchants(t *testing.T) {
+	openTestDB(t, 0)
+	const (
+		globalSeed = "3A9F2C7E1B04D8F56A2E9C1D7B3F0A85E6C4D2B1F9A7E3C5D8B0F2A4C6E1D9B7"
+		shopSeed   = "C7D2E9F1A3B5C8D0E4F6A1B3C5D7E9F2A4B6C8D1E3F5A7B9C2D4E6F8A0B1C3D5"
+	)
+	// Node derives keys like a real node, so accounts depend on the seed.
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Seed  string `json:"seed"`
+			Index string `json:"index"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		index, _ := strconv.ParseUint(req.Index, 10, 64)
+		key, err := nano.DeriveKey(req.Seed, uint32(index))
+		if err != nil {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(key)
+	}))
+	t.Cleanup(nodeServer.Close)
+	oldNode := node
+	node = nano.New(nodeServer.URL)
+	shopAccount, _ := nano.DeriveKey(shopSeed, 1)
+	otherAccount, _ := nano.DeriveKey(shopSeed, 2)
+	config.Seed = globalSeed
+	config.Merchants = map[string]Merchant{
+		"shop-a": {Seed: shopSeed, Account: shopAccount.Account, NotificationURL: "https://a.example.com/hook", APIKey: "key-a"},
+		"shop-b": {Account: otherAccount.Account},
+	}
+	config.setDefaults()
+	config.AllowedDuration = -1
+	t.Cleanup(func() {
+		node = oldNode
+		config.Seed = ""
+		config.Merchants = nil
+		config.APIKeys = nil
+		config.AllowedDuration = 0
+	})
+	stopCheckLoops(t)
+	if err := config.validateMerchants(); err != nil {
+		t.Fatal(err)
+	}
+	if config.APIKeys["key-a"].Merchant != "shop-a" {
+		t.Fatalf("merchant key is not added: %+v", config.APIKeys)
+	}
+
+	post := func(h http.HandlerFunc, apiKey string, values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if apiKey != "" {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	pay := func(apiKey string, values url.Values) *Payment {
+		t.Helper()
+		values.Set("amount", "1")
+		w := post(handlePay, apiKey, values)
+		if w.Code != http.StatusOK {
+			t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+		}
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		p, err := LoadPayment([]byte(response.Account))
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := ParseToken(response.Token)
+		if err != nil || claims.Merchant != p.Merchant {
+			t.Fatalf("token does not have the merchant: %+v %v", claims, err)
+		}
+		return p
+	}
+
+	// Merchant is found from the API key and the account is derived from its seed.
+	a := pay("key-a", url.Values{})
+	index, _ := strconv.ParseUint(a.Index, 10, 64)
+	key, _ := nano.DeriveKey(shopSeed, uint32(index))
+	if a.Merchant != "shop-a" || a.Account != key.Account {
+		t.Fatalf("payment is not derived from the seed of the merchant: %s %s", a.Merchant, a.Account)
+	}
+	if account, _ := merchantAccount(a.Merchant); account != shopAccount.Account {
+		t.Errorf("unexpected destination: %s", account)
+	}
+	// Merchant without a seed shares the global keyspace.
+	b := pay("", url.Values{"merchant": {"shop-b"}})
+	index, _ = strconv.ParseUint(b.Index, 10, 64)
+	key, _ = nano.DeriveKey(globalSeed, uint32(index))
+	if b.Merchant != "shop-b" || b.Account != key.Account || indexNamespace("shop-b") != "" || indexNamespace("shop-a") != "shop-a" {
+		t.Fatalf("payment is not derived from the global seed: %s %s", b.Merchant, b.Account)
+	}
+
+	expectErrorCode(t, post(handlePay, "", url.Values{"amount": {"1"}, "merchant": {"shop-c"}}), http.StatusBadRequest, errCodeUnknownMerchant)
+	expectErrorCode(t, post(handlePay, "key-a", url.Values{"amount": {"1"}, "merchant": {"shop-b"}}), http.StatusForbidden, errCodeMerchantMismatch)
+
+	// Payments of other merchants cannot be verified with the key of a merchant.
+	token, err := newPaymentToken(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectErrorCode(t, post(handleVerify, "key-a", url.Values{"token": {token}}), http.StatusNotFound, errCodePaymentNotFound)
+	expectErrorCode(t, post(handleVerify, "key-a", url.Values{"id": {b.PaymentID}}), http.StatusNotFound, errCodePaymentNotFound)
+	if w := post(handleVerify, "", url.Values{"token": {token}}); w.Code != http.StatusOK {
+		t.Fatalf("cannot verify payment: %d %s", w.Code, w.Body)
+	}
+	// Token claiming another merchant is not accepted for the payment.
+	forged, err := newMerchantToken(b.Index, b.Account, b.PaymentID, "shop-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectErrorCode(t, post(handleVerify, "", url.Values{"token": {forged}}), http.StatusNotFound, errCodePaymentNotFound)
+
+	// Admin export is filtered by merchant.
+	w := httptest.NewRecorder()
+	handleAdminExport(w, httptest.NewRequest(http.MethodGet, "/admin/export?merchant=shop-a", nil))
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], a.Account) {
+		t.Errorf("unexpected export: %s", w.Body)
+	}
+
+	if keyIndex("shop-a", "5") != "shop-a/5" || keyIndex("", "5") != "5" {
+		t.Error("unexpected key indexes")
+	}
+	config.APIKeys["key-c"] = APIKey{Merchant: "shop-c"}
+	if config.validateMerchants() == nil {
+		t.Error("API key of unknown merchant is accepted")
+	}
+}
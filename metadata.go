@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var errInvalidMetadata = errors.New("metadata must be a JSON object")
+
+// parseMetadata decodes the metadata parameter of /api/pay.
+func parseMetadata(s string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	var metadata map[string]interface{}
+	if err := dec.Decode(&metadata); err != nil || metadata == nil || dec.More() {
+		return nil, errInvalidMetadata
+	}
+	p := Payment{Metadata: metadata}
+	if err := p.checkMetadataSize(); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// mergeMetadata returns the metadata of the preset with the keys of the request metadata set over it.
+func mergeMetadata(preset, req map[string]interface{}) map[string]interface{} {
+	if len(preset) == 0 {
+		return req
+	}
+	if len(req) == 0 {
+		return preset
+	}
+	merged := make(map[string]interface{}, len(preset)+len(req))
+	for k, v := range preset {
+		merged[k] = v
+	}
+	for k, v := range req {
+		merged[k] = v
+	}
+	return merged
+}
+
+// metadataFilter matches payments with a metadata key of the value.
+// Value matches a string exactly, other values match by their JSON encoding.
+type metadataFilter struct {
+	Key   string
+	Value string
+	// Only payments of this merchant match if set. Key is empty for filters by merchant only.
+	Merchant string
+}
+
+// requestMetadataFilter returns the filter in metadata_key, metadata_value and merchant parameters.
+// ok is false if only one of metadata_key and metadata_value is set.
+func requestMetadataFilter(r *http.Request) (f *metadataFilter, ok bool) {
+	key, value, merchant := r.FormValue("metadata_key"), r.FormValue("metadata_value"), r.FormValue("merchant")
+	if key == "" && value == "" && merchant == "" {
+		return nil, true
+	}
+	if (key == "") != (value == "") {
+		return nil, false
+	}
+	return &metadataFilter{Key: key, Value: value, Merchant: merchant}, true
+}
+
+func (f *metadataFilter) match(p *Payment) bool {
+	if f == nil {
+		return true
+	}
+	if f.Merchant != "" && p.Merchant != f.Merchant {
+		return false
+	}
+	if f.Key == "" {
+		return true
+	}
+	v, ok := p.Metadata[f.Key]
+	if !ok {
+		return false
+	}
+	if s, ok := v.(string); ok {
+		return s == f.Value
+	}
+	b, err := json.Marshal(v)
+	return err == nil && string(b) == f.Value
+}
+
+// errEnoughPayments stops the scan of findPaymentsByMetadata.
+var errEnoughPayments = errors.New("enough payments")
+
+// findPaymentsByMetadata scans all payments and returns at most limit payments matching the filter.
+// truncated is true if there are more.
+func findPaymentsByMetadata(f *metadataFilter, limit int) (payments []*Payment, truncated bool, err error) {
+	err = forEachPayment(func(p *Payment) error {
+		if !f.match(p) {
+			return nil
+		}
+		if len(payments) == limit {
+			truncated = true
+			return errEnoughPayments
+		}
+		payments = append(payments, p)
+		return nil
+	})
+	if err == errEnoughPayments {
+		err = nil
+	}
+	return
+}
+
+// writeMetadataError writes the error of metadata validation. It returns false if there is an error.
+func writeMetadataError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case errMetadataTooLarge:
+		writeError(w, errCodeMetadataTooLarge, http.StatusBadRequest, fmt.Sprintf("metadata cannot be larger than %d bytes", maxMetadataSize()))
+	default:
+		writeError(w, errCodeInvalidMetadata, http.StatusBadRequest, errInvalidMetadata.Error())
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPayMetadata(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.MaxMetadataSize = 64
+	config.AllowedDuration = -1
+	config.Presets = map[string]Preset{"gold-tier": {Amount: decimal.RequireFromString("2.5"), Metadata: map[string]interface{}{"tier": "gold", "order": "none"}}}
+	t.Cleanup(func() {
+		config.Presets = nil
+		config.AllowedDuration = 0
+		config.MaxMetadataSize = 0
+	})
+	stopCheckLoops(t)
+	pay := func(contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+	payForm := func(values url.Values) *httptest.ResponseRecorder {
+		return pay("application/x-www-form-urlencoded", values.Encode())
+	}
+
+	for _, metadata := range []string{`[1]`, `null`, `"order"`, `{"order":`, `{} {}`} {
+		w := payForm(url.Values{"amount": {"1"}, "metadata": {metadata}})
+		expectErrorCode(t, w, http.StatusBadRequest, errCodeInvalidMetadata)
+	}
+	w := payForm(url.Values{"amount": {"1"}, "metadata": {`{"x":"` + strings.Repeat("x", 64) + `"}`}})
+	expectErrorCode(t, w, http.StatusBadRequest, errCodeMetadataTooLarge)
+
+	// Metadata in a JSON body is an object.
+	w = pay("application/json", `{"amount":"1","metadata":{"order":"A-1","lines":2,"price":1.5}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+	}
+	var created Response
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/verify?token="+url.QueryEscape(created.Token), nil)
+	w = httptest.NewRecorder()
+	handleVerify(w, r)
+	var verified struct {
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &verified); err != nil {
+		t.Fatal(err)
+	}
+	if string(verified.Metadata) != `{"lines":2,"order":"A-1","price":1.5}` {
+		t.Fatalf("metadata is not returned unchanged: %s", w.Body)
+	}
+
+	// Searched before the next payment, it replaces this one because fakeKeyNode gives the same account to all payments.
+	search := func(query string) (payments []*Payment, code int) {
+		r := httptest.NewRequest(http.MethodGet, "/admin/payments/search?"+query, nil)
+		w := httptest.NewRecorder()
+		handleAdminSearchPayments(w, r)
+		var body struct {
+			Payments []*Payment
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return body.Payments, w.Code
+	}
+	if payments, _ := search("metadata_key=order&metadata_value=A-1"); len(payments) != 1 || payments[0].PaymentID != created.PaymentID {
+		t.Errorf("unexpected payments for order A-1: %v", payments)
+	}
+	if payments, _ := search("metadata_key=lines&metadata_value=2"); len(payments) != 1 || payments[0].PaymentID != created.PaymentID {
+		t.Errorf("unexpected payments for number value: %v", payments)
+	}
+	if payments, _ := search("metadata_key=tier&metadata_value=silver"); len(payments) != 0 {
+		t.Errorf("unexpected payments for tier silver: %v", payments)
+	}
+	if _, code := search("metadata_key=tier"); code != http.StatusBadRequest {
+		t.Errorf("key without value is accepted: %d", code)
+	}
+
+	// Request metadata is set over the metadata of the preset.
+	w = payForm(url.Values{"preset": {"gold-tier"}, "metadata": {`{"order":"A-2"}`}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+	}
+	var fromPreset Response
+	if err := json.Unmarshal(w.Body.Bytes(), &fromPreset); err != nil {
+		t.Fatal(err)
+	}
+	if fromPreset.Metadata["order"] != "A-2" || fromPreset.Metadata["tier"] != "gold" {
+		t.Fatalf("unexpected metadata: %v", fromPreset.Metadata)
+	}
+	if config.Presets["gold-tier"].Metadata["order"] != "none" {
+		t.Fatal("metadata of the preset is changed")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"expvar"
+)
+
+// Metrics are published with expvar and served in JSON format at /admin/metrics.
+var (
+	metricCompactions        = expvar.NewInt("compactions_total")
+	metricCompactionFailures = expvar.NewInt("compaction_failures_total")
+	metricExportFailures     = expvar.NewInt("object_storage_export_failures_total")
+	metricPriceStaleServes   = expvar.NewInt("price_stale_serves_total")
+	metricPriceRefusals      = expvar.NewInt("price_refusals_total")
+)
+
+func init() {
+	expvar.Publish("db_file_size_bytes", expvar.Func(func() interface{} {
+		size, _ := databaseFileSize()
+		return size
+	}))
+	expvar.Publish("partition_sizes", expvar.Func(func() interface{} {
+		if partitions == nil {
+			return nil
+		}
+		sizes, _ := partitions.partitionSizes()
+		return sizes
+	}))
+	expvar.Publish("price_provider_scores", expvar.Func(func() interface{} {
+		scores := make(map[string]float64)
+		for _, h := range priceProvidersHealth() {
+			scores[h.Name] = h.Score
+		}
+		return scores
+	}))
+	expvar.Publish("price_provider_preferred", expvar.Func(func() interface{} {
+		return preferredPriceProvider()
+	}))
+	expvar.Publish("db_freelist_bytes", expvar.Func(func() interface{} {
+		return dbStats().FreeAlloc
+	}))
+}
@@ -27,3 +27,20 @@ func (n *Node) AccountInfo(account string) (*AccountInfo, error) {
 	}
 	return &response, err
 }
+
+type AccountBalance struct {
+	Balance string `json:"balance"`
+	Pending string `json:"pending"`
+}
+
+// AccountsBalances returns balances of multiple accounts in a single call.
+func (n *Node) AccountsBalances(accounts []string) (map[string]AccountBalance, error) {
+	args := map[string]interface{}{
+		"accounts": accounts,
+	}
+	var response struct {
+		Balances map[string]AccountBalance `json:"balances"`
+	}
+	err := n.call("accounts_balances", args, &response)
+	return response.Balances, err
+}
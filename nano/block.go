@@ -3,6 +3,7 @@ package nano
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
 )
 
 type PendingBlock struct {
@@ -11,11 +12,29 @@ type PendingBlock struct {
 }
 
 func (n *Node) Pending(account string, count int, threshold string) (map[string]PendingBlock, error) {
+	return n.PendingPage(account, count, 0, threshold)
+}
+
+// PendingPage returns at most count confirmed pending blocks of account, skipping the first offset blocks.
+func (n *Node) PendingPage(account string, count, offset int, threshold string) (map[string]PendingBlock, error) {
+	return n.pendingPage(account, count, offset, threshold, true)
+}
+
+// PendingPageAll is like PendingPage but it includes the blocks that are not confirmed yet.
+func (n *Node) PendingPageAll(account string, count, offset int, threshold string) (map[string]PendingBlock, error) {
+	return n.pendingPage(account, count, offset, threshold, false)
+}
+
+func (n *Node) pendingPage(account string, count, offset int, threshold string, onlyConfirmed bool) (map[string]PendingBlock, error) {
 	args := map[string]interface{}{
-		"account":   account,
-		"count":     count,
-		"threshold": threshold,
-		"source":    "true",
+		"account":                account,
+		"count":                  count,
+		"threshold":              threshold,
+		"source":                 "true",
+		"include_only_confirmed": strconv.FormatBool(onlyConfirmed),
+	}
+	if offset > 0 {
+		args["offset"] = offset
 	}
 	var nodeResponse struct {
 		Blocks *json.RawMessage `json:"blocks"`
@@ -35,7 +54,8 @@ func (n *Node) Pending(account string, count int, threshold string) (map[string]
 	return ret, err
 }
 
-func (n *Node) BlockCreate(previous, account, representative, balance, link, key, work string) (string, error) {
+// BlockCreate returns the hash and the contents of a new signed state block.
+func (n *Node) BlockCreate(previous, account, representative, balance, link, key, work string) (hash, block string, err error) {
 	args := map[string]interface{}{
 		"type":           "state",
 		"previous":       previous,
@@ -50,11 +70,11 @@ func (n *Node) BlockCreate(previous, account, representative, balance, link, key
 		Hash  string `json:"hash"`
 		Block string `json:"block"`
 	}
-	err := n.call("block_create", args, &response)
+	err = n.call("block_create", args, &response)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	return response.Block, nil
+	return response.Hash, response.Block, nil
 }
 
 func (n *Node) Process(block string) (string, error) {
@@ -70,3 +90,34 @@ func (n *Node) Process(block string) (string, error) {
 	}
 	return response.Hash, nil
 }
+
+type BlockInfo struct {
+	BlockAccount string `json:"block_account"`
+	Amount       string `json:"amount"`
+	Balance      string `json:"balance"`
+	Confirmed    string `json:"confirmed"`
+	Subtype      string `json:"subtype"`
+	Contents     struct {
+		Type          string `json:"type"`
+		Link          string `json:"link"`
+		LinkAsAccount string `json:"link_as_account"`
+		Destination   string `json:"destination"`
+	} `json:"contents"`
+}
+
+// BlocksInfo returns information about given blocks. Blocks not found in the ledger are not included in the returned map.
+func (n *Node) BlocksInfo(hashes []string) (map[string]BlockInfo, error) {
+	args := map[string]interface{}{
+		"hashes":            hashes,
+		"json_block":        "true",
+		"include_not_found": "true",
+	}
+	var response struct {
+		Blocks map[string]BlockInfo `json:"blocks"`
+	}
+	err := n.call("blocks_info", args, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Blocks, nil
+}
@@ -0,0 +1,186 @@
+package nano
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Keys are derived the same way as deterministic_key RPC, so the node is not needed.
+// Private key is Blake2b-256 of seed and index. Public key is Ed25519 with Blake2b-512 in place of SHA-512.
+
+var (
+	errInvalidSeed    = errors.New("invalid seed")
+	ErrInvalidAccount = errors.New("invalid account")
+)
+
+const accountAlphabet = "13456789abcdefghijkmnopqrstuwxyz"
+
+// Parameters of edwards25519 curve.
+var (
+	curveP, _  = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+	curveD2, _ = new(big.Int).SetString("16295367250680780974490674513165176452449235426866156013048779062215315747161", 10)
+	baseX, _   = new(big.Int).SetString("15112221349535400772501151409588531511454012693041857206046113283949847762202", 10)
+	baseY, _   = new(big.Int).SetString("46316835694926478169428394003475163141307993866256225615783033603165251855960", 10)
+)
+
+// DeriveKey derives the key at index of seed given in hex.
+func DeriveKey(seed string, index uint32) (*Key, error) {
+	s, err := hex.DecodeString(seed)
+	if err != nil || len(s) != 32 {
+		return nil, errInvalidSeed
+	}
+	digest, err := blake2b.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+	digest.Write(s)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], index)
+	digest.Write(b[:])
+	private := digest.Sum(nil)
+	public := publicKey(private)
+	return &Key{
+		Private: strings.ToUpper(hex.EncodeToString(private)),
+		Public:  strings.ToUpper(hex.EncodeToString(public)),
+		Account: accountFromPublicKey(public),
+	}, nil
+}
+
+func publicKey(private []byte) []byte {
+	h := blake2b.Sum512(private)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	var scalar [32]byte
+	for i := range scalar {
+		scalar[i] = h[31-i]
+	}
+	x, y := scalarBaseMult(new(big.Int).SetBytes(scalar[:]))
+	ret := make([]byte, 32)
+	yb := y.Bytes()
+	for i := range yb {
+		ret[i] = yb[len(yb)-1-i]
+	}
+	ret[31] |= byte(x.Bit(0)) << 7
+	return ret
+}
+
+// point is a curve point in extended coordinates.
+type point struct {
+	x, y, z, t *big.Int
+}
+
+func (p *point) add(q *point) *point {
+	mod := func(v *big.Int) *big.Int { return v.Mod(v, curveP) }
+	mul := func(a, b *big.Int) *big.Int { return mod(new(big.Int).Mul(a, b)) }
+	a := mul(new(big.Int).Sub(p.y, p.x), new(big.Int).Sub(q.y, q.x))
+	b := mul(new(big.Int).Add(p.y, p.x), new(big.Int).Add(q.y, q.x))
+	c := mul(mul(p.t, curveD2), q.t)
+	d := mul(new(big.Int).Lsh(p.z, 1), q.z)
+	e := mod(new(big.Int).Sub(b, a))
+	f := mod(new(big.Int).Sub(d, c))
+	g := mod(new(big.Int).Add(d, c))
+	h := mod(new(big.Int).Add(b, a))
+	return &point{x: mul(e, f), y: mul(g, h), z: mul(f, g), t: mul(e, h)}
+}
+
+func identity() *point {
+	return &point{x: big.NewInt(0), y: big.NewInt(1), z: big.NewInt(1), t: big.NewInt(0)}
+}
+
+// baseTable[i][j] is j*16^i*B, so a scalar is multiplied with one addition per 4 bits.
+var (
+	baseTable     [64][16]*point
+	baseTableOnce sync.Once
+)
+
+func initBaseTable() {
+	p := &point{x: baseX, y: baseY, z: big.NewInt(1), t: new(big.Int).Mod(new(big.Int).Mul(baseX, baseY), curveP)}
+	for i := range baseTable {
+		baseTable[i][0] = identity()
+		for j := 1; j < 16; j++ {
+			baseTable[i][j] = baseTable[i][j-1].add(p)
+		}
+		p = baseTable[i][15].add(p)
+	}
+}
+
+func scalarBaseMult(k *big.Int) (x, y *big.Int) {
+	baseTableOnce.Do(initBaseTable)
+	q := identity()
+	for i := range baseTable {
+		var j uint
+		for b := 0; b < 4; b++ {
+			j |= k.Bit(4*i+b) << b
+		}
+		if j != 0 {
+			q = q.add(baseTable[i][j])
+		}
+	}
+	zInv := new(big.Int).ModInverse(q.z, curveP)
+	x = new(big.Int).Mod(new(big.Int).Mul(q.x, zInv), curveP)
+	y = new(big.Int).Mod(new(big.Int).Mul(q.y, zInv), curveP)
+	return x, y
+}
+
+// accountFromPublicKey encodes public key and its checksum with "nano_" prefix.
+func accountFromPublicKey(public []byte) string {
+	return "nano_" + encodeBase32(new(big.Int).SetBytes(public), 52) + encodeBase32(new(big.Int).SetBytes(accountChecksum(public)), 8)
+}
+
+// accountChecksum is the reversed 5 byte Blake2b hash of public key.
+func accountChecksum(public []byte) []byte {
+	digest, _ := blake2b.New(5, nil)
+	digest.Write(public)
+	sum := digest.Sum(nil)
+	for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+		sum[i], sum[j] = sum[j], sum[i]
+	}
+	return sum
+}
+
+func encodeBase32(n *big.Int, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = accountAlphabet[n.Uint64()&31]
+		n.Rsh(n, 5)
+	}
+	return string(b)
+}
+
+// ValidateAccount checks the encoding and checksum of an account with "nano_" or "xrb_" prefix.
+func ValidateAccount(account string) error {
+	var encoded string
+	switch {
+	case strings.HasPrefix(account, "nano_"):
+		encoded = account[len("nano_"):]
+	case strings.HasPrefix(account, "xrb_"):
+		encoded = account[len("xrb_"):]
+	default:
+		return ErrInvalidAccount
+	}
+	if len(encoded) != 60 || (encoded[0] != '1' && encoded[0] != '3') {
+		return ErrInvalidAccount
+	}
+	n := new(big.Int)
+	for _, c := range encoded[:52] {
+		i := strings.IndexRune(accountAlphabet, c)
+		if i < 0 {
+			return ErrInvalidAccount
+		}
+		n.Lsh(n, 5).Or(n, big.NewInt(int64(i)))
+	}
+	b := n.Bytes()
+	public := make([]byte, 32)
+	copy(public[32-len(b):], b)
+	if accountFromPublicKey(public)[len("nano_"):] != encoded {
+		return ErrInvalidAccount
+	}
+	return nil
+}
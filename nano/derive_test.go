@@ -0,0 +1,54 @@
+package nano // nolint: testpackage
+
+import "testing"
+
+func TestDeriveKey(t *testing.T) {
+	const seed = "0000000000000000000000000000000000000000000000000000000000000000"
+	cases := []Key{
+		{
+			Private: "9F0E444C69F77A49BD0BE89DB92C38FE713E0963165CCA12FAF5712D7657120F",
+			Public:  "C008B814A7D269A1FA3C6528B19201A24D797912DB9996FF02A1FF356E45552B",
+			Account: "nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b7",
+		},
+		{
+			Private: "B73B723BF7BD042B66AD3332718BA98DE7312F95ED3D05A130C9204552A7AFFF",
+			Public:  "E30D22B7935BCC25412FC07427391AB4C98A4AD68BAA733300D23D82C9D20AD3",
+			Account: "nano_3rrf6cus8pye6o1kzi5n6wwjof8bjb7ff4xcgesi3njxid6x64pms6onw1f9",
+		},
+	}
+	for i, expected := range cases {
+		key, err := DeriveKey(seed, uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *key != expected {
+			t.Errorf("key %d: %+v", i, key)
+		}
+		if err = ValidateAccount(key.Account); err != nil {
+			t.Errorf("derived account is invalid: %s", key.Account)
+		}
+	}
+	if _, err := DeriveKey("SEED", 0); err != errInvalidSeed {
+		t.Errorf("invalid seed is accepted: %v", err)
+	}
+}
+
+func TestValidateAccount(t *testing.T) {
+	for _, account := range []string{
+		"",
+		"nano_1merchant",
+		"btc_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b7",
+		// Checksum does not match.
+		"nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b8",
+		"nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b",
+		"nano_5i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b7",
+		"nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r32l",
+	} {
+		if ValidateAccount(account) == nil {
+			t.Errorf("invalid account %q is accepted", account)
+		}
+	}
+	if err := ValidateAccount("xrb_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b7"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,147 @@
+package nano
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Priority of a node request. When all slots of a Limiter are in use,
+// the next free slot is given to the waiting request with the highest priority.
+type Priority int
+
+const (
+	// PriorityBackground is for bulk jobs that can wait.
+	PriorityBackground Priority = iota
+	// PriorityChecker is for periodic checks of payments.
+	PriorityChecker
+	// PriorityInteractive is for requests made while a client is waiting for the response.
+	PriorityInteractive
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"background", "checker", "interactive"}
+
+func (p Priority) String() string {
+	if p < 0 || p >= numPriorities {
+		return "unknown"
+	}
+	return priorityNames[p]
+}
+
+// ErrThrottled is returned when a request cannot get a slot before the queue timeout of its priority.
+var ErrThrottled = errors.New("too many concurrent node requests")
+
+// Limiter limits the number of concurrent requests made to a node.
+type Limiter struct {
+	mu       sync.Mutex
+	free     int
+	queues   [numPriorities][]chan struct{}
+	timeouts [numPriorities]time.Duration
+	observer func(p Priority, wait time.Duration, throttled bool)
+}
+
+// NewLimiter returns a Limiter that allows limit concurrent requests.
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{free: limit}
+}
+
+// SetTimeout sets how long requests with priority p can wait for a slot. Zero means no limit.
+func (l *Limiter) SetTimeout(p Priority, d time.Duration) {
+	l.mu.Lock()
+	l.timeouts[p] = d
+	l.mu.Unlock()
+}
+
+// SetObserver sets a function that is called after a request gets a slot or gives up waiting.
+func (l *Limiter) SetObserver(f func(p Priority, wait time.Duration, throttled bool)) {
+	l.mu.Lock()
+	l.observer = f
+	l.mu.Unlock()
+}
+
+// Waiting returns the number of requests with priority p waiting for a slot.
+func (l *Limiter) Waiting(p Priority) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queues[p])
+}
+
+// Acquire waits for a free slot. Release must be called after the request is done.
+func (l *Limiter) Acquire(p Priority) error {
+	start := time.Now()
+	l.mu.Lock()
+	observer := l.observer
+	if l.free > 0 && !l.waitingFrom(p) {
+		l.free--
+		l.mu.Unlock()
+		if observer != nil {
+			observer(p, 0, false)
+		}
+		return nil
+	}
+	ready := make(chan struct{})
+	l.queues[p] = append(l.queues[p], ready)
+	timeout := l.timeouts[p]
+	l.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-ready:
+	case <-expired:
+		if l.dequeue(p, ready) {
+			if observer != nil {
+				observer(p, time.Since(start), true)
+			}
+			return ErrThrottled
+		}
+		// Slot is given to us at the same time with the timeout.
+	}
+	if observer != nil {
+		observer(p, time.Since(start), false)
+	}
+	return nil
+}
+
+// waitingFrom returns true if there are requests waiting with priority p or higher.
+func (l *Limiter) waitingFrom(p Priority) bool {
+	for ; p < numPriorities; p++ {
+		if len(l.queues[p]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dequeue removes ready from queue. Returns false if it is already removed by Release.
+func (l *Limiter) dequeue(p Priority, ready chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, c := range l.queues[p] {
+		if c == ready {
+			l.queues[p] = append(l.queues[p][:i], l.queues[p][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Release gives the slot to the first waiting request with the highest priority.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for p := numPriorities - 1; p >= 0; p-- {
+		if len(l.queues[p]) > 0 {
+			ready := l.queues[p][0]
+			l.queues[p] = l.queues[p][1:]
+			close(ready)
+			return
+		}
+	}
+	l.free++
+}
@@ -0,0 +1,68 @@
+package nano // nolint: testpackage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInteractiveRequestNotStarved(t *testing.T) {
+	const requestDuration = 100 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(requestDuration)
+		_, _ = w.Write([]byte(`{"private":"","public":"","account":"nano_1test"}`))
+	}))
+	defer ts.Close()
+	node := New(ts.URL)
+	limiter := NewLimiter(2)
+	node.SetLimiter(limiter)
+
+	// Enough background work to keep all slots busy for a second.
+	background := node.WithPriority(PriorityBackground)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = background.DeterministicKey("seed", "0")
+		}()
+	}
+	defer wg.Wait()
+	for limiter.Waiting(PriorityBackground) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Waits for at most one background request to finish, then runs.
+	const budget = 3 * requestDuration
+	start := time.Now()
+	_, err := node.DeterministicKey("seed", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > budget {
+		t.Fatalf("interactive request took %s", d)
+	}
+	if limiter.Waiting(PriorityBackground) == 0 {
+		t.Fatal("background requests are not queued")
+	}
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	limiter := NewLimiter(1)
+	limiter.SetTimeout(PriorityBackground, 10*time.Millisecond)
+	if err := limiter.Acquire(PriorityInteractive); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.Acquire(PriorityBackground); err != ErrThrottled {
+		t.Fatalf("expected ErrThrottled, got %v", err)
+	}
+	if limiter.Waiting(PriorityBackground) != 0 {
+		t.Fatal("timed out request is still queued")
+	}
+	limiter.Release()
+	if err := limiter.Acquire(PriorityBackground); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,30 +2,426 @@ package nano
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/log"
 )
 
+// Node is a client for node RPC. Requests are made with PriorityInteractive unless changed with WithPriority.
 type Node struct {
-	url    string
-	client http.Client
+	*conn
+	priority Priority
+	ctx      context.Context
 }
 
-func New(nodeURL string) *Node {
+// conn is shared by the views of a Node returned from WithPriority.
+type conn struct {
+	endpoints []*endpoint
+	client    http.Client
+	limiter   *Limiter
+
+	m             sync.Mutex
+	lastSuccessAt time.Time
+	lastFailureAt time.Time
+	observer      func(failed bool)
+	// Endpoint is skipped after this many consecutive failures until a request to it succeeds.
+	failureThreshold int
+	// Calls are given up after callTimeout, or after the timeout in actionTimeouts of their action. No limit if zero.
+	callTimeout    time.Duration
+	actionTimeouts map[string]time.Duration
+	// Calls of retriedActions are tried again this many times after backoff, doubled after each attempt.
+	retries int
+	backoff time.Duration
+	breaker breaker
+}
+
+// breaker fails calls fast for cooldown after threshold consecutive calls failed to reach any node.
+// After cooldown, one call is let through. The breaker closes if it succeeds and stays open for another cooldown if it fails.
+// Fields are guarded by conn.m.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// ErrCircuitOpen is returned without contacting the node while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("node is unavailable")
+
+// retriedActions only read from the node, so they are safe to send again after a failure.
+// Blocks are never published twice, so process and send are not retried.
+var retriedActions = map[string]bool{
+	"account_info":      true,
+	"accounts_balances": true,
+	"blocks_info":       true,
+	"deterministic_key": true,
+	"pending":           true,
+	"version":           true,
+}
+
+// endpoint is one of the node URLs. Fields other than url are guarded by conn.m.
+type endpoint struct {
+	url            string
+	failures       int
+	unhealthySince time.Time
+	lastError      string
+	lastSuccessAt  time.Time
+	lastFailureAt  time.Time
+}
+
+// EndpointStatus is the health of a node URL.
+type EndpointStatus struct {
+	// URL without user info.
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	UnhealthySince      *time.Time `json:"unhealthySince,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastSuccessAt       *time.Time `json:"lastSuccessAt,omitempty"`
+	LastFailureAt       *time.Time `json:"lastFailureAt,omitempty"`
+}
+
+const defaultFailureThreshold = 3
+
+// New returns a client for the nodes at nodeURLs. Requests are sent to the first healthy node in order.
+// A request is retried on the next node if the node cannot be reached.
+func New(nodeURLs ...string) *Node {
+	c := &conn{failureThreshold: defaultFailureThreshold}
+	for _, u := range nodeURLs {
+		c.endpoints = append(c.endpoints, &endpoint{url: u})
+	}
 	return &Node{
-		url: nodeURL,
+		conn:     c,
+		priority: PriorityInteractive,
 	}
 }
 
+// WithPriority returns a Node that makes requests with priority p.
+// Returned Node shares the connection, limiter and settings with n.
+func (n *Node) WithPriority(p Priority) *Node {
+	return &Node{conn: n.conn, priority: p, ctx: n.ctx}
+}
+
+// WithContext returns a Node that makes requests with ctx. Requests in progress are aborted when ctx is done.
+// Returned Node shares the connection, limiter and settings with n.
+func (n *Node) WithContext(ctx context.Context) *Node {
+	return &Node{conn: n.conn, priority: n.priority, ctx: ctx}
+}
+
+// SetLimiter limits concurrent requests made from all views of the Node.
+func (n *Node) SetLimiter(l *Limiter) {
+	n.limiter = l
+}
+
 func (n *Node) SetTimeout(d time.Duration) {
 	n.client.Timeout = d
 }
 
+func (n *Node) SetTransport(t http.RoundTripper) {
+	n.client.Transport = t
+}
+
+// SetObserver sets a function that is called after every request to the node.
+// failed is true if the node could not be reached.
+func (n *Node) SetObserver(f func(failed bool)) {
+	n.m.Lock()
+	n.observer = f
+	n.m.Unlock()
+}
+
+// SetFailureThreshold sets the number of consecutive failures after which a node is skipped.
+func (n *Node) SetFailureThreshold(threshold int) {
+	n.m.Lock()
+	n.failureThreshold = threshold
+	n.m.Unlock()
+}
+
+// SetCallTimeout limits the duration of calls, including retries and requests to other nodes.
+// Actions in byAction are given their own timeout, e.g. for work_generate.
+func (n *Node) SetCallTimeout(d time.Duration, byAction map[string]time.Duration) {
+	n.m.Lock()
+	n.callTimeout, n.actionTimeouts = d, byAction
+	n.m.Unlock()
+}
+
+// SetRetries sets how many times read-only calls are retried when no node can be reached.
+// Attempts wait backoff, doubled after each attempt, with random jitter.
+func (n *Node) SetRetries(retries int, backoff time.Duration) {
+	n.m.Lock()
+	n.retries, n.backoff = retries, backoff
+	n.m.Unlock()
+}
+
+// SetCircuitBreaker makes calls fail with ErrCircuitOpen for cooldown after threshold consecutive failed calls.
+// Breaker is disabled if threshold is zero.
+func (n *Node) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	n.m.Lock()
+	n.breaker = breaker{threshold: threshold, cooldown: cooldown}
+	n.m.Unlock()
+}
+
+// CircuitOpen returns true if calls fail fast because the node has failed recently.
+func (n *Node) CircuitOpen() bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.breaker.open(time.Now())
+}
+
+func (b *breaker) open(now time.Time) bool {
+	return b.threshold > 0 && b.failures >= b.threshold && now.Before(b.openUntil)
+}
+
+// allow returns true if a call can be made at now.
+func (b *breaker) allow(now time.Time) bool {
+	if b.open(now) {
+		return false
+	}
+	if b.threshold > 0 && b.failures >= b.threshold {
+		// Only this call is let through until it fails or cooldown passes again.
+		b.openUntil = now.Add(b.cooldown)
+	}
+	return true
+}
+
+// record adds the result of a call. It returns true if the breaker is opened by this failure.
+func (b *breaker) record(failed bool, now time.Time) (opened bool) {
+	if !failed {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return b.failures == b.threshold
+}
+
+// Endpoints returns the health of the node URLs in order.
+func (n *Node) Endpoints() []EndpointStatus {
+	n.m.Lock()
+	defer n.m.Unlock()
+	ret := make([]EndpointStatus, 0, len(n.endpoints))
+	for _, e := range n.endpoints {
+		s := EndpointStatus{
+			URL:                 redactURL(e.url),
+			Healthy:             e.unhealthySince.IsZero(),
+			ConsecutiveFailures: e.failures,
+			LastError:           e.lastError,
+			UnhealthySince:      timePtr(e.unhealthySince),
+			LastSuccessAt:       timePtr(e.lastSuccessAt),
+			LastFailureAt:       timePtr(e.lastFailureAt),
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// Probe sends a version request to the unhealthy nodes, so they are used again when they are back.
+func (n *Node) Probe() {
+	n.m.Lock()
+	var unhealthy []*endpoint
+	for _, e := range n.endpoints {
+		if !e.unhealthySince.IsZero() {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	n.m.Unlock()
+	data, _ := json.Marshal(map[string]interface{}{"action": "version"})
+	for _, e := range unhealthy {
+		var v Version
+		err := n.post(context.Background(), e.url, data, &v)
+		n.recordEndpoint(e, err)
+		if err == nil {
+			log.Noticef("node %s is healthy again", redactURL(e.url))
+		}
+	}
+}
+
+// candidates returns the healthy endpoints in order, or all of them if none is healthy.
+func (n *Node) candidates() []*endpoint {
+	n.m.Lock()
+	defer n.m.Unlock()
+	var ret []*endpoint
+	for _, e := range n.endpoints {
+		if e.unhealthySince.IsZero() {
+			ret = append(ret, e)
+		}
+	}
+	if len(ret) == 0 {
+		return n.endpoints
+	}
+	return ret
+}
+
+func (n *Node) recordEndpoint(e *endpoint, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	now := time.Now()
+	if !isUnreachable(err) {
+		e.failures, e.unhealthySince, e.lastSuccessAt = 0, time.Time{}, now
+		return
+	}
+	e.failures++
+	e.lastError, e.lastFailureAt = err.Error(), now
+	if e.failures >= n.failureThreshold && e.unhealthySince.IsZero() {
+		e.unhealthySince = now
+		log.Warningf("node %s is unhealthy after %d failures: %s", redactURL(e.url), e.failures, err)
+	}
+}
+
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.User = nil
+	return u.String()
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// LastContact returns the time of last successful and failed requests made to the node.
+// A request is failed if node could not be reached or it has responded with a non-2xx status code.
+func (n *Node) LastContact() (success, failure time.Time) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.lastSuccessAt, n.lastFailureAt
+}
+
+func (n *Node) recordContact(success bool) {
+	n.m.Lock()
+	if success {
+		n.lastSuccessAt = time.Now()
+	} else {
+		n.lastFailureAt = time.Now()
+	}
+	observer := n.observer
+	n.m.Unlock()
+	if observer != nil {
+		observer(!success)
+	}
+}
+
+// Call sends an RPC request that has no typed method, e.g. to check the raw responses that the typed methods depend on.
+func (n *Node) Call(action string, args map[string]interface{}, response interface{}) error {
+	return n.call(action, args, response)
+}
+
 func (n *Node) call(action string, args map[string]interface{}, response interface{}) error {
+	n.m.Lock()
+	allowed := n.breaker.allow(time.Now())
+	retries, backoff := n.retries, n.backoff
+	n.m.Unlock()
+	if !allowed {
+		return ErrCircuitOpen
+	}
+	if n.limiter != nil {
+		err := n.limiter.Acquire(n.priority)
+		if err != nil {
+			return err
+		}
+		defer n.limiter.Release()
+	}
+	ctx, cancel := n.callContext(action)
+	defer cancel()
+	err := n.doCall(ctx, action, args, response)
+	for i := 0; isUnreachable(err) && retriedActions[action] && i < retries && ctx.Err() == nil; i++ {
+		if !sleepContext(ctx, jitter(backoff<<uint(i))) {
+			break
+		}
+		log.Debugf("retrying node request %s after: %s", action, err)
+		err = n.doCall(ctx, action, args, response)
+	}
+	// Calls given up by the caller do not tell anything about the node.
+	if n.ctx == nil || n.ctx.Err() == nil {
+		n.recordCall(action, isUnreachable(err))
+	}
+	n.recordContact(!isUnreachable(err))
+	return err
+}
+
+// callContext returns the context of a call of action, with the timeout of the action.
+func (n *Node) callContext(action string) (context.Context, context.CancelFunc) {
+	ctx := n.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	n.m.Lock()
+	timeout, ok := n.actionTimeouts[action]
+	if !ok {
+		timeout = n.callTimeout
+	}
+	n.m.Unlock()
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (n *Node) recordCall(action string, failed bool) {
+	n.m.Lock()
+	opened := n.breaker.record(failed, time.Now())
+	cooldown := n.breaker.cooldown
+	n.m.Unlock()
+	if opened {
+		log.Warningf("node calls fail fast for %s after %s failed", cooldown, action)
+	}
+}
+
+// jitter returns a random duration between d/2 and 3d/2.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// sleepContext waits for d. It returns false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// IsUnavailable returns true if err indicates that the node could not be contacted or that the circuit breaker is open.
+func IsUnavailable(err error) bool {
+	return err == ErrCircuitOpen || isUnreachable(err)
+}
+
+// isUnreachable returns true if err indicates that the node could not be contacted.
+func isUnreachable(err error) bool {
+	switch err.(type) {
+	case nil, *NodeError:
+		return false
+	case *HTTPError:
+		return true
+	}
+	// Errors from net and net/http packages.
+	_, ok := err.(interface{ Timeout() bool })
+	return ok
+}
+
+// doCall sends the request to the candidate nodes in order until one of them can be reached.
+func (n *Node) doCall(ctx context.Context, action string, args map[string]interface{}, response interface{}) error {
 	if args == nil {
 		args = make(map[string]interface{})
 	}
@@ -35,11 +431,24 @@ func (n *Node) call(action string, args map[string]interface{}, response interfa
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", n.url, bytes.NewReader(data))
+	for _, e := range n.candidates() {
+		err = n.post(ctx, e.url, data, response)
+		n.recordEndpoint(e, err)
+		if !isUnreachable(err) || ctx.Err() != nil {
+			return err
+		}
+		log.Debugf("node %s cannot be reached: %s", redactURL(e.url), err)
+	}
+	return err
+}
+
+func (n *Node) post(ctx context.Context, nodeURL string, data []byte, response interface{}) error {
+	req, err := http.NewRequest("POST", nodeURL, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
 	resp, err := n.client.Do(req)
 	if err != nil {
 		return err
@@ -49,9 +458,13 @@ func (n *Node) call(action string, args map[string]interface{}, response interfa
 	if err != nil {
 		return err
 	}
-	log.Debugf("node response: %#v", string(body))
+	log.Debugf("node response from %s: %#v", redactURL(nodeURL), string(body))
 	var errorResponse NodeError
 	err = json.Unmarshal(body, &errorResponse)
+	if err != nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		// A proxy in front of the node may respond with HTML.
+		return &HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
 	if err != nil {
 		return err
 	}
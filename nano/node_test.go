@@ -0,0 +1,113 @@
+package nano // nolint: testpackage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNodeFailover(t *testing.T) {
+	var down int32 = 1
+	var primaryHits, backupHits int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryHits, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "<html>bad gateway</html>", http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"node_vendor":"primary"}`))
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backupHits, 1)
+		_, _ = w.Write([]byte(`{"node_vendor":"backup"}`))
+	}))
+	defer backup.Close()
+	node := New(primary.URL, backup.URL)
+	node.SetFailureThreshold(2)
+
+	for i := 0; i < 4; i++ {
+		v, err := node.Version()
+		if err != nil || v.NodeVendor != "backup" {
+			t.Fatalf("request is not served by backup: %v %+v", err, v)
+		}
+	}
+	// Primary is skipped after 2 failures.
+	if n := atomic.LoadInt32(&primaryHits); n != 2 {
+		t.Errorf("primary is tried %d times", n)
+	}
+	if e := node.Endpoints(); e[0].Healthy || e[0].ConsecutiveFailures != 2 || e[0].LastError == "" || !e[1].Healthy {
+		t.Fatalf("unexpected endpoints: %+v", e)
+	}
+
+	// Probe brings primary back.
+	node.Probe()
+	if node.Endpoints()[0].Healthy {
+		t.Fatal("primary is healthy while it is down")
+	}
+	atomic.StoreInt32(&down, 0)
+	node.Probe()
+	v, err := node.Version()
+	if err != nil || v.NodeVendor != "primary" || !node.Endpoints()[0].Healthy {
+		t.Fatalf("request is not served by primary: %v %+v", err, v)
+	}
+}
+
+func TestNodeRetriesAndBreaker(t *testing.T) {
+	var hits, failures int32
+	var hang int32
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&hang) == 1 {
+			<-release
+			return
+		}
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "<html>bad gateway</html>", http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"node_vendor":"node"}`))
+	}))
+	defer s.Close()
+	defer close(release)
+	node := New(s.URL)
+	node.SetFailureThreshold(100)
+	node.SetRetries(2, time.Millisecond)
+	node.SetCallTimeout(50*time.Millisecond, nil)
+	node.SetCircuitBreaker(2, 100*time.Millisecond)
+
+	// Reads are retried.
+	atomic.StoreInt32(&failures, 2)
+	if _, err := node.Version(); err != nil || atomic.LoadInt32(&hits) != 3 {
+		t.Fatalf("version is not retried: %v %d", err, hits)
+	}
+	// Blocks are not published again.
+	atomic.StoreInt32(&hits, 0)
+	atomic.StoreInt32(&failures, 1)
+	if err := node.Call("process", nil, nil); err == nil || atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("process is retried: %v %d", err, hits)
+	}
+
+	// Hanging calls time out. Breaker opens after the failed process call and this one.
+	atomic.StoreInt32(&hang, 1)
+	if _, err := node.Version(); !IsUnavailable(err) {
+		t.Fatalf("call does not time out: %v", err)
+	}
+	if !node.CircuitOpen() {
+		t.Fatal("breaker is not open")
+	}
+	atomic.StoreInt32(&hits, 0)
+	if _, err := node.Version(); err != ErrCircuitOpen || atomic.LoadInt32(&hits) != 0 {
+		t.Fatalf("call does not fail fast: %v %d", err, hits)
+	}
+
+	// A call is let through after cooldown and closes the breaker.
+	atomic.StoreInt32(&hang, 0)
+	time.Sleep(110 * time.Millisecond)
+	if _, err := node.Version(); err != nil || node.CircuitOpen() {
+		t.Fatalf("breaker is not closed: %v", err)
+	}
+}
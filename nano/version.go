@@ -0,0 +1,18 @@
+package nano
+
+// Version is the response of version RPC.
+type Version struct {
+	RPCVersion      string `json:"rpc_version"`
+	StoreVersion    string `json:"store_version"`
+	ProtocolVersion string `json:"protocol_version"`
+	// Name and version of the node software, e.g. "Nano V21.3".
+	NodeVendor string `json:"node_vendor"`
+	Network    string `json:"network"`
+	BuildInfo  string `json:"build_info"`
+}
+
+func (n *Node) Version() (*Version, error) {
+	var response Version
+	err := n.call("version", nil, &response)
+	return &response, err
+}
@@ -0,0 +1,21 @@
+package nano
+
+// Send sends amount (in raw) from source, an account in the node wallet, to destination.
+// Node does not send a second block for the same id, so a failed request can be retried with it.
+func (n *Node) Send(wallet, source, destination, amount, id string) (string, error) {
+	args := map[string]interface{}{
+		"wallet":      wallet,
+		"source":      source,
+		"destination": destination,
+		"amount":      amount,
+		"id":          id,
+	}
+	var response struct {
+		Block string `json:"block"`
+	}
+	err := n.call("send", args, &response)
+	if err != nil {
+		return "", err
+	}
+	return response.Block, nil
+}
@@ -55,7 +55,7 @@ func (w *Websocket) Send(action, topic string, ack bool, options map[string]inte
 	log.Debugf("sending websocket message: %#v", m)
 	err := websocket.JSON.Send(w.conn, m)
 	if err != nil {
-		return nil
+		return err
 	}
 	if ack {
 		var ackMsg struct {
@@ -3,8 +3,11 @@ package nano
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
 	"runtime"
+	"strconv"
 
 	"github.com/cenkalti/log"
 	"golang.org/x/crypto/blake2b"
@@ -13,7 +16,23 @@ import (
 var workThresholdForSend uint64 = 0xff00000000000000
 var workThresholdForRecv uint64 = 0xff00000000000000
 
+// WorkThreshold returns the difficulty of the work from GenerateWork in hex, as in the difficulty parameter of work_validate.
+func WorkThreshold(forSend bool) string {
+	if forSend {
+		return fmt.Sprintf("%016x", workThresholdForSend)
+	}
+	return fmt.Sprintf("%016x", workThresholdForRecv)
+}
+
 func GenerateWork(hash string, forSend bool) (string, error) {
+	if forSend {
+		return GenerateWorkWithThreshold(hash, workThresholdForSend)
+	}
+	return GenerateWorkWithThreshold(hash, workThresholdForRecv)
+}
+
+// GenerateWorkWithThreshold generates work for hash whose difficulty is at least workThreshold.
+func GenerateWorkWithThreshold(hash string, workThreshold uint64) (string, error) {
 	b, err := hex.DecodeString(hash)
 	if err != nil {
 		return "", err
@@ -23,12 +42,6 @@ func GenerateWork(hash string, forSend bool) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	var workThreshold uint64
-	if forSend {
-		workThreshold = workThresholdForSend
-	} else {
-		workThreshold = workThresholdForRecv
-	}
 	var nonce uint64
 	log.Debug("starting work")
 	for ; !validateWork(digest, b, nonce, workThreshold); nonce++ {
@@ -42,6 +55,43 @@ func GenerateWork(hash string, forSend bool) (string, error) {
 	return hex.EncodeToString(work), nil
 }
 
+// ValidateWork returns true if work for hash, both in hex, has a difficulty of at least workThreshold.
+func ValidateWork(hash, work string, workThreshold uint64) bool {
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	nonce, err := strconv.ParseUint(work, 16, 64)
+	if err != nil {
+		return false
+	}
+	const hashSize = 8
+	digest, err := blake2b.New(hashSize, nil)
+	if err != nil {
+		return false
+	}
+	return validateWork(digest, b, nonce, workThreshold)
+}
+
+// WorkGenerate requests work for hash with at least difficulty, in hex, from the node or a work server.
+func (n *Node) WorkGenerate(hash, difficulty string) (string, error) {
+	args := map[string]interface{}{
+		"hash":       hash,
+		"difficulty": difficulty,
+	}
+	var response struct {
+		Work string `json:"work"`
+	}
+	err := n.call("work_generate", args, &response)
+	if err != nil {
+		return "", err
+	}
+	if response.Work == "" {
+		return "", errors.New("invalid node response")
+	}
+	return response.Work, nil
+}
+
 func validateWork(digest hash.Hash, block []byte, work uint64, workThreshold uint64) bool {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, work)
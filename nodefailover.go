@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+// nodeURLs returns the node URLs in the order they are tried.
+func nodeURLs() []string {
+	if len(config.NodeURLs) > 0 {
+		return config.NodeURLs
+	}
+	return []string{config.NodeURL}
+}
+
+// configureNodeCalls sets the call timeouts, retries and circuit breaker of n from config.
+func configureNodeCalls(n *nano.Node) {
+	n.SetCallTimeout(time.Duration(config.NodeCallTimeout)*time.Millisecond, map[string]time.Duration{
+		// Work may take long to generate on the node.
+		"work_generate": time.Duration(config.NodeTimeout) * time.Millisecond,
+	})
+	n.SetRetries(config.NodeRetries, time.Duration(config.NodeRetryBackoff)*time.Millisecond)
+	n.SetCircuitBreaker(config.NodeBreakerThreshold, time.Duration(config.NodeBreakerCooldown)*time.Second)
+}
+
+// writeNodeUnavailable writes the response of /api/pay when no node can be reached or the circuit breaker is open.
+func writeNodeUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(config.NodeBreakerCooldown))
+	writeError(w, errCodeNodeUnavailable, http.StatusServiceUnavailable, "node is unavailable")
+}
+
+// handleAdminNodes returns the health of the node URLs in the order they are tried.
+func handleAdminNodes(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, node.Endpoints())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestPayNodeUnavailable(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	var hits int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.Error(w, "<html>bad gateway</html>", http.StatusBadGateway)
+	}))
+	t.Cleanup(s.Close)
+	oldNode := node
+	node = nano.New(s.URL)
+	t.Cleanup(func() { node = oldNode })
+	config.NodeRetries, config.NodeBreakerThreshold = -1, 1
+	t.Cleanup(func() { config.NodeRetries, config.NodeBreakerThreshold = 0, 0 })
+	configureNodeCalls(node)
+	pay := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader("amount=1"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+
+	// Unreachable node opens the breaker, then requests fail without calling the node.
+	expectErrorCode(t, pay(), http.StatusServiceUnavailable, errCodeNodeUnavailable)
+	w := pay()
+	expectErrorCode(t, w, http.StatusServiceUnavailable, errCodeNodeUnavailable)
+	if hits != 1 || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("unexpected node requests or Retry-After: %d %q", hits, w.Header().Get("Retry-After"))
+	}
+}
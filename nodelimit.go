@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+// Node requests are limited by NodeConcurrency and share the slots in priority order:
+// API handlers use node directly, payment checks and fund movements use checkerNode,
+// bulk jobs use backgroundNode.
+
+var (
+	metricNodeQueueWaits       = expvar.NewMap("node_queue_waits_total")
+	metricNodeQueueWaitSeconds = expvar.NewMap("node_queue_wait_seconds_total")
+	metricNodeThrottled        = expvar.NewMap("node_requests_throttled_total")
+)
+
+// nodeLimiter is nil if node requests are not limited.
+var nodeLimiter *nano.Limiter
+
+func checkerNode() *nano.Node { return node.WithPriority(nano.PriorityChecker) }
+
+func backgroundNode() *nano.Node { return node.WithPriority(nano.PriorityBackground) }
+
+func newNodeLimiter() *nano.Limiter {
+	l := nano.NewLimiter(config.NodeConcurrency)
+	l.SetTimeout(nano.PriorityInteractive, time.Duration(config.NodeQueueTimeoutInteractive)*time.Millisecond)
+	l.SetTimeout(nano.PriorityChecker, time.Duration(config.NodeQueueTimeoutChecker)*time.Millisecond)
+	l.SetTimeout(nano.PriorityBackground, time.Duration(config.NodeQueueTimeoutBackground)*time.Millisecond)
+	l.SetObserver(observeNodeQueue)
+	return l
+}
+
+func observeNodeQueue(p nano.Priority, wait time.Duration, throttled bool) {
+	if wait == 0 {
+		return
+	}
+	metricNodeQueueWaits.Add(p.String(), 1)
+	metricNodeQueueWaitSeconds.AddFloat(p.String(), wait.Seconds())
+	if throttled {
+		metricNodeThrottled.Add(p.String(), 1)
+	}
+}
+
+// nodeThrottled returns true if requests with priority p are waiting for a free slot.
+func nodeThrottled(p nano.Priority) bool {
+	return nodeLimiter != nil && nodeLimiter.Waiting(p) > 0
+}
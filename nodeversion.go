@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Payments are stamped with the software versions when they are created and funds are moved,
+// so that the behavior of old payments can be investigated later.
+
+// Operations stamped in Payment.OperationVersions.
+const (
+	operationReceive = "receive"
+	operationFee     = "fee"
+	operationSend    = "send"
+	operationRefund  = "refund"
+)
+
+var nodeMajorVersionRegexp = regexp.MustCompile(`[Vv](\d+)`)
+
+// SoftwareVersions identifies the software running at the time of an operation.
+type SoftwareVersions struct {
+	AcceptNano string `json:"acceptNano"`
+	// node_vendor of version RPC. Empty if it could not be fetched yet.
+	Node string `json:"node,omitempty"`
+}
+
+func currentVersions() SoftwareVersions {
+	return SoftwareVersions{AcceptNano: Version, Node: nodeVersion.get()}
+}
+
+// stampOperation records current versions for operation.
+func (p *Payment) stampOperation(operation string) {
+	if p.OperationVersions == nil {
+		p.OperationVersions = make(map[string]SoftwareVersions)
+	}
+	p.OperationVersions[operation] = currentVersions()
+}
+
+// operationVersions returns the versions stamped for operation. Versions at creation are returned for receive
+// because payments received by older versions do not have the stamp. Empty if not stamped.
+func (p *Payment) operationVersions(operation string) SoftwareVersions {
+	if v, ok := p.OperationVersions[operation]; ok {
+		return v
+	}
+	if operation == operationReceive && p.CreatedWith != nil {
+		return *p.CreatedWith
+	}
+	return SoftwareVersions{}
+}
+
+// nodeVersionCache keeps the version of the node which is refreshed every NodeVersionRefreshInterval.
+// The operator is notified when the major version of the node changes.
+type nodeVersionCache struct {
+	notify func(kind, message string, details map[string]interface{})
+
+	m      sync.Mutex
+	vendor string
+	major  int
+}
+
+var nodeVersion = &nodeVersionCache{notify: sendAlert}
+
+func (c *nodeVersionCache) get() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.vendor
+}
+
+// update sets the node version.
+func (c *nodeVersionCache) update(vendor string) {
+	var major int
+	if m := nodeMajorVersionRegexp.FindStringSubmatch(vendor); m != nil {
+		major, _ = strconv.Atoi(m[1])
+	}
+	c.m.Lock()
+	previous, previousMajor := c.vendor, c.major
+	c.vendor = vendor
+	if major > 0 {
+		c.major = major
+	}
+	c.m.Unlock()
+	if previousMajor > 0 && major > 0 && major != previousMajor {
+		c.notify("node_version_changed",
+			fmt.Sprintf("node major version changed from %d to %d, RPC behavior may differ", previousMajor, major),
+			map[string]interface{}{"previous": previous, "current": vendor})
+	}
+}
+
+func refreshNodeVersion() error {
+	v, err := backgroundNode().Version()
+	if err != nil {
+		return err
+	}
+	nodeVersion.update(v.NodeVendor)
+	return nil
+}
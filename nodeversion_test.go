@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestVersionStampsSurviveSaveLoad(t *testing.T) {
+	openTestDB(t, 0)
+	nodeVersion.update("Nano V21.3")
+	t.Cleanup(func() { nodeVersion = &nodeVersionCache{notify: sendAlert} })
+	versions := currentVersions()
+	p := &Payment{Account: "nano_1stamped", CreatedWith: &versions}
+	p.stampOperation(operationSend)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.CreatedWith == nil || *loaded.CreatedWith != versions || versions.Node != "Nano V21.3" {
+		t.Fatalf("creation stamp is lost: %+v", loaded.CreatedWith)
+	}
+	if loaded.operationVersions(operationSend) != versions || loaded.operationVersions(operationReceive) != versions {
+		t.Fatalf("operation stamps are lost: %+v", loaded.OperationVersions)
+	}
+	if v := loaded.operationVersions(operationFee); v != (SoftwareVersions{}) {
+		t.Fatalf("unexpected fee stamp: %+v", v)
+	}
+}
+
+func TestNodeVersionChangeNotification(t *testing.T) {
+	vendor := "Nano V21.3"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"rpc_version": "1", "node_vendor": vendor})
+	}))
+	defer ts.Close()
+	oldNode := node
+	node = nano.New(ts.URL)
+	defer func() { node = oldNode }()
+	var alerts []string
+	nodeVersion = &nodeVersionCache{notify: func(kind, message string, details map[string]interface{}) { alerts = append(alerts, kind) }}
+	defer func() { nodeVersion = &nodeVersionCache{notify: sendAlert} }()
+
+	for _, v := range []string{"Nano V21.3", "Nano V21.3", "Nano V22.0", "Nano V22.0", "Nano V22.1"} {
+		vendor = v
+		if err := refreshNodeVersion(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nodeVersion.get() != "Nano V22.1" {
+		t.Fatalf("unexpected version: %s", nodeVersion.get())
+	}
+	if len(alerts) != 1 || alerts[0] != "node_version_changed" {
+		t.Fatalf("unexpected alerts: %v", alerts)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// tagsBucket indexes payments by their tags with "<tag>\x00<account>" keys.
+const tagsBucket = "tags"
+
+const (
+	maxPaymentNotes = 100
+	maxNoteLength   = 2000
+	maxPaymentTags  = 20
+)
+
+var tagRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,63}$`)
+
+// PaymentNote is a note left by an operator investigating the payment.
+type PaymentNote struct {
+	Text      string    `json:"text"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func tagIndexKey(tag, account string) []byte {
+	return []byte(tag + "\x00" + account)
+}
+
+func tagIndexPrefix(tag string) []byte {
+	return []byte(tag + "\x00")
+}
+
+// setTags replaces the tags of the payment. The index is updated when the payment is saved.
+func (p *Payment) setTags(tags []string) {
+	if !p.tagsChanged {
+		p.oldTags = p.Tags
+		p.tagsChanged = true
+	}
+	p.Tags = tags
+}
+
+// saveTagIndex updates the index for the tags changed since the last save.
+func (p *Payment) saveTagIndex(tx *bbolt.Tx) error {
+	if !p.tagsChanged {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(tagsBucket))
+	if err != nil {
+		return err
+	}
+	for _, tag := range p.oldTags {
+		if err = b.Delete(tagIndexKey(tag, p.Account)); err != nil {
+			return err
+		}
+	}
+	for _, tag := range p.Tags {
+		if err = b.Put(tagIndexKey(tag, p.Account), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findPaymentsByTag returns at most limit payments with the tag that match the state, if set, and the metadata filter.
+// truncated is true if there are more.
+func findPaymentsByTag(tag, state string, filter *metadataFilter, limit int) (payments []*Payment, truncated bool, err error) {
+	payments, err = store.List(PaymentFilter{State: state, Tag: tag, Match: filter.match, Limit: limit + 1})
+	if len(payments) > limit {
+		payments, truncated = payments[:limit], true
+	}
+	return
+}
+
+// parseTags returns the sorted unique tags in tag parameters.
+func parseTags(values []string) ([]string, bool) {
+	seen := make(map[string]bool, len(values))
+	tags := make([]string, 0, len(values))
+	for _, tag := range values {
+		if !tagRegexp.MatchString(tag) {
+			return nil, false
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, len(tags) <= maxPaymentTags
+}
+
+// updatePayment loads the payment in account or id parameter, calls f and saves the payment if f returns true.
+// f must write the error response if it returns false.
+// It returns the saved payment, or nil if an error response is written.
+func updatePayment(w http.ResponseWriter, r *http.Request, f func(p *Payment) bool) *Payment {
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return nil
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if !f(payment) {
+		return nil
+	}
+	if err = payment.Save(); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return payment
+}
+
+// handleAdminPaymentNotes appends a note to the payment. Notes cannot be changed or removed.
+func handleAdminPaymentNotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	p := updatePayment(w, r, func(p *Payment) bool {
+		text := r.FormValue("text")
+		if text == "" || len(text) > maxNoteLength {
+			http.Error(w, "invalid text", http.StatusBadRequest)
+			return false
+		}
+		if len(p.Notes) >= maxPaymentNotes {
+			http.Error(w, "payment has too many notes", http.StatusConflict)
+			return false
+		}
+		note := PaymentNote{Text: text, Author: adminIdentity(r), CreatedAt: *now()}
+		p.Notes = append(p.Notes, note)
+		log.Noticef("note added to %s by %s", p.Account, note.Author)
+		return true
+	})
+	if p != nil {
+		writeAdminJSON(w, p)
+	}
+}
+
+// handleAdminPaymentTags replaces the tags of the payment with the ones in tag parameters.
+func handleAdminPaymentTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "PUT only", http.StatusMethodNotAllowed)
+		return
+	}
+	p := updatePayment(w, r, func(p *Payment) bool {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		tags, ok := parseTags(r.Form["tag"])
+		if !ok {
+			http.Error(w, "invalid tags", http.StatusBadRequest)
+			return false
+		}
+		log.Noticef("tags of %s set by %s: %v -> %v", p.Account, adminIdentity(r), p.Tags, tags)
+		p.setTags(tags)
+		return true
+	})
+	if p != nil {
+		writeAdminJSON(w, p)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func putTags(account string, tags ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(url.Values{"account": {account}, "tag": tags}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(adminName, "")
+	w := httptest.NewRecorder()
+	handleAdminPaymentTags(w, r)
+	return w
+}
+
+func TestPaymentNotes(t *testing.T) {
+	openTestDB(t, 0)
+	p := &Payment{Account: "nano_1noted"}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"customer called", "refund promised"} {
+		w := postAdminForm(handleAdminPaymentNotes, url.Values{"account": {p.Account}, "text": {text}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("cannot add note: %d %s", w.Code, w.Body)
+		}
+	}
+	w := postAdminForm(handleAdminPaymentNotes, url.Values{"account": {p.Account}, "text": {strings.Repeat("x", maxNoteLength+1)}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("long note is accepted: %d", w.Code)
+	}
+	p, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Notes) != 2 || p.Notes[0].Text != "customer called" || p.Notes[1].Author != adminName || p.Notes[1].CreatedAt.IsZero() {
+		t.Fatalf("unexpected notes: %+v", p.Notes)
+	}
+
+	for len(p.Notes) < maxPaymentNotes {
+		p.Notes = append(p.Notes, PaymentNote{Text: "x"})
+	}
+	if err = p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	w = postAdminForm(handleAdminPaymentNotes, url.Values{"account": {p.Account}, "text": {"one more"}})
+	if w.Code != http.StatusConflict {
+		t.Errorf("note over the limit is accepted: %d", w.Code)
+	}
+}
+
+func TestPaymentTags(t *testing.T) {
+	openTestDB(t, 0)
+	for _, account := range []string{"nano_1tagged", "nano_1other"} {
+		p := &Payment{Account: account, State: "order-1"}
+		if err := p.create(statePolicy{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(query string) []*Payment {
+		r := httptest.NewRequest(http.MethodGet, "/admin/payments/search?"+query, nil)
+		w := httptest.NewRecorder()
+		handleAdminSearchPayments(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("cannot search: %d %s", w.Code, w.Body)
+		}
+		var body struct {
+			Payments []*Payment
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Payments
+	}
+
+	if w := putTags("nano_1tagged", "chargeback-risk", "vip", "vip"); w.Code != http.StatusOK {
+		t.Fatalf("cannot set tags: %d %s", w.Code, w.Body)
+	}
+	if w := putTags("nano_1other", "vip"); w.Code != http.StatusOK {
+		t.Fatalf("cannot set tags: %d %s", w.Code, w.Body)
+	}
+	if payments := search("tag=chargeback-risk"); len(payments) != 1 || payments[0].Account != "nano_1tagged" {
+		t.Fatalf("unexpected payments: %+v", payments)
+	}
+	if payments := search("tag=vip&state=order-1"); len(payments) != 2 || payments[1].Tags[0] != "chargeback-risk" {
+		t.Fatalf("unexpected payments: %+v", payments)
+	}
+
+	// Removed tags are removed from the index.
+	if w := putTags("nano_1tagged", "vip"); w.Code != http.StatusOK {
+		t.Fatalf("cannot set tags: %d %s", w.Code, w.Body)
+	}
+	if payments := search("tag=chargeback-risk"); len(payments) != 0 {
+		t.Fatalf("removed tag is found: %+v", payments)
+	}
+	many := make([]string, maxPaymentTags+1)
+	for i := range many {
+		many[i] = "tag-" + string(rune('a'+i))
+	}
+	for _, tags := range [][]string{{"Chargeback Risk"}, {""}, many} {
+		if w := putTags("nano_1tagged", tags...); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid tags %q are accepted: %d", tags, w.Code)
+		}
+	}
+}
@@ -1,18 +1,170 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/cenkalti/log"
 	"github.com/shopspring/decimal"
 )
 
 type Notification struct {
+	// Empty for verified payments. Set to "late_paid" when funds arrive after the payment is expired,
+	// to "expired_credit" when funds of an expired payment are to be credited to the customer
+	// and to "final" when funds are moved to their final place.
+	Event            string          `json:"event,omitempty"`
+	PaymentID        string          `json:"paymentId"`
 	Account          string          `json:"account"`
 	Amount           decimal.Decimal `json:"amount"`
-	AmountInCurrency decimal.Decimal `json:"amountInCurrency"`
+	AmountInCurrency CurrencyAmount  `json:"amountInCurrency"`
 	Currency         string          `json:"currency"`
 	Balance          decimal.Decimal `json:"balance"`
-	State            string          `json:"state"`
-	Fulfilled        bool            `json:"fulfilled"`
-	FulfilledAt      *time.Time      `json:"fulfillAt"`
+	// Balance in raw and the amount received over Amount, if any.
+	AmountReceivedRaw string           `json:"amountReceivedRaw"`
+	Overpaid          *decimal.Decimal `json:"overpaid,omitempty"`
+	State             string           `json:"state"`
+	Fulfilled         bool             `json:"fulfilled"`
+	FulfilledAt       *time.Time       `json:"fulfillAt"`
+	SatisfiedBy       []SatisfiedBlock `json:"satisfiedBy"`
+	// Set for payments created from a preset with metadata.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Set for sandbox payments. No funds are received for them.
+	Sandbox bool `json:"sandbox,omitempty"`
+	// Set in "final" event.
+	Summary *FinancialSummary `json:"summary,omitempty"`
+	// Set in "expired_credit" event.
+	Credit *ExpiryCredit `json:"credit,omitempty"`
+}
+
+func (p *Payment) notification() *Notification {
+	return &Notification{
+		PaymentID:         p.PaymentID,
+		Account:           p.Account,
+		Amount:            RawToNano(p.Amount),
+		AmountInCurrency:  p.AmountInCurrency,
+		Currency:          p.Currency,
+		Balance:           RawToNano(p.Balance),
+		AmountReceivedRaw: p.Balance.String(),
+		Overpaid:          rawToNanoPtr(p.overpaid()),
+		State:             p.State,
+		Fulfilled:         p.FulfilledAt != nil,
+		FulfilledAt:       p.FulfilledAt,
+		SatisfiedBy:       p.SatisfiedBy,
+		Metadata:          p.Metadata,
+		Sandbox:           p.Sandbox,
+	}
+}
+
+// validNotificationURL returns true if s is an absolute HTTP URL.
+func validNotificationURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// notificationSignature returns the value of X-Signature header for the notification body.
+func notificationSignature(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(data)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverNotification posts the encoded notification to url.
+func deliverNotification(client *http.Client, url string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.NotificationSecret != "" {
+		req.Header.Set("X-Signature", notificationSignature(config.NotificationSecret, data))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := resp.Body.Close(); err2 != nil {
+			log.Debug(err2)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad notification response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordNotificationError saves the failed attempt to notify the merchant.
+// Notifying is given up when the attempts reach NotificationMaxAttempts.
+func (p *Payment) recordNotificationError(err error) {
+	p.NotificationAttempts++
+	p.NotificationError = err.Error()
+	if config.NotificationMaxAttempts == 0 || p.NotificationAttempts < config.NotificationMaxAttempts || p.NotifiedAt != nil || p.NotificationFailedAt != nil {
+		return
+	}
+	p.NotificationFailedAt = now()
+	log.Errorf("giving up notifying merchant of %s after %d attempts: %s", p.logName(), p.NotificationAttempts, err)
+	sendAlert("notification_failed", fmt.Sprintf("giving up notifying merchant of %s after %d attempts", p.Account, p.NotificationAttempts), map[string]interface{}{"account": p.Account, "error": p.NotificationError})
+}
+
+// handleAdminNotify posts the notification of a verified payment to the merchant again.
+func handleAdminNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if payment.FulfilledAt == nil {
+		http.Error(w, errPaymentNotFulfilled.Error(), http.StatusConflict)
+		return
+	}
+	err = payment.notifyMerchant()
+	if err != nil {
+		payment.recordNotificationError(err)
+	} else {
+		payment.NotificationError = ""
+		if payment.NotifiedAt == nil {
+			payment.NotifiedAt = now()
+		}
+	}
+	if err2 := payment.Save(); err2 != nil {
+		log.Error(err2)
+		http.Error(w, err2.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeAdminJSON(w, payment)
 }
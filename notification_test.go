@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNotificationRetries(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.NotificationSecret = "secret"
+	config.NotificationMaxAttempts = 2
+	t.Cleanup(func() { config.NotificationSecret, config.NotificationMaxAttempts = "", 0 })
+	failing := true
+	var signature, expected string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature, expected = r.Header.Get("X-Signature"), notificationSignature("secret", body)
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	p := &Payment{Account: "nano_1notify", NotificationURL: ts.URL, FulfilledAt: now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.runStep(stepNotify); err == nil || p.NotificationAttempts != 1 || p.nextStep() != stepNotify {
+		t.Fatalf("failed notification is not retried: %v %+v", err, p)
+	}
+	if signature == "" || signature != expected {
+		t.Fatalf("bad signature: %q", signature)
+	}
+	// Payment moves on after the last attempt.
+	if err := p.runStep(stepNotify); err != nil || p.NotificationFailedAt == nil || p.nextStep() != stepReceive {
+		t.Fatalf("notification is not given up: %v %+v", err, p)
+	}
+
+	failing = false
+	w := postAdminForm(handleAdminNotify, url.Values{"account": {p.Account}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot notify again: %d %s", w.Code, w.Body)
+	}
+	p, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.NotifiedAt == nil || p.NotificationError != "" {
+		t.Fatalf("notification is not saved: %+v", p)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	exportsBucket = "exports"
+	// Number of payments read from database in a single transaction while exporting.
+	// Transaction is closed during uploads so a slow upload does not block compaction.
+	exportPageSize = 1000
+	// Smallest part size allowed by S3 for parts other than the last one.
+	minExportPartSize = 5 << 20
+)
+
+var errExportInProgress = errors.New("export is in progress")
+
+// ExportManifest describes an export uploaded to object storage.
+type ExportManifest struct {
+	Key        string    `json:"key"`
+	Records    int       `json:"records"`
+	Bytes      int64     `json:"bytes"`
+	Parts      int       `json:"parts"`
+	SHA256     string    `json:"sha256"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// objectExporter streams all payments as JSON lines to object storage with multipart upload.
+type objectExporter struct {
+	store      objectStorage
+	prefix     string
+	partSize   int
+	retries    int
+	retryDelay time.Duration
+}
+
+var (
+	exportMu      sync.Mutex
+	exportRunning bool
+)
+
+func newObjectExporter() *objectExporter {
+	return &objectExporter{
+		store:      newS3Client(config.ObjectStorageEndpoint, config.ObjectStorageRegion, config.ObjectStorageBucket, config.ObjectStorageAccessKey, config.ObjectStorageSecretKey),
+		prefix:     config.ObjectStoragePrefix,
+		partSize:   config.ObjectStoragePartSize,
+		retries:    config.ObjectStoragePartRetries,
+		retryDelay: time.Second,
+	}
+}
+
+// run exports payments unless another export is running and saves the manifest.
+func (e *objectExporter) run(ctx context.Context) (*ExportManifest, error) {
+	exportMu.Lock()
+	if exportRunning {
+		exportMu.Unlock()
+		return nil, errExportInProgress
+	}
+	exportRunning = true
+	exportMu.Unlock()
+	defer func() {
+		exportMu.Lock()
+		exportRunning = false
+		exportMu.Unlock()
+	}()
+
+	m, err := e.export(ctx, clock.Now())
+	if err != nil {
+		metricExportFailures.Add(1)
+		return nil, err
+	}
+	log.Noticef("exported %d payments to %s", m.Records, m.Key)
+	return m, saveExportManifest(m)
+}
+
+// export uploads the payments. Incomplete upload is aborted on error.
+func (e *objectExporter) export(ctx context.Context, now time.Time) (*ExportManifest, error) {
+	m := &ExportManifest{
+		Key:       e.prefix + "payments-" + now.Format("20060102T150405Z") + ".jsonl",
+		StartedAt: now,
+	}
+	uploadID, err := e.store.CreateMultipartUpload(ctx, m.Key)
+	if err != nil {
+		return nil, err
+	}
+	u := &partUploader{exporter: e, key: m.Key, uploadID: uploadID, hash: sha256.New()}
+	err = e.writeRecords(ctx, u, m)
+	if err == nil {
+		// Last part is uploaded even if it is empty because S3 requires at least one part.
+		err = u.flush(ctx)
+	}
+	if err == nil {
+		err = e.store.CompleteMultipartUpload(ctx, m.Key, uploadID, u.parts)
+	}
+	if err != nil {
+		// Context may be cancelled already.
+		abortCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if abortErr := e.store.AbortMultipartUpload(abortCtx, m.Key, uploadID); abortErr != nil {
+			log.Errorln("cannot abort incomplete upload:", abortErr)
+		}
+		return nil, err
+	}
+	m.Bytes = u.total
+	m.Parts = len(u.parts)
+	m.SHA256 = hex.EncodeToString(u.hash.Sum(nil))
+	m.FinishedAt = clock.Now()
+	return m, nil
+}
+
+func (e *objectExporter) writeRecords(ctx context.Context, u *partUploader, m *ExportManifest) error {
+	var after []byte
+	for {
+		values, next, err := loadPaymentsPage(after, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			u.write(v)
+			u.write([]byte("\n"))
+			m.Records++
+			if u.buf.Len() >= e.partSize {
+				// Reading waits for the upload, so memory use is bounded by part size.
+				err = u.flush(ctx)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		after = next
+	}
+}
+
+type partUploader struct {
+	exporter *objectExporter
+	key      string
+	uploadID string
+	buf      bytes.Buffer
+	hash     hash.Hash
+	total    int64
+	parts    []completedPart
+}
+
+func (u *partUploader) write(b []byte) {
+	u.buf.Write(b)
+	u.hash.Write(b)
+	u.total += int64(len(b))
+}
+
+// flush uploads buffered data as the next part, retrying on failure.
+func (u *partUploader) flush(ctx context.Context) error {
+	number := len(u.parts) + 1
+	var err error
+	for attempt := 0; attempt <= u.exporter.retries; attempt++ {
+		if attempt > 0 {
+			log.Warningf("retrying upload of part %d: %s", number, err)
+			select {
+			case <-time.After(time.Duration(attempt) * u.exporter.retryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var etag string
+		etag, err = u.exporter.store.UploadPart(ctx, u.key, u.uploadID, number, u.buf.Bytes())
+		if err == nil {
+			u.parts = append(u.parts, completedPart{PartNumber: number, ETag: etag})
+			u.buf.Reset()
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot upload part %d: %w", number, err)
+}
+
+// loadPaymentsPage returns raw payment records with keys after the given key.
+// next is nil if there are no more records.
+func loadPaymentsPage(after []byte, limit int) (values [][]byte, next []byte, err error) {
+	accounts, values, err := store.Page(string(after), limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(values) > limit {
+		values, next = values[:limit], []byte(accounts[limit-1])
+	}
+	return values, next, nil
+}
+
+func saveExportManifest(m *ExportManifest) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(exportsBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(m.StartedAt.Format(time.RFC3339Nano)), value)
+	})
+}
+
+// loadExportManifests returns the last manifests, newest first.
+func loadExportManifests(limit int) ([]ExportManifest, error) {
+	manifests := make([]ExportManifest, 0)
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(exportsBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(manifests) < limit; k, v = c.Prev() {
+			var m ExportManifest
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			manifests = append(manifests, m)
+		}
+		return nil
+	})
+	return manifests, err
+}
+
+// exportToObjectStorage runs a scheduled export and alerts on failure.
+func exportToObjectStorage() error {
+	_, err := newObjectExporter().run(context.Background())
+	if err != nil {
+		log.Errorln("export to object storage failed:", err)
+		sendAlert("export_failed", "export to object storage failed", map[string]interface{}{"error": err.Error()})
+	}
+	return err
+}
+
+// handleAdminExportToObjectStorage starts an export in background.
+func handleAdminExportToObjectStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	exportMu.Lock()
+	running := exportRunning
+	exportMu.Unlock()
+	if running {
+		writeError(w, errCodeExportInProgress, http.StatusConflict, "export is in progress")
+		return
+	}
+	go func() {
+		_, err := newObjectExporter().run(context.Background())
+		if err != nil {
+			log.Errorln("export to object storage failed:", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleAdminGetExports returns the last export manifests.
+func handleAdminGetExports(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	manifests, err := loadExportManifests(limit)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, manifests)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryObjectStorage is an in-memory fake of S3 multipart uploads.
+type memoryObjectStorage struct {
+	mu       sync.Mutex
+	uploads  map[string]map[int][]byte
+	objects  map[string][]byte
+	aborted  []string
+	failPart map[int]int // part number -> number of failures left
+}
+
+func newMemoryObjectStorage() *memoryObjectStorage {
+	return &memoryObjectStorage{uploads: make(map[string]map[int][]byte), objects: make(map[string][]byte), failPart: make(map[int]int)}
+}
+
+func (s *memoryObjectStorage) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := fmt.Sprintf("upload-%d", len(s.uploads)+1)
+	s.uploads[id] = make(map[int][]byte)
+	return id, nil
+}
+
+func (s *memoryObjectStorage) UploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failPart[partNumber] > 0 {
+		s.failPart[partNumber]--
+		return "", errors.New("connection reset")
+	}
+	s.uploads[uploadID][partNumber] = append([]byte(nil), data...)
+	return fmt.Sprintf("etag-%d", partNumber), nil
+}
+
+func (s *memoryObjectStorage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.Write(s.uploads[uploadID][p.PartNumber])
+	}
+	s.objects[key] = buf.Bytes()
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *memoryObjectStorage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, uploadID)
+	s.aborted = append(s.aborted, uploadID)
+	return nil
+}
+
+func TestObjectStorageExport(t *testing.T) {
+	openTestDB(t, 2500)
+	store := newMemoryObjectStorage()
+	store.failPart[2] = 1
+	e := &objectExporter{store: store, prefix: "exports/", partSize: 1000, retries: 2}
+	m, err := e.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Records != 2500 || m.Parts < 3 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	object := store.objects[m.Key]
+	if len(object) != 2500*3 || int64(len(object)) != m.Bytes {
+		t.Fatalf("unexpected object size: %d", len(object))
+	}
+	sum := sha256.Sum256(object)
+	if m.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatal("checksum mismatch")
+	}
+	manifests, err := loadExportManifests(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 || manifests[0].Key != m.Key {
+		t.Fatalf("manifest is not saved: %+v", manifests)
+	}
+}
+
+func TestObjectStorageExportAbort(t *testing.T) {
+	openTestDB(t, 2500)
+	store := newMemoryObjectStorage()
+	store.failPart[2] = 10
+	e := &objectExporter{store: store, prefix: "exports/", partSize: 1000, retries: 2}
+	_, err := e.run(context.Background())
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(store.aborted) != 1 || len(store.uploads) != 0 || len(store.objects) != 0 {
+		t.Fatalf("incomplete upload is not cleaned up: aborted=%v uploads=%d", store.aborted, len(store.uploads))
+	}
+	manifests, err := loadExportManifests(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 0 {
+		t.Fatal("manifest is saved for failed export")
+	}
+}
+
+func TestS3ClientRequests(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			t.Errorf("request is not signed: %q", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			t.Error("invalid payload hash")
+		}
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Get("uploadId") == "":
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>abc</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == http.MethodPut:
+			w.Header().Set("ETag", `"etag1"`)
+		case r.Method == http.MethodPost:
+			if !bytes.Contains(body, []byte(`<Part><PartNumber>1</PartNumber><ETag>&#34;etag1&#34;</ETag></Part>`)) {
+				t.Errorf("unexpected complete body: %s", body)
+			}
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>try again</Message></Error>")
+		}
+	}))
+	defer srv.Close()
+	c := newS3Client(srv.URL, "us-east-1", "bucket", "key", "secret")
+	ctx := context.Background()
+	id, err := c.CreateMultipartUpload(ctx, "exports/a b.jsonl")
+	if err != nil || id != "abc" {
+		t.Fatal(id, err)
+	}
+	etag, err := c.UploadPart(ctx, "exports/a b.jsonl", id, 1, []byte("data"))
+	if err != nil || etag != `"etag1"` {
+		t.Fatal(etag, err)
+	}
+	err = c.CompleteMultipartUpload(ctx, "exports/a b.jsonl", id, []completedPart{{1, etag}})
+	var s3err *S3Error
+	if !errors.As(err, &s3err) || s3err.Code != "InternalError" {
+		t.Fatalf("error in complete response is not returned: %v", err)
+	}
+	expected := []string{
+		"POST /bucket/exports/a%20b.jsonl?uploads=",
+		"PUT /bucket/exports/a%20b.jsonl?partNumber=1&uploadId=abc",
+		"POST /bucket/exports/a%20b.jsonl?uploadId=abc",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected requests:\n%s", strings.Join(requests, "\n"))
+	}
+}
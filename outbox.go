@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// When OutboxEnabled is set, notifications are saved to the outbox and delivered in background
+// by a lane per destination host, so a slow or dead endpoint of one merchant does not delay the others.
+// Each lane has a circuit breaker that pauses deliveries to a failing host and probes it with a single delivery
+// after a cooldown. Paused deliveries do not use their attempts. Retry times are saved with the delivery,
+// so a restart does not reset the schedule.
+
+const outboxBucket = "outbox"
+
+// States of a destination's circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var (
+	metricOutboxDelivered = expvar.NewInt("outbox_delivered_total")
+	metricOutboxFailures  = expvar.NewMap("outbox_failures_total")
+)
+
+// Delivery is a notification waiting in the outbox.
+type Delivery struct {
+	ID      uint64          `json:"id"`
+	Account string          `json:"account"`
+	Event   string          `json:"event,omitempty"`
+	URL     string          `json:"url"`
+	Body    json.RawMessage `json:"body"`
+	// Time the delivery is attempted next.
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	// Set when the delivery is given up after OutboxMaxAttempts.
+	FailedAt *time.Time `json:"failedAt,omitempty"`
+}
+
+func (d *Delivery) key() []byte {
+	k := make([]byte, 8) // nolint: gomnd
+	binary.BigEndian.PutUint64(k, d.ID)
+	return k
+}
+
+// host returns the destination host that the delivery is queued by.
+func (d *Delivery) host() string {
+	u, err := url.Parse(d.URL)
+	if err != nil || u.Host == "" {
+		return d.URL
+	}
+	return u.Host
+}
+
+// OutboxDestination is the state of deliveries to a host, returned from /admin/outbox.
+type OutboxDestination struct {
+	Host    string `json:"host"`
+	Breaker string `json:"breaker"`
+	// Failed attempts since the last successful delivery.
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	QueueDepth          int        `json:"queueDepth"`
+	NextAttemptAt       *time.Time `json:"nextAttemptAt,omitempty"`
+	// Deliveries given up after OutboxMaxAttempts.
+	Failed int `json:"failed"`
+}
+
+// outboxLane delivers the notifications to a single host one at a time.
+type outboxLane struct {
+	host string
+	wake chan struct{}
+
+	mu sync.Mutex
+	// Sorted by NextAttemptAt.
+	pending  []*Delivery
+	failed   int
+	breaker  string
+	failures int
+	openedAt time.Time
+}
+
+func newOutboxLane(host string) *outboxLane {
+	return &outboxLane{host: host, wake: make(chan struct{}, 1), breaker: breakerClosed}
+}
+
+// add queues d. Must be called with mu held.
+func (l *outboxLane) add(d *Delivery) {
+	l.pending = append(l.pending, d)
+	l.sort()
+}
+
+func (l *outboxLane) sort() {
+	sort.SliceStable(l.pending, func(i, j int) bool { return l.pending[i].NextAttemptAt.Before(l.pending[j].NextAttemptAt) })
+}
+
+func (l *outboxLane) remove(d *Delivery) {
+	for i := range l.pending {
+		if l.pending[i] == d {
+			l.pending = append(l.pending[:i], l.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *outboxLane) signal() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the delivery to attempt next and how long to wait before attempting it.
+// Returns nil if nothing is queued.
+func (l *outboxLane) next(now time.Time) (*Delivery, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) == 0 {
+		return nil, 0
+	}
+	d := l.pending[0]
+	wait := d.NextAttemptAt.Sub(now)
+	if l.breaker == breakerOpen {
+		probeAt := l.openedAt.Add(time.Duration(config.OutboxBreakerCooldown) * time.Millisecond)
+		if w := probeAt.Sub(now); w > wait {
+			wait = w
+		}
+	}
+	return d, wait
+}
+
+func (l *outboxLane) status() OutboxDestination {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := OutboxDestination{Host: l.host, Breaker: l.breaker, ConsecutiveFailures: l.failures, QueueDepth: len(l.pending), Failed: l.failed}
+	if l.breaker != breakerClosed {
+		openedAt := l.openedAt
+		s.OpenedAt = &openedAt
+	}
+	if len(l.pending) > 0 {
+		next := l.pending[0].NextAttemptAt
+		s.NextAttemptAt = &next
+	}
+	return s
+}
+
+// outboxDispatcher runs a lane for every destination host.
+type outboxDispatcher struct {
+	client *http.Client
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	lanes map[string]*outboxLane
+}
+
+var outbox *outboxDispatcher
+
+func newOutboxDispatcher() *outboxDispatcher {
+	return &outboxDispatcher{
+		client: &http.Client{Timeout: time.Duration(config.OutboxTimeout) * time.Millisecond},
+		stop:   make(chan struct{}),
+		lanes:  make(map[string]*outboxLane),
+	}
+}
+
+// start loads the saved deliveries and starts delivering them.
+func (o *outboxDispatcher) start() error {
+	return scanBucket(outboxBucket, func(k, v []byte) error {
+		var d Delivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			log.Errorf("cannot load outbox delivery %x: %s", k, err)
+			return nil
+		}
+		l := o.lane(d.host())
+		l.mu.Lock()
+		if d.FailedAt != nil {
+			l.failed++
+		} else {
+			l.add(&d)
+		}
+		l.mu.Unlock()
+		l.signal()
+		return nil
+	})
+}
+
+// close stops the lanes and waits for running deliveries to finish.
+func (o *outboxDispatcher) close() {
+	close(o.stop)
+	o.wg.Wait()
+}
+
+// lane returns the lane of host, starting it if it does not exist.
+func (o *outboxDispatcher) lane(host string) *outboxLane {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	l, ok := o.lanes[host]
+	if !ok {
+		l = newOutboxLane(host)
+		o.lanes[host] = l
+		o.wg.Add(1)
+		go o.run(l)
+	}
+	return l
+}
+
+// enqueue saves d to the outbox and queues it for delivery as soon as possible.
+func (o *outboxDispatcher) enqueue(d *Delivery) error {
+	d.CreatedAt = clock.Now()
+	d.NextAttemptAt = d.CreatedAt
+	err := dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(outboxBucket))
+		if err != nil {
+			return err
+		}
+		if d.ID, err = b.NextSequence(); err != nil {
+			return err
+		}
+		value, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return b.Put(d.key(), value)
+	})
+	if err != nil {
+		return err
+	}
+	l := o.lane(d.host())
+	l.mu.Lock()
+	l.add(d)
+	l.mu.Unlock()
+	l.signal()
+	return nil
+}
+
+func (o *outboxDispatcher) run(l *outboxLane) {
+	defer o.wg.Done()
+	for {
+		select {
+		case <-o.stop:
+			return
+		default:
+		}
+		d, wait := l.next(clock.Now())
+		if d != nil && wait <= 0 {
+			o.attempt(l, d)
+			continue
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if d != nil {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+		case <-l.wake:
+		case <-o.stop:
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// attempt posts d and updates the breaker of the lane with the result.
+// An attempt made while the breaker is open is the probe that closes it on success.
+func (o *outboxDispatcher) attempt(l *outboxLane, d *Delivery) {
+	l.mu.Lock()
+	if l.breaker == breakerOpen {
+		l.breaker = breakerHalfOpen
+	}
+	l.mu.Unlock()
+
+	err := deliverNotification(o.client, d.URL, d.Body)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d.Attempts++
+	t := clock.Now()
+	if err == nil {
+		if l.breaker != breakerClosed {
+			log.Noticef("closing circuit breaker of %s", l.host)
+		}
+		l.breaker, l.failures = breakerClosed, 0
+		l.remove(d)
+		metricOutboxDelivered.Add(1)
+		if err = o.delete(d); err != nil {
+			log.Errorln("cannot delete delivered notification:", err)
+		}
+		return
+	}
+	log.Warningf("cannot deliver notification of %s to %s: %s", d.Account, l.host, err)
+	metricOutboxFailures.Add(l.host, 1)
+	d.LastError = err.Error()
+	l.failures++
+	if l.breaker == breakerHalfOpen || l.failures >= config.OutboxBreakerThreshold {
+		if l.breaker == breakerClosed {
+			log.Warningf("opening circuit breaker of %s after %d failures", l.host, l.failures)
+		}
+		l.breaker, l.openedAt = breakerOpen, t
+	}
+	if config.OutboxMaxAttempts > 0 && d.Attempts >= config.OutboxMaxAttempts {
+		d.FailedAt = &t
+		l.remove(d)
+		l.failed++
+		sendAlert("notification_failed", fmt.Sprintf("giving up delivering notification of %s after %d attempts", d.Account, d.Attempts), map[string]interface{}{"account": d.Account, "host": l.host, "error": d.LastError})
+	} else {
+		d.NextAttemptAt = t.Add(outboxBackoff(d.Attempts))
+		l.sort()
+	}
+	if err = o.save(d); err != nil {
+		log.Errorln("cannot save notification:", err)
+	}
+}
+
+func (o *outboxDispatcher) save(d *Delivery) error {
+	value, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(outboxBucket)).Put(d.key(), value)
+	})
+}
+
+func (o *outboxDispatcher) delete(d *Delivery) error {
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(outboxBucket)).Delete(d.key())
+	})
+}
+
+// outboxBackoff returns the delay after the nth failed attempt.
+// Half of the delay is random, so retries of many deliveries to a recovering host are spread out.
+func outboxBackoff(attempts int) time.Duration {
+	d := time.Duration(config.OutboxMinBackoff) * time.Millisecond
+	max := time.Duration(config.OutboxMaxBackoff) * time.Millisecond
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) // nolint: gosec
+}
+
+// destinations returns the state of all destination hosts sorted by host.
+func (o *outboxDispatcher) destinations() []OutboxDestination {
+	o.mu.Lock()
+	lanes := make([]*outboxLane, 0, len(o.lanes))
+	for _, l := range o.lanes {
+		lanes = append(lanes, l)
+	}
+	o.mu.Unlock()
+	ret := make([]OutboxDestination, len(lanes))
+	for i, l := range lanes {
+		ret[i] = l.status()
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Host < ret[j].Host })
+	return ret
+}
+
+// resetBreaker closes the breaker of host and makes its queued deliveries due now.
+// Returns false if there is no lane for host.
+func (o *outboxDispatcher) resetBreaker(host string) (bool, error) {
+	o.mu.Lock()
+	l, ok := o.lanes[host]
+	o.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	l.mu.Lock()
+	defer l.signal()
+	defer l.mu.Unlock()
+	l.breaker, l.failures = breakerClosed, 0
+	t := clock.Now()
+	for _, d := range l.pending {
+		d.NextAttemptAt = t
+		if err := o.save(d); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func handleAdminOutbox(w http.ResponseWriter, r *http.Request) {
+	if outbox == nil {
+		http.Error(w, "outbox is not enabled", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, outbox.destinations())
+}
+
+func handleAdminResetBreaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if outbox == nil {
+		http.Error(w, "outbox is not enabled", http.StatusNotFound)
+		return
+	}
+	host := r.FormValue("host")
+	found, err := outbox.resetBreaker(host)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "unknown host", http.StatusNotFound)
+		return
+	}
+	log.Noticef("circuit breaker of %s reset by %s", host, adminIdentity(r))
+	writeAdminJSON(w, outbox.lane(host).status())
+}
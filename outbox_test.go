@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDestination is a notification endpoint that can be made unresponsive.
+type fakeDestination struct {
+	*httptest.Server
+	received int32
+	mu       sync.Mutex
+	// Requests hang until the client gives up while set.
+	blackHole bool
+	released  chan struct{}
+}
+
+func newFakeDestination(t *testing.T, blackHole bool) *fakeDestination {
+	d := &fakeDestination{blackHole: blackHole, released: make(chan struct{})}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		hang := d.blackHole
+		d.mu.Unlock()
+		if hang {
+			select {
+			case <-r.Context().Done():
+			case <-d.released:
+			}
+			return
+		}
+		atomic.AddInt32(&d.received, 1)
+	}))
+	t.Cleanup(func() {
+		close(d.released)
+		d.Close()
+	})
+	return d
+}
+
+func (d *fakeDestination) fix() {
+	d.mu.Lock()
+	d.blackHole = false
+	d.mu.Unlock()
+}
+
+func (d *fakeDestination) host() string {
+	u, _ := url.Parse(d.URL)
+	return u.Host
+}
+
+func startTestOutbox(t *testing.T) *outboxDispatcher {
+	o := newOutboxDispatcher()
+	if err := o.start(); err != nil {
+		t.Fatal(err)
+	}
+	outbox = o
+	t.Cleanup(func() {
+		if outbox == o {
+			o.close()
+			outbox = nil
+		}
+	})
+	return o
+}
+
+func notifyTo(t *testing.T, destination *fakeDestination, account string) {
+	t.Helper()
+	p := &Payment{Account: account, NotificationURL: destination.URL}
+	if err := p.notifyMerchant(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+	}
+}
+
+func savedDeliveries(t *testing.T) []Delivery {
+	t.Helper()
+	var ret []Delivery
+	err := scanBucket(outboxBucket, func(k, v []byte) error {
+		var d Delivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		ret = append(ret, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestOutboxBreaker(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.OutboxMinBackoff = 10
+	config.OutboxMaxBackoff = 40
+	config.OutboxBreakerThreshold = 3
+	config.OutboxBreakerCooldown = 300
+	config.OutboxTimeout = 200
+	healthy := newFakeDestination(t, false)
+	dead := newFakeDestination(t, true)
+	o := startTestOutbox(t)
+	const count = 5
+	for i := 0; i < count; i++ {
+		notifyTo(t, dead, "nano_1dead"+string(rune('a'+i)))
+		notifyTo(t, healthy, "nano_1healthy"+string(rune('a'+i)))
+	}
+
+	// Healthy destination gets all of its notifications while the first one to the dead destination is hanging.
+	waitFor(t, "healthy deliveries", func() bool { return atomic.LoadInt32(&healthy.received) == count })
+	if s := o.lane(dead.host()).status(); s.ConsecutiveFailures != 0 || s.QueueDepth != count {
+		t.Fatalf("healthy deliveries waited for the dead destination: %+v", s)
+	}
+
+	waitFor(t, "breaker to open", func() bool { return o.lane(dead.host()).status().Breaker == breakerOpen })
+	// Deliveries waiting behind the open breaker keep their attempts.
+	var attempts int
+	for _, d := range savedDeliveries(t) {
+		attempts += d.Attempts
+	}
+	if attempts != config.OutboxBreakerThreshold {
+		t.Fatalf("%d attempts made to the dead destination", attempts)
+	}
+
+	// Probe after cooldown closes the breaker and the queue is drained.
+	dead.fix()
+	waitFor(t, "breaker to close", func() bool {
+		s := o.lane(dead.host()).status()
+		return s.Breaker == breakerClosed && s.QueueDepth == 0
+	})
+	if n := atomic.LoadInt32(&dead.received); n != count {
+		t.Fatalf("recovered destination received %d notifications", n)
+	}
+	if d := savedDeliveries(t); len(d) != 0 {
+		t.Fatalf("delivered notifications are not removed: %+v", d)
+	}
+}
+
+func TestOutboxResume(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.OutboxMinBackoff = 3600000
+	config.OutboxMaxBackoff = 3600000
+	config.OutboxTimeout = 100
+	dead := newFakeDestination(t, true)
+	o := startTestOutbox(t)
+	notifyTo(t, dead, "nano_1resume")
+	waitFor(t, "failed attempt", func() bool { return o.lane(dead.host()).status().ConsecutiveFailures == 1 })
+	o.close()
+	outbox = nil
+	saved := savedDeliveries(t)
+	if len(saved) != 1 || saved[0].Attempts != 1 || saved[0].NextAttemptAt.Before(clock.Now().Add(30*time.Minute)) {
+		t.Fatalf("retry is not saved: %+v", saved)
+	}
+
+	// Schedule is kept after restart.
+	o = startTestOutbox(t)
+	s := o.lane(dead.host()).status()
+	if s.QueueDepth != 1 || s.NextAttemptAt == nil || !s.NextAttemptAt.Equal(saved[0].NextAttemptAt) {
+		t.Fatalf("schedule is reset: %+v", s)
+	}
+
+	w := httptest.NewRecorder()
+	handleAdminOutbox(w, httptest.NewRequest(http.MethodGet, "/admin/outbox", nil))
+	var destinations []OutboxDestination
+	if err := json.Unmarshal(w.Body.Bytes(), &destinations); err != nil || len(destinations) != 1 || destinations[0].QueueDepth != 1 {
+		t.Fatalf("unexpected destinations: %s", w.Body)
+	}
+
+	if w = postAdminForm(handleAdminResetBreaker, url.Values{"host": {"unknown"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown host is reset: %d", w.Code)
+	}
+	dead.fix()
+	if w = postAdminForm(handleAdminResetBreaker, url.Values{"host": {dead.host()}}); w.Code != http.StatusOK {
+		t.Fatalf("cannot reset breaker: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "delivery after reset", func() bool { return atomic.LoadInt32(&dead.received) == 1 })
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cenkalti/log"
+)
+
+// Results of the ownership check. Funds are moved only from accounts owned by Seed.
+const (
+	// Account is derived from Seed at the payment's index.
+	ownershipOwned = "owned"
+	// Account is derived from one of LegacySeeds. Its key is not derived from Seed.
+	ownershipLegacySeed = "legacy_seed"
+	// Account is not derived from any of the configured seeds.
+	ownershipNotOwned = "not_owned"
+	// Payment is imported from another processor.
+	ownershipImported = "imported"
+)
+
+var (
+	errAccountNotOwned   = errors.New("account is not derived from seed")
+	errAccountLegacySeed = errors.New("account is derived from a legacy seed")
+)
+
+// Ownership is the result of re-deriving the key of a payment account.
+type Ownership struct {
+	Account string `json:"account"`
+	Index   string `json:"index,omitempty"`
+	Result  string `json:"result"`
+	// Position of the matching seed in LegacySeeds if Result is legacy_seed.
+	LegacySeed *int `json:"legacySeed,omitempty"`
+}
+
+// checkOwnership derives the key at the payment's recorded index from each configured seed
+// and compares it with the account and public key of the payment.
+func (p *Payment) checkOwnership() (*Ownership, error) {
+	o := &Ownership{Account: p.Account, Index: p.Index}
+	if p.Imported {
+		o.Result = ownershipImported
+		return o, nil
+	}
+	o.Result = ownershipNotOwned
+	if p.Index == "" {
+		return o, nil
+	}
+	current, err := merchantSeed(p.Merchant)
+	if err != nil {
+		return nil, err
+	}
+	for i, seed := range append([]string{current}, config.LegacySeeds...) {
+		key, err := p.node().DeterministicKey(seed, p.Index)
+		if err != nil {
+			return nil, err
+		}
+		if key.Account != p.Account || !strings.EqualFold(key.Public, p.PublicKey) {
+			continue
+		}
+		if i == 0 {
+			o.Result = ownershipOwned
+		} else {
+			o.Result = ownershipLegacySeed
+			legacy := i - 1
+			o.LegacySeed = &legacy
+		}
+		break
+	}
+	return o, nil
+}
+
+// requireOwnership writes an error response and returns false if funds of p must not be moved by operation.
+// The result of the check is logged with the admin identity for auditing.
+func requireOwnership(w http.ResponseWriter, r *http.Request, operation string, p *Payment) bool {
+	if p.integrity.blocks() {
+		log.Noticef("admin %s of %s by %s: integrity mismatch", operation, p.Account, adminIdentity(r))
+		writeError(w, errCodeIntegrityMismatch, http.StatusConflict, errIntegrityMismatch.Error())
+		return false
+	}
+	o, err := p.checkOwnership()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	log.Noticef("admin %s of %s by %s: ownership %s", operation, p.Account, adminIdentity(r), o.Result)
+	switch o.Result {
+	case ownershipOwned:
+		return true
+	case ownershipImported:
+		writeError(w, errCodePaymentImported, http.StatusConflict, errPaymentImported.Error())
+	case ownershipLegacySeed:
+		writeError(w, errCodeAccountLegacySeed, http.StatusConflict, errAccountLegacySeed.Error())
+	default:
+		writeError(w, errCodeAccountNotOwned, http.StatusConflict, errAccountNotOwned.Error())
+	}
+	return false
+}
+
+// handleAdminAccountOwnership reports the ownership of a payment account so it can be checked before moving funds.
+func handleAdminAccountOwnership(w http.ResponseWriter, r *http.Request) {
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	payment, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	o, err := payment.checkOwnership()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, o)
+}
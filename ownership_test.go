@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+// fakeDeriveNode is a node that answers deterministic_key by deriving the key.
+func fakeDeriveNode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Seed  string `json:"seed"`
+			Index string `json:"index"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		index, err := strconv.ParseUint(req.Index, 10, 32)
+		if err != nil {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid index"})
+			return
+		}
+		key, err := nano.DeriveKey(req.Seed, uint32(index))
+		if err != nil {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Bad seed"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(key)
+	}))
+	t.Cleanup(ts.Close)
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+}
+
+func TestOwnership(t *testing.T) {
+	openTestDB(t, 0)
+	fakeDeriveNode(t)
+	config.setDefaults()
+	const seed = "0000000000000000000000000000000000000000000000000000000000000000"
+	const legacySeed = "1111111111111111111111111111111111111111111111111111111111111111"
+	const otherSeed = "2222222222222222222222222222222222222222222222222222222222222222"
+	oldSeed := config.Seed
+	config.Seed, config.LegacySeeds = seed, []string{legacySeed}
+	t.Cleanup(func() { config.Seed, config.LegacySeeds = oldSeed, nil })
+
+	newPayment := func(seed string, index uint32) *Payment {
+		key, err := nano.DeriveKey(seed, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Payment{Account: key.Account, PublicKey: key.Public, Index: strconv.Itoa(int(index)), FulfilledAt: now(), NotifiedAt: now(), ReceivedAt: now()}
+		if err = p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	owned := newPayment(seed, 5)
+	legacy := newPayment(legacySeed, 6)
+	notOwned := newPayment(otherSeed, 7)
+	// Account is derived from seed but recorded with another index.
+	moved := newPayment(seed, 8)
+	moved.Index = "9"
+	imported := newPayment(otherSeed, 10)
+	imported.Imported = true
+	for _, p := range []*Payment{moved, imported} {
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		payment *Payment
+		result  string
+		code    string
+	}{
+		{owned, ownershipOwned, ""},
+		{legacy, ownershipLegacySeed, errCodeAccountLegacySeed},
+		{notOwned, ownershipNotOwned, errCodeAccountNotOwned},
+		{moved, ownershipNotOwned, errCodeAccountNotOwned},
+		{imported, ownershipImported, errCodePaymentImported},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/account/ownership?account="+c.payment.Account, nil)
+		w := httptest.NewRecorder()
+		handleAdminAccountOwnership(w, r)
+		var o Ownership
+		if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("cannot check ownership: %d %s", w.Code, w.Body)
+		}
+		if o.Result != c.result || (o.LegacySeed != nil) != (c.result == ownershipLegacySeed) {
+			t.Errorf("%s: unexpected ownership %+v", c.payment.Account, o)
+		}
+		if c.code == "" {
+			continue
+		}
+		w = postAdminForm(handleAdminSendToMerchant, url.Values{"account": {c.payment.Account}})
+		expectErrorCode(t, w, http.StatusConflict, c.code)
+	}
+}
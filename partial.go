@@ -0,0 +1,46 @@
+package main
+
+import "github.com/shopspring/decimal"
+
+// Funds sent in multiple blocks add up in Balance until the payment is fulfilled.
+// Clients are updated after every block, so they can ask the customer to send the rest.
+
+// PaymentPartiallyPaid is published when funds arrive that do not fulfill the payment yet.
+type PaymentPartiallyPaid struct {
+	Payment
+}
+
+func (p PaymentPartiallyPaid) Account() Account {
+	return Account(p.Payment.Account)
+}
+
+// partiallyPaid returns true if funds are received but they are not enough to fulfill the payment.
+func (p Payment) partiallyPaid() bool {
+	return p.FulfilledAt == nil && p.CancelledAt == nil && p.Balance.IsPositive() && p.Balance.LessThan(p.Amount)
+}
+
+// amountRemaining returns the amount in raw that customer needs to send to fulfill the payment. Nil if not partially paid.
+func (p Payment) amountRemaining() *decimal.Decimal {
+	if !p.partiallyPaid() {
+		return nil
+	}
+	d := p.Amount.Sub(p.Balance)
+	return &d
+}
+
+// overpaid returns the amount in raw received over the requested amount. Nil if not overpaid.
+func (p Payment) overpaid() *decimal.Decimal {
+	if !p.Balance.GreaterThan(p.Amount) || p.Amount.IsZero() {
+		return nil
+	}
+	d := p.Balance.Sub(p.Amount)
+	return &d
+}
+
+func rawToNanoPtr(raw *decimal.Decimal) *decimal.Decimal {
+	if raw == nil {
+		return nil
+	}
+	d := RawToNano(*raw)
+	return &d
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPartialPayment(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	l := fakeLedgerNode(t)
+	p := &Payment{Account: "nano_1partial", Amount: NanoToRaw(decimal.NewFromInt(2)), CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 1)
+	cancel := verifications.Subscribe(Account(p.Account), func(e Event) { events <- e })
+	defer cancel()
+
+	l.send("nano_1customer", p.Account, NanoToRaw(decimal.RequireFromString("1.2")))
+	if err := p.runStep(stepCheckPending); err != errPaymentNotFulfilled {
+		t.Fatalf("expected errPaymentNotFulfilled, got %v", err)
+	}
+	select {
+	case e := <-events:
+		if _, ok := e.(PaymentPartiallyPaid); !ok {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("partial payment is not published")
+	}
+	r := NewResponse(p, "")
+	if !r.PartiallyPaid || r.AmountRemaining == nil || r.AmountRemaining.String() != "0.8" || r.Overpaid != nil || r.AmountReceivedRaw != NanoToRaw(decimal.RequireFromString("1.2")).String() {
+		t.Fatalf("unexpected response: %+v", r)
+	}
+
+	l.send("nano_1customer", p.Account, NanoToRaw(decimal.NewFromInt(1)))
+	if err := p.runStep(stepCheckPending); err != nil {
+		t.Fatal(err)
+	}
+	r = NewResponse(p, "")
+	if !r.Fulfilled || r.PartiallyPaid || r.AmountRemaining != nil || r.Overpaid == nil || r.Overpaid.String() != "0.2" {
+		t.Fatalf("unexpected response: %+v", r)
+	}
+}
+
+func TestUnderPaymentTolerance(t *testing.T) {
+	t.Cleanup(func() { config.UnderPaymentTolerancePercent, config.UnderPaymentToleranceFixed = 0, 0 })
+	p := &Payment{Amount: NanoToRaw(decimal.NewFromInt(100))}
+	nano := func(s string) decimal.Decimal { return NanoToRaw(decimal.RequireFromString(s)) }
+	config.UnderPaymentTolerancePercent = 1
+	if !p.fulfilledBy(nano("99")) || p.fulfilledBy(nano("98.99")) {
+		t.Error("percent tolerance is not applied to the amount")
+	}
+	config.UnderPaymentTolerancePercent = 0
+	config.UnderPaymentToleranceFixed = 0.5
+	if !p.fulfilledBy(nano("99.5")) || p.fulfilledBy(nano("99.4")) {
+		t.Error("fixed tolerance is not applied to the amount")
+	}
+	config.UnderPaymentToleranceFixed = 0
+	if !p.fulfilledBy(nano("100")) || p.fulfilledBy(nano("99.99")) {
+		t.Error("exact amount is not required without tolerance")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Active payments can be partitioned between instances sharing a payment store.
+// Each instance sends heartbeats to the store and checks only the payments
+// whose account hashes to itself on a consistent hash ring of live instances.
+// Every instance keeps a check loop for every active payment, so when ownership
+// of a payment moves after a membership change, the new owner checks it
+// at its next scheduled time.
+
+const (
+	instancesBucket = "instances"
+	// Number of points for each instance on the hash ring.
+	ringReplicas = 64
+)
+
+// partitions is set when Partitioning is enabled in config.
+var partitions *coordinator
+
+// MembershipStore keeps heartbeats of instances.
+type MembershipStore interface {
+	Heartbeat(instanceID string, at time.Time) error
+	// Members returns instances with a heartbeat after since.
+	Members(since time.Time) ([]string, error)
+}
+
+// boltMembership stores heartbeats in the instances bucket.
+type boltMembership struct{}
+
+func (boltMembership) Heartbeat(instanceID string, at time.Time) error {
+	value, err := at.MarshalText()
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(instancesBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(instanceID), value)
+	})
+}
+
+func (boltMembership) Members(since time.Time) ([]string, error) {
+	var members []string
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(instancesBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var t time.Time
+			if t.UnmarshalText(v) == nil && t.After(since) {
+				members = append(members, string(k))
+			}
+			return nil
+		})
+	})
+	return members, err
+}
+
+// hashRing maps keys to members with consistent hashing.
+type hashRing struct {
+	points  []uint64
+	members map[uint64]string
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	// fnv has poor avalanche on similar inputs, mix the bits.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+func newHashRing(members []string) *hashRing {
+	r := &hashRing{members: make(map[uint64]string, len(members)*ringReplicas)}
+	for _, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			p := ringHash(m + "#" + strconv.Itoa(i))
+			r.points = append(r.points, p)
+			r.members[p] = m
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the member for key, or empty string if there are no members.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]]
+}
+
+// coordinator keeps the hash ring of live instances up to date.
+type coordinator struct {
+	id    string
+	store MembershipStore
+	ttl   time.Duration
+
+	mu   sync.RWMutex
+	ring *hashRing
+}
+
+func newCoordinator(id string, store MembershipStore, ttl time.Duration) *coordinator {
+	return &coordinator{id: id, store: store, ttl: ttl, ring: newHashRing([]string{id})}
+}
+
+// defaultInstanceID returns a name unique to this process.
+func defaultInstanceID() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	return fmt.Sprintf("%s-%d-%x", hostname, os.Getpid(), b[4:])
+}
+
+// refresh sends a heartbeat and rebuilds the ring from live instances.
+// Instance always includes itself in the ring, so it keeps checking payments if the store is unreachable.
+func (c *coordinator) refresh(now time.Time) error {
+	err := c.store.Heartbeat(c.id, now)
+	if err != nil {
+		return err
+	}
+	members, err := c.store.Members(now.Add(-c.ttl))
+	if err != nil {
+		return err
+	}
+	if !stringInSlice(c.id, members) {
+		members = append(members, c.id)
+	}
+	sort.Strings(members)
+	ring := newHashRing(members)
+	c.mu.Lock()
+	old := c.ring
+	c.ring = ring
+	c.mu.Unlock()
+	if len(old.points) != len(ring.points) {
+		log.Noticef("partition members changed: %v", members)
+	}
+	return nil
+}
+
+// owns returns true if this instance must check the account.
+// Without a coordinator every account is owned.
+func (c *coordinator) owns(account string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.owner(account) == c.id
+}
+
+func (c *coordinator) owner(account string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.owner(account)
+}
+
+// partitionSizes returns the number of active payments owned by each instance.
+func (c *coordinator) partitionSizes() (map[string]int, error) {
+	sizes := make(map[string]int)
+	err := forEachPayment(func(p *Payment) error {
+		if !p.finished() {
+			sizes[c.owner(p.Account)]++
+		}
+		return nil
+	})
+	return sizes, err
+}
+
+// checkingPayments contains accounts with a running check loop in this instance.
+var (
+	checkingMu       sync.Mutex
+	checkingPayments = make(map[string]*checkerState)
+)
+
+// startCheckingOnce starts the check loop unless it is already running.
+func startCheckingOnce(p *Payment) {
+	checkingMu.Lock()
+	_, ok := checkingPayments[p.Account]
+	if !ok {
+		checkingPayments[p.Account] = &checkerState{}
+	}
+	checkingMu.Unlock()
+	if !ok {
+		p.StartChecking()
+	}
+}
+
+func stopChecking(account string) {
+	checkingMu.Lock()
+	delete(checkingPayments, account)
+	checkingMu.Unlock()
+	subscriber.unwatch(account)
+}
+
+// runCoordinator sends heartbeats and starts check loops for payments created by other instances.
+func runCoordinator(c *coordinator) {
+	interval := time.Duration(config.HeartbeatInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.refresh(clock.Now()); err != nil {
+			log.Errorln("cannot refresh partition members:", err)
+		}
+		payments, err := LoadActivePayments()
+		if err != nil {
+			log.Errorln("cannot load active payments:", err)
+		}
+		for _, p := range payments {
+			startCheckingOnce(p)
+		}
+		select {
+		case <-ticker.C:
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+func handleAdminPartitions(w http.ResponseWriter, r *http.Request) {
+	if partitions == nil {
+		http.Error(w, "partitioning is not enabled", http.StatusNotFound)
+		return
+	}
+	sizes, err := partitions.partitionSizes()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, map[string]interface{}{"instance": partitions.id, "partitions": sizes})
+}
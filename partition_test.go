@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryMembership struct {
+	mu    sync.Mutex
+	beats map[string]time.Time
+}
+
+func (m *memoryMembership) Heartbeat(instanceID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.beats[instanceID] = at
+	return nil
+}
+
+func (m *memoryMembership) Members(since time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var members []string
+	for id, t := range m.beats {
+		if t.After(since) {
+			members = append(members, id)
+		}
+	}
+	return members, nil
+}
+
+func TestPartitionRebalance(t *testing.T) {
+	store := &memoryMembership{beats: make(map[string]time.Time)}
+	ttl := 30 * time.Second
+	a := newCoordinator("a", store, ttl)
+	b := newCoordinator("b", store, ttl)
+	now := time.Now()
+	for _, c := range []*coordinator{a, b, a} {
+		if err := c.refresh(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accounts := make([]string, 1000)
+	for i := range accounts {
+		accounts[i] = "nano_" + strconv.Itoa(i)
+	}
+	var ownedByA int
+	for _, account := range accounts {
+		if a.owns(account) == b.owns(account) {
+			t.Fatalf("account %s must have exactly one owner", account)
+		}
+		if a.owns(account) {
+			ownedByA++
+		}
+	}
+	if ownedByA < 300 || ownedByA > 700 {
+		t.Errorf("unbalanced partitions: a owns %d of %d", ownedByA, len(accounts))
+	}
+
+	// b stops sending heartbeats.
+	if err := a.refresh(now.Add(ttl + time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range accounts {
+		if !a.owns(account) {
+			t.Fatalf("account %s is not taken over after b is gone", account)
+		}
+	}
+}
@@ -1,184 +1,429 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"hash/fnv"
 	"net/http"
 	"time"
 
 	"github.com/tundak/accept-nano/nano"
 	"github.com/cenkalti/log"
 	"github.com/shopspring/decimal"
-	"go.etcd.io/bbolt"
 )
 
 var (
 	errPaymentNotFound     = errors.New("payment not found")
 	errPaymentNotFulfilled = errors.New("payment not fulfilled")
+	errSweepNotApproved    = errors.New("sweep is waiting for admin approval")
 )
 
 // Payment is the data type stored in the database in JSON format.
 type Payment struct {
+	// Unique identifier of the payment for clients.
+	// Account is the deposit address and must not be used as an identifier.
+	PaymentID string `json:"paymentId"`
 	// Customer sends money to this account.
 	Account string `json:"account"`
 	// Public key of Account.
 	PublicKey string `json:"publicKey"`
 	// Index for generating deterministic key.
 	Index string `json:"index"`
+	// Work for the open block of Account, generated after the payment is created so funds are received without waiting for it.
+	OpenWork string `json:"openWork,omitempty"`
+	// Incremented every time the record is saved. Responses carry it so clients can ignore older ones.
+	Revision uint64 `json:"revision,omitempty"`
 	// Currency of amount in original request.
 	Currency string `json:"currency"`
 	// Original amount requested by client. Amount * Price(Currency)
-	AmountInCurrency decimal.Decimal `json:"amountInCurrency"`
+	AmountInCurrency CurrencyAmount `json:"amountInCurrency"`
+	// Price of NANO in Currency at the time payment is created.
+	// Zero if amount is requested in NANO.
+	Price decimal.Decimal `json:"price"`
+	// Price of NANO in Currency at the time payment is verified.
+	// Null if price could not be fetched.
+	VerificationPrice decimal.NullDecimal `json:"verificationPrice"`
+	// Change of price between creation and verification in percent.
+	PriceSlippagePercent decimal.NullDecimal `json:"priceSlippagePercent"`
+	// Historical price fetched afterwards for payments without Price.
+	// Kept separate because it is not the rate the customer paid with.
+	BackfilledRate *BackfilledRate `json:"backfilledRate,omitempty"`
+	// Set when Price was older than PriceMaxStaleness at creation.
+	// Funds are not sent to the merchant until SweepApprovedAt is set.
+	StaleRate bool `json:"staleRate,omitempty"`
+	// Set when admin approves sending funds of a payment with StaleRate.
+	SweepApprovedAt *time.Time `json:"sweepApprovedAt"`
+	// Last dispute opened for the payment.
+	Dispute *Dispute `json:"dispute,omitempty"`
+	// Notes of operators, oldest first. Notes are only appended.
+	Notes []PaymentNote `json:"notes,omitempty"`
+	// Tags set by operators, indexed in tagsBucket.
+	Tags []string `json:"tags,omitempty"`
 	// In NANO currency. Payment is fulfilled when Account contains this amount.
 	Amount decimal.Decimal `json:"amount"`
 	// Current balance in Account
 	Balance decimal.Decimal `json:"balance"`
 	// Individual transactions to pay the total amount.
 	SubPayments map[string]SubPayment `json:"subPayments"`
+	// Blocks over MaxSubPayments that are not kept in SubPayments.
+	ElidedBlocks *ElidedBlocks `json:"elidedBlocks,omitempty"`
+	// Progress of reading pending blocks that do not fit in a single check.
+	PendingScan *PendingScan `json:"pendingScan,omitempty"`
+	// Set when the account has more than MaxPayments pending blocks. Blocks over the limit are not counted.
+	PendingOverflowAt *time.Time `json:"pendingOverflowAt,omitempty"`
+	// Sum of pending blocks that are not confirmed by the network yet, in raw. They are not counted in Balance.
+	Unconfirmed *decimal.Decimal `json:"unconfirmed,omitempty"`
+	// Set when detected funds fulfill the payment but they are not all confirmed yet. Cleared if the blocks are dropped.
+	PendingConfirmationAt *time.Time `json:"pendingConfirmationAt,omitempty"`
+	// Set when the funds are not confirmed within RequiredConfirmationTimeout after PendingConfirmationAt.
+	ConfirmationTimedOutAt *time.Time `json:"confirmationTimedOutAt,omitempty"`
 	// Free text field to pass from customer to merchant.
 	State string `json:"state"`
+	// Checker tier from CheckerTiers config. Empty for default tier.
+	Tier string `json:"tier,omitempty"`
+	// Fingerprint of the API key that the payment is created with. Empty if created without a key.
+	Client string `json:"client,omitempty"`
+	// Scoped idempotency key of the /api/pay request that created the payment, see idempotencyBucket.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Name of the preset that the payment is created from.
+	Preset string `json:"preset,omitempty"`
+	// Payment expires after this duration (seconds). AllowedDuration is used if zero.
+	Timeout int `json:"timeout,omitempty"`
+	// Notification is posted to this URL instead of NotificationURL if set.
+	NotificationURL string `json:"notificationUrl,omitempty"`
+	// Merchant defined values sent in notification.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
 	// Set when customer created the payment request via API.
 	CreatedAt time.Time `json:"createdAt"`
+	// Set when funds arrive after the payment is expired.
+	Late *LatePayment `json:"late,omitempty"`
+	// Policy for funds of the payment if it expires with less than Amount, see expiry.go. Funds are held if empty.
+	OnExpiryWithFunds string `json:"onExpiryWithFunds,omitempty"`
+	// Set when the payment expires with funds and OnExpiryWithFunds is executed.
+	Expiry *ExpiryAction `json:"expiry,omitempty"`
+	// Set when an admin refunds the payment with /admin/refund.
+	Refund *Refund `json:"refund,omitempty"`
+	// Set for payments imported from another processor's export. Imported payments are never checked and their funds are never moved.
+	Imported bool `json:"imported,omitempty"`
+	// Set for payments created in SandboxMode. They are fulfilled with /api/sandbox/fulfill and never touch the ledger.
+	Sandbox bool `json:"sandbox,omitempty"`
+	// ID of the merchant in Merchants. Empty for payments of the global Seed and Account.
+	Merchant string `json:"merchant,omitempty"`
+	// ID of the /api/pay request that created the payment, printed in checker log lines.
+	RequestID string `json:"requestId,omitempty"`
+	// Format of the file that the payment is imported from.
+	ImportedFrom string `json:"importedFrom,omitempty"`
+	// Software versions at creation. Nil for payments created by older versions.
+	CreatedWith *SoftwareVersions `json:"createdWith,omitempty"`
+	// Software versions at the last time funds are moved, by operation ("receive", "fee" or "send").
+	OperationVersions map[string]SoftwareVersions `json:"operationVersions,omitempty"`
+	// Set when the payment is cancelled before funds arrive. Cancelled payments are not checked.
+	CancelledAt *time.Time `json:"cancelledAt,omitempty"`
+	// Admin that cancelled the payment. Empty if cancelled by the customer.
+	CancelledBy string `json:"cancelledBy,omitempty"`
+	// State transitions in time order, appended when the payment is saved.
+	History []HistoryEvent `json:"history,omitempty"`
 	// Set every time Account is checked for incoming funds.
 	LastCheckedAt *time.Time `json:"lastCheckedAt"`
+	// Time of the next scheduled check, so the schedule is resumed after a restart. Nil when finished.
+	NextCheckAt *time.Time `json:"nextCheckAt,omitempty"`
+	// Set when a new block is first seen. Checks are scheduled from this time, like from CreatedAt.
+	ScheduleResetAt *time.Time `json:"scheduleResetAt,omitempty"`
 	// Set when detected customer has sent enough funds to Account.
 	FulfilledAt *time.Time `json:"fulfilledAt"`
+	// Blocks that add up to Balance at the time payment is fulfilled. Not changed afterwards.
+	SatisfiedBy []SatisfiedBlock `json:"satisfiedBy"`
 	// Set when merchant is notified.
 	NotifiedAt *time.Time `json:"notifiedAt"`
+	// Failed attempts to notify the merchant and the error of the last one.
+	NotificationAttempts int    `json:"notificationAttempts,omitempty"`
+	NotificationError    string `json:"notificationError,omitempty"`
+	// Set when notifying the merchant is given up after NotificationMaxAttempts.
+	NotificationFailedAt *time.Time `json:"notificationFailedAt,omitempty"`
 	// Set when pending funds are accepted to Account.
 	ReceivedAt *time.Time `json:"receivedAt"`
 	// Set when Amount is sent to the merchant account.
 	SentAt *time.Time `json:"sentAt"`
+	// Hash of the block sending funds to the merchant account.
+	SendHash string `json:"sendHash,omitempty"`
+	// Account that fee is sent to. Set when fee is calculated on sweep.
+	FeeAccount string `json:"feeAccount,omitempty"`
+	// Fee share of received funds in raw.
+	FeeAmount decimal.Decimal `json:"feeAmount"`
+	// Hash of the block sending fee to FeeAccount.
+	FeeSendHash string `json:"feeSendHash,omitempty"`
+	// Set when fee is sent to FeeAccount.
+	FeeSentAt *time.Time `json:"feeSentAt"`
+	// Set when the merchant accepts the final notification with the financial summary.
+	FinalNotifiedAt *time.Time `json:"finalNotifiedAt,omitempty"`
+	// Failed attempts of the final notification. It is given up after NotificationMaxAttempts.
+	FinalNotificationAttempts int        `json:"finalNotificationAttempts,omitempty"`
+	FinalNotificationFailedAt *time.Time `json:"finalNotificationFailedAt,omitempty"`
+
+	// Context of the running check. RPCs made with p.node() are aborted when it is cancelled.
+	ctx context.Context
+	// Prefixes of blocks added to ElidedBlocks since the last save.
+	newElided map[string]bool
+	// Set by LoadPayment if the stored key does not match the seed, see integrityBucket.
+	integrity *IntegrityMismatch
+	// Tags before setTags, removed from the index on save.
+	oldTags     []string
+	tagsChanged bool
 }
 
 type SubPayment struct {
 	Amount  decimal.Decimal `json:"amount"`
 	Account string          `json:"account"`
+	// Hash of the receive block in Account chain.
+	ReceiveHash string `json:"receiveHash,omitempty"`
+	// Set when the block is first seen as pending, confirmed or not.
+	ConfirmedAt *time.Time `json:"confirmedAt"`
+	// Set while the network has not confirmed the block. Unconfirmed blocks are not counted in Balance.
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
 }
 
 // LoadPayment fetches a Payment object from database by key.
 func LoadPayment(key []byte) (*Payment, error) {
-	var value []byte
-	err := db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(paymentsBucket))
-		v := b.Get(key)
-		if v == nil {
-			return nil
-		}
-		value = make([]byte, len(v))
-		copy(value, v)
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	if value == nil {
-		return nil, errPaymentNotFound
-	}
-	var payment Payment
-	err = json.Unmarshal(value, &payment)
-	return &payment, err
+	return store.Load(string(key))
 }
 
 func LoadActivePayments() ([]*Payment, error) {
-	ret := make([]*Payment, 0)
-	err := db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(paymentsBucket))
-		return b.ForEach(func(k, v []byte) error {
-			p := new(Payment)
-			err := json.Unmarshal(v, p)
-			if err != nil {
-				log.Error(err)
-				return nil
-			}
-			if !p.finished() {
-				ret = append(ret, p)
-			}
-			return nil
-		})
-	})
-	return ret, err
+	return store.LoadActive()
+}
+
+// forEachPayment calls f for every Payment in database.
+// Records that cannot be decoded are logged and skipped.
+func forEachPayment(f func(p *Payment) error) error {
+	return store.ForEach(f)
 }
 
 // Save the Payment object in database.
 func (p *Payment) Save() error {
-	key := []byte(p.Account)
-	value, err := json.Marshal(&p)
+	if err := p.checkMetadataSize(); err != nil {
+		return err
+	}
+	p.syncHistory()
+	err := store.Save(p)
 	if err != nil {
 		return err
 	}
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(paymentsBucket))
-		return b.Put(key, value)
-	})
+	p.newElided = nil
+	p.oldTags, p.tagsChanged = nil, false
+	return nil
 }
 
-// NextCheck returns the next timestamp payment should be checked at.
+// NextCheck returns the duration until the payment should be checked.
+// Checks missed while the server was down are spread by account over MinNextCheckDuration,
+// so they do not all run at the start.
 func (p Payment) NextCheck() time.Duration {
-	if p.LastCheckedAt == nil {
-		return time.Duration(config.MinNextCheckDuration) * time.Second
+	now := clock.Now()
+	var wait time.Duration
+	switch {
+	case p.NextCheckAt != nil:
+		wait = p.NextCheckAt.Sub(now)
+	case p.LastCheckedAt != nil:
+		// Saved by an older version.
+		wait = p.LastCheckedAt.Add(p.checkInterval(*p.LastCheckedAt)).Sub(now)
+	default:
+		wait = p.checkInterval(now)
+	}
+	if wait < 0 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(p.Account))
+		spread := time.Duration(config.MinNextCheckDuration) * time.Second
+		wait = time.Duration(uint64(spread) * uint64(h.Sum32()) >> 32)
+	}
+	return wait
+}
+
+// checked records a check at the current time and schedules the next one.
+func (p *Payment) checked() {
+	p.LastCheckedAt = now()
+	p.NextCheckAt = nil
+	if !p.finished() {
+		next := p.LastCheckedAt.Add(p.checkInterval(*p.LastCheckedAt))
+		if p.Refund.retrying() && p.Refund.RetryAt.Before(next) {
+			next = *p.Refund.RetryAt
+		}
+		p.NextCheckAt = &next
+	}
+}
+
+// checkInterval returns the wait after a check at t.
+// Payments are checked every FastCheckInterval for FastCheckDuration after they are created or a new block is seen,
+// when funds are most likely to arrive. Then the wait grows with the time passed, so it backs off exponentially
+// until MaxNextCheckDuration.
+func (p Payment) checkInterval(t time.Time) time.Duration {
+	from := p.CreatedAt
+	if p.ScheduleResetAt != nil && p.ScheduleResetAt.After(from) {
+		from = *p.ScheduleResetAt
+	}
+	passed := t.Sub(from)
+	if passed < time.Duration(config.FastCheckDuration)*time.Second {
+		return time.Duration(config.FastCheckInterval) * time.Second
+	}
+
+	factor, maxDuration := config.NextCheckDurationFactor, config.MaxNextCheckDuration
+	if tier, ok := config.CheckerTiers[p.Tier]; ok {
+		if tier.NextCheckDurationFactor > 0 {
+			factor = tier.NextCheckDurationFactor
+		}
+		if tier.MaxNextCheckDuration > 0 {
+			maxDuration = tier.MaxNextCheckDuration
+		}
 	}
-	create := p.CreatedAt
-	lastCheck := *p.LastCheckedAt
 
-	now := time.Now().UTC()
 	minWait := time.Duration(config.MinNextCheckDuration) * time.Second
-	maxWait := time.Duration(config.MaxNextCheckDuration) * time.Second
-	passed := now.Sub(create)
-	nextWait := passed / time.Duration(config.NextCheckDurationFactor)
+	maxWait := time.Duration(maxDuration) * time.Second
+	nextWait := passed / time.Duration(factor)
 	if nextWait < minWait {
 		nextWait = minWait
 	} else if nextWait > maxWait {
 		nextWait = maxWait
 	}
-	nextCheck := lastCheck.Add(nextWait)
-	return nextCheck.Sub(now)
+	return nextWait
 }
 
 // finished returns true after all operations are complete or allowed duration for payment is passed.
+// Expired payments are checked for late funds within LatePaymentWindow.
+// Received funds are left on the account when sweeping is disabled.
+// Funds of a verified payment are moved after the allowed duration too, so a receive or sweep
+// interrupted by a shutdown is resumed when the payment is loaded at the next start.
+// Failed final notifications and failed refunds are retried as long as they are not given up.
 func (p Payment) finished() bool {
-	return p.SentAt != nil || now().Sub(p.CreatedAt) > time.Duration(config.AllowedDuration)*time.Second
+	if step := p.nextStep(); step == stepNotifyFinal || step == stepAdminRefund {
+		return false
+	}
+	if p.ReceivedAt != nil && !config.sweepEnabled() {
+		return true
+	}
+	if p.Imported || p.SentAt != nil || p.CancelledAt != nil {
+		return true
+	}
+	if now().Sub(p.CreatedAt) <= p.allowedDuration() || p.awaitingConfirmation() || p.awaitingLateFunds() {
+		return false
+	}
+	switch p.nextStep() {
+	case stepReceive, stepSweep, stepRefund, stepExpire, stepExpiryRefund, stepNotifyCredit:
+		return false
+	}
+	return true
+}
+
+// allowedDuration is the time customer has to send the funds.
+func (p Payment) allowedDuration() time.Duration {
+	if p.Timeout > 0 {
+		return time.Duration(p.Timeout) * time.Second
+	}
+	return time.Duration(config.AllowedDuration) * time.Second
+}
+
+// price returns the stored rate of the payment.
+// For payments created before rates are stored, it is calculated from requested amounts.
+func (p Payment) price() decimal.Decimal {
+	if !p.Price.IsZero() {
+		return p.Price
+	}
+	amount := RawToNano(p.Amount)
+	if p.Currency == "BCB" || amount.IsZero() {
+		return decimal.Zero
+	}
+	return p.AmountInCurrency.DivRound(amount, 6) // nolint: gomnd
 }
 
 func (p Payment) remainingDuration() time.Duration {
-	allow := time.Duration(config.AllowedDuration) * time.Second
-	return p.CreatedAt.Add(allow).Sub(*now())
+	return p.expiresAt().Sub(*now())
 }
 
 // StartChecking starts a goroutine to check the payment periodically.
 func (p *Payment) StartChecking() {
+	checkingMu.Lock()
+	s, ok := checkingPayments[p.Account]
+	if !ok {
+		s = &checkerState{}
+		checkingPayments[p.Account] = s
+	}
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	stop := s.stop
+	checkingMu.Unlock()
 	checkPaymentWG.Add(1)
-	go p.checkLoop()
+	go p.checkLoop(stop)
 }
 
-func (p *Payment) checkLoop() {
+func (p *Payment) checkLoop(stop chan struct{}) {
 	defer checkPaymentWG.Done()
+	defer stopChecking(p.Account)
+	if !p.Sandbox {
+		subscriber.watch(p.Account)
+	}
+	minWait := time.Duration(config.MinNextCheckDuration) * time.Second
 	for {
 		if p.finished() {
 			return
 		}
+		// Payments owned by other instances are only followed, so they can be taken over
+		// at their next check time if the owner goes away.
+		owned := partitions.owns(p.Account)
+		wait := p.NextCheck()
+		if !owned && wait < minWait {
+			wait = minWait
+		}
+		recordExpected(p.Account, wait)
 		select {
-		case <-time.After(p.NextCheck()):
-			p.checkOnce()
+		case <-time.After(wait):
+			if owned && partitions.owns(p.Account) {
+				checks.run(p.lane(), func() {
+					// Checks queued before the shutdown are not started.
+					if !stopping() {
+						p.checkOnce()
+					}
+				})
+			} else {
+				p.follow()
+			}
+		case <-stop:
+			return
 		case <-stopCheckPayments:
 			return
 		}
 	}
 }
 
+// follow reloads the payment saved by the instance that owns it.
+func (p *Payment) follow() {
+	locks.Lock(p.Account)
+	defer locks.Unlock(p.Account)
+	if err := p.reload(); err != nil {
+		log.Errorln("cannot load payment:", p.Account)
+	}
+}
+
+// lane returns the check scheduler lane of the payment's tier.
+func (p Payment) lane() int {
+	if config.CheckerTiers[p.Tier].Priority {
+		return lanePriority
+	}
+	return laneDefault
+}
+
 func (p *Payment) checkOnce() {
 	locks.Lock(p.Account)
 	defer locks.Unlock(p.Account)
 
 	err := p.reload()
 	if err != nil {
-		log.Errorln("cannot load payment:", p.Account)
+		log.Errorln("cannot load payment:", p.logName())
 		return
 	}
+	ctx, done := beginCheck(p.Account)
+	defer done()
+	p.ctx = ctx
 	err = p.check()
 	if err != nil {
-		log.Errorf("error checking %s: %s", p.Account, err)
+		log.Errorf("error checking %s: %s", p.logName(), err)
 		return
 	}
 }
@@ -189,16 +434,18 @@ func (p *Payment) reload() error {
 	if err != nil {
 		return err
 	}
+	ctx := p.ctx
 	*p = *p2
+	p.ctx = ctx
 	return nil
 }
 
 func (p *Payment) check() error {
-	log.Debugln("checking payment:", p.Account)
+	log.Debugln("checking payment:", p.logName())
 	err := p.process()
-	p.LastCheckedAt = now()
+	p.checked()
 	switch err {
-	case errPaymentNotFulfilled:
+	case errPaymentNotFulfilled, errSweepNotApproved, errPaymentDisputed, errPaymentLate, errOrphanFunds, errRefundRetry, errIntegrityMismatch:
 		log.Debug(err)
 		return p.Save()
 	case nil:
@@ -213,102 +460,90 @@ func (p *Payment) check() error {
 
 var locks = NewMapLock()
 
-func (p *Payment) process() error { // nolint: gocognit
-	if p.SentAt == nil { // nolint: nestif
-		if p.ReceivedAt == nil {
-			if p.NotifiedAt == nil {
-				if p.FulfilledAt == nil {
-					err := p.checkPending()
-					if err != nil {
-						return err
-					}
-					p.FulfilledAt = now()
-					err = p.Save()
-					if err != nil {
-						return err
-					}
-					go verifications.Publish(PaymentVerified{Payment: *p})
-				}
-				err := p.notifyMerchant()
-				if err != nil {
-					return err
-				}
-				p.NotifiedAt = now()
-				err = p.Save()
-				if err != nil {
-					return err
-				}
-				go verifications.Publish(PaymentVerified{Payment: *p})
-			}
-			err := p.receivePending()
-			if err != nil {
-				return err
-			}
-			p.ReceivedAt = now()
-			err = p.Save()
-			if err != nil {
-				return err
-			}
-		}
-		err := p.sendToMerchant()
-		if err != nil {
-			return err
+func (p *Payment) process() error {
+	for {
+		step := p.nextStep()
+		if step == stepNone {
+			return nil
 		}
-		p.SentAt = now()
-		err = p.Save()
+		err := p.runStep(step)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
 }
 
 func now() *time.Time {
-	t := time.Now().UTC()
+	t := clock.Now()
 	return &t
 }
 
 func (p *Payment) checkPending() error {
+	if p.Sandbox {
+		return p.checkSandboxPending()
+	}
 	threshold, err := decimal.NewFromString(config.ReceiveThreshold)
 	if err != nil {
 		return err
 	}
 	var totalAmount decimal.Decimal
-	accountInfo, err := node.AccountInfo(p.Account)
+	accountInfo, err := p.node().AccountInfo(p.Account)
 	switch err {
 	case nano.ErrAccountNotFound:
 	case nil:
-		accountBalance, err2 := decimal.NewFromString(accountInfo.Balance)
+		accountBalance, err2 := parseRaw(accountInfo.Balance)
 		if err2 != nil {
 			return err2
 		}
-		totalAmount.Add(accountBalance)
+		totalAmount = accountBalance
 	default:
 		return err
 	}
-	pendingBlocks, err := node.Pending(p.Account, config.MaxPayments, NanoToRaw(threshold).String())
+	// Record is saved if the pass was in progress or the payment is flagged in this check, even if the balance is same.
+	overflow := p.PendingOverflowAt
+	scanning := p.PendingScan != nil
+	scan := p.PendingScan
+	if scan == nil {
+		scan = &PendingScan{}
+	}
+	done, err := p.scanPending(scan, totalAmount, NanoToRaw(threshold).String())
 	if err != nil {
 		return err
 	}
-	if len(pendingBlocks) == 0 {
+	p.capSubPayments()
+	if !done {
+		p.PendingScan = scan
+		err = p.Save()
+		if err != nil {
+			return err
+		}
 		return errPaymentNotFulfilled
 	}
-	for hash, pendingBlock := range pendingBlocks {
-		log.Debugf("received new block: %#v", hash)
-		amount, err2 := decimal.NewFromString(pendingBlock.Amount)
-		if err2 != nil {
-			return err2
-		}
-		log.Debugln("amount:", RawToNano(amount))
-		totalAmount = totalAmount.Add(amount)
-		if p.SubPayments == nil {
-			p.SubPayments = make(map[string]SubPayment, 1)
+	p.PendingScan = nil
+	changed := scanning || p.PendingOverflowAt != overflow
+	changed = p.setUnconfirmed(scan.Unconfirmed) || changed
+	if scan.Blocks == 0 {
+		changed = p.updatePendingConfirmation() || changed
+		if changed {
+			err = p.Save()
+			if err != nil {
+				return err
+			}
 		}
-		p.SubPayments[hash] = SubPayment{Account: pendingBlock.Source, Amount: amount}
+		return errPaymentNotFulfilled
+	}
+	// Unconfirmed blocks are not counted until the network confirms them.
+	totalAmount, err = addRaw(totalAmount, scan.Amount.Sub(scan.Unconfirmed))
+	if err != nil {
+		return err
 	}
 	log.Debugln("total amount:", RawToNano(totalAmount))
 	if p.Balance != totalAmount {
 		p.Balance = totalAmount
+		changed = true
+	}
+	changed = p.updatePendingConfirmation() || changed
+	if changed {
 		err = p.Save()
 		if err != nil {
 			return err
@@ -321,77 +556,178 @@ func (p *Payment) checkPending() error {
 }
 
 func (p *Payment) isFulfilled() bool {
-	if config.UnderPaymentToleranceFixed != 0 && p.Balance.GreaterThanOrEqual(p.Amount.Sub(NanoToRaw(decimal.NewFromFloat(config.UnderPaymentToleranceFixed)))) {
+	return p.fulfilledBy(p.Balance)
+}
+
+// fulfilledBy returns true if balance is enough to fulfill the payment.
+func (p *Payment) fulfilledBy(balance decimal.Decimal) bool {
+	if config.UnderPaymentToleranceFixed != 0 && balance.GreaterThanOrEqual(p.Amount.Sub(NanoToRaw(decimal.NewFromFloat(config.UnderPaymentToleranceFixed)))) {
 		return true
 	}
-	if config.UnderPaymentTolerancePercent != 0 && p.Balance.GreaterThanOrEqual(p.Amount.Mul(decimal.NewFromFloat(100-config.UnderPaymentTolerancePercent))) { // nolint: gomnd
+	if config.UnderPaymentTolerancePercent != 0 && balance.GreaterThanOrEqual(p.Amount.Mul(decimal.NewFromFloat(100-config.UnderPaymentTolerancePercent)).Shift(-2)) { // nolint: gomnd
 		return true
 	}
-	return p.Balance.GreaterThanOrEqual(p.Amount)
+	return balance.GreaterThanOrEqual(p.Amount)
 }
 
 func (p *Payment) receivePending() error {
-	threshold, err := decimal.NewFromString(config.ReceiveThreshold)
-	if err != nil {
-		return err
-	}
-	pendingBlocks, err := node.Pending(p.Account, config.MaxPayments, NanoToRaw(threshold).String())
-	if err != nil {
-		return err
-	}
-	if len(pendingBlocks) == 0 {
+	if p.Sandbox {
 		return nil
 	}
-	key, err := node.DeterministicKey(config.Seed, p.Index)
+	threshold, err := decimal.NewFromString(config.ReceiveThreshold)
 	if err != nil {
 		return err
 	}
-	for hash, pendingBlock := range pendingBlocks {
-		err = receiveBlock(hash, pendingBlock.Amount, p.Account, key.Private, p.PublicKey)
+	var key *nano.Key
+	for received := 0; received < config.MaxPayments; {
+		count := pendingPageSize()
+		if left := config.MaxPayments - received; left < count {
+			count = left
+		}
+		n, err := p.receiveBlocks(count, NanoToRaw(threshold).String(), &key)
 		if err != nil {
 			return err
 		}
+		received += n
+		if n < count {
+			return nil
+		}
 	}
 	return nil
 }
 
+// receiveBlocks receives a page of pending blocks and returns the number of received blocks.
+// Payment and pending blocks are read after acquiring the lock because another instance
+// may have received them while waiting.
+func (p *Payment) receiveBlocks(count int, threshold string, key **nano.Key) (n int, err error) {
+	err = withMoneyLock(p.Account, func(lease Lease) error {
+		err2 := p.reload()
+		if err2 != nil {
+			return err2
+		}
+		// Received blocks are not pending anymore, so the next page starts at the beginning.
+		pendingBlocks, err2 := p.node().PendingPage(p.Account, count, 0, threshold)
+		if err2 != nil {
+			return err2
+		}
+		if len(pendingBlocks) == 0 {
+			return nil
+		}
+		if *key == nil {
+			*key, err2 = p.deriveKey()
+			if err2 != nil {
+				return err2
+			}
+		}
+		for hash, pendingBlock := range pendingBlocks {
+			receiveHash, err2 := receiveBlock(lease, hash, pendingBlock.Amount, p.Account, (*key).Private, p.PublicKey, p.OpenWork)
+			if err2 != nil {
+				return err2
+			}
+			if sp, ok := p.SubPayments[hash]; ok {
+				sp.ReceiveHash = receiveHash
+				p.SubPayments[hash] = sp
+			}
+		}
+		n = len(pendingBlocks)
+		p.stampOperation(operationReceive)
+		return p.Save()
+	})
+	return n, err
+}
+
 func (p *Payment) sendToMerchant() error {
-	key, err := node.DeterministicKey(config.Seed, p.Index)
+	if p.Sandbox {
+		return nil
+	}
+	key, err := p.deriveKey()
 	if err != nil {
 		return err
 	}
-	return sendAll(p.Account, config.Account, key.Private)
+	destination, err := merchantAccount(p.Merchant)
+	if err != nil {
+		return err
+	}
+	return withMoneyLock(p.Account, func(lease Lease) error {
+		// Another instance may have swept the payment while waiting for the lock.
+		err := p.reload()
+		if err != nil {
+			return err
+		}
+		if p.SentAt != nil {
+			return nil
+		}
+		if p.FeeSentAt == nil && (p.FeeAccount != "" || config.FeeAccount != "") {
+			err = p.sendFee(lease, key.Private)
+			if err != nil {
+				return err
+			}
+		}
+		hash, err := sendAll(lease, p.Account, destination, key.Private)
+		if err != nil {
+			return err
+		}
+		if hash != "" {
+			p.SendHash = hash
+			p.stampOperation(operationSend)
+		}
+		return nil
+	})
+}
+
+// sendFee sends the fee share of the balance to the fee account.
+// Fee amount is calculated once and saved, so a failed sweep only retries the missing leg.
+func (p *Payment) sendFee(lease Lease, privateKey string) error {
+	if p.FeeAccount == "" {
+		info, err := p.node().AccountInfo(p.Account)
+		if err != nil {
+			return err
+		}
+		balance, err := parseRaw(info.Balance)
+		if err != nil {
+			return err
+		}
+		p.FeeAccount = config.FeeAccount
+		p.FeeAmount = calculateFee(balance)
+		err = p.Save()
+		if err != nil {
+			return err
+		}
+	}
+	if !p.FeeAmount.IsZero() {
+		hash, err := sendAmount(lease, p.Account, p.FeeAccount, privateKey, p.FeeAmount)
+		if err != nil {
+			return err
+		}
+		p.FeeSendHash = hash
+	}
+	p.FeeSentAt = now()
+	p.stampOperation(operationFee)
+	return p.Save()
 }
 
 func (p *Payment) notifyMerchant() error {
-	if config.NotificationURL == "" {
-		return nil
+	return p.postNotification(p.notification())
+}
+
+// postNotification posts n to the notification URL of the payment.
+func (p *Payment) postNotification(n *Notification) error {
+	notificationURL := config.NotificationURL
+	if m, ok := config.Merchants[p.Merchant]; ok && m.NotificationURL != "" {
+		notificationURL = m.NotificationURL
 	}
-	notification := Notification{
-		Account:          p.Account,
-		Amount:           RawToNano(p.Amount),
-		AmountInCurrency: p.AmountInCurrency,
-		Currency:         p.Currency,
-		Balance:          RawToNano(p.Balance),
-		State:            p.State,
-		Fulfilled:        p.FulfilledAt != nil,
-		FulfilledAt:      p.FulfilledAt,
-	}
-	data, err := json.Marshal(notification)
-	if err != nil {
-		return err
+	if p.NotificationURL != "" {
+		notificationURL = p.NotificationURL
+	}
+	if notificationURL == "" {
+		return nil
 	}
-	resp, err := http.Post(config.NotificationURL, "application/json", bytes.NewReader(data))
+	data, err := json.Marshal(n)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err2 := resp.Body.Close(); err2 != nil {
-			log.Debug(err2)
-		}
-	}()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("bad notification response")
+	if outbox != nil {
+		return outbox.enqueue(&Delivery{Account: p.Account, Event: n.Event, URL: notificationURL, Body: data})
 	}
-	return nil
+	return deliverNotification(http.DefaultClient, notificationURL, data)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// paymentIDsBucket maps payment IDs to accounts.
+const paymentIDsBucket = "payment_ids"
+
+// NewPaymentID returns a random version 4 UUID.
+func NewPaymentID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// createPaymentIDsBucket creates the payment ID index.
+// Payments created before IDs existed are given an ID when the bucket is new.
+func createPaymentIDsBucket(tx *bbolt.Tx) error {
+	if tx.Bucket([]byte(paymentIDsBucket)) != nil {
+		return nil
+	}
+	ib, err := tx.CreateBucket([]byte(paymentIDsBucket))
+	if err != nil {
+		return err
+	}
+	pb := tx.Bucket([]byte(paymentsBucket))
+	updated := make(map[string][]byte)
+	err = pb.ForEach(func(k, v []byte) error {
+		var p Payment
+		if json.Unmarshal(v, &p) != nil {
+			return nil
+		}
+		if p.PaymentID == "" {
+			p.PaymentID, err = NewPaymentID()
+			if err != nil {
+				return err
+			}
+			value, err2 := json.Marshal(&p)
+			if err2 != nil {
+				return err2
+			}
+			updated[string(k)] = value
+		}
+		return ib.Put([]byte(p.PaymentID), k)
+	})
+	if err != nil {
+		return err
+	}
+	// Bucket cannot be modified during ForEach.
+	for k, v := range updated {
+		if err = pb.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	if len(updated) > 0 {
+		log.Infof("assigned payment ID to %d payments", len(updated))
+	}
+	return nil
+}
+
+// LoadPaymentByID returns the payment with the ID.
+func LoadPaymentByID(id string) (*Payment, error) {
+	account, err := accountOfPaymentID(id)
+	if err != nil {
+		return nil, err
+	}
+	return LoadPayment([]byte(account))
+}
+
+func accountOfPaymentID(id string) (string, error) {
+	return store.AccountOf(id)
+}
+
+// requestAccount returns the account from "account" parameter, or from "id" parameter by looking up the payment ID.
+// Returns empty string if neither is given.
+func requestAccount(r *http.Request) (string, error) {
+	if account := r.FormValue("account"); account != "" {
+		return account, nil
+	}
+	if id := r.FormValue("id"); id != "" {
+		return accountOfPaymentID(id)
+	}
+	return "", nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestPaymentID(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	id, err := NewPaymentID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("invalid UUID: %s", id)
+	}
+	p := &Payment{PaymentID: id, Account: "nano_1new", Index: "1"}
+	if err = p.create(statePolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPaymentByID(id)
+	if err != nil || loaded.Account != p.Account {
+		t.Fatalf("cannot load by ID: %v", err)
+	}
+	if _, err = LoadPaymentByID("unknown"); err != errPaymentNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handleVerify(w, httptest.NewRequest(http.MethodGet, "/api/verify?id="+id, nil))
+	var response Response
+	if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	claims, err := ParseToken(response.Token)
+	if err != nil || response.PaymentID != id || claims.PaymentID != id || claims.Account != p.Account {
+		t.Fatalf("unexpected response: %+v, %v", response, err)
+	}
+
+	// Tokens created before payment IDs only have the account.
+	oldToken, _ := NewToken("1", p.Account, "")
+	w = httptest.NewRecorder()
+	handleVerify(w, httptest.NewRequest(http.MethodGet, "/api/verify?token="+oldToken, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("old token is rejected: %d", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/payment?id="+id, nil)
+	r.SetBasicAuth(adminName, "")
+	w = httptest.NewRecorder()
+	handleAdminGetPayment(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot get payment by ID in admin: %d", w.Code)
+	}
+	w = postAdminForm(handleAdminApproveSweep, url.Values{"id": {"unknown"}})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status for unknown ID: %d", w.Code)
+	}
+}
+
+func TestPaymentIDMigration(t *testing.T) {
+	openTestDB(t, 3)
+	err := dbUpdate(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(paymentIDsBucket)); err != nil {
+			return err
+		}
+		return createPaymentIDsBucket(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	err = forEachPayment(func(p *Payment) error {
+		loaded, err := LoadPaymentByID(p.PaymentID)
+		if err != nil {
+			return err
+		}
+		if loaded.Account != p.Account {
+			t.Errorf("ID of %s points to %s", p.Account, loaded.Account)
+		}
+		ids[p.PaymentID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 unique IDs, got %v", ids)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"expvar"
+	"strconv"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// An account can have more pending blocks than a single node response should carry, e.g. when it is
+// spammed with blocks just over ReceiveThreshold. Pending blocks are read in pages of PendingPageSize and
+// a check reads at most PendingPagesPerCheck pages. Progress is saved in the payment, so the next check
+// continues from the next page. Blocks over MaxPayments are not counted and the payment is flagged.
+
+var metricPendingOverflows = expvar.NewInt("pending_overflows_total")
+
+// PendingScan is the progress of a pass over the pending blocks of an account.
+type PendingScan struct {
+	// Position of the next page in the pending blocks at the node.
+	Offset int `json:"offset"`
+	// Number of blocks counted in the pass.
+	Blocks int `json:"blocks"`
+	// Sum of blocks counted in the pass in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Sum of blocks counted in the pass that are not confirmed yet, in raw. It is included in Amount.
+	Unconfirmed decimal.Decimal `json:"unconfirmed"`
+	// Prefixes of block hashes in the last page. Pages shift when blocks arrive between checks,
+	// so blocks of the last page are not counted again if they are seen in the next page.
+	LastPage []string `json:"lastPage,omitempty"`
+}
+
+// pendingPageSize returns the number of pending blocks requested at once.
+func pendingPageSize() int {
+	if config.PendingPageSize > config.MaxPayments {
+		return config.MaxPayments
+	}
+	return config.PendingPageSize
+}
+
+// scanPending reads the next pages of pending blocks of the payment into scan.
+// It returns true if the pass is complete, or if balance and the confirmed blocks counted so far fulfill the payment.
+func (p *Payment) scanPending(scan *PendingScan, balance decimal.Decimal, threshold string) (bool, error) {
+	for i := 0; i < config.PendingPagesPerCheck; i++ {
+		count := pendingPageSize()
+		if left := config.MaxPayments - scan.Offset; left < count {
+			count = left
+		}
+		if count <= 0 {
+			// MaxPayments is lowered during the pass.
+			return true, nil
+		}
+		blocks, err := p.node().PendingPageAll(p.Account, count, scan.Offset, threshold)
+		if err != nil {
+			return false, err
+		}
+		unconfirmed, err := p.unconfirmedBlocks(blocks, scan.LastPage)
+		if err != nil {
+			return false, err
+		}
+		page := make([]string, 0, len(blocks))
+		for hash, block := range blocks {
+			page = append(page, hashPrefix(hash))
+			if stringInSlice(hashPrefix(hash), scan.LastPage) {
+				continue
+			}
+			log.Debugf("received new block: %#v", hash)
+			amount, err := parseRaw(block.Amount)
+			if err != nil {
+				return false, err
+			}
+			log.Debugln("amount:", RawToNano(amount))
+			scan.Amount, err = addRaw(scan.Amount, amount)
+			if err != nil {
+				return false, err
+			}
+			if unconfirmed[hash] {
+				scan.Unconfirmed, err = addRaw(scan.Unconfirmed, amount)
+				if err != nil {
+					return false, err
+				}
+			}
+			scan.Blocks++
+			err = p.addSubPayment(hash, block.Source, amount)
+			if err != nil {
+				return false, err
+			}
+			p.setBlockConfirmed(hash, !unconfirmed[hash])
+		}
+		scan.Offset += len(blocks)
+		scan.LastPage = page
+		if len(blocks) < count || p.fulfilledBy(balance.Add(scan.Amount).Sub(scan.Unconfirmed)) {
+			return true, nil
+		}
+		if scan.Offset >= config.MaxPayments {
+			return true, p.checkPendingOverflow(scan.Offset, threshold)
+		}
+	}
+	return false, nil
+}
+
+func (p *Payment) addSubPayment(hash, source string, amount decimal.Decimal) error {
+	elided, err := p.isElided(hash)
+	if err != nil || elided {
+		return err
+	}
+	if p.SubPayments == nil {
+		p.SubPayments = make(map[string]SubPayment, 1)
+	}
+	sp, ok := p.SubPayments[hash]
+	if !ok {
+		sp.ConfirmedAt = now()
+		// More blocks may follow, e.g. the rest of a partial payment.
+		p.ScheduleResetAt = sp.ConfirmedAt
+	}
+	sp.Account = source
+	sp.Amount = amount
+	p.SubPayments[hash] = sp
+	return nil
+}
+
+// checkPendingOverflow flags the payment if the account has pending blocks after the first offset blocks.
+func (p *Payment) checkPendingOverflow(offset int, threshold string) error {
+	if p.PendingOverflowAt != nil {
+		return nil
+	}
+	blocks, err := p.node().PendingPageAll(p.Account, 1, offset, threshold)
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+	p.PendingOverflowAt = now()
+	metricPendingOverflows.Add(1)
+	sendAlert("pending_overflow", "payment "+p.Account+" has more than "+strconv.Itoa(offset)+" pending blocks", map[string]interface{}{
+		"account":   p.Account,
+		"paymentId": p.PaymentID,
+	})
+	return nil
+}
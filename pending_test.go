@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// fakeSpamNode serves total pending blocks of 1 raw for every account, generated from the requested page.
+type fakeSpamNode struct {
+	mu       sync.Mutex
+	total    int
+	maxCount int
+	maxBody  int
+}
+
+func newFakeSpamNode(t *testing.T, total int) *fakeSpamNode {
+	n := &fakeSpamNode{total: total}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action string      `json:"action"`
+			Count  json.Number `json:"count"`
+			Offset json.Number `json:"offset"`
+			Hashes []string    `json:"hashes"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.Action == "blocks_info" {
+			blocks := make(map[string]nano.BlockInfo, len(req.Hashes))
+			for _, hash := range req.Hashes {
+				blocks[hash] = nano.BlockInfo{Confirmed: "true"}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"blocks": blocks})
+			return
+		}
+		if req.Action != "pending" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Account not found"})
+			return
+		}
+		count, _ := req.Count.Int64()
+		offset, _ := req.Offset.Int64()
+		blocks := make(map[string]nano.PendingBlock)
+		for i := int(offset); i < int(offset+count) && i < n.total; i++ {
+			blocks[fmt.Sprintf("%016X", i)+strings.Repeat("0", 48)] = nano.PendingBlock{Amount: "1", Source: "nano_1spam"}
+		}
+		body, _ := json.Marshal(map[string]interface{}{"blocks": blocks})
+		if len(blocks) == 0 {
+			body = []byte(`{"blocks":""}`)
+		}
+		n.mu.Lock()
+		if int(count) > n.maxCount {
+			n.maxCount = int(count)
+		}
+		if len(body) > n.maxBody {
+			n.maxBody = len(body)
+		}
+		n.mu.Unlock()
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(ts.Close)
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+	return n
+}
+
+func TestCheckPendingInPages(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.ReceiveThreshold = "0"
+	config.MaxPayments = 5000
+	config.PendingPageSize = 250
+	config.PendingPagesPerCheck = 5
+	t.Cleanup(func() {
+		config.ReceiveThreshold = ""
+		config.MaxPayments = 0
+		config.PendingPageSize = 0
+		config.PendingPagesPerCheck = 0
+	})
+	n := newFakeSpamNode(t, 50000)
+	p := &Payment{Account: "nano_1spammed", Amount: decimal.New(1, 30), CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		if err := p.checkPending(); err != errPaymentNotFulfilled {
+			t.Fatalf("check %d: %v", i, err)
+		}
+		saved, err := LoadPayment([]byte(p.Account))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 4 && (saved.PendingScan == nil || saved.PendingScan.Offset != i*1250 || !saved.Balance.IsZero()) {
+			t.Fatalf("progress of check %d is not saved: %+v", i, saved.PendingScan)
+		}
+		p = saved
+	}
+	if p.PendingScan != nil || !p.Balance.Equal(decimal.NewFromInt(5000)) {
+		t.Fatalf("pass is not complete: %s %+v", p.Balance, p.PendingScan)
+	}
+	if p.PendingOverflowAt == nil {
+		t.Fatal("payment with pending blocks over MaxPayments is not flagged")
+	}
+	if len(p.SubPayments) > config.MaxSubPayments || p.ElidedBlocks.Count+len(p.SubPayments) != 5000 {
+		t.Fatalf("unexpected blocks in record: %d", len(p.SubPayments))
+	}
+	if n.maxCount > config.PendingPageSize || n.maxBody > 250*(64+50) {
+		t.Fatalf("node is requested for %d blocks in %d bytes", n.maxCount, n.maxBody)
+	}
+
+	// Next pass starts from the first page.
+	if err := p.checkPending(); err != errPaymentNotFulfilled || p.PendingScan == nil || p.PendingScan.Offset != 1250 {
+		t.Fatalf("next pass is not started: %v %+v", err, p.PendingScan)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"io"
+	"time"
+)
+
+// advisoryLock is a DistributedLock that uses session level advisory locks of the Postgres payment store.
+// Every lease holds a connection of the pool. Postgres releases the lock when the connection is closed,
+// so the lease is renewed by checking the connection and it is lost if the connection is broken.
+type advisoryLock struct {
+	db       *sql.DB
+	interval time.Duration
+	// Delay between attempts while the lock is held by another instance.
+	retry time.Duration
+	// Acquire gives up after this duration.
+	wait time.Duration
+}
+
+func newAdvisoryLock(db *sql.DB, ttl, wait time.Duration) *advisoryLock {
+	return &advisoryLock{
+		db:       db,
+		interval: ttl / 3, // nolint: gomnd
+		retry:    100 * time.Millisecond,
+		wait:     wait,
+	}
+}
+
+func (l *advisoryLock) Acquire(key string) (Lease, error) {
+	ctx := context.Background()
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := advisoryLockID(key)
+	deadline := time.Now().Add(l.wait)
+	for {
+		var locked bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", id).Scan(&locked)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			conn.Close()
+			return nil, errLockTimeout
+		}
+		time.Sleep(l.retry)
+	}
+	renew := func() error {
+		var one int
+		return conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	}
+	release := func() error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", id)
+		if err != nil {
+			// Connection must not go back to the pool while it may still hold the lock.
+			_ = conn.Raw(func(dc interface{}) error {
+				if c, ok := dc.(io.Closer); ok {
+					return c.Close()
+				}
+				return nil
+			})
+		}
+		conn.Close()
+		return err
+	}
+	return newRenewingLease(l.interval, renew, release), nil
+}
+
+// advisoryLockID maps key to the 64-bit key space of advisory locks.
+func advisoryLockID(key string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("accept-nano:lock:" + key))
+	return int64(h.Sum64())
+}
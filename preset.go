@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"go.etcd.io/bbolt"
+)
+
+// Presets let merchants create payments by name with /api/pay?preset=NAME,
+// so the amount cannot be changed on the client side.
+// Presets are defined in config or managed at /admin/presets.
+// Presets from config cannot be changed from admin endpoints.
+
+const presetsBucket = "presets"
+
+var presetNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Fields of /api/pay request that can be allowed to override preset values.
+var presetOverridableFields = []string{"amount", "currency", "notify_url", "timeout"}
+
+var (
+	errPresetNotFound = errors.New("preset not found")
+	errPresetInConfig = errors.New("preset is defined in config")
+)
+
+// Preset is a template for payments.
+type Preset struct {
+	Name string `json:"name" toml:"-"`
+	// Amount in Currency.
+	Amount decimal.Decimal `json:"amount"`
+	// Currency of Amount. Amount is in NANO if empty.
+	Currency string `json:"currency"`
+	// Payment expires after this duration (seconds). AllowedDuration is used if zero.
+	Timeout int `json:"timeout,omitempty"`
+	// Notification is posted to this URL instead of NotificationURL.
+	NotificationURL string `json:"notificationUrl,omitempty"`
+	// Copied to payments and sent in notifications.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Fields that the request can set to a different value than the preset.
+	// Allowed values are "amount" and "currency".
+	Overridable []string `json:"overridable,omitempty"`
+	// Set to "config" or "admin" in admin responses.
+	Source string `json:"source,omitempty" toml:"-"`
+}
+
+func (pr Preset) validate() error {
+	if !presetNameRegexp.MatchString(pr.Name) {
+		return errors.New("name must be lowercase letters, digits, dash or underscore")
+	}
+	if !pr.Amount.IsPositive() {
+		return errors.New("amount must be positive")
+	}
+	if strings.ToUpper(pr.Currency) != pr.Currency {
+		return errors.New("currency must be uppercase")
+	}
+	if pr.Timeout < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+	if pr.NotificationURL != "" && !validNotificationURL(pr.NotificationURL) {
+		return errors.New("invalid notification url")
+	}
+	if b, _ := json.Marshal(pr.Metadata); len(b) > maxMetadataSize() {
+		return fmt.Errorf("metadata cannot be larger than %d bytes", maxMetadataSize())
+	}
+	for _, field := range pr.Overridable {
+		if !stringInSlice(field, presetOverridableFields) {
+			return fmt.Errorf("field cannot be overridable: %q", field)
+		}
+	}
+	return nil
+}
+
+// payFields are the values in /api/pay request that can come from a preset.
+type payFields struct {
+	Amount    string
+	Currency  string
+	NotifyURL string
+	// Seconds, zero if not set.
+	Timeout int
+}
+
+// presetConflictError is returned when request sets a field of the preset that is not overridable.
+type presetConflictError struct {
+	Field string
+}
+
+func (e *presetConflictError) Error() string {
+	return fmt.Sprintf("%s cannot be changed for the preset", e.Field)
+}
+
+// Code is the error code returned to client.
+func (e *presetConflictError) Code() string {
+	return strings.ToUpper("preset_" + e.Field + "_conflict")
+}
+
+// merge fills the fields missing in request from the preset.
+// Fields set in request are kept if they are overridable or equal to the preset value.
+func (pr Preset) merge(req payFields) (payFields, error) {
+	overridable := func(field string) bool { return stringInSlice(field, pr.Overridable) }
+	merged := payFields{Amount: pr.Amount.String(), Currency: pr.Currency, NotifyURL: pr.NotificationURL, Timeout: pr.Timeout}
+	if req.Amount != "" {
+		amount, err := parseAmount(req.Amount)
+		switch {
+		case overridable("amount"):
+			merged.Amount = req.Amount
+		case err != nil || !amount.Equal(pr.Amount):
+			return merged, &presetConflictError{Field: "amount"}
+		}
+	}
+	if req.Currency != "" {
+		switch {
+		case overridable("currency"):
+			merged.Currency = req.Currency
+		case !strings.EqualFold(req.Currency, pr.Currency):
+			return merged, &presetConflictError{Field: "currency"}
+		}
+	}
+	if req.NotifyURL != "" {
+		if !overridable("notify_url") && pr.NotificationURL != "" && req.NotifyURL != pr.NotificationURL {
+			return merged, &presetConflictError{Field: "notify_url"}
+		}
+		merged.NotifyURL = req.NotifyURL
+	}
+	if req.Timeout != 0 {
+		if !overridable("timeout") && pr.Timeout != 0 && req.Timeout != pr.Timeout {
+			return merged, &presetConflictError{Field: "timeout"}
+		}
+		merged.Timeout = req.Timeout
+	}
+	return merged, nil
+}
+
+// apply copies the settings of the preset that are not request fields to the payment.
+func (pr Preset) apply(p *Payment) {
+	p.Preset = pr.Name
+	p.NotificationURL = pr.NotificationURL
+	p.Metadata = pr.Metadata
+}
+
+// loadPreset returns the preset from config or database.
+func loadPreset(name string) (*Preset, error) {
+	if pr, ok := config.Presets[name]; ok {
+		pr.Name = name
+		pr.Source = "config"
+		return &pr, nil
+	}
+	var pr Preset
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(presetsBucket))
+		if b == nil {
+			return errPresetNotFound
+		}
+		value := b.Get([]byte(name))
+		if value == nil {
+			return errPresetNotFound
+		}
+		return json.Unmarshal(value, &pr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	pr.Source = "admin"
+	return &pr, nil
+}
+
+// loadPresets returns all presets sorted by name.
+func loadPresets() ([]Preset, error) {
+	presets := make([]Preset, 0, len(config.Presets))
+	for name, pr := range config.Presets {
+		pr.Name = name
+		pr.Source = "config"
+		presets = append(presets, pr)
+	}
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(presetsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var pr Preset
+			if err := json.Unmarshal(v, &pr); err != nil {
+				return err
+			}
+			pr.Source = "admin"
+			presets = append(presets, pr)
+			return nil
+		})
+	})
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	return presets, err
+}
+
+func savePreset(pr Preset) error {
+	if _, ok := config.Presets[pr.Name]; ok {
+		return errPresetInConfig
+	}
+	pr.Source = ""
+	value, err := json.Marshal(pr)
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(presetsBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(pr.Name), value)
+	})
+}
+
+func deletePreset(name string) error {
+	if _, ok := config.Presets[name]; ok {
+		return errPresetInConfig
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(presetsBucket))
+		if b == nil || b.Get([]byte(name)) == nil {
+			return errPresetNotFound
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// parsePreset reads a preset from admin request form values.
+// Metadata is a JSON object. Overridable fields can be repeated.
+func parsePreset(r *http.Request) (Preset, error) {
+	pr := Preset{
+		Name:            r.FormValue("name"),
+		Currency:        strings.ToUpper(r.FormValue("currency")),
+		NotificationURL: r.FormValue("notification_url"),
+	}
+	// Form is parsed by FormValue above.
+	pr.Overridable = r.Form["overridable"]
+	var err error
+	pr.Amount, err = decimal.NewFromString(r.FormValue("amount"))
+	if err != nil {
+		return pr, errors.New("invalid amount")
+	}
+	if s := r.FormValue("timeout"); s != "" {
+		pr.Timeout, err = strconv.Atoi(s)
+		if err != nil {
+			return pr, errors.New("invalid timeout")
+		}
+	}
+	if s := r.FormValue("metadata"); s != "" {
+		if err = json.Unmarshal([]byte(s), &pr.Metadata); err != nil {
+			return pr, errors.New("metadata must be a JSON object")
+		}
+	}
+	return pr, pr.validate()
+}
+
+// handleAdminPresets lists presets on GET, creates or replaces a preset on POST and deletes a preset on DELETE.
+// GET with name returns a single preset.
+func handleAdminPresets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if name := r.FormValue("name"); name != "" {
+			pr, err := loadPreset(name)
+			if err == errPresetNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Error(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeAdminJSON(w, pr)
+			return
+		}
+		presets, err := loadPresets()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, presets)
+	case http.MethodPost:
+		pr, err := parsePreset(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = savePreset(pr)
+		if err == errPresetInConfig {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Noticeln("preset saved by", adminIdentity(r)+":", pr.Name)
+		pr.Source = "admin"
+		writeAdminJSON(w, pr)
+	case http.MethodDelete:
+		name := r.FormValue("name")
+		err := deletePreset(name)
+		switch err {
+		case nil:
+			log.Noticeln("preset deleted by", adminIdentity(r)+":", name)
+			w.WriteHeader(http.StatusNoContent)
+		case errPresetNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errPresetInConfig:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "GET, POST or DELETE only", http.StatusMethodNotAllowed)
+	}
+}
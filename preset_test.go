@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPresetMerge(t *testing.T) {
+	gold := Preset{Name: "gold", Amount: decimal.RequireFromString("10"), Currency: "USD"}
+	open := gold
+	open.Overridable = []string{"amount"}
+	hooked := gold
+	hooked.NotificationURL = "https://example.com/hook"
+	timed := gold
+	timed.Timeout = 600
+	cases := []struct {
+		name     string
+		preset   Preset
+		request  payFields
+		expected payFields
+		conflict string
+	}{
+		{"preset values", gold, payFields{}, payFields{"10", "USD", "", 0}, ""},
+		{"same amount", gold, payFields{Amount: "10.00"}, payFields{"10", "USD", "", 0}, ""},
+		{"same currency", gold, payFields{Currency: "usd"}, payFields{"10", "USD", "", 0}, ""},
+		{"different amount", gold, payFields{Amount: "1"}, payFields{}, "amount"},
+		{"invalid amount", gold, payFields{Amount: "ten"}, payFields{}, "amount"},
+		{"exponent amount", gold, payFields{Amount: "1e1"}, payFields{}, "amount"},
+		{"different currency", gold, payFields{Currency: "EUR"}, payFields{}, "currency"},
+		{"overridable amount", open, payFields{Amount: "25"}, payFields{"25", "USD", "", 0}, ""},
+		{"overridable amount, fixed currency", open, payFields{Amount: "25", Currency: "EUR"}, payFields{}, "currency"},
+		{"notify url", gold, payFields{NotifyURL: "https://example.com/other"}, payFields{"10", "USD", "https://example.com/other", 0}, ""},
+		{"preset notify url", hooked, payFields{}, payFields{"10", "USD", "https://example.com/hook", 0}, ""},
+		{"different notify url", hooked, payFields{NotifyURL: "https://example.com/other"}, payFields{}, "notify_url"},
+		{"timeout", gold, payFields{Timeout: 300}, payFields{"10", "USD", "", 300}, ""},
+		{"preset timeout", timed, payFields{}, payFields{"10", "USD", "", 600}, ""},
+		{"different timeout", timed, payFields{Timeout: 300}, payFields{}, "timeout"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			merged, err := c.preset.merge(c.request)
+			if c.conflict != "" {
+				e, ok := err.(*presetConflictError)
+				if !ok || e.Field != c.conflict {
+					t.Fatalf("expected conflict in %s, got %v", c.conflict, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if merged != c.expected {
+				t.Fatalf("got %+v, expected %+v", merged, c.expected)
+			}
+		})
+	}
+}
+
+func TestPresetValidate(t *testing.T) {
+	valid := Preset{Name: "gold-tier", Amount: decimal.RequireFromString("10"), Currency: "USD", Overridable: []string{"amount"}}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]func(pr *Preset){
+		"name":        func(pr *Preset) { pr.Name = "Gold Tier" },
+		"amount":      func(pr *Preset) { pr.Amount = decimal.Zero },
+		"timeout":     func(pr *Preset) { pr.Timeout = -1 },
+		"url":         func(pr *Preset) { pr.NotificationURL = "ftp://example.com" },
+		"overridable": func(pr *Preset) { pr.Overridable = []string{"notification_url"} },
+		"metadata": func(pr *Preset) {
+			pr.Metadata = map[string]interface{}{"x": strings.Repeat("x", maxMetadataSize())}
+		},
+	}
+	for name, f := range invalid {
+		pr := valid
+		f(&pr)
+		if pr.validate() == nil {
+			t.Errorf("invalid %s accepted", name)
+		}
+	}
+}
+
+func TestAdminPresets(t *testing.T) {
+	openTestDB(t, 0)
+	config.Presets = map[string]Preset{"fixed": {Amount: decimal.RequireFromString("1")}}
+	t.Cleanup(func() { config.Presets = nil })
+
+	w := postAdminForm(handleAdminPresets, url.Values{
+		"name": {"donation"}, "amount": {"5"}, "currency": {"eur"}, "timeout": {"600"},
+		"metadata": {`{"campaign":"spring"}`}, "overridable": {"amount"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot save preset: %d %s", w.Code, w.Body)
+	}
+	pr, err := loadPreset("donation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pr.Amount.Equal(decimal.New(5, 0)) || pr.Currency != "EUR" || pr.Timeout != 600 || pr.Metadata["campaign"] != "spring" || pr.Source != "admin" {
+		t.Fatalf("unexpected preset: %+v", pr)
+	}
+	w = postAdminForm(handleAdminPresets, url.Values{"name": {"fixed"}, "amount": {"2"}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("config preset is replaced: %d", w.Code)
+	}
+	presets, err := loadPresets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != 2 || presets[0].Name != "donation" || presets[1].Source != "config" {
+		t.Fatalf("unexpected presets: %+v", presets)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/admin/presets?name=donation", nil)
+	w = httptest.NewRecorder()
+	handleAdminPresets(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("cannot delete preset: %d %s", w.Code, w.Body)
+	}
+	if _, err = loadPreset("donation"); err != errPresetNotFound {
+		t.Fatalf("preset is not deleted: %v", err)
+	}
+}
+
+func TestPayWithPreset(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedDuration = -1
+	config.Presets = map[string]Preset{"gold-tier": {Amount: decimal.RequireFromString("2.5"), Metadata: map[string]interface{}{"tier": "gold"}}}
+	t.Cleanup(func() {
+		config.Presets = nil
+		config.AllowedDuration = 0
+	})
+	stopCheckLoops(t)
+	pay := func(values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+
+	w := pay(url.Values{"preset": {"gold-tier"}, "amount": {"0.1"}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "PRESET_AMOUNT_CONFLICT") {
+		t.Fatalf("tampered amount accepted: %d %s", w.Code, w.Body)
+	}
+	w = pay(url.Values{"preset": {"silver-tier"}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "UNKNOWN_PRESET") {
+		t.Fatalf("unknown preset accepted: %d %s", w.Code, w.Body)
+	}
+	w = pay(url.Values{"preset": {"gold-tier"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+	}
+	var response Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPaymentByID(response.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Preset != "gold-tier" || !p.AmountInCurrency.Equal(decimal.RequireFromString("2.5")) || p.Metadata["tier"] != "gold" {
+		t.Fatalf("preset is not applied: %+v", p)
+	}
+}
+
+func TestPayTimeout(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.MinPaymentTimeout, config.MaxPaymentTimeout = 600, 86400
+	t.Cleanup(func() { config.MinPaymentTimeout, config.MaxPaymentTimeout = 0, 0 })
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	stopCheckLoops(t)
+	pay := func(timeout string) *httptest.ResponseRecorder {
+		values := url.Values{"amount": {"1"}, "timeout": {timeout}}
+		r := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+
+	for _, timeout := range []string{"599", "86401", "ten"} {
+		expectErrorCode(t, pay(timeout), http.StatusBadRequest, errCodeInvalidTimeout)
+	}
+	w := pay("900")
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+	}
+	var response Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.RemainingSeconds != 900 || !response.ExpiresAt.Equal(c.Now().Add(900*time.Second)) {
+		t.Fatalf("unexpected expiry: %d %s", response.RemainingSeconds, response.ExpiresAt)
+	}
+	c.Add(901 * time.Second)
+	p, err := LoadPaymentByID(response.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Timeout != 900 || !p.finished() {
+		t.Errorf("payment is not expired at its timeout: %+v", p)
+	}
+}
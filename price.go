@@ -1,11 +1,7 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -15,109 +11,125 @@ import (
 )
 
 const (
-	tickerURL = "https://pro-api.coinmarketcap.com/v1/cryptocurrency/quotes/latest"
-	nanoID    = "1567"
 	// Coinmarketcap updates quotes every 60 seconds.
-	priceUpdateInterval = 60 * time.Second
-	priceFetchTimeout   = 10 * time.Second
+	defaultPriceCacheDuration = 60
+	priceFetchTimeout         = 10 * time.Second
+)
+
+// Values for PriceStalePolicy config.
+const (
+	priceStaleRefuse = "refuse"
+	priceStaleFlag   = "flag"
 )
 
 type PriceWithTimestamp struct {
 	Price     decimal.Decimal
 	FetchedAt time.Time
+	// Name of the provider that returned the price.
+	Source string
+}
+
+// PriceQuote is a price returned from cache.
+type PriceQuote struct {
+	Price  decimal.Decimal
+	AsOf   time.Time
+	Source string
+	// Set when ticker cannot be reached and the last cached price is served.
+	Stale bool
+}
+
+// priceFetch is a fetch in progress shared by concurrent lookups of the same currency.
+type priceFetch struct {
+	done  chan struct{}
+	quote PriceQuote
+	err   error
 }
 
 var (
-	errBadTickerResponse = errors.New("bad ticker response")
+	// Ticker cannot be reached and there is no cached price younger than PriceMaxStaleness.
+	errPriceUnavailable = errors.New("price unavailable")
+	// None of the providers has a price in the currency.
+	errPriceCurrencyUnsupported = errors.New("currency is not supported by price providers")
 
-	// Cache price
-	mPrice sync.Mutex
-	prices = make(map[string]PriceWithTimestamp)
+	// Replaced in tests.
+	priceNow   = clockNow
+	fetchPrice = fetchNanoPrice
 
-	priceClient = &http.Client{
-		Timeout: priceFetchTimeout,
-	}
+	// Cache price
+	mPrice       sync.Mutex
+	prices       = make(map[string]PriceWithTimestamp)
+	priceFetches = make(map[string]*priceFetch)
 )
 
-type TickerResponse struct {
-	Data map[string]struct {
-		Quote map[string]struct {
-			Price float64 `json:"price"`
-		} `json:"quote"`
-	} `json:"data"`
+func getNanoPrice(currency string) (decimal.Decimal, error) {
+	quote, err := getNanoPriceQuote(currency)
+	return quote.Price, err
 }
 
-func getNanoPrice(currency string) (price decimal.Decimal, err error) {
-	if config.CoinmarketcapAPIKey == "" {
-		err = errors.New("empty CoinmarketcapAPIKey value in config")
-		return
-	}
+func priceCacheDuration() time.Duration {
+	return time.Duration(config.PriceCacheDuration) * time.Second
+}
+
+// getNanoPriceQuote returns the cached price if it is younger than PriceCacheDuration, otherwise fetches a new one.
+// Concurrent lookups of the same currency wait for a single fetch.
+// If fetching fails, the cached price is returned as stale until it is older than PriceMaxStaleness.
+// After that, errPriceUnavailable is returned together with the stale quote, if any.
+func getNanoPriceQuote(currency string) (quote PriceQuote, err error) {
 	if currency == "" {
 		currency = "USD"
 	}
 	currency = strings.ToUpper(currency)
 
 	mPrice.Lock()
-	defer mPrice.Unlock()
-
-	if cached, ok := prices[currency]; ok && time.Since(cached.FetchedAt) < priceUpdateInterval {
-		return cached.Price, nil
+	cached, ok := prices[currency]
+	if ok && priceNow().Sub(cached.FetchedAt) < priceCacheDuration() {
+		mPrice.Unlock()
+		priceCacheStats.hit(priceNow().Sub(cached.FetchedAt))
+		return PriceQuote{Price: cached.Price, AsOf: cached.FetchedAt, Source: cached.Source}, nil
 	}
-
-	req, err := http.NewRequest("GET", tickerURL, nil)
-	if err != nil {
-		return
+	priceCacheStats.miss()
+	f, fetching := priceFetches[currency]
+	if fetching {
+		mPrice.Unlock()
+		<-f.done
+		return f.quote, f.err
 	}
+	f = &priceFetch{done: make(chan struct{})}
+	priceFetches[currency] = f
+	mPrice.Unlock()
 
-	q := url.Values{}
-	q.Add("id", nanoID)
-	q.Add("convert", currency)
-
-	req.Header.Set("Accepts", "application/json")
-	req.Header.Add("X-CMC_PRO_API_KEY", config.CoinmarketcapAPIKey)
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := priceClient.Do(req)
-	if err != nil {
-		return
-	}
-	defer func() {
-		if err2 := resp.Body.Close(); err2 != nil {
-			log.Debug(err2)
+	price, source, err := fetchPrice(currency)
+	mPrice.Lock()
+	if err == nil {
+		if ok {
+			priceCacheStats.invalidate()
 		}
-	}()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		err = errBadTickerResponse
-		return
+		fetchedAt := priceNow()
+		prices[currency] = PriceWithTimestamp{Price: price, FetchedAt: fetchedAt, Source: source}
+		f.quote = PriceQuote{Price: price, AsOf: fetchedAt, Source: source}
+	} else if err == errPriceCurrencyUnsupported {
+		f.err = err
+	} else {
+		log.Errorln("cannot fetch price:", err)
+		f.quote, f.err = staleQuote(cached, ok)
 	}
-	var response TickerResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return
-	}
-	currencyVal, ok := response.Data[nanoID]
-	if !ok {
-		err = errors.New("bad currency")
-		return
-	}
-	quoteVal, ok := currencyVal.Quote[currency]
+	delete(priceFetches, currency)
+	mPrice.Unlock()
+	close(f.done)
+	return f.quote, f.err
+}
+
+// staleQuote returns the cached price after a failed fetch if it is younger than PriceMaxStaleness.
+func staleQuote(cached PriceWithTimestamp, ok bool) (PriceQuote, error) {
 	if !ok {
-		err = errBadTickerResponse
-		return
-	}
-	price = decimal.NewFromFloat(quoteVal.Price)
-	if price.LessThanOrEqual(decimal.NewFromFloat(0)) {
-		err = errors.New("bad price")
-		return
+		metricPriceRefusals.Add(1)
+		return PriceQuote{}, errPriceUnavailable
 	}
-	// Cache new value
-	prices[currency] = PriceWithTimestamp{
-		Price:     price,
-		FetchedAt: time.Now(),
+	quote := PriceQuote{Price: cached.Price, AsOf: cached.FetchedAt, Source: cached.Source, Stale: true}
+	if priceNow().Sub(cached.FetchedAt) > time.Duration(config.PriceMaxStaleness)*time.Second {
+		metricPriceRefusals.Add(1)
+		return quote, errPriceUnavailable
 	}
-	return
+	metricPriceStaleServes.Add(1)
+	return quote, nil
 }
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Classes of PriceError.
+const (
+	priceErrRateLimited         = "rate_limited"
+	priceErrUnsupportedCurrency = "unsupported_currency"
+	priceErrNetwork             = "network"
+	priceErrMalformedResponse   = "malformed_response"
+)
+
+const (
+	// Backoff duration when a rate limited response does not contain Retry-After header.
+	defaultRetryAfter = 60 * time.Second
+	// Provider is skipped after this many consecutive failures.
+	providerMaxFailures = 3
+	// Duration to skip an unhealthy provider.
+	providerFailureBackoff = 30 * time.Second
+	// Weight of the last fetch in moving latency and success rate of a provider.
+	providerScoreAlpha = 0.2
+	// Success rate is not taken lower than this when calculating score.
+	providerMinSuccessRate = 0.01
+)
+
+// Values of ProviderSelection config.
+const (
+	// Providers are tried in the order of PriceProviders.
+	providerSelectionOrdered = "ordered"
+	// Healthy providers are tried in the order of their scores.
+	providerSelectionFastest = "fastest"
+)
+
+var (
+	priceClient = &http.Client{
+		Timeout: priceFetchTimeout,
+	}
+
+	metricPriceProviderErrors = expvar.NewMap("price_provider_errors_total")
+	metricPriceProviderFetch  = expvar.NewMap("price_provider_fetches_total")
+)
+
+// PriceError is returned from price providers.
+type PriceError struct {
+	Provider string
+	Class    string
+	// Set for rate limited errors.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *PriceError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Provider, e.Class, e.Err)
+}
+
+func (e *PriceError) Unwrap() error {
+	return e.Err
+}
+
+// priceProvider fetches the price of NANO in a fiat currency.
+// Fetch must return *PriceError on failure.
+type priceProvider interface {
+	Name() string
+	Fetch(currency string) (decimal.Decimal, error)
+}
+
+// currencyLister is a provider that can list the fiat currencies it has prices in.
+// SupportedCurrencies must return *PriceError on failure.
+type currencyLister interface {
+	priceProvider
+	SupportedCurrencies() ([]string, error)
+}
+
+// historicalPriceProvider fetches the price of NANO at a time in the past.
+// HistoricalPrice must return *PriceError on failure.
+type historicalPriceProvider interface {
+	priceProvider
+	HistoricalPrice(currency string, at time.Time) (decimal.Decimal, error)
+}
+
+// providerState tracks health of a provider.
+type providerState struct {
+	provider priceProvider
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	backoffUntil        time.Time
+	lastError           *PriceError
+	lastErrorAt         time.Time
+	lastSuccessAt       time.Time
+	// Moving averages of fetches. Fetches for unsupported currencies are not counted.
+	samples     int
+	latency     float64
+	successRate float64
+}
+
+// ProviderHealth is returned from admin debug providers endpoint.
+type ProviderHealth struct {
+	Name                string     `json:"name"`
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	BackoffUntil        *time.Time `json:"backoffUntil"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorClass      string     `json:"lastErrorClass,omitempty"`
+	LastErrorAt         *time.Time `json:"lastErrorAt"`
+	LastSuccessAt       *time.Time `json:"lastSuccessAt"`
+	// Moving average of fetch duration in seconds.
+	LatencySeconds float64 `json:"latencySeconds"`
+	SuccessRate    float64 `json:"successRate"`
+	// Used for ordering providers when ProviderSelection is "fastest". Lower is better.
+	Score float64 `json:"score"`
+	// Set for the provider that is tried first for the next fetch.
+	Preferred bool `json:"preferred"`
+}
+
+var (
+	priceProvidersMu sync.Mutex
+	priceProviders   []*providerState
+)
+
+// setPriceProviders sets providers in failover order.
+func setPriceProviders(providers ...priceProvider) {
+	states := make([]*providerState, len(providers))
+	for i, p := range providers {
+		states[i] = &providerState{provider: p}
+	}
+	priceProvidersMu.Lock()
+	priceProviders = states
+	priceProvidersMu.Unlock()
+}
+
+// newPriceProvider returns the provider with name from PriceProviders config.
+func newPriceProvider(name string) (priceProvider, error) {
+	switch name {
+	case "coinmarketcap":
+		return &coinmarketcap{url: coinmarketcapURL, apiKey: config.CoinmarketcapAPIKey}, nil
+	case "coingecko":
+		return &coingecko{url: coingeckoURL}, nil
+	}
+	return nil, fmt.Errorf("unknown price provider: %q", name)
+}
+
+func initPriceProviders() error {
+	providers := make([]priceProvider, 0, len(config.PriceProviders))
+	for _, name := range config.PriceProviders {
+		if name == "coinmarketcap" && config.CoinmarketcapAPIKey == "" {
+			continue
+		}
+		p, err := newPriceProvider(name)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, p)
+	}
+	setPriceProviders(providers...)
+	return nil
+}
+
+// orderedPriceProviders returns providers in the order they are tried.
+// With "fastest" selection, healthy providers come first, sorted by score.
+func orderedPriceProviders() []*providerState {
+	priceProvidersMu.Lock()
+	providers := priceProviders
+	priceProvidersMu.Unlock()
+	if config.ProviderSelection != providerSelectionFastest {
+		return providers
+	}
+	type scored struct {
+		state   *providerState
+		healthy bool
+		score   float64
+	}
+	list := make([]scored, len(providers))
+	for i, s := range providers {
+		list[i] = scored{state: s, healthy: !s.skip(), score: s.score()}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].healthy != list[j].healthy {
+			return list[i].healthy
+		}
+		return list[i].score < list[j].score
+	})
+	ordered := make([]*providerState, len(list))
+	for i, l := range list {
+		ordered[i] = l.state
+	}
+	return ordered
+}
+
+// fetchNanoPrice tries providers in order until one returns the price. Name of the provider is returned with the price.
+// Unsupported currency errors skip to the next provider without affecting provider health.
+// errPriceCurrencyUnsupported is returned if all tried providers do not support the currency.
+// Rate limited providers are skipped until their Retry-After passes.
+func fetchNanoPrice(currency string) (decimal.Decimal, string, error) {
+	providers := orderedPriceProviders()
+	if len(providers) == 0 {
+		return decimal.Zero, "", errors.New("no price provider configured")
+	}
+	var lastErr error
+	unsupported := true
+	for _, s := range providers {
+		if s.skip() {
+			continue
+		}
+		start := time.Now()
+		price, err := s.provider.Fetch(currency)
+		elapsed := time.Since(start)
+		metricPriceProviderFetch.Add(s.provider.Name(), 1)
+		if err == nil {
+			s.record(elapsed, true)
+			s.success()
+			if lastErr != nil {
+				anomalies.record(anomalyPriceFailovers, "")
+			}
+			return price, s.provider.Name(), nil
+		}
+		perr, ok := err.(*PriceError)
+		if !ok {
+			perr = &PriceError{Provider: s.provider.Name(), Class: priceErrMalformedResponse, Err: err}
+		}
+		log.Warningf("price provider %s failed: %s", perr.Provider, perr.Err)
+		if perr.Class != priceErrUnsupportedCurrency {
+			s.record(elapsed, false)
+			unsupported = false
+		}
+		s.failure(perr)
+		lastErr = perr
+	}
+	if lastErr != nil && unsupported {
+		return decimal.Zero, "", errPriceCurrencyUnsupported
+	}
+	if lastErr == nil {
+		lastErr = errors.New("all price providers are backing off")
+	}
+	return decimal.Zero, "", lastErr
+}
+
+// record updates moving latency and success rate with the result of a fetch.
+func (s *providerState) record(latency time.Duration, success bool) {
+	var ok float64
+	if success {
+		ok = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.samples == 0 {
+		s.latency, s.successRate = latency.Seconds(), ok
+	} else {
+		s.latency += providerScoreAlpha * (latency.Seconds() - s.latency)
+		s.successRate += providerScoreAlpha * (ok - s.successRate)
+	}
+	s.samples++
+}
+
+// score is the expected latency adjusted for failures.
+// Providers without samples score zero so that they are tried and measured.
+func (s *providerState) score() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scoreLocked()
+}
+
+func (s *providerState) scoreLocked() float64 {
+	if s.samples == 0 {
+		return 0
+	}
+	rate := s.successRate
+	if rate < providerMinSuccessRate {
+		rate = providerMinSuccessRate
+	}
+	return s.latency / rate
+}
+
+func (s *providerState) skip() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return priceNow().Before(s.backoffUntil)
+}
+
+func (s *providerState) success() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consecutiveFailures = 0
+	s.backoffUntil = time.Time{}
+	s.lastSuccessAt = priceNow()
+}
+
+func (s *providerState) failure(err *PriceError) {
+	metricPriceProviderErrors.Add(err.Provider+"."+err.Class, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+	s.lastErrorAt = priceNow()
+	switch err.Class {
+	case priceErrUnsupportedCurrency:
+		// Not a problem of the provider.
+	case priceErrRateLimited:
+		retryAfter := err.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfter
+		}
+		s.backoffUntil = priceNow().Add(retryAfter)
+	default:
+		s.consecutiveFailures++
+		if s.consecutiveFailures >= providerMaxFailures {
+			s.backoffUntil = priceNow().Add(providerFailureBackoff)
+		}
+	}
+}
+
+func (s *providerState) health() ProviderHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := ProviderHealth{
+		Name:                s.provider.Name(),
+		Healthy:             !priceNow().Before(s.backoffUntil),
+		ConsecutiveFailures: s.consecutiveFailures,
+		BackoffUntil:        timePtr(s.backoffUntil),
+		LastErrorAt:         timePtr(s.lastErrorAt),
+		LastSuccessAt:       timePtr(s.lastSuccessAt),
+		LatencySeconds:      s.latency,
+		SuccessRate:         s.successRate,
+		Score:               s.scoreLocked(),
+	}
+	if s.lastError != nil {
+		h.LastError = s.lastError.Error()
+		h.LastErrorClass = s.lastError.Class
+	}
+	return h
+}
+
+// priceProvidersHealth returns the health of providers in config order.
+func priceProvidersHealth() []ProviderHealth {
+	priceProvidersMu.Lock()
+	providers := priceProviders
+	priceProvidersMu.Unlock()
+	preferred := preferredPriceProvider()
+	ret := make([]ProviderHealth, len(providers))
+	for i, s := range providers {
+		ret[i] = s.health()
+		ret[i].Preferred = ret[i].Name == preferred
+	}
+	return ret
+}
+
+// preferredPriceProvider returns the name of the provider that is tried first for the next fetch.
+func preferredPriceProvider() string {
+	for _, s := range orderedPriceProviders() {
+		if !s.skip() {
+			return s.provider.Name()
+		}
+	}
+	return ""
+}
+
+// timePtr returns nil for zero time.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// getProviderJSON does a GET request and classifies errors.
+// Responses with status 400 are passed to badRequest to decide if they mean unsupported currency.
+func getProviderJSON(provider string, req *http.Request, response interface{}, badRequest func(body []byte) bool) error {
+	newErr := func(class string, err error) *PriceError {
+		return &PriceError{Provider: provider, Class: class, Err: err}
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := priceClient.Do(req)
+	if err != nil {
+		return newErr(priceErrNetwork, err)
+	}
+	defer func() {
+		if err2 := resp.Body.Close(); err2 != nil {
+			log.Debug(err2)
+		}
+	}()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return newErr(priceErrNetwork, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		perr := newErr(priceErrRateLimited, errors.New(resp.Status))
+		perr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		return perr
+	case resp.StatusCode == http.StatusBadRequest && badRequest != nil && badRequest(body):
+		return newErr(priceErrUnsupportedCurrency, errors.New(resp.Status))
+	case resp.StatusCode >= 500:
+		return newErr(priceErrNetwork, errors.New(resp.Status))
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return newErr(priceErrMalformedResponse, errors.New(resp.Status))
+	}
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		return newErr(priceErrMalformedResponse, err)
+	}
+	return nil
+}
+
+// parseRetryAfter parses the header in seconds or HTTP date format.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return t.Sub(priceNow())
+	}
+	return 0
+}
+
+const (
+	coinmarketcapURL = "https://pro-api.coinmarketcap.com/v1/cryptocurrency/quotes/latest"
+	nanoID           = "1567"
+)
+
+const coinmarketcapFiatURL = "https://pro-api.coinmarketcap.com/v1/fiat/map"
+
+type coinmarketcap struct {
+	url     string
+	fiatURL string
+	apiKey  string
+}
+
+type TickerResponse struct {
+	Data map[string]struct {
+		Quote map[string]struct {
+			Price float64 `json:"price"`
+		} `json:"quote"`
+	} `json:"data"`
+}
+
+func (c *coinmarketcap) Name() string { return "coinmarketcap" }
+
+func (c *coinmarketcap) Fetch(currency string) (decimal.Decimal, error) {
+	newErr := func(class string, err error) *PriceError {
+		return &PriceError{Provider: c.Name(), Class: class, Err: err}
+	}
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return decimal.Zero, newErr(priceErrNetwork, err)
+	}
+	q := url.Values{}
+	q.Add("id", nanoID)
+	q.Add("convert", currency)
+	req.Header.Add("X-CMC_PRO_API_KEY", c.apiKey)
+	req.URL.RawQuery = q.Encode()
+
+	var response TickerResponse
+	err = getProviderJSON(c.Name(), req, &response, func(body []byte) bool {
+		// Coinmarketcap returns 400 with "Invalid value for \"convert\"" message.
+		return strings.Contains(string(body), "convert")
+	})
+	if err != nil {
+		return decimal.Zero, err
+	}
+	currencyVal, ok := response.Data[nanoID]
+	if !ok {
+		return decimal.Zero, newErr(priceErrMalformedResponse, errors.New("no data for NANO"))
+	}
+	quoteVal, ok := currencyVal.Quote[currency]
+	if !ok {
+		return decimal.Zero, newErr(priceErrUnsupportedCurrency, errors.New("no quote for currency"))
+	}
+	price := decimal.NewFromFloat(quoteVal.Price)
+	if !price.IsPositive() {
+		return decimal.Zero, newErr(priceErrMalformedResponse, errors.New("bad price"))
+	}
+	return price, nil
+}
+
+// SupportedCurrencies returns the fiat currencies listed by coinmarketcap.
+func (c *coinmarketcap) SupportedCurrencies() ([]string, error) {
+	u := c.fiatURL
+	if u == "" {
+		u = coinmarketcapFiatURL
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, &PriceError{Provider: c.Name(), Class: priceErrNetwork, Err: err}
+	}
+	req.Header.Add("X-CMC_PRO_API_KEY", c.apiKey)
+	var response struct {
+		Data []struct {
+			Symbol string `json:"symbol"`
+		} `json:"data"`
+	}
+	err = getProviderJSON(c.Name(), req, &response, nil)
+	if err != nil {
+		return nil, err
+	}
+	currencies := make([]string, 0, len(response.Data))
+	for _, d := range response.Data {
+		if validCurrency(d.Symbol) {
+			currencies = append(currencies, strings.ToUpper(d.Symbol))
+		}
+	}
+	return currencies, nil
+}
+
+const (
+	coingeckoURL           = "https://api.coingecko.com/api/v3/simple/price"
+	coingeckoCurrenciesURL = "https://api.coingecko.com/api/v3/simple/supported_vs_currencies"
+)
+
+// Currencies that coingecko lists with fiat currencies.
+var coingeckoNonFiat = map[string]bool{
+	"btc": true, "eth": true, "ltc": true, "bch": true, "bnb": true, "eos": true, "xrp": true, "xlm": true,
+	"link": true, "dot": true, "yfi": true, "bits": true, "sats": true, "xag": true, "xau": true, "xdr": true,
+}
+
+type coingecko struct {
+	url           string
+	rangeURL      string
+	currenciesURL string
+}
+
+func (c *coingecko) Name() string { return "coingecko" }
+
+func (c *coingecko) Fetch(currency string) (decimal.Decimal, error) {
+	newErr := func(class string, err error) *PriceError {
+		return &PriceError{Provider: c.Name(), Class: class, Err: err}
+	}
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return decimal.Zero, newErr(priceErrNetwork, err)
+	}
+	vs := strings.ToLower(currency)
+	q := url.Values{}
+	q.Add("ids", "nano")
+	q.Add("vs_currencies", vs)
+	req.URL.RawQuery = q.Encode()
+
+	var response map[string]map[string]decimal.Decimal
+	err = getProviderJSON(c.Name(), req, &response, nil)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	quotes, ok := response["nano"]
+	if !ok {
+		return decimal.Zero, newErr(priceErrMalformedResponse, errors.New("no data for NANO"))
+	}
+	// Coingecko omits the currencies it does not support.
+	price, ok := quotes[vs]
+	if !ok {
+		return decimal.Zero, newErr(priceErrUnsupportedCurrency, errors.New("no quote for currency"))
+	}
+	if !price.IsPositive() {
+		return decimal.Zero, newErr(priceErrMalformedResponse, errors.New("bad price"))
+	}
+	return price, nil
+}
+
+// SupportedCurrencies returns the fiat currencies that coingecko has prices in. Cryptocurrencies and metals are left out.
+func (c *coingecko) SupportedCurrencies() ([]string, error) {
+	u := c.currenciesURL
+	if u == "" {
+		u = coingeckoCurrenciesURL
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, &PriceError{Provider: c.Name(), Class: priceErrNetwork, Err: err}
+	}
+	var response []string
+	err = getProviderJSON(c.Name(), req, &response, nil)
+	if err != nil {
+		return nil, err
+	}
+	currencies := make([]string, 0, len(response))
+	for _, currency := range response {
+		if validCurrency(currency) && !coingeckoNonFiat[strings.ToLower(currency)] {
+			currencies = append(currencies, strings.ToUpper(currency))
+		}
+	}
+	return currencies, nil
+}
+
+const coingeckoRangeURL = "https://api.coingecko.com/api/v3/coins/nano/market_chart/range"
+
+// Range of price data requested around the time of historical price.
+// Coingecko returns hourly data for ranges between 1 and 90 days.
+const coingeckoHistoryRange = 12 * time.Hour
+
+// HistoricalPrice returns the price point closest to the given time.
+func (c *coingecko) HistoricalPrice(currency string, at time.Time) (decimal.Decimal, error) {
+	newErr := func(class string, err error) *PriceError {
+		return &PriceError{Provider: c.Name(), Class: class, Err: err}
+	}
+	u := c.rangeURL
+	if u == "" {
+		u = coingeckoRangeURL
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return decimal.Zero, newErr(priceErrNetwork, err)
+	}
+	q := url.Values{}
+	q.Add("vs_currency", strings.ToLower(currency))
+	q.Add("from", strconv.FormatInt(at.Add(-coingeckoHistoryRange).Unix(), 10))
+	q.Add("to", strconv.FormatInt(at.Add(coingeckoHistoryRange).Unix(), 10))
+	req.URL.RawQuery = q.Encode()
+
+	var response struct {
+		// Pairs of timestamp in milliseconds and price.
+		Prices [][2]decimal.Decimal `json:"prices"`
+	}
+	err = getProviderJSON(c.Name(), req, &response, func(body []byte) bool {
+		return strings.Contains(string(body), "vs_currency")
+	})
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if len(response.Prices) == 0 {
+		return decimal.Zero, newErr(priceErrMalformedResponse, errors.New("no price data in range"))
+	}
+	target := decimal.NewFromInt(at.UnixNano() / int64(time.Millisecond))
+	best := response.Prices[0]
+	for _, p := range response.Prices[1:] {
+		if p[0].Sub(target).Abs().LessThan(best[0].Sub(target).Abs()) {
+			best = p
+		}
+	}
+	if !best[1].IsPositive() {
+		return decimal.Zero, newErr(priceErrMalformedResponse, errors.New("bad price"))
+	}
+	return best[1], nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// testProviderServer responds with status and body, setting Retry-After for 429.
+func testProviderServer(t *testing.T, status *int, body *string) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "120")
+		}
+		w.WriteHeader(*status)
+		_, _ = w.Write([]byte(*body))
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestPriceProviderErrorClasses(t *testing.T) {
+	var status int
+	var body string
+	url := testProviderServer(t, &status, &body)
+	providers := []priceProvider{
+		&coinmarketcap{url: url, apiKey: "key"},
+		&coingecko{url: url},
+	}
+	cases := []struct {
+		provider string
+		status   int
+		body     string
+		class    string
+	}{
+		{"coinmarketcap", 429, `{}`, priceErrRateLimited},
+		{"coinmarketcap", 400, `{"status":{"error_message":"Invalid value for \"convert\": \"XYZ\""}}`, priceErrUnsupportedCurrency},
+		{"coinmarketcap", 200, `{"data":{"1567":{"quote":{}}}}`, priceErrUnsupportedCurrency},
+		{"coinmarketcap", 502, `bad gateway`, priceErrNetwork},
+		{"coinmarketcap", 200, `not json`, priceErrMalformedResponse},
+		{"coingecko", 429, `{}`, priceErrRateLimited},
+		{"coingecko", 200, `{"nano":{}}`, priceErrUnsupportedCurrency},
+		{"coingecko", 503, ``, priceErrNetwork},
+		{"coingecko", 200, `{"bitcoin":{}}`, priceErrMalformedResponse},
+	}
+	for _, c := range cases {
+		status, body = c.status, c.body
+		for _, p := range providers {
+			if p.Name() != c.provider {
+				continue
+			}
+			_, err := p.Fetch("XYZ")
+			perr, ok := err.(*PriceError)
+			if !ok {
+				t.Fatalf("%s %d: expected PriceError, got %v", c.provider, c.status, err)
+			}
+			if perr.Class != c.class || perr.Provider != c.provider {
+				t.Errorf("%s %d %s: got class %s", c.provider, c.status, c.body, perr.Class)
+			}
+			if c.class == priceErrRateLimited && perr.RetryAfter != 120*time.Second {
+				t.Errorf("%s: unexpected retry after: %s", c.provider, perr.RetryAfter)
+			}
+		}
+	}
+
+	status, body = 200, `{"nano":{"usd":1.5}}`
+	price, err := providers[1].Fetch("USD")
+	if err != nil || !price.Equal(decimal.RequireFromString("1.5")) {
+		t.Errorf("unexpected price: %s, %v", price, err)
+	}
+}
+
+// stubProvider returns err if set, otherwise price after delay.
+type stubProvider struct {
+	name  string
+	price decimal.Decimal
+	err   *PriceError
+	delay time.Duration
+	calls int
+}
+
+func (p *stubProvider) Name() string { return p.name }
+
+func (p *stubProvider) Fetch(currency string) (decimal.Decimal, error) {
+	p.calls++
+	time.Sleep(p.delay)
+	if p.err != nil {
+		return decimal.Zero, p.err
+	}
+	return p.price, nil
+}
+
+func TestPriceProviderFailover(t *testing.T) {
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldNow := priceNow
+	priceNow = func() time.Time { return clock }
+	defer func() { priceNow = oldNow }()
+
+	first := &stubProvider{name: "first", price: decimal.NewFromInt(1)}
+	second := &stubProvider{name: "second", price: decimal.NewFromInt(2)}
+	setPriceProviders(first, second)
+	defer setPriceProviders()
+
+	metric := func(key string) int64 {
+		v := metricPriceProviderErrors.Get(key)
+		if v == nil {
+			return 0
+		}
+		return v.(interface{ Value() int64 }).Value()
+	}
+	health := func() ProviderHealth { return priceProvidersHealth()[0] }
+
+	// Unsupported currency skips to the next provider without counting as a failure.
+	before := metric("first.unsupported_currency")
+	first.err = &PriceError{Provider: "first", Class: priceErrUnsupportedCurrency, Err: errors.New("unsupported")}
+	price, _, err := fetchNanoPrice("XYZ")
+	if err != nil || !price.Equal(second.price) {
+		t.Fatalf("expected failover, got %s, %v", price, err)
+	}
+	if h := health(); !h.Healthy || h.ConsecutiveFailures != 0 || h.LastErrorClass != priceErrUnsupportedCurrency {
+		t.Errorf("unexpected health: %+v", h)
+	}
+	if metric("first.unsupported_currency") != before+1 {
+		t.Error("error is not counted")
+	}
+
+	// Network errors count as failures and back off the provider after max failures.
+	first.err = &PriceError{Provider: "first", Class: priceErrNetwork, Err: errors.New("timeout")}
+	for i := 0; i < providerMaxFailures; i++ {
+		_, _, _ = fetchNanoPrice("USD")
+	}
+	if h := health(); h.Healthy || h.ConsecutiveFailures != providerMaxFailures {
+		t.Errorf("unexpected health: %+v", h)
+	}
+	first.calls = 0
+	_, _, _ = fetchNanoPrice("USD")
+	if first.calls != 0 {
+		t.Error("unhealthy provider is called")
+	}
+	clock = clock.Add(providerFailureBackoff)
+	first.err = nil
+	price, _, _ = fetchNanoPrice("USD")
+	if !price.Equal(first.price) || !health().Healthy {
+		t.Error("provider did not recover")
+	}
+
+	// Rate limited provider backs off for Retry-After.
+	first.err = &PriceError{Provider: "first", Class: priceErrRateLimited, RetryAfter: 5 * time.Minute, Err: errors.New("429")}
+	_, _, _ = fetchNanoPrice("USD")
+	first.err = nil
+	clock = clock.Add(4 * time.Minute)
+	price, _, _ = fetchNanoPrice("USD")
+	if !price.Equal(second.price) {
+		t.Error("rate limited provider is not backed off")
+	}
+	clock = clock.Add(time.Minute)
+	price, _, _ = fetchNanoPrice("USD")
+	if !price.Equal(first.price) {
+		t.Error("rate limited provider is not retried after Retry-After")
+	}
+
+	// All providers failing returns the last error.
+	first.err = &PriceError{Provider: "first", Class: priceErrMalformedResponse, Err: errors.New("bad json")}
+	second.err = &PriceError{Provider: "second", Class: priceErrMalformedResponse, Err: errors.New("bad json")}
+	_, _, err = fetchNanoPrice("USD")
+	if perr, ok := err.(*PriceError); !ok || perr.Provider != "second" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPriceProviderFastest(t *testing.T) {
+	config.ProviderSelection = providerSelectionFastest
+	defer func() { config.ProviderSelection = providerSelectionOrdered }()
+	slow := &stubProvider{name: "slow", price: decimal.NewFromInt(1), delay: 20 * time.Millisecond}
+	fast := &stubProvider{name: "fast", price: decimal.NewFromInt(2), delay: time.Millisecond}
+	setPriceProviders(slow, fast)
+	defer setPriceProviders()
+
+	// Both are measured once, then the faster one is preferred.
+	for i := 0; i < 10; i++ {
+		if _, _, err := fetchNanoPrice("USD"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if preferredPriceProvider() != "fast" || slow.calls != 1 || fast.calls != 9 {
+		t.Fatalf("did not converge to fast provider: slow=%d fast=%d", slow.calls, fast.calls)
+	}
+	health := priceProvidersHealth()
+	if health[0].Preferred || !health[1].Preferred || health[1].Score >= health[0].Score {
+		t.Fatalf("unexpected health: %+v", health)
+	}
+
+	// Failures fall back to the slow provider until the fast one is backed off.
+	fast.err = &PriceError{Provider: "fast", Class: priceErrNetwork, Err: errors.New("down")}
+	for i := 0; i < providerMaxFailures; i++ {
+		price, _, err := fetchNanoPrice("USD")
+		if err != nil || !price.Equal(slow.price) {
+			t.Fatalf("expected fallback, got %s, %v", price, err)
+		}
+	}
+	if preferredPriceProvider() != "slow" {
+		t.Fatal("preferred provider is not switched")
+	}
+	calls := fast.calls
+	if _, _, err := fetchNanoPrice("USD"); err != nil || fast.calls != calls {
+		t.Fatalf("failing provider is tried: %v", err)
+	}
+}
+
+func TestCoingeckoHistoricalPrice(t *testing.T) {
+	var status int
+	var body string
+	url := testProviderServer(t, &status, &body)
+	p := &coingecko{rangeURL: url}
+	at := time.Unix(1590000000, 0)
+
+	status, body = 200, `{"prices":[[1589996400000,1.1],[1590001200000,1.2],[1590004800000,1.3]]}`
+	price, err := p.HistoricalPrice("USD", at)
+	if err != nil || !price.Equal(decimal.RequireFromString("1.2")) {
+		t.Errorf("unexpected price: %s, %v", price, err)
+	}
+	for _, c := range []struct {
+		status int
+		body   string
+		class  string
+	}{
+		{200, `{"prices":[]}`, priceErrMalformedResponse},
+		{400, `{"error":"invalid vs_currency"}`, priceErrUnsupportedCurrency},
+		{429, `{}`, priceErrRateLimited},
+	} {
+		status, body = c.status, c.body
+		_, err = p.HistoricalPrice("XYZ", at)
+		if perr, ok := err.(*PriceError); !ok || perr.Class != c.class {
+			t.Errorf("%d %s: expected %s, got %v", c.status, c.body, c.class, err)
+		}
+	}
+}
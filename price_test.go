@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// fakePriceSource replaces the ticker and the cache clock for the duration of a test.
+func fakePriceSource(t *testing.T) (clock *time.Time, fail *bool) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock = &start
+	fail = new(bool)
+	oldNow, oldFetch := priceNow, fetchPrice
+	priceNow = func() time.Time { return *clock }
+	fetchPrice = func(currency string) (decimal.Decimal, string, error) {
+		if *fail {
+			return decimal.Zero, "", errors.New("ticker is down")
+		}
+		return decimal.NewFromInt(2), "test", nil
+	}
+	prices = make(map[string]PriceWithTimestamp)
+	t.Cleanup(func() {
+		priceNow, fetchPrice = oldNow, oldFetch
+		prices = make(map[string]PriceWithTimestamp)
+	})
+	return clock, fail
+}
+
+func TestPriceStaleness(t *testing.T) {
+	config.setDefaults()
+	clock, fail := fakePriceSource(t)
+
+	quote, err := getNanoPriceQuote("usd")
+	if err != nil || quote.Stale {
+		t.Fatalf("expected fresh price, got %+v, %v", quote, err)
+	}
+
+	// Past the update interval the cached price is served as stale.
+	*fail = true
+	*clock = clock.Add(priceCacheDuration() + time.Second)
+	staleServes := metricPriceStaleServes.Value()
+	quote, err = getNanoPriceQuote("usd")
+	if err != nil || !quote.Stale || !quote.Price.Equal(decimal.NewFromInt(2)) {
+		t.Fatalf("expected stale price, got %+v, %v", quote, err)
+	}
+	if metricPriceStaleServes.Value() != staleServes+1 {
+		t.Error("stale serve is not counted")
+	}
+
+	// Past the hard limit the price is unavailable.
+	*clock = clock.Add(time.Duration(config.PriceMaxStaleness) * time.Second)
+	refusals := metricPriceRefusals.Value()
+	_, err = getNanoPriceQuote("usd")
+	if err != errPriceUnavailable {
+		t.Fatalf("expected errPriceUnavailable, got %v", err)
+	}
+	if metricPriceRefusals.Value() != refusals+1 {
+		t.Error("refusal is not counted")
+	}
+
+	// Ticker recovers.
+	*fail = false
+	quote, err = getNanoPriceQuote("usd")
+	if err != nil || quote.Stale || !quote.AsOf.Equal(*clock) {
+		t.Fatalf("expected fresh price, got %+v, %v", quote, err)
+	}
+}
+
+func TestPricePolicy(t *testing.T) {
+	config.setDefaults()
+	clock, fail := fakePriceSource(t)
+	_, _ = getNanoPriceQuote("USD")
+	*fail = true
+	*clock = clock.Add(time.Duration(config.PriceMaxStaleness+1) * time.Second)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/price?currency=USD", nil)
+	w := httptest.NewRecorder()
+	handlePrice(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != `{"error":{"code":"PRICE_UNAVAILABLE","message":"price is not available"}}`+"\n" {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	config.PriceStalePolicy = priceStaleFlag
+	defer func() { config.PriceStalePolicy = priceStaleRefuse }()
+	w = httptest.NewRecorder()
+	handlePrice(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	expected := `{"age":601,"asOf":"2020-01-01T00:00:00Z","price":"2","source":"test","stale":true}`
+	if body := w.Body.String(); body != expected {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
+
+func TestPriceSingleFlight(t *testing.T) {
+	config.setDefaults()
+	fakePriceSource(t)
+	var calls int32
+	release := make(chan struct{})
+	fetchPrice = func(currency string) (decimal.Decimal, string, error) {
+		atomic.AddInt32(&calls, 1)
+		if currency == "USD" {
+			<-release
+		}
+		return decimal.NewFromInt(2), "test", nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if price, err := getNanoPrice("USD"); err != nil || !price.Equal(decimal.NewFromInt(2)) {
+				t.Errorf("unexpected price: %s, %v", price, err)
+			}
+		}()
+	}
+	// Fetch of another currency is not blocked.
+	if _, err := getNanoPrice("EUR"); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt32(&calls) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("price is fetched %d times", calls)
+	}
+}
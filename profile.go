@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cenkalti/log"
+)
+
+// Profiles are named sets of defaults for common deployments, selected with Profile in config.
+// Settings are layered: values in config file and environment win over the profile,
+// and built-in defaults from setDefaults fill what is still unset.
+
+type configProfile struct {
+	defaults Config
+	// Checks the settings the profile depends on after defaults are set.
+	validate func(c *Config) error
+}
+
+var profiles = map[string]configProfile{
+	// Customer waits at the counter: payments expire soon and are checked often.
+	"kiosk": {defaults: Config{
+		AllowedDuration:         600,
+		NextCheckDurationFactor: 5,
+		MinNextCheckDuration:    2,
+		MaxNextCheckDuration:    10,
+		NodeTimeout:             5000,
+		HealthTimeout:           1000,
+		AdmissionSoftLag:        5,
+		AdmissionHardLag:        30,
+	}},
+	// Invoices are paid in days and merchants are told about payments with notifications.
+	"invoicing": {
+		defaults: Config{
+			AllowedDuration:      7 * 24 * 3600,
+			MaxNextCheckDuration: 3600,
+			LatePaymentWindow:    30 * 24 * 3600,
+			OutboxEnabled:        true,
+		},
+		validate: func(c *Config) error {
+			if c.NotificationURL == "" {
+				return errors.New("invoicing profile requires NotificationURL")
+			}
+			return nil
+		},
+	},
+	// Many concurrent payments on a dedicated node.
+	"high-volume": {defaults: Config{
+		CheckWorkers:         1000,
+		NodeConcurrency:      64,
+		PendingPagesPerCheck: 20,
+		OutboxEnabled:        true,
+		AdmissionSoftQueue:   100,
+		AdmissionHardQueue:   500,
+	}},
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the fields of c that are not set to the values in the selected profile.
+func (c *Config) applyProfile() error {
+	if c.Profile == "" {
+		return nil
+	}
+	p, ok := profiles[c.Profile]
+	if !ok {
+		return fmt.Errorf("unknown profile %q, must be one of: %s", c.Profile, strings.Join(profileNames(), ", "))
+	}
+	dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(&p.defaults).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if f := dst.Field(i); f.IsZero() && !src.Field(i).IsZero() {
+			f.Set(src.Field(i))
+		}
+	}
+	return nil
+}
+
+// validateProfile checks the settings required by the selected profile.
+func (c *Config) validateProfile() error {
+	if c.Profile == "" {
+		return nil
+	}
+	p, ok := profiles[c.Profile]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", c.Profile)
+	}
+	if p.validate != nil {
+		return p.validate(c)
+	}
+	return nil
+}
+
+// redactedConfig returns a copy of c with secrets replaced. API keys are replaced with their fingerprints.
+func (c Config) redactedConfig() Config {
+	for _, s := range []*string{&c.Seed, &c.MerchantWallet, &c.NotificationSecret, &c.AdminPassword, &c.CoinmarketcapAPIKey, &c.ObjectStorageAccessKey, &c.ObjectStorageSecretKey} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	if len(c.LegacySeeds) > 0 {
+		seeds := make([]string, len(c.LegacySeeds))
+		for i := range seeds {
+			seeds[i] = redacted
+		}
+		c.LegacySeeds = seeds
+	}
+	if c.APIKeys != nil {
+		keys := make(map[string]APIKey, len(c.APIKeys))
+		for key, apiKey := range c.APIKeys {
+			keys[keyFingerprint(key)] = apiKey
+		}
+		c.APIKeys = keys
+	}
+	if c.Merchants != nil {
+		merchants := make(map[string]Merchant, len(c.Merchants))
+		for id, m := range c.Merchants {
+			if m.Seed != "" {
+				m.Seed = redacted
+			}
+			if m.APIKey != "" {
+				m.APIKey = keyFingerprint(m.APIKey)
+			}
+			merchants[id] = m
+		}
+		c.Merchants = merchants
+	}
+	return c
+}
+
+// handleAdminConfigEffective returns the configuration in use, merged with the profile and defaults.
+func handleAdminConfigEffective(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, config.redactedConfig())
+}
+
+func runCheckConfigCommand(args []string) {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	fs.StringVar(configPath, "config", *configPath, "config file path")
+	printEffective := fs.Bool("print-effective", false, "print the configuration merged with the profile and defaults, secrets redacted")
+	_ = fs.Parse(args)
+	err := config.Read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*printEffective {
+		fmt.Println("config is valid")
+		return
+	}
+	err = toml.NewEncoder(os.Stdout).Encode(config.redactedConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigProfiles(t *testing.T) {
+	for _, name := range profileNames() {
+		c := Config{Profile: name, NotificationURL: "http://merchant.example/notify"}
+		if err := c.applyProfile(); err != nil {
+			t.Fatal(err)
+		}
+		c.setDefaults()
+		if err := c.validate(); err != nil {
+			t.Errorf("profile %s is invalid: %s", name, err)
+		}
+	}
+
+	// Explicit settings win over the profile, the profile wins over the defaults.
+	c := Config{Profile: "kiosk", AllowedDuration: 900}
+	if err := c.applyProfile(); err != nil {
+		t.Fatal(err)
+	}
+	c.setDefaults()
+	if c.AllowedDuration != 900 || c.MaxNextCheckDuration != 10 || c.CheckWorkers != 100 {
+		t.Errorf("unexpected merged config: %d %d %d", c.AllowedDuration, c.MaxNextCheckDuration, c.CheckWorkers)
+	}
+
+	c = Config{Profile: "invoicing"}
+	_ = c.applyProfile()
+	c.setDefaults()
+	if err := c.validate(); err == nil {
+		t.Error("invoicing profile is valid without NotificationURL")
+	}
+	c = Config{Profile: "unknown"}
+	if err := c.applyProfile(); err == nil {
+		t.Error("unknown profile is applied")
+	}
+}
+
+func TestAdminConfigEffective(t *testing.T) {
+	config.setDefaults()
+	config.AdminPassword = "admin-secret"
+	config.APIKeys = map[string]APIKey{"merchant-key": {Tier: "gold"}}
+	t.Cleanup(func() {
+		config.AdminPassword = ""
+		config.APIKeys = nil
+	})
+	w := httptest.NewRecorder()
+	handleAdminConfigEffective(w, httptest.NewRequest(http.MethodGet, "/admin/config-effective", nil))
+	if strings.Contains(w.Body.String(), "admin-secret") || strings.Contains(w.Body.String(), "merchant-key") {
+		t.Fatalf("secrets are not redacted: %s", w.Body)
+	}
+	var c Config
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.APIKeys[keyFingerprint("merchant-key")].Tier != "gold" || c.CheckWorkers != config.CheckWorkers {
+		t.Errorf("unexpected effective config: %+v", c.APIKeys)
+	}
+	if config.AdminPassword != "admin-secret" {
+		t.Error("config is changed")
+	}
+}
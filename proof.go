@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+const (
+	proofVersion     = 1
+	proofNodeTimeout = 10 * time.Second
+	maxProofBodySize = 64 * 1024
+)
+
+const proofInstructions = "Call blocks_info RPC with json_block=true on any Nano node you trust for the hashes in sendBlocks. " +
+	"For each block check that block_account equals source, contents.link_as_account equals account, amount equals amountRaw and confirmed is true. " +
+	"The sum of amountRaw values must be greater than or equal to the requested amountRaw. " +
+	"Alternatively, POST this document with a nodeURL to /api/proof/verify."
+
+var (
+	errForbiddenScheme  = errors.New("scheme is not allowed")
+	errForbiddenPort    = errors.New("port is not allowed")
+	errForbiddenAddress = errors.New("address is not allowed")
+)
+
+// Proof contains everything needed to verify a payment directly on the ledger without trusting this server.
+type Proof struct {
+	Version          int             `json:"version"`
+	Account          string          `json:"account"`
+	AmountRaw        decimal.Decimal `json:"amountRaw"`
+	AmountInCurrency CurrencyAmount  `json:"amountInCurrency"`
+	Currency         string          `json:"currency"`
+	State            string          `json:"state"`
+	CreatedAt        time.Time       `json:"createdAt"`
+	FulfilledAt      *time.Time      `json:"fulfilledAt"`
+	SendBlocks       []ProofBlock    `json:"sendBlocks"`
+	SweepBlock       string          `json:"sweepBlock,omitempty"`
+	Instructions     string          `json:"instructions"`
+}
+
+type ProofBlock struct {
+	Hash         string          `json:"hash"`
+	Source       string          `json:"source"`
+	AmountRaw    decimal.Decimal `json:"amountRaw"`
+	ReceiveBlock string          `json:"receiveBlock,omitempty"`
+}
+
+func NewProof(p *Payment) *Proof {
+	blocks := make([]ProofBlock, 0, len(p.SubPayments))
+	for hash, sp := range p.SubPayments {
+		blocks = append(blocks, ProofBlock{
+			Hash:         hash,
+			Source:       sp.Account,
+			AmountRaw:    sp.Amount,
+			ReceiveBlock: sp.ReceiveHash,
+		})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Hash < blocks[j].Hash })
+	return &Proof{
+		Version:          proofVersion,
+		Account:          p.Account,
+		AmountRaw:        p.Amount,
+		AmountInCurrency: p.AmountInCurrency,
+		Currency:         p.Currency,
+		State:            p.State,
+		CreatedAt:        p.CreatedAt,
+		FulfilledAt:      p.FulfilledAt,
+		SendBlocks:       blocks,
+		SweepBlock:       p.SendHash,
+		Instructions:     proofInstructions,
+	}
+}
+
+// ProofVerification is the result of checking a Proof against a node.
+type ProofVerification struct {
+	Valid  bool                     `json:"valid"`
+	Total  decimal.Decimal          `json:"totalRaw"`
+	Blocks []ProofBlockVerification `json:"blocks"`
+}
+
+type ProofBlockVerification struct {
+	Hash               string `json:"hash"`
+	Found              bool   `json:"found"`
+	SourceMatches      bool   `json:"sourceMatches"`
+	DestinationMatches bool   `json:"destinationMatches"`
+	AmountMatches      bool   `json:"amountMatches"`
+	Confirmed          bool   `json:"confirmed"`
+}
+
+// verifyProof checks that the blocks in proof exist on the ledger of n and carry the stated amounts.
+func verifyProof(n *nano.Node, proof *Proof) (*ProofVerification, error) {
+	hashes := make([]string, len(proof.SendBlocks))
+	for i, b := range proof.SendBlocks {
+		hashes[i] = b.Hash
+	}
+	result := &ProofVerification{Blocks: make([]ProofBlockVerification, len(proof.SendBlocks))}
+	if len(hashes) == 0 {
+		return result, nil
+	}
+	infos, err := n.BlocksInfo(hashes)
+	if err != nil {
+		return nil, err
+	}
+	valid := true
+	for i, b := range proof.SendBlocks {
+		v := ProofBlockVerification{Hash: b.Hash}
+		info, ok := infos[b.Hash]
+		if ok {
+			v.Found = true
+			v.SourceMatches = info.BlockAccount == b.Source
+			v.DestinationMatches = info.Contents.LinkAsAccount == proof.Account || info.Contents.Destination == proof.Account
+			amount, err2 := decimal.NewFromString(info.Amount)
+			v.AmountMatches = err2 == nil && amount.Equal(b.AmountRaw)
+			v.Confirmed = info.Confirmed == "true"
+		}
+		if v.Found && v.SourceMatches && v.DestinationMatches && v.AmountMatches && v.Confirmed {
+			result.Total = result.Total.Add(b.AmountRaw)
+		} else {
+			valid = false
+		}
+		result.Blocks[i] = v
+	}
+	result.Valid = valid && result.Total.GreaterThanOrEqual(proof.AmountRaw)
+	return result, nil
+}
+
+// validateNodeURL checks the node URL supplied by a third party before we make a request to it.
+func validateNodeURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !stringInSlice(u.Scheme, config.ProofNodeAllowedSchemes) {
+		return nil, errForbiddenScheme
+	}
+	if u.Hostname() == "" || u.User != nil {
+		return nil, errForbiddenAddress
+	}
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "http":
+			port = "80"
+		}
+	}
+	if !portAllowed(port) {
+		return nil, errForbiddenPort
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublicIP(ip) {
+		return nil, errForbiddenAddress
+	}
+	return u, nil
+}
+
+func portAllowed(port string) bool {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range config.ProofNodeAllowedPorts {
+		if p == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+var nonPublicNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	ret := make([]*net.IPNet, len(cidrs))
+	for i, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ret[i] = n
+	}
+	return ret
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// safeDialControl is called for every connection made to third party nodes.
+// Checking the resolved address at connect time also covers DNS rebinding and redirects.
+func safeDialControl(network, address string, c syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !portAllowed(port) {
+		return errForbiddenPort
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+func newProofNode(u *url.URL) *nano.Node {
+	dialer := &net.Dialer{
+		Timeout: proofNodeTimeout,
+		Control: safeDialControl,
+	}
+	n := nano.New(u.String())
+	n.SetTimeout(proofNodeTimeout)
+	n.SetTransport(&http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout: proofNodeTimeout,
+	})
+	return n
+}
+
+func handleProof(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	claims, err := ParseToken(token)
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	payment, err := LoadPayment([]byte(claims.Account))
+	if err == errPaymentNotFound {
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	if payment.FulfilledAt == nil {
+		writeError(w, errCodePaymentNotVerified, http.StatusConflict, "payment is not verified")
+		return
+	}
+	b, err := json.Marshal(NewProof(payment))
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+func handleProofVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, errCodeMethodNotAllowed, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	var req struct {
+		NodeURL string `json:"nodeURL"`
+		Proof   Proof  `json:"proof"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProofBodySize)).Decode(&req)
+	if err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	u, err := validateNodeURL(req.NodeURL)
+	if err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, fmt.Sprintf("invalid node url: %s", err))
+		return
+	}
+	result, err := verifyProof(newProofNode(u), &req.Proof)
+	if err != nil {
+		log.Debugln("proof verification error:", err)
+		writeError(w, errCodeNodeUnavailable, http.StatusBadGateway, "cannot query node")
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// publicStatsFields are the only stats that can be published with PublicStatsFields config.
+// Each field is copied explicitly so adding a field to Stats never exposes it publicly.
+var publicStatsFields = map[string]func(s *Stats) interface{}{
+	"total_verified":              func(s *Stats) interface{} { return s.Verified },
+	"median_verification_seconds": func(s *Stats) interface{} { return s.MedianVerificationLatency.Seconds() },
+	"verified_within_percent":     func(s *Stats) interface{} { return s.VerifiedWithinPercent },
+	"uptime_seconds":              func(s *Stats) interface{} { return int64(s.Uptime.Seconds()) },
+}
+
+// validatePublicStatsFields returns an error for unknown field names.
+func validatePublicStatsFields(fields []string) error {
+	for _, f := range fields {
+		if _, ok := publicStatsFields[f]; !ok {
+			return fmt.Errorf("unknown field in PublicStatsFields: %q", f)
+		}
+	}
+	return nil
+}
+
+// publicStats returns whitelisted fields from stats.
+func publicStats(stats *Stats, fields []string) map[string]interface{} {
+	ret := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if get, ok := publicStatsFields[f]; ok {
+			ret[f] = get(stats)
+		}
+	}
+	return ret
+}
+
+var (
+	publicStatsMu       sync.Mutex
+	publicStatsCache    []byte
+	publicStatsCachedAt time.Time
+)
+
+// getPublicStats returns the encoded public stats, collecting them at most once per PublicStatsCacheDuration.
+func getPublicStats() ([]byte, error) {
+	publicStatsMu.Lock()
+	defer publicStatsMu.Unlock()
+	if publicStatsCache != nil && time.Since(publicStatsCachedAt) < time.Duration(config.PublicStatsCacheDuration)*time.Second {
+		return publicStatsCache, nil
+	}
+	stats, err := collectStats("year")
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(publicStats(stats, config.PublicStatsFields))
+	if err != nil {
+		return nil, err
+	}
+	publicStatsCache = b
+	publicStatsCachedAt = time.Now()
+	return b, nil
+}
+
+func handlePublicStats(w http.ResponseWriter, r *http.Request) {
+	b, err := getPublicStats()
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.PublicStatsCacheDuration))
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPublicStats(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	created := time.Now().Add(-time.Hour)
+	for i, latency := range []time.Duration{10 * time.Second, 20 * time.Second, time.Minute} {
+		verified := created.Add(latency)
+		p := &Payment{Account: "nano_" + string(rune('a'+i)), CreatedAt: created, FulfilledAt: &verified, FeeSentAt: &verified, FeeAmount: NanoToRaw(decimal.NewFromInt(1))}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.PublicStatsFields = []string{"total_verified", "median_verification_seconds", "verified_within_percent"}
+	t.Cleanup(func() {
+		config.PublicStatsFields = nil
+		publicStatsCache = nil
+	})
+
+	w := httptest.NewRecorder()
+	handlePublicStats(w, httptest.NewRequest("GET", "/api/stats/public", nil))
+	var stats map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"total_verified": 3.0, "median_verification_seconds": 20.0, "verified_within_percent": "66.7"}
+	if len(stats) != len(expected) {
+		t.Fatalf("unexpected fields: %v", stats)
+	}
+	for k, v := range expected {
+		if stats[k] != v {
+			t.Errorf("%s: got %v, expected %v", k, stats[k], v)
+		}
+	}
+
+	// Fields of Stats that are not whitelisted are never published.
+	all := publicStats(&Stats{TotalFees: decimal.NewFromInt(1)}, []string{"totalFees", "fees", "alerts", "verified"})
+	if len(all) != 0 {
+		t.Fatalf("non-whitelisted fields are published: %v", all)
+	}
+	c := config
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fields := range [][]string{{"totalFees"}, {"total_verified", "Total_Verified"}, {"uptime"}} {
+		c := config
+		c.PublicStatsFields = fields
+		if err := c.validate(); err == nil {
+			t.Errorf("unknown field is accepted: %v", fields)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/tundak/accept-nano/nano"
+	"go.etcd.io/bbolt"
+)
+
+// A block is saved to the journal of its account before it is published.
+// When the node does not answer process clearly (a timeout or a dropped connection),
+// the block may still be in the ledger, so it is looked up by hash instead of being marked failed.
+// Next send or receive of the account publishes the journaled block again before creating a new one,
+// so a crash between creating and publishing a block does not move the funds twice.
+// Journal is only changed while the money lock of the account is held.
+
+const publishingBucket = "publishing"
+
+var errPublishUncertain = errors.New("node did not confirm the block, it is checked on the next attempt")
+
+var metricPublishUncertain = expvar.NewInt("publish_uncertain_total")
+
+// journaledBlock is a created block that is not known to be in the ledger yet.
+type journaledBlock struct {
+	Hash  string `json:"hash"`
+	Block string `json:"block"`
+	// Destination account of a send or source hash of a receive.
+	Link      string    `json:"link"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func loadJournaledBlock(account string) (*journaledBlock, error) {
+	return store.JournaledBlock(account)
+}
+
+func saveJournaledBlock(account string, j *journaledBlock) error {
+	return store.SaveJournaledBlock(account, j)
+}
+
+func deleteJournaledBlock(account string) error {
+	return store.DeleteJournaledBlock(account)
+}
+
+func (boltStore) JournaledBlock(account string) (*journaledBlock, error) {
+	var j *journaledBlock
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(publishingBucket))
+		if b == nil {
+			return nil
+		}
+		value := b.Get([]byte(account))
+		if value == nil {
+			return nil
+		}
+		j = new(journaledBlock)
+		return json.Unmarshal(value, j)
+	})
+	return j, err
+}
+
+func (boltStore) SaveJournaledBlock(account string, j *journaledBlock) error {
+	value, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(publishingBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(account), value)
+	})
+}
+
+func (boltStore) DeleteJournaledBlock(account string) error {
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(publishingBucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(account))
+	})
+}
+
+// blockExists returns true if the block is in the ledger of the node.
+func blockExists(hash string) (bool, error) {
+	blocks, err := checkerNode().BlocksInfo([]string{hash})
+	if err != nil {
+		return false, err
+	}
+	_, ok := blocks[hash]
+	return ok, nil
+}
+
+// createAndPublish creates a block, saves it to the journal of account and publishes it.
+func createAndPublish(lease Lease, previous, account, balance, link, privateKey, work string) (string, error) {
+	hash, block, err := checkerNode().BlockCreate(previous, account, config.Representative, balance, link, privateKey, work)
+	if err != nil {
+		return "", err
+	}
+	j := &journaledBlock{Hash: hash, Block: block, Link: link, CreatedAt: clock.Now()}
+	if err = saveJournaledBlock(account, j); err != nil {
+		return "", err
+	}
+	return publishBlock(lease, account, j)
+}
+
+// publishBlock publishes the journaled block of account and removes it from the journal when the outcome is known.
+// Returns a *nano.NodeError only if the node rejects the block and it is not in the ledger.
+// Returns errPublishUncertain if the block may or may not be in the ledger.
+func publishBlock(lease Lease, account string, j *journaledBlock) (string, error) {
+	_, err := publish(lease, j.Block)
+	if err == errLeaseLost {
+		return "", err
+	}
+	if err == nil {
+		return j.Hash, deleteJournaledBlock(account)
+	}
+	// Node may answer "Old block" or time out for a block it has accepted.
+	exists, err2 := blockExists(j.Hash)
+	if err2 == nil && exists {
+		log.Noticef("block %s of %s is in the ledger, ignoring process error: %s", j.Hash, account, err)
+		return j.Hash, deleteJournaledBlock(account)
+	}
+	if _, ok := err.(*nano.NodeError); ok && err2 == nil {
+		log.Warningf("block %s of %s is rejected: %s", j.Hash, account, err)
+		anomalies.record(anomalyPublishRejections, "")
+		if err2 = deleteJournaledBlock(account); err2 != nil {
+			return "", err2
+		}
+		return "", err
+	}
+	metricPublishUncertain.Add(1)
+	if err2 != nil {
+		log.Warningf("cannot check block %s of %s: %s", j.Hash, account, err2)
+	}
+	return "", fmt.Errorf("%w: %s", errPublishUncertain, err)
+}
+
+// resumePublish resolves the journaled block of account left from a previous attempt.
+// Returns the hash of the block if it has the same link, so the caller does not create another one.
+func resumePublish(lease Lease, account, link string) (string, error) {
+	j, err := loadJournaledBlock(account)
+	if err != nil || j == nil {
+		return "", err
+	}
+	log.Noticef("publishing journaled block %s of %s again", j.Hash, account)
+	hash, err := publishBlock(lease, account, j)
+	if _, ok := err.(*nano.NodeError); ok {
+		// A new block is created from the current state of the account.
+		return "", nil
+	}
+	if err != nil || j.Link != link {
+		return "", err
+	}
+	return hash, nil
+}
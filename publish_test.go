@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestPublishAmbiguousResults(t *testing.T) {
+	openTestDB(t, 0)
+	l := fakeLedgerNode(t)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	t.Cleanup(func() { config.Account = "" })
+	amount := NanoToRaw(decimal.NewFromInt(2))
+	newPayment := func(account string) *Payment {
+		p := &Payment{Account: account, PublicKey: randomHash(), Amount: amount, CreatedAt: clock.Now()}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		l.send("nano_1customer", account, amount)
+		return p
+	}
+	fault := func(action string, faults ...string) {
+		l.mu.Lock()
+		l.faults[action] = faults
+		l.mu.Unlock()
+	}
+	journaled := func(account string) *journaledBlock {
+		j, err := loadJournaledBlock(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	// Receive times out after the node accepts it.
+	p := newPayment("nano_1timeout")
+	fault("process", faultAcceptDrop)
+	if err := p.runStep(stepReceive); err != nil {
+		t.Fatalf("accepted receive is failed: %v", err)
+	}
+	if !l.received(p.Account).Equal(amount) || len(l.pending[p.Account]) != 0 || journaled(p.Account) != nil {
+		t.Fatalf("receive is not completed: %v", l.pending[p.Account])
+	}
+
+	// Sweep is rejected, nothing is sent and a new block is created on retry.
+	fault("process", faultReject)
+	var nodeErr *nano.NodeError
+	if err := p.runStep(stepSweep); !errors.As(err, &nodeErr) {
+		t.Fatalf("expected node error, got %v", err)
+	}
+	if !l.received(config.Account).IsZero() || journaled(p.Account) != nil || p.SentAt != nil {
+		t.Fatal("rejected sweep is recorded")
+	}
+
+	// Sweep is accepted but neither process nor the block lookup answers.
+	fault("process", faultAcceptDrop)
+	fault("blocks_info", faultDrop)
+	if err := p.runStep(stepSweep); !errors.Is(err, errPublishUncertain) {
+		t.Fatalf("expected uncertain publish, got %v", err)
+	}
+	j := journaled(p.Account)
+	if j == nil || p.SentAt != nil {
+		t.Fatal("uncertain sweep is not journaled")
+	}
+	// Retry finds the block instead of sending again.
+	if err := p.runStep(stepSweep); err != nil {
+		t.Fatal(err)
+	}
+	if p.SendHash != j.Hash || p.SentAt == nil || !l.received(config.Account).Equal(amount) || journaled(p.Account) != nil {
+		t.Fatalf("sweep is not resolved: %s %s", p.SendHash, l.received(config.Account))
+	}
+
+	// Crash after the block is created and journaled but before it is published.
+	p = newPayment("nano_1crash")
+	if err := p.runStep(stepReceive); err != nil {
+		t.Fatal(err)
+	}
+	info, err := checkerNode().AccountInfo(p.Account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, block, err := checkerNode().BlockCreate(info.Frontier, p.Account, config.Representative, "0", config.Account, "PRIV", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = saveJournaledBlock(p.Account, &journaledBlock{Hash: hash, Block: block, Link: config.Account}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.runStep(stepSweep); err != nil {
+		t.Fatal(err)
+	}
+	if p.SendHash != hash || !l.received(config.Account).Equal(amount.Mul(decimal.NewFromInt(2))) || journaled(p.Account) != nil {
+		t.Fatalf("journaled block is not published: %s %s", p.SendHash, l.received(config.Account))
+	}
+}
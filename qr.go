@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // for decoding QRLogoFile
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QR codes of payments are served at /api/qr?token=TOKEN with optional parameters:
+// qr_size (or size) in pixels, qr_level for error correction (L, M, Q or H) and qr_format (png or svg).
+// Content of a QR code does not change for a payment so generated images are cached.
+
+const (
+	qrDefaultSize = 256
+	qrMinSize     = 64
+	// Generated QR codes kept in memory.
+	qrCacheSize = 1000
+	// Width of the logo relative to the QR code.
+	qrLogoRatio = 0.2
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// qrLogo is drawn at the center of QR codes with error correction level Q or H. Nil if QRLogoFile is not set.
+var qrLogo *qrLogoImage
+
+type qrLogoImage struct {
+	image image.Image
+	// PNG encoded image for embedding in SVG.
+	png []byte
+}
+
+func loadQRLogo(path string) (*qrLogoImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode QR logo: %w", err)
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &qrLogoImage{image: img, png: buf.Bytes()}, nil
+}
+
+// qrParams are the options for rendering a QR code.
+type qrParams struct {
+	Size   int
+	Level  string
+	Format string
+}
+
+// parseQRParams reads QR parameters from request. Size is clamped between qrMinSize and QRMaxSize.
+// Sizes that are not positive numbers are rejected.
+func parseQRParams(r *http.Request) (qrParams, error) {
+	params := qrParams{Size: qrDefaultSize, Level: "M", Format: "png"}
+	s := r.FormValue("qr_size")
+	if s == "" {
+		s = r.FormValue("size")
+	}
+	if s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size <= 0 {
+			return params, errors.New("invalid qr_size")
+		}
+		if size > config.QRMaxSize {
+			return params, fmt.Errorf("qr_size cannot be larger than %d", config.QRMaxSize)
+		}
+		params.Size = size
+	}
+	if params.Size < qrMinSize {
+		params.Size = qrMinSize
+	}
+	if s := r.FormValue("qr_level"); s != "" {
+		params.Level = strings.ToUpper(s)
+		if _, ok := qrLevels[params.Level]; !ok {
+			return params, errors.New("qr_level must be L, M, Q or H")
+		}
+	}
+	if s := r.FormValue("qr_format"); s != "" {
+		params.Format = strings.ToLower(s)
+		if params.Format != "png" && params.Format != "svg" {
+			return params, errors.New("qr_format must be png or svg")
+		}
+	}
+	return params, nil
+}
+
+// withLogo returns true if the logo is drawn for params.
+// Lower levels cannot recover the modules covered by the logo.
+func (params qrParams) withLogo() bool {
+	return qrLogo != nil && (params.Level == "Q" || params.Level == "H")
+}
+
+func (params qrParams) contentType() string {
+	if params.Format == "svg" {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// paymentURI is the content of the QR code of a payment.
+func paymentURI(p *Payment) string {
+	return "nano:" + p.Account + "?amount=" + p.Amount.String()
+}
+
+type qrCache struct {
+	mu     sync.Mutex
+	images map[string]qrImage
+}
+
+type qrImage struct {
+	b        []byte
+	storedAt time.Time
+}
+
+var qrImages = &qrCache{images: make(map[string]qrImage)}
+
+func (c *qrCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img, ok := c.images[key]
+	if !ok {
+		qrCacheStats.miss()
+		return nil, false
+	}
+	qrCacheStats.hit(clock.Now().Sub(img.storedAt))
+	return img.b, true
+}
+
+func (c *qrCache) put(key string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.images) >= qrCacheSize {
+		for k := range c.images {
+			delete(c.images, k)
+			qrCacheStats.invalidate()
+			break
+		}
+	}
+	c.images[key] = qrImage{b: b, storedAt: clock.Now()}
+}
+
+// generateQR returns the QR code image of content from cache or renders a new one.
+func generateQR(content string, params qrParams) ([]byte, error) {
+	key := fmt.Sprintf("%s|%d|%s|%s|%t", content, params.Size, params.Level, params.Format, params.withLogo())
+	if b, ok := qrImages.get(key); ok {
+		return b, nil
+	}
+	q, err := qrcode.New(content, qrLevels[params.Level])
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if params.Format == "svg" {
+		b = renderQRSVG(q, params)
+	} else {
+		b, err = renderQRPNG(q, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	qrImages.put(key, b)
+	return b, nil
+}
+
+func renderQRPNG(q *qrcode.QRCode, params qrParams) ([]byte, error) {
+	if !params.withLogo() {
+		return q.PNG(params.Size)
+	}
+	code := q.Image(params.Size)
+	img := image.NewRGBA(code.Bounds())
+	draw.Draw(img, img.Bounds(), code, image.Point{}, draw.Src)
+	size := img.Bounds().Dx()
+	logoSize := int(float64(size) * qrLogoRatio)
+	offset := (size - logoSize) / 2
+	logo := scaleImage(qrLogo.image, logoSize, logoSize)
+	draw.Draw(img, logo.Bounds().Add(image.Pt(offset, offset)), logo, image.Point{}, draw.Over)
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// scaleImage resizes src to width x height with nearest neighbor sampling.
+func scaleImage(src image.Image, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	b := src.Bounds()
+	for y := 0; y < height; y++ {
+		sy := b.Min.Y + y*b.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := b.Min.X + x*b.Dx()/width
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+	return dst
+}
+
+// renderQRSVG draws each horizontal run of dark modules as a rectangle in a single path.
+// Coordinates are in modules, including the quiet zone.
+func renderQRSVG(q *qrcode.QRCode, params qrParams) []byte {
+	bitmap := q.Bitmap()
+	n := len(bitmap)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, params.Size, params.Size, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < n && row[x] {
+				x++
+			}
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	buf.WriteString(`"/>`)
+	if params.withLogo() {
+		logoSize := float64(n) * qrLogoRatio
+		offset := (float64(n) - logoSize) / 2
+		fmt.Fprintf(&buf, `<image x="%g" y="%g" width="%g" height="%g" xlink:href="data:image/png;base64,%s"/>`,
+			offset, offset, logoSize, logoSize, base64.StdEncoding.EncodeToString(qrLogo.png))
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
+
+func handleQR(w http.ResponseWriter, r *http.Request) {
+	claims, err := ParseToken(r.FormValue("token"))
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	params, err := parseQRParams(r)
+	if err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, err.Error())
+		return
+	}
+	payment, err := LoadPayment([]byte(claims.Account))
+	if err == errPaymentNotFound {
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	b, err := generateQR(paymentURI(payment), params)
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", params.contentType())
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
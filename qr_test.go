@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+const testQRContent = "nano:nano_1payment?amount=30000000000000000000000000000"
+
+func TestQRPNGSize(t *testing.T) {
+	config.setDefaults()
+	cases := map[string]int{"": qrDefaultSize, "300": 300, "10": qrMinSize, "1024": 1024}
+	for size, expected := range cases {
+		params, err := parseQRParams(httptest.NewRequest("GET", "/api/qr?qr_level=h&qr_size="+size, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := generateQR(testQRContent, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := img.Bounds().Size(); d.X != expected || d.Y != expected {
+			t.Errorf("qr_size=%q: got %s, expected %d", size, d, expected)
+		}
+	}
+	if params, err := parseQRParams(httptest.NewRequest("GET", "/api/qr?size=300", nil)); err != nil || params.Size != 300 {
+		t.Errorf("size is not used: %+v %v", params, err)
+	}
+	for _, query := range []string{"qr_size=big", "qr_size=0", "size=-5", "qr_size=100000", "size=100000", "qr_level=X", "qr_format=gif"} {
+		if _, err := parseQRParams(httptest.NewRequest("GET", "/api/qr?"+query, nil)); err == nil {
+			t.Errorf("%s accepted", query)
+		}
+	}
+}
+
+func TestQRSVG(t *testing.T) {
+	b, err := generateQR(testQRContent, qrParams{Size: 200, Level: "Q", Format: "svg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	if !strings.HasPrefix(s, `<svg xmlns="http://www.w3.org/2000/svg"`) || !strings.Contains(s, `width="200" height="200"`) || !strings.HasSuffix(s, "</svg>\n") {
+		t.Fatalf("unexpected svg: %s", s)
+	}
+	golden := filepath.Join("testdata", "qr.svg.golden")
+	if *update {
+		if err = ioutil.WriteFile(golden, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("%s does not match:\n%s", golden, b)
+	}
+}
+
+func TestQRLogo(t *testing.T) {
+	logo := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	red := color.RGBA{R: 255, A: 255}
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			logo.Set(x, y, red)
+		}
+	}
+	qrLogo = &qrLogoImage{image: logo, png: []byte("logo")}
+	defer func() { qrLogo = nil }()
+
+	center := func(level string) color.Color {
+		b, err := generateQR(testQRContent, qrParams{Size: 100, Level: level, Format: "png"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img.At(50, 50)
+	}
+	if r, g, _, _ := center("Q").RGBA(); r != 0xffff || g != 0 {
+		t.Error("logo is not drawn")
+	}
+	if r, g, _, _ := center("M").RGBA(); r == 0xffff && g == 0 {
+		t.Error("logo is drawn with low error correction")
+	}
+	b, err := generateQR(testQRContent, qrParams{Size: 100, Level: "H", Format: "svg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "<image ") {
+		t.Error("logo is not embedded in svg")
+	}
+}
+
+func TestQRHandler(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	p := &Payment{Account: "nano_1payment", Amount: decimal.RequireFromString("30000000000000000000000000000")}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if uri := NewResponse(p, "").URI; uri != testQRContent {
+		t.Fatalf("unexpected uri: %s", uri)
+	}
+	qr := func(account, query string) *httptest.ResponseRecorder {
+		token, err := NewToken("1", account, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handleQR(w, httptest.NewRequest(http.MethodGet, "/api/qr?token="+token+query, nil))
+		return w
+	}
+	w := qr(p.Account, "&size=128")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+	}
+	if img, err := png.Decode(w.Body); err != nil || img.Bounds().Dx() != 128 {
+		t.Fatalf("unexpected image: %v", err)
+	}
+	expectErrorCode(t, qr("nano_1unknown", ""), http.StatusNotFound, errCodePaymentNotFound)
+	expectErrorCode(t, qr(p.Account, "&size=0"), http.StatusBadRequest, errCodeInvalidRequest)
+	expectErrorCode(t, qr(p.Account, "&size=100000"), http.StatusBadRequest, errCodeInvalidRequest)
+}
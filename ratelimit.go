@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+// Behind a reverse proxy every request comes from the proxy address. When the peer is in TrustedProxies,
+// the client address is taken from the forwarding headers set by the proxy and replaces the remote address
+// of the request, so rate limits and request logs see the client. Headers from other peers are ignored,
+// because anyone can send them.
+
+type proxyAddrKey struct{}
+
+// newRateLimiter returns a limiter with its own counters for a rate like "60-H".
+func newRateLimiter(formatted string) (*limiter.Limiter, error) {
+	rate, err := limiter.NewRateFromFormatted(formatted)
+	if err != nil {
+		return nil, err
+	}
+	return limiter.New(memory.NewStore(), rate), nil
+}
+
+// parseTrustedProxies parses CIDRs or single IP addresses.
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent r. If the peer is a trusted proxy, it is the rightmost
+// address in X-Forwarded-For that is not a trusted proxy, or X-Real-IP if there is no X-Forwarded-For.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := remoteIP(r)
+	ip := net.ParseIP(peer)
+	if ip == nil || !ipInNets(ip, trusted) {
+		return peer
+	}
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	if len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				// Hops left of an invalid one cannot be trusted.
+				return ip.String()
+			}
+			ip = hop
+			if !ipInNets(hop, trusted) {
+				break
+			}
+		}
+		// If all hops are trusted proxies, the leftmost one is the client.
+		return ip.String()
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+	return peer
+}
+
+// clientIPMiddleware sets the remote address of requests from trusted proxies to the client address.
+// The address of the proxy is kept in the request context for logging.
+func clientIPMiddleware(trusted []*net.IPNet, h http.Handler) http.Handler {
+	if len(trusted) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r, trusted); ip != remoteIP(r) {
+			r2 := r.WithContext(context.WithValue(r.Context(), proxyAddrKey{}, r.RemoteAddr))
+			r2.RemoteAddr = net.JoinHostPort(ip, "0")
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// proxyAddr returns the address of the proxy that forwarded r, or empty string if it is not forwarded.
+func proxyAddr(r *http.Request) string {
+	addr, _ := r.Context().Value(proxyAddrKey{}).(string)
+	return addr
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, peer, forwardedFor, realIP, expected string
+	}{
+		{"untrusted peer", "1.1.1.1:1234", "2.2.2.2", "3.3.3.3", "1.1.1.1"},
+		{"forwarded", "10.0.0.1:1234", "2.2.2.2", "", "2.2.2.2"},
+		{"spoofed hop", "10.0.0.1:1234", "6.6.6.6, 2.2.2.2, 10.0.0.2", "", "2.2.2.2"},
+		{"single address proxy", "192.168.1.1:1234", "2.2.2.2", "", "2.2.2.2"},
+		{"all trusted", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"invalid hop", "10.0.0.1:1234", "2.2.2.2, bogus", "", "10.0.0.1"},
+		{"real ip", "10.0.0.1:1234", "", "2.2.2.2", "2.2.2.2"},
+		{"no header", "10.0.0.1:1234", "", "", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/api/price", nil)
+		r.RemoteAddr = c.peer
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		if ip := clientIP(r, trusted); ip != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, ip)
+		}
+	}
+	if _, err = parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR is accepted")
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.1"})
+	l, err := newRateLimiter("1-H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var proxies []string
+	h := clientIPMiddleware(trusted, newRateLimitMiddleware(l).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxies = append(proxies, proxyAddr(r))
+	})))
+	request := func(peer, client string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/pay", nil)
+		r.RemoteAddr = peer
+		r.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if request("10.0.0.1:1000", "2.2.2.2") != http.StatusOK || request("10.0.0.1:1000", "3.3.3.3") != http.StatusOK {
+		t.Fatal("clients behind the proxy share a limit")
+	}
+	if request("10.0.0.1:1000", "2.2.2.2") != http.StatusTooManyRequests {
+		t.Fatal("client is not limited")
+	}
+	// The header of an untrusted peer is ignored.
+	if request("4.4.4.4:1000", "5.5.5.5") != http.StatusOK || request("4.4.4.4:1000", "6.6.6.6") != http.StatusTooManyRequests {
+		t.Fatal("forwarded address of an untrusted peer is used")
+	}
+	if proxies[0] != "10.0.0.1:1000" || proxies[2] != "" {
+		t.Fatalf("unexpected proxy addresses: %v", proxies)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/shopspring/decimal"
+)
+
+// Receipt is the proof-of-payment document rendered for a verified payment.
+type Receipt struct {
+	MerchantName     string
+	State            string
+	Account          string
+	Amount           decimal.Decimal
+	AmountInCurrency CurrencyAmount
+	Currency         string
+	Price            decimal.Decimal
+	Blocks           []ReceiptBlock
+	CreatedAt        time.Time
+	FulfilledAt      time.Time
+}
+
+type ReceiptBlock struct {
+	Hash   string
+	Amount decimal.Decimal
+	Source string
+	URL    string
+}
+
+func NewReceipt(p *Payment) *Receipt {
+	blocks := make([]ReceiptBlock, 0, len(p.SubPayments))
+	for hash, sp := range p.SubPayments {
+		blocks = append(blocks, ReceiptBlock{
+			Hash:   hash,
+			Amount: RawToNano(sp.Amount),
+			Source: sp.Account,
+			URL:    explorerURL(config.BlockExplorerURL, hash),
+		})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Hash < blocks[j].Hash })
+	r := &Receipt{
+		MerchantName:     config.MerchantName,
+		State:            p.State,
+		Account:          p.Account,
+		Amount:           RawToNano(p.Amount),
+		AmountInCurrency: p.AmountInCurrency,
+		Currency:         p.Currency,
+		Price:            p.price(),
+		Blocks:           blocks,
+		CreatedAt:        p.CreatedAt,
+	}
+	if p.FulfilledAt != nil {
+		r.FulfilledAt = *p.FulfilledAt
+	}
+	return r
+}
+
+// explorerURL returns the link for block hash by replacing "{hash}" in tmpl.
+// Returns empty string if tmpl is empty.
+func explorerURL(tmpl, hash string) string {
+	if tmpl == "" {
+		return ""
+	}
+	return strings.ReplaceAll(tmpl, "{hash}", url.PathEscape(hash))
+}
+
+var receiptTemplate = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Payment receipt</title>
+</head>
+<body>
+<h1>{{if .MerchantName}}{{.MerchantName}} - {{end}}Payment receipt</h1>
+<table>
+{{if .State}}<tr><th>Reference</th><td>{{.State}}</td></tr>{{end}}
+<tr><th>Amount</th><td>{{.Amount}} NANO</td></tr>
+<tr><th>Amount in {{.Currency}}</th><td>{{.AmountInCurrency}} {{.Currency}}</td></tr>
+{{if not .Price.IsZero}}<tr><th>Rate</th><td>1 NANO = {{.Price}} {{.Currency}}</td></tr>{{end}}
+<tr><th>Destination account</th><td>{{.Account}}</td></tr>
+<tr><th>Created at</th><td>{{.CreatedAt.Format "2006-01-02T15:04:05Z07:00"}}</td></tr>
+<tr><th>Verified at</th><td>{{.FulfilledAt.Format "2006-01-02T15:04:05Z07:00"}}</td></tr>
+</table>
+<h2>Received blocks</h2>
+<table>
+<tr><th>Hash</th><th>Amount</th><th>Source</th></tr>
+{{range .Blocks}}<tr><td>{{if .URL}}<a href="{{.URL}}">{{.Hash}}</a>{{else}}{{.Hash}}{{end}}</td><td>{{.Amount}} NANO</td><td>{{.Source}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (r *Receipt) WriteHTML(w io.Writer) error {
+	return receiptTemplate.Execute(w, r)
+}
+
+func (r *Receipt) WritePDF(w io.Writer) error {
+	const (
+		fontSize   = 10
+		lineHeight = 6
+		labelWidth = 45
+	)
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("Payment receipt", true)
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", fontSize+4)
+	title := "Payment receipt"
+	if r.MerchantName != "" {
+		title = r.MerchantName + " - " + title
+	}
+	pdf.CellFormat(0, lineHeight*2, title, "", 1, "", false, 0, "")
+	row := func(label, value string) {
+		pdf.SetFont("Helvetica", "B", fontSize)
+		pdf.CellFormat(labelWidth, lineHeight, label, "", 0, "", false, 0, "")
+		pdf.SetFont("Helvetica", "", fontSize)
+		pdf.MultiCell(0, lineHeight, value, "", "", false)
+	}
+	if r.State != "" {
+		row("Reference", r.State)
+	}
+	row("Amount", r.Amount.String()+" NANO")
+	row("Amount in "+r.Currency, r.AmountInCurrency.String()+" "+r.Currency)
+	if !r.Price.IsZero() {
+		row("Rate", "1 NANO = "+r.Price.String()+" "+r.Currency)
+	}
+	row("Destination account", r.Account)
+	row("Created at", r.CreatedAt.Format(time.RFC3339))
+	row("Verified at", r.FulfilledAt.Format(time.RFC3339))
+	pdf.Ln(lineHeight)
+	pdf.SetFont("Helvetica", "B", fontSize+2)
+	pdf.CellFormat(0, lineHeight*2, "Received blocks", "", 1, "", false, 0, "")
+	for _, b := range r.Blocks {
+		pdf.SetFont("Helvetica", "", fontSize)
+		if b.URL != "" {
+			pdf.SetTextColor(0, 0, 255) // nolint: gomnd
+			pdf.WriteLinkString(lineHeight, b.Hash, b.URL)
+			pdf.SetTextColor(0, 0, 0)
+			pdf.Ln(lineHeight)
+		} else {
+			pdf.MultiCell(0, lineHeight, b.Hash, "", "", false)
+		}
+		pdf.MultiCell(0, lineHeight, b.Amount.String()+" NANO from "+b.Source, "", "", false)
+	}
+	return pdf.Output(w)
+}
+
+func handleReceipt(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	claims, err := ParseToken(token)
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	payment, err := LoadPayment([]byte(claims.Account))
+	if err == errPaymentNotFound {
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	if payment.FulfilledAt == nil {
+		writeError(w, errCodePaymentNotVerified, http.StatusConflict, "payment is not verified")
+		return
+	}
+	receipt := NewReceipt(payment)
+	var buf bytes.Buffer
+	var contentType string
+	switch r.FormValue("format") {
+	case "", "html":
+		contentType = "text/html; charset=utf-8"
+		err = receipt.WriteHTML(&buf)
+	case "pdf":
+		contentType = "application/pdf"
+		err = receipt.WritePDF(&buf)
+	case "json":
+		writeFinancialSummary(w, payment)
+		return
+	default:
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, "invalid format")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// writeFinancialSummary writes the summary of a final payment as the JSON receipt.
+func writeFinancialSummary(w http.ResponseWriter, p *Payment) {
+	if p.outcome() == "" {
+		writeError(w, errCodePaymentNotFinal, http.StatusConflict, "payment is not final")
+		return
+	}
+	summary, err := p.financialSummary()
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main // nolint: testpackage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func testReceipt() *Receipt {
+	return &Receipt{
+		MerchantName:     "Test <Shop>",
+		State:            "order-1",
+		Account:          "nano_1test",
+		Amount:           decimal.RequireFromString("1.5"),
+		AmountInCurrency: NewCurrencyAmount(decimal.RequireFromString("3"), "USD"),
+		Currency:         "USD",
+		Price:            decimal.RequireFromString("2"),
+		Blocks: []ReceiptBlock{
+			{Hash: "ABC123", Amount: decimal.RequireFromString("1.5"), Source: "nano_1source", URL: "https://explorer.test/block/ABC123"},
+		},
+		CreatedAt:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		FulfilledAt: time.Date(2020, 1, 1, 0, 5, 0, 0, time.UTC),
+	}
+}
+
+func TestExplorerURL(t *testing.T) {
+	cases := []struct {
+		tmpl, hash, expected string
+	}{
+		{"", "ABC", ""},
+		{"https://explorer.test/block/{hash}", "ABC", "https://explorer.test/block/ABC"},
+		{"https://explorer.test/?b={hash}&h={hash}", "ABC", "https://explorer.test/?b=ABC&h=ABC"},
+		{"https://explorer.test/block/{hash}", "A/B", "https://explorer.test/block/A%2FB"},
+	}
+	for _, c := range cases {
+		if s := explorerURL(c.tmpl, c.hash); s != c.expected {
+			t.Errorf("explorerURL(%q, %q) = %q, expected %q", c.tmpl, c.hash, s, c.expected)
+		}
+	}
+}
+
+func TestReceiptHTML(t *testing.T) {
+	var buf bytes.Buffer
+	err := testReceipt().WriteHTML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	for _, expected := range []string{
+		"Test &lt;Shop&gt;",
+		"order-1",
+		"1.5 NANO",
+		"1 NANO = 2 USD",
+		"nano_1test",
+		`<a href="https://explorer.test/block/ABC123">ABC123</a>`,
+		"2020-01-01T00:05:00Z",
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("receipt does not contain %q", expected)
+		}
+	}
+}
+
+func TestReceiptPDF(t *testing.T) {
+	var buf bytes.Buffer
+	err := testReceipt().WritePDF(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")) {
+		t.Fatal("output is not a PDF document")
+	}
+}
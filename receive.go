@@ -6,16 +6,20 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-func receiveBlock(hash, amount, account, privateKey, publicKey string) error {
-	sentAmount, err := decimal.NewFromString(amount)
+// receiveBlock receives the pending block hash to account. openWork is used for the open block if it is valid.
+func receiveBlock(lease Lease, hash, amount, account, privateKey, publicKey, openWork string) (string, error) {
+	sentAmount, err := parseRaw(amount)
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Debugln("amount:", sentAmount)
+	if newHash, err2 := resumePublish(lease, account, hash); newHash != "" || err2 != nil {
+		return newHash, err2
+	}
 	var newReceiverBlockPreviousHash string
 	var newReceiverBalance decimal.Decimal
 	var workHash string
-	receiverAccountInfo, err := node.AccountInfo(account)
+	receiverAccountInfo, err := checkerNode().AccountInfo(account)
 	switch err {
 	case nano.ErrAccountNotFound:
 		// First block in account chain. This is the common case.
@@ -26,28 +30,31 @@ func receiveBlock(hash, amount, account, privateKey, publicKey string) error {
 		// More than one payment is made to the account.
 		log.Debugf("account info: %#v", receiverAccountInfo)
 		newReceiverBlockPreviousHash = receiverAccountInfo.Frontier
-		currentReceiverBalance, err2 := decimal.NewFromString(receiverAccountInfo.Balance)
+		currentReceiverBalance, err2 := parseRaw(receiverAccountInfo.Balance)
+		if err2 != nil {
+			return "", err2
+		}
+		newReceiverBalance, err2 = addRaw(currentReceiverBalance, sentAmount)
 		if err2 != nil {
-			return err2
+			return "", err2
 		}
-		newReceiverBalance = currentReceiverBalance.Add(sentAmount)
 		workHash = newReceiverBlockPreviousHash
 	default:
-		return err
+		return "", err
 	}
-	work, err := nano.GenerateWork(workHash, false)
-	if err != nil {
-		return err
-	}
-	newReceiverBlock, err := node.BlockCreate(newReceiverBlockPreviousHash, account, config.Representative, newReceiverBalance.String(), hash, privateKey, work)
-	if err != nil {
-		return err
+	work := openWork
+	if workHash != publicKey || !validWork(workHash, work, false) {
+		work, err = generateWork(workHash, false)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		metricWork.Add("precomputed", 1)
 	}
-	log.Debugf("new block: %#v", newReceiverBlock)
-	newHash, err := node.Process(newReceiverBlock)
+	newHash, err := createAndPublish(lease, newReceiverBlockPreviousHash, account, newReceiverBalance.String(), hash, privateKey, work)
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Debugln("published new block:", newHash)
-	return nil
+	return newHash, nil
 }
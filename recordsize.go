@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"go.etcd.io/bbolt"
+)
+
+// Budgets for the size of a payment record, so that a payment with thousands of blocks
+// or a large metadata does not slow down every load of the account.
+
+const defaultMaxMetadataSize = 1024
+
+// Length of block hash prefixes kept for elided blocks.
+const elidedHashPrefixSize = 16
+
+// Prefixes of elided blocks are kept in this bucket with "<account>/<prefix>" keys,
+// so the payment record does not grow with the number of blocks.
+// They are written in the same transaction as the payment record.
+const elidedBlocksBucket = "elided_blocks"
+
+var errMetadataTooLarge = errors.New("metadata is too large")
+
+// ElidedBlocks aggregates the blocks that are not kept in SubPayments because of MaxSubPayments.
+type ElidedBlocks struct {
+	Count int `json:"count"`
+	// Sum of block amounts in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Prefixes of block hashes elided by older versions. Newer ones are in elidedBlocksBucket.
+	HashPrefixes []string `json:"hashPrefixes,omitempty"`
+}
+
+func elidedBlockKey(account, hash string) []byte {
+	return []byte(account + "/" + hashPrefix(hash))
+}
+
+// isElided returns true if the block is counted in ElidedBlocks, so that a block seen again as pending is not counted twice.
+func (p *Payment) isElided(hash string) (bool, error) {
+	if p.ElidedBlocks == nil {
+		return false, nil
+	}
+	if p.newElided[hashPrefix(hash)] || stringInSlice(hashPrefix(hash), p.ElidedBlocks.HashPrefixes) {
+		return true, nil
+	}
+	return store.IsElided(p.Account, hashPrefix(hash))
+}
+
+func (boltStore) IsElided(account, prefix string) (bool, error) {
+	var found bool
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(elidedBlocksBucket))
+		found = b != nil && b.Get(elidedBlockKey(account, prefix)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// saveElided writes the prefixes of blocks elided since the last save.
+func (p *Payment) saveElided(tx *bbolt.Tx) error {
+	if len(p.newElided) == 0 {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(elidedBlocksBucket))
+	if err != nil {
+		return err
+	}
+	for prefix := range p.newElided {
+		err = b.Put(elidedBlockKey(p.Account, prefix), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashPrefix(hash string) string {
+	if len(hash) > elidedHashPrefixSize {
+		return hash[:elidedHashPrefixSize]
+	}
+	return hash
+}
+
+// subPaymentsTotal returns the sum of received blocks including elided ones.
+func (p *Payment) subPaymentsTotal() decimal.Decimal {
+	var sum decimal.Decimal
+	for _, sp := range p.SubPayments {
+		if !sp.Unconfirmed {
+			sum = sum.Add(sp.Amount)
+		}
+	}
+	if p.ElidedBlocks != nil {
+		sum = sum.Add(p.ElidedBlocks.Amount)
+	}
+	return sum
+}
+
+// capSubPayments keeps the first MaxSubPayments blocks by confirmation time and adds the rest to ElidedBlocks.
+func (p *Payment) capSubPayments() {
+	if len(p.SubPayments) <= config.MaxSubPayments {
+		return
+	}
+	hashes := make([]string, 0, len(p.SubPayments))
+	for hash := range p.SubPayments {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		a, b := p.SubPayments[hashes[i]].ConfirmedAt, p.SubPayments[hashes[j]].ConfirmedAt
+		if a != nil && b != nil && !a.Equal(*b) {
+			return a.Before(*b)
+		}
+		return hashes[i] < hashes[j]
+	})
+	if p.ElidedBlocks == nil {
+		p.ElidedBlocks = &ElidedBlocks{}
+	}
+	for _, hash := range hashes[config.MaxSubPayments:] {
+		p.ElidedBlocks.Count++
+		p.ElidedBlocks.Amount = p.ElidedBlocks.Amount.Add(p.SubPayments[hash].Amount)
+		if p.newElided == nil {
+			p.newElided = make(map[string]bool)
+		}
+		p.newElided[hashPrefix(hash)] = true
+		delete(p.SubPayments, hash)
+	}
+}
+
+// maxMetadataSize returns MaxMetadataSize, or the default if config is not set.
+func maxMetadataSize() int {
+	if config.MaxMetadataSize > 0 {
+		return config.MaxMetadataSize
+	}
+	return defaultMaxMetadataSize
+}
+
+// checkMetadataSize returns errMetadataTooLarge if the encoded metadata is over MaxMetadataSize.
+func (p *Payment) checkMetadataSize() error {
+	if p.Metadata == nil {
+		return nil
+	}
+	b, err := json.Marshal(p.Metadata)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxMetadataSize() {
+		return errMetadataTooLarge
+	}
+	return nil
+}
+
+// LargePayment is returned from /admin/debug/large-payments.
+type LargePayment struct {
+	Account      string `json:"account"`
+	PaymentID    string `json:"paymentId"`
+	Size         int    `json:"size"`
+	SubPayments  int    `json:"subPayments"`
+	ElidedBlocks int    `json:"elidedBlocks"`
+	MetadataSize int    `json:"metadataSize"`
+}
+
+// largestPayments returns the limit largest payment records by encoded size.
+func largestPayments(limit int) ([]LargePayment, error) {
+	type record struct {
+		key  string
+		size int
+	}
+	var records []record
+	err := forEachPayment(func(p *Payment) error {
+		v, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		records = append(records, record{p.Account, len(v)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].size > records[j].size })
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	ret := make([]LargePayment, 0, len(records))
+	for _, r := range records {
+		p, err := LoadPayment([]byte(r.key))
+		if err == errPaymentNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		lp := LargePayment{Account: p.Account, PaymentID: p.PaymentID, Size: r.size, SubPayments: len(p.SubPayments)}
+		if p.ElidedBlocks != nil {
+			lp.ElidedBlocks = p.ElidedBlocks.Count
+		}
+		if p.Metadata != nil {
+			b, _ := json.Marshal(p.Metadata)
+			lp.MetadataSize = len(b)
+		}
+		ret = append(ret, lp)
+	}
+	return ret, nil
+}
+
+func handleAdminDebugLargePayments(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	payments, err := largestPayments(limit)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, payments)
+}
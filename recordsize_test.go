@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func oversizedPayment(account string, blocks int) *Payment {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &Payment{Account: account, SubPayments: make(map[string]SubPayment)}
+	for i := 0; i < blocks; i++ {
+		confirmedAt := t0.Add(time.Duration(i) * time.Second)
+		amount := decimal.NewFromInt(int64(i + 1))
+		p.SubPayments[fmt.Sprintf("%064X", i)] = SubPayment{Account: "nano_1dust", Amount: amount, ConfirmedAt: &confirmedAt}
+		p.Balance = p.Balance.Add(amount)
+	}
+	return p
+}
+
+func TestCapSubPayments(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	p := oversizedPayment("nano_1large", 250)
+	p.capSubPayments()
+	if len(p.SubPayments) != config.MaxSubPayments || p.ElidedBlocks.Count != 150 {
+		t.Fatalf("budget is not enforced: %d blocks, %d elided", len(p.SubPayments), p.ElidedBlocks.Count)
+	}
+	if _, ok := p.SubPayments[fmt.Sprintf("%064X", 0)]; !ok {
+		t.Fatal("first block is elided")
+	}
+	if elided, err := p.isElided(fmt.Sprintf("%064X", 249)); !elided || err != nil {
+		t.Fatal("elided block is not remembered")
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash, expected := range map[string]bool{fmt.Sprintf("%064X", 249): true, strings.Repeat("F", 64): false} {
+		if elided, err := loaded.isElided(hash); elided != expected || err != nil {
+			t.Errorf("elided state of %s is %v: %v", hash, elided, err)
+		}
+	}
+	// Record does not grow with the number of elided blocks.
+	b, _ := json.Marshal(loaded)
+	if strings.Contains(string(b), "hashPrefixes") {
+		t.Errorf("hashes of elided blocks are in the record: %d bytes", len(b))
+	}
+	// Prefixes saved by older versions in the record are still known.
+	legacy := &Payment{Account: "nano_1legacy", ElidedBlocks: &ElidedBlocks{Count: 1, HashPrefixes: []string{hashPrefix(fmt.Sprintf("%064X", 1))}}}
+	if elided, _ := legacy.isElided(fmt.Sprintf("%064X", 1)); !elided {
+		t.Error("legacy elided block is not remembered")
+	}
+	if !loaded.subPaymentsTotal().Equal(p.Balance) {
+		t.Fatalf("total %s does not match balance %s", loaded.subPaymentsTotal(), p.Balance)
+	}
+	blocks, err := loaded.satisfiedBy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := blocks[len(blocks)-1]
+	if len(blocks) != config.MaxSubPayments+1 || last.Elided != 150 || last.Hash != "" {
+		t.Fatalf("elision marker is missing: %+v", last)
+	}
+
+	p.Metadata = map[string]interface{}{"x": strings.Repeat("x", maxMetadataSize())}
+	if err = p.Save(); err != errMetadataTooLarge {
+		t.Fatalf("large metadata is saved: %v", err)
+	}
+}
+
+func TestAdminLargePayments(t *testing.T) {
+	openTestDB(t, 0)
+	for i, blocks := range []int{1, 30, 10} {
+		if err := oversizedPayment(fmt.Sprintf("nano_1account%d", i), blocks).Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	handleAdminDebugLargePayments(w, httptest.NewRequest("GET", "/admin/debug/large-payments?limit=2", nil))
+	var payments []LargePayment
+	if err := json.Unmarshal(w.Body.Bytes(), &payments); err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].Account != "nano_1account1" || payments[0].SubPayments != 30 || payments[1].Account != "nano_1account2" {
+		t.Fatalf("unexpected payments: %+v", payments)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// Recovery scan walks deterministic key indexes of the seed and reports accounts holding funds.
+// It is meant for recovering funds when the database is lost but the seed is not.
+// Seeds of merchants are scanned after Seed, each with its own checkpoint.
+//
+// Note that payment indexes are generated randomly (see NewIndex),
+// so only accounts with indexes in the scanned range can be found.
+
+const defaultRecoverBatchSize = 100
+
+var (
+	errRecoverRunning     = errors.New("recover scan is already running")
+	errRecoverMaxIndex    = errors.New("max index cannot be larger than 4294967296")
+	errRecoverPaymentOpen = errors.New("account belongs to an unfinished payment")
+)
+
+// RecoverOptions are the parameters of a recovery scan.
+type RecoverOptions struct {
+	Seed string `json:"-"`
+	// Merchant whose seed is scanned. Empty for Seed.
+	Merchant string `json:"merchant,omitempty"`
+	// Indexes in [0, MaxIndex) are scanned.
+	MaxIndex uint64 `json:"maxIndex"`
+	// Number of accounts queried from node in a single call.
+	BatchSize int `json:"batchSize"`
+	// Progress is saved to this file after each batch. Scan resumes from it if exists.
+	CheckpointPath string `json:"checkpointPath"`
+	// Each found account and money movement is appended to this file.
+	LedgerPath string `json:"ledgerPath"`
+	// If set, pending funds are received and balances are sent to this account.
+	SweepTo string `json:"sweepTo"`
+	// Accounts for which skip returns true are reported but not swept.
+	Skip func(account string) bool `json:"-"`
+}
+
+// RecoveredAccount is an account with balance or pending funds found in scan.
+// Amounts are in raw.
+type RecoveredAccount struct {
+	Merchant  string          `json:"merchant,omitempty"`
+	Index     string          `json:"index"`
+	Account   string          `json:"account"`
+	Balance   decimal.Decimal `json:"balance"`
+	Pending   decimal.Decimal `json:"pending"`
+	SweepHash string          `json:"sweepHash,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// RecoverReport is the result of a scan. It is also saved as checkpoint.
+type RecoverReport struct {
+	NextIndex uint64             `json:"nextIndex"`
+	MaxIndex  uint64             `json:"maxIndex"`
+	Accounts  []RecoveredAccount `json:"accounts"`
+	Done      bool               `json:"done"`
+}
+
+// recoverLedgerEntry is a line in the ledger file.
+type recoverLedgerEntry struct {
+	Time     time.Time       `json:"time"`
+	Event    string          `json:"event"`
+	Merchant string          `json:"merchant,omitempty"`
+	Index    string          `json:"index"`
+	Account  string          `json:"account"`
+	Amount   decimal.Decimal `json:"amount"`
+	Hash     string          `json:"hash,omitempty"`
+}
+
+// recoverLedger is an append-only log of the actions taken during recovery.
+type recoverLedger struct {
+	f *os.File
+}
+
+func openRecoverLedger(path string) (*recoverLedger, error) {
+	if path == "" {
+		return &recoverLedger{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &recoverLedger{f: f}, nil
+}
+
+func (l *recoverLedger) write(e recoverLedgerEntry) error {
+	e.Time = clock.Now()
+	log.Infof("recover: %s %s index=%s amount=%s hash=%s", e.Event, e.Account, e.Index, e.Amount, e.Hash)
+	if l.f == nil {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *recoverLedger) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+func loadRecoverCheckpoint(path string) (*RecoverReport, error) {
+	var report RecoverReport
+	if path == "" {
+		return &report, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &report, json.Unmarshal(b, &report)
+}
+
+func saveRecoverCheckpoint(path string, report *RecoverReport) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// recoverScan scans indexes in batches and optionally sweeps found funds.
+// progress is called with a copy of the report after each batch.
+func recoverScan(ctx context.Context, opts RecoverOptions, progress func(RecoverReport)) (*RecoverReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultRecoverBatchSize
+	}
+	if opts.MaxIndex > math.MaxUint32+1 {
+		return nil, errRecoverMaxIndex
+	}
+	if opts.SweepTo != "" {
+		if err := nano.ValidateAccount(opts.SweepTo); err != nil {
+			return nil, err
+		}
+	}
+	report, err := loadRecoverCheckpoint(opts.CheckpointPath)
+	if err != nil {
+		return nil, err
+	}
+	if report.NextIndex > 0 {
+		log.Noticef("recover: resuming from index %d", report.NextIndex)
+	}
+	report.MaxIndex = opts.MaxIndex
+	report.Done = false
+	ledger, err := openRecoverLedger(opts.LedgerPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ledger.Close()
+
+	for report.NextIndex < report.MaxIndex {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		end := report.NextIndex + uint64(opts.BatchSize)
+		if end > report.MaxIndex {
+			end = report.MaxIndex
+		}
+		found, err := recoverBatch(opts, report.NextIndex, end, ledger)
+		if err != nil {
+			return report, err
+		}
+		report.Accounts = append(report.Accounts, found...)
+		report.NextIndex = end
+		report.Done = report.NextIndex >= report.MaxIndex
+		err = saveRecoverCheckpoint(opts.CheckpointPath, report)
+		if err != nil {
+			return report, err
+		}
+		if progress != nil {
+			progress(*report)
+		}
+	}
+	report.Done = true
+	return report, nil
+}
+
+func recoverBatch(opts RecoverOptions, start, end uint64, ledger *recoverLedger) ([]RecoveredAccount, error) {
+	indexes := make(map[string]string, end-start)
+	keys := make(map[string]*nano.Key, end-start)
+	accounts := make([]string, 0, end-start)
+	for i := start; i < end; i++ {
+		key, err := nano.DeriveKey(opts.Seed, uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		indexes[key.Account] = strconv.FormatUint(i, 10)
+		keys[key.Account] = key
+		accounts = append(accounts, key.Account)
+	}
+	balances, err := backgroundNode().AccountsBalances(accounts)
+	if err != nil {
+		return nil, err
+	}
+	var found []RecoveredAccount
+	for _, account := range accounts {
+		b, ok := balances[account]
+		if !ok {
+			continue
+		}
+		balance, err := parseRaw(b.Balance)
+		if err != nil {
+			return nil, err
+		}
+		pending, err := parseRaw(b.Pending)
+		if err != nil {
+			return nil, err
+		}
+		if balance.IsZero() && pending.IsZero() {
+			continue
+		}
+		ra := RecoveredAccount{Merchant: opts.Merchant, Index: indexes[account], Account: account, Balance: balance, Pending: pending}
+		err = ledger.write(recoverLedgerEntry{Event: "found", Merchant: opts.Merchant, Index: ra.Index, Account: account, Amount: balance.Add(pending)})
+		if err != nil {
+			return nil, err
+		}
+		if opts.SweepTo != "" {
+			err = recoverSweep(opts, &ra, keys[account], ledger)
+			if err != nil {
+				log.Errorf("recover: cannot sweep %s: %s", account, err)
+				ra.Error = err.Error()
+			}
+		}
+		found = append(found, ra)
+	}
+	return found, nil
+}
+
+// recoverSweep receives pending funds of the account, then sends the whole balance to opts.SweepTo.
+// Accounts of unfinished payments are left to the payment checks.
+func recoverSweep(opts RecoverOptions, ra *RecoveredAccount, key *nano.Key, ledger *recoverLedger) error {
+	locks.Lock(ra.Account)
+	defer locks.Unlock(ra.Account)
+	if opts.Skip != nil && opts.Skip(ra.Account) {
+		return errRecoverPaymentOpen
+	}
+	return withMoneyLock(ra.Account, func(lease Lease) error {
+		if !ra.Pending.IsZero() {
+			pendingBlocks, err := backgroundNode().Pending(ra.Account, config.MaxPayments, "1")
+			if err != nil {
+				return err
+			}
+			for hash, pendingBlock := range pendingBlocks {
+				receiveHash, err := receiveBlock(lease, hash, pendingBlock.Amount, ra.Account, key.Private, key.Public, "")
+				if err != nil {
+					return err
+				}
+				amount, _ := decimal.NewFromString(pendingBlock.Amount)
+				err = ledger.write(recoverLedgerEntry{Event: "received", Merchant: opts.Merchant, Index: ra.Index, Account: ra.Account, Amount: amount, Hash: receiveHash})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		info, err := backgroundNode().AccountInfo(ra.Account)
+		if err != nil {
+			return err
+		}
+		balance, err := parseRaw(info.Balance)
+		if err != nil {
+			return err
+		}
+		hash, err := sendAll(lease, ra.Account, opts.SweepTo, key.Private)
+		if err != nil {
+			return err
+		}
+		ra.SweepHash = hash
+		return ledger.write(recoverLedgerEntry{Event: "swept", Merchant: opts.Merchant, Index: ra.Index, Account: ra.Account, Amount: balance, Hash: hash})
+	})
+}
+
+// seedFromSource reads the seed from "config", "env:NAME" or "file:PATH".
+func seedFromSource(source string) (string, error) {
+	switch {
+	case source == "" || source == "config":
+		return config.Seed, nil
+	case strings.HasPrefix(source, "env:"):
+		seed := os.Getenv(strings.TrimPrefix(source, "env:"))
+		if seed == "" {
+			return "", errors.New("seed environment variable is empty")
+		}
+		return seed, nil
+	case strings.HasPrefix(source, "file:"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", fmt.Errorf("invalid seed source: %q", source)
+}
+
+// recoverScans returns the scans of Seed and of the seeds of merchants, in scan order.
+// Merchants without their own seed share the accounts of Seed.
+func recoverScans(opts RecoverOptions) []RecoverOptions {
+	scans := []RecoverOptions{opts}
+	var ids []string
+	for id, m := range config.Merchants {
+		if m.Seed != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		scan := opts
+		scan.Seed = config.Merchants[id].Seed
+		scan.Merchant = id
+		if opts.CheckpointPath != "" {
+			scan.CheckpointPath = opts.CheckpointPath + "." + id
+		}
+		scans = append(scans, scan)
+	}
+	return scans
+}
+
+var (
+	recoverMu     sync.Mutex
+	recoverStatus *RecoverReport
+	// Reports of the scans of merchant seeds by merchant ID.
+	recoverMerchantStatus map[string]*RecoverReport
+	recoverErr            error
+	recoverActive         bool
+)
+
+// startRecoverScan runs a scan in background. Checkpoint and ledger are kept next to the database.
+func startRecoverScan(maxIndex uint64, sweepTo string) error {
+	if sweepTo != "" && !config.sweepEnabled() {
+		return errSweepDisabled
+	}
+	if sweepTo != "" {
+		if err := nano.ValidateAccount(sweepTo); err != nil {
+			return err
+		}
+	}
+	if maxIndex > math.MaxUint32+1 {
+		return errRecoverMaxIndex
+	}
+	recoverMu.Lock()
+	defer recoverMu.Unlock()
+	if recoverActive {
+		return errRecoverRunning
+	}
+	recoverActive = true
+	recoverErr = nil
+	recoverMerchantStatus = make(map[string]*RecoverReport)
+	scans := recoverScans(RecoverOptions{
+		Seed:           config.Seed,
+		MaxIndex:       maxIndex,
+		CheckpointPath: config.DatabasePath + ".recover",
+		LedgerPath:     config.DatabasePath + ".recover.log",
+		SweepTo:        sweepTo,
+		Skip:           unfinishedPaymentAccount,
+	})
+	go func() {
+		var err error
+		for _, opts := range scans {
+			merchant := opts.Merchant
+			setStatus := func(r *RecoverReport) {
+				recoverMu.Lock()
+				defer recoverMu.Unlock()
+				if merchant == "" {
+					recoverStatus = r
+				} else {
+					recoverMerchantStatus[merchant] = r
+				}
+			}
+			var report *RecoverReport
+			report, err = recoverScan(context.Background(), opts, func(r RecoverReport) { setStatus(&r) })
+			if report != nil {
+				setStatus(report)
+			}
+			if err != nil {
+				log.Errorf("recover scan of seed of merchant %q failed: %s", merchant, err)
+				break
+			}
+		}
+		recoverMu.Lock()
+		recoverErr = err
+		recoverActive = false
+		recoverMu.Unlock()
+	}()
+	return nil
+}
+
+// unfinishedPaymentAccount returns true if account belongs to a payment that is still being checked.
+func unfinishedPaymentAccount(account string) bool {
+	p, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		return false
+	}
+	return err != nil || !p.finished()
+}
+
+// handleAdminRecoverScan starts a scan on POST and returns the progress on GET.
+func handleAdminRecoverScan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		maxIndex, err := strconv.ParseUint(r.FormValue("max_index"), 10, 64)
+		if err != nil || maxIndex == 0 {
+			http.Error(w, "invalid max_index", http.StatusBadRequest)
+			return
+		}
+		err = startRecoverScan(maxIndex, r.FormValue("sweep_to"))
+		if err == errRecoverRunning || err == errSweepDisabled {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err == nano.ErrInvalidAccount {
+			http.Error(w, "invalid sweep_to", http.StatusBadRequest)
+			return
+		}
+		if err == errRecoverMaxIndex {
+			http.Error(w, "invalid max_index", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	recoverMu.Lock()
+	status := struct {
+		Running bool `json:"running"`
+		// Set while the scan is waiting for node requests with higher priority.
+		Throttled bool           `json:"throttled"`
+		Error     string         `json:"error,omitempty"`
+		Report    *RecoverReport `json:"report"`
+		// Reports of merchants with their own seed.
+		Merchants map[string]*RecoverReport `json:"merchants,omitempty"`
+	}{Running: recoverActive, Throttled: recoverActive && nodeThrottled(nano.PriorityBackground), Report: recoverStatus, Merchants: recoverMerchantStatus}
+	if recoverErr != nil {
+		status.Error = recoverErr.Error()
+	}
+	recoverMu.Unlock()
+	writeAdminJSON(w, status)
+}
+
+// runRecoverCommand implements "accept-nano recover" subcommand.
+// It does not open the database so it can run while the database file is lost or locked by a running instance.
+// Unfinished payments are not known to it, so sweeping must not be done while an instance is checking payments.
+// Seeds of merchants in config are scanned too if the seed is read from config.
+func runRecoverCommand(args []string) {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	fs.StringVar(configPath, "config", *configPath, "config file path")
+	seedSource := fs.String("seed-source", "config", `where to read the seed from: "config", "env:NAME" or "file:PATH"`)
+	var opts RecoverOptions
+	fs.Uint64Var(&opts.MaxIndex, "max-index", 0, "scan indexes below this number")
+	fs.IntVar(&opts.BatchSize, "batch-size", defaultRecoverBatchSize, "number of accounts queried from node at once")
+	fs.StringVar(&opts.CheckpointPath, "checkpoint", "recover-checkpoint.json", "progress file for resuming the scan")
+	fs.StringVar(&opts.LedgerPath, "ledger", "recover-ledger.jsonl", "append-only log of found accounts and sent funds")
+	fs.StringVar(&opts.SweepTo, "sweep-to", "", "receive pending funds and send all balances to this account")
+	_ = fs.Parse(args)
+
+	err := config.Read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.EnableDebugLog {
+		log.SetLevel(log.DEBUG)
+	}
+	if opts.MaxIndex == 0 {
+		log.Fatal("-max-index is required")
+	}
+	opts.Seed, err = seedFromSource(*seedSource)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node = nano.New(nodeURLs()...)
+	node.SetTimeout(time.Duration(config.NodeTimeout) * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		cancel()
+	}()
+	scans := []RecoverOptions{opts}
+	if source := *seedSource; source == "" || source == "config" {
+		scans = recoverScans(opts)
+	}
+	for _, scan := range scans {
+		merchant := scan.Merchant
+		report, err := recoverScan(ctx, scan, func(r RecoverReport) {
+			log.Infof("recover: scanned %d/%d of seed of merchant %q, found %d accounts", r.NextIndex, r.MaxIndex, merchant, len(r.Accounts))
+		})
+		if report != nil {
+			b, err2 := json.MarshalIndent(report, "", "  ")
+			if err2 != nil {
+				log.Fatal(err2)
+			}
+			fmt.Println(string(b))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
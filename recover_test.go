@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+const testRecoverSeed = "4A1B5E3F0C6D7E8F901A2B3C4D5E6F708192A3B4C5D6E7F8091A2B3C4D5E6F70"
+
+func recoverAccount(t *testing.T, index uint32) string {
+	key, err := nano.DeriveKey(testRecoverSeed, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.Account
+}
+
+// fakeRecoverNode has funds on a few sparse indexes.
+func fakeRecoverNode(t *testing.T, funds map[string][2]string, calls *int32) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action   string   `json:"action"`
+			Accounts []string `json:"accounts"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch req.Action {
+		case "accounts_balances":
+			atomic.AddInt32(calls, 1)
+			balances := make(map[string]nano.AccountBalance)
+			for _, account := range req.Accounts {
+				f, ok := funds[account]
+				if !ok {
+					f = [2]string{"0", "0"}
+				}
+				balances[account] = nano.AccountBalance{Balance: f[0], Pending: f[1]}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"balances": balances})
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "unexpected action"})
+		}
+	}))
+	t.Cleanup(ts.Close)
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+}
+
+func TestRecoverScan(t *testing.T) {
+	funds := map[string][2]string{
+		recoverAccount(t, 3):    {"1000", "0"},
+		recoverAccount(t, 777):  {"0", "5"},
+		recoverAccount(t, 4999): {"2", "3"},
+	}
+	var calls int32
+	fakeRecoverNode(t, funds, &calls)
+	dir := t.TempDir()
+	opts := RecoverOptions{
+		Seed:           testRecoverSeed,
+		MaxIndex:       5000,
+		BatchSize:      500,
+		CheckpointPath: filepath.Join(dir, "checkpoint.json"),
+		LedgerPath:     filepath.Join(dir, "ledger.jsonl"),
+	}
+
+	// Interrupt after the second batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	var batches int
+	_, err := recoverScan(ctx, opts, func(r RecoverReport) {
+		batches++
+		if batches == 2 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancel, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 batch calls, got %d", calls)
+	}
+
+	// Resume from checkpoint.
+	report, err := recoverScan(context.Background(), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 10 {
+		t.Errorf("scan is not resumed from checkpoint, %d batch calls", calls)
+	}
+	if !report.Done || report.NextIndex != 5000 {
+		t.Errorf("scan not finished: %+v", report)
+	}
+	var accounts []string
+	for _, a := range report.Accounts {
+		accounts = append(accounts, a.Account+"@"+a.Index)
+	}
+	expected := recoverAccount(t, 3) + "@3," + recoverAccount(t, 777) + "@777," + recoverAccount(t, 4999) + "@4999"
+	if got := strings.Join(accounts, ","); got != expected {
+		t.Errorf("unexpected accounts: %s", got)
+	}
+	ledger, err := ioutil.ReadFile(opts.LedgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(ledger), `"event":"found"`); n != 3 {
+		t.Errorf("expected 3 ledger entries, got %d", n)
+	}
+}
+
+func TestSeedFromSource(t *testing.T) {
+	config.Seed = "CONFIGSEED"
+	t.Setenv("TEST_SEED", "ENVSEED")
+	path := filepath.Join(t.TempDir(), "seed")
+	if err := ioutil.WriteFile(path, []byte("FILESEED\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]string{"config": "CONFIGSEED", "env:TEST_SEED": "ENVSEED", "file:" + path: "FILESEED"} {
+		seed, err := seedFromSource(source)
+		if err != nil || seed != expected {
+			t.Errorf("%s: got %q, %v", source, seed, err)
+		}
+	}
+	if _, err := seedFromSource("env:TEST_SEED_MISSING"); err == nil {
+		t.Error("expected error for empty env")
+	}
+}
+
+func TestRecoverSweep(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	config.setDefaults()
+	amount := NanoToRaw(decimal.NewFromInt(1))
+	lost, active := recoverAccount(t, 0), recoverAccount(t, 1)
+	ledger.send("nano_1customer", lost, amount)
+	ledger.send("nano_1customer", active, amount)
+	p := &Payment{Account: active, Amount: amount, CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	sweepTo := recoverAccount(t, 100)
+	opts := RecoverOptions{Seed: testRecoverSeed, MaxIndex: 2, SweepTo: sweepTo, Skip: unfinishedPaymentAccount}
+	report, err := recoverScan(context.Background(), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Accounts) != 2 || report.Accounts[0].SweepHash == "" || report.Accounts[1].Error != errRecoverPaymentOpen.Error() {
+		t.Fatalf("unexpected report: %+v", report.Accounts)
+	}
+	if !ledger.received(sweepTo).Equal(amount) || !ledger.received(active).Equal(amount) {
+		t.Errorf("funds are swept wrong: %s", ledger.received(sweepTo))
+	}
+
+	opts.SweepTo = "nano_1merchant"
+	if _, err = recoverScan(context.Background(), opts, nil); err != nano.ErrInvalidAccount {
+		t.Errorf("invalid sweep account is accepted: %v", err)
+	}
+	for _, values := range []url.Values{{"max_index": {"10"}, "sweep_to": {"nano_1merchant"}}, {"max_index": {"4294967297"}}} {
+		if w := postAdminForm(handleAdminRecoverScan, values); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid scan %v is started: %d", values, w.Code)
+		}
+	}
+}
+
+func TestRecoverScanMerchantSeeds(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = testRecoverSeed
+	shopSeed := strings.Repeat("1", 64)
+	config.Merchants = map[string]Merchant{
+		"shop": {Seed: shopSeed, Account: "nano_1shop"},
+		// Accounts of merchants without their own seed are derived from Seed.
+		"shared": {Account: "nano_1shared"},
+	}
+	t.Cleanup(func() {
+		config.Seed = ""
+		config.Merchants = nil
+	})
+	shopKey, err := nano.DeriveKey(shopSeed, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	fakeRecoverNode(t, map[string][2]string{recoverAccount(t, 2): {"1", "0"}, shopKey.Account: {"0", "7"}}, &calls)
+	if err = startRecoverScan(10, ""); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		recoverMu.Lock()
+		active := recoverActive
+		recoverMu.Unlock()
+		if !active {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("scan is not finished")
+		}
+	}
+	w := httptest.NewRecorder()
+	handleAdminRecoverScan(w, httptest.NewRequest(http.MethodGet, "/admin/recover-scan", nil))
+	var status struct {
+		Error     string
+		Report    *RecoverReport
+		Merchants map[string]*RecoverReport
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Error != "" || calls != 2 || len(status.Merchants) != 1 {
+		t.Fatalf("unexpected status: %s", w.Body)
+	}
+	if a := status.Report.Accounts; len(a) != 1 || a[0].Account != recoverAccount(t, 2) || a[0].Merchant != "" {
+		t.Errorf("unexpected accounts of Seed: %+v", a)
+	}
+	if r := status.Merchants["shop"]; r == nil || !r.Done || len(r.Accounts) != 1 || r.Accounts[0].Account != shopKey.Account || r.Accounts[0].Merchant != "shop" || r.Accounts[0].Index != "5" {
+		t.Errorf("account of merchant seed is not found: %+v", r)
+	}
+	if _, err = os.Stat(config.DatabasePath + ".recover.shop"); err != nil {
+		t.Errorf("checkpoint of merchant seed is not saved: %s", err)
+	}
+}
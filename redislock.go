@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Scripts only modify the key if it still holds the token of the lease.
+const (
+	redisRenewScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+var errRedisNil = errors.New("redis: nil reply")
+
+// redisLock is a DistributedLock that uses SET NX with an expiry on a Redis server.
+// Leases are renewed in background at one third of the TTL.
+type redisLock struct {
+	address string
+	prefix  string
+	ttl     time.Duration
+	// Delay between attempts while the lock is held by another instance.
+	retry time.Duration
+	// Acquire gives up after this duration.
+	wait    time.Duration
+	timeout time.Duration
+}
+
+func newRedisLock(address string, ttl, wait time.Duration) *redisLock {
+	return &redisLock{
+		address: address,
+		prefix:  "accept-nano:lock:",
+		ttl:     ttl,
+		retry:   100 * time.Millisecond,
+		wait:    wait,
+		timeout: 5 * time.Second,
+	}
+}
+
+func (l *redisLock) Acquire(key string) (Lease, error) {
+	key = l.prefix + key
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+	ttl := strconv.FormatInt(l.ttl.Milliseconds(), 10)
+	deadline := time.Now().Add(l.wait)
+	for {
+		_, err = l.do("SET", key, token, "NX", "PX", ttl)
+		if err == nil {
+			break
+		}
+		if err != errRedisNil {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errLockTimeout
+		}
+		time.Sleep(l.retry)
+	}
+	renew := func() error {
+		n, err := l.do("EVAL", redisRenewScript, "1", key, token, ttl)
+		if err != nil {
+			return err
+		}
+		if n != "1" {
+			return errLeaseLost
+		}
+		return nil
+	}
+	release := func() error {
+		_, err := l.do("EVAL", redisReleaseScript, "1", key, token)
+		return err
+	}
+	return newRenewingLease(l.ttl/3, renew, release), nil // nolint: gomnd
+}
+
+// do runs a single command on a new connection and returns the reply as string.
+// Lock operations are rare compared to their duration, so connections are not pooled.
+func (l *redisLock) do(args ...string) (string, error) {
+	conn, err := net.DialTimeout("tcp", l.address, l.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(l.timeout))
+	if err != nil {
+		return "", err
+	}
+	_, err = conn.Write(encodeRESP(args))
+	if err != nil {
+		return "", err
+	}
+	return readRESP(bufio.NewReader(conn))
+}
+
+// encodeRESP encodes args as a RESP array of bulk strings.
+func encodeRESP(args []string) []byte {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b = append(b, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	return b
+}
+
+// readRESP reads a simple string, error, integer or bulk string reply.
+func readRESP(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: invalid reply: %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			return "", errRedisNil
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return "", err
+		}
+		return string(b[:n]), nil
+	default:
+		return "", fmt.Errorf("redis: unsupported reply: %q", line)
+	}
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// An admin refunds a payment with POST /admin/refund, e.g. when the order falls through after the customer paid.
+// Funds are sent back to the account that sent them, found from the links of the receive blocks in the deposit account.
+// If the funds are already sent to the merchant, the refund is sent from Account with the node wallet in MerchantWallet,
+// otherwise from the deposit account. Exchange hot wallets may not credit the funds to the customer, so refunds to
+// them require an explicit destination. A payment is refunded once; a failed refund can be requested again.
+// Failed refunds are also retried by the checker with exponential backoff until maxRefundAttempts, then the operator
+// is alerted. A sent refund changes the financial summary, so the final notification is sent again with it.
+
+// Accounts that a refund is sent from.
+const (
+	refundSourceDeposit  = "deposit"
+	refundSourceMerchant = "merchant"
+)
+
+// Statuses of a refund.
+const (
+	refundStatusPending = "pending"
+	refundStatusSent    = "sent"
+	refundStatusFailed  = "failed"
+)
+
+// Retries of a failed refund wait refundRetryDelay, doubled after every attempt.
+const (
+	refundRetryDelay  = time.Minute
+	maxRefundAttempts = 8
+)
+
+var (
+	errRefundRetry     = errors.New("waiting to retry the refund")
+	errAlreadyRefunded  = errors.New("payment is already refunded")
+	errRefundNoFunds    = errors.New("payment has no funds to refund")
+	errRefundAmount     = errors.New("amount is more than the funds received")
+	errRefundSender     = errors.New("destination is required because the funds are sent from multiple accounts")
+	errRefundExchange   = errors.New("destination is required because the sender is an exchange hot wallet")
+	errNoMerchantWallet = errors.New("funds are sent to the merchant and MerchantWallet is not set")
+	errMerchantRefund   = errors.New("funds are sent to the account of the merchant, it must send the refund")
+	errRefundSwept      = errors.New("funds are sent to the merchant during the refund")
+)
+
+var metricRefunds = expvar.NewMap("refunds_total")
+
+// Refund records a refund requested by an admin.
+type Refund struct {
+	RequestedAt time.Time `json:"requestedAt"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	Destination string    `json:"destination"`
+	// In raw.
+	Amount decimal.Decimal `json:"amount"`
+	Source string          `json:"source"`
+	Status string          `json:"status"`
+	Hash   string          `json:"hash,omitempty"`
+	// Error of the last failed attempt.
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	// Time of the next attempt after a failure. Nil if the refund is given up.
+	RetryAt    *time.Time `json:"retryAt,omitempty"`
+	RefundedAt *time.Time `json:"refundedAt"`
+}
+
+func (r *Refund) sent() bool {
+	return r != nil && r.Status == refundStatusSent
+}
+
+// retrying returns true if the refund failed and it is not given up.
+func (r *Refund) retrying() bool {
+	return r != nil && r.Status == refundStatusFailed && r.RetryAt != nil
+}
+
+// unsent returns true if a refund is requested but the funds are not sent yet.
+func (r *Refund) unsent() bool {
+	return r != nil && r.Status != refundStatusSent
+}
+
+// refunded returns true if the funds of the payment are sent back to the customer.
+func (p Payment) refunded() bool {
+	return p.Refund.sent() || p.Late.refunded() || p.Expiry.refunded()
+}
+
+// refundStarted returns true if a refund of the payment is sent or being sent.
+func (p Payment) refundStarted() bool {
+	if p.Refund != nil && p.Refund.Status != refundStatusFailed {
+		return true
+	}
+	return p.refunded() || p.Late.refunding() || p.Expiry.refunding()
+}
+
+// refundSender returns the account that sent the funds of the payment, looked up in the ledger.
+// It is empty if the funds are sent from multiple accounts, or if some blocks are not kept in SubPayments.
+func (p *Payment) refundSender() (string, error) {
+	if p.ElidedBlocks != nil {
+		return "", nil
+	}
+	// Receive blocks link to the send blocks. Blocks not received yet are keyed by their send block.
+	var receives, sends []string
+	for hash, sp := range p.SubPayments {
+		if sp.ReceiveHash != "" {
+			receives = append(receives, sp.ReceiveHash)
+		} else {
+			sends = append(sends, hash)
+		}
+	}
+	if len(receives) > 0 {
+		blocks, err := p.node().BlocksInfo(receives)
+		if err != nil {
+			return "", err
+		}
+		for _, hash := range receives {
+			b, ok := blocks[hash]
+			if !ok || b.Contents.Link == "" {
+				return "", fmt.Errorf("receive block %s is not found", hash)
+			}
+			sends = append(sends, b.Contents.Link)
+		}
+	}
+	if len(sends) == 0 {
+		return "", nil
+	}
+	blocks, err := p.node().BlocksInfo(sends)
+	if err != nil {
+		return "", err
+	}
+	var sender string
+	for _, hash := range sends {
+		b, ok := blocks[hash]
+		if !ok {
+			return "", fmt.Errorf("send block %s is not found", hash)
+		}
+		if sender != "" && b.BlockAccount != sender {
+			return "", nil
+		}
+		sender = b.BlockAccount
+	}
+	return sender, nil
+}
+
+// sendRefund sends the refund recorded in p.Refund and returns the hash of the block.
+func (p *Payment) sendRefund() (string, error) {
+	if p.Refund.Source == refundSourceMerchant {
+		// Node sends a single block for the id, so retrying a refund that timed out does not send it twice.
+		return p.node().Send(config.MerchantWallet, config.Account, p.Refund.Destination, p.Refund.Amount.String(), "refund-"+p.Account)
+	}
+	err := p.receivePending()
+	if err != nil {
+		return "", err
+	}
+	key, err := p.deriveKey()
+	if err != nil {
+		return "", err
+	}
+	var hash string
+	err = withMoneyLock(p.Account, func(lease Lease) error {
+		err := p.reload()
+		if err != nil {
+			return err
+		}
+		// Another instance may have swept the payment before the refund is saved.
+		if p.SentAt != nil {
+			return errRefundSwept
+		}
+		hash, err = sendAmount(lease, p.Account, p.Refund.Destination, key.Private, p.Refund.Amount)
+		if err != nil {
+			return err
+		}
+		p.stampOperation(operationRefund)
+		return nil
+	})
+	return hash, err
+}
+
+// recordRefundError records a failed attempt of the refund and schedules the next one.
+func (p *Payment) recordRefundError(err error) {
+	log.Errorf("cannot refund payment %s: %s", p.logName(), err)
+	metricRefunds.Add(refundStatusFailed, 1)
+	r := p.Refund
+	r.Status = refundStatusFailed
+	r.Error = err.Error()
+	r.Attempts++
+	if r.Attempts >= maxRefundAttempts {
+		r.RetryAt = nil
+		sendAlert("refund_failed", fmt.Sprintf("giving up refund of %s after %d attempts", p.Account, r.Attempts), map[string]interface{}{"account": p.Account, "error": r.Error})
+		return
+	}
+	retryAt := now().Add(refundRetryDelay << (r.Attempts - 1))
+	r.RetryAt = &retryAt
+}
+
+// recordRefundSent records the sent refund. Final notification is sent again with the refund in the summary.
+func (p *Payment) recordRefundSent(hash string) {
+	r := p.Refund
+	r.Status = refundStatusSent
+	r.Hash = hash
+	r.Error = ""
+	r.RetryAt = nil
+	r.RefundedAt = now()
+	p.FinalNotifiedAt, p.FinalNotificationFailedAt, p.FinalNotificationAttempts = nil, nil, 0
+	metricRefunds.Add(r.Source, 1)
+	log.Noticef("payment %s refunded by %s: %s raw to %s", p.logName(), r.RequestedBy, r.Amount, r.Destination)
+}
+
+// retryRefund sends the failed refund again.
+func (p *Payment) retryRefund() error {
+	hash, err := p.sendRefund()
+	if err != nil {
+		p.recordRefundError(err)
+		if err2 := p.Save(); err2 != nil {
+			log.Error(err2)
+		}
+		return err
+	}
+	p.recordRefundSent(hash)
+	return p.saveMilestone()
+}
+
+func handleAdminRefund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if token := r.FormValue("token"); account == "" && token != "" {
+		claims, err := ParseToken(token)
+		if err != nil {
+			http.Error(w, "invalid token", http.StatusBadRequest)
+			return
+		}
+		account = claims.Account
+	}
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	destination := r.FormValue("destination")
+	if destination != "" && !accountRegexp.MatchString(destination) {
+		http.Error(w, "invalid destination", http.StatusBadRequest)
+		return
+	}
+	var amount decimal.Decimal
+	if s := r.FormValue("amount"); s != "" {
+		nano, err := parseAmount(s)
+		if err == nil {
+			amount, err = NanoToRawChecked(nano)
+		}
+		if err != nil || !amount.IsPositive() {
+			http.Error(w, "invalid amount", http.StatusBadRequest)
+			return
+		}
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if payment.Imported {
+		writeError(w, errCodePaymentImported, http.StatusConflict, "imported payments are not refunded")
+		return
+	}
+	if payment.Sandbox {
+		http.Error(w, "sandbox payments are not refunded", http.StatusConflict)
+		return
+	}
+	if payment.refundStarted() {
+		http.Error(w, errAlreadyRefunded.Error(), http.StatusConflict)
+		return
+	}
+	if !payment.Balance.IsPositive() {
+		http.Error(w, errRefundNoFunds.Error(), http.StatusConflict)
+		return
+	}
+	if amount.IsZero() {
+		amount = payment.Balance
+	}
+	if amount.GreaterThan(payment.Balance) {
+		http.Error(w, errRefundAmount.Error(), http.StatusBadRequest)
+		return
+	}
+	source := refundSourceDeposit
+	if payment.SentAt != nil {
+		source = refundSourceMerchant
+	}
+	if source == refundSourceMerchant && payment.Merchant != "" {
+		http.Error(w, errMerchantRefund.Error(), http.StatusConflict)
+		return
+	}
+	if source == refundSourceMerchant && config.MerchantWallet == "" {
+		http.Error(w, errNoMerchantWallet.Error(), http.StatusConflict)
+		return
+	}
+	if source == refundSourceDeposit && !config.sweepEnabled() {
+		http.Error(w, errSweepDisabled.Error(), http.StatusConflict)
+		return
+	}
+	if destination == "" {
+		destination, err = payment.refundSender()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if destination == "" {
+			http.Error(w, errRefundSender.Error(), http.StatusBadRequest)
+			return
+		}
+		if isExchangeAccount(destination) {
+			http.Error(w, errRefundExchange.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if source == refundSourceDeposit && !requireOwnership(w, r, "refund", payment) {
+		return
+	}
+	// Saved before sending, so the payment is not swept meanwhile and the refund is not started twice.
+	payment.Refund = &Refund{
+		RequestedAt: *now(),
+		RequestedBy: adminIdentity(r),
+		Destination: destination,
+		Amount:      amount,
+		Source:      source,
+		Status:      refundStatusPending,
+	}
+	err = payment.Save()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hash, err := payment.sendRefund()
+	if err != nil {
+		payment.recordRefundError(err)
+		if err2 := payment.Save(); err2 != nil {
+			log.Error(err2)
+		}
+		// Check loop of a swept payment is finished, so it is started again for the retry.
+		startCheckingOnce(payment)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payment.recordRefundSent(hash)
+	err = payment.Save()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go verifications.Publish(PaymentVerified{Payment: *payment})
+	// Refund is sent, so a failed notification does not fail the request. It is retried by the checker.
+	if err = payment.notifyFinal(); err != nil {
+		log.Warningf("cannot send final notification of refunded payment %s: %s", payment.logName(), err)
+		startCheckingOnce(payment)
+	}
+	writeAdminJSON(w, payment)
+}
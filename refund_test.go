@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestAdminRefund(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	config.ExchangeAccounts = []string{"nano_1exchange"}
+	t.Cleanup(func() {
+		config.Account = ""
+		config.ExchangeAccounts = nil
+		config.MerchantWallet = ""
+	})
+	amount := NanoToRaw(decimal.New(1, 0))
+	newPayment := func(account, sender string, staleRate bool) *Payment {
+		p := &Payment{Account: account, PublicKey: randomHash(), Amount: amount, CreatedAt: clock.Now(), StaleRate: staleRate}
+		ledger.own(p)
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		ledger.send(sender, account, amount)
+		if err := p.check(); err != nil {
+			t.Fatal(err)
+		}
+		if p.ReceivedAt == nil {
+			t.Fatalf("payment is not received: %+v", p)
+		}
+		return p
+	}
+	refund := func(values url.Values) (int, *Payment) {
+		w := postAdminForm(handleAdminRefund, values)
+		p, err := LoadPayment([]byte(values.Get("account")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, p
+	}
+
+	// Funds not sent to the merchant yet are refunded from the deposit account.
+	held := newPayment("nano_1held", "nano_1customer", true)
+	code, p := refund(url.Values{"account": {held.Account}, "amount": {"0.4"}})
+	if code != http.StatusOK || !p.Refund.sent() || p.Refund.Source != refundSourceDeposit || p.Refund.Destination != "nano_1customer" || p.Refund.Hash == "" {
+		t.Fatalf("payment is not refunded: %d %+v", code, p.Refund)
+	}
+	if !ledger.received("nano_1customer").Equal(NanoToRaw(decimal.New(4, -1))) || p.nextStep() != stepNone {
+		t.Fatalf("refund is not sent from deposit: %s", ledger.received("nano_1customer"))
+	}
+	if !NewResponse(p, "").Refunded {
+		t.Error("refund is not shown in response")
+	}
+	if code, _ = refund(url.Values{"account": {held.Account}}); code != http.StatusConflict {
+		t.Errorf("payment is refunded twice: %d", code)
+	}
+
+	// Funds sent to the merchant are refunded from the merchant wallet.
+	swept := newPayment("nano_1swept", "nano_1buyer", false)
+	if swept.SentAt == nil {
+		t.Fatal("payment is not swept")
+	}
+	if code, _ = refund(url.Values{"account": {swept.Account}}); code != http.StatusConflict {
+		t.Errorf("payment is refunded without merchant wallet: %d", code)
+	}
+	config.MerchantWallet = "wallet"
+	// Merchant wallet receives the swept funds.
+	received := ledger.received(config.Account)
+	ledger.mu.Lock()
+	ledger.balances[config.Account], ledger.pending[config.Account] = received, nil
+	ledger.mu.Unlock()
+	if code, _ = refund(url.Values{"account": {swept.Account}, "amount": {"2"}}); code != http.StatusBadRequest {
+		t.Errorf("more than the funds is refunded: %d", code)
+	}
+	code, p = refund(url.Values{"account": {swept.Account}})
+	if code != http.StatusOK || !p.Refund.sent() || p.Refund.Source != refundSourceMerchant || !p.Refund.Amount.Equal(amount) {
+		t.Fatalf("payment is not refunded: %d %+v", code, p.Refund)
+	}
+	if !ledger.received("nano_1buyer").Equal(amount) || !ledger.received(config.Account).IsZero() {
+		t.Fatal("refund is not sent from merchant")
+	}
+
+	// Exchanges may not credit the customer, so destination must be given.
+	exchange := newPayment("nano_1fromexchange", "nano_1exchange", true)
+	if code, _ = refund(url.Values{"account": {exchange.Account}}); code != http.StatusBadRequest {
+		t.Errorf("payment is refunded to an exchange: %d", code)
+	}
+	wallet := "nano_3" + strings.Repeat("a", 59)
+	code, p = refund(url.Values{"account": {exchange.Account}, "destination": {wallet}})
+	if code != http.StatusOK || p.Refund.Destination != wallet || !ledger.received(wallet).Equal(amount) {
+		t.Fatalf("payment is not refunded to destination: %d %+v", code, p.Refund)
+	}
+}
+
+func TestAdminRefundRetry(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	clock := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	config.Seed = "seed"
+	config.Account = "nano_1merchant"
+	config.MerchantWallet = "wallet"
+	t.Cleanup(func() {
+		config.Account = ""
+		config.MerchantWallet = ""
+	})
+	stopCheckLoops(t)
+	amount := NanoToRaw(decimal.New(1, 0))
+	p := &Payment{Account: "nano_1retry", PublicKey: randomHash(), Amount: amount, CreatedAt: clock.Now()}
+	ledger.own(p)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ledger.send("nano_1customer", p.Account, amount)
+	if err := p.check(); err != nil || p.SentAt == nil {
+		t.Fatalf("payment is not swept: %v", err)
+	}
+	finals := make(chan PaymentFinal, 2)
+	cancel := verifications.Subscribe(Account(p.Account), func(e Event) {
+		if f, ok := e.(PaymentFinal); ok {
+			finals <- f
+		}
+	})
+	defer cancel()
+
+	// Merchant wallet has not received the swept funds yet, so the refund fails and it is retried later.
+	if w := postAdminForm(handleAdminRefund, url.Values{"account": {p.Account}}); w.Code != http.StatusInternalServerError {
+		t.Fatalf("refund does not fail: %d", w.Code)
+	}
+	p, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Refund.retrying() || p.Refund.Attempts != 1 || p.nextStep() != stepAdminRefund || p.finished() {
+		t.Fatalf("refund is not retried: %s %+v", p.nextStep(), p.Refund)
+	}
+	if err = p.runStep(stepAdminRefund); err != errRefundRetry {
+		t.Fatalf("refund is retried before backoff: %v", err)
+	}
+	received := ledger.received(config.Account)
+	ledger.mu.Lock()
+	ledger.balances[config.Account], ledger.pending[config.Account] = received, nil
+	ledger.mu.Unlock()
+	clock.Add(refundRetryDelay)
+	if err = p.check(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Refund.sent() || !ledger.received("nano_1customer").Equal(amount) || p.FinalNotifiedAt == nil || p.nextStep() != stepNone {
+		t.Fatalf("refund is not sent: %s %+v", p.nextStep(), p.Refund)
+	}
+	// Event of the sweep may be published after the subscription.
+	for f := (PaymentFinal{}); f.Summary == nil || f.Summary.Outcome == outcomeSwept; {
+		select {
+		case f = <-finals:
+		case <-time.After(5 * time.Second):
+			t.Fatal("final notification is not sent after refund")
+		}
+		if f.Summary.Outcome != outcomeSwept && (f.Summary.Outcome != outcomeRefunded || f.Summary.Refund == nil || f.Summary.Refund.Hash != p.Refund.Hash) {
+			t.Errorf("unexpected summary: %+v", f.Summary)
+		}
+	}
+
+	// Wait is doubled after every attempt until the refund is given up.
+	q := &Payment{Account: "nano_1givenup", Refund: &Refund{Status: refundStatusPending}}
+	for i := 1; i < maxRefundAttempts; i++ {
+		q.recordRefundError(errRefundNoFunds)
+		if !q.Refund.RetryAt.Equal(clock.Now().Add(refundRetryDelay << (i - 1))) {
+			t.Fatalf("unexpected retry time after %d attempts: %s", i, q.Refund.RetryAt)
+		}
+	}
+	q.recordRefundError(errRefundNoFunds)
+	if q.Refund.retrying() || q.nextStep() != stepNone {
+		t.Errorf("refund is not given up: %+v", q.Refund)
+	}
+}
@@ -1,47 +1,202 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
 	"time"
 
+	"github.com/cenkalti/log"
+
 	"github.com/shopspring/decimal"
 )
 
 // Response that we return from API endpoints.
 type Response struct {
-	Token            string                        `json:"token"`
-	Account          string                        `json:"account"`
-	Amount           decimal.Decimal               `json:"amount"`
-	AmountInCurrency decimal.Decimal               `json:"amountInCurrency"`
-	Currency         string                        `json:"currency"`
-	Balance          decimal.Decimal               `json:"balance"`
-	SubPayments      map[string]SubPaymentResponse `json:"subPayments"`
-	RemainingSeconds int                           `json:"remainingSeconds"`
-	State            string                        `json:"state"`
-	Fulfilled        bool                          `json:"fulfilled"`
-	MerchantNotified bool                          `json:"merchantNotified"`
+	Token     string `json:"token"`
+	PaymentID string `json:"paymentId"`
+	// Deposit address. It is not an identifier of the payment, use PaymentID instead.
+	Account string `json:"account"`
+	// URI for wallets in "nano:ACCOUNT?amount=RAW" form. It is the content of the QR code from /api/qr.
+	URI              string          `json:"uri"`
+	Amount           decimal.Decimal `json:"amount"`
+	AmountInCurrency CurrencyAmount  `json:"amountInCurrency"`
+	Currency         string          `json:"currency"`
+	Balance          decimal.Decimal `json:"balance"`
+	// Balance in raw. It is the total of received blocks, including any amount over Amount.
+	AmountReceivedRaw string                        `json:"amountReceivedRaw"`
+	SubPayments       map[string]SubPaymentResponse `json:"subPayments"`
+	RemainingSeconds  int                           `json:"remainingSeconds"`
+	// Time that the payment is not accepted anymore. It is CreatedAt plus the timeout of the payment.
+	ExpiresAt        time.Time        `json:"expiresAt"`
+	State            string           `json:"state"`
+	Fulfilled        bool             `json:"fulfilled"`
+	MerchantNotified bool             `json:"merchantNotified"`
+	StaleRate        bool             `json:"staleRate"`
+	SatisfiedBy      []SatisfiedBlock `json:"satisfiedBy"`
+	// Set when funds arrived after expiry and the merchant has not decided yet.
+	LatePaid bool `json:"latePaid,omitempty"`
+	// Set when the payment is cancelled. Payment is not checked for funds anymore.
+	Cancelled bool `json:"cancelled,omitempty"`
+	// Set when funds of the payment are sent back to the customer.
+	Refunded bool `json:"refunded,omitempty"`
+	// Set for sandbox payments. No funds are moved for them.
+	Sandbox bool `json:"sandbox,omitempty"`
+	// State transitions of the payment in time order, for showing its progress.
+	History []HistoryState `json:"history,omitempty"`
+	// Set when funds are received but they are not enough yet. AmountRemaining is the rest to send.
+	PartiallyPaid   bool             `json:"partiallyPaid,omitempty"`
+	AmountRemaining *decimal.Decimal `json:"amountRemaining,omitempty"`
+	// Set when the funds are seen but the network has not confirmed them yet. The payment is not fulfilled until then.
+	PendingConfirmation bool `json:"pendingConfirmation,omitempty"`
+	// Amount received over Amount. Merchant decides to credit or refund it.
+	Overpaid *decimal.Decimal `json:"overpaid,omitempty"`
+	// Amounts in the currencies requested in display_currencies parameter.
+	Display []DisplayAmount `json:"display,omitempty"`
+	// Revision of the payment record. It only increases, in responses of /api/verify and websocket messages alike.
+	// Clients ignore a response with a lower revision than one they have seen.
+	Revision uint64 `json:"revision"`
+	// Sequence number of websocket messages of the token.
+	// Clients pass the last one in "since" query parameter when reconnecting to get the missed update.
+	Seq uint64 `json:"seq,omitempty"`
+	// Set to "degraded" with a message to display when node is failing or payment checks are backlogged.
+	ServiceStatus  string `json:"serviceStatus,omitempty"`
+	ServiceMessage string `json:"serviceMessage,omitempty"`
+	// Set with a longer interval than usual when payment checks are backlogged (seconds).
+	SuggestedClientPollSeconds int `json:"suggestedClientPollSeconds,omitempty"`
+	// Set in the websocket message sent when funds are moved to their final place.
+	Summary *FinancialSummary `json:"summary,omitempty"`
+	// Metadata of the payment as sent in /api/pay, over the metadata of the preset.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Static values from ExtraResponseFields config.
+	Extra map[string]interface{} `json:"extra,omitempty"`
 }
 
 type SubPaymentResponse struct {
 	Amount  decimal.Decimal `json:"amount"`
 	Account string          `json:"account"`
+	// Set while the network has not confirmed the block.
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
 }
 
 func NewResponse(p *Payment, token string) *Response {
 	subPayments := make(map[string]SubPaymentResponse, len(p.SubPayments))
 	for k, v := range p.SubPayments {
-		subPayments[k] = SubPaymentResponse{Account: v.Account, Amount: RawToNano(v.Amount)}
+		subPayments[k] = SubPaymentResponse{Account: v.Account, Amount: RawToNano(v.Amount), Unconfirmed: v.Unconfirmed}
+	}
+	response := &Response{
+		Token:             token,
+		PaymentID:         p.PaymentID,
+		Revision:          p.Revision,
+		Account:           p.Account,
+		URI:               paymentURI(p),
+		Amount:            RawToNano(p.Amount),
+		AmountInCurrency:  p.AmountInCurrency,
+		Currency:          p.Currency,
+		Balance:           RawToNano(p.Balance),
+		AmountReceivedRaw: p.Balance.String(),
+		State:             p.State,
+		SubPayments:       subPayments,
+		RemainingSeconds:  int(p.remainingDuration() / time.Second),
+		ExpiresAt:         p.expiresAt(),
+		Fulfilled:         p.FulfilledAt != nil,
+		MerchantNotified:  p.NotifiedAt != nil,
+		StaleRate:         p.StaleRate,
+		SatisfiedBy:       p.SatisfiedBy,
+		LatePaid:          p.Late.unresolved(),
+		Cancelled:         p.CancelledAt != nil,
+		Refunded:          p.refunded(),
+		Sandbox:           p.Sandbox,
+		History:           p.historyStates(),
+		PartiallyPaid:     p.partiallyPaid(),
+		AmountRemaining:   rawToNanoPtr(p.amountRemaining()),
+		Overpaid:          rawToNanoPtr(p.overpaid()),
+		Metadata:          p.Metadata,
+		Extra:             extraResponseFields(p.Client),
+	}
+	response.PendingConfirmation = p.pendingConfirmation()
+	if response.Cancelled {
+		response.RemainingSeconds = 0
+	}
+	if status, message := nodeErrors.status(); status != serviceStatusOK {
+		response.ServiceStatus = status
+		response.ServiceMessage = message
 	}
-	return &Response{
-		Token:            token,
-		Account:          p.Account,
-		Amount:           RawToNano(p.Amount),
-		AmountInCurrency: p.AmountInCurrency,
-		Currency:         p.Currency,
-		Balance:          RawToNano(p.Balance),
-		State:            p.State,
-		SubPayments:      subPayments,
-		RemainingSeconds: int(p.remainingDuration() / time.Second),
-		Fulfilled:        p.FulfilledAt != nil,
-		MerchantNotified: p.NotifiedAt != nil,
+	return response
+}
+
+// Error codes in ErrorResponse. Codes are stable, clients can switch on them instead of messages.
+const (
+	errCodeInvalidRequest      = "INVALID_REQUEST"
+	errCodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	errCodeInvalidAPIKey       = "INVALID_API_KEY"
+	errCodeInvalidAmount       = "INVALID_AMOUNT"
+	errCodeInvalidUnit         = "INVALID_UNIT"
+	errCodeAmountOutOfRange    = "AMOUNT_OUT_OF_RANGE"
+	errCodeInvalidSuccessURL   = "INVALID_SUCCESS_URL"
+	errCodeInvalidCurrency     = "INVALID_CURRENCY"
+	errCodeUnsupportedCurrency = "UNSUPPORTED_CURRENCY"
+	errCodeInvalidState        = "MISSING_OR_INVALID_STATE"
+	errCodeDuplicateState      = "DUPLICATE_STATE"
+	errCodeInvalidNotifyURL    = "INVALID_NOTIFY_URL"
+	errCodeInvalidTimeout      = "INVALID_TIMEOUT"
+	errCodeInvalidExpiryPolicy = "INVALID_EXPIRY_POLICY"
+	errCodeUnknownPreset       = "UNKNOWN_PRESET"
+	errCodePriceUnavailable    = "PRICE_UNAVAILABLE"
+	errCodeTokenInvalid        = "TOKEN_INVALID"
+	errCodePaymentNotFound     = "PAYMENT_NOT_FOUND"
+	errCodePaymentNotVerified  = "PAYMENT_NOT_VERIFIED"
+	errCodePaymentNotFinal     = "PAYMENT_NOT_FINAL"
+	errCodeCannotCancel        = "CANNOT_CANCEL"
+	errCodeOriginNotAllowed    = "ORIGIN_NOT_ALLOWED"
+	errCodeInvalidDeadline     = "INVALID_DEADLINE"
+	errCodeDeadlineExceeded    = "DEADLINE_EXCEEDED"
+	errCodeDeprecatedParameter = "DEPRECATED_PARAMETER"
+	errCodeNodeUnavailable     = "NODE_UNAVAILABLE"
+	errCodeExposureLimit       = "EXPOSURE_LIMIT"
+	errCodeRateLimited         = "RATE_LIMITED"
+	errCodeBackfillInProgress  = "BACKFILL_IN_PROGRESS"
+	errCodeExportInProgress    = "EXPORT_IN_PROGRESS"
+	errCodeCheckingBacklogged  = "CHECKING_BACKLOGGED"
+	errCodePaymentImported     = "PAYMENT_IMPORTED"
+	errCodeAccountNotOwned     = "ACCOUNT_NOT_OWNED"
+	errCodeAccountLegacySeed   = "ACCOUNT_LEGACY_SEED"
+	errCodeIntegrityMismatch   = "INTEGRITY_MISMATCH"
+	errCodeInvalidMetadata     = "INVALID_METADATA"
+	errCodeMetadataTooLarge    = "METADATA_TOO_LARGE"
+	errCodeInvalidIdempotency  = "INVALID_IDEMPOTENCY_KEY"
+	errCodeIdempotencyInUse    = "IDEMPOTENCY_KEY_IN_USE"
+	errCodeSubscriptionLimit   = "SUBSCRIPTION_LIMIT"
+	errCodeSandboxDisabled     = "SANDBOX_DISABLED"
+	errCodeUnknownMerchant     = "UNKNOWN_MERCHANT"
+	errCodeMerchantMismatch    = "MERCHANT_MISMATCH"
+	errCodeNotSandbox          = "NOT_SANDBOX_PAYMENT"
+	errCodeCannotFulfill       = "CANNOT_FULFILL"
+	errCodeInternal            = "INTERNAL"
+)
+
+// ErrorResponse is returned from API endpoints for errors.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type APIError struct {
+	Code string `json:"code"`
+	// Human readable description. May change between versions.
+	Message string `json:"message"`
+}
+
+// writeError writes an ErrorResponse with the code and message.
+func writeError(w http.ResponseWriter, code string, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(ErrorResponse{Error: APIError{Code: code, Message: msg}})
+	if err != nil {
+		log.Debug(err)
 	}
 }
+
+// writeInternalError writes the response for unexpected errors. Details are not exposed to clients.
+func writeInternalError(w http.ResponseWriter) {
+	writeError(w, errCodeInternal, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/middleware/stdlib"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+func expectErrorCode(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid error response: %d %s", w.Code, w.Body)
+	}
+	if w.Code != status || resp.Error.Code != code || resp.Error.Message == "" {
+		t.Fatalf("expected %d %s, got %d %s", status, code, w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	form := func(method, target, body string) *http.Request {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	withAPIKey := form(http.MethodPost, "/api/pay", "amount=1")
+	withAPIKey.Header.Set("X-API-Key", "unknown")
+	invalidJSON := httptest.NewRequest(http.MethodPost, "/api/pay", strings.NewReader(`{"amount":`))
+	invalidJSON.Header.Set("Content-Type", "application/json")
+	noUpgrade := httptest.NewRequest(http.MethodGet, "/websocket", nil)
+	badOrigin := httptest.NewRequest(http.MethodGet, "/websocket", nil)
+	badOrigin.Header.Set("Upgrade", "websocket")
+	badOrigin.Header.Set("Origin", "https://evil.example.com")
+	config.AllowedOrigins = []string{testWebsocketOrigin}
+	t.Cleanup(func() { config.AllowedOrigins = nil })
+
+	cases := []struct {
+		name    string
+		handler http.Handler
+		request *http.Request
+		status  int
+		code    string
+	}{
+		{"pay with GET", http.HandlerFunc(handlePay), httptest.NewRequest(http.MethodGet, "/api/pay", nil), http.StatusMethodNotAllowed, errCodeMethodNotAllowed},
+		{"invalid JSON", http.HandlerFunc(handlePay), invalidJSON, http.StatusBadRequest, errCodeInvalidRequest},
+		{"unknown API key", http.HandlerFunc(handlePay), withAPIKey, http.StatusUnauthorized, errCodeInvalidAPIKey},
+		{"invalid amount", http.HandlerFunc(handlePay), form(http.MethodPost, "/api/pay", "amount=ten"), http.StatusBadRequest, errCodeInvalidAmount},
+		{"zero amount", http.HandlerFunc(handlePay), form(http.MethodPost, "/api/pay", "amount=0"), http.StatusBadRequest, errCodeInvalidAmount},
+		{"invalid currency", http.HandlerFunc(handlePay), form(http.MethodPost, "/api/pay", "amount=1&currency=US1"), http.StatusBadRequest, errCodeInvalidCurrency},
+		{"invalid notify url", http.HandlerFunc(handlePay), form(http.MethodPost, "/api/pay", "amount=1&notify_url=ftp://x"), http.StatusBadRequest, errCodeInvalidNotifyURL},
+		{"unknown preset", http.HandlerFunc(handlePay), form(http.MethodPost, "/api/pay", "preset=none"), http.StatusBadRequest, errCodeUnknownPreset},
+		{"invalid token", http.HandlerFunc(handleVerify), httptest.NewRequest(http.MethodGet, "/api/verify?token=x", nil), http.StatusBadRequest, errCodeTokenInvalid},
+		{"missing token", http.HandlerFunc(handleVerify), httptest.NewRequest(http.MethodGet, "/api/verify", nil), http.StatusBadRequest, errCodeTokenInvalid},
+		{"unknown payment", http.HandlerFunc(handleVerify), httptest.NewRequest(http.MethodGet, "/api/verify?id=none", nil), http.StatusNotFound, errCodePaymentNotFound},
+		{"price in invalid currency", http.HandlerFunc(handlePrice), httptest.NewRequest(http.MethodGet, "/api/price?currency=U", nil), http.StatusBadRequest, errCodeInvalidCurrency},
+		{"websocket without upgrade", websocketHandler(), noUpgrade, http.StatusBadRequest, errCodeInvalidRequest},
+		{"websocket from other origin", websocketHandler(), badOrigin, http.StatusForbidden, errCodeOriginNotAllowed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c.handler.ServeHTTP(w, c.request)
+			expectErrorCode(t, w, c.status, c.code)
+		})
+	}
+}
+
+func TestRateLimitedCode(t *testing.T) {
+	rl := limiter.New(memory.NewStore(), limiter.Rate{Period: time.Hour, Limit: 1})
+	h := stdlib.NewMiddleware(rl, stdlib.WithLimitReachedHandler(handleRateLimited)).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/price", nil))
+		if i == 1 {
+			expectErrorCode(t, w, http.StatusTooManyRequests, errCodeRateLimited)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objectStorage is the subset of S3 multipart upload API used for exports.
+type objectStorage interface {
+	CreateMultipartUpload(ctx context.Context, key string) (uploadID string, err error)
+	UploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (etag string, err error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Client is a minimal client for S3 compatible object storage.
+// Requests are signed with AWS Signature Version 4 and use path-style URLs.
+type s3Client struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+func newS3Client(endpoint, region, bucket, accessKey, secretKey string) *s3Client {
+	return &s3Client{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       clockNow,
+	}
+}
+
+// S3Error is an error response returned from object storage.
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("object storage error (status %d): %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (c *s3Client) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	_, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &result)
+	return result.UploadID, err
+}
+
+func (c *s3Client) UploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {uploadID}}
+	header, err := c.do(ctx, http.MethodPut, key, query, data, nil)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("ETag"), nil
+}
+
+func (c *s3Client) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	body := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for _, p := range parts {
+		body.Parts = append(body.Parts, part(p))
+	}
+	b, err := xml.Marshal(&body)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, b, nil)
+	return err
+}
+
+func (c *s3Client) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
+
+// do sends a signed request and decodes XML response into result if it is not nil.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte, result interface{}) (http.Header, error) {
+	path := "/" + awsEscape(c.bucket, false) + "/" + awsEscape(key, true)
+	rawQuery := canonicalQuery(query)
+	req, err := http.NewRequest(method, c.endpoint+path+"?"+rawQuery, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	c.sign(req, path, rawQuery, body)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// CompleteMultipartUpload can return an error with status 200.
+	if resp.StatusCode/100 != 2 || bytes.Contains(b, []byte("<Error>")) {
+		s3err := &S3Error{StatusCode: resp.StatusCode}
+		_ = xml.Unmarshal(b, s3err)
+		return nil, s3err
+	}
+	if result != nil {
+		err = xml.Unmarshal(b, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+func (c *s3Client) sign(req *http.Request, path, rawQuery string, body []byte) {
+	t := c.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{req.Method, path, rawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key as required by signature version 4.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes all characters except unreserved ones defined in RFC 3986.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
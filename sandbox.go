@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cenkalti/log"
+)
+
+// With SandboxMode, /api/pay accepts sandbox=true for testing integrations without moving funds.
+// POST /api/sandbox/fulfill?token=... pays a sandbox payment with a made-up block, then the payment goes through
+// the same steps as a real one: it is verified, websocket clients and the merchant are notified, and it is received
+// and sent to the merchant. The steps that use the node do nothing for sandbox payments.
+// Sandbox payments are flagged in responses and notifications and are left out of stats, digests, exports and balances.
+
+// Sender of the made-up blocks of sandbox payments, the burn address.
+const sandboxSender = "nano_1111111111111111111111111111111111111111111111111111hifc8npp"
+
+var (
+	errSandboxDisabled = errors.New("sandbox mode is not enabled")
+	errNotSandbox      = errors.New("payment is not a sandbox payment")
+	errCannotFulfill   = errors.New("payment is cancelled or expired")
+)
+
+// parseSandbox returns the sandbox parameter of /api/pay. It writes the error response if it returns false.
+func parseSandbox(w http.ResponseWriter, r *http.Request) (sandbox, ok bool) {
+	s := r.FormValue("sandbox")
+	if s == "" {
+		return false, true
+	}
+	sandbox, err := strconv.ParseBool(s)
+	if err != nil {
+		writeError(w, errCodeInvalidRequest, http.StatusBadRequest, "invalid sandbox")
+		return false, false
+	}
+	if sandbox && !config.SandboxMode {
+		writeError(w, errCodeSandboxDisabled, http.StatusBadRequest, errSandboxDisabled.Error())
+		return false, false
+	}
+	return sandbox, true
+}
+
+// checkSandboxPending replaces checkPending for sandbox payments. Funds only come from /api/sandbox/fulfill.
+func (p *Payment) checkSandboxPending() error {
+	if !p.isFulfilled() {
+		return errPaymentNotFulfilled
+	}
+	return nil
+}
+
+// fulfillSandbox adds a block of the whole amount to the sandbox payment of account and runs its steps.
+func fulfillSandbox(account string) (*Payment, error) {
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	p, err := LoadPayment([]byte(account))
+	if err != nil {
+		return nil, err
+	}
+	if !p.Sandbox {
+		return nil, errNotSandbox
+	}
+	if p.FulfilledAt != nil {
+		return p, nil
+	}
+	if p.CancelledAt != nil || p.remainingDuration() <= 0 {
+		return nil, errCannotFulfill
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	hash := strings.ToUpper(hex.EncodeToString(b))
+	if err = p.addSubPayment(hash, sandboxSender, p.Amount.Sub(p.Balance)); err != nil {
+		return nil, err
+	}
+	p.Balance = p.Amount
+	log.Noticef("sandbox payment %s is fulfilled", account)
+	// Notification errors are retried by the check loop like for real payments.
+	if err = p.check(); err != nil {
+		log.Errorf("error checking sandbox payment %s: %s", account, err)
+	}
+	return p, nil
+}
+
+func handleSandboxFulfill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, errCodeMethodNotAllowed, http.StatusMethodNotAllowed, "POST only")
+		return
+	}
+	if !config.SandboxMode {
+		writeError(w, errCodeSandboxDisabled, http.StatusNotFound, errSandboxDisabled.Error())
+		return
+	}
+	token := r.FormValue("token")
+	claims, err := ParseToken(token)
+	if err != nil {
+		writeError(w, errCodeTokenInvalid, http.StatusBadRequest, "invalid token")
+		return
+	}
+	p, err := fulfillSandbox(claims.Account)
+	switch err {
+	case nil:
+	case errPaymentNotFound:
+		writeError(w, errCodePaymentNotFound, http.StatusNotFound, "payment not found")
+		return
+	case errNotSandbox:
+		writeError(w, errCodeNotSandbox, http.StatusConflict, err.Error())
+		return
+	case errCannotFulfill:
+		writeError(w, errCodeCannotFulfill, http.StatusConflict, err.Error())
+		return
+	default:
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	b, err := json.Marshal(NewResponse(p, token))
+	if err != nil {
+		log.Error(err)
+		writeInternalError(w)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestSandboxPayment(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedDuration = -1
+	var mu sync.Mutex
+	var actions, events []string
+	nodeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action string `json:"action"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		actions = append(actions, req.Action)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(nano.Key{
+			Private: "9F0E444C69F77A49BD0BE89DB92C38FE713E0963165CCA12FAF5712D7657120F",
+			Public:  "C008B814A7D269A1FA3C6528B19201A24D797912DB9996FF02A1FF356E45552B",
+			Account: "nano_3i1aq1cchnmbn9x5rsbap8b15akfh7wj7pwskuzi7ahz8oq6cobd99d4r3b7",
+		})
+	}))
+	t.Cleanup(nodeServer.Close)
+	oldNode := node
+	node = nano.New(nodeServer.URL)
+	notifications := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		_ = json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		if n.Sandbox {
+			events = append(events, n.Event)
+		}
+		mu.Unlock()
+	}))
+	t.Cleanup(notifications.Close)
+	config.NotificationURL = notifications.URL
+	config.Account = "nano_1merchant"
+	t.Cleanup(func() {
+		node = oldNode
+		config.AllowedDuration = 0
+		config.NotificationURL = ""
+		config.Account = ""
+		config.SandboxMode = false
+	})
+	stopCheckLoops(t)
+	post := func(h http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	pay := func(sandbox string) Response {
+		t.Helper()
+		w := post(handlePay, url.Values{"amount": {"1"}, "sandbox": {sandbox}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("cannot create payment: %d %s", w.Code, w.Body)
+		}
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		// Unexpired, so it can be fulfilled.
+		p, err := LoadPayment([]byte(response.Account))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Timeout = 3600
+		if err = p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	expectErrorCode(t, post(handlePay, url.Values{"amount": {"1"}, "sandbox": {"true"}}), http.StatusBadRequest, errCodeSandboxDisabled)
+	expectErrorCode(t, post(handleSandboxFulfill, url.Values{"token": {"x"}}), http.StatusNotFound, errCodeSandboxDisabled)
+
+	config.SandboxMode = true
+	real := pay("false")
+	expectErrorCode(t, post(handleSandboxFulfill, url.Values{"token": {real.Token}}), http.StatusConflict, errCodeNotSandbox)
+
+	sandbox := pay("true")
+	if !sandbox.Sandbox {
+		t.Fatal("sandbox payment is not flagged")
+	}
+	mu.Lock()
+	actions = nil
+	mu.Unlock()
+	w := post(handleSandboxFulfill, url.Values{"token": {sandbox.Token}})
+	var response Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("cannot fulfill: %d %s", w.Code, w.Body)
+	}
+	if !response.Fulfilled || !response.MerchantNotified || !response.Sandbox || len(response.SatisfiedBy) != 1 {
+		t.Fatalf("sandbox payment is not fulfilled: %s", w.Body)
+	}
+	p, err := LoadPayment([]byte(sandbox.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ReceivedAt == nil || p.SentAt == nil || p.SendHash != "" || p.nextStep() != stepNone {
+		t.Fatalf("sandbox payment is not finished: %+v", p)
+	}
+	mu.Lock()
+	if len(actions) != 0 {
+		t.Errorf("node is called for sandbox payment: %v", actions)
+	}
+	if len(events) != 2 || events[0] != "" || events[1] != notificationEventFinal {
+		t.Errorf("unexpected notifications: %v", events)
+	}
+	mu.Unlock()
+
+	stats, err := collectStats("day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Verified != 0 {
+		t.Error("sandbox payment is counted in stats")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SatisfiedBlock is a block that contributed to the received amount of a payment.
+type SatisfiedBlock struct {
+	Hash        string     `json:"hash"`
+	AmountRaw   string     `json:"amountRaw"`
+	Source      string     `json:"source"`
+	ConfirmedAt *time.Time `json:"confirmedAt"`
+	// Set in the last entry which aggregates the blocks not kept in the payment record.
+	// Hash and Source are empty in that entry.
+	Elided int `json:"elided,omitempty"`
+}
+
+// satisfiedBy returns the sub payments ordered by confirmation time.
+// It is an error if their sum does not equal Balance, which means a block is lost or counted twice.
+func (p *Payment) satisfiedBy() ([]SatisfiedBlock, error) {
+	blocks := make([]SatisfiedBlock, 0, len(p.SubPayments))
+	for hash, sp := range p.SubPayments {
+		if sp.Unconfirmed {
+			continue
+		}
+		blocks = append(blocks, SatisfiedBlock{
+			Hash:        hash,
+			AmountRaw:   sp.Amount.String(),
+			Source:      sp.Account,
+			ConfirmedAt: sp.ConfirmedAt,
+		})
+	}
+	if sum := p.subPaymentsTotal(); !sum.Equal(p.Balance) {
+		err := fmt.Errorf("sum of blocks (%s) does not match received amount (%s)", sum, p.Balance)
+		sendAlert("satisfied_by_mismatch", p.Account+": "+err.Error(), map[string]interface{}{"account": p.Account})
+		return nil, err
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := blocks[i].ConfirmedAt, blocks[j].ConfirmedAt
+		if a != nil && b != nil && !a.Equal(*b) {
+			return a.Before(*b)
+		}
+		return blocks[i].Hash < blocks[j].Hash
+	})
+	if e := p.ElidedBlocks; e != nil {
+		blocks = append(blocks, SatisfiedBlock{AmountRaw: e.Amount.String(), Elided: e.Count})
+	}
+	return blocks, nil
+}
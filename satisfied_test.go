@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func testFulfilledPayment() *Payment {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	return &Payment{
+		PaymentID:        "0b5c3f0e-8f4b-4d0e-9a57-2f2d1c7e6a10",
+		Account:          "nano_1payment",
+		Amount:           decimal.RequireFromString("30000000000000000000000000000"),
+		AmountInCurrency: NewCurrencyAmount(decimal.RequireFromString("3"), "BCB"),
+		Currency:         "BCB",
+		Balance:          decimal.RequireFromString("35000000000000000000000000000"),
+		CreatedAt:        t1.Add(-time.Minute),
+		SubPayments: map[string]SubPayment{
+			"HASH2": {Account: "nano_1sender", Amount: decimal.RequireFromString("25000000000000000000000000000"), ConfirmedAt: &t2},
+			"HASH1": {Account: "nano_1sender", Amount: decimal.RequireFromString("10000000000000000000000000000"), ConfirmedAt: &t1},
+		},
+	}
+}
+
+func checkGolden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err = ioutil.WriteFile(golden, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("%s does not match:\n%s", golden, b)
+	}
+}
+
+func TestSatisfiedByPayload(t *testing.T) {
+	config.setDefaults()
+	p := testFulfilledPayment()
+	var err error
+	p.SatisfiedBy, err = p.satisfiedBy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fulfilledAt := p.SubPayments["HASH2"].ConfirmedAt.Add(time.Second)
+	p.FulfilledAt = &fulfilledAt
+	config.ExtraResponseFields = map[string]interface{}{"supportEmail": "support@example.com", "storeId": int64(42)}
+	t.Cleanup(func() { config.ExtraResponseFields = nil })
+	response := NewResponse(p, "TOKEN")
+	response.RemainingSeconds = 0
+	checkGolden(t, "verified_response", response)
+	checkGolden(t, "verified_notification", p.notification())
+
+	// Blocks seen later do not change the frozen list.
+	t3 := fulfilledAt.Add(time.Minute)
+	p.SubPayments["HASH3"] = SubPayment{Account: "nano_1sender", Amount: decimal.RequireFromString("1"), ConfirmedAt: &t3}
+	checkGolden(t, "verified_notification", p.notification())
+}
+
+func TestSatisfiedByMismatch(t *testing.T) {
+	p := testFulfilledPayment()
+	p.Balance = decimal.RequireFromString("40000000000000000000000000000")
+	if _, err := p.satisfiedBy(); err == nil {
+		t.Fatal("expected mismatch error")
+	}
+}
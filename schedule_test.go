@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestCheckSchedule(t *testing.T) {
+	openTestDB(t, 0)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := useFakeClock(t, start)
+	config.setDefaults()
+	config.AllowedDuration = 30 * 24 * 3600
+	t.Cleanup(func() { config.AllowedDuration = 0 })
+
+	p := &Payment{Account: "nano_1schedule", Amount: decimal.New(1, 0), CreatedAt: start}
+	if wait := p.NextCheck(); wait != 3*time.Second {
+		t.Fatalf("new payment is not checked fast: %s", wait)
+	}
+	// Checked every few seconds for the first two minutes.
+	for clock.Now().Sub(start) < 2*time.Minute {
+		p.checked()
+		if wait := p.NextCheck(); wait != 3*time.Second {
+			t.Fatalf("payment is not checked fast at %s: %s", clock.Now().Sub(start), wait)
+		}
+		clock.Add(3 * time.Second)
+	}
+	// Then the wait grows with each check until MaxNextCheckDuration.
+	var last time.Duration
+	for i := 0; i < 200; i++ {
+		p.checked()
+		wait := p.NextCheck()
+		if wait < last || wait > 1200*time.Second {
+			t.Fatalf("unexpected wait after %s: %s", clock.Now().Sub(start), wait)
+		}
+		last = wait
+		clock.Add(wait)
+	}
+	if last != 1200*time.Second {
+		t.Fatalf("wait does not reach the max: %s", last)
+	}
+
+	// Schedule is saved, so it is resumed after a restart.
+	p.checked()
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Payment
+	if err = json.Unmarshal(b, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.NextCheckAt == nil || loaded.NextCheck() != 1200*time.Second {
+		t.Fatalf("schedule is not saved: %s", b)
+	}
+	// Missed checks are spread.
+	clock.Add(time.Hour)
+	if wait := loaded.NextCheck(); wait < 0 || wait > 10*time.Second {
+		t.Errorf("missed check is not spread: %s", wait)
+	}
+
+	// A new block is checked fast again.
+	if err = p.addSubPayment(randomHash(), "nano_1sender", decimal.New(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	p.checked()
+	if wait := p.NextCheck(); wait != 3*time.Second {
+		t.Errorf("schedule is not reset by a new block: %s", wait)
+	}
+
+	p.CancelledAt = now()
+	p.checked()
+	if p.NextCheckAt != nil {
+		t.Error("finished payment has a next check")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lanes of the check scheduler.
+const (
+	laneDefault = iota
+	lanePriority
+	numLanes
+)
+
+// checkScheduler runs payment checks on a fixed number of workers.
+// When workers are saturated, jobs in the priority lane run first,
+// up to priorityShare of the worker slots, so the default lane is not starved.
+type checkScheduler struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	queues        [numLanes][]schedulerJob
+	served        [numLanes]int
+	priorityShare float64
+	workers       int
+	// Wait times of recently started jobs.
+	lags []lagSample
+}
+
+type schedulerJob struct {
+	f        func()
+	queuedAt time.Time
+}
+
+type lagSample struct {
+	at  time.Time
+	lag time.Duration
+}
+
+// schedulerHealth is the load of the scheduler, used for admitting new payments.
+type schedulerHealth struct {
+	Workers    int
+	QueueDepth int
+	// Median wait of jobs between being queued and started, including the ones still waiting.
+	MedianLag time.Duration
+}
+
+// fairnessWindow is the number of served jobs after which served counts are halved,
+// so the ratio reflects recent history.
+const fairnessWindow = 1000
+
+// Job waits are kept for lagWindow, at most maxLagSamples of them, for calculating the median lag.
+const (
+	lagWindow     = time.Minute
+	maxLagSamples = 1000
+)
+
+var checks *checkScheduler
+
+func newCheckScheduler(workers int, priorityShare float64) *checkScheduler {
+	s := &checkScheduler{priorityShare: priorityShare, workers: workers}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// run queues f in the lane and blocks until it is finished.
+func (s *checkScheduler) run(lane int, f func()) {
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.queues[lane] = append(s.queues[lane], schedulerJob{f: func() {
+		defer close(done)
+		f()
+	}, queuedAt: clock.Now()})
+	s.mu.Unlock()
+	s.cond.Signal()
+	<-done
+}
+
+func (s *checkScheduler) work() {
+	for {
+		s.mu.Lock()
+		for len(s.queues[laneDefault]) == 0 && len(s.queues[lanePriority]) == 0 {
+			s.cond.Wait()
+		}
+		lane := s.next()
+		job := s.queues[lane][0]
+		s.queues[lane] = s.queues[lane][1:]
+		now := clock.Now()
+		s.lags = append(s.lags, lagSample{at: now, lag: now.Sub(job.queuedAt)})
+		if len(s.lags) > maxLagSamples {
+			s.lags = s.lags[len(s.lags)-maxLagSamples:]
+		}
+		s.served[lane]++
+		if s.served[laneDefault]+s.served[lanePriority] >= fairnessWindow {
+			s.served[laneDefault] /= 2
+			s.served[lanePriority] /= 2
+		}
+		s.mu.Unlock()
+		job.f()
+	}
+}
+
+// next returns the lane to take the next job from. Must be called with mu held.
+func (s *checkScheduler) next() int {
+	if len(s.queues[lanePriority]) == 0 {
+		return laneDefault
+	}
+	if len(s.queues[laneDefault]) == 0 {
+		return lanePriority
+	}
+	total := s.served[laneDefault] + s.served[lanePriority] + 1
+	if float64(s.served[lanePriority]) < s.priorityShare*float64(total) {
+		return lanePriority
+	}
+	return laneDefault
+}
+
+// health returns the queue depth and the median lag of jobs in lagWindow before now.
+func (s *checkScheduler) health(now time.Time) schedulerHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for i < len(s.lags) && now.Sub(s.lags[i].at) > lagWindow {
+		i++
+	}
+	s.lags = s.lags[i:]
+	h := schedulerHealth{Workers: s.workers}
+	lags := make([]time.Duration, 0, len(s.lags))
+	for _, l := range s.lags {
+		lags = append(lags, l.lag)
+	}
+	for _, q := range s.queues {
+		h.QueueDepth += len(q)
+		for _, job := range q {
+			lags = append(lags, now.Sub(job.queuedAt))
+		}
+	}
+	if len(lags) > 0 {
+		sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+		h.MedianLag = lags[len(lags)/2]
+	}
+	return h
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCheckSchedulerFairness(t *testing.T) {
+	s := newCheckScheduler(0, 0.75)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	const jobsPerLane = 400
+	for lane := 0; lane < numLanes; lane++ {
+		for i := 0; i < jobsPerLane; i++ {
+			wg.Add(1)
+			go func(lane int) {
+				defer wg.Done()
+				s.run(lane, func() {
+					mu.Lock()
+					order = append(order, lane)
+					mu.Unlock()
+				})
+			}(lane)
+		}
+	}
+	// Wait until all jobs are queued so the single worker is saturated from the start.
+	for {
+		s.mu.Lock()
+		n := len(s.queues[laneDefault]) + len(s.queues[lanePriority])
+		s.mu.Unlock()
+		if n == numLanes*jobsPerLane {
+			break
+		}
+	}
+	go s.work()
+	wg.Wait()
+
+	// While both lanes have jobs waiting, priority lane gets 75% of the slots.
+	const window = 400
+	var priority int
+	for _, lane := range order[:window] {
+		if lane == lanePriority {
+			priority++
+		}
+	}
+	if priority < window*70/100 || priority > window*80/100 {
+		t.Errorf("priority lane got %d of %d slots", priority, window)
+	}
+	// Default lane is not starved.
+	for i := 0; i < window; i += 10 {
+		var found bool
+		for _, lane := range order[i : i+10] {
+			if lane == laneDefault {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("default lane starved at %d", i)
+		}
+	}
+}
+
+func TestCheckSchedulerPriorityFirst(t *testing.T) {
+	s := newCheckScheduler(0, 0.5)
+	s.queues[laneDefault] = append(s.queues[laneDefault], schedulerJob{f: func() {}})
+	s.queues[lanePriority] = append(s.queues[lanePriority], schedulerJob{f: func() {}})
+	if lane := s.next(); lane != lanePriority {
+		t.Errorf("expected priority lane, got %d", lane)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/cenkalti/log"
+)
+
+const seedLength = 64
+
+// Shannon entropy of hex digits in a random seed is close to 4 bits.
+// Seeds below this are clearly not random.
+const minSeedEntropy = 3.0
+
+// knownWeakSeeds are seeds published in documentation and examples.
+var knownWeakSeeds = map[string]struct{}{
+	// Example in README.
+	"12F36345AB0B10557F22B36B5FF241EF09AF7AEA00A40B3F52CCD34640040E92": {},
+}
+
+var errWeakSeed = errors.New("seed is not random")
+
+// validateSeed checks the format of the seed and returns errWeakSeed if it looks generated by hand.
+func validateSeed(seed string) error {
+	if len(seed) != seedLength {
+		return fmt.Errorf("seed must be %d hex characters", seedLength)
+	}
+	if _, err := hex.DecodeString(seed); err != nil {
+		return errors.New("seed must be hex encoded")
+	}
+	s := strings.ToUpper(seed)
+	if _, ok := knownWeakSeeds[s]; ok {
+		return fmt.Errorf("%w: seed is published in examples", errWeakSeed)
+	}
+	if hasShortPeriod(s) {
+		return fmt.Errorf("%w: seed is a repeated pattern", errWeakSeed)
+	}
+	if isSequential(s) {
+		return fmt.Errorf("%w: seed is a sequence", errWeakSeed)
+	}
+	if e := hexEntropy(s); e < minSeedEntropy {
+		return fmt.Errorf("%w: low entropy (%.2f bits per character)", errWeakSeed, e)
+	}
+	return nil
+}
+
+// checkSeed validates config.Seed and the seeds of Merchants at startup. Weak seeds are allowed only with AllowWeakSeed.
+func (c *Config) checkSeed() error {
+	err := c.checkWeakSeed(c.Seed)
+	if err != nil {
+		return err
+	}
+	for id, m := range c.Merchants {
+		if m.Seed == "" {
+			continue
+		}
+		if err = c.checkWeakSeed(m.Seed); err != nil {
+			return fmt.Errorf("invalid Seed of merchant %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) checkWeakSeed(seed string) error {
+	err := validateSeed(seed)
+	if errors.Is(err, errWeakSeed) && c.AllowWeakSeed {
+		log.Warningf("USING A WEAK SEED BECAUSE AllowWeakSeed IS SET: %s. "+
+			"Funds on payment accounts can be stolen by anyone who guesses the seed. Never use this seed in production!", err)
+		return nil
+	}
+	return err
+}
+
+// hasShortPeriod returns true if s consists of a repeated substring up to 16 characters, e.g. "ABCDABCD...".
+func hasShortPeriod(s string) bool {
+	for p := 1; p <= 16; p++ {
+		repeated := true
+		for i := p; i < len(s); i++ {
+			if s[i] != s[i-p] {
+				repeated = false
+				break
+			}
+		}
+		if repeated {
+			return true
+		}
+	}
+	return false
+}
+
+// isSequential returns true if hex digits increase or decrease by a constant step, e.g. "0123456789ABCDEF0123...".
+func isSequential(s string) bool {
+	digit := func(i int) int {
+		b, _ := hex.DecodeString("0" + s[i:i+1])
+		return int(b[0])
+	}
+	step := (digit(1) - digit(0) + 16) % 16
+	for i := 2; i < len(s); i++ {
+		if (digit(i)-digit(i-1)+16)%16 != step {
+			return false
+		}
+	}
+	return true
+}
+
+// hexEntropy returns the Shannon entropy of hex digits in s in bits.
+func hexEntropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var e float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(s))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateSeed(t *testing.T) {
+	cases := []struct {
+		seed string
+		weak bool
+	}{
+		{strings.Repeat("0", 64), true},
+		{strings.Repeat("F", 64), true},
+		{strings.Repeat("AB", 32), true},
+		{strings.Repeat("ABCD", 16), true},
+		{strings.Repeat("DEADBEEF", 8), true},
+		{strings.Repeat("0123456789ABCDEF", 4), true},
+		{strings.Repeat("FEDCBA9876543210", 4), true},
+		{strings.Repeat("02468ACE", 8), true},
+		{strings.Repeat("0", 63) + "1", true},
+		{strings.Repeat("0", 32) + strings.Repeat("1", 32), true},
+		{"12F36345AB0B10557F22B36B5FF241EF09AF7AEA00A40B3F52CCD34640040E92", true},
+		{"12f36345ab0b10557f22b36b5ff241ef09af7aea00a40b3f52ccd34640040e92", true},
+		{"9C4B1F0E7A2D8B3365F1C0A94E7D2B18F6A3C5E0D9B7142A8F3E6C1D0B5A7924", false},
+	}
+	for _, c := range cases {
+		err := validateSeed(c.seed)
+		if c.weak != errors.Is(err, errWeakSeed) {
+			t.Errorf("%s: weak=%v, got %v", c.seed, c.weak, err)
+		}
+	}
+	for _, seed := range []string{"", "seed", strings.Repeat("G", 64), strings.Repeat("A", 66)} {
+		if err := validateSeed(seed); err == nil || errors.Is(err, errWeakSeed) {
+			t.Errorf("%q: expected format error, got %v", seed, err)
+		}
+	}
+}
+
+func TestAllowWeakSeed(t *testing.T) {
+	c := Config{Seed: strings.Repeat("0", 64)}
+	if err := c.checkSeed(); err == nil {
+		t.Fatal("weak seed is accepted")
+	}
+	c.AllowWeakSeed = true
+	if err := c.checkSeed(); err != nil {
+		t.Fatal(err)
+	}
+	c.Seed = "seed"
+	if err := c.checkSeed(); err == nil {
+		t.Fatal("AllowWeakSeed must not allow invalid seeds")
+	}
+}
+
+func TestNewSeedIsValid(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		seed, err := NewSeed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateSeed(seed); err != nil {
+			t.Fatalf("generated seed %s is rejected: %s", seed, err)
+		}
+	}
+}
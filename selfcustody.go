@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Self-custody merchants set SweepEnabled to false and sweep the payment accounts with their own tooling.
+// Payments are verified, merchants are notified and funds are received as usual but nothing is ever sent
+// from payment accounts. /admin/balances lists the accounts holding funds for the external sweeper.
+
+const (
+	exposureCheckInterval = time.Minute
+	maxBalancesPageSize   = 1000
+)
+
+var errSweepDisabled = errors.New("sweeping is disabled")
+
+// sweepEnabled returns false if funds must be left on payment accounts.
+func (c *Config) sweepEnabled() bool {
+	return c.SweepEnabled == nil || *c.SweepEnabled
+}
+
+// AccountBalance is a payment account holding funds, returned from balances endpoint.
+type AccountBalance struct {
+	Account string `json:"account"`
+	Index   string `json:"index"`
+	// In NANO, from our records.
+	Balance    decimal.Decimal `json:"balance"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+	// Set when reconciled against the node.
+	NodeBalance *decimal.Decimal `json:"nodeBalance,omitempty"`
+	Mismatch    bool             `json:"mismatch,omitempty"`
+	// Error from the node if balance cannot be reconciled.
+	Error string `json:"error,omitempty"`
+}
+
+// held returns true if funds of the payment are received to its account and not sent to the merchant.
+func (p *Payment) held() bool {
+	return p.ReceivedAt != nil && p.SentAt == nil && !p.Balance.IsZero() && !p.Sandbox
+}
+
+// handleAdminBalances lists payment accounts holding funds in pages ordered by account.
+// Pass the returned next value as after to get the next page.
+// Balances are compared with the node when reconcile is true.
+func handleAdminBalances(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxBalancesPageSize {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	balances, next, err := heldBalances(r.FormValue("after"), limit)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("reconcile") == "true" {
+		for i := range balances {
+			reconcileBalance(&balances[i])
+		}
+	}
+	writeAdminJSON(w, map[string]interface{}{"balances": balances, "next": next})
+}
+
+// heldBalances returns up to limit accounts after the given account.
+// Next is the last returned account if there may be more.
+func heldBalances(after string, limit int) (balances []AccountBalance, next string, err error) {
+	balances = make([]AccountBalance, 0)
+	held := func(p *Payment) bool { return p.held() }
+	payments, err := store.List(PaymentFilter{After: after, Match: held, Limit: limit + 1})
+	if err != nil {
+		return
+	}
+	for _, p := range payments {
+		if len(balances) == limit {
+			next = balances[len(balances)-1].Account
+			return
+		}
+		balances = append(balances, AccountBalance{
+			Account:    p.Account,
+			Index:      p.Index,
+			Balance:    RawToNano(p.Balance),
+			ReceivedAt: p.ReceivedAt,
+		})
+	}
+	return
+}
+
+func reconcileBalance(b *AccountBalance) {
+	info, err := node.AccountInfo(b.Account)
+	if err != nil {
+		b.Error = err.Error()
+		return
+	}
+	raw, err := parseRaw(info.Balance)
+	if err != nil {
+		b.Error = err.Error()
+		return
+	}
+	balance := RawToNano(raw)
+	b.NodeBalance = &balance
+	b.Mismatch = !balance.Equal(b.Balance)
+}
+
+// exposureMonitor alerts when the funds held on payment accounts are above ExposureAlertThreshold.
+// New payments are refused while the threshold is exceeded if funds are swept.
+// Sweeping is the merchant's job in self-custody mode, so there only the alert is sent.
+type exposureMonitor struct {
+	m        sync.Mutex
+	exceeded bool
+}
+
+var exposure = &exposureMonitor{}
+
+// refusePayments returns true if new payments must not be created.
+func (e *exposureMonitor) refusePayments() bool {
+	if !config.sweepEnabled() {
+		return false
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.exceeded
+}
+
+// check sums the held funds and updates the state.
+func (e *exposureMonitor) check() error {
+	if config.ExposureAlertThreshold == "" {
+		return nil
+	}
+	threshold, err := decimal.NewFromString(config.ExposureAlertThreshold)
+	if err != nil {
+		return err
+	}
+	var total decimal.Decimal
+	err = forEachPayment(func(p *Payment) error {
+		if p.held() {
+			total = total.Add(p.Balance)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	exceeded := total.GreaterThan(NanoToRaw(threshold))
+	e.m.Lock()
+	changed := exceeded != e.exceeded
+	e.exceeded = exceeded
+	e.m.Unlock()
+	if !changed {
+		return nil
+	}
+	details := map[string]interface{}{"total": RawToNano(total), "threshold": threshold, "enforced": config.sweepEnabled()}
+	switch {
+	case exceeded && config.sweepEnabled():
+		sendAlert("exposure", "funds held on payment accounts are above threshold, new payments are refused", details)
+	case exceeded:
+		sendAlert("exposure", "funds held on payment accounts are above threshold", details)
+	default:
+		sendAlert("exposure_resolved", "funds held on payment accounts are below threshold", details)
+	}
+	return nil
+}
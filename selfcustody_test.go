@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestSweepDisabled(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	disabled := false
+	config.SweepEnabled = &disabled
+	config.Account = "nano_1merchant"
+	t.Cleanup(func() { config.SweepEnabled, config.Account = nil, "" })
+	amount := NanoToRaw(decimal.NewFromInt(2))
+	var mu sync.Mutex
+	var actions []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action  string `json:"action"`
+			Account string `json:"account"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		actions = append(actions, req.Action)
+		mu.Unlock()
+		if req.Action == "account_info" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"frontier": "F", "balance": amount.String(), "block_count": "1"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "unexpected action"})
+	}))
+	t.Cleanup(ts.Close)
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+
+	held := &Payment{Account: "nano_1held", Index: "1", Amount: amount, Balance: amount, CreatedAt: clock.Now(),
+		FulfilledAt: now(), NotifiedAt: now(), ReceivedAt: now(), SubPayments: map[string]SubPayment{"HASH": {Account: "nano_1customer", Amount: amount}}}
+	if err := held.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := held.process(); err != nil || held.SentAt != nil || !held.finished() {
+		t.Fatalf("received payment is swept: %v", err)
+	}
+	if w := postAdminForm(handleAdminSendToMerchant, url.Values{"account": {held.Account}}); w.Code != http.StatusConflict {
+		t.Errorf("admin send is allowed: %d", w.Code)
+	}
+	if err := startRecoverScan(10, config.Account); err != errSweepDisabled {
+		t.Errorf("recover sweep is allowed: %v", err)
+	}
+	if _, err := sendAll(noopLease{}, held.Account, config.Account, "PRIV"); err != errSweepDisabled {
+		t.Errorf("send is allowed: %v", err)
+	}
+	if _, err := sendAmount(noopLease{}, held.Account, config.Account, "PRIV", decimal.NewFromInt(1)); err != errSweepDisabled {
+		t.Errorf("send is allowed: %v", err)
+	}
+	mu.Lock()
+	if len(actions) != 0 {
+		t.Errorf("node is called: %v", actions)
+	}
+	mu.Unlock()
+
+	// Held funds are listed and reconciled against the node.
+	pending := &Payment{Account: "nano_1pending", Index: "2", Amount: decimal.NewFromInt(5), FulfilledAt: now()}
+	if err := pending.Save(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleAdminBalances(w, httptest.NewRequest(http.MethodGet, "/admin/balances?reconcile=true", nil))
+	var page struct {
+		Balances []AccountBalance `json:"balances"`
+		Next     string           `json:"next"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("invalid balances: %s", w.Body)
+	}
+	if len(page.Balances) != 1 || page.Balances[0].Account != held.Account || page.Next != "" {
+		t.Fatalf("unexpected balances: %s", w.Body)
+	}
+	if b := page.Balances[0]; b.NodeBalance == nil || b.Mismatch {
+		t.Errorf("balance is not reconciled: %+v", b)
+	}
+	mu.Lock()
+	for _, action := range actions {
+		if action != "account_info" {
+			t.Errorf("unexpected node call in self-custody mode: %s", action)
+		}
+	}
+	mu.Unlock()
+
+	// Exposure alert does not refuse payments in self-custody mode.
+	config.ExposureAlertThreshold = "0"
+	t.Cleanup(func() { config.ExposureAlertThreshold = "" })
+	if err := exposure.check(); err != nil {
+		t.Fatal(err)
+	}
+	if !exposure.exceeded || exposure.refusePayments() {
+		t.Error("exposure is enforced in self-custody mode")
+	}
+	config.SweepEnabled = nil
+	if !exposure.refusePayments() {
+		t.Error("exposure is not enforced")
+	}
+	exposure.exceeded = false
+}
+
+func TestHeldBalancesPages(t *testing.T) {
+	openTestDB(t, 0)
+	for _, account := range []string{"nano_1a", "nano_1b", "nano_1c"} {
+		p := &Payment{Account: account, Balance: decimal.NewFromInt(1), ReceivedAt: now()}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var accounts []string
+	after := ""
+	for i := 0; i < 3; i++ {
+		page, next, err := heldBalances(after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range page {
+			accounts = append(accounts, b.Account)
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if len(accounts) != 3 || accounts[2] != "nano_1c" {
+		t.Fatalf("unexpected pages: %v", accounts)
+	}
+}
@@ -1,36 +1,71 @@
 package main
 
 import (
+	"errors"
+
 	"github.com/tundak/accept-nano/nano"
 	"github.com/cenkalti/log"
 	"github.com/shopspring/decimal"
 )
 
-func sendAll(account, destination, privateKey string) error {
+var errInsufficientBalance = errors.New("insufficient balance")
+
+// sendAll sends the whole balance of account to destination.
+// Returns an empty hash if there is nothing to send.
+func sendAll(lease Lease, account, destination, privateKey string) (string, error) {
+	if !config.sweepEnabled() {
+		return "", errSweepDisabled
+	}
 	log.Debugln("sending from", account)
-	info, err := node.AccountInfo(account)
+	if hash, err := resumePublish(lease, account, destination); hash != "" || err != nil {
+		return hash, err
+	}
+	info, err := checkerNode().AccountInfo(account)
 	if err != nil {
-		return err
+		return "", err
 	}
-	accountBalance, err := decimal.NewFromString(info.Balance)
+	accountBalance, err := parseRaw(info.Balance)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if accountBalance.IsZero() {
-		return nil
+		return "", nil
+	}
+	return sendBlock(lease, info, account, destination, privateKey, decimal.Zero)
+}
+
+// sendAmount sends amount (in raw) from account to destination.
+func sendAmount(lease Lease, account, destination, privateKey string, amount decimal.Decimal) (string, error) {
+	if !config.sweepEnabled() {
+		return "", errSweepDisabled
 	}
-	work, err := nano.GenerateWork(info.Frontier, true)
+	log.Debugln("sending", amount, "raw from", account)
+	if hash, err := resumePublish(lease, account, destination); hash != "" || err != nil {
+		return hash, err
+	}
+	info, err := checkerNode().AccountInfo(account)
+	if err != nil {
+		return "", err
+	}
+	accountBalance, err := parseRaw(info.Balance)
 	if err != nil {
-		return err
+		return "", err
 	}
-	block, err := node.BlockCreate(info.Frontier, account, config.Representative, "0", destination, privateKey, work)
+	if accountBalance.LessThan(amount) {
+		return "", errInsufficientBalance
+	}
+	return sendBlock(lease, info, account, destination, privateKey, accountBalance.Sub(amount))
+}
+
+func sendBlock(lease Lease, info *nano.AccountInfo, account, destination, privateKey string, newBalance decimal.Decimal) (string, error) {
+	work, err := generateWork(info.Frontier, true)
 	if err != nil {
-		return err
+		return "", err
 	}
-	hash, err := node.Process(block)
+	hash, err := createAndPublish(lease, info.Frontier, account, newBalance.String(), destination, privateKey, work)
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Debugln("published new block:", hash)
-	return nil
+	return hash, nil
 }
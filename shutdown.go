@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// At shutdown check loops are stopped after their running check, so a receive started by a check is followed
+// by the sweep in the same check. Checks that do not complete in the grace period are cancelled and the step
+// they are in is resumed at the next startup, because verified payments are not finished until their funds are moved.
+
+// stopping returns true after the shutdown is started.
+func stopping() bool {
+	select {
+	case <-stopCheckPayments:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitChecks waits for the check loops to return. If they do not return in grace, running checks are cancelled
+// and it waits for them up to grace again. It returns false if checks are cancelled.
+func waitChecks(grace time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		checkPaymentWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+	}
+	accounts := cancelRunningChecks()
+	log.Warningf("cancelled %d payment checks still running after %s: %v", len(accounts), grace, accounts)
+	select {
+	case <-done:
+	case <-time.After(grace):
+		log.Errorln("check loops did not return after cancel")
+	}
+	return false
+}
+
+// cancelRunningChecks cancels the checks that are running and returns their accounts.
+func cancelRunningChecks() []string {
+	checkingMu.Lock()
+	defer checkingMu.Unlock()
+	var accounts []string
+	for account, s := range checkingPayments {
+		if s.cancel != nil {
+			s.cancel()
+			s.cancelled = true
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Strings(accounts)
+	return accounts
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFinishedAfterInterruptedSweep(t *testing.T) {
+	config.setDefaults()
+	c := useFakeClock(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := Payment{CreatedAt: c.Now(), FulfilledAt: now(), NotifiedAt: now()}
+	c.Add(p.allowedDuration() + time.Second)
+	if p.finished() {
+		t.Error("expired payment is finished before its funds are received")
+	}
+	p.ReceivedAt = now()
+	if p.finished() {
+		t.Error("expired payment is finished before its funds are sent to merchant")
+	}
+	p.SentAt = now()
+	if p.finished() {
+		t.Error("sent payment is finished before the final notification")
+	}
+	p.FinalNotifiedAt = now()
+	if !p.finished() {
+		t.Error("sent payment is not finished")
+	}
+	if unverified := (Payment{CreatedAt: p.CreatedAt}); !unverified.finished() {
+		t.Error("expired unverified payment is not finished")
+	}
+}
+
+func TestWaitChecksCancelsRunningChecks(t *testing.T) {
+	const account = "nano_1shutdown"
+	ctx, cancel := context.WithCancel(context.Background())
+	checkingMu.Lock()
+	checkingPayments[account] = &checkerState{cancel: cancel}
+	checkingMu.Unlock()
+	t.Cleanup(func() {
+		checkingMu.Lock()
+		delete(checkingPayments, account)
+		checkingMu.Unlock()
+	})
+	checkPaymentWG.Add(1)
+	go func() {
+		defer checkPaymentWG.Done()
+		<-ctx.Done()
+	}()
+	if waitChecks(10 * time.Millisecond) {
+		t.Error("running check is not reported")
+	}
+	if ctx.Err() == nil {
+		t.Error("running check is not cancelled")
+	}
+}
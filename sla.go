@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	slaAlertNoVerification   = "no_verification"
+	slaAlertSlowVerification = "slow_verification"
+	slaAlertNodeUnreachable  = "node_unreachable"
+
+	slaLatencyWindow = time.Hour
+)
+
+// SLAAlert is an alert raised by the SLA evaluator.
+type SLAAlert struct {
+	Name    string    `json:"name"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+	// Set when the condition is not met anymore.
+	// Alert is resolved after condition stays clear for SLAAlertRecoveryTime.
+	ClearSince *time.Time `json:"clearSince,omitempty"`
+}
+
+type verificationSample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// slaEvaluator keeps recent payment milestones in memory and evaluates the SLA conditions on them.
+type slaEvaluator struct {
+	now         func() time.Time
+	nodeContact func() (success, failure time.Time)
+	notify      func(kind, message string, details map[string]interface{})
+
+	m             sync.Mutex
+	created       []time.Time
+	verifications []verificationSample
+	alerts        map[string]*SLAAlert
+}
+
+var slaAlerts = &slaEvaluator{
+	now:         clockNow,
+	nodeContact: func() (time.Time, time.Time) { return node.LastContact() },
+	notify:      sendAlert,
+}
+
+func (e *slaEvaluator) recordCreated(t time.Time) {
+	e.m.Lock()
+	e.created = append(e.created, t)
+	e.m.Unlock()
+}
+
+func (e *slaEvaluator) recordVerified(createdAt, verifiedAt time.Time) {
+	e.m.Lock()
+	e.verifications = append(e.verifications, verificationSample{at: verifiedAt, latency: verifiedAt.Sub(createdAt)})
+	e.m.Unlock()
+}
+
+// Alerts returns currently active alerts.
+func (e *slaEvaluator) Alerts() []SLAAlert {
+	e.m.Lock()
+	defer e.m.Unlock()
+	ret := make([]SLAAlert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		ret = append(ret, *a)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// evaluate checks all conditions and fires or resolves alerts.
+func (e *slaEvaluator) evaluate() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	now := e.now()
+	e.prune(now)
+	e.evaluateNoVerification(now)
+	e.evaluateLatency(now)
+	e.evaluateNode(now)
+}
+
+// prune removes samples older than the largest window.
+func (e *slaEvaluator) prune(now time.Time) {
+	window := time.Duration(config.SLANoVerificationMinutes) * time.Minute
+	if window < slaLatencyWindow {
+		window = slaLatencyWindow
+	}
+	cutoff := now.Add(-window)
+	i := sort.Search(len(e.created), func(i int) bool { return e.created[i].After(cutoff) })
+	e.created = e.created[i:]
+	i = sort.Search(len(e.verifications), func(i int) bool { return e.verifications[i].at.After(cutoff) })
+	e.verifications = e.verifications[i:]
+}
+
+func (e *slaEvaluator) evaluateNoVerification(now time.Time) {
+	if config.SLANoVerificationMinutes <= 0 {
+		return
+	}
+	cutoff := now.Add(-time.Duration(config.SLANoVerificationMinutes) * time.Minute)
+	var created, verified int
+	for _, t := range e.created {
+		if t.After(cutoff) {
+			created++
+		}
+	}
+	for _, v := range e.verifications {
+		if v.at.After(cutoff) {
+			verified++
+		}
+	}
+	e.set(now, slaAlertNoVerification, verified == 0 && created >= config.SLANoVerificationMinCreated,
+		"no payment is verified recently, checking might be broken",
+		map[string]interface{}{"created": created, "minutes": config.SLANoVerificationMinutes})
+}
+
+func (e *slaEvaluator) evaluateLatency(now time.Time) {
+	if config.SLAMaxMedianLatency <= 0 {
+		return
+	}
+	cutoff := now.Add(-slaLatencyWindow)
+	latencies := make([]time.Duration, 0, len(e.verifications))
+	for _, v := range e.verifications {
+		if v.at.After(cutoff) {
+			latencies = append(latencies, v.latency)
+		}
+	}
+	var median time.Duration
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		median = latencies[len(latencies)/2]
+	}
+	limit := time.Duration(config.SLAMaxMedianLatency) * time.Second
+	e.set(now, slaAlertSlowVerification, median > limit,
+		"median verification latency is too high",
+		map[string]interface{}{"median": median.String(), "limit": limit.String(), "samples": len(latencies)})
+}
+
+func (e *slaEvaluator) evaluateNode(now time.Time) {
+	if config.SLANodeUnreachableSeconds <= 0 {
+		return
+	}
+	success, failure := e.nodeContact()
+	limit := time.Duration(config.SLANodeUnreachableSeconds) * time.Second
+	unreachable := failure.After(success) && now.Sub(success) > limit
+	e.set(now, slaAlertNodeUnreachable, unreachable,
+		"node is unreachable",
+		map[string]interface{}{"lastSuccess": success, "lastFailure": failure})
+}
+
+// set updates the state of the named alert with hysteresis.
+// Alert fires immediately when condition is met and gets resolved
+// when the condition stays clear for SLAAlertRecoveryTime.
+func (e *slaEvaluator) set(now time.Time, name string, condition bool, message string, details map[string]interface{}) {
+	if e.alerts == nil {
+		e.alerts = make(map[string]*SLAAlert)
+	}
+	a, active := e.alerts[name]
+	switch {
+	case condition && !active:
+		e.alerts[name] = &SLAAlert{Name: name, Message: message, Since: now}
+		e.notify("sla_"+name, message, details)
+	case condition && active:
+		a.ClearSince = nil
+	case !condition && active:
+		if a.ClearSince == nil {
+			a.ClearSince = &now
+		}
+		if now.Sub(*a.ClearSince) >= time.Duration(config.SLAAlertRecoveryTime)*time.Second {
+			delete(e.alerts, name)
+			e.notify("sla_"+name+"_resolved", "resolved: "+message, details)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// nodeContact holds the last contact times returned to slaEvaluator.
+type nodeContact struct {
+	success, failure time.Time
+}
+
+func newTestSLAEvaluator(t *testing.T, notified *[]string) (*slaEvaluator, *fakeClock, *nodeContact) {
+	c := useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	config.SLANoVerificationMinutes = 30
+	config.SLANoVerificationMinCreated = 3
+	config.SLAAlertRecoveryTime = 300
+	t.Cleanup(func() {
+		config.SLANoVerificationMinutes, config.SLAMaxMedianLatency, config.SLANodeUnreachableSeconds = 0, 0, 0
+	})
+	contact := &nodeContact{success: c.Now()}
+	e := &slaEvaluator{
+		now:         clockNow,
+		nodeContact: func() (time.Time, time.Time) { return contact.success, contact.failure },
+		notify:      func(kind, message string, details map[string]interface{}) { *notified = append(*notified, kind) },
+	}
+	return e, c, contact
+}
+
+func alertNames(e *slaEvaluator) []string {
+	ret := []string{}
+	for _, a := range e.Alerts() {
+		ret = append(ret, a.Name)
+	}
+	return ret
+}
+
+func TestSLANoVerification(t *testing.T) {
+	var notified []string
+	e, c, _ := newTestSLAEvaluator(t, &notified)
+	for i := 0; i < 3; i++ {
+		e.recordCreated(c.Now())
+		c.Add(time.Minute)
+	}
+	e.evaluate()
+	if !reflect.DeepEqual(notified, []string{"sla_no_verification"}) {
+		t.Fatalf("alert is not fired: %v", notified)
+	}
+	e.evaluate()
+	if len(notified) != 1 {
+		t.Fatalf("alert is fired again: %v", notified)
+	}
+
+	// Condition clears but alert stays until recovery time passes.
+	e.recordVerified(c.Now().Add(-10*time.Second), c.Now())
+	e.evaluate()
+	a := e.Alerts()
+	if len(a) != 1 || a[0].ClearSince == nil {
+		t.Fatalf("alert is not clearing: %+v", a)
+	}
+	c.Add(4 * time.Minute)
+	e.evaluate()
+	if len(e.Alerts()) != 1 {
+		t.Fatal("alert is resolved before recovery time")
+	}
+	c.Add(time.Minute)
+	e.evaluate()
+	if len(e.Alerts()) != 0 || !reflect.DeepEqual(notified, []string{"sla_no_verification", "sla_no_verification_resolved"}) {
+		t.Fatalf("alert is not resolved: %v", notified)
+	}
+}
+
+func TestSLAHysteresis(t *testing.T) {
+	var notified []string
+	e, c, _ := newTestSLAEvaluator(t, &notified)
+	config.SLAMaxMedianLatency = 60
+	verify := func(latency time.Duration) {
+		e.recordVerified(c.Now().Add(-latency), c.Now())
+		e.evaluate()
+		c.Add(time.Minute)
+	}
+	verify(2 * time.Minute)
+	verify(time.Second)
+	verify(time.Second)
+	if a := e.Alerts(); len(a) != 1 || a[0].ClearSince == nil {
+		t.Fatalf("alert is not clearing: %+v", a)
+	}
+	// Condition comes back before recovery time, so the alert does not flap.
+	verify(2 * time.Minute)
+	verify(2 * time.Minute)
+	a := e.Alerts()
+	if len(a) != 1 || a[0].ClearSince != nil || !reflect.DeepEqual(notified, []string{"sla_slow_verification"}) {
+		t.Fatalf("alert flaps: %v %+v", notified, a)
+	}
+}
+
+func TestSLALatencyAndNode(t *testing.T) {
+	var notified []string
+	e, c, contact := newTestSLAEvaluator(t, &notified)
+	config.SLAMaxMedianLatency = 60
+	config.SLANodeUnreachableSeconds = 120
+	contact.failure = c.Now().Add(time.Second)
+	for _, latency := range []time.Duration{10 * time.Second, 90 * time.Second, 2 * time.Minute} {
+		e.recordVerified(c.Now().Add(-latency), c.Now())
+	}
+	e.evaluate()
+	if !reflect.DeepEqual(alertNames(e), []string{slaAlertSlowVerification}) {
+		t.Fatalf("unexpected alerts: %v", alertNames(e))
+	}
+
+	c.Add(3 * time.Minute)
+	e.evaluate()
+	if !reflect.DeepEqual(alertNames(e), []string{slaAlertNodeUnreachable, slaAlertSlowVerification}) {
+		t.Fatalf("unexpected alerts: %v", alertNames(e))
+	}
+
+	// Old samples leave the window and node is reachable again.
+	c.Add(time.Hour)
+	contact.success = c.Now()
+	e.evaluate()
+	c.Add(5 * time.Minute)
+	e.evaluate()
+	if len(e.Alerts()) != 0 {
+		t.Fatalf("alerts are not resolved: %v", alertNames(e))
+	}
+	expected := []string{"sla_slow_verification", "sla_node_unreachable", "sla_slow_verification_resolved", "sla_node_unreachable_resolved"}
+	if !reflect.DeepEqual(notified, expected) {
+		t.Errorf("unexpected notifications: %v", notified)
+	}
+}
+
+func TestHealthSLAAlerts(t *testing.T) {
+	openTestDB(t, 0)
+	fakeKeyNode(t)
+	var notified []string
+	e, c, _ := newTestSLAEvaluator(t, &notified)
+	old := slaAlerts
+	slaAlerts = e
+	t.Cleanup(func() { slaAlerts = old })
+	for i := 0; i < 3; i++ {
+		e.recordCreated(c.Now())
+	}
+	e.evaluate()
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var h Health
+	if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.SLAAlerts) != 1 || h.SLAAlerts[0].Name != slaAlertNoVerification {
+		t.Fatalf("alerts are not in health: %s", w.Body)
+	}
+}
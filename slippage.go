@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// recordVerificationPrice saves the current price of currency on the payment to compare with the price at creation.
+// It runs in background so fetching the price never delays verification.
+func recordVerificationPrice(account, currency string) {
+	price, err := getNanoPrice(currency)
+	if err != nil {
+		log.Warningf("cannot get verification price for %s: %s", account, err)
+		return
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	p, err := LoadPayment([]byte(account))
+	if err != nil {
+		log.Errorln("cannot load payment:", err)
+		return
+	}
+	p.VerificationPrice = decimal.NullDecimal{Decimal: price, Valid: true}
+	if !p.Price.IsZero() {
+		slippage := price.Sub(p.Price).DivRound(p.Price, 8).Shift(2) // nolint: gomnd
+		p.PriceSlippagePercent = decimal.NullDecimal{Decimal: slippage, Valid: true}
+	}
+	err = p.Save()
+	if err != nil {
+		log.Errorln("cannot save payment:", err)
+	}
+}
+
+// fiatImpact returns the difference between value of received amount at verification time and the requested amount in currency.
+func (p Payment) fiatImpact() decimal.Decimal {
+	return RawToNano(p.Amount).Mul(p.VerificationPrice.Decimal).Sub(p.AmountInCurrency.Decimal)
+}
+
+// SlippageStats is the aggregated price change between payment creation and verification.
+type SlippageStats struct {
+	Count       int                        `json:"count"`
+	MeanPercent decimal.Decimal            `json:"meanPercent"`
+	P50Percent  decimal.Decimal            `json:"p50Percent"`
+	P90Percent  decimal.Decimal            `json:"p90Percent"`
+	P99Percent  decimal.Decimal            `json:"p99Percent"`
+	FiatImpact  map[string]decimal.Decimal `json:"fiatImpact"`
+	values      []decimal.Decimal
+}
+
+func newSlippageStats() *SlippageStats {
+	return &SlippageStats{FiatImpact: make(map[string]decimal.Decimal)}
+}
+
+func (s *SlippageStats) add(p *Payment) {
+	if !p.PriceSlippagePercent.Valid || !p.VerificationPrice.Valid {
+		return
+	}
+	s.values = append(s.values, p.PriceSlippagePercent.Decimal)
+	s.FiatImpact[p.Currency] = s.FiatImpact[p.Currency].Add(p.fiatImpact())
+}
+
+func (s *SlippageStats) finish() {
+	s.Count = len(s.values)
+	if s.Count == 0 {
+		return
+	}
+	sort.Slice(s.values, func(i, j int) bool { return s.values[i].LessThan(s.values[j]) })
+	s.MeanPercent = decimal.Sum(s.values[0], s.values[1:]...).DivRound(decimal.New(int64(s.Count), 0), 8) // nolint: gomnd
+	s.P50Percent = percentile(s.values, 50)                                                               // nolint: gomnd
+	s.P90Percent = percentile(s.values, 90)                                                               // nolint: gomnd
+	s.P99Percent = percentile(s.values, 99)                                                               // nolint: gomnd
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []decimal.Decimal, p int) decimal.Decimal {
+	i := (len(sorted)*p+99)/100 - 1 // nolint: gomnd
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
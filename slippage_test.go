@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestRecordVerificationPrice(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	_, fail := fakePriceSource(t)
+	save := func(account string) {
+		p := &Payment{Account: account, Currency: "USD", Price: decimal.RequireFromString("1.6"), Amount: NanoToRaw(decimal.NewFromInt(1)),
+			AmountInCurrency: CurrencyAmount{decimal.RequireFromString("1.6")}}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save("nano_1priced")
+	recordVerificationPrice("nano_1priced", "USD")
+	p, err := LoadPayment([]byte("nano_1priced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.VerificationPrice.Valid || !p.VerificationPrice.Decimal.Equal(decimal.NewFromInt(2)) {
+		t.Fatalf("verification price is not recorded: %+v", p.VerificationPrice)
+	}
+	if !p.PriceSlippagePercent.Decimal.Equal(decimal.NewFromInt(25)) || !p.fiatImpact().Equal(decimal.RequireFromString("0.4")) {
+		t.Errorf("unexpected slippage: %s, impact %s", p.PriceSlippagePercent.Decimal, p.fiatImpact())
+	}
+
+	// Price cannot be fetched, so nothing is recorded and the payment is left as is.
+	*fail = true
+	prices = make(map[string]PriceWithTimestamp)
+	save("nano_1unpriced")
+	recordVerificationPrice("nano_1unpriced", "USD")
+	p, err = LoadPayment([]byte("nano_1unpriced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.VerificationPrice.Valid || p.PriceSlippagePercent.Valid {
+		t.Fatalf("price is recorded: %+v", p)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"verificationPrice":null`) || !strings.Contains(string(b), `"priceSlippagePercent":null`) {
+		t.Errorf("missing price is not null: %s", b)
+	}
+
+	stats := newSlippageStats()
+	stats.add(p)
+	stats.finish()
+	if stats.Count != 0 {
+		t.Error("payment without verification price is counted")
+	}
+}
+
+func TestSlippageStats(t *testing.T) {
+	stats := newSlippageStats()
+	for i := 10; i >= 1; i-- {
+		stats.add(&Payment{
+			Currency:             "USD",
+			Amount:               NanoToRaw(decimal.NewFromInt(1)),
+			AmountInCurrency:     CurrencyAmount{decimal.NewFromInt(1)},
+			VerificationPrice:    decimal.NullDecimal{Decimal: decimal.RequireFromString("1.1"), Valid: true},
+			PriceSlippagePercent: decimal.NullDecimal{Decimal: decimal.NewFromInt(int64(i)), Valid: true},
+		})
+	}
+	stats.finish()
+	expected := map[string]decimal.Decimal{
+		"mean": decimal.RequireFromString("5.5"),
+		"p50":  decimal.NewFromInt(5),
+		"p90":  decimal.NewFromInt(9),
+		"p99":  decimal.NewFromInt(10),
+		"fiat": decimal.NewFromInt(1),
+	}
+	got := map[string]decimal.Decimal{"mean": stats.MeanPercent, "p50": stats.P50Percent, "p90": stats.P90Percent, "p99": stats.P99Percent, "fiat": stats.FiatImpact["USD"]}
+	for name, value := range expected {
+		if !got[name].Equal(value) {
+			t.Errorf("%s is %s, expected %s", name, got[name], value)
+		}
+	}
+
+	// Nearest rank of a single value is the value itself.
+	one := []decimal.Decimal{decimal.NewFromInt(-3)}
+	for _, p := range []int{1, 50, 99} {
+		if !percentile(one, p).Equal(one[0]) {
+			t.Errorf("p%d of single value is %s", p, percentile(one, p))
+		}
+	}
+}
+
+func TestVerificationDoesNotWaitForPrice(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	config.setDefaults()
+	fakePriceSource(t)
+	release := make(chan struct{})
+	fetchPrice = func(currency string) (decimal.Decimal, string, error) {
+		<-release
+		return decimal.NewFromInt(2), "test", nil
+	}
+	amount := NanoToRaw(decimal.NewFromInt(1))
+	p := &Payment{Account: "nano_1slow", Currency: "USD", Price: decimal.RequireFromString("1.6"), Amount: amount, CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ledger.send("nano_1customer", p.Account, amount)
+
+	done := make(chan error, 1)
+	go func() { done <- p.runStep(stepCheckPending) }()
+	select {
+	case err := <-done:
+		if err != nil || p.FulfilledAt == nil {
+			t.Fatalf("payment is not verified: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("verification waits for price")
+	}
+	close(release)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		p2, err := LoadPayment([]byte(p.Account))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p2.VerificationPrice.Valid {
+			return
+		}
+	}
+	t.Error("verification price is not recorded")
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqlStore keeps payments in a Postgres or SQLite database selected with DatabaseURL.
+// Payments are saved as JSON in the data column. The other columns are for querying and are updated on every save.
+// Saves compare the revision of the record, so an instance saving a stale copy gets errRevisionConflict
+// instead of overwriting the changes of another instance.
+// Key indexes are allocated in key_indexes table, so instances sharing the database never use the same index.
+// Indexes of merchants with their own seed are kept as "namespace/index".
+type sqlStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// sqlMigrations are run in order at startup. Applied versions are recorded in schema_migrations table.
+// Do not change an applied migration, add a new one instead.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE payments (
+			account TEXT PRIMARY KEY,
+			payment_id TEXT NOT NULL,
+			key_index TEXT NOT NULL,
+			state TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			active INTEGER NOT NULL,
+			revision BIGINT NOT NULL,
+			data TEXT NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX payments_payment_id ON payments (payment_id) WHERE payment_id <> ''`,
+		`CREATE INDEX payments_state ON payments (state, created_at)`,
+		`CREATE INDEX payments_active ON payments (active)`,
+		`CREATE TABLE payment_tags (
+			tag TEXT NOT NULL,
+			account TEXT NOT NULL,
+			PRIMARY KEY (tag, account)
+		)`,
+		`CREATE TABLE key_indexes (key_index TEXT PRIMARY KEY)`,
+		`CREATE TABLE instances (
+			instance_id TEXT PRIMARY KEY,
+			heartbeat_at BIGINT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE idempotency_keys (
+			scope TEXT PRIMARY KEY,
+			account TEXT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE TABLE elided_blocks (
+			account TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			PRIMARY KEY (account, prefix)
+		)`,
+		`CREATE TABLE integrity_mismatches (account TEXT PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE publishing (account TEXT PRIMARY KEY, data TEXT NOT NULL)`,
+	},
+}
+
+var errRevisionConflict = errors.New("payment is changed by another instance")
+
+// Key of the Postgres advisory lock held while running migrations.
+const sqlMigrationsLock = 7337
+
+// sqlDataSource returns the driver and data source name for url: "postgres://..." or "sqlite:<path>".
+func sqlDataSource(url string) (driver, dsn string, err error) {
+	switch {
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return "postgres", url, nil
+	case strings.HasPrefix(url, "sqlite:"):
+		path := strings.TrimPrefix(strings.TrimPrefix(url, "sqlite:"), "//")
+		// Write transactions take the lock at start, so a read followed by a write in a transaction does not fail.
+		return "sqlite3", "file:" + path + "?_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL", nil
+	default:
+		return "", "", errors.New("DatabaseURL must start with postgres:// or sqlite:")
+	}
+}
+
+// openSQLStore connects to the database at url and runs the pending migrations.
+func openSQLStore(url string) (*sqlStore, error) {
+	driver, dsn, err := sqlDataSource(url)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugln("opening", driver, "payment store")
+	s := &sqlStore{postgres: driver == "postgres"}
+	s.db, err = sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.migrate(); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// rebind replaces ? placeholders with $n for Postgres.
+func (s *sqlStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Exec(s.rebind(query), args...)
+}
+
+// withTx runs fn in a transaction and commits it if fn returns nil.
+func (s *sqlStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	return s.withTx(func(tx *sql.Tx) error {
+		if s.postgres {
+			// Instances starting at the same time run migrations one by one.
+			if _, err := s.exec(tx, `SELECT pg_advisory_xact_lock(?)`, sqlMigrationsLock); err != nil {
+				return err
+			}
+		}
+		var version int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+			return err
+		}
+		for ; version < len(sqlMigrations); version++ {
+			for _, stmt := range sqlMigrations[version] {
+				if _, err := tx.Exec(stmt); err != nil {
+					return fmt.Errorf("migration %d: %w", version+1, err)
+				}
+			}
+			_, err := s.exec(tx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version+1, clock.Now().Unix())
+			if err != nil {
+				return err
+			}
+			log.Infof("applied payment store migration %d", version+1)
+		}
+		return nil
+	})
+}
+
+// isUniqueViolation returns true if err is caused by a unique constraint.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// insert adds a row for p. If ignoreExisting is set, nothing is inserted if there is a row with the account already.
+func (s *sqlStore) insert(tx *sql.Tx, p *Payment, ignoreExisting bool) (inserted bool, err error) {
+	value, err := json.Marshal(p)
+	if err != nil {
+		return false, err
+	}
+	query := `INSERT INTO payments (account, payment_id, key_index, state, created_at, active, revision, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if ignoreExisting {
+		query += ` ON CONFLICT (account) DO NOTHING`
+	}
+	res, err := s.exec(tx, query, p.Account, p.PaymentID, p.Index, p.State, p.CreatedAt.UnixNano(), boolInt(!p.finished()), p.Revision, string(value))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) saveTags(tx *sql.Tx, p *Payment) error {
+	if _, err := s.exec(tx, `DELETE FROM payment_tags WHERE account = ?`, p.Account); err != nil {
+		return err
+	}
+	for _, tag := range p.Tags {
+		if _, err := s.exec(tx, `INSERT INTO payment_tags (tag, account) VALUES (?, ?)`, tag, p.Account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putIdempotencyKey records the key of p in tx. A key is taken over only after it expires, so
+// instances creating payments with the same key at the same time get errDuplicateIdempotencyKey.
+func (s *sqlStore) putIdempotencyKey(tx *sql.Tx, p *Payment) error {
+	res, err := s.exec(tx, `INSERT INTO idempotency_keys (scope, account, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (scope) DO UPDATE SET account = excluded.account, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at <= ?`,
+		p.IdempotencyKey, p.Account, idempotencyExpiry(p).UnixNano(), clock.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errDuplicateIdempotencyKey
+	}
+	return nil
+}
+
+// Create records the idempotency key in the same transaction as the payment.
+func (s *sqlStore) Create(p *Payment, policy statePolicy) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if p.State != "" && policy.maxDuplicates > 0 {
+			if s.postgres {
+				// Payments with the same state are counted and inserted one by one.
+				if _, err := s.exec(tx, `SELECT pg_advisory_xact_lock(hashtext(?))`, p.State); err != nil {
+					return err
+				}
+			}
+			var count int
+			since := p.CreatedAt.Add(-policy.window).UnixNano()
+			err := tx.QueryRow(s.rebind(`SELECT COUNT(*) FROM payments WHERE state = ? AND created_at > ?`), p.State, since).Scan(&count)
+			if err != nil {
+				return err
+			}
+			if count >= policy.maxDuplicates {
+				return errDuplicateState
+			}
+		}
+		if p.IdempotencyKey != "" {
+			if err := s.putIdempotencyKey(tx, p); err != nil {
+				return err
+			}
+		}
+		if _, err := s.insert(tx, p, false); err != nil {
+			return err
+		}
+		return s.saveTags(tx, p)
+	})
+}
+
+// Save updates the record only if its revision is still the one that p is loaded with.
+// It returns errRevisionConflict otherwise, and the payment must be loaded again.
+// Elided blocks are recorded in the same transaction.
+func (s *sqlStore) Save(p *Payment) error {
+	revision := p.Revision
+	p.Revision++
+	err := s.withTx(func(tx *sql.Tx) error {
+		value, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		res, err := s.exec(tx, `UPDATE payments SET payment_id = ?, key_index = ?, state = ?, active = ?, revision = ?, data = ?
+			WHERE account = ? AND revision = ?`,
+			p.PaymentID, p.Index, p.State, boolInt(!p.finished()), p.Revision, string(value), p.Account, revision)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			var count int
+			err = tx.QueryRow(s.rebind(`SELECT COUNT(*) FROM payments WHERE account = ?`), p.Account).Scan(&count)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return errRevisionConflict
+			}
+			if _, err = s.insert(tx, p, false); err != nil {
+				return err
+			}
+		}
+		for prefix := range p.newElided {
+			_, err = s.exec(tx, `INSERT INTO elided_blocks (account, prefix) VALUES (?, ?) ON CONFLICT DO NOTHING`, p.Account, prefix)
+			if err != nil {
+				return err
+			}
+		}
+		if !p.tagsChanged {
+			return nil
+		}
+		return s.saveTags(tx, p)
+	})
+	if err != nil {
+		p.Revision = revision
+	}
+	return err
+}
+
+func (s *sqlStore) Load(account string) (*Payment, error) {
+	var value string
+	var mismatch sql.NullString
+	err := s.db.QueryRow(s.rebind(`SELECT p.data, m.data FROM payments p
+		LEFT JOIN integrity_mismatches m ON m.account = p.account WHERE p.account = ?`), account).Scan(&value, &mismatch)
+	if err == sql.ErrNoRows {
+		return nil, errPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var payment Payment
+	err = json.Unmarshal([]byte(value), &payment)
+	if err != nil {
+		return &payment, err
+	}
+	var v []byte
+	if mismatch.Valid {
+		v = []byte(mismatch.String)
+	}
+	return finishLoad(&payment, v)
+}
+
+func (s *sqlStore) AccountOf(paymentID string) (string, error) {
+	var account string
+	err := s.db.QueryRow(s.rebind(`SELECT account FROM payments WHERE payment_id = ? AND payment_id <> ''`), paymentID).Scan(&account)
+	if err == sql.ErrNoRows {
+		return "", errPaymentNotFound
+	}
+	return account, err
+}
+
+// query returns the decoded payments of rows with a data column. Records that cannot be decoded are logged and skipped.
+func (s *sqlStore) query(query string, args ...interface{}) ([]*Payment, error) {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payments := make([]*Payment, 0)
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		p := new(Payment)
+		if err = json.Unmarshal([]byte(value), p); err != nil {
+			log.Error(err)
+			continue
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// LoadActive reads the payments that were not finished at their last save.
+func (s *sqlStore) LoadActive() ([]*Payment, error) {
+	payments, err := s.query(`SELECT data FROM payments WHERE active = 1 ORDER BY account`)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Payment, 0, len(payments))
+	for _, p := range payments {
+		if !p.finished() {
+			ret = append(ret, p)
+		}
+	}
+	return ret, nil
+}
+
+func (s *sqlStore) List(f PaymentFilter) ([]*Payment, error) {
+	query := `SELECT p.data FROM payments p`
+	var where []string
+	var args []interface{}
+	if f.Tag != "" {
+		query += ` JOIN payment_tags t ON t.account = p.account AND t.tag = ?`
+		args = append(args, f.Tag)
+	}
+	if f.State != "" {
+		where = append(where, `p.state = ?`)
+		args = append(args, f.State)
+	}
+	if f.After != "" {
+		where = append(where, `p.account > ?`)
+		args = append(args, f.After)
+	}
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY p.account`
+	// Payments are matched after they are read, so the limit cannot be applied in the query.
+	if f.Limit > 0 && f.Match == nil {
+		query += ` LIMIT ` + strconv.Itoa(f.Limit)
+	}
+	payments, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	ret := payments[:0]
+	for _, p := range payments {
+		if !f.match(p) {
+			continue
+		}
+		ret = append(ret, p)
+		if len(ret) == f.Limit {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func (s *sqlStore) Page(after string, limit int) (accounts []string, values [][]byte, err error) {
+	rows, err := s.db.Query(s.rebind(`SELECT account, data FROM payments WHERE account > ? ORDER BY account LIMIT `+strconv.Itoa(limit)), after)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var account, value string
+		if err = rows.Scan(&account, &value); err != nil {
+			return nil, nil, err
+		}
+		accounts = append(accounts, account)
+		values = append(values, []byte(value))
+	}
+	return accounts, values, rows.Err()
+}
+
+// ForEach reads payments in chunks of ScanChunkSize, so fn can write to the store.
+func (s *sqlStore) ForEach(fn func(p *Payment) error) error {
+	chunkSize := config.ScanChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultScanChunkSize
+	}
+	var after string
+	for {
+		payments, err := s.query(`SELECT data FROM payments WHERE account > ? ORDER BY account LIMIT `+strconv.Itoa(chunkSize), after)
+		if err != nil {
+			return err
+		}
+		for _, p := range payments {
+			if err = fn(p); err != nil {
+				return err
+			}
+		}
+		if len(payments) < chunkSize {
+			return nil
+		}
+		after = payments[len(payments)-1].Account
+	}
+}
+
+// AllocateIndex reserves a random index in key_indexes. It retries if another instance has reserved the same index.
+func (s *sqlStore) AllocateIndex(namespace string) (string, error) {
+	const attempts = 10
+	for i := 0; i < attempts; i++ {
+		index, err := NewIndex()
+		if err != nil {
+			return "", err
+		}
+		_, err = s.db.Exec(s.rebind(`INSERT INTO key_indexes (key_index) VALUES (?)`), keyIndex(namespace, index))
+		if err == nil {
+			return index, nil
+		}
+		if !isUniqueViolation(err) {
+			return "", err
+		}
+	}
+	return "", errors.New("cannot allocate a key index")
+}
+
+// keyIndex returns the value of index in key_indexes table.
+func keyIndex(namespace, index string) string {
+	if namespace == "" {
+		return index
+	}
+	return namespace + "/" + index
+}
+
+func (s *sqlStore) IdempotencyRecord(scope string) (*idempotencyRecord, error) {
+	var account string
+	var expiresAt int64
+	err := s.db.QueryRow(s.rebind(`SELECT account, expires_at FROM idempotency_keys WHERE scope = ?`), scope).Scan(&account, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &idempotencyRecord{Account: account, ExpiresAt: time.Unix(0, expiresAt).UTC()}, nil
+}
+
+func (s *sqlStore) DeleteExpiredIdempotencyKeys(now time.Time) (int, error) {
+	res, err := s.db.Exec(s.rebind(`DELETE FROM idempotency_keys WHERE expires_at <= ?`), now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqlStore) IsElided(account, prefix string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(s.rebind(`SELECT COUNT(*) FROM elided_blocks WHERE account = ? AND prefix = ?`), account, prefix).Scan(&count)
+	return count > 0, err
+}
+
+func (s *sqlStore) SaveIntegrityMismatch(m *IntegrityMismatch) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.put("integrity_mismatches", m.Account, value)
+}
+
+func (s *sqlStore) IntegrityMismatches() ([]IntegrityMismatch, error) {
+	rows, err := s.db.Query(`SELECT data FROM integrity_mismatches ORDER BY account`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make([]IntegrityMismatch, 0)
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		var m IntegrityMismatch
+		if err = json.Unmarshal([]byte(value), &m); err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, rows.Err()
+}
+
+func (s *sqlStore) JournaledBlock(account string) (*journaledBlock, error) {
+	var value string
+	err := s.db.QueryRow(s.rebind(`SELECT data FROM publishing WHERE account = ?`), account).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := new(journaledBlock)
+	return j, json.Unmarshal([]byte(value), j)
+}
+
+func (s *sqlStore) SaveJournaledBlock(account string, j *journaledBlock) error {
+	value, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return s.put("publishing", account, value)
+}
+
+func (s *sqlStore) DeleteJournaledBlock(account string) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM publishing WHERE account = ?`), account)
+	return err
+}
+
+// put sets the data of account in a table with account and data columns.
+func (s *sqlStore) put(table, account string, value []byte) error {
+	_, err := s.db.Exec(s.rebind(`INSERT INTO `+table+` (account, data) VALUES (?, ?)
+		ON CONFLICT (account) DO UPDATE SET data = excluded.data`), account, string(value))
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// Heartbeat implements MembershipStore, so instances sharing the database can partition payments.
+func (s *sqlStore) Heartbeat(instanceID string, at time.Time) error {
+	_, err := s.db.Exec(s.rebind(`INSERT INTO instances (instance_id, heartbeat_at) VALUES (?, ?)
+		ON CONFLICT (instance_id) DO UPDATE SET heartbeat_at = excluded.heartbeat_at`), instanceID, at.UnixNano())
+	return err
+}
+
+func (s *sqlStore) Members(since time.Time) ([]string, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT instance_id FROM instances WHERE heartbeat_at > ? ORDER BY instance_id`), since.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		members = append(members, id)
+	}
+	return members, rows.Err()
+}
+
+// copyPayment saves p with its key index and tags. Payments already in the store are left as they are.
+func (s *sqlStore) copyPayment(p *Payment) (copied bool, err error) {
+	err = s.withTx(func(tx *sql.Tx) error {
+		if p.Index != "" {
+			_, err := s.exec(tx, `INSERT INTO key_indexes (key_index) VALUES (?) ON CONFLICT DO NOTHING`, keyIndex(indexNamespace(p.Merchant), p.Index))
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		copied, err = s.insert(tx, p, true)
+		if err != nil || !copied {
+			return err
+		}
+		return s.saveTags(tx, p)
+	})
+	return
+}
+
+// migrateFromBolt copies the payments in the embedded database to the SQL store opened with DatabaseURL.
+// It can be run again, for example after an interrupted copy.
+func migrateFromBolt() error {
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return errors.New("DatabaseURL is not set")
+	}
+	var total, copied int
+	err := boltStore{}.ForEach(func(p *Payment) error {
+		total++
+		ok, err := s.copyPayment(p)
+		if err != nil {
+			return fmt.Errorf("cannot copy payment %s: %w", p.Account, err)
+		}
+		if ok {
+			copied++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Noticef("copied %d of %d payments to payment store, others were already there", copied, total)
+	n, err := s.copyBoltRecords()
+	if err != nil {
+		return err
+	}
+	log.Noticef("copied %d idempotency keys, elided blocks, integrity mismatches and journaled blocks", n)
+	return nil
+}
+
+// copyBoltRecords copies the records kept with the payments from the embedded database.
+// Records already in the store are left as they are. Returns the number of copied records.
+func (s *sqlStore) copyBoltRecords() (int, error) {
+	insert := func(query string, args ...interface{}) (int, error) {
+		res, err := s.db.Exec(s.rebind(query+` ON CONFLICT DO NOTHING`), args...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), err
+	}
+	copies := []struct {
+		bucket string
+		copy   func(k, v []byte) (int, error)
+	}{
+		{idempotencyBucket, func(k, v []byte) (int, error) {
+			var record idempotencyRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return 0, err
+			}
+			return insert(`INSERT INTO idempotency_keys (scope, account, expires_at) VALUES (?, ?, ?)`, string(k), record.Account, record.ExpiresAt.UnixNano())
+		}},
+		{elidedBlocksBucket, func(k, v []byte) (int, error) {
+			// Keys are "<account>/<prefix>".
+			i := strings.LastIndex(string(k), "/")
+			if i < 0 {
+				return 0, errors.New("invalid key")
+			}
+			return insert(`INSERT INTO elided_blocks (account, prefix) VALUES (?, ?)`, string(k[:i]), string(k[i+1:]))
+		}},
+		{integrityBucket, func(k, v []byte) (int, error) {
+			return insert(`INSERT INTO integrity_mismatches (account, data) VALUES (?, ?)`, string(k), string(v))
+		}},
+		{publishingBucket, func(k, v []byte) (int, error) {
+			return insert(`INSERT INTO publishing (account, data) VALUES (?, ?)`, string(k), string(v))
+		}},
+	}
+	var count int
+	for _, c := range copies {
+		err := scanBucket(c.bucket, func(k, v []byte) error {
+			n, err := c.copy(k, v)
+			if err != nil {
+				return fmt.Errorf("cannot copy %s record %s: %w", c.bucket, k, err)
+			}
+			count += n
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestSQLStore opens a SQLite payment store next to the test database and makes it the store.
+func openTestSQLStore(t *testing.T) *sqlStore {
+	t.Helper()
+	openTestDB(t, 0)
+	s, err := openSQLStore("sqlite:" + filepath.Join(filepath.Dir(config.DatabasePath), "payments.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	t.Cleanup(func() {
+		store = boltStore{}
+		_ = s.Close()
+	})
+	return s
+}
+
+func TestSQLStore(t *testing.T) {
+	config.setDefaults()
+	openTestSQLStore(t)
+	useFakeClock(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := &Payment{Account: "nano_1sql", PaymentID: "id-1", Index: "7", State: "order-1", CreatedAt: clock.Now()}
+	policy := statePolicy{maxDuplicates: 1, window: time.Hour}
+	if err := p.create(policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Payment{Account: "nano_1other", State: "order-1", CreatedAt: clock.Now()}).create(policy); err != errDuplicateState {
+		t.Fatalf("duplicate state is not refused: %v", err)
+	}
+	p.setTags([]string{"vip"})
+	for i := 0; i < 2; i++ {
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := LoadPaymentByID("id-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Account != p.Account || loaded.Revision != 2 || loaded.Index != "7" {
+		t.Fatalf("unexpected payment: %+v", loaded)
+	}
+	if _, err = LoadPayment([]byte("nano_1missing")); err != errPaymentNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	active, err := LoadActivePayments()
+	if err != nil || len(active) != 1 {
+		t.Fatalf("unexpected active payments: %v %v", active, err)
+	}
+	byState, _, err := findPaymentsByState("order-1", nil, 10)
+	if err != nil || len(byState) != 1 {
+		t.Fatalf("unexpected payments by state: %v %v", byState, err)
+	}
+	byTag, _, err := findPaymentsByTag("vip", "", nil, 10)
+	if err != nil || len(byTag) != 1 {
+		t.Fatalf("unexpected payments by tag: %v %v", byTag, err)
+	}
+}
+
+func TestSQLStoreAllocateIndex(t *testing.T) {
+	s := openTestSQLStore(t)
+	// A second instance sharing the database.
+	other, err := openSQLStore("sqlite:" + filepath.Join(filepath.Dir(config.DatabasePath), "payments.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		for _, instance := range []*sqlStore{s, other} {
+			wg.Add(1)
+			go func(instance *sqlStore) {
+				defer wg.Done()
+				index, err := instance.AllocateIndex("")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if seen[index] {
+					t.Errorf("index %s is allocated twice", index)
+				}
+				seen[index] = true
+			}(instance)
+		}
+	}
+	wg.Wait()
+	var count int
+	if err = s.db.QueryRow(`SELECT COUNT(*) FROM key_indexes`).Scan(&count); err != nil || count != 100 {
+		t.Fatalf("unexpected number of reserved indexes: %d %v", count, err)
+	}
+}
+
+func TestMigrateFromBolt(t *testing.T) {
+	config.setDefaults()
+	openTestDB(t, 0)
+	p := &Payment{Account: "nano_1bolt", PaymentID: "id-bolt", Index: "9", CreatedAt: clock.Now()}
+	if err := p.create(statePolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	p.setTags([]string{"imported"})
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveIntegrityMismatch(&IntegrityMismatch{Account: p.Account, Index: p.Index, DetectedAt: clock.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveJournaledBlock(p.Account, &journaledBlock{Hash: "HASH"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSQLStore("sqlite:" + filepath.Join(filepath.Dir(config.DatabasePath), "payments.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	t.Cleanup(func() {
+		store = boltStore{}
+		_ = s.Close()
+	})
+	// Copying again does not change the copied payments.
+	for i := 0; i < 2; i++ {
+		if err = migrateFromBolt(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := LoadPaymentByID("id-bolt")
+	if err != nil || loaded.Revision != 1 || !loaded.integrity.blocks() {
+		t.Fatalf("payment is not copied: %+v %v", loaded, err)
+	}
+	if j, err := s.JournaledBlock(p.Account); err != nil || j == nil || j.Hash != "HASH" {
+		t.Fatalf("journaled block is not copied: %+v %v", j, err)
+	}
+	byTag, _, err := findPaymentsByTag("imported", "", nil, 10)
+	if err != nil || len(byTag) != 1 {
+		t.Fatalf("tags are not copied: %v %v", byTag, err)
+	}
+	if _, err = s.db.Exec(`INSERT INTO key_indexes (key_index) VALUES ('9')`); !isUniqueViolation(err) {
+		t.Fatalf("index of copied payment is not reserved: %v", err)
+	}
+}
+
+func TestSQLStoreRevisionConflict(t *testing.T) {
+	config.setDefaults()
+	openTestSQLStore(t)
+	p := &Payment{Account: "nano_1cas", CreatedAt: clock.Now()}
+	if err := p.create(statePolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.State = "first"
+	if err = first.Save(); err != nil {
+		t.Fatal(err)
+	}
+	second.State = "second"
+	if err = second.Save(); err != errRevisionConflict {
+		t.Fatalf("stale copy is saved: %v", err)
+	}
+	if second.Revision != first.Revision-1 {
+		t.Errorf("revision of refused save is changed: %d", second.Revision)
+	}
+	loaded, err := LoadPayment([]byte(p.Account))
+	if err != nil || loaded.State != "first" || loaded.Revision != first.Revision {
+		t.Fatalf("record is overwritten: %+v %v", loaded, err)
+	}
+	// Saved again after it is loaded.
+	loaded.State = "second"
+	if err = loaded.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLStoreSharedRecords(t *testing.T) {
+	config.setDefaults()
+	s := openTestSQLStore(t)
+	useFakeClock(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	// A second instance sharing the database.
+	other, err := openSQLStore("sqlite:" + filepath.Join(filepath.Dir(config.DatabasePath), "payments.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	p := &Payment{Account: "nano_1shared", IdempotencyKey: "client/key", CreatedAt: clock.Now()}
+	if err = s.Create(p, statePolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := other.IdempotencyRecord("client/key"); err != nil || record == nil || record.Account != p.Account {
+		t.Fatalf("idempotency key is not shared: %+v %v", record, err)
+	}
+	if err = other.Create(&Payment{Account: "nano_1again", IdempotencyKey: "client/key", CreatedAt: clock.Now()}, statePolicy{}); err != errDuplicateIdempotencyKey {
+		t.Fatalf("duplicate idempotency key is not refused: %v", err)
+	}
+	if _, err = other.Load("nano_1again"); err != errPaymentNotFound {
+		t.Fatalf("payment with duplicate key is saved: %v", err)
+	}
+
+	prefix := hashPrefix(randomHash())
+	p.ElidedBlocks = &ElidedBlocks{Count: 1}
+	p.newElided = map[string]bool{prefix: true}
+	if err = s.Save(p); err != nil {
+		t.Fatal(err)
+	}
+	if elided, err := other.IsElided(p.Account, prefix); err != nil || !elided {
+		t.Fatalf("elided block is not shared: %v", err)
+	}
+
+	m := &IntegrityMismatch{Account: p.Account, Index: p.Index, PublicKey: p.PublicKey, DetectedAt: clock.Now()}
+	if err = s.SaveIntegrityMismatch(m); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := other.Load(p.Account)
+	if err != nil || !loaded.integrity.blocks() {
+		t.Fatalf("integrity mismatch is not shared: %+v %v", loaded, err)
+	}
+	if mismatches, err := other.IntegrityMismatches(); err != nil || len(mismatches) != 1 {
+		t.Fatalf("unexpected mismatches: %v %v", mismatches, err)
+	}
+
+	j := &journaledBlock{Hash: "HASH", Block: "{}", Link: "nano_1merchant", CreatedAt: clock.Now()}
+	if err = s.SaveJournaledBlock(p.Account, j); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := other.JournaledBlock(p.Account); err != nil || loaded == nil || loaded.Hash != j.Hash {
+		t.Fatalf("journaled block is not shared: %+v %v", loaded, err)
+	}
+	if err = other.DeleteJournaledBlock(p.Account); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := s.JournaledBlock(p.Account); err != nil || loaded != nil {
+		t.Fatalf("journaled block is not deleted: %+v %v", loaded, err)
+	}
+
+	if n, err := other.DeleteExpiredIdempotencyKeys(idempotencyExpiry(p)); err != nil || n != 1 {
+		t.Fatalf("expired key is not deleted: %d %v", n, err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// statesBucket indexes payments by state.
+// Keys are state + 0x00 + account and values are creation times of payments.
+const statesBucket = "states"
+
+// maxStateSearchResults is the max number of payments returned from state search endpoint.
+const maxStateSearchResults = 100
+
+var errDuplicateState = errors.New("too many payments with the same state")
+
+var (
+	statePatternsMu sync.Mutex
+	statePatterns   = make(map[string]*regexp.Regexp)
+)
+
+// compileStatePattern returns the compiled pattern, or nil if pattern is empty.
+func compileStatePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	statePatternsMu.Lock()
+	defer statePatternsMu.Unlock()
+	if re, ok := statePatterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	statePatterns[pattern] = re
+	return re, nil
+}
+
+// statePolicy is the validation applied to state of new payments.
+type statePolicy struct {
+	require       bool
+	pattern       *regexp.Regexp
+	maxDuplicates int
+	window        time.Duration
+}
+
+func statePolicyFor(key APIKey) statePolicy {
+	policy := statePolicy{
+		require:       config.RequireState || key.RequireState,
+		maxDuplicates: config.MaxDuplicateStates,
+		window:        time.Duration(config.DuplicateStateWindow) * time.Second,
+	}
+	pattern := config.StatePattern
+	if key.StatePattern != "" {
+		pattern = key.StatePattern
+	}
+	// Patterns are validated when config is loaded.
+	policy.pattern, _ = compileStatePattern(pattern)
+	if key.MaxDuplicateStates > 0 {
+		policy.maxDuplicates = key.MaxDuplicateStates
+	}
+	return policy
+}
+
+func (sp statePolicy) valid(state string) bool {
+	if state == "" {
+		return !sp.require
+	}
+	return sp.pattern == nil || sp.pattern.MatchString(state)
+}
+
+func stateIndexKey(state, account string) []byte {
+	return []byte(state + "\x00" + account)
+}
+
+func stateIndexPrefix(state string) []byte {
+	return []byte(state + "\x00")
+}
+
+// create saves a new payment and indexes its state.
+// Returns errDuplicateState if there are already maxDuplicates payments with the same state in window.
+func (p *Payment) create(policy statePolicy) error {
+	p.syncHistory()
+	return store.Create(p, policy)
+}
+
+func putStateIndex(b *bbolt.Bucket, p *Payment) error {
+	createdAt, err := p.CreatedAt.MarshalText()
+	if err != nil {
+		return err
+	}
+	return b.Put(stateIndexKey(p.State, p.Account), createdAt)
+}
+
+// createStatesBucket creates the state index, filling it from existing payments if the bucket is new.
+func createStatesBucket(tx *bbolt.Tx) error {
+	if tx.Bucket([]byte(statesBucket)) != nil {
+		return nil
+	}
+	sb, err := tx.CreateBucket([]byte(statesBucket))
+	if err != nil {
+		return err
+	}
+	var count int
+	err = tx.Bucket([]byte(paymentsBucket)).ForEach(func(k, v []byte) error {
+		var p Payment
+		if json.Unmarshal(v, &p) != nil || p.State == "" {
+			return nil
+		}
+		count++
+		return putStateIndex(sb, &p)
+	})
+	if count > 0 {
+		log.Infof("indexed state of %d payments", count)
+	}
+	return err
+}
+
+// findPaymentsByState returns at most limit payments with the state that match the metadata filter.
+// truncated is true if there are more.
+func findPaymentsByState(state string, filter *metadataFilter, limit int) (payments []*Payment, truncated bool, err error) {
+	payments, err = store.List(PaymentFilter{State: state, Match: filter.match, Limit: limit + 1})
+	if len(payments) > limit {
+		payments, truncated = payments[:limit], true
+	}
+	return
+}
+
+// handleAdminSearchPayments returns payments with the given state.
+// At most maxStateSearchResults payments are returned. "truncated" is set when there are more.
+// Setting MaxDuplicateStates keeps the number of payments per state bounded within DuplicateStateWindow.
+// Payments can be filtered by tag, by merchant and by metadata with metadata_key and metadata_value parameters.
+// State can be omitted with a tag, or with a metadata or merchant filter, then all payments are scanned.
+func handleAdminSearchPayments(w http.ResponseWriter, r *http.Request) {
+	filter, ok := requestMetadataFilter(r)
+	if !ok {
+		http.Error(w, "metadata_key and metadata_value must be set together", http.StatusBadRequest)
+		return
+	}
+	state, tag := r.FormValue("state"), r.FormValue("tag")
+	if state == "" && tag == "" && filter == nil {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	limit := maxStateSearchResults
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxStateSearchResults {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var payments []*Payment
+	var truncated bool
+	var err error
+	switch {
+	case tag != "":
+		payments, truncated, err = findPaymentsByTag(tag, state, filter, limit)
+	case state != "":
+		payments, truncated, err = findPaymentsByState(state, filter, limit)
+	default:
+		payments, truncated, err = findPaymentsByMetadata(filter, limit)
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, map[string]interface{}{"payments": payments, "truncated": truncated})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStatePolicy(t *testing.T) {
+	config = Config{StatePattern: `^order-\d+$`}
+	config.setDefaults()
+	defer func() { config = Config{} }()
+
+	policy := statePolicyFor(APIKey{})
+	for state, valid := range map[string]bool{"": true, "order-1": true, "foo": false} {
+		if policy.valid(state) != valid {
+			t.Errorf("state %q: expected valid=%v", state, valid)
+		}
+	}
+	policy = statePolicyFor(APIKey{RequireState: true, StatePattern: `^[a-z]+$`})
+	for state, valid := range map[string]bool{"": false, "order-1": false, "foo": true} {
+		if policy.valid(state) != valid {
+			t.Errorf("state %q with key policy: expected valid=%v", state, valid)
+		}
+	}
+	config.APIKeys = map[string]APIKey{"key": {StatePattern: "("}}
+	if config.validate() == nil {
+		t.Error("invalid pattern passed validation")
+	}
+}
+
+func TestDuplicateStates(t *testing.T) {
+	openTestDB(t, 0)
+	config.DuplicateStateWindow = 3600
+	policy := statePolicyFor(APIKey{MaxDuplicateStates: 2})
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newPayment := func(i int, createdAt time.Time) *Payment {
+		return &Payment{Account: "nano_" + strconv.Itoa(i), State: "order-1", CreatedAt: createdAt}
+	}
+	for i := 0; i < 2; i++ {
+		if err := newPayment(i, created).create(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newPayment(2, created.Add(time.Minute)).create(policy); err != errDuplicateState {
+		t.Fatalf("expected errDuplicateState, got %v", err)
+	}
+	// Outside of the window.
+	if err := newPayment(3, created.Add(2*time.Hour)).create(policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Payment{Account: "nano_other", State: "order-10", CreatedAt: created}).create(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	payments, truncated, err := findPaymentsByState("order-1", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 3 || truncated {
+		t.Errorf("expected 3 payments, got %d truncated=%v", len(payments), truncated)
+	}
+	payments, truncated, _ = findPaymentsByState("order-1", nil, 2)
+	if len(payments) != 2 || !truncated {
+		t.Errorf("expected truncated results, got %d truncated=%v", len(payments), truncated)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+var statsPeriodLayouts = map[string]string{
+	"day":   "2006-01-02",
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+// Stats is the aggregated data returned from admin stats endpoint.
+// Amounts are in NANO.
+type Stats struct {
+	Period    string                     `json:"period"`
+	Fees      map[string]decimal.Decimal `json:"fees"`
+	TotalFees decimal.Decimal            `json:"totalFees"`
+	Slippage  *SlippageStats             `json:"slippage"`
+	Alerts    []SLAAlert                 `json:"alerts"`
+	// Number of verified payments.
+	Verified int `json:"verified"`
+	// Median duration from creation to verification of payments.
+	MedianVerificationLatency time.Duration `json:"medianVerificationLatency"`
+	// Percent of verified payments verified within PublicStatsVerifiedWithin.
+	VerifiedWithinPercent decimal.Decimal `json:"verifiedWithinPercent"`
+	Uptime                time.Duration   `json:"uptime"`
+}
+
+// startedAt is the time the process has started.
+var startedAt = time.Now()
+
+// collectStats aggregates all payments in database grouped by period.
+// Sums over many payments can exceed max supply so they are not checked with addRaw.
+func collectStats(period string) (*Stats, error) {
+	layout := statsPeriodLayouts[period]
+	stats := &Stats{
+		Period:   period,
+		Fees:     make(map[string]decimal.Decimal),
+		Slippage: newSlippageStats(),
+		Alerts:   slaAlerts.Alerts(),
+	}
+	var latencies []time.Duration
+	err := forEachPayment(func(p *Payment) error {
+		if p.Sandbox {
+			return nil
+		}
+		if p.FulfilledAt != nil {
+			latencies = append(latencies, p.FulfilledAt.Sub(p.CreatedAt))
+		}
+		if p.FeeSentAt != nil && !p.FeeAmount.IsZero() {
+			key := p.FeeSentAt.UTC().Format(layout)
+			stats.Fees[key] = stats.Fees[key].Add(RawToNano(p.FeeAmount))
+			stats.TotalFees = stats.TotalFees.Add(RawToNano(p.FeeAmount))
+		}
+		stats.Slippage.add(p)
+		return nil
+	})
+	stats.Slippage.finish()
+	stats.Verified = len(latencies)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		stats.MedianVerificationLatency = latencies[len(latencies)/2]
+		within := time.Duration(config.PublicStatsVerifiedWithin) * time.Second
+		n := sort.Search(len(latencies), func(i int) bool { return latencies[i] > within })
+		stats.VerifiedWithinPercent = decimal.NewFromInt(int64(n * 100)).DivRound(decimal.NewFromInt(int64(len(latencies))), 1)
+	}
+	stats.Uptime = time.Since(startedAt)
+	return stats, err
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	period := r.FormValue("period")
+	if period == "" {
+		period = "day"
+	}
+	if _, ok := statsPeriodLayouts[period]; !ok {
+		http.Error(w, "invalid period", http.StatusBadRequest)
+		return
+	}
+	stats, err := collectStats(period)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, stats)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/cenkalti/log"
+)
+
+// Steps of a payment from creation to its final state.
+// Payment is moved forward one step at a time in this order.
+const (
+	// Check the account for funds until expected amount is received.
+	stepCheckPending = "check_pending"
+	// Notify the merchant about the verified payment.
+	stepNotify = "notify"
+	// Receive pending funds to the payment account.
+	stepReceive = "receive"
+	// Waiting for admin approval because price was stale at creation.
+	stepAwaitApproval = "await_sweep_approval"
+	// Waiting for the dispute to be resolved.
+	stepAwaitDispute = "await_dispute_resolution"
+	// Send funds to the merchant account.
+	stepSweep = "sweep"
+	// Waiting for admin to resolve funds that arrived after expiry.
+	stepAwaitLate = "await_late_resolution"
+	// Send late funds back to the customer.
+	stepRefund = "refund"
+	// Execute OnExpiryWithFunds of a payment expired with partial funds.
+	stepExpire = "expire"
+	// Send funds of the expired payment back to the customer.
+	stepExpiryRefund = "expiry_refund"
+	// Notify the merchant to credit funds of the expired payment to the customer.
+	stepNotifyCredit = "notify_credit"
+	// Retry the refund requested by admin after it failed.
+	stepAdminRefund = "admin_refund"
+	// Notify the merchant with the financial summary after funds reach their final place.
+	stepNotifyFinal = "notify_final"
+	// Payment is final. Nothing to do.
+	stepNone = "none"
+)
+
+// paymentSteps are the steps that change the payment, in order.
+var paymentSteps = []string{stepCheckPending, stepNotify, stepReceive, stepSweep, stepNotifyFinal}
+
+// nextStep returns the step to move the payment towards its final state.
+// Later milestones take precedence, so a payment received by admin before fulfillment is swept.
+func (p *Payment) nextStep() string {
+	switch {
+	case p.Imported, p.CancelledAt != nil:
+		return stepNone
+	case p.Refund.retrying():
+		// Refunds from the merchant account are retried after the sweep too.
+		return stepAdminRefund
+	case p.SentAt != nil, p.refunded():
+		return p.finalStep()
+	case p.Refund != nil:
+		// Refund is being sent or it is given up.
+		// Funds left on the deposit account after the refund are sent by the leftover sweep.
+		return stepNone
+	case p.Late.unresolved():
+		return stepAwaitLate
+	case p.Late.refunding():
+		return stepRefund
+	case p.Expiry.refunding():
+		// Dispute opened after expiry stops the refund too.
+		if p.disputed() {
+			return stepAwaitDispute
+		}
+		return stepExpiryRefund
+	case p.Expiry.crediting():
+		return stepNotifyCredit
+	case p.ReceivedAt != nil:
+		// Funds are left on the account in self-custody mode.
+		if !config.sweepEnabled() {
+			return p.finalStep()
+		}
+		if p.StaleRate && p.SweepApprovedAt == nil {
+			return stepAwaitApproval
+		}
+		if p.disputed() {
+			return stepAwaitDispute
+		}
+		return stepSweep
+	case p.NotifiedAt != nil, p.NotificationFailedAt != nil, p.Expiry.credited():
+		return stepReceive
+	case p.FulfilledAt != nil:
+		return stepNotify
+	case p.expiredWithFunds():
+		return stepExpire
+	default:
+		return stepCheckPending
+	}
+}
+
+// remainingSteps returns the steps left after step on the way to the final state.
+func remainingSteps(step string) []string {
+	switch step {
+	case stepNone:
+		return []string{}
+	case stepAwaitApproval, stepAwaitDispute:
+		return []string{stepSweep, stepNotifyFinal}
+	}
+	for i, s := range paymentSteps {
+		if s == step {
+			return append([]string{}, paymentSteps[i+1:]...)
+		}
+	}
+	return []string{}
+}
+
+// runStep performs the step and saves the payment.
+// Waiting steps return the error describing what the payment is waiting for.
+// Steps moving funds return errIntegrityMismatch until an integrity mismatch of the payment is resolved.
+func (p *Payment) runStep(step string) error {
+	switch step {
+	case stepReceive, stepRefund, stepExpiryRefund, stepAdminRefund, stepSweep:
+		if p.integrity.blocks() {
+			return errIntegrityMismatch
+		}
+	}
+	var err error
+	switch step {
+	case stepCheckPending:
+		balance := p.Balance
+		err = p.checkPending()
+		if (err == nil || err == errPaymentNotFulfilled) && p.hasLateFunds() {
+			return p.markLate()
+		}
+		if err == errPaymentNotFulfilled && !p.Balance.Equal(balance) && p.partiallyPaid() {
+			go verifications.Publish(PaymentPartiallyPaid{Payment: *p})
+		}
+		if err != nil {
+			return err
+		}
+		p.SatisfiedBy, err = p.satisfiedBy()
+		if err != nil {
+			return err
+		}
+		p.FulfilledAt = now()
+		err = p.Save()
+		if err != nil {
+			return err
+		}
+		slaAlerts.recordVerified(p.CreatedAt, *p.FulfilledAt)
+		go verifications.Publish(PaymentVerified{Payment: *p})
+		if !p.Price.IsZero() {
+			go recordVerificationPrice(p.Account, p.Currency)
+		}
+		return nil
+	case stepNotify:
+		err = p.notifyMerchant()
+		if err != nil {
+			p.recordNotificationError(err)
+			if p.NotificationFailedAt != nil {
+				return p.Save()
+			}
+			if err2 := p.Save(); err2 != nil {
+				log.Error(err2)
+			}
+			return err
+		}
+		p.NotificationError = ""
+		p.NotifiedAt = now()
+		err = p.Save()
+		if err != nil {
+			return err
+		}
+		go verifications.Publish(PaymentVerified{Payment: *p})
+		return nil
+	case stepReceive:
+		err = p.receivePending()
+		if err != nil {
+			return err
+		}
+		p.ReceivedAt = now()
+		return p.saveMilestone()
+	case stepAwaitApproval:
+		return errSweepNotApproved
+	case stepAwaitDispute:
+		return errPaymentDisputed
+	case stepAwaitLate:
+		// Notification is retried on every check until the merchant accepts it.
+		err = p.notifyLate()
+		if err != nil {
+			return err
+		}
+		return errPaymentLate
+	case stepRefund:
+		err = p.refundLate()
+		if err != nil {
+			return err
+		}
+		p.Late.RefundedAt = now()
+		return p.saveMilestone()
+	case stepExpire:
+		return p.expire()
+	case stepExpiryRefund:
+		err = p.refundExpired()
+		if err != nil {
+			return err
+		}
+		p.Expiry.RefundedAt = now()
+		return p.saveMilestone()
+	case stepNotifyCredit:
+		err = p.notifyCredit()
+		if err != nil {
+			return err
+		}
+		p.Expiry.CreditNotifiedAt = now()
+		return p.Save()
+	case stepSweep:
+		err = p.sendToMerchant()
+		if err != nil {
+			return err
+		}
+		p.SentAt = now()
+		return p.saveMilestone()
+	case stepAdminRefund:
+		if now().Before(*p.Refund.RetryAt) {
+			return errRefundRetry
+		}
+		return p.retryRefund()
+	case stepNotifyFinal:
+		return p.notifyFinal()
+	}
+	return nil
+}
+
+// Results of an advance operation.
+const (
+	advanceDone    = "done"
+	advanceDryRun  = "dry_run"
+	advanceWaiting = "waiting"
+	advanceFinal   = "final"
+)
+
+// AdvanceResult is returned from advance endpoint.
+type AdvanceResult struct {
+	// Step performed, or to be performed in dry run.
+	Step   string `json:"step"`
+	Result string `json:"result"`
+	// Reason when result is "waiting".
+	Reason    string   `json:"reason,omitempty"`
+	NextStep  string   `json:"nextStep"`
+	Remaining []string `json:"remaining"`
+	Payment   *Payment `json:"payment"`
+}
+
+// advance performs the next step of the payment.
+// Calling it again after the payment is final does nothing.
+func (p *Payment) advance(dryRun bool) (*AdvanceResult, error) {
+	step := p.nextStep()
+	result := &AdvanceResult{Step: step, Payment: p}
+	switch {
+	case step == stepNone:
+		result.Result = advanceFinal
+	case dryRun:
+		result.Result = advanceDryRun
+	default:
+		err := p.runStep(step)
+		if step == stepCheckPending {
+			p.checked()
+			if err2 := p.Save(); err2 != nil {
+				return nil, err2
+			}
+		}
+		switch err {
+		case nil:
+			result.Result = advanceDone
+		case errPaymentNotFulfilled, errSweepNotApproved, errPaymentDisputed, errPaymentLate, errOrphanFunds, errRefundRetry, errIntegrityMismatch:
+			result.Result = advanceWaiting
+			result.Reason = err.Error()
+		default:
+			return nil, err
+		}
+	}
+	if dryRun {
+		result.NextStep = step
+		result.Remaining = remainingSteps(step)
+	} else {
+		result.NextStep = p.nextStep()
+		result.Remaining = remainingSteps(result.NextStep)
+	}
+	return result, nil
+}
+
+// handleAdminAdvance performs the single next step of a payment.
+// With dry_run=true it only reports the step.
+func handleAdminAdvance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	account, err := requestAccount(r)
+	if err == errPaymentNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	var dryRun bool
+	if s := r.FormValue("dry_run"); s != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			http.Error(w, "invalid dry_run", http.StatusBadRequest)
+			return
+		}
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment([]byte(account))
+	if err == errPaymentNotFound {
+		log.Debugln("account not found:", account)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if step := payment.nextStep(); !dryRun && (step == stepReceive || step == stepSweep || step == stepRefund || step == stepExpiryRefund || step == stepAdminRefund) {
+		if !requireOwnership(w, r, "advance "+step, payment) {
+			return
+		}
+	}
+	result, err := payment.advance(dryRun)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, result)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// fakeEmptyNode responds as if no funds are sent to any account.
+func fakeEmptyNode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action string `json:"action"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch req.Action {
+		case "account_info":
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Account not found"})
+		case "pending":
+			_ = json.NewEncoder(w).Encode(map[string]string{"blocks": ""})
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "unexpected action"})
+		}
+	}))
+	t.Cleanup(ts.Close)
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+}
+
+func TestAdvance(t *testing.T) {
+	openTestDB(t, 0)
+	fakeEmptyNode(t)
+	config.setDefaults()
+	config.NotificationURL = ""
+	cases := []struct {
+		name    string
+		payment Payment
+		step    string
+		// Expected result when not a dry run.
+		result string
+		next   string
+	}{
+		{"created", Payment{}, stepCheckPending, advanceWaiting, stepCheckPending},
+		{"fulfilled", Payment{FulfilledAt: now()}, stepNotify, advanceDone, stepReceive},
+		{"notified", Payment{FulfilledAt: now(), NotifiedAt: now()}, stepReceive, "", ""},
+		{"stale rate", Payment{ReceivedAt: now(), StaleRate: true}, stepAwaitApproval, advanceWaiting, stepAwaitApproval},
+		{"approved", Payment{ReceivedAt: now(), StaleRate: true, SweepApprovedAt: now()}, stepSweep, "", ""},
+		{"disputed", Payment{ReceivedAt: now(), Dispute: &Dispute{OpenedAt: *now()}}, stepAwaitDispute, advanceWaiting, stepAwaitDispute},
+		{"received", Payment{FulfilledAt: now(), NotifiedAt: now(), ReceivedAt: now()}, stepSweep, "", ""},
+		{"received by admin", Payment{ReceivedAt: now()}, stepSweep, "", ""},
+		{"late", Payment{Late: &LatePayment{DetectedAt: *now(), NotifiedAt: now()}}, stepAwaitLate, advanceWaiting, stepAwaitLate},
+		{"swept", Payment{ReceivedAt: now(), SentAt: now()}, stepNotifyFinal, advanceDone, stepNone},
+		{"sent", Payment{ReceivedAt: now(), SentAt: now(), FinalNotifiedAt: now()}, stepNone, advanceFinal, stepNone},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := c.payment
+			p.Account = "nano_1" + url.PathEscape(c.name)
+			if err := p.Save(); err != nil {
+				t.Fatal(err)
+			}
+			if step := p.nextStep(); step != c.step {
+				t.Fatalf("next step: got %s, expected %s", step, c.step)
+			}
+			// Dry run does not change the payment.
+			for i := 0; i < 2; i++ {
+				w := postAdminForm(handleAdminAdvance, url.Values{"account": {p.Account}, "dry_run": {"true"}})
+				var result AdvanceResult
+				if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+					t.Fatal(w.Code, w.Body.String())
+				}
+				if result.Step != c.step || (result.Result != advanceDryRun && result.Result != advanceFinal) {
+					t.Fatalf("unexpected dry run result: %+v", result)
+				}
+			}
+			saved, _ := LoadPayment([]byte(p.Account))
+			if saved.nextStep() != c.step {
+				t.Fatal("dry run changed the payment")
+			}
+			if c.result == "" {
+				// Step requires sending blocks.
+				return
+			}
+			// Waiting and final states stay the same on repeated calls.
+			for i := 0; i < 2; i++ {
+				w := postAdminForm(handleAdminAdvance, url.Values{"account": {p.Account}})
+				var result AdvanceResult
+				if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+					t.Fatal(w.Code, w.Body.String())
+				}
+				if result.Result != c.result || result.NextStep != c.next {
+					t.Fatalf("unexpected result: %+v", result)
+				}
+				if c.result == advanceDone {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestAdvanceOrphanFunds(t *testing.T) {
+	openTestDB(t, 0)
+	ledger := fakeLedgerNode(t)
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	config.setDefaults()
+	config.LatePaymentWindow = 3600
+	t.Cleanup(func() { config.LatePaymentWindow = 0 })
+	p := &Payment{Account: "nano_1orphan", Amount: NanoToRaw(decimal.New(1, 0)), CreatedAt: clock.Now(), Timeout: 600}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c.Add(2 * time.Hour)
+	ledger.send("nano_1customer", p.Account, p.Amount)
+	w := postAdminForm(handleAdminAdvance, url.Values{"account": {p.Account}})
+	var result AdvanceResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if result.Step != stepCheckPending || result.Result != advanceWaiting || result.Reason != errOrphanFunds.Error() {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestRemainingSteps(t *testing.T) {
+	cases := map[string]int{
+		stepCheckPending:  4,
+		stepNotify:        3,
+		stepReceive:       2,
+		stepAwaitApproval: 2,
+		stepAwaitDispute:  2,
+		stepSweep:         1,
+		stepNotifyFinal:   0,
+		stepNone:          0,
+	}
+	for step, n := range cases {
+		if got := len(remainingSteps(step)); got != n {
+			t.Errorf("%s: got %d remaining steps, expected %d", step, got, n)
+		}
+	}
+}
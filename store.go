@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Payment records are kept in a PaymentStore. The default store is the payments bucket of the embedded database.
+// When DatabaseURL is set, records are kept in a SQL database that can be shared by instances, together with
+// the records that instances must agree on: idempotency keys, elided blocks, integrity mismatches and
+// the publish journal. Data local to an instance, such as signing keys and the notification outbox,
+// stays in the embedded database.
+
+// PaymentStore keeps payment records.
+type PaymentStore interface {
+	// Create saves a new payment. Returns errDuplicateState if policy does not allow more payments with its state.
+	Create(p *Payment, policy statePolicy) error
+	// Save updates the payment and sets its Revision to the next one of the stored record.
+	// A store shared by instances returns errRevisionConflict if the record is changed since p is loaded.
+	Save(p *Payment) error
+	// Load returns the payment of account or errPaymentNotFound.
+	Load(account string) (*Payment, error)
+	// AccountOf returns the account of the payment with the ID or errPaymentNotFound.
+	AccountOf(paymentID string) (string, error)
+	// LoadActive returns the payments that are not finished.
+	LoadActive() ([]*Payment, error)
+	// List returns the payments matching f in the order of their accounts.
+	List(f PaymentFilter) ([]*Payment, error)
+	// Page returns up to limit encoded records with accounts after the given one.
+	Page(after string, limit int) (accounts []string, values [][]byte, err error)
+	// ForEach calls fn for every payment. Records that cannot be decoded are logged and skipped.
+	ForEach(fn func(p *Payment) error) error
+	// AllocateIndex returns a key index that is not used by any payment in the store with keys in the namespace.
+	AllocateIndex(namespace string) (string, error)
+	// IdempotencyRecord returns the record of the scoped idempotency key, or nil if there is none.
+	// Keys are recorded by Create.
+	IdempotencyRecord(scope string) (*idempotencyRecord, error)
+	// DeleteExpiredIdempotencyKeys removes the keys that expired before now and returns their number.
+	DeleteExpiredIdempotencyKeys(now time.Time) (int, error)
+	// IsElided returns true if the block with the hash prefix is elided from the record of account.
+	// Blocks are recorded by Save.
+	IsElided(account, prefix string) (bool, error)
+	// SaveIntegrityMismatch records the mismatch of its account. Load sets it on the payment.
+	SaveIntegrityMismatch(m *IntegrityMismatch) error
+	// IntegrityMismatches returns the recorded mismatches, resolved ones included.
+	IntegrityMismatches() ([]IntegrityMismatch, error)
+	// JournaledBlock returns the block in the publish journal of account, or nil if there is none.
+	JournaledBlock(account string) (*journaledBlock, error)
+	SaveJournaledBlock(account string, j *journaledBlock) error
+	DeleteJournaledBlock(account string) error
+	Close() error
+}
+
+// PaymentFilter selects payments in PaymentStore.List.
+type PaymentFilter struct {
+	State string
+	Tag   string
+	// Only payments with accounts after this one are returned.
+	After string
+	// Match is called for every payment selected by the other fields.
+	Match func(p *Payment) bool
+	// Maximum number of payments. Zero means no limit.
+	Limit int
+}
+
+func (f *PaymentFilter) match(p *Payment) bool {
+	return (f.State == "" || p.State == f.State) && (f.Match == nil || f.Match(p))
+}
+
+// store is set by openDB.
+var store PaymentStore = boltStore{}
+
+// openStore returns the store selected by DatabaseURL.
+func openStore() (PaymentStore, error) {
+	if config.DatabaseURL == "" {
+		return boltStore{}, nil
+	}
+	s, err := openSQLStore(config.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// finishLoad sets the integrity mismatch recorded for the loaded payment and checks integrity if needed.
+func finishLoad(p *Payment, mismatch []byte) (*Payment, error) {
+	var err error
+	p.integrity, err = decodeIntegrityMismatch(mismatch, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.shouldCheckIntegrity() {
+		p.checkIntegrity()
+	}
+	return p, nil
+}
+
+// boltStore keeps payments in the payments bucket.
+type boltStore struct{}
+
+func (boltStore) Create(p *Payment, policy statePolicy) error {
+	value, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		if p.State != "" {
+			sb := tx.Bucket([]byte(statesBucket))
+			if policy.maxDuplicates > 0 {
+				since := p.CreatedAt.Add(-policy.window)
+				var count int
+				prefix := stateIndexPrefix(p.State)
+				c := sb.Cursor()
+				for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+					var createdAt time.Time
+					if createdAt.UnmarshalText(v) == nil && createdAt.After(since) {
+						count++
+					}
+				}
+				if count >= policy.maxDuplicates {
+					return errDuplicateState
+				}
+			}
+			err = putStateIndex(sb, p)
+			if err != nil {
+				return err
+			}
+		}
+		if p.IdempotencyKey != "" {
+			err = putIdempotencyKey(tx, p)
+			if err != nil {
+				return err
+			}
+		}
+		if p.PaymentID != "" {
+			err = tx.Bucket([]byte(paymentIDsBucket)).Put([]byte(p.PaymentID), []byte(p.Account))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(paymentsBucket)).Put([]byte(p.Account), value)
+	})
+}
+
+func (boltStore) Save(p *Payment) error {
+	key := []byte(p.Account)
+	return dbUpdate(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(paymentsBucket))
+		// Revision follows the stored record, so a save from a stale copy does not go back.
+		var stored struct {
+			Revision uint64 `json:"revision"`
+		}
+		if v := b.Get(key); v != nil {
+			if err2 := json.Unmarshal(v, &stored); err2 != nil {
+				return err2
+			}
+		}
+		p.Revision = stored.Revision + 1
+		value, err2 := json.Marshal(&p)
+		if err2 != nil {
+			return err2
+		}
+		err2 = b.Put(key, value)
+		if err2 != nil {
+			return err2
+		}
+		err2 = p.saveElided(tx)
+		if err2 != nil {
+			return err2
+		}
+		return p.saveTagIndex(tx)
+	})
+}
+
+func (boltStore) Load(account string) (*Payment, error) {
+	key := []byte(account)
+	var value, mismatch []byte
+	err := dbView(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(paymentsBucket))
+		v := b.Get(key)
+		if v == nil {
+			return nil
+		}
+		value = make([]byte, len(v))
+		copy(value, v)
+		if ib := tx.Bucket([]byte(integrityBucket)); ib != nil {
+			if v = ib.Get(key); v != nil {
+				mismatch = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, errPaymentNotFound
+	}
+	var payment Payment
+	err = json.Unmarshal(value, &payment)
+	if err != nil {
+		return &payment, err
+	}
+	return finishLoad(&payment, mismatch)
+}
+
+func (boltStore) AccountOf(paymentID string) (string, error) {
+	var account string
+	err := dbView(func(tx *bbolt.Tx) error {
+		account = string(tx.Bucket([]byte(paymentIDsBucket)).Get([]byte(paymentID)))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if account == "" {
+		return "", errPaymentNotFound
+	}
+	return account, nil
+}
+
+func (s boltStore) LoadActive() ([]*Payment, error) {
+	ret := make([]*Payment, 0)
+	err := s.ForEach(func(p *Payment) error {
+		if !p.finished() {
+			ret = append(ret, p)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// List uses the state or tag index if the filter has one.
+func (boltStore) List(f PaymentFilter) ([]*Payment, error) {
+	payments := make([]*Payment, 0)
+	err := dbView(func(tx *bbolt.Tx) error {
+		pb := tx.Bucket([]byte(paymentsBucket))
+		var c *bbolt.Cursor
+		var prefix []byte
+		switch {
+		case f.Tag != "":
+			tb := tx.Bucket([]byte(tagsBucket))
+			if tb == nil {
+				return nil
+			}
+			c, prefix = tb.Cursor(), tagIndexPrefix(f.Tag)
+		case f.State != "":
+			c, prefix = tx.Bucket([]byte(statesBucket)).Cursor(), stateIndexPrefix(f.State)
+		default:
+			c = pb.Cursor()
+		}
+		seek := append(append([]byte{}, prefix...), f.After...)
+		for k, v := c.Seek(seek); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			account := string(k[len(prefix):])
+			if f.After != "" && account <= f.After {
+				continue
+			}
+			if prefix != nil {
+				v = pb.Get([]byte(account))
+				if v == nil {
+					continue
+				}
+			}
+			p := new(Payment)
+			if err := json.Unmarshal(v, p); err != nil {
+				log.Error(err)
+				continue
+			}
+			if !f.match(p) {
+				continue
+			}
+			payments = append(payments, p)
+			if len(payments) == f.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	return payments, err
+}
+
+func (boltStore) Page(after string, limit int) (accounts []string, values [][]byte, err error) {
+	err = dbView(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(paymentsBucket)).Cursor()
+		k, v := c.First()
+		if after != "" {
+			k, v = c.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(values) < limit; k, v = c.Next() {
+			accounts = append(accounts, string(k))
+			values = append(values, append([]byte(nil), v...))
+		}
+		return nil
+	})
+	return
+}
+
+// ForEach reads records in chunks, see scanBucket for consistency.
+func (boltStore) ForEach(fn func(p *Payment) error) error {
+	return scanBucket(paymentsBucket, func(k, v []byte) error {
+		p := new(Payment)
+		err := json.Unmarshal(v, p)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		return fn(p)
+	})
+}
+
+// AllocateIndex returns a random index. Only one instance can open the embedded database,
+// and collisions of random 64-bit indexes are not expected.
+func (boltStore) AllocateIndex(string) (string, error) {
+	return NewIndex()
+}
+
+// Close does nothing because the embedded database is closed by closeDB.
+func (boltStore) Close() error {
+	return nil
+}
@@ -1,34 +1,139 @@
 package main
 
 import (
+	"expvar"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/tundak/accept-nano/nano"
 	"github.com/cenkalti/log"
 )
 
-func runSubscriber() {
+// Confirmations of the accounts being checked are received from the node websocket, so payments are checked
+// as soon as funds arrive instead of at their next check time. Polling still runs as a fallback.
+// Subscription is filtered by the accounts in checkingPayments and kept in sync as check loops start and stop.
+// Expired payments keep their check loop within LatePaymentWindow, so funds arriving late are detected too.
+// After a reconnect, all accounts are checked once because confirmations may be missed while disconnected.
+// The check is deferred in a maintenance window, payments are still polled meanwhile.
+
+var metricWebsocketReconnects = expvar.NewInt("node_websocket_reconnects_total")
+
+// confirmationSubscriber is the websocket connection to the node.
+type confirmationSubscriber struct {
+	mu sync.Mutex
+	// Set while subscribed.
+	ws *nano.Websocket
+}
+
+var subscriber = &confirmationSubscriber{}
+
+// watch adds account to the subscription. Accounts are subscribed on the next connect while disconnected.
+func (s *confirmationSubscriber) watch(account string) {
+	s.update("accounts_add", account)
+}
+
+// unwatch removes account from the subscription.
+func (s *confirmationSubscriber) unwatch(account string) {
+	s.update("accounts_del", account)
+}
+
+func (s *confirmationSubscriber) update(option, account string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ws == nil {
+		return
+	}
+	err := s.ws.Send("update", "confirmation", false, map[string]interface{}{option: []string{account}})
+	if err != nil {
+		log.Warningln("cannot update websocket subscription:", err)
+		// Receive loop ends and all accounts are subscribed again after reconnect.
+		_ = s.ws.Close()
+	}
+}
+
+// activeAccounts returns the accounts with a running check loop, including expired payments waiting for late funds.
+func activeAccounts() []string {
+	checkingMu.Lock()
+	defer checkingMu.Unlock()
+	accounts := make([]string, 0, len(checkingPayments))
+	for account := range checkingPayments {
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// runSubscriber keeps the subscription until stop is closed, reconnecting with exponential backoff.
+func runSubscriber(stop chan struct{}) {
+	minBackoff := time.Duration(config.NodeWebsocketMinBackoff) * time.Millisecond
+	maxBackoff := time.Duration(config.NodeWebsocketMaxBackoff) * time.Millisecond
+	backoff := minBackoff
+	reconnect := false
 	for {
-		err := subscribe()
-		if err != nil {
-			log.Errorf("websocket error: %s", err.Error())
-			time.Sleep(time.Second)
+		subscribed, err := subscriber.subscribe(reconnect, stop)
+		if subscribed {
+			backoff = minBackoff
+			reconnect = true
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Errorf("websocket error: %s", err.Error())
+		// Jitter spreads reconnects of instances after a node restart.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)) // nolint: gosec
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		metricWebsocketReconnects.Add(1)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
 		}
 	}
 }
 
-func subscribe() (err error) {
+// subscribe connects to the node and sends confirmed accounts to confirmations until the connection fails.
+// Returns true if the subscription is made.
+func (s *confirmationSubscriber) subscribe(reconnect bool, stop chan struct{}) (subscribed bool, err error) {
 	ws := nano.NewWebsocket(config.NodeWebsocketURL)
 	err = ws.Connect()
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer ws.Close()
-	err = ws.Send("subscribe", "confirmation", true, map[string]interface{}{"include_election_info": "false", "include_block": "true"})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			_ = ws.Close()
+		case <-done:
+		}
+	}()
+	s.mu.Lock()
+	accounts := activeAccounts()
+	err = ws.Send("subscribe", "confirmation", true, map[string]interface{}{"include_election_info": "false", "include_block": "true", "accounts": accounts})
+	if err == nil {
+		s.ws = ws
+	}
+	s.mu.Unlock()
 	if err != nil {
-		return err
+		return false, err
+	}
+	defer func() {
+		s.mu.Lock()
+		s.ws = nil
+		s.mu.Unlock()
+	}()
+	log.Debugf("subscribed to confirmations of %d accounts", len(accounts))
+	if reconnect {
+		go maintenance.runOrDefer(jobReconcile)
 	}
 	var msg struct {
+		Topic   string `json:"topic"`
 		Message struct {
 			FromAccount string `json:"account"`
 			Block       struct {
@@ -37,11 +142,22 @@ func subscribe() (err error) {
 		} `json:"message"`
 	}
 	for {
-		err := ws.Recv(&msg)
+		msg.Topic = ""
+		err = ws.Recv(&msg)
 		if err != nil {
-			return err
+			return true, err
+		}
+		if msg.Topic == "confirmation" {
+			confirmations <- msg.Message.Block.ToAccount
 		}
-		confirmations <- msg.Message.Block.ToAccount
+	}
+}
+
+// reconcile checks the accounts once for the confirmations missed while disconnected.
+func reconcile(accounts []string) {
+	log.Noticef("checking %d accounts after websocket reconnect", len(accounts))
+	for _, account := range accounts {
+		confirmations <- account
 	}
 }
 
@@ -55,7 +171,10 @@ func runChecker() {
 			log.Errorf("cannot load payment: %s", err.Error())
 			continue
 		}
+		if !partitions.owns(account) {
+			continue
+		}
 		log.Debugf("received confirmation from websocket, checking account: %s", account)
-		go p.checkOnce()
+		go checks.run(p.lane(), p.checkOnce)
 	}
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestConfirmationSubscriber(t *testing.T) {
+	config.setDefaults()
+	config.NodeWebsocketMinBackoff, config.NodeWebsocketMaxBackoff = 10, 10
+	type nodeMessage struct {
+		Action  string                 `json:"action"`
+		ID      string                 `json:"id"`
+		Options map[string]interface{} `json:"options"`
+	}
+	messages := make(chan nodeMessage, 10)
+	conns := make(chan *websocket.Conn, 2)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var m nodeMessage
+			if err := websocket.JSON.Receive(ws, &m); err != nil {
+				return
+			}
+			if m.Action == "subscribe" {
+				_ = websocket.JSON.Send(ws, map[string]string{"ack": m.Action, "id": m.ID})
+				conns <- ws
+			}
+			messages <- m
+		}
+	}))
+	defer ts.Close()
+	config.NodeWebsocketURL = "ws" + strings.TrimPrefix(ts.URL, "http")
+	t.Cleanup(func() {
+		config.NodeWebsocketURL = ""
+		config.NodeWebsocketMinBackoff, config.NodeWebsocketMaxBackoff = 0, 0
+	})
+	checkingMu.Lock()
+	checkingPayments["nano_1first"] = &checkerState{}
+	checkingMu.Unlock()
+	t.Cleanup(func() {
+		checkingMu.Lock()
+		delete(checkingPayments, "nano_1first")
+		delete(checkingPayments, "nano_1second")
+		checkingMu.Unlock()
+	})
+	next := func() nodeMessage {
+		select {
+		case m := <-messages:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from subscriber")
+		}
+		return nodeMessage{}
+	}
+	confirmed := func() string {
+		select {
+		case account := <-confirmations:
+			return account
+		case <-time.After(5 * time.Second):
+			t.Fatal("no confirmation")
+		}
+		return ""
+	}
+	// accounts returns the sorted accounts in a subscription option.
+	accounts := func(v interface{}) string {
+		var ret []string
+		for _, a := range v.([]interface{}) {
+			ret = append(ret, a.(string))
+		}
+		sort.Strings(ret)
+		return strings.Join(ret, ",")
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go runSubscriber(stop)
+	if m := next(); m.Action != "subscribe" || accounts(m.Options["accounts"]) != "nano_1first" {
+		t.Fatalf("unexpected subscription: %+v", m)
+	}
+	ws := <-conns
+
+	// New accounts are added to the subscription.
+	checkingMu.Lock()
+	checkingPayments["nano_1second"] = &checkerState{}
+	checkingMu.Unlock()
+	subscriber.watch("nano_1second")
+	if m := next(); m.Action != "update" || accounts(m.Options["accounts_add"]) != "nano_1second" {
+		t.Fatalf("unexpected update: %+v", m)
+	}
+	_ = websocket.JSON.Send(ws, map[string]interface{}{"topic": "confirmation", "message": map[string]interface{}{
+		"account": "nano_1customer", "block": map[string]string{"link_as_account": "nano_1first"}}})
+	if account := confirmed(); account != "nano_1first" {
+		t.Fatalf("unexpected confirmation: %s", account)
+	}
+
+	// After a drop all accounts are subscribed again and checked for missed confirmations.
+	_ = ws.Close()
+	if m := next(); m.Action != "subscribe" || accounts(m.Options["accounts"]) != "nano_1first,nano_1second" {
+		t.Fatalf("unexpected subscription after reconnect: %+v", m)
+	}
+	checked := []string{confirmed(), confirmed()}
+	sort.Strings(checked)
+	if strings.Join(checked, ",") != "nano_1first,nano_1second" {
+		t.Errorf("accounts are not checked after reconnect: %v", checked)
+	}
+	if metricWebsocketReconnects.Value() == 0 {
+		t.Error("reconnect is not counted")
+	}
+}
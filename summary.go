@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"go.etcd.io/bbolt"
+)
+
+// When a payment with funds reaches its final state, the merchant is notified with "final" event
+// containing the FinancialSummary, so that the order can be reconciled without other requests.
+// The notification is recorded in FinalNotifiedAt after the merchant accepts it. Until then it is retried
+// with stepNotifyFinal at every check, so it is not lost if the merchant is down when funds are moved.
+
+const notificationEventFinal = "final"
+
+// Final states reported in FinancialSummary.
+const (
+	// Funds are sent to the merchant account.
+	outcomeSwept = "swept"
+	// Funds are received and kept on the payment account in self-custody mode.
+	outcomeReceived = "received"
+	// Funds are sent back to the customer by an admin, or late funds or funds of an expired payment are sent back.
+	outcomeRefunded = "refunded"
+)
+
+// FinancialSummary contains all money movements of a payment in its final state.
+type FinancialSummary struct {
+	PaymentID string           `json:"paymentId"`
+	Account   string           `json:"account"`
+	State     string           `json:"state"`
+	Outcome   string           `json:"outcome"`
+	Requested SummaryRequested `json:"requested"`
+	Received  SummaryReceived  `json:"received"`
+	// Difference of received and requested amounts in raw. Only one of them is set.
+	OverpaidRaw  string `json:"overpaidRaw,omitempty"`
+	ShortfallRaw string `json:"shortfallRaw,omitempty"`
+	// Set for the legs of funds sent from the payment account.
+	Fee    *SummaryTransfer `json:"fee,omitempty"`
+	Sweep  *SummaryTransfer `json:"sweep,omitempty"`
+	Refund *SummaryTransfer `json:"refund,omitempty"`
+	// Set for payments whose funds arrived after expiry.
+	Late       *SummaryLate      `json:"late,omitempty"`
+	Timestamps SummaryTimestamps `json:"timestamps"`
+}
+
+type SummaryRequested struct {
+	AmountRaw string          `json:"amountRaw"`
+	Amount    decimal.Decimal `json:"amount"`
+	// Fiat amount and the rate used to convert it to NANO. Rate is zero if requested in NANO.
+	Currency         string          `json:"currency"`
+	AmountInCurrency CurrencyAmount  `json:"amountInCurrency"`
+	Rate             decimal.Decimal `json:"rate"`
+}
+
+type SummaryReceived struct {
+	TotalRaw string          `json:"totalRaw"`
+	Total    decimal.Decimal `json:"total"`
+	// Blocks in the order they are confirmed. Blocks not kept in the record are aggregated in the last entry.
+	Blocks []SatisfiedBlock `json:"blocks"`
+}
+
+type SummaryTransfer struct {
+	Account   string     `json:"account"`
+	AmountRaw string     `json:"amountRaw"`
+	Hash      string     `json:"hash,omitempty"`
+	At        *time.Time `json:"at"`
+}
+
+type SummaryLate struct {
+	DetectedAt  time.Time  `json:"detectedAt"`
+	ResolvedAt  *time.Time `json:"resolvedAt"`
+	Disposition string     `json:"disposition"`
+}
+
+type SummaryTimestamps struct {
+	CreatedAt   time.Time  `json:"createdAt"`
+	FulfilledAt *time.Time `json:"fulfilledAt"`
+	NotifiedAt  *time.Time `json:"notifiedAt"`
+	ReceivedAt  *time.Time `json:"receivedAt"`
+	FeeSentAt   *time.Time `json:"feeSentAt"`
+	SentAt      *time.Time `json:"sentAt"`
+	RefundedAt  *time.Time `json:"refundedAt"`
+}
+
+// PaymentFinal is published when a payment with funds reaches its final state.
+type PaymentFinal struct {
+	Payment
+	Summary *FinancialSummary
+}
+
+func (p PaymentFinal) Account() Account {
+	return Account(p.Payment.Account)
+}
+
+// outcome returns the final state of the payment's funds. Empty if funds are not moved to their final place yet.
+func (p *Payment) outcome() string {
+	switch {
+	case p.Refund.sent(), p.Late.refunded(), p.Expiry.refunded():
+		return outcomeRefunded
+	case p.SentAt != nil:
+		return outcomeSwept
+	case p.ReceivedAt != nil:
+		if step := p.nextStep(); step == stepNone || step == stepNotifyFinal {
+			return outcomeReceived
+		}
+	}
+	return ""
+}
+
+// finalStep returns the step of a payment whose funds are in their final place.
+func (p *Payment) finalStep() string {
+	if p.FinalNotifiedAt == nil && p.FinalNotificationFailedAt == nil {
+		return stepNotifyFinal
+	}
+	return stepNone
+}
+
+// financialSummary assembles the summary from the payment record.
+// It is an error if the payment is not final or the amounts do not reconcile.
+func (p *Payment) financialSummary() (*FinancialSummary, error) {
+	outcome := p.outcome()
+	if outcome == "" {
+		return nil, fmt.Errorf("payment %s is not final", p.Account)
+	}
+	blocks, err := p.satisfiedBy()
+	if err != nil {
+		return nil, err
+	}
+	s := &FinancialSummary{
+		PaymentID: p.PaymentID,
+		Account:   p.Account,
+		State:     p.State,
+		Outcome:   outcome,
+		Requested: SummaryRequested{
+			AmountRaw:        p.Amount.String(),
+			Amount:           RawToNano(p.Amount),
+			Currency:         p.Currency,
+			AmountInCurrency: p.AmountInCurrency,
+			Rate:             p.Price,
+		},
+		Received: SummaryReceived{TotalRaw: p.Balance.String(), Total: RawToNano(p.Balance), Blocks: blocks},
+		Timestamps: SummaryTimestamps{
+			CreatedAt:   p.CreatedAt,
+			FulfilledAt: p.FulfilledAt,
+			NotifiedAt:  p.NotifiedAt,
+			ReceivedAt:  p.ReceivedAt,
+			FeeSentAt:   p.FeeSentAt,
+			SentAt:      p.SentAt,
+		},
+	}
+	switch diff := p.Balance.Sub(p.Amount); {
+	case diff.IsPositive():
+		s.OverpaidRaw = diff.String()
+	case diff.IsNegative():
+		s.ShortfallRaw = diff.Neg().String()
+	}
+	sent := decimal.Zero
+	if p.FeeSentAt != nil {
+		s.Fee = &SummaryTransfer{Account: p.FeeAccount, AmountRaw: p.FeeAmount.String(), Hash: p.FeeSendHash, At: p.FeeSentAt}
+		sent = sent.Add(p.FeeAmount)
+	}
+	if p.SentAt != nil {
+		amount := p.Balance.Sub(sent)
+		destination, _ := merchantAccount(p.Merchant)
+		s.Sweep = &SummaryTransfer{Account: destination, AmountRaw: amount.String(), Hash: p.SendHash, At: p.SentAt}
+		sent = sent.Add(amount)
+	}
+	if l := p.Late; l != nil {
+		s.Late = &SummaryLate{DetectedAt: l.DetectedAt, ResolvedAt: l.ResolvedAt, Disposition: l.Disposition}
+		if l.refunded() {
+			s.Refund = &SummaryTransfer{Account: l.RefundAccount, AmountRaw: p.Balance.String(), Hash: l.RefundHash, At: l.RefundedAt}
+			s.Timestamps.RefundedAt = l.RefundedAt
+			sent = sent.Add(p.Balance)
+		}
+	}
+	if e := p.Expiry; e.refunded() {
+		s.Refund = &SummaryTransfer{Account: e.RefundAccount, AmountRaw: p.Balance.String(), Hash: e.RefundHash, At: e.RefundedAt}
+		s.Timestamps.RefundedAt = e.RefundedAt
+		sent = sent.Add(p.Balance)
+	}
+	if r := p.Refund; r.sent() {
+		s.Refund = &SummaryTransfer{Account: r.Destination, AmountRaw: r.Amount.String(), Hash: r.Hash, At: r.RefundedAt}
+		s.Timestamps.RefundedAt = r.RefundedAt
+		// Refunds after the sweep are sent from the merchant account, not from the received funds.
+		if r.Source == refundSourceDeposit {
+			sent = sent.Add(r.Amount)
+		}
+	}
+	// Funds of sandbox payments are not moved, so there are no blocks to reconcile.
+	if p.Sandbox {
+		return s, nil
+	}
+	if err = s.reconcile(sent); err != nil {
+		sendAlert("summary_mismatch", p.Account+": "+err.Error(), map[string]interface{}{"account": p.Account})
+		return nil, err
+	}
+	return s, nil
+}
+
+// reconcile checks that the received blocks add up to the received total, the funds sent from the payment account
+// do not exceed it and each leg that moved funds has a block. The whole total must be sent when the funds are swept.
+func (s *FinancialSummary) reconcile(sent decimal.Decimal) error {
+	total := decimal.RequireFromString(s.Received.TotalRaw)
+	received := decimal.Zero
+	for _, b := range s.Received.Blocks {
+		received = received.Add(decimal.RequireFromString(b.AmountRaw))
+	}
+	if !received.Equal(total) {
+		return fmt.Errorf("sum of blocks (%s) does not match received amount (%s)", received, total)
+	}
+	for _, leg := range []*SummaryTransfer{s.Fee, s.Sweep, s.Refund} {
+		if leg == nil {
+			continue
+		}
+		amount := decimal.RequireFromString(leg.AmountRaw)
+		if amount.IsNegative() {
+			return fmt.Errorf("negative amount sent to %s: %s", leg.Account, amount)
+		}
+		if amount.IsPositive() && leg.Hash == "" {
+			return fmt.Errorf("no block for %s sent to %s", amount, leg.Account)
+		}
+	}
+	// Funds are left on the account in self-custody mode and after a partial refund.
+	if sent.GreaterThan(total) || (s.Outcome == outcomeSwept && !sent.Equal(total)) {
+		return fmt.Errorf("sent amount (%s) does not match received amount (%s)", sent, total)
+	}
+	return nil
+}
+
+// finalize notifies the merchant and websocket clients with the summary of the final payment.
+func (p *Payment) finalize() error {
+	summary, err := p.financialSummary()
+	if err != nil {
+		log.Errorf("cannot finalize payment %s: %s", p.Account, err)
+		return err
+	}
+	n := p.notification()
+	n.Event = notificationEventFinal
+	n.Summary = summary
+	err = p.postNotification(n)
+	if err != nil {
+		return err
+	}
+	go verifications.Publish(PaymentFinal{Payment: *p, Summary: summary})
+	return nil
+}
+
+// notifyFinal finalizes the payment and records the notification.
+// Failed attempts are saved, so the notification is retried at the next check until NotificationMaxAttempts.
+func (p *Payment) notifyFinal() error {
+	err := p.finalize()
+	if err != nil {
+		p.FinalNotificationAttempts++
+		if config.NotificationMaxAttempts > 0 && p.FinalNotificationAttempts >= config.NotificationMaxAttempts {
+			p.FinalNotificationFailedAt = now()
+			log.Errorf("giving up final notification of %s after %d attempts: %s", p.logName(), p.FinalNotificationAttempts, err)
+			sendAlert("notification_failed", fmt.Sprintf("giving up final notification of %s after %d attempts", p.Account, p.FinalNotificationAttempts), map[string]interface{}{"account": p.Account, "error": err.Error()})
+		}
+		if err2 := p.Save(); err2 != nil {
+			log.Error(err2)
+		}
+		return err
+	}
+	p.FinalNotifiedAt = now()
+	return p.Save()
+}
+
+// saveMilestone saves the payment after a step and finalizes it if the step is the last one.
+// The milestone is saved before the notification, so a failed notification does not move the funds again.
+func (p *Payment) saveMilestone() error {
+	err := p.Save()
+	if err != nil {
+		return err
+	}
+	if p.nextStep() != stepNotifyFinal {
+		return nil
+	}
+	return p.notifyFinal()
+}
+
+// markFinalNotified records the final notification of payments that are finalized before it is recorded,
+// so they are not notified again.
+func (p *Payment) markFinalNotified() bool {
+	if p.FinalNotifiedAt != nil || p.outcome() == "" {
+		return false
+	}
+	p.FinalNotifiedAt = now()
+	return true
+}
+
+// migrateFinalNotified rewrites finalized payments saved before FinalNotifiedAt.
+func migrateFinalNotified(tx *bbolt.Tx) error {
+	n, err := rewritePayments(tx, (*Payment).markFinalNotified)
+	if n > 0 {
+		log.Infof("recorded final notification of %d payments", n)
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestFinancialSummary(t *testing.T) {
+	config.setDefaults()
+	config.Account = "nano_1merchant"
+	t.Cleanup(func() { config.Account = "" })
+	at := func(minutes int) *time.Time {
+		t := time.Date(2020, 1, 1, 0, minutes, 0, 0, time.UTC)
+		return &t
+	}
+	swept := func() *Payment {
+		p := testFulfilledPayment()
+		p.Price = decimal.RequireFromString("0.1")
+		p.FulfilledAt, p.NotifiedAt, p.ReceivedAt, p.SentAt = at(1), at(2), at(3), at(4)
+		p.SendHash = "SWEEPHASH"
+		return p
+	}
+
+	checkGolden(t, "summary_verified", mustSummary(t, swept()))
+
+	fee := swept()
+	fee.FeeAccount = "nano_1fee"
+	fee.FeeAmount = decimal.RequireFromString("350000000000000000000000000")
+	fee.FeeSendHash = "FEEHASH"
+	fee.FeeSentAt = at(4)
+	checkGolden(t, "summary_fee_split", mustSummary(t, fee))
+
+	// Funds arrived after expiry and the merchant accepted them.
+	expired := swept()
+	expired.Balance = decimal.RequireFromString("25000000000000000000000000000")
+	delete(expired.SubPayments, "HASH1")
+	expired.Late = &LatePayment{DetectedAt: *at(30), Amount: expired.Balance, ResolvedAt: at(40), Disposition: lateDispositionFulfill}
+	checkGolden(t, "summary_expired_with_funds", mustSummary(t, expired))
+
+	refunded := testFulfilledPayment()
+	refunded.Late = &LatePayment{DetectedAt: *at(30), Amount: refunded.Balance, ResolvedAt: at(40), Disposition: lateDispositionRefund,
+		RefundAccount: "nano_1sender", RefundHash: "REFUNDHASH", RefundedAt: at(41)}
+	checkGolden(t, "summary_refunded", mustSummary(t, refunded))
+
+	// Part of the funds are refunded by an admin before the sweep and the rest is left on the account.
+	partial := testFulfilledPayment()
+	partial.Refund = &Refund{Destination: "nano_1sender", Amount: decimal.RequireFromString("10000000000000000000000000000"),
+		Source: refundSourceDeposit, Status: refundStatusSent, Hash: "REFUNDHASH", RefundedAt: at(50)}
+	s := mustSummary(t, partial)
+	if s.Outcome != outcomeRefunded || s.Refund.AmountRaw != partial.Refund.Amount.String() || s.Timestamps.RefundedAt != partial.Refund.RefundedAt {
+		t.Errorf("unexpected summary of admin refund: %+v", s)
+	}
+}
+
+func mustSummary(t *testing.T, p *Payment) *FinancialSummary {
+	t.Helper()
+	s, err := p.financialSummary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFinancialSummaryMismatch(t *testing.T) {
+	config.setDefaults()
+	if _, err := testFulfilledPayment().financialSummary(); err == nil {
+		t.Error("summary of a payment that is not final")
+	}
+	for name, modify := range map[string]func(p *Payment){
+		"blocks do not add up": func(p *Payment) { p.Balance = p.Balance.Add(decimal.NewFromInt(1)) },
+		"fee over balance":     func(p *Payment) { p.FeeAmount = p.Balance.Add(decimal.NewFromInt(1)) },
+		"no sweep block":       func(p *Payment) { p.SendHash = "" },
+		"no fee block":         func(p *Payment) { p.FeeSendHash = "" },
+		"refund of swept funds": func(p *Payment) {
+			p.Refund = &Refund{Amount: p.Balance, Source: refundSourceDeposit, Status: refundStatusSent, Hash: "REFUNDHASH", RefundedAt: now()}
+		},
+	} {
+		p := testFulfilledPayment()
+		p.FulfilledAt, p.ReceivedAt, p.SentAt, p.FeeSentAt = now(), now(), now(), now()
+		p.SendHash, p.FeeSendHash, p.FeeAccount = "SWEEPHASH", "FEEHASH", "nano_1fee"
+		p.FeeAmount = decimal.NewFromInt(1)
+		if _, err := p.financialSummary(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		modify(p)
+		if _, err := p.financialSummary(); err == nil {
+			t.Errorf("%s: summary is not rejected", name)
+		}
+	}
+}
+
+func TestReconcileBlocks(t *testing.T) {
+	config.setDefaults()
+	p := testFulfilledPayment()
+	p.FulfilledAt, p.ReceivedAt, p.SentAt, p.SendHash = now(), now(), now(), "SWEEPHASH"
+	s := mustSummary(t, p)
+	s.Received.Blocks = s.Received.Blocks[1:]
+	if err := s.reconcile(p.Balance); err == nil {
+		t.Error("summary with a missing block is reconciled")
+	}
+}
+
+func TestFinalNotificationRetry(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	var mu sync.Mutex
+	var events []string
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		_ = json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, n.Event)
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	config.NotificationURL = ts.URL
+	config.Account = "nano_1merchant"
+	t.Cleanup(func() { config.NotificationURL, config.Account, config.NotificationMaxAttempts = "", "", 0 })
+	p := testFulfilledPayment()
+	p.FulfilledAt, p.NotifiedAt, p.ReceivedAt, p.SendHash = now(), now(), now(), "SWEEPHASH"
+
+	// Funds are sent while the merchant is down.
+	p.SentAt = now()
+	if err := p.saveMilestone(); err == nil {
+		t.Fatal("failed notification is not reported")
+	}
+	saved, err := LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.SentAt == nil || saved.FinalNotificationAttempts != 1 || saved.nextStep() != stepNotifyFinal || saved.finished() {
+		t.Fatalf("final notification is not retried: %+v", saved)
+	}
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if err = saved.process(); err != nil {
+		t.Fatal(err)
+	}
+	if saved.FinalNotifiedAt == nil || saved.nextStep() != stepNone || !saved.finished() {
+		t.Fatalf("final notification is not recorded: %+v", saved)
+	}
+	mu.Lock()
+	if len(events) != 2 || events[1] != notificationEventFinal {
+		t.Errorf("unexpected notifications: %v", events)
+	}
+	fail = true
+	mu.Unlock()
+
+	// Notification is given up after NotificationMaxAttempts.
+	config.NotificationMaxAttempts = 2
+	p = testFulfilledPayment()
+	p.Account = "nano_1down"
+	p.FulfilledAt, p.NotifiedAt, p.ReceivedAt, p.SentAt, p.SendHash = now(), now(), now(), now(), "SWEEPHASH"
+	for i := 0; i < 2; i++ {
+		if err = p.process(); err == nil {
+			t.Fatal("failed notification is not reported")
+		}
+	}
+	if p.FinalNotificationFailedAt == nil || p.nextStep() != stepNone {
+		t.Errorf("final notification is not given up: %+v", p)
+	}
+}
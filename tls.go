@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+const certExpiryCheckInterval = 12 * time.Hour
+
+// certs is set when serving with CertFile and KeyFile.
+var certs *certReloader
+
+// certReloader serves the certificate from CertFile and KeyFile
+// and reloads it when the modification time of any of the files changes.
+// If the new files cannot be parsed, the old certificate is kept.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu               sync.RWMutex
+	cert             *tls.Certificate
+	certMod, keyMod  time.Time
+	lastReloadFailed bool
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	err = r.load(certMod, keyMod)
+	return r, err
+}
+
+func (r *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	fi, err := os.Stat(r.certFile)
+	if err != nil {
+		return
+	}
+	certMod = fi.ModTime()
+	fi, err = os.Stat(r.keyFile)
+	if err != nil {
+		return
+	}
+	keyMod = fi.ModTime()
+	return
+}
+
+func (r *certReloader) load(certMod, keyMod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.certMod, r.keyMod = certMod, keyMod
+	r.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged loads the files again if they are modified since the last load.
+func (r *certReloader) reloadIfChanged() {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		log.Errorln("cannot stat certificate files:", err)
+		return
+	}
+	r.mu.RLock()
+	changed := !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+	failed := r.lastReloadFailed
+	r.mu.RUnlock()
+	if !changed {
+		return
+	}
+	err = r.load(certMod, keyMod)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		// Files may be in the middle of being replaced. Log once and try again on next handshake.
+		if !failed {
+			log.Errorln("cannot reload certificate, keeping the old one:", err)
+		}
+		r.lastReloadFailed = true
+		return
+	}
+	r.lastReloadFailed = false
+	log.Noticeln("certificate reloaded, expires at:", r.cert.Leaf.NotAfter)
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.reloadIfChanged()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ExpiresAt returns the expiry time of the certificate being served.
+func (r *certReloader) ExpiresAt() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert.Leaf.NotAfter
+}
+
+// runCertExpiryMonitor alerts periodically while the certificate expires in less than CertExpiryAlertDays.
+func runCertExpiryMonitor(r *certReloader) {
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		r.reloadIfChanged()
+		checkCertExpiry(r, clock.Now())
+		select {
+		case <-ticker.C:
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+func checkCertExpiry(r *certReloader, now time.Time) bool {
+	expiresAt := r.ExpiresAt()
+	if expiresAt.Sub(now) > time.Duration(config.CertExpiryAlertDays)*24*time.Hour {
+		return false
+	}
+	sendAlert("tls_cert_expiry", fmt.Sprintf("TLS certificate expires at %s", expiresAt.UTC().Format(time.RFC3339)), map[string]interface{}{
+		"certFile":  r.certFile,
+		"expiresAt": expiresAt,
+	})
+	return true
+}
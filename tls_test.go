@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with serial and returns its expiry.
+// Modification time is set explicitly so that reload is detected even on coarse file system clocks.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64, notAfter time.Time, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err = os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedSerial(t *testing.T, conn *tls.Conn) int64 {
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertReload(t *testing.T) {
+	config.setDefaults()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	mtime := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, 1, time.Now().Add(365*24*time.Hour), mtime)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{GetCertificate: r.GetCertificate} // nolint: gosec
+	// httptest sets its own certificate, which is used only when the client does not send SNI.
+	srv.StartTLS()
+	defer srv.Close()
+	dial := func() *tls.Conn {
+		conn, err2 := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}) // nolint: gosec
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+		return conn
+	}
+
+	inflight := dial()
+	defer inflight.Close()
+	if serial := servedSerial(t, inflight); serial != 1 {
+		t.Fatalf("expected serial 1, got %d", serial)
+	}
+
+	// Broken files keep the old certificate.
+	err = ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dial()
+	if serial := servedSerial(t, conn); serial != 1 {
+		t.Errorf("expected old certificate after failed reload, got %d", serial)
+	}
+	conn.Close()
+
+	notAfter := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, certFile, keyFile, 2, notAfter, mtime.Add(time.Minute))
+	conn = dial()
+	if serial := servedSerial(t, conn); serial != 2 {
+		t.Errorf("expected new certificate, got %d", serial)
+	}
+	conn.Close()
+	if !r.ExpiresAt().Equal(notAfter) {
+		t.Errorf("unexpected expiry: %s", r.ExpiresAt())
+	}
+
+	// In-flight connection still works with the old certificate.
+	_, err = inflight.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(inflight), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || servedSerial(t, inflight) != 1 {
+		t.Error("in-flight connection is affected by reload")
+	}
+
+	if !checkCertExpiry(r, time.Now()) {
+		t.Error("expected expiry alert")
+	}
+	if checkCertExpiry(r, time.Now().Add(-30*24*time.Hour)) {
+		t.Error("unexpected expiry alert")
+	}
+}
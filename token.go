@@ -5,31 +5,119 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"expvar"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
+// Tokens are JWTs with registered claims, so they can be validated by standard JWT middleware
+// with the keys published at /api/keys:
+//
+//	iss  TokenIssuer
+//	aud  TokenAudience
+//	sub  payment ID, omitted for payments created before payment IDs
+//	iat  creation time
+//	exp  expiry, only set for tokens signed with a key from /admin/keys/rotate
+//	jti  random identifier of the token
+//
+// Claims of the payment are in the "accept-nano:" namespace:
+//
+//	accept-nano:account  deposit account of the payment
+//	accept-nano:index    derivation index of the deposit account
+//	accept-nano:merchant merchant of the payment, omitted for payments without a merchant
+//
+// Tokens created by older versions have only "account", "index" and "paymentId" claims.
+// They are accepted until AcceptLegacyTokensUntil.
+// testdata/token_vectors.json has a token with its key and claims for testing other implementations.
+
+var (
+	errLegacyToken          = errors.New("legacy token is not accepted")
+	metricLegacyTokensTotal = expvar.NewInt("legacy_tokens_total")
+)
+
 type MyCustomClaims struct {
-	Index   string `json:"index"`
-	Account string `json:"account"`
+	Index    string `json:"accept-nano:index"`
+	Account  string `json:"accept-nano:account"`
+	Merchant string `json:"accept-nano:merchant,omitempty"`
+	// Copied from sub claim. Empty in tokens created before payment IDs.
+	PaymentID string `json:"-"`
+	// Claims of legacy tokens. Copied to the fields above when parsed.
+	LegacyIndex     string `json:"index,omitempty"`
+	LegacyAccount   string `json:"account,omitempty"`
+	LegacyPaymentID string `json:"paymentId,omitempty"`
 	jwt.StandardClaims
 }
 
-func NewToken(index, account string) (string, error) {
-	claims := MyCustomClaims{
+// newTokenClaims returns the claims of a token issued at now.
+func newTokenClaims(index, account, paymentID, id string, now time.Time) MyCustomClaims {
+	return MyCustomClaims{
 		Index:   index,
 		Account: account,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   config.TokenIssuer,
+			Audience: config.TokenAudience,
+			Subject:  paymentID,
+			IssuedAt: now.Unix(),
+			Id:       id,
+		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.Seed))
+}
+
+// legacy returns true if the token is created before registered claims.
+func (c *MyCustomClaims) legacy() bool {
+	return c.Issuer == "" && c.Audience == "" && c.Id == ""
+}
+
+// NewToken signs the claims of a payment without a merchant with the current signing key.
+// Tokens signed with the seed do not expire.
+func NewToken(index, account, paymentID string) (string, error) {
+	return newMerchantToken(index, account, paymentID, "")
+}
+
+// newPaymentToken returns a new token of p.
+func newPaymentToken(p *Payment) (string, error) {
+	return newMerchantToken(p.Index, p.Account, p.PaymentID, p.Merchant)
+}
+
+func newMerchantToken(index, account, paymentID, merchant string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	now := clock.Now()
+	claims := newTokenClaims(index, account, paymentID, hex.EncodeToString(id), now)
+	claims.Merchant = merchant
+	key := tokenKeys.signingKey(now)
+	if key == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(config.Seed))
+	}
+	claims.ExpiresAt = now.Add(time.Duration(config.TokenLifetime) * time.Second).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = key.KID
+	return token.SignedString(key.private)
 }
 
 func ParseToken(token string) (*MyCustomClaims, error) {
 	var claims MyCustomClaims
 	t, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.Seed), nil
+		switch token.Method {
+		case jwt.SigningMethodHS256:
+			return []byte(config.Seed), nil
+		case jwt.SigningMethodES256:
+			kid, _ := token.Header["kid"].(string)
+			key := tokenKeys.verificationKey(kid, clock.Now())
+			if key == nil {
+				return nil, fmt.Errorf("unknown signing key: %q", kid)
+			}
+			return &key.private.PublicKey, nil
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %s", token.Method.Alg())
+		}
 	})
 	if err != nil {
 		return nil, err
@@ -37,9 +125,30 @@ func ParseToken(token string) (*MyCustomClaims, error) {
 	if !t.Valid {
 		return nil, errors.New("invalid token")
 	}
+	if claims.legacy() {
+		if !legacyTokensAccepted(clock.Now()) {
+			return nil, errLegacyToken
+		}
+		metricLegacyTokensTotal.Add(1)
+		claims.Index, claims.Account, claims.PaymentID = claims.LegacyIndex, claims.LegacyAccount, claims.LegacyPaymentID
+		return &claims, nil
+	}
+	if !claims.VerifyIssuer(config.TokenIssuer, true) || !claims.VerifyAudience(config.TokenAudience, true) {
+		return nil, errors.New("invalid token issuer or audience")
+	}
+	claims.PaymentID = claims.Subject
 	return &claims, nil
 }
 
+// legacyTokensAccepted returns true if tokens without registered claims are accepted at now.
+func legacyTokensAccepted(now time.Time) bool {
+	if config.AcceptLegacyTokensUntil == "" {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, config.AcceptLegacyTokensUntil)
+	return err == nil && now.Before(until)
+}
+
 func NewSeed() (string, error) {
 	b := make([]byte, 32)
 	_, err := rand.Read(b)
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// tokenVector is the format of testdata/token_vectors.json.
+type tokenVector struct {
+	Description string `json:"description"`
+	// Public key with the private part "d" (base64url) that the token is signed with.
+	Key struct {
+		JWK
+		D string `json:"d"`
+	} `json:"key"`
+	// Time the token is verified at (unix seconds).
+	Now    int64                  `json:"now"`
+	Token  string                 `json:"token"`
+	Header map[string]interface{} `json:"header"`
+	Claims map[string]interface{} `json:"claims"`
+}
+
+func (v *tokenVector) signingKey(t *testing.T) *SigningKey {
+	t.Helper()
+	coordinate := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	private := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: coordinate(v.Key.X), Y: coordinate(v.Key.Y)},
+		D:         coordinate(v.Key.D),
+	}
+	return &SigningKey{KID: v.Key.KID, ActiveAt: time.Unix(v.Key.NotBefore, 0).UTC(), private: private}
+}
+
+// decodeSegment decodes a base64url JSON segment of token.
+func decodeSegment(t *testing.T, token string, i int) map[string]interface{} {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[i])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTokenVectors(t *testing.T) {
+	config.setDefaults()
+	t.Cleanup(func() { tokenKeys.set(nil) })
+	path := filepath.Join("testdata", "token_vectors.json")
+	if *update {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		useFakeClock(t, now)
+		key := &SigningKey{KID: "test-vector", ActiveAt: now.Add(-time.Hour), private: private}
+		tokenKeys.set([]*SigningKey{key})
+		token, err := NewToken("42", "nano_1testvector", "0b5c3f0e-8f4b-4d0e-9a57-2f2d1c7e6a10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := tokenVector{
+			Description: "ES256 token with the default TokenIssuer and TokenAudience. The key is only for testing.",
+			Now:         now.Unix(),
+			Token:       token,
+			Header:      decodeSegment(t, token, 0),
+			Claims:      decodeSegment(t, token, 1),
+		}
+		v.Key.JWK = key.jwk()
+		d := private.D.Bytes()
+		v.Key.D = base64.RawURLEncoding.EncodeToString(append(make([]byte, 32-len(d)), d...))
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v tokenVector
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	useFakeClock(t, time.Unix(v.Now, 0).UTC())
+	tokenKeys.set([]*SigningKey{v.signingKey(t)})
+
+	claims, err := ParseToken(v.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Account != v.Claims["accept-nano:account"] || claims.Index != v.Claims["accept-nano:index"] || claims.PaymentID != v.Claims["sub"] {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if h := decodeSegment(t, v.Token, 0); !reflect.DeepEqual(h, v.Header) {
+		t.Fatalf("header does not match: %v", h)
+	}
+
+	// Tokens created now have the same claims except the random identifier.
+	token, err := NewToken(claims.Index, claims.Account, claims.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeSegment(t, token, 1)
+	if got["jti"] == v.Claims["jti"] {
+		t.Fatal("token identifier is reused")
+	}
+	got["jti"] = v.Claims["jti"]
+	if !reflect.DeepEqual(got, v.Claims) {
+		t.Fatalf("claims do not match the vector:\n%v\n%v", got, v.Claims)
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	config.setDefaults()
+	config.Seed = "seed"
+	t.Cleanup(func() { config.AcceptLegacyTokensUntil = "" })
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"index": "1", "account": "nano_1legacy", "paymentId": "id"}).SignedString([]byte(config.Seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ParseToken(legacy)
+	if err != nil || claims.Account != "nano_1legacy" || claims.Index != "1" || claims.PaymentID != "id" {
+		t.Fatalf("legacy token is not accepted: %+v %v", claims, err)
+	}
+	config.AcceptLegacyTokensUntil = clock.Now().Add(-time.Hour).Format(time.RFC3339)
+	if _, err = ParseToken(legacy); err != errLegacyToken {
+		t.Fatalf("legacy token is accepted after deprecation: %v", err)
+	}
+
+	// Tokens for another audience are refused.
+	config.TokenAudience = "other"
+	token, err := NewToken("1", "nano_1other", "id")
+	config.TokenAudience = "accept-nano"
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseToken(token); err == nil {
+		t.Fatal("token for another audience is accepted")
+	}
+}
@@ -1,15 +1,75 @@
 package main
 
 import (
+	"errors"
+
 	"github.com/shopspring/decimal"
 )
 
-var rawMultiplier = decimal.RequireFromString("10000000000000000000000000000")
+// rawDigits is the number of fraction digits of amounts in NANO when they are given in raw.
+const rawDigits = 28
+
+var rawMultiplier = decimal.New(1, rawDigits)
+
+// maxSupplyRaw is the total supply of NANO in raw (2^128-1).
+// No account balance or block amount can be larger than this.
+var maxSupplyRaw = decimal.RequireFromString("340282366920938463463374607431768211455")
+
+var (
+	errAmountNegative    = errors.New("amount is negative")
+	errAmountNotInteger  = errors.New("raw amount is not an integer")
+	errAmountOverflow    = errors.New("amount exceeds max supply")
+	errAmountNotPositive = errors.New("amount must be positive")
+)
 
 func NanoToRaw(nano decimal.Decimal) decimal.Decimal {
 	return nano.Mul(rawMultiplier)
 }
 
+// RawToNano converts the amount in raw to NANO. The result is exact, unlike division,
+// which rounds to decimal.DivisionPrecision digits.
 func RawToNano(raw decimal.Decimal) decimal.Decimal {
-	return raw.Div(rawMultiplier)
+	return raw.Shift(-rawDigits)
+}
+
+// NanoToRawChecked converts the amount in NANO to raw and validates the result.
+// Use this for amounts coming from outside.
+func NanoToRawChecked(nano decimal.Decimal) (decimal.Decimal, error) {
+	raw := NanoToRaw(nano)
+	return raw, validateRaw(raw)
+}
+
+// validateRaw returns an error if raw is not a valid amount to have in an account.
+func validateRaw(raw decimal.Decimal) error {
+	if raw.IsNegative() {
+		return errAmountNegative
+	}
+	if !raw.Equal(raw.Truncate(0)) {
+		return errAmountNotInteger
+	}
+	if raw.GreaterThan(maxSupplyRaw) {
+		return errAmountOverflow
+	}
+	return nil
+}
+
+// parseRaw parses a raw amount string such as the ones returned from node RPC.
+func parseRaw(s string) (decimal.Decimal, error) {
+	raw, err := decimal.NewFromString(s)
+	if err != nil {
+		return raw, err
+	}
+	return raw, validateRaw(raw)
+}
+
+// addRaw returns a+b, or an error if the sum is more than max supply.
+// Use this for amounts that belong to a single account.
+// Aggregates over many accounts (e.g. stats) can be summed with decimal.Add directly
+// because decimal.Decimal has arbitrary precision.
+func addRaw(a, b decimal.Decimal) (decimal.Decimal, error) {
+	sum := a.Add(b)
+	if sum.GreaterThan(maxSupplyRaw) {
+		return sum, errAmountOverflow
+	}
+	return sum, nil
 }
@@ -0,0 +1,23 @@
+//go:build go1.18
+// +build go1.18
+
+package main // nolint: testpackage
+
+import (
+	"testing"
+)
+
+func FuzzParseRaw(f *testing.F) {
+	for _, s := range []string{"0", "1", "340282366920938463463374607431768211455", "340282366920938463463374607431768211456", "-1", "1.5", "1e38"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		raw, err := parseRaw(s)
+		if err != nil {
+			return
+		}
+		if raw.IsNegative() || raw.GreaterThan(maxSupplyRaw) || !raw.Equal(raw.Truncate(0)) {
+			t.Fatalf("parseRaw(%q) accepted invalid amount: %s", s, raw)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package main // nolint: testpackage
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestValidateRaw(t *testing.T) {
+	one := decimal.New(1, 0)
+	cases := []struct {
+		raw decimal.Decimal
+		err error
+	}{
+		{decimal.Zero, nil},
+		{one, nil},
+		{maxSupplyRaw, nil},
+		{maxSupplyRaw.Add(one), errAmountOverflow},
+		{maxSupplyRaw.Mul(maxSupplyRaw), errAmountOverflow},
+		{one.Neg(), errAmountNegative},
+		{decimal.RequireFromString("0.5"), errAmountNotInteger},
+		{maxSupplyRaw.Add(decimal.RequireFromString("0.1")), errAmountNotInteger},
+	}
+	for _, c := range cases {
+		if err := validateRaw(c.raw); err != c.err {
+			t.Errorf("validateRaw(%s) = %v, expected %v", c.raw, err, c.err)
+		}
+	}
+}
+
+func TestAddRaw(t *testing.T) {
+	half := maxSupplyRaw.Div(decimal.New(2, 0)).Floor()
+	sum, err := addRaw(half, half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err = addRaw(sum, decimal.New(1, 0))
+	if err != nil || !sum.Equal(maxSupplyRaw) {
+		t.Fatalf("unexpected result: %s, %v", sum, err)
+	}
+	_, err = addRaw(sum, decimal.New(1, 0))
+	if err != errAmountOverflow {
+		t.Fatalf("expected overflow, got: %v", err)
+	}
+}
+
+func TestNanoToRawChecked(t *testing.T) {
+	cases := []struct {
+		nano string
+		ok   bool
+	}{
+		{"0.000001", true},
+		{"0.0000000000000000000000000001", true},
+		{"0.00000000000000000000000000001", false},
+		{"34028236692.0938463463374607431768211455", true},
+		{"34028236692.0938463463374607431768211456", false},
+		{"1e40", false},
+		{"-1", false},
+	}
+	for _, c := range cases {
+		_, err := NanoToRawChecked(decimal.RequireFromString(c.nano))
+		if (err == nil) != c.ok {
+			t.Errorf("NanoToRawChecked(%s) returned error: %v", c.nano, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// A check loop can hang inside a node RPC that never returns, so its payment is neither verified nor failed
+// while the loop still looks alive. Check loops record their progress in checkingPayments and the watchdog
+// cancels the check if it is still running long after the time the loop expected to be done.
+// Loops waiting for their next check time are never flagged, however long the wait is.
+
+var metricStuckCheckers = expvar.NewInt("stuck_checkers_total")
+
+// checkerState is the progress of a check loop.
+type checkerState struct {
+	// Time the last iteration of the loop is completed.
+	heartbeat time.Time
+	// Time the next check is scheduled at and the wait before it.
+	expectedAt time.Time
+	interval   time.Duration
+	// Set while a check is running.
+	checkStartedAt time.Time
+	cancel         context.CancelFunc
+	// Set when the running check is cancelled by the watchdog.
+	cancelled bool
+	// Closed to stop the check loop.
+	stop chan struct{}
+}
+
+// stuck returns true if the check has been running for more than factor times the expected interval after its scheduled time.
+func (s *checkerState) stuck(now time.Time, factor int, minInterval time.Duration) bool {
+	if s.cancel == nil || s.cancelled {
+		return false
+	}
+	interval := s.interval
+	if interval < minInterval {
+		interval = minInterval
+	}
+	return now.Sub(s.expectedAt) > time.Duration(factor)*interval
+}
+
+// recordExpected saves the time the next check of account is scheduled at.
+func recordExpected(account string, wait time.Duration) {
+	checkingMu.Lock()
+	defer checkingMu.Unlock()
+	if s, ok := checkingPayments[account]; ok {
+		t := clock.Now()
+		s.heartbeat, s.expectedAt, s.interval = t, t.Add(wait), wait
+	}
+}
+
+// beginCheck returns the context for the check of account and a function to call when the check is done.
+func beginCheck(account string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	checkingMu.Lock()
+	s, ok := checkingPayments[account]
+	if ok {
+		s.checkStartedAt, s.cancel, s.cancelled = clock.Now(), cancel, false
+	}
+	checkingMu.Unlock()
+	return ctx, func() {
+		cancel()
+		checkingMu.Lock()
+		if ok {
+			s.heartbeat, s.cancel = clock.Now(), nil
+		}
+		checkingMu.Unlock()
+	}
+}
+
+// node returns the node for the RPCs of the payment check, so they are aborted if the check is cancelled.
+func (p *Payment) node() *nano.Node {
+	if p.ctx == nil {
+		return checkerNode()
+	}
+	return checkerNode().WithContext(p.ctx)
+}
+
+// cancelStuckChecks cancels the checks that are stuck at now and returns their accounts.
+func cancelStuckChecks(now time.Time) []string {
+	minInterval := time.Duration(config.MinNextCheckDuration) * time.Second
+	var stuck []string
+	checkingMu.Lock()
+	for account, s := range checkingPayments {
+		if s.stuck(now, config.StuckCheckFactor, minInterval) {
+			log.Warningf("check of %s is stuck since %s, cancelling", account, s.checkStartedAt.Format(time.RFC3339))
+			s.cancel()
+			s.cancelled = true
+			stuck = append(stuck, account)
+		}
+	}
+	checkingMu.Unlock()
+	if len(stuck) > 0 {
+		metricStuckCheckers.Add(int64(len(stuck)))
+	}
+	if config.StuckCheckAlertThreshold > 0 && len(stuck) >= config.StuckCheckAlertThreshold {
+		sendAlert("stuck_checkers", fmt.Sprintf("%d payment checks are stuck", len(stuck)), map[string]interface{}{"accounts": stuck})
+	}
+	return stuck
+}
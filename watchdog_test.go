@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+func TestWatchdogCancelsStuckCheck(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	// First request never gets a response, like a connection to a black hole.
+	var requests int32
+	hanging, released := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(hanging)
+			<-released
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Account not found"})
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(released) })
+	oldNode := node
+	node = nano.New(ts.URL)
+	t.Cleanup(func() { node = oldNode })
+
+	stuck := &Payment{Account: "nano_1stuck", CreatedAt: clock.Now()}
+	waiting := &Payment{Account: "nano_1waiting", CreatedAt: clock.Now()}
+	for _, p := range []*Payment{stuck, waiting} {
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		checkingMu.Lock()
+		checkingPayments[p.Account] = &checkerState{}
+		checkingMu.Unlock()
+		account := p.Account
+		t.Cleanup(func() { stopChecking(account) })
+	}
+	recordExpected(stuck.Account, 10*time.Second)
+	// Waits for a long confirmation interval. It is not stuck however old its heartbeat is.
+	recordExpected(waiting.Account, 20*time.Minute)
+
+	c.Add(10 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		stuck.checkOnce()
+		close(done)
+	}()
+	<-hanging
+
+	// A slow call is not stuck until it runs for StuckCheckFactor times its interval.
+	c.Add(20 * time.Second)
+	if accounts := cancelStuckChecks(clock.Now()); len(accounts) != 0 {
+		t.Fatalf("slow check is cancelled: %v", accounts)
+	}
+	c.Add(time.Hour)
+	before := metricStuckCheckers.Value()
+	accounts := cancelStuckChecks(clock.Now())
+	if len(accounts) != 1 || accounts[0] != stuck.Account || metricStuckCheckers.Value() != before+1 {
+		t.Fatalf("unexpected stuck checks: %v", accounts)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck check is not cancelled")
+	}
+	if accounts = cancelStuckChecks(clock.Now()); len(accounts) != 0 {
+		t.Fatalf("finished check is reported as stuck: %v", accounts)
+	}
+
+	// Next check of the payment is not affected.
+	stuck.checkOnce()
+	if atomic.LoadInt32(&requests) < 2 || stuck.LastCheckedAt == nil || !stuck.LastCheckedAt.Equal(clock.Now()) {
+		t.Fatalf("payment is not checked after recovery: %+v", stuck)
+	}
+}
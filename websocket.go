@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	errWebsocketNoToken    = errors.New("no token")
+	errWebsocketBadOrigin  = errors.New("origin not allowed")
+	errWebsocketQueryToken = errors.New("token in query is disabled")
+)
+
+// websocketAuth is the first message sent by clients that do not pass the token in query.
+type websocketAuth struct {
+	Auth string `json:"auth"`
+	// Clients subscribing to multiple tokens may start with a subscribe message instead.
+	Subscribe string `json:"subscribe"`
+}
+
+// checkWebsocketOrigin rejects upgrade requests from browsers on origins not in AllowedOrigins.
+func checkWebsocketOrigin(c *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(c, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return errWebsocketBadOrigin
+	}
+	c.Origin = origin
+	if !originAllowed(origin) {
+		return errWebsocketBadOrigin
+	}
+	return nil
+}
+
+func originAllowed(origin *url.URL) bool {
+	if len(config.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, pattern := range config.AllowedOrigins {
+		if matchOrigin(pattern, origin.Scheme+"://"+origin.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// websocketHandler returns the handler of websocket connections.
+// Requests that fail the handshake checks get an ErrorResponse instead of the plain response of the websocket server.
+func websocketHandler() http.Handler {
+	server := websocket.Server{Handshake: checkWebsocketOrigin, Handler: handleWebsocket}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			writeError(w, errCodeInvalidRequest, http.StatusBadRequest, "websocket upgrade required")
+			return
+		}
+		origin, err := url.ParseRequestURI(r.Header.Get("Origin"))
+		if err != nil || !originAllowed(origin) {
+			writeError(w, errCodeOriginNotAllowed, http.StatusForbidden, errWebsocketBadOrigin.Error())
+			return
+		}
+		server.ServeHTTP(w, r)
+	})
+}
+
+// websocketToken returns the token from query or, if not present, from the first message.
+// Returned errors must not contain the token because they are logged.
+func websocketToken(conn *websocket.Conn) (string, error) {
+	if token := conn.Request().FormValue("token"); token != "" {
+		if config.DisableWebsocketQueryToken {
+			return "", errWebsocketQueryToken
+		}
+		return token, nil
+	}
+	err := conn.SetReadDeadline(time.Now().Add(time.Duration(config.WebsocketAuthTimeout) * time.Second))
+	if err != nil {
+		return "", err
+	}
+	var msg websocketAuth
+	err = websocket.JSON.Receive(conn, &msg)
+	if err != nil {
+		return "", errors.New("cannot read auth message")
+	}
+	token := msg.Auth
+	if token == "" {
+		token = msg.Subscribe
+	}
+	if token == "" {
+		return "", errWebsocketNoToken
+	}
+	return token, conn.SetReadDeadline(time.Time{})
+}
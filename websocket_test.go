@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+)
+
+const testWebsocketOrigin = "https://shop.example.com"
+
+func startWebsocketServer(t testing.TB) string {
+	config.setDefaults()
+	config.Seed = "seed"
+	config.AllowedOrigins = []string{testWebsocketOrigin}
+	config.WebsocketAuthTimeout = 1
+	// Handlers of hijacked connections are not waited by srv.Close, they are closed and waited here
+	// so they do not see the config reset below.
+	var mu sync.Mutex
+	var conns []*websocket.Conn
+	var wg sync.WaitGroup
+	srv := httptest.NewServer(websocket.Server{Handshake: checkWebsocketOrigin, Handler: func(ws *websocket.Conn) {
+		mu.Lock()
+		conns = append(conns, ws)
+		wg.Add(1)
+		mu.Unlock()
+		defer wg.Done()
+		handleWebsocket(ws)
+	}})
+	t.Cleanup(func() {
+		srv.Close()
+		mu.Lock()
+		for _, ws := range conns {
+			_ = ws.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+		config.AllowedOrigins = nil
+		config.DisableWebsocketQueryToken = false
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// captureLogs returns a buffer collecting debug logs until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	h := log.NewWriterHandler(&buf)
+	h.SetLevel(log.DEBUG)
+	log.DefaultLogger.SetHandler(h)
+	log.DefaultLogger.SetLevel(log.DEBUG)
+	t.Cleanup(func() {
+		log.DefaultLogger.SetHandler(log.DefaultHandler)
+		log.DefaultLogger.SetLevel(log.DefaultLevel)
+	})
+	return &buf
+}
+
+// expectClosed waits for the server to close the connection. Messages sent before closing are skipped.
+func expectClosed(t *testing.T, ws *websocket.Conn) {
+	err := ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b []byte
+	for err == nil {
+		err = websocket.Message.Receive(ws, &b)
+	}
+	if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+		t.Fatal("server did not close connection")
+	}
+}
+
+func TestWebsocketBadOrigin(t *testing.T) {
+	url := startWebsocketServer(t)
+	_, err := websocket.Dial(url, "", "https://evil.example.com")
+	if err == nil {
+		t.Fatal("expected handshake to fail")
+	}
+}
+
+func TestWebsocketAuthTimeout(t *testing.T) {
+	url := startWebsocketServer(t)
+	ws, err := websocket.Dial(url, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	expectClosed(t, ws)
+}
+
+func TestWebsocketQueryTokenDisabled(t *testing.T) {
+	url := startWebsocketServer(t)
+	config.DisableWebsocketQueryToken = true
+	token, err := NewToken("1", "nano_1test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.Dial(url+"?token="+token, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	expectClosed(t, ws)
+}
+
+func TestWebsocketFirstMessageAuth(t *testing.T) {
+	openTestDB(t, 0)
+	url := startWebsocketServer(t)
+	logs := captureLogs(t)
+	if err := (&Payment{Account: "nano_1test", Balance: decimal.Zero, CreatedAt: clock.Now()}).Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken("1", "nano_1test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid token is rejected.
+	bad, err := websocket.Dial(url, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	err = websocket.JSON.Send(bad, websocketAuth{Auth: token + "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wsErr websocketError
+	if err = websocket.JSON.Receive(bad, &wsErr); err != nil || wsErr.Error.Code != errCodeTokenInvalid {
+		t.Fatalf("invalid token is not answered with error: %v %+v", err, wsErr)
+	}
+	expectClosed(t, bad)
+
+	ws, err := websocket.Dial(url, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	err = websocket.JSON.Send(ws, websocketAuth{Auth: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for subscription.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		verifications.m.RLock()
+		n := len(verifications.subscribers["nano_1test"])
+		verifications.m.RUnlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := receiveResponse(t, ws); resp.Account != "nano_1test" || resp.Fulfilled {
+		t.Fatalf("current state is not sent: %+v", resp)
+	}
+	verifications.Publish(PaymentVerified{Payment: Payment{Account: "nano_1test", Revision: 1, Balance: decimal.Zero}})
+	var resp Response
+	err = websocket.JSON.Receive(ws, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Account != "nano_1test" {
+		t.Errorf("unexpected account: %s", resp.Account)
+	}
+	if strings.Contains(logs.String(), token) {
+		t.Errorf("token is logged: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "websocket auth failed") {
+		t.Errorf("auth failure is not logged: %s", logs.String())
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// The payment widget is served from the binary at /widget/v<version>/widget.js, so merchants do not need a CDN.
+// A version is never changed after release. Pages pin it with the integrity value from /api/capabilities.
+// Released versions are kept in widgetBundles after newer ones, and served with Deprecation header for
+// WidgetDeprecationWindow days after they are superseded. The widget reads /widget/config.json to find the API.
+
+const (
+	widgetPrefix     = "/widget/"
+	widgetConfigPath = "/widget/config.json"
+	widgetFile       = "widget.js"
+)
+
+var colorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// widgetBundle is a released version of the widget.
+type widgetBundle struct {
+	Version string
+	// Release date of the next version (YYYY-MM-DD). Empty for the latest version.
+	SupersededAt string
+	Source       string
+}
+
+// widgetBundles are the released versions, oldest first. Kept in source like staticFiles.
+var widgetBundles = []widgetBundle{
+	{Version: "1.0.0", Source: `(function () {
+  "use strict";
+  var base = new URL(document.currentScript.src);
+  function text(el, selector, value) {
+    var node = el.querySelector(selector);
+    if (node) { node.textContent = value; }
+  }
+  function update(el, p) {
+    text(el, ".accept-nano-amount", p.amount + " NANO");
+    text(el, ".accept-nano-account", p.account);
+    text(el, ".accept-nano-status", p.fulfilled ? "Paid" : (p.remainingSeconds > 0 ? "Waiting for payment" : "Expired"));
+    el.setAttribute("data-status", p.fulfilled ? "paid" : (p.remainingSeconds > 0 ? "waiting" : "expired"));
+    return p.fulfilled || p.remainingSeconds <= 0;
+  }
+  function mount(el, token) {
+    return fetch(new URL("config.json", new URL("..", base)).href)
+      .then(function (r) { return r.json(); })
+      .then(function (config) {
+        if (config.branding.accentColor) { el.style.borderColor = config.branding.accentColor; }
+        text(el, ".accept-nano-merchant", config.branding.merchantName || "");
+        var ws = new WebSocket(config.websocketUrl + "?token=" + encodeURIComponent(token));
+        ws.onmessage = function (e) {
+          if (update(el, JSON.parse(e.data))) { ws.close(); }
+        };
+        return fetch(config.apiBase + "/verify?token=" + encodeURIComponent(token))
+          .then(function (r) { return r.json(); })
+          .then(function (p) { update(el, p); });
+      });
+  }
+  window.AcceptNanoWidget = { version: "1.0.0", mount: mount };
+})();
+`},
+}
+
+// WidgetBundle is a served version of the widget.
+type WidgetBundle struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	// Subresource integrity value for integrity attribute.
+	Integrity string `json:"integrity"`
+	// Set for superseded versions. They are not served after SunsetAt.
+	Deprecated bool       `json:"deprecated,omitempty"`
+	SunsetAt   *time.Time `json:"sunsetAt,omitempty"`
+
+	content []byte
+	etag    string
+}
+
+// widgetIndex holds the widget versions by path.
+type widgetIndex struct {
+	byPath map[string]*WidgetBundle
+	// In release order.
+	bundles []*WidgetBundle
+}
+
+func newWidgetIndex(bundles []widgetBundle) *widgetIndex {
+	idx := &widgetIndex{byPath: make(map[string]*WidgetBundle, len(bundles))}
+	for _, b := range bundles {
+		sum := sha512.Sum384([]byte(b.Source))
+		wb := &WidgetBundle{
+			Version:   b.Version,
+			Path:      widgetPrefix + "v" + b.Version + "/" + widgetFile,
+			Integrity: "sha384-" + base64.StdEncoding.EncodeToString(sum[:]),
+			content:   []byte(b.Source),
+			etag:      `"` + hex.EncodeToString(sum[:])[:assetHashLength] + `"`,
+		}
+		if b.SupersededAt != "" {
+			// Dates are checked by tests.
+			superseded, _ := time.Parse("2006-01-02", b.SupersededAt)
+			sunset := superseded.AddDate(0, 0, config.WidgetDeprecationWindow)
+			wb.Deprecated, wb.SunsetAt = true, &sunset
+		}
+		idx.byPath[wb.Path] = wb
+		idx.bundles = append(idx.bundles, wb)
+	}
+	return idx
+}
+
+// served returns the bundles that are not past their sunset.
+func (idx *widgetIndex) served(now time.Time) []*WidgetBundle {
+	bundles := make([]*WidgetBundle, 0, len(idx.bundles))
+	for _, b := range idx.bundles {
+		if b.SunsetAt == nil || now.Before(*b.SunsetAt) {
+			bundles = append(bundles, b)
+		}
+	}
+	return bundles
+}
+
+// latest returns the newest bundle.
+func (idx *widgetIndex) latest() *WidgetBundle {
+	return idx.bundles[len(idx.bundles)-1]
+}
+
+// widgets is built on first use, because sunsets depend on config.
+var widgets *widgetIndex
+
+func widgetBundleIndex() *widgetIndex {
+	if widgets == nil {
+		widgets = newWidgetIndex(widgetBundles)
+	}
+	return widgets
+}
+
+func handleWidget(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == widgetConfigPath {
+		handleWidgetConfig(w, r)
+		return
+	}
+	b, ok := widgetBundleIndex().byPath[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if b.SunsetAt != nil {
+		if !clock.Now().Before(*b.SunsetAt) {
+			http.Error(w, "widget version "+b.Version+" is not served anymore, use "+widgetBundleIndex().latest().Path, http.StatusGone)
+			return
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", b.SunsetAt.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	// Content of a version never changes.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Header.Get("If-None-Match") == b.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, err := w.Write(b.content)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+// WidgetConfig is returned from /widget/config.json.
+type WidgetConfig struct {
+	// Base of the API paths, e.g. "/api" or "https://pay.example.com/api" if PublicURL is set.
+	APIBase      string `json:"apiBase"`
+	WebsocketURL string `json:"websocketUrl"`
+	// Currencies that amounts can be requested in.
+	Currencies []string       `json:"currencies"`
+	Branding   WidgetBranding `json:"branding"`
+	// Newest version of the widget.
+	LatestVersion string `json:"latestVersion"`
+}
+
+type WidgetBranding struct {
+	MerchantName string `json:"merchantName,omitempty"`
+	AccentColor  string `json:"accentColor,omitempty"`
+}
+
+// currentWidgetConfig derives the widget config from config.
+// URLs are absolute if PublicURL is set, otherwise the widget resolves them against the page.
+func currentWidgetConfig() *WidgetConfig {
+	c := &WidgetConfig{
+		APIBase:       "/api",
+		WebsocketURL:  "/websocket",
+		Currencies:    []string{"NANO"},
+		Branding:      WidgetBranding{MerchantName: config.MerchantName, AccentColor: config.WidgetAccentColor},
+		LatestVersion: widgetBundleIndex().latest().Version,
+	}
+	if len(config.PriceProviders) > 0 {
+		c.Currencies = append(c.Currencies, config.WidgetCurrencies...)
+	}
+	if config.PublicURL != "" {
+		// Validated when config is loaded.
+		u, _ := url.Parse(strings.TrimSuffix(config.PublicURL, "/"))
+		c.APIBase = u.String() + c.APIBase
+		if u.Scheme == "https" {
+			u.Scheme = "wss"
+		} else {
+			u.Scheme = "ws"
+		}
+		c.WebsocketURL = u.String() + c.WebsocketURL
+	}
+	return c
+}
+
+func handleWidgetConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err := json.NewEncoder(w).Encode(currentWidgetConfig())
+	if err != nil {
+		log.Debug(err)
+	}
+}
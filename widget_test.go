@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWidgetBundleIntegrity(t *testing.T) {
+	config.setDefaults()
+	widgets = nil
+	t.Cleanup(func() {
+		widgets = nil
+		capabilitiesCache = nil
+	})
+	for _, b := range widgetBundles {
+		if _, err := time.Parse("2006-01-02", b.SupersededAt); b.SupersededAt != "" && err != nil {
+			t.Errorf("invalid date of widget %s: %s", b.Version, err)
+		}
+	}
+	if widgetBundles[len(widgetBundles)-1].SupersededAt != "" {
+		t.Error("latest widget is superseded")
+	}
+	w := httptest.NewRecorder()
+	handleCapabilities(w, httptest.NewRequest(http.MethodGet, "/api/capabilities", nil))
+	var c Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Widget.Bundles) == 0 || c.Widget.Latest != c.Widget.Bundles[len(c.Widget.Bundles)-1].Version || c.Widget.Config != widgetConfigPath {
+		t.Fatalf("unexpected widget capabilities: %+v", c.Widget)
+	}
+	for _, b := range c.Widget.Bundles {
+		w := httptest.NewRecorder()
+		handleWidget(w, httptest.NewRequest(http.MethodGet, b.Path, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+			t.Fatalf("cannot get widget %s: %d %v", b.Path, w.Code, w.Header())
+		}
+		sum := sha512.Sum384(w.Body.Bytes())
+		if integrity := "sha384-" + base64.StdEncoding.EncodeToString(sum[:]); integrity != b.Integrity {
+			t.Errorf("served widget %s does not match integrity: %s", b.Version, integrity)
+		}
+		r := httptest.NewRequest(http.MethodGet, b.Path, nil)
+		r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+		w = httptest.NewRecorder()
+		handleWidget(w, r)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("ETag of widget %s is not matched: %d", b.Version, w.Code)
+		}
+	}
+}
+
+func TestWidgetDeprecation(t *testing.T) {
+	config.setDefaults()
+	config.WidgetDeprecationWindow = 30
+	c := useFakeClock(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	widgets = newWidgetIndex([]widgetBundle{
+		{Version: "1.0.0", SupersededAt: "2021-01-01", Source: "old"},
+		{Version: "2.0.0", Source: "new"},
+	})
+	t.Cleanup(func() {
+		config.WidgetDeprecationWindow = 0
+		widgets = nil
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleWidget(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	if w := get("/widget/v2.0.0/widget.js"); w.Code != http.StatusOK || w.Body.String() != "new" || w.Header().Get("Deprecation") != "" {
+		t.Fatalf("unexpected latest widget: %d %v", w.Code, w.Header())
+	}
+	w := get("/widget/v1.0.0/widget.js")
+	if w.Code != http.StatusOK || w.Body.String() != "old" || w.Header().Get("Deprecation") != "true" || w.Header().Get("Sunset") != "Sun, 31 Jan 2021 00:00:00 GMT" {
+		t.Fatalf("superseded widget is not deprecated: %d %v", w.Code, w.Header())
+	}
+	if w := get("/widget/v3.0.0/widget.js"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown widget version is served: %d", w.Code)
+	}
+	if len(widgets.served(c.Now())) != 2 {
+		t.Fatal("superseded widget is not listed")
+	}
+	c.Add(30 * 24 * time.Hour)
+	if w := get("/widget/v1.0.0/widget.js"); w.Code != http.StatusGone {
+		t.Fatalf("widget is served after sunset: %d", w.Code)
+	}
+	if served := widgets.served(c.Now()); len(served) != 1 || served[0].Version != "2.0.0" {
+		t.Fatalf("widget is listed after sunset: %+v", served)
+	}
+}
+
+func TestWidgetConfig(t *testing.T) {
+	config.setDefaults()
+	config.MerchantName = "Shop"
+	config.WidgetAccentColor = "#4a90e2"
+	config.WidgetCurrencies = []string{"USD", "EUR"}
+	config.PublicURL = "https://pay.example.com/"
+	widgets = nil
+	t.Cleanup(func() {
+		config.MerchantName = ""
+		config.WidgetAccentColor = ""
+		config.WidgetCurrencies = nil
+		config.PublicURL = ""
+		config.PriceProviders = nil
+	})
+	get := func() WidgetConfig {
+		w := httptest.NewRecorder()
+		handleWidget(w, httptest.NewRequest(http.MethodGet, widgetConfigPath, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=300" {
+			t.Fatalf("cannot get widget config: %d %v", w.Code, w.Header())
+		}
+		var c WidgetConfig
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c := get()
+	if c.APIBase != "https://pay.example.com/api" || c.WebsocketURL != "wss://pay.example.com/websocket" {
+		t.Fatalf("unexpected URLs: %+v", c)
+	}
+	if len(c.Currencies) != 3 || c.Currencies[0] != "NANO" || c.Currencies[2] != "EUR" {
+		t.Fatalf("unexpected currencies: %v", c.Currencies)
+	}
+	if c.Branding.MerchantName != "Shop" || c.Branding.AccentColor != "#4a90e2" || c.LatestVersion != widgetBundleIndex().latest().Version {
+		t.Fatalf("unexpected widget config: %+v", c)
+	}
+	config.PublicURL = ""
+	config.PriceProviders = []string{}
+	c = get()
+	if c.APIBase != "/api" || c.WebsocketURL != "/websocket" || len(c.Currencies) != 1 {
+		t.Fatalf("unexpected widget config without public URL and prices: %+v", c)
+	}
+}
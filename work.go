@@ -0,0 +1,126 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/tundak/accept-nano/nano"
+)
+
+// Work of receive and send blocks is requested from WorkServerURLs in order, then from the node if all of them fail.
+// Without work servers, work is generated on this host. Work for the open block of a deposit account does not depend
+// on the ledger, so it is generated as soon as the payment is created and saved in OpenWork, and the first receive
+// is published without waiting for it. Work is checked against WorkDifficultySend or WorkDifficultyReceive,
+// so work from a server or saved before a difficulty change is not used if it is below the current difficulty.
+
+// Payments whose open work is generated at the same time. Others are left to generate it when funds arrive.
+const maxOpenWorkPrecomputations = 4
+
+var (
+	openWorkSlots = make(chan struct{}, maxOpenWorkPrecomputations)
+	// Work by source: "server", "node", "local" or "precomputed".
+	metricWork = expvar.NewMap("work_total")
+)
+
+// parseWorkDifficulty parses a difficulty in hex. Empty string is zero.
+func parseWorkDifficulty(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// workThreshold returns the minimum difficulty of the work of send or receive blocks.
+func workThreshold(forSend bool) uint64 {
+	s := config.WorkDifficultyReceive
+	if forSend {
+		s = config.WorkDifficultySend
+	}
+	if s == "" {
+		s = nano.WorkThreshold(forSend)
+	}
+	threshold, _ := parseWorkDifficulty(s)
+	return threshold
+}
+
+// validWork returns true if work for hash meets the current difficulty.
+func validWork(hash, work string, forSend bool) bool {
+	return work != "" && nano.ValidateWork(hash, work, workThreshold(forSend))
+}
+
+// generateWork returns work for the block after hash.
+func generateWork(hash string, forSend bool) (string, error) {
+	threshold := workThreshold(forSend)
+	if len(config.WorkServerURLs) == 0 {
+		metricWork.Add("local", 1)
+		return nano.GenerateWorkWithThreshold(hash, threshold)
+	}
+	difficulty := fmt.Sprintf("%016x", threshold)
+	for _, u := range config.WorkServerURLs {
+		server := nano.New(u)
+		server.SetTimeout(time.Duration(config.WorkServerTimeout) * time.Millisecond)
+		work, err := server.WorkGenerate(hash, difficulty)
+		if err == nil && !validWork(hash, work, forSend) {
+			err = fmt.Errorf("work %s is below difficulty %s", work, difficulty)
+		}
+		if err == nil {
+			metricWork.Add("server", 1)
+			return work, nil
+		}
+		log.Warningf("cannot get work from work server %s: %s", u, err)
+	}
+	work, err := checkerNode().WorkGenerate(hash, difficulty)
+	if err != nil {
+		return "", err
+	}
+	if !validWork(hash, work, forSend) {
+		return "", fmt.Errorf("work %s from node is below difficulty %s", work, difficulty)
+	}
+	metricWork.Add("node", 1)
+	return work, nil
+}
+
+// startOpenWork runs precomputeOpenWork in background.
+// It is waited with the check loops at shutdown, so the payment is not saved after the database is closed.
+func startOpenWork(account, publicKey string) {
+	if stopping() {
+		return
+	}
+	checkPaymentWG.Add(1)
+	go func() {
+		defer checkPaymentWG.Done()
+		precomputeOpenWork(account, publicKey)
+	}()
+}
+
+// precomputeOpenWork generates the work for the open block of account, whose root is its public key, and saves it.
+func precomputeOpenWork(account, publicKey string) {
+	select {
+	case openWorkSlots <- struct{}{}:
+		defer func() { <-openWorkSlots }()
+	default:
+		return
+	}
+	work, err := generateWork(publicKey, false)
+	if err != nil {
+		log.Warningf("cannot generate open work for %s: %s", account, err)
+		return
+	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	p, err := LoadPayment([]byte(account))
+	if err != nil {
+		log.Errorln("cannot load payment:", err)
+		return
+	}
+	if p.ReceivedAt != nil || p.OpenWork != "" {
+		return
+	}
+	p.OpenWork = work
+	if err = p.Save(); err != nil {
+		log.Errorln("cannot save payment:", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tundak/accept-nano/nano"
+)
+
+// testWorkServer answers work_generate requests with work from work, or with an error if work returns an empty string.
+func testWorkServer(t *testing.T, requests *int, work func(hash string) string) string {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action string `json:"action"`
+			Hash   string `json:"hash"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.Action != "work_generate" {
+			t.Errorf("unexpected action: %s", req.Action)
+		}
+		*requests++
+		if result := work(req.Hash); result != "" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"work": result})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "busy"})
+	}))
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+func TestGenerateWork(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	t.Cleanup(func() {
+		config.WorkServerURLs = nil
+		config.WorkDifficultyReceive = ""
+	})
+	const hash = "C008B814A7D269A1FA3C6528B19201A24D797912DB9996FF02A1FF356E45552B"
+	valid := func(hash string) string {
+		work, err := nano.GenerateWorkWithThreshold(hash, workThreshold(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return work
+	}
+	failing := func(string) string { return "" }
+	var failed, served, nodeRequests int
+	oldNode := node
+	node = nano.New(testWorkServer(t, &nodeRequests, valid))
+	t.Cleanup(func() { node = oldNode })
+
+	// Next server is asked when a server fails.
+	config.WorkServerURLs = []string{testWorkServer(t, &failed, failing), testWorkServer(t, &served, valid)}
+	work, err := generateWork(hash, false)
+	if err != nil || !validWork(hash, work, false) || failed != 1 || served != 1 || nodeRequests != 0 {
+		t.Fatalf("work is not generated by the servers: %s %v", work, err)
+	}
+
+	// Node is asked when all servers fail.
+	config.WorkServerURLs = config.WorkServerURLs[:1]
+	work, err = generateWork(hash, false)
+	if err != nil || !validWork(hash, work, false) || nodeRequests != 1 {
+		t.Fatalf("work is not generated by the node: %s %v", work, err)
+	}
+
+	// Open work is saved on the payment.
+	config.WorkServerURLs = nil
+	p := &Payment{Account: "nano_1openwork", PublicKey: hash, CreatedAt: clock.Now()}
+	if err = p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	precomputeOpenWork(p.Account, p.PublicKey)
+	p, err = LoadPayment([]byte(p.Account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validWork(hash, p.OpenWork, false) {
+		t.Fatalf("open work is not saved: %q", p.OpenWork)
+	}
+	// Saved work is not used after the difficulty is raised.
+	config.WorkDifficultyReceive = "ffffffffffffffff"
+	if validWork(hash, p.OpenWork, false) {
+		t.Error("work below the difficulty is valid")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"golang.org/x/net/websocket"
+)
+
+// A websocket connection starts subscribed to the token in query or in the first message,
+// and can subscribe to more tokens by sending {"subscribe": "<token>"} and {"unsubscribe": "<token>"}.
+// The current state of the payment is sent after each subscription. Frames that cannot be handled
+// are answered with {"error": {...}, "token": "<token>"} and the connection stays open.
+// Clients are pinged at WebsocketPingInterval and the connection is closed if they go silent.
+
+// Longest message accepted from a websocket client (bytes). Tokens are much shorter.
+const maxWebsocketMessageSize = 4096
+
+var (
+	errWebsocketSubscriptionLimit = errors.New("too many subscriptions")
+	errWebsocketInvalidToken      = errors.New("invalid token")
+	errWebsocketUnknownPayment    = errors.New("payment of token is not found")
+)
+
+// websocketCommand is a message sent by the client after the connection is authenticated.
+type websocketCommand struct {
+	Subscribe   string `json:"subscribe"`
+	Unsubscribe string `json:"unsubscribe"`
+}
+
+// websocketError is sent when a message of the client cannot be handled.
+type websocketError struct {
+	Error APIError `json:"error"`
+	// Token of the failed subscription, if any.
+	Token string `json:"token,omitempty"`
+}
+
+// wsConn is a websocket client with its subscriptions.
+type wsConn struct {
+	conn  *websocket.Conn
+	queue *wsQueue
+	// Messages, errors and pings are written from different goroutines.
+	// Guards PayloadType of conn too.
+	writeMu sync.Mutex
+	// Sessions by token. Only used by the goroutine reading the connection.
+	sessions map[string]*wsSession
+	// Zero if pings are disabled.
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	done         chan struct{}
+}
+
+func newWSConn(conn *websocket.Conn, id uint64) *wsConn {
+	c := &wsConn{
+		conn:     conn,
+		sessions: make(map[string]*wsSession),
+		done:     make(chan struct{}),
+	}
+	if config.WebsocketPingInterval > 0 {
+		c.pingInterval = time.Duration(config.WebsocketPingInterval) * time.Millisecond
+		c.pongTimeout = time.Duration(config.WebsocketPongTimeout) * time.Millisecond
+	}
+	c.queue = newWSQueue(wsClassPayment, config.WebsocketQueueSize, func(b []byte) error {
+		return c.write(websocket.TextFrame, b)
+	})
+	c.queue.conn = id
+	return c
+}
+
+func (c *wsConn) write(payloadType byte, b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	err := c.conn.SetWriteDeadline(time.Now().Add(time.Duration(config.WebsocketWriteTimeout) * time.Second))
+	if err != nil {
+		return err
+	}
+	c.conn.PayloadType = payloadType
+	_, err = c.conn.Write(b)
+	return err
+}
+
+// subscribe attaches the connection to the session of token and queues the current state of the payment.
+// since is the sequence number of the latest message seen by the client, if it is reconnecting.
+func (c *wsConn) subscribe(token, since string) error {
+	s, ok := c.sessions[token]
+	if !ok {
+		if len(c.sessions) >= config.WebsocketMaxSubscriptions {
+			return errWebsocketSubscriptionLimit
+		}
+		var err error
+		s, err = wsSessions.acquire(token, c.queue)
+		if err != nil {
+			return errWebsocketInvalidToken
+		}
+		c.sessions[token] = s
+	}
+	err := s.resume(c.queue, since)
+	switch err {
+	case nil:
+	case errPaymentNotFound:
+		c.unsubscribe(token)
+		return errWebsocketUnknownPayment
+	default:
+		// Client gets the state with the next event.
+		log.Debugln("cannot send websocket snapshot:", err)
+	}
+	return nil
+}
+
+func (c *wsConn) unsubscribe(token string) {
+	if s, ok := c.sessions[token]; ok {
+		wsSessions.release(s, c.queue)
+		delete(c.sessions, token)
+	}
+}
+
+// sendError writes an error frame. Write errors are noticed by the reader when the connection is closed.
+func (c *wsConn) sendError(code string, cause error, token string) {
+	b, err := json.Marshal(websocketError{Error: APIError{Code: code, Message: cause.Error()}, Token: token})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err = c.write(websocket.TextFrame, b); err != nil {
+		log.Debugln("cannot send websocket error:", err)
+	}
+}
+
+// subscribeError sends the error frame for a failed subscription.
+func (c *wsConn) subscribeError(err error, token string) {
+	switch err {
+	case errWebsocketSubscriptionLimit:
+		c.sendError(errCodeSubscriptionLimit, err, token)
+	case errWebsocketUnknownPayment:
+		c.sendError(errCodePaymentNotFound, err, token)
+	default:
+		c.sendError(errCodeTokenInvalid, err, token)
+	}
+}
+
+// handle runs a command received from the client.
+func (c *wsConn) handle(b []byte) {
+	var cmd websocketCommand
+	err := json.Unmarshal(b, &cmd)
+	if err != nil || (cmd.Subscribe == "") == (cmd.Unsubscribe == "") {
+		c.sendError(errCodeInvalidRequest, errors.New(`message must be {"subscribe": token} or {"unsubscribe": token}`), "")
+		return
+	}
+	if cmd.Unsubscribe != "" {
+		c.unsubscribe(cmd.Unsubscribe)
+		return
+	}
+	if err = c.subscribe(cmd.Subscribe, ""); err != nil {
+		c.subscribeError(err, cmd.Subscribe)
+	}
+}
+
+// keepalive pings the client until the connection is closed.
+// Pongs are handled by the websocket package while reading.
+func (c *wsConn) keepalive() {
+	if c.pingInterval == 0 {
+		return
+	}
+	t := time.NewTicker(c.pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.write(websocket.PingFrame, nil); err != nil {
+				_ = c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readDeadline returns the time that the next frame must arrive by. Pongs count as frames.
+func (c *wsConn) readDeadline() time.Time {
+	if c.pingInterval == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.pingInterval + c.pongTimeout)
+}
+
+// read handles frames of the client until the connection is closed or the client misses a pong.
+// Frames are read one by one instead of with conn.Read, so pongs are seen too.
+func (c *wsConn) read() {
+	for {
+		err := c.conn.SetReadDeadline(c.readDeadline())
+		if err != nil {
+			return
+		}
+		frame, err := c.conn.NewFrameReader()
+		if err != nil {
+			return
+		}
+		// Pings are answered and control frames are consumed here.
+		frame, err = c.conn.HandleFrame(frame)
+		if err != nil {
+			return
+		}
+		if frame == nil {
+			continue
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(frame, maxWebsocketMessageSize+1))
+		if err != nil {
+			return
+		}
+		if _, err = io.Copy(ioutil.Discard, frame); err != nil {
+			return
+		}
+		onWebsocketRead()
+		if len(b) > maxWebsocketMessageSize {
+			c.sendError(errCodeInvalidRequest, errors.New("message is too large"), "")
+			continue
+		}
+		c.handle(b)
+	}
+}
+
+// close releases the sessions of the connection.
+func (c *wsConn) close() {
+	for token := range c.sessions {
+		c.unsubscribe(token)
+	}
+	c.queue.close()
+	close(c.done)
+}
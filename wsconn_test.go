@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+)
+
+// wsFrame holds the fields of both payment and error frames.
+type wsFrame struct {
+	Account string    `json:"account"`
+	Error   *APIError `json:"error"`
+	Token   string    `json:"token"`
+}
+
+func saveWebsocketPayment(t *testing.T, account string) string {
+	p := &Payment{Account: account, PaymentID: account, Balance: decimal.Zero, CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken("1", p.Account, p.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func receiveFrame(t *testing.T, ws *websocket.Conn) wsFrame {
+	t.Helper()
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var f wsFrame
+	if err := websocket.JSON.Receive(ws, &f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestWebsocketSubscriptions(t *testing.T) {
+	openTestDB(t, 0)
+	// Set before starting the server, so it is reset after handlers return.
+	config.WebsocketMaxSubscriptions = 2
+	t.Cleanup(func() { config.WebsocketMaxSubscriptions = 0 })
+	url := startWebsocketServer(t)
+	wsSessions = &wsSessionCache{}
+	first := saveWebsocketPayment(t, "nano_1first")
+	second := saveWebsocketPayment(t, "nano_1second")
+	third := saveWebsocketPayment(t, "nano_1third")
+	missing, err := NewToken("1", "nano_1missing", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := websocket.Dial(url+"?token="+first, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if f := receiveFrame(t, ws); f.Account != "nano_1first" {
+		t.Fatalf("state of query token is not sent: %+v", f)
+	}
+	send := func(cmd interface{}) {
+		if err := websocket.JSON.Send(ws, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectError := func(cmd interface{}, code, token string) {
+		t.Helper()
+		send(cmd)
+		if f := receiveFrame(t, ws); f.Error == nil || f.Error.Code != code || f.Token != token {
+			t.Fatalf("expected %s error, got %+v", code, f)
+		}
+	}
+	expectError(map[string]string{"hello": "world"}, errCodeInvalidRequest, "")
+	expectError(websocketCommand{Subscribe: "bad"}, errCodeTokenInvalid, "bad")
+	expectError(websocketCommand{Subscribe: missing}, errCodePaymentNotFound, missing)
+	send(websocketCommand{Subscribe: second})
+	if f := receiveFrame(t, ws); f.Account != "nano_1second" {
+		t.Fatalf("state of subscribed token is not sent: %+v", f)
+	}
+	expectError(websocketCommand{Subscribe: third}, errCodeSubscriptionLimit, third)
+
+	verifications.Publish(PaymentVerified{Payment: Payment{Account: "nano_1second", Revision: 1, Balance: decimal.Zero}})
+	if f := receiveFrame(t, ws); f.Account != "nano_1second" {
+		t.Fatalf("event of subscribed token is not sent: %+v", f)
+	}
+	send(websocketCommand{Unsubscribe: second})
+	waitFor(t, "unsubscribe", func() bool { return subscriptionsOf("nano_1second") == 0 })
+	verifications.Publish(PaymentVerified{Payment: Payment{Account: "nano_1second", Revision: 2, Balance: decimal.Zero}})
+	verifications.Publish(PaymentVerified{Payment: Payment{Account: "nano_1first", Revision: 1, Balance: decimal.Zero}})
+	if f := receiveFrame(t, ws); f.Account != "nano_1first" {
+		t.Fatalf("event of unsubscribed token is sent: %+v", f)
+	}
+}
+
+func TestWebsocketKeepalive(t *testing.T) {
+	openTestDB(t, 0)
+	config.WebsocketPingInterval = 20
+	config.WebsocketPongTimeout = 50
+	t.Cleanup(func() {
+		config.WebsocketPingInterval = 0
+		config.WebsocketPongTimeout = 0
+	})
+	url := startWebsocketServer(t)
+	wsSessions = &wsSessionCache{}
+	alive := saveWebsocketPayment(t, "nano_1alive")
+	silent := saveWebsocketPayment(t, "nano_1silent")
+
+	// Client answers pings while it is reading.
+	ws, err := websocket.Dial(url+"?token="+alive, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	receiveFrame(t, ws)
+	if err = ws.SetReadDeadline(time.Now().Add(300 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	var b []byte
+	err = websocket.Message.Receive(ws, &b)
+	if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+		t.Fatalf("connection answering pings is closed: %v", err)
+	}
+
+	// Client does not read, so pings are not answered.
+	ws2, err := websocket.Dial(url+"?token="+silent, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws2.Close()
+	waitFor(t, "subscription", func() bool { return subscriptionsOf("nano_1silent") == 1 })
+	waitFor(t, "silent connection to be closed", func() bool { return subscriptionsOf("nano_1silent") == 0 })
+	expectClosed(t, ws2)
+}
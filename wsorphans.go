@@ -0,0 +1,135 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Subscriptions of websocket sessions are cancelled when their connections close.
+// If a teardown is skipped, the subscription keeps a closure over a dead connection.
+// The sweep compares subscriptions with open connections and cancels the subscriptions of sessions
+// that are neither used by an open connection nor kept in the session cache.
+
+var metricOrphanSubscriptions = expvar.NewInt("orphan_subscriptions_reaped_total")
+
+// wsRegistry keeps the open websocket connections and the sessions by the owner ID of their subscriptions.
+type wsRegistry struct {
+	mu       sync.Mutex
+	seq      uint64
+	conns    map[uint64]io.Closer
+	sessions map[string]*wsSession
+}
+
+var websockets = &wsRegistry{conns: make(map[uint64]io.Closer), sessions: make(map[string]*wsSession)}
+
+// open registers a new connection and returns its ID.
+func (r *wsRegistry) open(conn io.Closer) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	r.conns[r.seq] = conn
+	return r.seq
+}
+
+func (r *wsRegistry) close(id uint64) {
+	r.mu.Lock()
+	delete(r.conns, id)
+	r.mu.Unlock()
+}
+
+// closeAll closes the open connections. Server.Shutdown does not wait for hijacked connections,
+// so they are closed at shutdown with a close frame instead of being dropped when the process exits.
+func (r *wsRegistry) closeAll() {
+	r.mu.Lock()
+	conns := make([]io.Closer, 0, len(r.conns))
+	for _, conn := range r.conns {
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	r.mu.Unlock()
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil {
+			log.Debugln("cannot close websocket:", err)
+		}
+	}
+}
+
+func (r *wsRegistry) isOpen(id uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.conns[id]
+	return ok
+}
+
+// addSession registers s and returns the owner ID for its subscription.
+func (r *wsRegistry) addSession(s *wsSession) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	owner := "session-" + strconv.FormatUint(r.seq, 10)
+	r.sessions[owner] = s
+	return owner
+}
+
+func (r *wsRegistry) removeSession(owner string) {
+	r.mu.Lock()
+	delete(r.sessions, owner)
+	r.mu.Unlock()
+}
+
+func (r *wsRegistry) session(owner string) (*wsSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[owner]
+	return s, ok
+}
+
+func (r *wsRegistry) counts() (conns, sessions int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns), len(r.sessions)
+}
+
+// WebsocketDebugStats is the websocket part of DebugStats.
+type WebsocketDebugStats struct {
+	Connections   int   `json:"connections"`
+	Sessions      int   `json:"sessions"`
+	Subscriptions int   `json:"subscriptions"`
+	OrphansReaped int64 `json:"orphansReaped"`
+}
+
+func websocketDebugStats() WebsocketDebugStats {
+	conns, sessions := websockets.counts()
+	return WebsocketDebugStats{
+		Connections:   conns,
+		Sessions:      sessions,
+		Subscriptions: verifications.Len(),
+		OrphansReaped: metricOrphanSubscriptions.Value(),
+	}
+}
+
+// reapOrphanSubscriptions cancels the subscriptions of sessions that are not used at now and returns their number.
+// Sessions idle for less than grace are kept, so a session is not reaped while its first connection is attached.
+func reapOrphanSubscriptions(now time.Time, grace time.Duration) int {
+	var reaped int
+	for _, owner := range verifications.Owners() {
+		s, ok := websockets.session(owner)
+		if ok && s.live(now, grace) {
+			continue
+		}
+		n := verifications.CancelOwner(owner)
+		websockets.removeSession(owner)
+		log.Warningf("cancelled %d orphan subscriptions of websocket %s", n, owner)
+		reaped += n
+	}
+	if reaped > 0 {
+		metricOrphanSubscriptions.Add(int64(reaped))
+	}
+	return reaped
+}
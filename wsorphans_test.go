@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func subscriptionsOf(account Account) int {
+	verifications.m.RLock()
+	defer verifications.m.RUnlock()
+	return len(verifications.subscribers[account])
+}
+
+func TestSubscriberPanic(t *testing.T) {
+	var hub Hub
+	hub.SubscribeOwner("nano_1panic", "broken", func(e Event) { panic("broken subscriber") })
+	received := make(chan struct{}, 1)
+	hub.Subscribe("nano_1panic", func(e Event) { received <- struct{}{} })
+	hub.Publish(PaymentVerified{Payment: Payment{Account: "nano_1panic"}})
+	select {
+	case <-received:
+	default:
+		t.Fatal("event is not delivered to other subscribers")
+	}
+	if n := hub.Len(); n != 1 || len(hub.Owners()) != 0 {
+		t.Fatalf("panicking subscription is not removed: %d", n)
+	}
+}
+
+func TestWebsocketPanicInReadLoop(t *testing.T) {
+	openTestDB(t, 0)
+	url := startWebsocketServer(t)
+	token := saveSessionPayment(t)
+	onWebsocketRead = func() { panic("read loop") }
+	t.Cleanup(func() { onWebsocketRead = func() {} })
+
+	ws, err := websocket.Dial(url+"?token="+token, "", testWebsocketOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	waitFor(t, "subscription", func() bool { return subscriptionsOf("nano_1session") == 1 })
+	if _, err = ws.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, ws)
+	waitFor(t, "subscription to be cancelled", func() bool { return subscriptionsOf("nano_1session") == 0 })
+}
+
+func TestReapOrphanSubscriptions(t *testing.T) {
+	openTestDB(t, 0)
+	config.setDefaults()
+	config.Seed = "seed"
+	token := saveSessionPayment(t)
+	claims, err := ParseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sessions left by other tests.
+	reapOrphanSubscriptions(clock.Now(), 0)
+	reapedBefore := metricOrphanSubscriptions.Value()
+
+	// Connection of the orphan is closed without releasing the session.
+	orphan := newWSSession(token, claims)
+	closed := newWSQueue(wsClassPayment, 1, nil)
+	closed.conn = websockets.open(nil)
+	orphan.attach(closed)
+	websockets.close(closed.conn)
+	used := newWSSession(token, claims)
+	open := newWSQueue(wsClassPayment, 1, nil)
+	open.conn = websockets.open(nil)
+	used.attach(open)
+	t.Cleanup(func() {
+		used.cancel()
+		websockets.close(open.conn)
+	})
+
+	if n := reapOrphanSubscriptions(clock.Now(), 0); n != 1 || metricOrphanSubscriptions.Value() != reapedBefore+1 {
+		t.Fatalf("%d subscriptions reaped", n)
+	}
+	if owners := verifications.Owners(); len(owners) != 1 || owners[0] != used.owner {
+		t.Fatalf("unexpected subscriptions left: %v", owners)
+	}
+	if stats := websocketDebugStats(); stats.Sessions != 1 || stats.OrphansReaped != reapedBefore+1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Connection classes for websocket metrics.
+const (
+	wsClassPayment = "payment"
+	// Server-Sent Events streams of /api/events.
+	wsClassEvents = "events"
+)
+
+var (
+	metricWebsocketCoalesced = expvar.NewMap("websocket_events_coalesced_total")
+	metricWebsocketDropped   = expvar.NewMap("websocket_events_dropped_total")
+)
+
+// wsResyncMessage is sent when queued events are dropped because the client cannot keep up.
+// Client must fetch the current state of its payments from /api/verify.
+var wsResyncMessage = []byte(`{"resync":true}`)
+
+// wsQueue buffers outgoing messages of a websocket connection so publishers never wait for slow clients.
+// Messages are full snapshots of a payment, so only the latest message for each account is kept.
+// Messages are written by a single goroutine in batches.
+type wsQueue struct {
+	class string
+	// ID of the connection in websockets registry.
+	conn  uint64
+	limit int
+	// write sends a single frame.
+	write func(b []byte) error
+
+	mu      sync.Mutex
+	pending map[Account][]byte
+	order   []Account
+	resync  bool
+	closed  bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newWSQueue(class string, limit int, write func(b []byte) error) *wsQueue {
+	return &wsQueue{
+		class:   class,
+		limit:   limit,
+		write:   write,
+		pending: make(map[Account][]byte),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// push queues the message for account, replacing the queued message of the same account.
+// If the queue is full all queued messages are dropped and a resync message is sent instead.
+func (q *wsQueue) push(account Account, b []byte) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	switch _, ok := q.pending[account]; {
+	case q.resync:
+		// Client fetches the current state after resync anyway.
+		metricWebsocketDropped.Add(q.class, 1)
+	case ok:
+		metricWebsocketCoalesced.Add(q.class, 1)
+		q.pending[account] = b
+	case len(q.order) >= q.limit:
+		metricWebsocketDropped.Add(q.class, int64(len(q.order)+1))
+		q.pending = make(map[Account][]byte)
+		q.order = nil
+		q.resync = true
+	default:
+		q.order = append(q.order, account)
+		q.pending[account] = b
+	}
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns queued messages in order and empties the queue.
+func (q *wsQueue) take() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var batch [][]byte
+	if q.resync {
+		batch = append(batch, wsResyncMessage)
+		q.resync = false
+	}
+	for _, account := range q.order {
+		batch = append(batch, q.pending[account])
+	}
+	q.pending = make(map[Account][]byte)
+	q.order = nil
+	return batch
+}
+
+// run writes queued messages until close is called or a write fails.
+func (q *wsQueue) run() {
+	for {
+		select {
+		case <-q.wake:
+			for _, b := range q.take() {
+				if err := q.write(b); err != nil {
+					q.close()
+					return
+				}
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+func (q *wsQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWSQueueCoalesce(t *testing.T) {
+	q := newWSQueue(wsClassPayment, 10, nil)
+	q.push("a", []byte("a1"))
+	q.push("b", []byte("b1"))
+	q.push("a", []byte("a2"))
+	batch := q.take()
+	if len(batch) != 2 || string(batch[0]) != "a2" || string(batch[1]) != "b1" {
+		t.Fatalf("unexpected batch: %q", batch)
+	}
+	if len(q.take()) != 0 {
+		t.Fatal("queue is not emptied")
+	}
+}
+
+func TestWSQueueOverflow(t *testing.T) {
+	q := newWSQueue(wsClassPayment, 2, nil)
+	q.push("a", []byte("a"))
+	q.push("b", []byte("b"))
+	q.push("c", []byte("c"))
+	q.push("d", []byte("d"))
+	batch := q.take()
+	if len(batch) != 1 || string(batch[0]) != string(wsResyncMessage) {
+		t.Fatalf("expected only resync message, got %q", batch)
+	}
+	q.push("e", []byte("e"))
+	batch = q.take()
+	if len(batch) != 1 || string(batch[0]) != "e" {
+		t.Fatalf("queue is not usable after resync: %q", batch)
+	}
+}
+
+func TestWSQueueWriteError(t *testing.T) {
+	q := newWSQueue(wsClassPayment, 10, func(b []byte) error { return fmt.Errorf("broken pipe") })
+	done := make(chan struct{})
+	go func() {
+		q.run()
+		close(done)
+	}()
+	q.push("a", []byte("a"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not stop after error")
+	}
+	q.push("b", []byte("b"))
+}
+
+// BenchmarkWSQueueSlowClient publishes events to a slow client subscribed to many accounts
+// and measures how long a fast client waits for its events.
+func BenchmarkWSQueueSlowClient(b *testing.B) {
+	const events = 10000
+	const accounts = 100
+	for i := 0; i < b.N; i++ {
+		var hub Hub
+		slow := newWSQueue(wsClassPayment, 50, func(b []byte) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+		go slow.run()
+		for a := 0; a < accounts; a++ {
+			hub.Subscribe(Account(fmt.Sprint(a)), func(e Event) { slow.push(e.Account(), []byte("snapshot")) })
+		}
+		var mu sync.Mutex
+		var maxLatency time.Duration
+		var wg sync.WaitGroup
+		fast := newWSQueue(wsClassPayment, 50, func(b []byte) error {
+			sent, _ := time.Parse(time.RFC3339Nano, string(b))
+			mu.Lock()
+			if d := time.Since(sent); d > maxLatency {
+				maxLatency = d
+			}
+			mu.Unlock()
+			wg.Done()
+			return nil
+		})
+		go fast.run()
+		hub.Subscribe("fast", func(e Event) { fast.push(e.Account(), []byte(time.Now().Format(time.RFC3339Nano))) })
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for n := 0; n < events; n++ {
+			hub.Publish(PaymentVerified{Payment: Payment{Account: fmt.Sprint(n % accounts)}})
+			if n%100 == 0 {
+				wg.Add(1)
+				hub.Publish(PaymentVerified{Payment: Payment{Account: "fast"}})
+				// Wait so fast events are not coalesced.
+				wg.Wait()
+			}
+		}
+		runtime.ReadMemStats(&after)
+		slow.close()
+		fast.close()
+		b.ReportMetric(float64(maxLatency.Microseconds()), "max-fast-latency-us")
+		b.ReportMetric(float64(after.HeapInuse)-float64(before.HeapInuse), "heap-growth-bytes")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Websocket sessions are kept for WebsocketSessionTTL after a client disconnects,
+// so a client reconnecting with the same token does not parse the token or load the payment again.
+// A session stays subscribed while it is cached and stores the latest message for the token.
+// Messages are full snapshots, so the latest message covers all events since the sequence number
+// that the client passes in "since" query parameter when reconnecting.
+
+var metricWebsocketSessions = expvar.NewMap("websocket_session_cache_total")
+
+// wsSession is the state of a websocket token shared by its connections.
+type wsSession struct {
+	token  string
+	claims *MyCustomClaims
+	// Owner ID of the subscription in websockets registry.
+	owner  string
+	cancel func()
+
+	mu sync.Mutex
+	// Sequence number of the latest message.
+	seq uint64
+	// Revision of the payment in the latest message.
+	revision uint64
+	snapshot []byte
+	queues   map[*wsQueue]struct{}
+	idleAt   time.Time
+	element  *list.Element
+	// Time the session is cached.
+	createdAt time.Time
+}
+
+func newWSSession(token string, claims *MyCustomClaims) *wsSession {
+	s := &wsSession{
+		token:     token,
+		claims:    claims,
+		queues:    make(map[*wsQueue]struct{}),
+		idleAt:    clock.Now(),
+		createdAt: clock.Now(),
+	}
+	s.owner = websockets.addSession(s)
+	cancel := verifications.SubscribeOwner(Account(claims.Account), s.owner, s.publish)
+	s.cancel = func() {
+		cancel()
+		websockets.removeSession(s.owner)
+	}
+	return s
+}
+
+func (s *wsSession) publish(e Event) {
+	// Other events are for admin use.
+	var p Payment
+	var summary *FinancialSummary
+	switch e := e.(type) {
+	case PaymentVerified:
+		p = e.Payment
+	case PaymentLate:
+		p = e.Payment
+	case PaymentCancelled:
+		p = e.Payment
+	case PaymentPartiallyPaid:
+		p = e.Payment
+	case PaymentPendingConfirmation:
+		p = e.Payment
+	case PaymentExpired:
+		p = e.Payment
+	case PaymentFinal:
+		p, summary = e.Payment, e.Summary
+	default:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Events are published from their own goroutines and may arrive out of order.
+	if p.Revision < s.revision {
+		return
+	}
+	s.revision = p.Revision
+	s.seq++
+	b, err := s.message(&p, summary)
+	if err != nil {
+		return
+	}
+	s.snapshot = b
+	for q := range s.queues {
+		q.push(e.Account(), b)
+	}
+}
+
+// message returns the websocket message for p with the current sequence number.
+func (s *wsSession) message(p *Payment, summary *FinancialSummary) ([]byte, error) {
+	response := NewResponse(p, s.token)
+	response.Seq = s.seq
+	response.Summary = summary
+	return json.Marshal(&response)
+}
+
+// resume queues the latest message to q if the client has not seen it.
+// The payment is loaded from database if there is no message since the session is created.
+// Nothing is sent if since is the sequence number of the latest message.
+func (s *wsSession) resume(q *wsQueue, since string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seen, err := strconv.ParseUint(since, 10, 64); err == nil && s.seq > 0 && seen == s.seq {
+		return nil
+	}
+	if s.snapshot == nil {
+		p, err := LoadPayment([]byte(s.claims.Account))
+		if err == nil && !p.visibleTo(nil, s.claims) {
+			err = errPaymentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		s.snapshot, err = s.message(p, nil)
+		if err != nil {
+			return err
+		}
+		s.revision = p.Revision
+	}
+	q.push(Account(s.claims.Account), s.snapshot)
+	return nil
+}
+
+// idle returns true if no connection is using the session for ttl.
+func (s *wsSession) idle(now time.Time, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queues) == 0 && now.Sub(s.idleAt) >= ttl
+}
+
+// live returns true if the session is used by an open connection, kept in the cache or idle for less than grace.
+// Queues of closed connections that are left attached are detached.
+func (s *wsSession) live(now time.Time, grace time.Duration) bool {
+	s.mu.Lock()
+	for q := range s.queues {
+		if !websockets.isOpen(q.conn) {
+			delete(s.queues, q)
+			s.idleAt = now
+		}
+	}
+	used := len(s.queues) > 0 || now.Sub(s.idleAt) < grace
+	s.mu.Unlock()
+	return used || wsSessions.cached(s)
+}
+
+func (s *wsSession) attach(q *wsQueue) {
+	s.mu.Lock()
+	s.queues[q] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *wsSession) detach(q *wsQueue) {
+	s.mu.Lock()
+	delete(s.queues, q)
+	s.idleAt = clock.Now()
+	s.mu.Unlock()
+}
+
+// wsSessionCache keeps sessions by token with LRU eviction.
+type wsSessionCache struct {
+	mu       sync.Mutex
+	sessions map[string]*wsSession
+	// Front is the most recently used.
+	lru *list.List
+}
+
+var wsSessions = &wsSessionCache{}
+
+func (c *wsSessionCache) enabled() bool { return config.WebsocketSessionTTL > 0 }
+
+func (c *wsSessionCache) ttl() time.Duration {
+	return time.Duration(config.WebsocketSessionTTL) * time.Second
+}
+
+// acquire returns the session for token with q attached, creating a new session if it is not cached.
+func (c *wsSessionCache) acquire(token string, q *wsQueue) (*wsSession, error) {
+	if !c.enabled() {
+		claims, err := ParseToken(token)
+		if err != nil {
+			return nil, err
+		}
+		s := newWSSession(token, claims)
+		s.attach(q)
+		return s, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		c.sessions = make(map[string]*wsSession)
+		c.lru = list.New()
+	}
+	c.prune(clock.Now())
+	if s, ok := c.sessions[token]; ok {
+		// Tokens signed with rotated keys expire.
+		if s.claims.Valid() == nil {
+			metricWebsocketSessions.Add("hit", 1)
+			sessionCacheStats.hit(clock.Now().Sub(s.createdAt))
+			c.lru.MoveToFront(s.element)
+			s.attach(q)
+			return s, nil
+		}
+		c.remove(s)
+	}
+	metricWebsocketSessions.Add("miss", 1)
+	sessionCacheStats.miss()
+	claims, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	s := newWSSession(token, claims)
+	s.attach(q)
+	s.element = c.lru.PushFront(s)
+	c.sessions[token] = s
+	c.evict()
+	return s, nil
+}
+
+func (c *wsSessionCache) cached(s *wsSession) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessions[s.token] == s
+}
+
+// release detaches q from the session. The session is closed if sessions are not cached.
+func (c *wsSessionCache) release(s *wsSession, q *wsQueue) {
+	s.detach(q)
+	if !c.enabled() {
+		s.cancel()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions[s.token] == s {
+		c.lru.MoveToFront(s.element)
+	}
+}
+
+// prune removes sessions that are idle for longer than ttl.
+// Idle sessions are ordered by the time they are released, so pruning stops at the first idle session that is not expired.
+func (c *wsSessionCache) prune(now time.Time) {
+	ttl := c.ttl()
+	for e := c.lru.Back(); e != nil; {
+		s := e.Value.(*wsSession)
+		e = e.Prev()
+		switch {
+		case s.idle(now, ttl):
+			c.remove(s)
+		case s.idle(now, 0):
+			return
+		}
+	}
+}
+
+// evict removes the least recently used idle sessions until the cache fits WebsocketSessionCacheSize.
+// Sessions with connections are not evicted.
+func (c *wsSessionCache) evict() {
+	for e := c.lru.Back(); e != nil && len(c.sessions) > config.WebsocketSessionCacheSize; {
+		s := e.Value.(*wsSession)
+		e = e.Prev()
+		if s.idle(clock.Now(), 0) {
+			metricWebsocketSessions.Add("evicted", 1)
+			c.remove(s)
+		}
+	}
+}
+
+func (c *wsSessionCache) remove(s *wsSession) {
+	sessionCacheStats.invalidate()
+	s.cancel()
+	c.lru.Remove(s.element)
+	delete(c.sessions, s.token)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/net/websocket"
+)
+
+// saveSessionPayment saves a payment and returns its token.
+func saveSessionPayment(t testing.TB) string {
+	wsSessions = &wsSessionCache{}
+	p := &Payment{Account: "nano_1session", PaymentID: "session", Balance: decimal.Zero, CreatedAt: clock.Now()}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken("1", p.Account, p.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func receiveResponse(t testing.TB, ws *websocket.Conn) Response {
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var resp Response
+	if err := websocket.JSON.Receive(ws, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestWebsocketSessionResume(t *testing.T) {
+	openTestDB(t, 0)
+	// Set before starting the server, so it is reset after handlers return.
+	config.WebsocketSessionTTL = 60
+	t.Cleanup(func() { config.WebsocketSessionTTL = 0 })
+	url := startWebsocketServer(t)
+	token := saveSessionPayment(t)
+	hits := func() int64 {
+		if v, ok := metricWebsocketSessions.Get("hit").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	dial := func(since string) *websocket.Conn {
+		ws, err := websocket.Dial(url+"?since="+since+"&token="+token, "", testWebsocketOrigin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+
+	// First connection loads the snapshot from database.
+	ws := dial("0")
+	if resp := receiveResponse(t, ws); resp.Account != "nano_1session" || resp.Seq != 0 {
+		t.Fatalf("unexpected snapshot: %+v", resp)
+	}
+	verifications.Publish(PaymentVerified{Payment: Payment{Account: "nano_1session", Revision: 2, Balance: decimal.NewFromInt(1)}})
+	if resp := receiveResponse(t, ws); resp.Seq != 1 {
+		t.Fatalf("unexpected event: %+v", resp)
+	}
+	ws.Close()
+
+	// Event is stored while the client is disconnected.
+	verifications.Publish(PaymentVerified{Payment: Payment{Account: "nano_1session", Revision: 3, Balance: decimal.NewFromInt(2)}})
+	before := hits()
+	ws = dial("1")
+	defer ws.Close()
+	resp := receiveResponse(t, ws)
+	if resp.Seq != 2 || !resp.Balance.Equal(RawToNano(decimal.NewFromInt(2))) {
+		t.Fatalf("missed event is not sent: %+v", resp)
+	}
+	if hits() != before+1 {
+		t.Fatal("session is not served from cache")
+	}
+}
+
+func TestWebsocketSessionEviction(t *testing.T) {
+	config.setDefaults()
+	config.Seed = "seed"
+	config.WebsocketSessionTTL = 60
+	config.WebsocketSessionCacheSize = 2
+	t.Cleanup(func() {
+		config.WebsocketSessionTTL = 0
+		config.WebsocketSessionCacheSize = 0
+	})
+	c := useFakeClock(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache := &wsSessionCache{}
+	acquire := func(account string) (*wsSession, *wsQueue) {
+		token, err := NewToken("1", account, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := newWSQueue(wsClassPayment, 1, nil)
+		s, err := cache.acquire(token, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, q
+	}
+	a, qa := acquire("nano_1a")
+	b, qb := acquire("nano_1b")
+	x, qx := acquire("nano_1c")
+	if len(cache.sessions) != 3 {
+		t.Fatal("connected session is evicted")
+	}
+	for _, s := range []struct {
+		session *wsSession
+		queue   *wsQueue
+	}{{a, qa}, {b, qb}, {x, qx}} {
+		cache.release(s.session, s.queue)
+		c.Add(time.Second)
+	}
+	d, _ := acquire("nano_1d")
+	if len(cache.sessions) != 2 || cache.sessions[x.token] == nil {
+		t.Fatal("least recently used sessions are not evicted")
+	}
+
+	config.WebsocketSessionCacheSize = 100
+	c.Add(time.Minute)
+	acquire("nano_1e")
+	if cache.sessions[x.token] != nil || cache.sessions[d.token] == nil {
+		t.Fatal("expired session is not removed")
+	}
+}
+
+// BenchmarkWebsocketReconnect measures a client reconnecting with the same token and asking for the latest state.
+func BenchmarkWebsocketReconnect(b *testing.B) {
+	for _, ttl := range []int{0, 60} {
+		name := "no cache"
+		if ttl > 0 {
+			name = "cache"
+		}
+		b.Run(name, func(b *testing.B) {
+			openTestDB(b, 0)
+			url := startWebsocketServer(b)
+			token := saveSessionPayment(b)
+			config.WebsocketSessionTTL = ttl
+			defer func() { config.WebsocketSessionTTL = 0 }()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ws, err := websocket.Dial(url+"?since=0&token="+token, "", testWebsocketOrigin)
+				if err != nil {
+					b.Fatal(err)
+				}
+				receiveResponse(b, ws)
+				ws.Close()
+			}
+		})
+	}
+}